@@ -8,10 +8,60 @@ const (
 	RouteRoot = "/"
 	// RouteLogin is the login page route
 	RouteLogin = "/_login"
+	// RouteMagicLink signs in with a link sent by Herald
+	RouteMagicLink = "/_login/magic"
+	// RouteQRLogin starts a cross-device QR login
+	RouteQRLogin = "/_login/qr"
+	// RouteQRLoginStatus is polled by the device showing the QR code
+	RouteQRLoginStatus = "/_login/qr/status"
+	// RouteQRLoginApprove is where a signed-in phone approves a QR login
+	RouteQRLoginApprove = "/_login/qr/approve"
 	// RouteLogout is the logout route
 	RouteLogout = "/_logout"
+	// RouteOIDCLogin starts a login with the upstream OpenID Connect provider
+	RouteOIDCLogin = "/_oidc/login"
+	// RouteOIDCCallback is the OpenID Connect redirect URI
+	RouteOIDCCallback = "/_oidc/callback"
+	// RouteIDPDiscovery is the OpenID Connect provider discovery document
+	RouteIDPDiscovery = "/.well-known/openid-configuration"
+	// RouteIDPAuthorize is the OpenID Connect provider authorization endpoint
+	RouteIDPAuthorize = "/authorize"
+	// RouteIDPToken is the OpenID Connect provider token endpoint
+	RouteIDPToken = "/token"
+	// RouteIDPUserInfo is the OpenID Connect provider userinfo endpoint
+	RouteIDPUserInfo = "/userinfo"
+	// RouteIDPJWKS publishes the OpenID Connect provider signing keys
+	RouteIDPJWKS = "/jwks.json"
+	// RouteJWKS publishes the signing keys of the identity JWT forwarded by /_auth
+	RouteJWKS = "/.well-known/jwks.json"
+	// RouteAPITokens is the personal access token page and creation endpoint
+	RouteAPITokens = "/_tokens"
+	// RouteAPITokensRevoke revokes a personal access token
+	RouteAPITokensRevoke = "/_tokens/revoke"
+	// RoutePasskeys is the passkey management page
+	RoutePasskeys = "/_passkeys"
+	// RoutePasskeyRegisterOptions starts the registration of a passkey
+	RoutePasskeyRegisterOptions = "/_passkeys/register/options"
+	// RoutePasskeyRegister stores a new passkey
+	RoutePasskeyRegister = "/_passkeys/register"
+	// RoutePasskeyRemove removes a passkey
+	RoutePasskeyRemove = "/_passkeys/remove"
+	// RoutePasskeyLoginOptions starts a passkey login
+	RoutePasskeyLoginOptions = "/_passkeys/login/options"
+	// RoutePasskeyLogin signs in with a passkey
+	RoutePasskeyLogin = "/_passkeys/login"
+	// RouteSessions is the session management page
+	RouteSessions = "/_sessions"
+	// RouteSessionRevoke signs out one of the user's sessions
+	RouteSessionRevoke = "/_sessions/revoke"
+	// RouteSessionRevokeOthers signs out every session of the user but the current one
+	RouteSessionRevokeOthers = "/_sessions/revoke_others"
+	// RouteStepUpPasskeyOptions starts a step-up with a passkey
+	RouteStepUpPasskeyOptions = "/_step_up/passkey/options"
 	// RouteSessionExchange is the session exchange route
 	RouteSessionExchange = "/_session_exchange"
+	// RouteStepUp is the step-up (re-authentication) route
+	RouteStepUp = "/_step_up"
 	// RouteAuth is the authentication check route
 	RouteAuth = "/_auth"
 	// RouteHealth is the health check route
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/passhash"
+	"golang.org/x/term"
+)
+
+// hashPasswordCommand is the subcommand that prints a password hash for PASSWORDS or USERS.
+const hashPasswordCommand = "hash-password"
+
+// runHashPassword implements "stargate hash-password [-algorithm argon2id] [-user name]
+// [-case-sensitive]". The password is read from the terminal without echo, or from the first line
+// of stdin when piped. Without -user it prints "algorithm:hash" for PASSWORDS, hashing the password
+// in the normalized form PASSWORDS are checked in unless -case-sensitive is given (for
+// PASSWORD_CASE_SENSITIVE); with -user it prints "name:hash" for USERS or USERS_FILE, always
+// hashing the password as typed. Returns the exit code.
+func runHashPassword(args []string, stdin *os.File, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet(hashPasswordCommand, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	algorithm := flags.String("algorithm", passhash.Argon2id, "hash algorithm: "+strings.Join(passhash.Algorithms, ", "))
+	user := flags.String("user", "", "print a USERS entry for this user name instead of a PASSWORDS value")
+	caseSensitive := flags.Bool("case-sensitive", false, "hash the password as typed, for PASSWORD_CASE_SENSITIVE=true")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if !slices.Contains(passhash.Algorithms, *algorithm) {
+		_, _ = fmt.Fprintf(stderr, "unsupported algorithm %q, use one of: %s\n", *algorithm, strings.Join(passhash.Algorithms, ", "))
+		return 2
+	}
+	if strings.ContainsAny(*user, ": \t|") {
+		_, _ = fmt.Fprintln(stderr, "user name must not contain ':', '|' or spaces")
+		return 2
+	}
+
+	password, err := readPassword(stdin, stderr)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if *user == "" && !*caseSensitive {
+		password = auth.NormalizePassword(password)
+	}
+
+	hash, err := passhash.Hash(*algorithm, password)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if *user != "" {
+		_, _ = fmt.Fprintf(stdout, "%s:%s\n", *user, hash)
+	} else {
+		_, _ = fmt.Fprintf(stdout, "%s:%s\n", *algorithm, hash)
+	}
+	return 0
+}
+
+// readPassword prompts for the password twice on a terminal, or reads one line from a pipe.
+func readPassword(stdin *os.File, prompt io.Writer) (string, error) {
+	if fd := int(stdin.Fd()); term.IsTerminal(fd) {
+		_, _ = fmt.Fprint(prompt, "Password: ")
+		first, err := term.ReadPassword(fd)
+		_, _ = fmt.Fprintln(prompt)
+		if err != nil {
+			return "", err
+		}
+		_, _ = fmt.Fprint(prompt, "Confirm password: ")
+		second, err := term.ReadPassword(fd)
+		_, _ = fmt.Fprintln(prompt)
+		if err != nil {
+			return "", err
+		}
+		if string(first) != string(second) {
+			return "", errors.New("passwords do not match")
+		}
+		return checkPassword(string(first))
+	}
+
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return checkPassword(strings.TrimRight(line, "\r\n"))
+}
+
+// checkPassword rejects passwords that could never be typed at the login page.
+func checkPassword(password string) (string, error) {
+	if strings.TrimSpace(password) == "" {
+		return "", errors.New("password must not be empty")
+	}
+	return password, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/soulteary/stargate/src/internal/passhash"
+)
+
+// pipedStdin returns a pipe reading input, standing in for a non-terminal stdin.
+func pipedStdin(t *testing.T, input string) *os.File {
+	t.Helper()
+	r, w, err := os.Pipe()
+	testza.AssertNoError(t, err)
+	_, err = w.WriteString(input)
+	testza.AssertNoError(t, err)
+	testza.AssertNoError(t, w.Close())
+	t.Cleanup(func() { _ = r.Close() })
+	return r
+}
+
+func TestRunHashPassword(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := runHashPassword([]string{"-algorithm", passhash.PBKDF2SHA256}, pipedStdin(t, "hunter 2\n"), &stdout, &stderr)
+	testza.AssertEqual(t, 0, code, stderr.String())
+
+	// A PASSWORDS value, hashed in the normalized form passwords are checked in
+	algorithm, hash, ok := strings.Cut(strings.TrimSpace(stdout.String()), ":")
+	testza.AssertTrue(t, ok)
+	testza.AssertEqual(t, passhash.PBKDF2SHA256, algorithm)
+	testza.AssertTrue(t, passhash.Check(algorithm, hash, "HUNTER2"))
+}
+
+func TestRunHashPassword_CaseSensitive(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := runHashPassword([]string{"-algorithm", passhash.PBKDF2SHA256, "-case-sensitive"}, pipedStdin(t, "Hunter 2\n"), &stdout, &stderr)
+	testza.AssertEqual(t, 0, code, stderr.String())
+
+	_, hash, _ := strings.Cut(strings.TrimSpace(stdout.String()), ":")
+	testza.AssertTrue(t, passhash.Check(passhash.PBKDF2SHA256, hash, "Hunter 2"))
+	testza.AssertFalse(t, passhash.Check(passhash.PBKDF2SHA256, hash, "HUNTER2"))
+}
+
+func TestRunHashPassword_User(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := runHashPassword([]string{"-algorithm", passhash.PBKDF2SHA256, "-user", "alice"}, pipedStdin(t, "Hunter 2"), &stdout, &stderr)
+	testza.AssertEqual(t, 0, code, stderr.String())
+
+	name, hash, ok := strings.Cut(strings.TrimSpace(stdout.String()), ":")
+	testza.AssertTrue(t, ok)
+	testza.AssertEqual(t, "alice", name)
+	testza.AssertTrue(t, passhash.Check(passhash.PBKDF2SHA256, hash, "Hunter 2"))
+}
+
+func TestRunHashPassword_Invalid(t *testing.T) {
+	for name, args := range map[string][]string{
+		"unknown algorithm": {"-algorithm", "md5"},
+		"bad user name":     {"-user", "al ice"},
+		"unknown flag":      {"-cost", "12"},
+	} {
+		var stdout, stderr bytes.Buffer
+		testza.AssertEqual(t, 2, runHashPassword(args, pipedStdin(t, "secret\n"), &stdout, &stderr), name)
+		testza.AssertEqual(t, "", stdout.String(), name)
+	}
+
+	var stdout, stderr bytes.Buffer
+	testza.AssertEqual(t, 1, runHashPassword(nil, pipedStdin(t, "  \n"), &stdout, &stderr), "empty password")
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/pterm/pterm"
 	"github.com/pterm/pterm/putils"
 	logger "github.com/soulteary/logger-kit"
+	"github.com/soulteary/stargate/src/internal/auditlog"
 	"github.com/soulteary/stargate/src/internal/auth"
 	"github.com/soulteary/stargate/src/internal/config"
 	"github.com/soulteary/tracing-kit"
@@ -80,6 +81,11 @@ func runApplication() error {
 			}
 		}
 
+		// Flush pending audit records and close sinks
+		if err := auditlog.Stop(); err != nil {
+			log.Error().Err(err).Msg("Failed to stop audit log")
+		}
+
 		log.Info().Msg("Stargate service stopped")
 	}
 
@@ -109,6 +115,10 @@ func runApplicationWithApp(app *fiber.App) error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == hashPasswordCommand {
+		os.Exit(runHashPassword(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
 	// Use runApplication to handle all initialization and server startup
 	// This allows the same logic to be tested via runApplication()
 	if err := runApplication(); err != nil {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -14,18 +15,32 @@ import (
 	"github.com/gofiber/fiber/v2/utils"
 	"github.com/gofiber/template/html"
 	"github.com/redis/go-redis/v9"
+	audit "github.com/soulteary/audit-kit"
 	health "github.com/soulteary/health-kit"
 	i18nkit "github.com/soulteary/i18n-kit"
 	logger "github.com/soulteary/logger-kit"
 	metricskit "github.com/soulteary/metrics-kit"
 	middlewarekit "github.com/soulteary/middleware-kit"
 	session "github.com/soulteary/session-kit"
+	"github.com/soulteary/stargate/src/internal/apitoken"
+	"github.com/soulteary/stargate/src/internal/auditlog"
 	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/bearerjwt"
 	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/filestore"
 	"github.com/soulteary/stargate/src/internal/handlers"
 	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/idp"
+	"github.com/soulteary/stargate/src/internal/keyring"
 	"github.com/soulteary/stargate/src/internal/metrics"
+	"github.com/soulteary/stargate/src/internal/oidc"
+	"github.com/soulteary/stargate/src/internal/policy"
+	"github.com/soulteary/stargate/src/internal/ratelimit"
+	"github.com/soulteary/stargate/src/internal/sessionindex"
+	"github.com/soulteary/stargate/src/internal/totpstore"
 	internal_tracing "github.com/soulteary/stargate/src/internal/tracing"
+	"github.com/soulteary/stargate/src/internal/users"
+	"github.com/soulteary/stargate/src/internal/webauthn"
 )
 
 // findFirstExistingPath returns the first path in candidates that exists, or defaultPath if none exist.
@@ -69,7 +84,7 @@ func setupSessionStore() (*fibersession.Store, *redis.Client) {
 
 	// Create session-kit config with Stargate settings
 	sessionConfig := session.DefaultConfig().
-		WithExpiration(config.SessionExpiration).
+		WithExpiration(config.SessionLifetime()).
 		WithCookieName(auth.SessionCookieName).
 		WithCookiePath("/").
 		WithHTTPOnly(true).
@@ -135,6 +150,293 @@ func setupSessionStore() (*fibersession.Store, *redis.Client) {
 	return fibersession.New(fiberConfig), redisClient
 }
 
+// setupAuditLog initializes the audit logger with the sinks configured via AUDIT_LOG_SINKS.
+// The redis sink reuses the session Redis client, so it requires SESSION_STORAGE_ENABLED=true.
+func setupAuditLog(redisClient *redis.Client) {
+	log.Debug().Msg("Initializing audit log")
+
+	storage, err := auditlog.NewStorageFromConfig(redisClient)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to initialize audit log storage")
+	}
+	auditlog.Init(storage, audit.DefaultConfig())
+
+	log.Info().
+		Bool("enabled", config.AuditLogEnabled.ToBool()).
+		Strs("sinks", config.AuditLogSinks.ToList()).
+		Str("format", config.AuditLogFormat.String()).
+		Msg("Audit log configured")
+}
+
+// setupRateLimiter initializes login and code send rate limiting from RATE_LIMIT_* settings.
+// Counters are shared through the session Redis client when SESSION_STORAGE_ENABLED=true.
+func setupRateLimiter(redisClient *redis.Client) {
+	limiter := ratelimit.NewFromConfig(redisClient)
+	ratelimit.Init(limiter)
+	if limiter == nil {
+		log.Info().Msg("Rate limiting is disabled")
+		return
+	}
+
+	log.Info().
+		Bool("shared", config.SessionStorageEnabled.ToBool() && redisClient != nil).
+		Int("max_failures", config.RateLimitMaxFailures.ToInt()).
+		Int("ip_max_failures", config.RateLimitIPMaxFailures.ToInt()).
+		Int("max_sends", config.RateLimitMaxSends.ToInt()).
+		Int("ip_max_sends", config.RateLimitIPMaxSends.ToInt()).
+		Msg("Rate limiting configured")
+}
+
+// setupPolicy loads the access policy from POLICY_FILE. Without a policy every authenticated
+// session may access every protected host.
+func setupPolicy() {
+	path := config.PolicyFile.String()
+	if path == "" {
+		policy.Init(nil)
+		log.Info().Msg("No access policy configured, all authenticated users are allowed")
+		return
+	}
+
+	p, err := policy.LoadFile(path)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("Failed to load access policy")
+	}
+	policy.Init(p)
+
+	log.Info().
+		Str("path", path).
+		Int("rules", len(p.Rules)).
+		Str("default_action", p.DefaultAction).
+		Msg("Access policy loaded")
+}
+
+// setupUsers loads the named users of USERS and USERS_FILE. Without any, logins only take the
+// shared PASSWORDS and Basic credentials are left to the upstream.
+func setupUsers() {
+	db, err := users.Load(config.Users.String(), config.UsersFile.String())
+	if err != nil {
+		log.Fatal().Err(err).Str("path", config.UsersFile.String()).Msg("Failed to load users")
+	}
+	if db.Len() == 0 {
+		users.Init(nil)
+		return
+	}
+	users.Init(db)
+	// Hash the password checked for unknown names now rather than on the first such login
+	users.Dummy()
+	log.Info().Int("users", db.Len()).Msg("Named users loaded")
+}
+
+// setupOIDC configures login through an upstream OpenID Connect provider when OIDC_ENABLED is set.
+// Provider metadata and keys are fetched on the first login, not at startup.
+func setupOIDC() {
+	client := oidc.NewFromConfig()
+	oidc.Init(client)
+	if client == nil {
+		return
+	}
+	log.Info().
+		Str("issuer", config.OIDCIssuerURL.String()).
+		Str("client_id", client.ClientID()).
+		Msg("OpenID Connect login enabled")
+}
+
+// setupSigningKeys loads the token signing keys from SIGNING_KEY_FILES when a feature issues signed
+// tokens (IDP_ENABLED or AUTH_JWT_ENABLED). Without key files a key is generated and replaced every
+// SIGNING_KEY_ROTATION; generated keys are per instance, so replicas behind a load balancer need
+// shared key files.
+func setupSigningKeys() {
+	if !config.IDPEnabled.ToBool() && !config.AuthJWTEnabled.ToBool() {
+		keyring.Init(nil)
+		return
+	}
+
+	paths := config.SigningKeyFiles.ToList()
+	if len(paths) > 0 {
+		keys := make([]*keyring.Key, 0, len(paths))
+		for _, path := range paths {
+			key, err := keyring.LoadFile(path)
+			if err != nil {
+				log.Fatal().Err(err).Str("path", path).Msg("Failed to load signing key")
+			}
+			keys = append(keys, key)
+		}
+		keyring.Init(keyring.New(keys...))
+		log.Info().Str("kid", keys[0].ID).Str("alg", keys[0].Algorithm).Int("keys", len(keys)).Msg("Signing keys loaded")
+		return
+	}
+
+	alg := config.SigningKeyAlgorithm.String()
+	key, err := keyring.Generate(alg)
+	if err != nil {
+		log.Fatal().Err(err).Str("alg", alg).Msg("Failed to generate signing key")
+	}
+	ring := keyring.New(key)
+	rotation := config.SigningKeyRotation.ToDuration()
+	ring.StartRotation(context.Background(), rotation, alg, func(err error) {
+		log.Error().Err(err).Msg("Failed to rotate signing key")
+	})
+	keyring.Init(ring)
+	log.Info().Str("kid", key.ID).Str("alg", alg).Dur("rotation", rotation).Msg("Signing key generated")
+}
+
+// setupIDP makes Stargate an OpenID Connect provider for the clients in IDP_CLIENTS_FILE when
+// IDP_ENABLED is set. Codes and access tokens live in the session storage.
+func setupIDP(store *fibersession.Store) {
+	if !config.IDPEnabled.ToBool() {
+		idp.Init(nil)
+		return
+	}
+
+	path := config.IDPClientsFile.String()
+	clients, err := idp.LoadClients(path)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("Failed to load OpenID Connect clients")
+	}
+	issuer := config.IDPIssuer.String()
+	if issuer == "" {
+		issuer = "https://" + config.AuthHost.String()
+	}
+	provider := idp.New(issuer, clients, keyring.Get(), store.Storage, config.IDPTokenTTL.ToDuration())
+	idp.Init(provider)
+
+	log.Info().
+		Str("issuer", provider.Issuer()).
+		Int("clients", clients.Len()).
+		Msg("OpenID Connect provider enabled")
+}
+
+// setupAPITokens enables personal access tokens when API_TOKENS_ENABLED is set. Tokens are kept
+// in API_TOKENS_FILE, or in the session storage (Redis, as enforced by the configuration).
+func setupAPITokens(store *fibersession.Store) {
+	if !config.APITokensEnabled.ToBool() {
+		apitoken.Init(nil)
+		return
+	}
+
+	var storage apitoken.Storage = store.Storage
+	backend := "session storage"
+	if path := config.APITokensFile.String(); path != "" {
+		fileStorage, err := apitoken.NewFileStorage(path)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("Failed to open API token file")
+		}
+		storage = fileStorage
+		backend = path
+	}
+	apitoken.Init(apitoken.New(storage, config.APITokensMaxTTL.ToDuration()))
+	log.Info().Str("storage", backend).Dur("max_ttl", apitoken.Get().MaxTTL()).Msg("Personal access tokens enabled")
+}
+
+// setupPasskeys enables passkey registration, login and step-up when PASSKEYS_ENABLED is set.
+// Passkeys are kept in PASSKEYS_FILE, or in the session storage (Redis, as enforced by the
+// configuration).
+func setupPasskeys(store *fibersession.Store) {
+	if !config.PasskeysEnabled.ToBool() {
+		webauthn.Init(nil)
+		return
+	}
+
+	var storage webauthn.Storage = store.Storage
+	backend := "session storage"
+	if path := config.PasskeysFile.String(); path != "" {
+		fileStorage, err := filestore.Open(path)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("Failed to open passkey file")
+		}
+		storage = fileStorage
+		backend = path
+	}
+	cfg := config.PasskeysConfig()
+	rp, err := webauthn.New(cfg, webauthn.NewStore(storage))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure passkeys")
+	}
+	webauthn.Init(rp)
+	log.Info().
+		Str("rp_id", cfg.RPID).
+		Strs("origins", cfg.Origins).
+		Str("storage", backend).
+		Msg("Passkeys enabled")
+}
+
+// setupTOTP enables the local per-user TOTP store when TOTP_ENABLED is set and Herald TOTP is
+// not. Secrets are kept encrypted in TOTP_FILE, or in the session storage (Redis, as enforced by
+// the configuration). The time steps of accepted codes, of the local store and of
+// WARDEN_OTP_SECRET_KEY alike, are remembered in the session storage so codes cannot be replayed.
+func setupTOTP(store *fibersession.Store) {
+	totpstore.InitReplayGuard(totpstore.NewReplayGuard(store.Storage))
+	if !config.TOTPEnabled.ToBool() {
+		totpstore.Init(nil)
+		return
+	}
+	if config.HeraldTOTPEnabled.ToBool() {
+		log.Warn().Msg("TOTP_ENABLED is ignored because HERALD_TOTP_ENABLED is set")
+		totpstore.Init(nil)
+		return
+	}
+
+	key, err := totpstore.ParseKey(config.TOTPEncryptionKey.String())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid TOTP encryption key")
+	}
+	var storage totpstore.Storage = store.Storage
+	backend := "session storage"
+	if path := config.TOTPFile.String(); path != "" {
+		fileStorage, err := filestore.Open(path)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("Failed to open TOTP file")
+		}
+		storage = fileStorage
+		backend = path
+	}
+	s, err := totpstore.New(storage, key, config.LoginPageTitle.String())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure TOTP")
+	}
+	totpstore.Init(s)
+	log.Info().Str("storage", backend).Msg("Local per-user TOTP enabled")
+}
+
+// setupSessionIndex enables session management (/_sessions) when sessions are kept in Redis
+// (SESSION_STORAGE_ENABLED). The in-memory storage is per instance, so it is not indexed.
+func setupSessionIndex(store *fibersession.Store) {
+	if !config.SessionStorageEnabled.ToBool() {
+		sessionindex.Init(nil)
+		return
+	}
+	sessionindex.Init(sessionindex.New(store.Storage, config.SessionLifetime()))
+	log.Info().Msg("Session management enabled")
+}
+
+// setupBearerJWT makes /_auth accept JWTs from BEARER_JWT_ISSUER when BEARER_JWT_ENABLED is set.
+// The issuer's keys are loaded in the background and reloaded every BEARER_JWT_JWKS_REFRESH.
+func setupBearerJWT() {
+	if !config.BearerJWTEnabled.ToBool() {
+		bearerjwt.Init(nil)
+		return
+	}
+
+	validator := bearerjwt.New(bearerjwt.Config{
+		JWKSURL:         config.BearerJWTJWKSURL.String(),
+		JWKSFile:        config.BearerJWTJWKSFile.String(),
+		Issuer:          config.BearerJWTIssuer.String(),
+		Audience:        config.BearerJWTAudience.String(),
+		UserClaim:       config.BearerJWTUserClaim.String(),
+		ScopesClaim:     config.BearerJWTScopesClaim.String(),
+		RoleClaim:       config.BearerJWTRoleClaim.String(),
+		RefreshInterval: config.BearerJWTJWKSRefresh.ToDuration(),
+	})
+	validator.Start(context.Background(), func(err error) {
+		log.Warn().Err(err).Str("source", validator.Source()).Msg("Failed to load Bearer JWT keys")
+	})
+	bearerjwt.Init(validator)
+	log.Info().
+		Str("issuer", validator.Issuer()).
+		Str("jwks", validator.Source()).
+		Msg("Bearer JWT validation enabled")
+}
+
 // setupHealthChecker creates a health check aggregator with all dependencies
 func setupHealthChecker(redisClient *redis.Client) *health.Aggregator {
 	healthConfig := health.DefaultConfig().
@@ -197,13 +499,42 @@ func setupRoutes(app *fiber.App, store *fibersession.Store, healthAggregator *he
 	app.Get(RouteRoot, handlers.IndexRoute(store))
 	app.Get(RouteLogin, handlers.LoginRoute(store))
 	app.Post(RouteLogin, handlers.LoginAPI(store))
-	app.Post("/_send_verify_code", handlers.SendVerifyCodeAPI())
+	app.Post("/_send_verify_code", handlers.SendVerifyCodeAPI(store))
+	app.Get(RouteMagicLink, handlers.MagicLinkRoute(store))
+	app.Post(RouteQRLogin, handlers.QRLoginStartAPI(store))
+	app.Get(RouteQRLoginStatus, handlers.QRLoginStatusAPI(store))
+	app.Get(RouteQRLoginApprove, handlers.QRLoginApproveRoute(store))
+	app.Post(RouteQRLoginApprove, handlers.QRLoginApproveAPI(store))
 	app.Get("/totp/enroll", handlers.TOTPEnrollRoute(store))
 	app.Post("/totp/enroll/confirm", handlers.TOTPEnrollConfirmAPI(store))
 	app.Get("/totp/revoke", handlers.TOTPRevokeRoute(store))
 	app.Post("/totp/revoke", handlers.TOTPRevokeConfirmAPI(store))
+	app.Get(RouteStepUp, handlers.StepUpRoute(store))
+	app.Post(RouteStepUp, handlers.StepUpAPI(store))
 	app.Get(RouteLogout, handlers.LogoutRoute(store))
-	app.Get(RouteSessionExchange, handlers.SessionShareRoute())
+	app.Get(RouteOIDCLogin, handlers.OIDCLoginRoute(store))
+	app.Get(RouteOIDCCallback, handlers.OIDCCallbackRoute(store))
+	app.Get(RouteIDPDiscovery, handlers.IDPDiscoveryRoute())
+	app.Get(RouteIDPAuthorize, handlers.IDPAuthorizeRoute(store))
+	app.Post(RouteIDPToken, handlers.IDPTokenRoute())
+	app.Get(RouteIDPUserInfo, handlers.IDPUserInfoRoute())
+	app.Post(RouteIDPUserInfo, handlers.IDPUserInfoRoute())
+	app.Get(RouteIDPJWKS, handlers.IDPJWKSRoute())
+	app.Get(RouteJWKS, handlers.JWKSRoute())
+	app.Get(RouteAPITokens, handlers.APITokensRoute(store))
+	app.Post(RouteAPITokens, handlers.APITokenCreateAPI(store))
+	app.Post(RouteAPITokensRevoke, handlers.APITokenRevokeAPI(store))
+	app.Get(RoutePasskeys, handlers.PasskeysRoute(store))
+	app.Post(RoutePasskeyRegisterOptions, handlers.PasskeyRegisterOptionsAPI(store))
+	app.Post(RoutePasskeyRegister, handlers.PasskeyRegisterAPI(store))
+	app.Post(RoutePasskeyRemove, handlers.PasskeyRemoveAPI(store))
+	app.Post(RoutePasskeyLoginOptions, handlers.PasskeyLoginOptionsAPI(store))
+	app.Post(RoutePasskeyLogin, handlers.PasskeyLoginAPI(store))
+	app.Post(RouteStepUpPasskeyOptions, handlers.StepUpPasskeyOptionsAPI(store))
+	app.Get(RouteSessions, handlers.SessionsRoute(store))
+	app.Post(RouteSessionRevoke, handlers.SessionRevokeAPI(store))
+	app.Post(RouteSessionRevokeOthers, handlers.SessionRevokeOthersAPI(store))
+	app.Get(RouteSessionExchange, handlers.SessionShareRoute(store))
 	app.Get(RouteAuth, handlers.CheckRoute(store))
 	// Prometheus metrics endpoint
 	app.Get("/metrics", metricskit.FiberHandlerFor(metrics.Registry))
@@ -241,29 +572,37 @@ func setupStaticFiles(app *fiber.App) {
 }
 
 // setupMiddleware configures all middleware for the Fiber application.
-// This includes recover, security headers, logging, tracing, i18n, and favicon handling.
+// This includes recover, trusted proxy check, security headers, logging, tracing, i18n, and favicon handling.
 func setupMiddleware(app *fiber.App) {
 	// 1. Panic recovery (highest priority - prevents server crashes)
 	app.Use(recover.New())
 	log.Debug().Msg("Panic recovery middleware enabled")
 
-	// 2. Security headers (XSS protection, clickjacking prevention, etc.)
+	// 2. Trusted proxies (drop X-Forwarded-* / Forwarded headers not set by a trusted proxy)
+	app.Use(handlers.TrustedProxyMiddleware())
+	if proxies := config.GetTrustedProxySet(); config.TrustedProxies.Value != "" {
+		log.Info().Strs("trusted_proxies", proxies.Strings()).Msg("Trusted proxy check enabled")
+	} else {
+		log.Warn().Strs("trusted_proxies", proxies.Strings()).Msg("TRUSTED_PROXIES is not set: forwarded headers and X-Forwarded-For are honored from loopback and private networks only; list your proxies if they use public addresses")
+	}
+
+	// 3. Security headers (XSS protection, clickjacking prevention, etc.)
 	app.Use(middlewarekit.SecurityHeaders(middlewarekit.DefaultSecurityHeadersConfig()))
 	log.Debug().Msg("Security headers middleware enabled")
 
-	// 3. OpenTelemetry tracing middleware (if enabled)
+	// 4. OpenTelemetry tracing middleware (if enabled)
 	if config.OTLPEnabled.ToBool() {
 		app.Use(internal_tracing.TracingMiddleware("stargate"))
 		log.Info().Msg("OpenTelemetry tracing middleware enabled")
 	}
 
-	// 4. i18n middleware (language detection from Query > Cookie > Header > Accept-Language)
+	// 5. i18n middleware (language detection from Query > Cookie > Header > Accept-Language)
 	app.Use(i18nkit.FiberMiddleware(i18nkit.MiddlewareConfig{
 		Bundle: i18n.GetBundle(),
 	}))
 	log.Debug().Msg("i18n middleware enabled")
 
-	// 5. Request logging with logger-kit
+	// 6. Request logging with logger-kit
 	app.Use(logger.FiberMiddleware(logger.MiddlewareConfig{
 		Logger:           log,
 		SkipPaths:        []string{"/healthz", "/metrics"},
@@ -272,26 +611,7 @@ func setupMiddleware(app *fiber.App) {
 	}))
 	log.Debug().Msg("Request logging middleware enabled")
 
-	// 6. Rate limiting (optional - uncomment to enable for production)
-	// To enable rate limiting, uncomment the following code:
-	//
-	// zerologLogger := log.Zerolog()
-	// limiter := middlewarekit.NewRateLimiter(middlewarekit.RateLimiterConfig{
-	// 	Rate:            100,           // 100 requests per minute
-	// 	Window:          time.Minute,
-	// 	MaxVisitors:     10000,
-	// 	CleanupInterval: time.Minute,
-	// })
-	// app.Use(middlewarekit.RateLimit(middlewarekit.RateLimitConfig{
-	// 	Limiter:   limiter,
-	// 	SkipPaths: []string{"/healthz", "/metrics"},
-	// 	Logger:    &zerologLogger,
-	// 	OnLimitReached: func(key string) {
-	// 		// Optional: increment Prometheus counter
-	// 		// metrics.RateLimitExceeded.Inc()
-	// 	},
-	// }))
-	// log.Info().Msg("Rate limiting middleware enabled")
+	// Failed logins and code sends are rate limited in the handlers; see setupRateLimiter.
 
 	// 7. Favicon middleware
 	log.Debug().Msg("Adding favicon middleware")
@@ -321,6 +641,18 @@ func createApp() *fiber.App {
 
 	setupMiddleware(app)
 	store, redisClient := setupSessionStore()
+	setupAuditLog(redisClient)
+	setupRateLimiter(redisClient)
+	setupPolicy()
+	setupUsers()
+	setupOIDC()
+	setupSigningKeys()
+	setupIDP(store)
+	setupAPITokens(store)
+	setupPasskeys(store)
+	setupTOTP(store)
+	setupSessionIndex(store)
+	setupBearerJWT()
 	healthAggregator := setupHealthChecker(redisClient)
 
 	setupRoutes(app, store, healthAggregator)
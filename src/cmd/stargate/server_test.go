@@ -336,6 +336,7 @@ func TestCreateApp_AllRoutesRegistered(t *testing.T) {
 		RouteRoot,
 		RouteLogin,
 		RouteLogout,
+		RouteStepUp,
 		RouteSessionExchange,
 		RouteAuth,
 	}
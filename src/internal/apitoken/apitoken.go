@@ -0,0 +1,336 @@
+// Package apitoken implements personal access tokens: long-lived Bearer tokens that users mint
+// for their scripts and machine clients. Only a SHA-256 hash of each token is stored.
+package apitoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix starts every token, so Bearer tokens meant for Stargate are told apart from tokens of
+// the upstream applications and are easy to find in leaked logs or code.
+const Prefix = "stg_"
+
+const (
+	// DefaultMaxTTL caps the lifetime of new tokens when no maximum is configured.
+	DefaultMaxTTL = 90 * 24 * time.Hour
+	// MaxNameLength limits the display name of a token.
+	MaxNameLength = 64
+	// MaxTokensPerUser limits how many live tokens a user can hold.
+	MaxTokensPerUser = 50
+
+	tokenKeyPrefix = "apitoken:"
+	indexKeyPrefix = "apitoken_user:"
+)
+
+var (
+	// ErrInvalidToken is returned for malformed, unknown, expired or revoked tokens.
+	ErrInvalidToken = errors.New("invalid API token")
+	// ErrNotFound is returned when revoking a token the user does not own.
+	ErrNotFound = errors.New("API token not found")
+	// ErrInvalidName is returned for empty or overlong token names.
+	ErrInvalidName = errors.New("invalid API token name")
+	// ErrInvalidTTL is returned for a non-positive lifetime or one above the maximum.
+	ErrInvalidTTL = errors.New("invalid API token lifetime")
+	// ErrInvalidScope is returned when a token asks for a scope its owner does not have.
+	ErrInvalidScope = errors.New("invalid API token scope")
+	// ErrTooManyTokens is returned when the owner already holds MaxTokensPerUser tokens.
+	ErrTooManyTokens = errors.New("too many API tokens")
+)
+
+// Storage keeps the hashed tokens. The session storage (Redis) and FileStorage implement it.
+type Storage interface {
+	Get(key string) ([]byte, error)
+	Set(key string, val []byte, exp time.Duration) error
+	Delete(key string) error
+}
+
+// Owner is the identity a token acts for, captured when it is minted.
+type Owner struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Role   string `json:"role,omitempty"`
+}
+
+// Token is a stored personal access token. The secret itself is never stored.
+type Token struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Owner     Owner     `json:"owner"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Hash is the hex SHA-256 of the token's secret part.
+	Hash string `json:"hash"`
+}
+
+// Store mints, lists, revokes and authenticates tokens.
+type Store struct {
+	storage Storage
+	maxTTL  time.Duration
+	now     func() time.Time
+	// mu serializes updates of the per-user index within this instance.
+	mu sync.Mutex
+}
+
+// New returns a store keeping tokens in storage. Token lifetimes are capped at maxTTL
+// (DefaultMaxTTL when not positive).
+func New(storage Storage, maxTTL time.Duration) *Store {
+	if maxTTL <= 0 {
+		maxTTL = DefaultMaxTTL
+	}
+	return &Store{storage: storage, maxTTL: maxTTL, now: time.Now}
+}
+
+// MaxTTL returns the longest lifetime a new token can have.
+func (s *Store) MaxTTL() time.Duration {
+	return s.maxTTL
+}
+
+// Mint creates a token for owner and returns it with the secret to show the user once.
+// scopes must be a subset of allowedScopes, the owner's own scopes.
+func (s *Store) Mint(owner Owner, name string, scopes, allowedScopes []string, ttl time.Duration) (string, *Token, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > MaxNameLength {
+		return "", nil, ErrInvalidName
+	}
+	if ttl <= 0 || ttl > s.maxTTL {
+		return "", nil, ErrInvalidTTL
+	}
+	for _, scope := range scopes {
+		if !contains(allowedScopes, scope) {
+			return "", nil, fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+		}
+	}
+	if owner.UserID == "" {
+		return "", nil, errors.New("API token owner has no user ID")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids, err := s.liveIDs(owner.UserID)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(ids) >= MaxTokensPerUser {
+		return "", nil, ErrTooManyTokens
+	}
+
+	id, err := randomString(9)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", nil, err
+	}
+	now := s.now()
+	t := &Token{
+		ID:        id,
+		Name:      name,
+		Owner:     owner,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		Hash:      hashSecret(secret),
+	}
+	value, err := json.Marshal(t)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := s.storage.Set(tokenKeyPrefix+id, value, ttl); err != nil {
+		return "", nil, err
+	}
+	if err := s.saveIndex(owner.UserID, append(ids, id)); err != nil {
+		return "", nil, err
+	}
+	return Prefix + id + "_" + secret, t, nil
+}
+
+// List returns the live tokens of userID, newest first.
+func (s *Store) List(userID string) ([]*Token, error) {
+	ids, err := s.indexIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]*Token, 0, len(ids))
+	for _, id := range ids {
+		t, err := s.load(id)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil && t.Owner.UserID == userID && s.now().Before(t.ExpiresAt) {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+// Revoke deletes the token id of userID.
+func (s *Store) Revoke(userID, id string) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil || t.Owner.UserID != userID {
+		return nil, ErrNotFound
+	}
+	if err := s.storage.Delete(tokenKeyPrefix + id); err != nil {
+		return nil, err
+	}
+	ids, err := s.liveIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	return t, s.saveIndex(userID, ids)
+}
+
+// Authenticate returns the live token matching the presented Bearer value.
+func (s *Store) Authenticate(value string) (*Token, error) {
+	rest, ok := strings.CutPrefix(value, Prefix)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return nil, ErrInvalidToken
+	}
+	t, err := s.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil || !s.now().Before(t.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(t.Hash)) != 1 {
+		return nil, ErrInvalidToken
+	}
+	return t, nil
+}
+
+// load returns the stored token id, or nil when there is none. IDs that cannot be a token ID
+// are not looked up, so values from the Authorization header never reach arbitrary keys.
+func (s *Store) load(id string) (*Token, error) {
+	if !validID(id) {
+		return nil, nil
+	}
+	value, err := s.storage.Get(tokenKeyPrefix + id)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var t Token
+	if err := json.Unmarshal(value, &t); err != nil {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+// indexIDs returns the token IDs recorded for userID.
+func (s *Store) indexIDs(userID string) ([]string, error) {
+	value, err := s.storage.Get(indexKeyPrefix + userID)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var ids []string
+	if err := json.Unmarshal(value, &ids); err != nil {
+		return nil, nil
+	}
+	return ids, nil
+}
+
+// liveIDs returns the index of userID without the tokens that expired or were revoked.
+func (s *Store) liveIDs(userID string) ([]string, error) {
+	ids, err := s.indexIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	live := ids[:0]
+	for _, id := range ids {
+		t, err := s.load(id)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil && s.now().Before(t.ExpiresAt) {
+			live = append(live, id)
+		}
+	}
+	return live, nil
+}
+
+// saveIndex stores the token IDs of userID. The index does not expire: stale IDs are pruned
+// whenever the user mints or revokes a token.
+func (s *Store) saveIndex(userID string, ids []string) error {
+	if len(ids) == 0 {
+		return s.storage.Delete(indexKeyPrefix + userID)
+	}
+	value, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return s.storage.Set(indexKeyPrefix+userID, value, 0)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// validID reports whether id has the shape of a generated token ID (base64url, 12 characters).
+func validID(id string) bool {
+	if len(id) != 12 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomString returns n random bytes, base64url-encoded. "_" is mapped to "-" so the token
+// can use "_" to separate its ID from its secret.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(base64.RawURLEncoding.EncodeToString(b), "_", "-"), nil
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+var store *Store
+
+// Init sets the store used by /_auth and the /_tokens pages; nil disables personal access tokens.
+func Init(s *Store) {
+	store = s
+}
+
+// Get returns the store, or nil when personal access tokens are disabled.
+func Get() *Store {
+	return store
+}
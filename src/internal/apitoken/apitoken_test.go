@@ -0,0 +1,150 @@
+package apitoken
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+)
+
+var testOwner = Owner{UserID: "u-1", Email: "alice@example.com", Name: "Alice", Role: "admin"}
+
+// newTestStore returns a store on a file storage in a temp dir, using the clock *now. The store
+// checks expiry itself, so the storage keeps the real clock.
+func newTestStore(t *testing.T, now *time.Time) (*Store, *FileStorage) {
+	t.Helper()
+	storage, err := NewFileStorage(filepath.Join(t.TempDir(), "tokens.json"))
+	testza.AssertNoError(t, err)
+	s := New(storage, 30*24*time.Hour)
+	s.now = func() time.Time { return *now }
+	return s, storage
+}
+
+func TestStore_MintAndAuthenticate(t *testing.T) {
+	now := time.Now()
+	s, _ := newTestStore(t, &now)
+
+	secret, token, err := s.Mint(testOwner, " ci ", []string{"read"}, []string{"read", "write"}, 24*time.Hour)
+	testza.AssertNoError(t, err)
+	testza.AssertTrue(t, strings.HasPrefix(secret, Prefix+token.ID+"_"))
+	testza.AssertEqual(t, "ci", token.Name)
+	testza.AssertFalse(t, strings.Contains(token.Hash, strings.TrimPrefix(secret, Prefix+token.ID+"_")))
+
+	got, err := s.Authenticate(secret)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, testOwner, got.Owner)
+	testza.AssertEqual(t, []string{"read"}, got.Scopes)
+
+	// Wrong secret, malformed values and unknown IDs
+	for _, value := range []string{secret + "x", "stg_", "stg_" + token.ID, "ghp_abc", "stg_../../x_y", "stg_AAAAAAAAAAAA_secret"} {
+		_, err := s.Authenticate(value)
+		testza.AssertEqual(t, ErrInvalidToken, err, value)
+	}
+
+	// Expired
+	now = now.Add(24 * time.Hour)
+	_, err = s.Authenticate(secret)
+	testza.AssertEqual(t, ErrInvalidToken, err)
+}
+
+func TestStore_MintValidation(t *testing.T) {
+	now := time.Now()
+	s, _ := newTestStore(t, &now)
+	allowed := []string{"read"}
+
+	_, _, err := s.Mint(testOwner, "", nil, allowed, time.Hour)
+	testza.AssertEqual(t, ErrInvalidName, err)
+	_, _, err = s.Mint(testOwner, strings.Repeat("n", MaxNameLength+1), nil, allowed, time.Hour)
+	testza.AssertEqual(t, ErrInvalidName, err)
+	_, _, err = s.Mint(testOwner, "ci", nil, allowed, 0)
+	testza.AssertEqual(t, ErrInvalidTTL, err)
+	_, _, err = s.Mint(testOwner, "ci", nil, allowed, s.MaxTTL()+time.Second)
+	testza.AssertEqual(t, ErrInvalidTTL, err)
+	_, _, err = s.Mint(testOwner, "ci", []string{"write"}, allowed, time.Hour)
+	testza.AssertErrorIs(t, err, ErrInvalidScope)
+	_, _, err = s.Mint(Owner{}, "ci", nil, allowed, time.Hour)
+	testza.AssertNotNil(t, err)
+}
+
+func TestStore_ListAndRevoke(t *testing.T) {
+	now := time.Now()
+	s, _ := newTestStore(t, &now)
+
+	first, t1, err := s.Mint(testOwner, "first", nil, nil, time.Hour)
+	testza.AssertNoError(t, err)
+	now = now.Add(time.Minute)
+	_, t2, err := s.Mint(testOwner, "second", nil, nil, 2*time.Hour)
+	testza.AssertNoError(t, err)
+	_, other, err := s.Mint(Owner{UserID: "u-2"}, "other", nil, nil, time.Hour)
+	testza.AssertNoError(t, err)
+
+	tokens, err := s.List("u-1")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, tokens, 2)
+	testza.AssertEqual(t, t2.ID, tokens[0].ID)
+	testza.AssertEqual(t, t1.ID, tokens[1].ID)
+
+	// Users can only revoke their own tokens
+	_, err = s.Revoke("u-1", other.ID)
+	testza.AssertEqual(t, ErrNotFound, err)
+
+	revoked, err := s.Revoke("u-1", t1.ID)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "first", revoked.Name)
+	_, err = s.Authenticate(first)
+	testza.AssertEqual(t, ErrInvalidToken, err)
+	_, err = s.Revoke("u-1", t1.ID)
+	testza.AssertEqual(t, ErrNotFound, err)
+
+	// Expired tokens drop out of the list
+	now = now.Add(2 * time.Hour)
+	tokens, err = s.List("u-1")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, tokens, 0)
+}
+
+func TestStore_TooManyTokens(t *testing.T) {
+	now := time.Now()
+	s, _ := newTestStore(t, &now)
+	for i := 0; i < MaxTokensPerUser; i++ {
+		_, _, err := s.Mint(testOwner, "t", nil, nil, time.Hour)
+		testza.AssertNoError(t, err)
+	}
+	_, _, err := s.Mint(testOwner, "t", nil, nil, time.Hour)
+	testza.AssertEqual(t, ErrTooManyTokens, err)
+
+	// Expired tokens no longer count
+	now = now.Add(time.Hour)
+	_, _, err = s.Mint(testOwner, "t", nil, nil, time.Hour)
+	testza.AssertNoError(t, err)
+}
+
+func TestFileStorage_Persists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	storage, err := NewFileStorage(path)
+	testza.AssertNoError(t, err)
+	s := New(storage, 0)
+	testza.AssertEqual(t, DefaultMaxTTL, s.MaxTTL())
+
+	secret, _, err := s.Mint(testOwner, "ci", nil, nil, time.Hour)
+	testza.AssertNoError(t, err)
+
+	// A new instance reading the same file accepts the token
+	reopened, err := NewFileStorage(path)
+	testza.AssertNoError(t, err)
+	got, err := New(reopened, 0).Authenticate(secret)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "u-1", got.Owner.UserID)
+
+	testza.AssertNoError(t, reopened.Delete("missing"))
+}
+
+func TestNewFileStorage_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	testza.AssertNoError(t, os.WriteFile(path, []byte("not json"), 0o600))
+	_, err := NewFileStorage(path)
+	testza.AssertNotNil(t, err)
+}
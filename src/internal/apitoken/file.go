@@ -0,0 +1,11 @@
+package apitoken
+
+import "github.com/soulteary/stargate/src/internal/filestore"
+
+// FileStorage keeps the tokens in a JSON file, for single-instance deployments without Redis.
+type FileStorage = filestore.Storage
+
+// NewFileStorage opens (or creates on first write) the token file at path.
+func NewFileStorage(path string) (*FileStorage, error) {
+	return filestore.Open(path)
+}
@@ -2,7 +2,10 @@ package auditlog
 
 import (
 	"context"
+	"math"
+	"strconv"
 	"sync"
+	"time"
 
 	audit "github.com/soulteary/audit-kit"
 	"github.com/soulteary/stargate/src/internal/config"
@@ -11,10 +14,12 @@ import (
 var (
 	logger     *audit.Logger
 	loggerInit sync.Once
+	// storage is kept so Stop can close sinks (files, streams) after the final flush
+	storage audit.Storage
 )
 
 // Init initializes the audit logger with the given storage and config
-func Init(storage audit.Storage, cfg *audit.Config) {
+func Init(s audit.Storage, cfg *audit.Config) {
 	loggerInit.Do(func() {
 		if cfg == nil {
 			cfg = audit.DefaultConfig()
@@ -25,10 +30,11 @@ func Init(storage audit.Storage, cfg *audit.Config) {
 			cfg.Enabled = config.AuditLogEnabled.ToBool()
 		}
 
-		if storage == nil {
+		if s == nil {
 			// Use no-op storage if none provided
-			storage = audit.NewNoopStorage()
+			s = audit.NewNoopStorage()
 		}
+		storage = s
 
 		logger = audit.NewLoggerWithWriter(storage, cfg)
 	})
@@ -43,12 +49,18 @@ func GetLogger() *audit.Logger {
 	return logger
 }
 
-// Stop stops the audit logger
+// Stop stops the audit logger, flushing pending records, then closes the storage
 func Stop() error {
+	var err error
 	if logger != nil {
-		return logger.Stop()
+		err = logger.Stop()
 	}
-	return nil
+	if storage != nil {
+		if closeErr := storage.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
 
 // LogLogin records a login event
@@ -149,3 +161,187 @@ func LogSessionDestroy(ctx context.Context, userID, ip string) {
 		audit.WithRecordIP(ip),
 	)
 }
+
+// LogStepUp records a step-up (re-authentication) attempt for an existing session
+func LogStepUp(ctx context.Context, userID, method, ip string, success bool, reason string) {
+	l := GetLogger()
+	if l == nil {
+		return
+	}
+
+	eventType := audit.EventLoginSuccess
+	result := audit.ResultSuccess
+	if !success {
+		eventType = audit.EventLoginFailed
+		result = audit.ResultFailure
+	}
+
+	l.LogAuth(ctx, eventType, userID, result,
+		audit.WithRecordIP(ip),
+		audit.WithRecordReason(reason),
+		audit.WithRecordMetadata("method", method),
+		audit.WithRecordMetadata("action", "step_up"),
+	)
+}
+
+// LogCallbackRejected records a login callback refused because its host is not on the allowlist
+func LogCallbackRejected(ctx context.Context, callback, ip string) {
+	l := GetLogger()
+	if l == nil {
+		return
+	}
+
+	l.LogAccess(ctx, audit.EventAccessDenied, "", callback, audit.ResultFailure,
+		audit.WithRecordIP(ip),
+		audit.WithRecordReason("callback_not_allowed"),
+		audit.WithRecordMetadata("action", "login_callback"),
+	)
+}
+
+// LogRateLimited records a login or code send refused because the client IP or identifier is locked out.
+// reason is "rate_limited" for a rejected request or "locked_out" when the attempt started a lockout.
+func LogRateLimited(ctx context.Context, scope, identifier, ip, reason string, retryAfter time.Duration) {
+	l := GetLogger()
+	if l == nil {
+		return
+	}
+
+	l.LogAccess(ctx, audit.EventAccessDenied, "", scope, audit.ResultFailure,
+		audit.WithRecordIP(ip),
+		audit.WithRecordReason(reason),
+		audit.WithRecordMetadata("action", "rate_limit"),
+		audit.WithRecordMetadata("identifier", identifier),
+		audit.WithRecordMetadata("retry_after", strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))),
+	)
+}
+
+// LogPolicyDenied records a request refused by the access policy.
+// rule is the matching policy rule ("" for the default action) and reason the unmet requirement.
+func LogPolicyDenied(ctx context.Context, userID, resource, ip, rule, reason string) {
+	l := GetLogger()
+	if l == nil {
+		return
+	}
+
+	l.LogAccess(ctx, audit.EventAccessDenied, userID, resource, audit.ResultFailure,
+		audit.WithRecordIP(ip),
+		audit.WithRecordReason(reason),
+		audit.WithRecordMetadata("action", "policy"),
+		audit.WithRecordMetadata("rule", rule),
+	)
+}
+
+// LogIDPToken records an ID token issued (or refused) by the OpenID Connect provider to client.
+// reason is the OAuth error code of a refused token request.
+func LogIDPToken(ctx context.Context, userID, client, ip string, success bool, reason string) {
+	l := GetLogger()
+	if l == nil {
+		return
+	}
+
+	eventType := audit.EventLoginSuccess
+	result := audit.ResultSuccess
+	if !success {
+		eventType = audit.EventLoginFailed
+		result = audit.ResultFailure
+	}
+
+	l.LogAuth(ctx, eventType, userID, result,
+		audit.WithRecordIP(ip),
+		audit.WithRecordReason(reason),
+		audit.WithRecordMetadata("action", "idp_token"),
+		audit.WithRecordMetadata("client_id", client),
+	)
+}
+
+// LogAPIToken records a personal access token being created or revoked by its owner
+// (action "api_token_create" or "api_token_revoke").
+func LogAPIToken(ctx context.Context, userID, tokenID, action, ip string) {
+	l := GetLogger()
+	if l == nil {
+		return
+	}
+
+	eventType := audit.EventSessionCreate
+	if action == "api_token_revoke" {
+		eventType = audit.EventSessionExpire
+	}
+
+	l.LogAuth(ctx, eventType, userID, audit.ResultSuccess,
+		audit.WithRecordIP(ip),
+		audit.WithRecordMetadata("action", action),
+		audit.WithRecordMetadata("token_id", tokenID),
+	)
+}
+
+// LogPasskey records a passkey being registered or removed by its owner
+// (action "passkey_register" or "passkey_remove").
+func LogPasskey(ctx context.Context, userID, credentialID, action, ip string) {
+	l := GetLogger()
+	if l == nil {
+		return
+	}
+
+	eventType := audit.EventSessionCreate
+	if action == "passkey_remove" {
+		eventType = audit.EventSessionExpire
+	}
+
+	l.LogAuth(ctx, eventType, userID, audit.ResultSuccess,
+		audit.WithRecordIP(ip),
+		audit.WithRecordMetadata("action", action),
+		audit.WithRecordMetadata("credential_id", credentialID),
+	)
+}
+
+// LogQRLogin records a user approving or denying a QR login from their signed-in device
+// (action "qr_login_approve" or "qr_login_deny"). targetIP is the device that showed the code.
+func LogQRLogin(ctx context.Context, userID, action, ip, targetIP string) {
+	l := GetLogger()
+	if l == nil {
+		return
+	}
+
+	eventType := audit.EventLoginSuccess
+	result := audit.ResultSuccess
+	if action == "qr_login_deny" {
+		eventType = audit.EventLoginFailed
+		result = audit.ResultFailure
+	}
+
+	l.LogAuth(ctx, eventType, userID, result,
+		audit.WithRecordIP(ip),
+		audit.WithRecordMetadata("action", action),
+		audit.WithRecordMetadata("target_ip", targetIP),
+	)
+}
+
+// LogSessionRevoke records a user signing out one of their sessions from the session list.
+// sessionHandle is the public handle of the session, never its ID.
+func LogSessionRevoke(ctx context.Context, userID, sessionHandle, ip string) {
+	l := GetLogger()
+	if l == nil {
+		return
+	}
+
+	l.LogAuth(ctx, audit.EventSessionExpire, userID, audit.ResultSuccess,
+		audit.WithRecordIP(ip),
+		audit.WithRecordMetadata("action", "session_revoke"),
+		audit.WithRecordMetadata("session", sessionHandle),
+	)
+}
+
+// LogSessionTimeout records /_auth ending a session that outlived its idle or absolute timeout.
+// reason is "idle_timeout" or "absolute_timeout".
+func LogSessionTimeout(ctx context.Context, userID, reason, host, ip string) {
+	l := GetLogger()
+	if l == nil {
+		return
+	}
+
+	l.LogAuth(ctx, audit.EventSessionExpire, userID, audit.ResultSuccess,
+		audit.WithRecordIP(ip),
+		audit.WithRecordReason(reason),
+		audit.WithRecordMetadata("host", host),
+	)
+}
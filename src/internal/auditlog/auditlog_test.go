@@ -4,6 +4,7 @@ import (
 	"context"
 	"sync"
 	"testing"
+	"time"
 
 	audit "github.com/soulteary/audit-kit"
 	"github.com/stretchr/testify/assert"
@@ -63,6 +64,42 @@ func TestAuditLogFunctions(t *testing.T) {
 		LogSessionDestroy(ctx, "user1", "127.0.0.1")
 	})
 
+	t.Run("LogRateLimited", func(t *testing.T) {
+		LogRateLimited(ctx, "login", "u***@example.com", "127.0.0.1", "locked_out", 90*time.Second)
+	})
+
+	t.Run("LogPolicyDenied", func(t *testing.T) {
+		LogPolicyDenied(ctx, "user123", "https://admin.example.com/settings", "127.0.0.1", "admins", "role")
+	})
+
+	t.Run("LogIDPToken", func(t *testing.T) {
+		LogIDPToken(ctx, "user123", "wiki", "127.0.0.1", true, "")
+		LogIDPToken(ctx, "", "wiki", "127.0.0.1", false, "invalid_grant")
+	})
+
+	t.Run("LogAPIToken", func(t *testing.T) {
+		LogAPIToken(ctx, "user123", "tok1", "api_token_create", "127.0.0.1")
+		LogAPIToken(ctx, "user123", "tok1", "api_token_revoke", "127.0.0.1")
+	})
+
+	t.Run("LogPasskey", func(t *testing.T) {
+		LogPasskey(ctx, "user123", "cred1", "passkey_register", "127.0.0.1")
+		LogPasskey(ctx, "user123", "cred1", "passkey_remove", "127.0.0.1")
+	})
+
+	t.Run("LogQRLogin", func(t *testing.T) {
+		LogQRLogin(ctx, "user123", "qr_login_approve", "127.0.0.1", "10.0.0.5")
+		LogQRLogin(ctx, "user123", "qr_login_deny", "127.0.0.1", "10.0.0.5")
+	})
+
+	t.Run("LogSessionRevoke", func(t *testing.T) {
+		LogSessionRevoke(ctx, "user123", "0123456789abcdef01", "127.0.0.1")
+	})
+
+	t.Run("LogSessionTimeout", func(t *testing.T) {
+		LogSessionTimeout(ctx, "user123", "idle_timeout", "app.example.com", "127.0.0.1")
+	})
+
 	// Test Stop
 	err := Stop()
 	assert.NoError(t, err)
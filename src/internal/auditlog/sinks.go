@@ -0,0 +1,434 @@
+package auditlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	audit "github.com/soulteary/audit-kit"
+	"github.com/soulteary/stargate/src/internal/config"
+)
+
+// Sink names accepted by AUDIT_LOG_SINKS.
+const (
+	SinkStdout = "stdout"
+	SinkFile   = "file"
+	SinkRedis  = "redis"
+)
+
+// Output formats accepted by AUDIT_LOG_FORMAT.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// redisWriteTimeout bounds a single XADD so a slow Redis never blocks audit flushing.
+const redisWriteTimeout = 2 * time.Second
+
+// formatRecord renders a record as a single line (without trailing newline).
+// "json" emits the record as-is; "text" emits space-separated key=value pairs,
+// with the timestamp first and remaining keys in lexical order.
+func formatRecord(record *audit.Record, format string) ([]byte, error) {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(format) != FormatText {
+		return raw, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	flat := make(map[string]string, len(fields))
+	flattenFields("", fields, flat)
+
+	keys := make([]string, 0, len(flat))
+	for k := range flat {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		// Keep timestamp first so text lines sort chronologically with standard tools
+		if keys[i] == "timestamp" || keys[j] == "timestamp" {
+			return keys[i] == "timestamp"
+		}
+		return keys[i] < keys[j]
+	})
+
+	var buf bytes.Buffer
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(quoteTextValue(flat[k]))
+	}
+	return buf.Bytes(), nil
+}
+
+// flattenFields flattens nested JSON objects into dotted keys (e.g. metadata.method).
+func flattenFields(prefix string, in map[string]interface{}, out map[string]string) {
+	for k, v := range in {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		switch val := v.(type) {
+		case nil:
+			continue
+		case map[string]interface{}:
+			flattenFields(key, val, out)
+		case string:
+			if val != "" {
+				out[key] = val
+			}
+		default:
+			encoded, err := json.Marshal(val)
+			if err == nil {
+				out[key] = string(encoded)
+			}
+		}
+	}
+}
+
+// quoteTextValue quotes values that would otherwise break key=value parsing.
+func quoteTextValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \t\r\n\"=") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// WriterStorage writes one formatted line per record to an io.Writer.
+// It is used for the stdout sink and is safe for concurrent use.
+type WriterStorage struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// NewWriterStorage creates a storage that writes to w in the given format.
+func NewWriterStorage(w io.Writer, format string) *WriterStorage {
+	return &WriterStorage{w: w, format: format}
+}
+
+// Write appends the record to the underlying writer.
+func (s *WriterStorage) Write(_ context.Context, record *audit.Record) error {
+	line, err := formatRecord(record, s.format)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// Query is not supported by write-only sinks and always returns no records.
+func (s *WriterStorage) Query(_ context.Context, _ *audit.QueryFilter) ([]*audit.Record, error) {
+	return nil, nil
+}
+
+// Close is a no-op; the writer is owned by the caller.
+func (s *WriterStorage) Close() error {
+	return nil
+}
+
+// FileStorage appends records to a file and rotates it by size and/or age.
+// Rotated files are renamed to "<path>.<UTC timestamp>" and pruned to maxBackups.
+type FileStorage struct {
+	mu         sync.Mutex
+	path       string
+	format     string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+
+	// now is overridable for tests
+	now func() time.Time
+}
+
+// NewFileStorage opens (or creates) the audit file at path in append-only mode.
+// maxSize is in bytes (0 disables size rotation), maxAge disables time rotation when 0,
+// and maxBackups of 0 keeps every rotated file.
+func NewFileStorage(path, format string, maxSize int64, maxAge time.Duration, maxBackups int) (*FileStorage, error) {
+	if path == "" {
+		return nil, errors.New("audit log file path is empty")
+	}
+	s := &FileStorage{
+		path:       path,
+		format:     format,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		now:        time.Now,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("create audit log directory: %w", err)
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the current file for appending and records its size.
+func (s *FileStorage) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("open audit log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("stat audit log file: %w", err)
+	}
+	s.file = f
+	s.size = info.Size()
+	s.openedAt = s.now()
+	return nil
+}
+
+// shouldRotate reports whether writing n more bytes requires a rotation first.
+func (s *FileStorage) shouldRotate(n int) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.maxSize > 0 && s.size+int64(n) > s.maxSize {
+		return true
+	}
+	if s.maxAge > 0 && s.now().Sub(s.openedAt) >= s.maxAge {
+		return true
+	}
+	return false
+}
+
+// rotate renames the current file aside, opens a fresh one and prunes old backups.
+func (s *FileStorage) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("close audit log file: %w", err)
+	}
+	backup := s.path + "." + s.now().UTC().Format("20060102T150405")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			break
+		}
+		backup = fmt.Sprintf("%s.%s.%d", s.path, s.now().UTC().Format("20060102T150405"), i)
+	}
+	if err := os.Rename(s.path, backup); err != nil {
+		return fmt.Errorf("rotate audit log file: %w", err)
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	s.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond maxBackups.
+func (s *FileStorage) prune() {
+	if s.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(s.path + ".*")
+	if err != nil || len(backups) <= s.maxBackups {
+		return
+	}
+	// Timestamps are fixed-width UTC, so lexical order is chronological
+	sort.Strings(backups)
+	for _, old := range backups[:len(backups)-s.maxBackups] {
+		_ = os.Remove(old)
+	}
+}
+
+// Write appends the record to the file, rotating first when limits are reached.
+func (s *FileStorage) Write(_ context.Context, record *audit.Record) error {
+	line, err := formatRecord(record, s.format)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+	if s.shouldRotate(len(line)) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// Query is not supported by the file sink and always returns no records.
+func (s *FileStorage) Query(_ context.Context, _ *audit.QueryFilter) ([]*audit.Record, error) {
+	return nil, nil
+}
+
+// Close flushes and closes the file. It is safe to call more than once.
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if err := s.file.Sync(); err != nil {
+		_ = s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// RedisStreamStorage appends records as JSON to a Redis stream (XADD).
+// The client is shared with the session store and is not closed by this storage.
+type RedisStreamStorage struct {
+	client *redis.Client
+	stream string
+	maxLen int64
+}
+
+// NewRedisStreamStorage creates a storage writing to the given stream, trimmed to about maxLen entries (0 = unbounded).
+func NewRedisStreamStorage(client *redis.Client, stream string, maxLen int64) *RedisStreamStorage {
+	return &RedisStreamStorage{client: client, stream: stream, maxLen: maxLen}
+}
+
+// Write adds the record to the stream under the "record" field.
+func (s *RedisStreamStorage) Write(ctx context.Context, record *audit.Record) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	// Detach from request cancellation: the audit writer may flush after the request has finished
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), redisWriteTimeout)
+	defer cancel()
+	return s.client.XAdd(writeCtx, &redis.XAddArgs{
+		Stream: s.stream,
+		MaxLen: s.maxLen,
+		Approx: s.maxLen > 0,
+		Values: map[string]interface{}{"record": string(payload)},
+	}).Err()
+}
+
+// Query is not supported by the stream sink; consumers read the stream directly.
+func (s *RedisStreamStorage) Query(_ context.Context, _ *audit.QueryFilter) ([]*audit.Record, error) {
+	return nil, nil
+}
+
+// Close is a no-op because the Redis client belongs to the session store.
+func (s *RedisStreamStorage) Close() error {
+	return nil
+}
+
+// MultiStorage fans every record out to several sinks.
+// A failing sink does not prevent the others from receiving the record.
+type MultiStorage []audit.Storage
+
+// Write writes the record to every sink and joins their errors.
+func (m MultiStorage) Write(ctx context.Context, record *audit.Record) error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Write(ctx, record); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Query returns the records of the first sink that yields any.
+func (m MultiStorage) Query(ctx context.Context, filter *audit.QueryFilter) ([]*audit.Record, error) {
+	for _, s := range m {
+		records, err := s.Query(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			return records, nil
+		}
+	}
+	return nil, nil
+}
+
+// Close closes every sink and joins their errors.
+func (m MultiStorage) Close() error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NewStorageFromConfig builds the audit storage selected by AUDIT_LOG_SINKS.
+//
+// Parameters:
+//   - redisClient: the session Redis client, reused by the redis sink (nil when session storage is in memory)
+//
+// Returns nil storage (no error) when no sink is configured. A redis sink without a client
+// is reported as an error so misconfiguration is visible at startup.
+func NewStorageFromConfig(redisClient *redis.Client) (audit.Storage, error) {
+	format := strings.ToLower(config.AuditLogFormat.String())
+	var sinks MultiStorage
+
+	for _, name := range config.AuditLogSinks.ToList() {
+		switch strings.ToLower(name) {
+		case SinkStdout:
+			sinks = append(sinks, NewWriterStorage(os.Stdout, format))
+		case SinkFile:
+			fileStorage, err := NewFileStorage(
+				config.AuditLogFilePath.String(),
+				format,
+				int64(config.AuditLogFileMaxSizeMB.ToInt())*1024*1024,
+				config.AuditLogFileMaxAge.ToDuration(),
+				config.AuditLogFileMaxBackups.ToInt(),
+			)
+			if err != nil {
+				_ = sinks.Close()
+				return nil, err
+			}
+			sinks = append(sinks, fileStorage)
+		case SinkRedis:
+			if redisClient == nil {
+				_ = sinks.Close()
+				return nil, errors.New("audit log redis sink requires SESSION_STORAGE_ENABLED=true")
+			}
+			sinks = append(sinks, NewRedisStreamStorage(
+				redisClient,
+				config.AuditLogRedisStream.String(),
+				int64(config.AuditLogRedisMaxLen.ToInt()),
+			))
+		}
+	}
+
+	switch len(sinks) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sinks[0], nil
+	default:
+		return sinks, nil
+	}
+}
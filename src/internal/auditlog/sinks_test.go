@@ -0,0 +1,230 @@
+package auditlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	audit "github.com/soulteary/audit-kit"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRecord() *audit.Record {
+	return audit.NewRecord(audit.EventLoginSuccess, audit.ResultSuccess)
+}
+
+func TestFormatRecord_JSON(t *testing.T) {
+	line, err := formatRecord(testRecord(), FormatJSON)
+	require.NoError(t, err)
+	assert.True(t, json.Valid(line))
+	assert.NotContains(t, string(line), "\n")
+}
+
+func TestFormatRecord_Text(t *testing.T) {
+	line, err := formatRecord(testRecord(), FormatText)
+	require.NoError(t, err)
+	assert.False(t, json.Valid(line), "text format should not be JSON")
+	assert.Contains(t, string(line), "=")
+	assert.NotContains(t, string(line), "\n")
+}
+
+func TestFlattenFields(t *testing.T) {
+	out := map[string]string{}
+	flattenFields("", map[string]interface{}{
+		"user_id":  "alice",
+		"empty":    "",
+		"nil":      nil,
+		"count":    float64(3),
+		"metadata": map[string]interface{}{"method": "password"},
+	}, out)
+
+	assert.Equal(t, map[string]string{
+		"user_id":         "alice",
+		"count":           "3",
+		"metadata.method": "password",
+	}, out)
+}
+
+func TestQuoteTextValue(t *testing.T) {
+	assert.Equal(t, "alice", quoteTextValue("alice"))
+	assert.Equal(t, `""`, quoteTextValue(""))
+	assert.Equal(t, `"two words"`, quoteTextValue("two words"))
+	assert.Equal(t, `"a=b"`, quoteTextValue("a=b"))
+}
+
+func TestWriterStorage(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewWriterStorage(&buf, FormatJSON)
+
+	require.NoError(t, s.Write(context.Background(), testRecord()))
+	require.NoError(t, s.Write(context.Background(), testRecord()))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	for _, line := range lines {
+		assert.True(t, json.Valid([]byte(line)))
+	}
+
+	records, err := s.Query(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Nil(t, records)
+	assert.NoError(t, s.Close())
+}
+
+func TestFileStorage_RotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+
+	line, err := formatRecord(testRecord(), FormatJSON)
+	require.NoError(t, err)
+
+	// Room for exactly two lines per file
+	s, err := NewFileStorage(path, FormatJSON, int64(2*(len(line)+1)), 0, 2)
+	require.NoError(t, err)
+
+	clock := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	for i := 0; i < 9; i++ {
+		require.NoError(t, s.Write(context.Background(), testRecord()))
+	}
+	require.NoError(t, s.Close())
+
+	backups, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	assert.Len(t, backups, 2, "old backups should be pruned to maxBackups")
+
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(current), "\n"))
+}
+
+func TestFileStorage_RotatesByAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nested", "audit.log")
+
+	clock := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	s, err := NewFileStorage(path, FormatText, 0, time.Hour, 0)
+	require.NoError(t, err)
+	s.now = func() time.Time { return clock }
+	s.openedAt = clock
+
+	require.NoError(t, s.Write(context.Background(), testRecord()))
+	clock = clock.Add(30 * time.Minute)
+	require.NoError(t, s.Write(context.Background(), testRecord()))
+
+	backups, _ := filepath.Glob(path + ".*")
+	assert.Empty(t, backups)
+
+	clock = clock.Add(time.Hour)
+	require.NoError(t, s.Write(context.Background(), testRecord()))
+
+	backups, _ = filepath.Glob(path + ".*")
+	assert.Len(t, backups, 1)
+	assert.Equal(t, path+".20250101T013000", backups[0])
+	require.NoError(t, s.Close())
+}
+
+func TestFileStorage_Close(t *testing.T) {
+	s, err := NewFileStorage(filepath.Join(t.TempDir(), "audit.log"), FormatJSON, 0, 0, 0)
+	require.NoError(t, err)
+
+	assert.NoError(t, s.Close())
+	assert.NoError(t, s.Close(), "Close should be idempotent")
+	assert.ErrorIs(t, s.Write(context.Background(), testRecord()), os.ErrClosed)
+}
+
+func TestNewFileStorage_EmptyPath(t *testing.T) {
+	_, err := NewFileStorage("", FormatJSON, 0, 0, 0)
+	assert.Error(t, err)
+}
+
+type failingStorage struct {
+	writes int
+	closed bool
+}
+
+func (f *failingStorage) Write(context.Context, *audit.Record) error {
+	f.writes++
+	return errors.New("sink unavailable")
+}
+
+func (f *failingStorage) Query(context.Context, *audit.QueryFilter) ([]*audit.Record, error) {
+	return nil, nil
+}
+
+func (f *failingStorage) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestMultiStorage(t *testing.T) {
+	var buf bytes.Buffer
+	failing := &failingStorage{}
+	m := MultiStorage{failing, NewWriterStorage(&buf, FormatJSON)}
+
+	err := m.Write(context.Background(), testRecord())
+	assert.Error(t, err)
+	assert.Equal(t, 1, failing.writes)
+	assert.NotEmpty(t, buf.String(), "healthy sinks still receive the record")
+
+	assert.NoError(t, m.Close())
+	assert.True(t, failing.closed)
+}
+
+func setAuditSinkConfig(t *testing.T, sinks, path string) {
+	t.Helper()
+	prevSinks, prevPath, prevFormat := config.AuditLogSinks.Value, config.AuditLogFilePath.Value, config.AuditLogFormat.Value
+	t.Cleanup(func() {
+		config.AuditLogSinks.Value = prevSinks
+		config.AuditLogFilePath.Value = prevPath
+		config.AuditLogFormat.Value = prevFormat
+	})
+	config.AuditLogSinks.Value = sinks
+	config.AuditLogFilePath.Value = path
+	config.AuditLogFormat.Value = FormatJSON
+}
+
+func TestNewStorageFromConfig(t *testing.T) {
+	t.Run("no sinks", func(t *testing.T) {
+		setAuditSinkConfig(t, "", "")
+		s, err := NewStorageFromConfig(nil)
+		assert.NoError(t, err)
+		assert.Nil(t, s)
+	})
+
+	t.Run("stdout", func(t *testing.T) {
+		setAuditSinkConfig(t, "stdout", "")
+		s, err := NewStorageFromConfig(nil)
+		require.NoError(t, err)
+		assert.IsType(t, &WriterStorage{}, s)
+	})
+
+	t.Run("stdout and file", func(t *testing.T) {
+		setAuditSinkConfig(t, "STDOUT, file", filepath.Join(t.TempDir(), "audit.log"))
+		s, err := NewStorageFromConfig(nil)
+		require.NoError(t, err)
+		multi, ok := s.(MultiStorage)
+		require.True(t, ok)
+		assert.Len(t, multi, 2)
+		assert.NoError(t, s.Close())
+	})
+
+	t.Run("redis without client", func(t *testing.T) {
+		setAuditSinkConfig(t, "redis", "")
+		s, err := NewStorageFromConfig(nil)
+		assert.Error(t, err)
+		assert.Nil(t, s)
+	})
+}
@@ -9,11 +9,15 @@ import (
 	"time"
 	"unicode"
 
+	fibersession "github.com/gofiber/fiber/v2/middleware/session"
 	"github.com/pquerna/otp/totp"
 	logger "github.com/soulteary/logger-kit"
 	secure "github.com/soulteary/secure-kit"
 	session "github.com/soulteary/session-kit"
 	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/passhash"
+	"github.com/soulteary/stargate/src/internal/totpstore"
+	"github.com/soulteary/stargate/src/internal/users"
 	"github.com/soulteary/warden/pkg/warden"
 )
 
@@ -24,11 +28,18 @@ var log *logger.Logger
 // Note: This constant is kept for backward compatibility. Consider using session-kit's Config.CookieName.
 const SessionCookieName = "stargate_session_id"
 
+const (
+	// AuthTimeSessionKey holds the Unix time (seconds) the session signed in, which
+	// SESSION_ABSOLUTE_TIMEOUT counts from.
+	AuthTimeSessionKey = "auth_time"
+	// LastAccessSessionKey holds the Unix time (seconds) the session was last used, which
+	// SESSION_IDLE_TIMEOUT counts from.
+	LastAccessSessionKey = "last_access_at"
+)
+
 // Re-export session-kit functions for session management.
 // This provides a unified interface for session operations in Stargate.
 var (
-	// Authenticate marks a fiber session as authenticated.
-	Authenticate = session.Authenticate
 	// Unauthenticate destroys a fiber session.
 	Unauthenticate = session.Unauthenticate
 	// IsAuthenticated checks if a fiber session is authenticated.
@@ -63,6 +74,15 @@ var (
 	UpdateLastAccess = session.UpdateLastAccess
 )
 
+// Authenticate marks a fiber session as authenticated and saves it, recording the sign-in time
+// as its auth time and last access.
+func Authenticate(sess *fibersession.Session) error {
+	now := time.Now().Unix()
+	sess.Set(AuthTimeSessionKey, now)
+	sess.Set(LastAccessSessionKey, now)
+	return session.Authenticate(sess)
+}
+
 // GetValidPasswords parses the password configuration and returns the algorithm and list of valid passwords.
 // The configuration format is: "algorithm:pass1|pass2|pass3"
 //
@@ -91,18 +111,41 @@ func GetValidPasswords() (string, []string) {
 		return algorithm, []string{}
 	}
 
+	// bcrypt and PHC hashes are case-sensitive, so they are only trimmed, as is every password in
+	// case-sensitive mode
+	caseSensitive := config.PasswordCaseSensitive.ToBool()
 	passwords := strings.Split(passwordsStr, "|")
 	for k, v := range passwords {
-		normalized := strings.ToUpper(strings.TrimSpace(v))
-		normalized = strings.ReplaceAll(normalized, " ", "")
-		passwords[k] = normalized
+		if caseSensitive || isCaseSensitiveHash(strings.TrimSpace(v)) {
+			passwords[k] = strings.TrimSpace(v)
+		} else {
+			passwords[k] = NormalizePassword(v)
+		}
 	}
 	return algorithm, passwords
 }
 
+// isCaseSensitiveHash reports whether a PASSWORDS entry is a hash format whose case matters:
+// bcrypt ("$2a$...", "$2b$...", "$2y$...") or PHC ("$argon2id$...", ...).
+func isCaseSensitiveHash(value string) bool {
+	if users.IsBcryptHash(value) {
+		return true
+	}
+	_, phc := passhash.Detect(value)
+	return phc
+}
+
+// NormalizePassword converts a password to the form shared passwords are checked in: upper case
+// without spaces.
+func NormalizePassword(password string) string {
+	return strings.ReplaceAll(strings.ToUpper(strings.TrimSpace(password)), " ", "")
+}
+
 // CheckPassword validates a password against the configured valid passwords.
 // It normalizes the input password (uppercase, trim spaces) and checks it against
-// all configured passwords using the configured algorithm.
+// all configured passwords using the configured algorithm; with PASSWORD_CASE_SENSITIVE the
+// password is checked exactly as typed. Every password is checked, so the time taken does not
+// reveal which one matched.
 //
 // Parameters:
 //   - password: The password to check
@@ -122,16 +165,47 @@ func CheckPassword(password string) bool {
 		return false
 	}
 
-	tryToCheck := strings.ToUpper(strings.TrimSpace(password))
-	tryToCheck = strings.ReplaceAll(tryToCheck, " ", "")
+	tryToCheck := password
+	if !config.PasswordCaseSensitive.ToBool() {
+		tryToCheck = NormalizePassword(password)
+	}
 
+	matched := false
 	for _, validPassword := range validPasswords {
 		if algorithmResolver.Check(validPassword, tryToCheck) {
-			return true
+			matched = true
 		}
 	}
 
-	return false
+	return matched
+}
+
+// CheckUserPassword validates the password of a named user from USERS or USERS_FILE. The hash
+// may be of the password as typed or, like shared passwords, of its normalized form; with
+// PASSWORD_CASE_SENSITIVE only the password as typed is checked.
+//
+// Parameters:
+//   - username: The user name (case-sensitive)
+//   - password: The password to check
+//
+// Returns true if the user exists and the password matches its hash, false otherwise.
+func CheckUserPassword(username, password string) bool {
+	db := users.Get()
+	if db == nil || password == "" {
+		return false
+	}
+	user, known := db.Lookup(username)
+	if !known {
+		// Check a dummy hash, so unknown names cannot be told from wrong passwords by timing
+		user = users.Dummy()
+	}
+	resolver, exists := config.SupportedAlgorithms[user.Algorithm]
+	if !exists {
+		return false
+	}
+	matched := resolver.Check(user.Hash, password) ||
+		(!config.PasswordCaseSensitive.ToBool() && resolver.Check(user.Hash, NormalizePassword(password)))
+	return known && matched
 }
 
 // wardenClient is a global instance of the Warden client.
@@ -417,6 +491,30 @@ func VerifyOTP(secret, code string) bool {
 	return true
 }
 
+// VerifyOTPFor verifies a TOTP code like VerifyOTP, and additionally rejects a code whose time
+// step was already used by subject, so a captured code cannot be replayed within its window.
+// Used steps are kept by the replay guard of the totpstore package; without one it behaves like
+// VerifyOTP.
+func VerifyOTPFor(subject, secret, code string) bool {
+	if secret == "" {
+		log.Debug().Msg("OTP secret is empty, cannot verify")
+		return false
+	}
+
+	ok, err := totpstore.VerifyOnce(subject, secret, code)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to record used OTP time step")
+		return false
+	}
+	if !ok {
+		log.Debug().Msg("OTP code verification failed or code was already used")
+		return false
+	}
+
+	log.Debug().Msg("OTP code verified successfully")
+	return true
+}
+
 // GetOTPSecret returns the OTP secret key from configuration.
 // This can be extended to fetch from remote API if needed.
 func GetOTPSecret() string {
@@ -16,6 +16,9 @@ import (
 	"github.com/pquerna/otp/totp"
 	logger "github.com/soulteary/logger-kit"
 	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/passhash"
+	"github.com/soulteary/stargate/src/internal/totpstore"
+	"github.com/soulteary/stargate/src/internal/users"
 	"github.com/valyala/fasthttp"
 )
 
@@ -123,19 +126,18 @@ func TestCheckPassword_Plaintext_Failure(t *testing.T) {
 
 func TestCheckPassword_Bcrypt(t *testing.T) {
 	t.Setenv("AUTH_HOST", "auth.example.com")
-	// Note: GetValidPasswords converts passwords to uppercase, which breaks bcrypt hashes
-	// This test documents the current behavior - bcrypt may not work correctly with current implementation
-	// The hash needs to be in the exact format expected by bcrypt
-	t.Setenv("PASSWORDS", "bcrypt:$2a$10$k8fBIpJInrE70BzYy5rO/OUSt1w2.IX0bWhiMdb2mJEhjheVHDhvK")
+	// bcrypt("HELLO,WORLD!"): bcrypt hashes are case-sensitive, so they are kept as written
+	// while the input is normalized as usual
+	t.Setenv("PASSWORDS", "bcrypt:$2a$04$DaSV6DGUxbgW.xAc.ZfMTeInhVk7y77TXH9e3ZqSMottmOQB1Qjve")
 
 	err := config.Initialize(testLogger())
 	testza.AssertNoError(t, err)
 
-	// The current implementation converts the hash to uppercase, which breaks bcrypt
-	// This is a known limitation - bcrypt hashes should not be case-converted
-	// For now, we test that the function doesn't panic
-	result := CheckPassword("Hello, World!")
-	_ = result // Accept that this may fail due to uppercase conversion issue
+	_, passwords := GetValidPasswords()
+	testza.AssertEqual(t, []string{"$2a$04$DaSV6DGUxbgW.xAc.ZfMTeInhVk7y77TXH9e3ZqSMottmOQB1Qjve"}, passwords)
+
+	testza.AssertTrue(t, CheckPassword("Hello, World!"), "should accept valid bcrypt password")
+	testza.AssertTrue(t, CheckPassword("HELLO,WORLD!"), "should accept valid bcrypt password (normalized)")
 	testza.AssertFalse(t, CheckPassword("wrong"), "should reject invalid password")
 }
 
@@ -175,6 +177,103 @@ func TestCheckPassword_SHA512(t *testing.T) {
 	testza.AssertFalse(t, CheckPassword("wrong"), "should reject invalid password")
 }
 
+func TestCheckPassword_PBKDF2(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	// PBKDF2-SHA256("HUNTER2"), as printed by "stargate hash-password". PHC hashes are
+	// case-sensitive, so unlike other hashes they are not upper-cased.
+	t.Setenv("PASSWORDS", "pbkdf2-sha256:$pbkdf2-sha256$i=1000$c3RhcmdhdGUtc2FsdC0wMg$otDoHWySYj+cDsF/vN8aoJIRdls9GArtDmbjzJOYu1E")
+
+	err := config.Initialize(testLogger())
+	testza.AssertNoError(t, err)
+
+	testza.AssertTrue(t, CheckPassword("hunter 2"))
+	testza.AssertTrue(t, CheckPassword("HUNTER2"))
+	testza.AssertFalse(t, CheckPassword("wrong"))
+
+	// A hash of the password as typed never matches, as the input is normalized
+	t.Setenv("PASSWORDS", "pbkdf2-sha256:$pbkdf2-sha256$i=1000$c3RhcmdhdGUtc2FsdC0wMg$6SO066ashIZJnzg4SolWsCBPppHepd4Mob+y2Swm2Wc")
+	err = config.Initialize(testLogger())
+	testza.AssertNoError(t, err)
+	testza.AssertFalse(t, CheckPassword("Hunter 2"))
+}
+
+func TestCheckPassword_CaseSensitive(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:Hunter 2|correct horse")
+	t.Setenv("PASSWORD_CASE_SENSITIVE", "true")
+
+	err := config.Initialize(testLogger())
+	testza.AssertNoError(t, err)
+
+	testza.AssertTrue(t, CheckPassword("Hunter 2"))
+	testza.AssertTrue(t, CheckPassword("correct horse"))
+	testza.AssertFalse(t, CheckPassword("hunter 2"), "case matters")
+	testza.AssertFalse(t, CheckPassword("Hunter2"), "spaces matter")
+	testza.AssertFalse(t, CheckPassword("HUNTER2"), "the normalized form no longer matches")
+}
+
+func TestCheckUserPassword_CaseSensitive(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORD_CASE_SENSITIVE", "true")
+	t.Setenv("USERS", "alice:plaintext:Secret|bob:plaintext:HUNTER2")
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+
+	db, err := users.Load(config.Users.String(), "")
+	testza.AssertNoError(t, err)
+	users.Init(db)
+	defer users.Init(nil)
+
+	testza.AssertTrue(t, CheckUserPassword("alice", "Secret"))
+	testza.AssertFalse(t, CheckUserPassword("alice", "secret"))
+	testza.AssertTrue(t, CheckUserPassword("bob", "HUNTER2"))
+	testza.AssertFalse(t, CheckUserPassword("bob", "hunter 2"), "no normalized fallback")
+}
+
+func TestCheckUserPassword(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	// alice: MD5("Secret"), a hash of the password as typed; bob: the normalized form, as in PASSWORDS
+	t.Setenv("USERS", "alice:md5:1e6947ac7fb3a9529a9726eb692c8cc5|bob:plaintext:HUNTER2")
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+
+	db, err := users.Load(config.Users.String(), "")
+	testza.AssertNoError(t, err)
+	users.Init(db)
+	defer users.Init(nil)
+
+	testza.AssertTrue(t, CheckUserPassword("alice", "Secret"))
+	testza.AssertFalse(t, CheckUserPassword("alice", "secret"), "hashes of the password as typed are case-sensitive")
+	testza.AssertTrue(t, CheckUserPassword("bob", "hunter 2"), "normalized hashes match like shared passwords")
+	testza.AssertFalse(t, CheckUserPassword("bob", "wrong"))
+	testza.AssertFalse(t, CheckUserPassword("Alice", "Secret"), "user names are case-sensitive")
+	testza.AssertFalse(t, CheckUserPassword("dave", "Secret"), "unknown user")
+	testza.AssertFalse(t, CheckUserPassword("alice", ""))
+
+	users.Init(nil)
+	testza.AssertFalse(t, CheckUserPassword("alice", "Secret"), "no named users configured")
+}
+
+func TestCheckUserPassword_UnknownUserTakesAsLong(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+	hash, err := passhash.Hash(passhash.Argon2id, "Secret")
+	testza.AssertNoError(t, err)
+	db, err := users.New(users.User{Name: "alice", Algorithm: passhash.Argon2id, Hash: hash})
+	testza.AssertNoError(t, err)
+	users.Init(db)
+	defer users.Init(nil)
+	users.Dummy()
+
+	elapsed := func(username string) time.Duration {
+		start := time.Now()
+		testza.AssertFalse(t, CheckUserPassword(username, "wrong"))
+		return time.Since(start)
+	}
+	known := elapsed("alice")
+	unknown := elapsed("dave")
+	// Both run the same argon2id checks; allow for scheduling noise
+	testza.AssertTrue(t, unknown > known/2, "unknown user took", unknown, "known user took", known)
+}
+
 func TestAuthenticate(t *testing.T) {
 	app := fiber.New()
 	store := session.New(session.Config{
@@ -194,6 +293,12 @@ func TestAuthenticate(t *testing.T) {
 	sess2, err := store.Get(ctx)
 	testza.AssertNoError(t, err)
 	testza.AssertTrue(t, IsAuthenticated(sess2), "session should be authenticated")
+
+	// The sign-in time bounds the session lifetime
+	authTime, ok := sess2.Get(AuthTimeSessionKey).(int64)
+	testza.AssertTrue(t, ok)
+	testza.AssertTrue(t, time.Now().Unix()-authTime < 5)
+	testza.AssertEqual(t, authTime, sess2.Get(LastAccessSessionKey))
 }
 
 func TestUnauthenticate(t *testing.T) {
@@ -1509,3 +1614,17 @@ func TestVerifyOTP_EmptyCode(t *testing.T) {
 func TestVerifyOTP_InvalidLength(t *testing.T) {
 	testza.AssertFalse(t, VerifyOTP("JBSWY3DPEHPK3PXP", "12345"))
 }
+
+func TestVerifyOTPFor_RejectsReplay(t *testing.T) {
+	totpstore.InitReplayGuard(totpstore.NewReplayGuard(session.New().Storage))
+	defer totpstore.InitReplayGuard(nil)
+
+	secret := "JBSWY3DPEHPK3PXP"
+	code, err := totp.GenerateCode(secret, time.Now().UTC())
+	testza.AssertNoError(t, err)
+
+	testza.AssertTrue(t, VerifyOTPFor("alice", secret, code))
+	testza.AssertFalse(t, VerifyOTPFor("alice", secret, code))
+	testza.AssertTrue(t, VerifyOTPFor("bob", secret, code))
+	testza.AssertFalse(t, VerifyOTPFor("carol", "", code))
+}
@@ -0,0 +1,305 @@
+// Package bearerjwt validates JWTs issued by an external identity provider and presented to
+// /_auth as Bearer tokens. Verification keys come from a JWKS URL or file and are refreshed in
+// the background, so requests do not wait for the provider once the keys are loaded.
+package bearerjwt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soulteary/stargate/src/internal/jose"
+)
+
+const (
+	// DefaultUserClaim is the claim used as the user ID.
+	DefaultUserClaim = "sub"
+	// DefaultScopesClaim is the claim mapped to the scopes: a space-separated string (RFC 8693
+	// "scope") or an array of strings.
+	DefaultScopesClaim = "scope"
+	// DefaultRoleClaim is the claim mapped to the role.
+	DefaultRoleClaim = "role"
+	// DefaultRefreshInterval is how often the keys are reloaded when no interval is configured.
+	DefaultRefreshInterval = 15 * time.Minute
+	// clockSkew tolerates clock differences between Stargate and the issuer.
+	clockSkew = time.Minute
+	// keysMinRefresh limits reloads triggered by unknown key IDs.
+	keysMinRefresh = time.Minute
+	// maxResponseSize limits JWKS documents.
+	maxResponseSize = 1 << 20
+)
+
+// Errors returned by the validator.
+var (
+	ErrNoKeys       = errors.New("jwks not available")
+	ErrInvalidToken = errors.New("invalid bearer jwt")
+)
+
+// Config configures a Validator. Exactly one of JWKSURL and JWKSFile is set.
+type Config struct {
+	JWKSURL  string
+	JWKSFile string
+	// Issuer is the required "iss"; tokens from other issuers are left to the upstream.
+	Issuer string
+	// Audience must be one of the token's "aud" values.
+	Audience    string
+	UserClaim   string
+	ScopesClaim string
+	RoleClaim   string
+	// RefreshInterval is how often the keys are reloaded (default DefaultRefreshInterval).
+	RefreshInterval time.Duration
+	// HTTPClient fetches JWKSURL (default: 10 second timeout).
+	HTTPClient *http.Client
+}
+
+// Identity is the caller described by a validated token.
+type Identity struct {
+	Subject string
+	// Email is empty when the issuer marks it as not verified.
+	Email  string
+	Name   string
+	Role   string
+	Scopes []string
+	AMR    []string
+	Claims jose.Claims
+}
+
+// Validator checks Bearer JWTs against one issuer. It is safe for concurrent use.
+type Validator struct {
+	cfg  Config
+	http *http.Client
+	now  func() time.Time
+
+	// loadMu serializes key loads; mu guards the loaded keys.
+	loadMu  sync.Mutex
+	mu      sync.RWMutex
+	keys    *jose.JWKS
+	fetched time.Time
+}
+
+// New creates a validator. Keys are loaded by Start or on first use.
+func New(cfg Config) *Validator {
+	if cfg.UserClaim == "" {
+		cfg.UserClaim = DefaultUserClaim
+	}
+	if cfg.ScopesClaim == "" {
+		cfg.ScopesClaim = DefaultScopesClaim
+	}
+	if cfg.RoleClaim == "" {
+		cfg.RoleClaim = DefaultRoleClaim
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = DefaultRefreshInterval
+	}
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Validator{cfg: cfg, http: httpClient, now: time.Now}
+}
+
+// Source describes where the keys come from, for logging.
+func (v *Validator) Source() string {
+	if v.cfg.JWKSFile != "" {
+		return v.cfg.JWKSFile
+	}
+	return v.cfg.JWKSURL
+}
+
+// Issuer returns the accepted issuer.
+func (v *Validator) Issuer() string {
+	return v.cfg.Issuer
+}
+
+// Owns reports whether raw is a JWT naming the configured issuer. The signature is not checked:
+// it only tells /_auth which Bearer tokens are its to validate and which belong to the upstream.
+func (v *Validator) Owns(raw string) bool {
+	token, err := jose.Parse(raw)
+	return err == nil && token.Claims.String("iss") == v.cfg.Issuer
+}
+
+// Refresh reloads the keys. On failure the previously loaded keys stay in use.
+func (v *Validator) Refresh(ctx context.Context) error {
+	v.loadMu.Lock()
+	defer v.loadMu.Unlock()
+	return v.load(ctx)
+}
+
+// load fetches the keys; loadMu must be held.
+func (v *Validator) load(ctx context.Context) error {
+	var (
+		data []byte
+		err  error
+	)
+	if v.cfg.JWKSFile != "" {
+		data, err = os.ReadFile(v.cfg.JWKSFile)
+	} else {
+		data, err = v.fetch(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNoKeys, err)
+	}
+	keys, err := jose.ParseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNoKeys, err)
+	}
+	if len(keys.Keys) == 0 {
+		return fmt.Errorf("%w: empty key set", ErrNoKeys)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	v.fetched = v.now()
+	return nil
+}
+
+// fetch downloads the JWKS document from JWKSURL.
+func (v *Validator) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.cfg.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, v.cfg.JWKSURL)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+}
+
+// Start loads the keys and reloads them every RefreshInterval until ctx is done. Load failures
+// are reported to onError; validation keeps using the last keys loaded.
+func (v *Validator) Start(ctx context.Context, onError func(error)) {
+	report := func(err error) {
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	go func() {
+		report(v.Refresh(ctx))
+		ticker := time.NewTicker(v.cfg.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report(v.Refresh(ctx))
+			}
+		}
+	}()
+}
+
+// keySet returns the loaded keys. Missing keys are loaded now; with refresh the keys are reloaded
+// unless they were loaded less than keysMinRefresh ago.
+func (v *Validator) keySet(ctx context.Context, refresh bool) (*jose.JWKS, error) {
+	v.mu.RLock()
+	keys, fetched := v.keys, v.fetched
+	v.mu.RUnlock()
+	if keys != nil && (!refresh || v.now().Sub(fetched) < keysMinRefresh) {
+		return keys, nil
+	}
+
+	v.loadMu.Lock()
+	defer v.loadMu.Unlock()
+	v.mu.RLock()
+	if v.keys != nil && v.fetched.After(fetched) {
+		// Another request reloaded the keys while this one waited
+		keys = v.keys
+		v.mu.RUnlock()
+		return keys, nil
+	}
+	v.mu.RUnlock()
+
+	if err := v.load(ctx); err != nil {
+		if keys != nil {
+			return keys, nil
+		}
+		return nil, err
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.keys, nil
+}
+
+// Validate checks the signature of raw and its iss, aud, exp and nbf claims, and returns the
+// identity it carries. Tokens without an expiry or a user claim are rejected.
+func (v *Validator) Validate(ctx context.Context, raw string) (*Identity, error) {
+	keys, err := v.keySet(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	token, err := jose.Verify(raw, keys)
+	if errors.Is(err, jose.ErrUnknownKey) {
+		// The issuer may have rotated its keys since the last load
+		if keys, err = v.keySet(ctx, true); err != nil {
+			return nil, err
+		}
+		token, err = jose.Verify(raw, keys)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	claims := token.Claims
+	if err := claims.Validate(jose.Expected{
+		Issuer:        v.cfg.Issuer,
+		Audience:      v.cfg.Audience,
+		Now:           v.now(),
+		Leeway:        clockSkew,
+		RequireExpiry: true,
+	}); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	identity := v.identity(claims)
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidToken, v.cfg.UserClaim)
+	}
+	return identity, nil
+}
+
+// identity maps token claims to an Identity.
+func (v *Validator) identity(claims jose.Claims) *Identity {
+	id := &Identity{
+		Subject: claims.String(v.cfg.UserClaim),
+		Name:    claims.String("name"),
+		Role:    claims.String(v.cfg.RoleClaim),
+		AMR:     claims.Strings("amr"),
+		Claims:  claims,
+	}
+	if scope, ok := claims[v.cfg.ScopesClaim].(string); ok {
+		id.Scopes = strings.Fields(scope)
+	} else {
+		id.Scopes = claims.Strings(v.cfg.ScopesClaim)
+	}
+	if id.Name == "" {
+		id.Name = claims.String("preferred_username")
+	}
+	if verified, ok := claims["email_verified"].(bool); !ok || verified {
+		id.Email = claims.String("email")
+	}
+	return id
+}
+
+var validator *Validator
+
+// Init sets the validator used by /_auth; nil disables Bearer JWT validation.
+func Init(v *Validator) {
+	validator = v
+}
+
+// Get returns the validator, or nil when Bearer JWT validation is disabled.
+func Get() *Validator {
+	return validator
+}
@@ -0,0 +1,194 @@
+package bearerjwt
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+
+	"github.com/soulteary/stargate/src/internal/jose"
+	"github.com/soulteary/stargate/src/internal/keyring"
+	"github.com/soulteary/stargate/src/internal/oidc/oidctest"
+)
+
+const testAudience = "https://api.example.com"
+
+func newTestIssuer(t *testing.T) (*oidctest.Server, *Validator) {
+	t.Helper()
+	issuer := oidctest.NewServer("stargate", "")
+	t.Cleanup(issuer.Close)
+	return issuer, New(Config{
+		JWKSURL:  issuer.URL + "/jwks",
+		Issuer:   issuer.Issuer(),
+		Audience: testAudience,
+	})
+}
+
+// accessToken returns claims for a valid token from issuer, with extra merged in.
+func accessToken(issuer string, extra map[string]interface{}) map[string]interface{} {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": issuer,
+		"sub": "svc-billing",
+		"aud": testAudience,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return claims
+}
+
+func TestValidate(t *testing.T) {
+	issuer, v := newTestIssuer(t)
+	raw := issuer.SignIDToken(accessToken(issuer.Issuer(), map[string]interface{}{
+		"scope": "read write",
+		"role":  "service",
+		"email": "billing@example.com",
+		"amr":   []string{"mfa"},
+	}))
+
+	testza.AssertTrue(t, v.Owns(raw))
+	identity, err := v.Validate(context.Background(), raw)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "svc-billing", identity.Subject)
+	testza.AssertEqual(t, "service", identity.Role)
+	testza.AssertEqual(t, "billing@example.com", identity.Email)
+	testza.AssertEqual(t, []string{"read", "write"}, identity.Scopes)
+	testza.AssertEqual(t, []string{"mfa"}, identity.AMR)
+}
+
+func TestValidate_ClaimMapping(t *testing.T) {
+	issuer := oidctest.NewServer("stargate", "")
+	defer issuer.Close()
+	v := New(Config{
+		JWKSURL:     issuer.URL + "/jwks",
+		Issuer:      issuer.Issuer(),
+		Audience:    testAudience,
+		UserClaim:   "client_id",
+		ScopesClaim: "scp",
+		RoleClaim:   "tier",
+	})
+	raw := issuer.SignIDToken(accessToken(issuer.Issuer(), map[string]interface{}{
+		"client_id":      "ci-runner",
+		"scp":            []string{"deploy"},
+		"tier":           "gold",
+		"email":          "ci@example.com",
+		"email_verified": false,
+	}))
+
+	identity, err := v.Validate(context.Background(), raw)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "ci-runner", identity.Subject)
+	testza.AssertEqual(t, []string{"deploy"}, identity.Scopes)
+	testza.AssertEqual(t, "gold", identity.Role)
+	testza.AssertEqual(t, "", identity.Email)
+}
+
+func TestValidate_Rejects(t *testing.T) {
+	issuer, v := newTestIssuer(t)
+	past := time.Now().Add(-time.Hour).Unix()
+	future := time.Now().Add(time.Hour).Unix()
+
+	for name, claims := range map[string]map[string]interface{}{
+		"wrong audience": accessToken(issuer.Issuer(), map[string]interface{}{"aud": "https://other.example.com"}),
+		"wrong issuer":   accessToken("https://other.example.com", nil),
+		"expired":        accessToken(issuer.Issuer(), map[string]interface{}{"exp": past}),
+		"not yet valid":  accessToken(issuer.Issuer(), map[string]interface{}{"nbf": future}),
+		"no expiry":      accessToken(issuer.Issuer(), map[string]interface{}{"exp": nil}),
+		"no subject":     accessToken(issuer.Issuer(), map[string]interface{}{"sub": ""}),
+	} {
+		_, err := v.Validate(context.Background(), issuer.SignIDToken(claims))
+		testza.AssertErrorIs(t, err, ErrInvalidToken, name)
+	}
+
+	// Signed by a key the issuer never published
+	key, err := keyring.Generate(jose.ES256)
+	testza.AssertNoError(t, err)
+	forged, err := keyring.New(key).Sign(accessToken(issuer.Issuer(), nil))
+	testza.AssertNoError(t, err)
+	_, err = v.Validate(context.Background(), forged)
+	testza.AssertErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestValidate_ReloadsOnKeyRotation(t *testing.T) {
+	issuer, v := newTestIssuer(t)
+	testza.AssertNoError(t, v.Refresh(context.Background()))
+
+	issuer.RotateKey()
+	// Unknown key IDs reload the keys, but not more than once per keysMinRefresh
+	v.now = func() time.Time { return time.Now().Add(keysMinRefresh) }
+	_, err := v.Validate(context.Background(), issuer.SignIDToken(accessToken(issuer.Issuer(), nil)))
+	testza.AssertNoError(t, err)
+
+	issuer.RotateKey()
+	_, err = v.Validate(context.Background(), issuer.SignIDToken(accessToken(issuer.Issuer(), nil)))
+	testza.AssertErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestValidate_KeepsKeysWhenIssuerUnreachable(t *testing.T) {
+	issuer, v := newTestIssuer(t)
+	testza.AssertNoError(t, v.Refresh(context.Background()))
+	raw := issuer.SignIDToken(accessToken(issuer.Issuer(), nil))
+	issuer.Close()
+
+	testza.AssertErrorIs(t, v.Refresh(context.Background()), ErrNoKeys)
+	_, err := v.Validate(context.Background(), raw)
+	testza.AssertNoError(t, err)
+}
+
+func TestValidate_NoKeys(t *testing.T) {
+	v := New(Config{JWKSURL: "http://127.0.0.1:1/jwks", Issuer: "https://idp.example.com"})
+	_, err := v.Validate(context.Background(), "a.b.c")
+	testza.AssertErrorIs(t, err, ErrNoKeys)
+}
+
+func TestValidate_JWKSFile(t *testing.T) {
+	key, err := keyring.Generate(jose.EdDSA)
+	testza.AssertNoError(t, err)
+	ring := keyring.New(key)
+	data, err := json.Marshal(ring.JWKS())
+	testza.AssertNoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	testza.AssertNoError(t, os.WriteFile(path, data, 0o600))
+
+	v := New(Config{JWKSFile: path, Issuer: "https://idp.example.com", Audience: testAudience})
+	testza.AssertEqual(t, path, v.Source())
+	raw, err := ring.Sign(accessToken("https://idp.example.com", nil))
+	testza.AssertNoError(t, err)
+	identity, err := v.Validate(context.Background(), raw)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "svc-billing", identity.Subject)
+
+	testza.AssertNoError(t, os.WriteFile(path, []byte(`{"keys":[]}`), 0o600))
+	testza.AssertErrorIs(t, v.Refresh(context.Background()), ErrNoKeys)
+}
+
+func TestOwns(t *testing.T) {
+	v := New(Config{Issuer: "https://idp.example.com"})
+	key, err := keyring.Generate(jose.ES256)
+	testza.AssertNoError(t, err)
+	ring := keyring.New(key)
+
+	ours, err := ring.Sign(map[string]interface{}{"iss": "https://idp.example.com"})
+	testza.AssertNoError(t, err)
+	theirs, err := ring.Sign(map[string]interface{}{"iss": "https://upstream.example.com"})
+	testza.AssertNoError(t, err)
+
+	testza.AssertTrue(t, v.Owns(ours))
+	testza.AssertFalse(t, v.Owns(theirs))
+	testza.AssertFalse(t, v.Owns("opaque-token"))
+}
+
+func TestInit(t *testing.T) {
+	testza.AssertNil(t, Get())
+	v := New(Config{})
+	Init(v)
+	defer Init(nil)
+	testza.AssertEqual(t, v, Get())
+}
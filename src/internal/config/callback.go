@@ -0,0 +1,111 @@
+package config
+
+import (
+	"net"
+	"strings"
+)
+
+// CallbackAllowlist decides which hosts may receive a session after login.
+//
+// Entries are either exact host names ("app.example.com"), wildcards matching any
+// subdomain ("*.example.com"), or cookie-style domains matching the domain itself
+// and its subdomains (".example.com"). Ports are ignored and matching is case-insensitive.
+type CallbackAllowlist struct {
+	exact    map[string]bool
+	suffixes []string // ".example.com" matches subdomains of example.com
+	apexes   map[string]bool
+}
+
+var callbackAllowlist *CallbackAllowlist
+
+// InitCallbackAllowlist builds the callback allowlist from CALLBACK_ALLOWED_DOMAINS.
+//
+// When CALLBACK_ALLOWED_DOMAINS is empty, it defaults to the COOKIE_DOMAIN suffix; when that is
+// empty too, to the domain AUTH_HOST lives under (auth.example.com -> .example.com).
+// AUTH_HOST itself is always allowed.
+func InitCallbackAllowlist() {
+	entries := CallbackAllowedDomains.ToList()
+	if len(entries) == 0 {
+		if CookieDomain.Value != "" {
+			entries = []string{"." + strings.TrimPrefix(CookieDomain.Value, ".")}
+		} else if parent := parentDomain(AuthHost.Value); parent != "" {
+			entries = []string{"." + parent}
+		}
+	}
+	callbackAllowlist = NewCallbackAllowlist(append(entries, AuthHost.Value)...)
+}
+
+// GetCallbackAllowlist returns the callback allowlist instance
+func GetCallbackAllowlist() *CallbackAllowlist {
+	if callbackAllowlist == nil {
+		InitCallbackAllowlist()
+	}
+	return callbackAllowlist
+}
+
+// NewCallbackAllowlist creates an allowlist from domain entries.
+func NewCallbackAllowlist(entries ...string) *CallbackAllowlist {
+	a := &CallbackAllowlist{
+		exact:  make(map[string]bool),
+		apexes: make(map[string]bool),
+	}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case strings.HasPrefix(entry, "*."):
+			a.suffixes = append(a.suffixes, entry[1:])
+		case strings.HasPrefix(entry, "."):
+			a.suffixes = append(a.suffixes, entry)
+			a.apexes[entry[1:]] = true
+		default:
+			a.exact[hostname(entry)] = true
+		}
+	}
+	return a
+}
+
+// Allows reports whether host (optionally with a port) is on the allowlist.
+func (a *CallbackAllowlist) Allows(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(hostname(host)), ".")
+	if host == "" {
+		return false
+	}
+	if a.exact[host] || a.apexes[host] {
+		return true
+	}
+	for _, suffix := range a.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostname strips an optional port from host.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// parentDomain returns the domain that AUTH_HOST lives under: host without its first label
+// ("auth.example.com" -> "example.com"), host itself for two-label names, or "" for IP
+// addresses and single labels such as "localhost".
+func parentDomain(host string) string {
+	host = strings.ToLower(hostname(strings.TrimSpace(host)))
+	if host == "" || net.ParseIP(host) != nil {
+		return ""
+	}
+	labels := strings.Split(host, ".")
+	switch {
+	case len(labels) < 2:
+		return ""
+	case len(labels) == 2:
+		return host
+	default:
+		return strings.Join(labels[1:], ".")
+	}
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+)
+
+func TestCallbackAllowlist_Allows(t *testing.T) {
+	a := NewCallbackAllowlist("app.example.com", "*.internal.example.org", ".example.net")
+
+	tests := []struct {
+		host     string
+		expected bool
+	}{
+		{"app.example.com", true},
+		{"APP.example.com:8443", true},
+		{"other.example.com", false},
+		{"x.internal.example.org", true},
+		{"a.b.internal.example.org", true},
+		{"internal.example.org", false}, // wildcard does not match the apex
+		{"example.net", true},
+		{"www.example.net", true},
+		{"evilexample.net", false},
+		{"example.net.evil.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			testza.AssertEqual(t, tt.expected, a.Allows(tt.host))
+		})
+	}
+}
+
+func TestInitCallbackAllowlist_DefaultsToCookieDomain(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("COOKIE_DOMAIN", ".example.org")
+	t.Setenv("CALLBACK_ALLOWED_DOMAINS", "")
+
+	err := Initialize(testLogger())
+	testza.AssertNoError(t, err)
+
+	a := GetCallbackAllowlist()
+	testza.AssertTrue(t, a.Allows("auth.example.com"), "auth host is always allowed")
+	testza.AssertTrue(t, a.Allows("app.example.org"))
+	testza.AssertFalse(t, a.Allows("app.example.com"))
+}
+
+func TestInitCallbackAllowlist_DefaultsToAuthHostDomain(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("COOKIE_DOMAIN", "")
+	t.Setenv("CALLBACK_ALLOWED_DOMAINS", "")
+
+	err := Initialize(testLogger())
+	testza.AssertNoError(t, err)
+
+	a := GetCallbackAllowlist()
+	testza.AssertTrue(t, a.Allows("app.example.com"))
+	testza.AssertTrue(t, a.Allows("example.com"))
+	testza.AssertFalse(t, a.Allows("evil.com"))
+}
+
+func TestInitCallbackAllowlist_Explicit(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("COOKIE_DOMAIN", ".example.com")
+	t.Setenv("CALLBACK_ALLOWED_DOMAINS", "app.example.com, *.apps.example.org")
+
+	err := Initialize(testLogger())
+	testza.AssertNoError(t, err)
+
+	a := GetCallbackAllowlist()
+	testza.AssertTrue(t, a.Allows("auth.example.com"))
+	testza.AssertTrue(t, a.Allows("app.example.com"))
+	testza.AssertTrue(t, a.Allows("grafana.apps.example.org"))
+	testza.AssertFalse(t, a.Allows("other.example.com"), "explicit list replaces the COOKIE_DOMAIN default")
+}
+
+func TestParentDomain(t *testing.T) {
+	testza.AssertEqual(t, "example.com", parentDomain("auth.example.com"))
+	testza.AssertEqual(t, "example.com", parentDomain("auth.example.com:8443"))
+	testza.AssertEqual(t, "example.com", parentDomain("example.com"))
+	testza.AssertEqual(t, "", parentDomain("localhost"))
+	testza.AssertEqual(t, "", parentDomain("10.0.0.1"))
+}
@@ -7,13 +7,15 @@ import (
 	logger "github.com/soulteary/logger-kit"
 
 	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/users"
+	"github.com/soulteary/stargate/src/internal/webauthn"
 )
 
 // log is the package-level logger instance
 var log *logger.Logger
 
-// SessionExpiration is the session expiration time
-const SessionExpiration = 24 * time.Hour
+// DefaultSessionLifetime is the absolute session lifetime when SESSION_ABSOLUTE_TIMEOUT is empty.
+const DefaultSessionLifetime = 24 * time.Hour
 
 var (
 	Debug = EnvVariable{
@@ -50,12 +52,39 @@ var (
 
 	Passwords = EnvVariable{
 		Name:           "PASSWORDS",
-		Required:       false, // Required only when WardenEnabled=false; see Initialize()
+		Required:       false, // Required only when WardenEnabled and OIDCEnabled are false and no named users are set; see Initialize()
 		DefaultValue:   "",
 		PossibleValues: []string{"algorithm:pass1|pass2|pass3"},
 		Validator:      ValidatePasswordsOrEmpty,
 	}
 
+	// Users lists named accounts for password logins and HTTP Basic authentication
+	Users = EnvVariable{
+		Name:           "USERS",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"name:hash|name:hash"},
+		Validator:      ValidateUsers,
+	}
+
+	// UsersFile is an htpasswd-style file of named accounts ("name:hash" per line)
+	UsersFile = EnvVariable{
+		Name:           "USERS_FILE",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"path"},
+		Validator:      ValidateUsersFile,
+	}
+
+	// PasswordCaseSensitive compares passwords exactly as typed instead of upper-cased without spaces
+	PasswordCaseSensitive = EnvVariable{
+		Name:           "PASSWORD_CASE_SENSITIVE",
+		Required:       false,
+		DefaultValue:   "false",
+		PossibleValues: []string{"true", "false"},
+		Validator:      ValidateCaseInsensitivePossibleValues,
+	}
+
 	UserHeaderName = EnvVariable{
 		Name:           "USER_HEADER_NAME",
 		Required:       false,
@@ -72,6 +101,26 @@ var (
 		Validator:      ValidateAny, // Empty value is also valid (means not setting domain)
 	}
 
+	// CallbackAllowedDomains lists hosts that may receive a session after login
+	// (e.g. "app.example.com,*.internal.example.com"); empty defaults to the COOKIE_DOMAIN suffix
+	CallbackAllowedDomains = EnvVariable{
+		Name:           "CALLBACK_ALLOWED_DOMAINS",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"host", "*.domain", ".domain"},
+		Validator:      ValidateCallbackDomains,
+	}
+
+	// TrustedProxies lists the reverse proxies (IPs or CIDRs, e.g. "10.0.0.0/8,192.168.1.10") whose
+	// X-Forwarded-* and Forwarded headers are honored; empty trusts loopback and private networks only
+	TrustedProxies = EnvVariable{
+		Name:           "TRUSTED_PROXIES",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"ip", "cidr"},
+		Validator:      ValidateTrustedProxies,
+	}
+
 	Language = EnvVariable{
 		Name:           "LANGUAGE",
 		Required:       false,
@@ -212,6 +261,405 @@ var (
 		Validator:      ValidateCaseInsensitivePossibleValues,
 	}
 
+	// TOTPEnabled keeps per-user TOTP secrets in Stargate, for deployments without Herald TOTP
+	TOTPEnabled = EnvVariable{
+		Name:           "TOTP_ENABLED",
+		Required:       false,
+		DefaultValue:   "false",
+		PossibleValues: []string{"true", "false"},
+		Validator:      ValidateCaseInsensitivePossibleValues,
+	}
+
+	// TOTPEncryptionKey encrypts the stored TOTP secrets: 32 random bytes, base64-encoded
+	TOTPEncryptionKey = EnvVariable{
+		Name:           "TOTP_ENCRYPTION_KEY",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"base64 (32 bytes)"},
+		Validator:      ValidateTOTPEncryptionKey,
+	}
+
+	// TOTPFile stores the TOTP secrets in a JSON file; empty uses the Redis session storage
+	TOTPFile = EnvVariable{
+		Name:           "TOTP_FILE",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"path"},
+		Validator:      ValidateStoreFile,
+	}
+
+	// OIDCEnabled turns on login through an upstream OpenID Connect provider (auth_method=oidc)
+	OIDCEnabled = EnvVariable{
+		Name:           "OIDC_ENABLED",
+		Required:       false,
+		DefaultValue:   "false",
+		PossibleValues: []string{"true", "false"},
+		Validator:      ValidateCaseInsensitivePossibleValues,
+	}
+
+	// OIDCIssuerURL is the provider issuer; discovery is read from {issuer}/.well-known/openid-configuration
+	OIDCIssuerURL = EnvVariable{
+		Name:           "OIDC_ISSUER_URL",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"url"},
+		Validator:      ValidateURLOrEmpty,
+	}
+
+	OIDCClientID = EnvVariable{
+		Name:           "OIDC_CLIENT_ID",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateAny,
+	}
+
+	// OIDCClientSecret is sent with client_secret_basic; leave empty for a public client (PKCE only)
+	OIDCClientSecret = EnvVariable{
+		Name:           "OIDC_CLIENT_SECRET",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateAny,
+	}
+
+	// OIDCRedirectURL is the callback registered with the provider; empty uses https://{AUTH_HOST}/_oidc/callback
+	OIDCRedirectURL = EnvVariable{
+		Name:           "OIDC_REDIRECT_URL",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"url"},
+		Validator:      ValidateURLOrEmpty,
+	}
+
+	OIDCScopes = EnvVariable{
+		Name:           "OIDC_SCOPES",
+		Required:       false,
+		DefaultValue:   "openid,profile,email",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateAny,
+	}
+
+	// OIDCGroupsClaim is the ID token claim stored as the session scopes (X-Auth-Scopes)
+	OIDCGroupsClaim = EnvVariable{
+		Name:           "OIDC_GROUPS_CLAIM",
+		Required:       false,
+		DefaultValue:   "groups",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateAny,
+	}
+
+	// OIDCProviderName is shown on the login page button ("Sign in with ...")
+	OIDCProviderName = EnvVariable{
+		Name:           "OIDC_PROVIDER_NAME",
+		Required:       false,
+		DefaultValue:   "SSO",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateAny,
+	}
+
+	// IDPEnabled makes Stargate an OpenID Connect provider for the clients in IDP_CLIENTS_FILE
+	IDPEnabled = EnvVariable{
+		Name:           "IDP_ENABLED",
+		Required:       false,
+		DefaultValue:   "false",
+		PossibleValues: []string{"true", "false"},
+		Validator:      ValidateCaseInsensitivePossibleValues,
+	}
+
+	// IDPClientsFile is the YAML/JSON registry of relying parties (id, secret, redirect_uris)
+	IDPClientsFile = EnvVariable{
+		Name:           "IDP_CLIENTS_FILE",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"path"},
+		Validator:      ValidateIDPClientsFile,
+	}
+
+	// IDPIssuer is the issuer of ID tokens; empty uses https://{AUTH_HOST}
+	IDPIssuer = EnvVariable{
+		Name:           "IDP_ISSUER",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"url"},
+		Validator:      ValidateURLOrEmpty,
+	}
+
+	// IDPTokenTTL is the lifetime of ID and access tokens issued to clients
+	IDPTokenTTL = EnvVariable{
+		Name:           "IDP_TOKEN_TTL",
+		Required:       false,
+		DefaultValue:   "1h",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateDurationOrEmpty,
+	}
+
+	// AuthJWTEnabled makes /_auth forward a signed identity JWT in AUTH_JWT_HEADER
+	AuthJWTEnabled = EnvVariable{
+		Name:           "AUTH_JWT_ENABLED",
+		Required:       false,
+		DefaultValue:   "false",
+		PossibleValues: []string{"true", "false"},
+		Validator:      ValidateCaseInsensitivePossibleValues,
+	}
+
+	// AuthJWTHeader is the response header carrying the identity JWT
+	AuthJWTHeader = EnvVariable{
+		Name:           "AUTH_JWT_HEADER",
+		Required:       false,
+		DefaultValue:   "X-Auth-JWT",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateNotEmptyString,
+	}
+
+	// AuthJWTTTL is the lifetime of the identity JWT; keep it short, it is minted on every /_auth request
+	AuthJWTTTL = EnvVariable{
+		Name:           "AUTH_JWT_TTL",
+		Required:       false,
+		DefaultValue:   "5m",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateDurationOrEmpty,
+	}
+
+	// AuthJWTIssuer is the "iss" of the identity JWT; empty uses https://{AUTH_HOST}
+	AuthJWTIssuer = EnvVariable{
+		Name:           "AUTH_JWT_ISSUER",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"url"},
+		Validator:      ValidateURLOrEmpty,
+	}
+
+	// APITokensEnabled lets users mint personal access tokens accepted as Bearer tokens by /_auth
+	APITokensEnabled = EnvVariable{
+		Name:           "API_TOKENS_ENABLED",
+		Required:       false,
+		DefaultValue:   "false",
+		PossibleValues: []string{"true", "false"},
+		Validator:      ValidateCaseInsensitivePossibleValues,
+	}
+
+	// APITokensFile stores the hashed tokens in a JSON file; empty uses the Redis session storage
+	APITokensFile = EnvVariable{
+		Name:           "API_TOKENS_FILE",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"path"},
+		Validator:      ValidateAPITokensFile,
+	}
+
+	// APITokensMaxTTL is the longest lifetime a user can give a token
+	APITokensMaxTTL = EnvVariable{
+		Name:           "API_TOKENS_MAX_TTL",
+		Required:       false,
+		DefaultValue:   "2160h",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateDurationOrEmpty,
+	}
+
+	// PasskeysEnabled lets users register passkeys (WebAuthn) for login and step-up
+	PasskeysEnabled = EnvVariable{
+		Name:           "PASSKEYS_ENABLED",
+		Required:       false,
+		DefaultValue:   "false",
+		PossibleValues: []string{"true", "false"},
+		Validator:      ValidateCaseInsensitivePossibleValues,
+	}
+
+	// PasskeysRPID is the WebAuthn relying party ID; empty uses the host name of AUTH_HOST
+	PasskeysRPID = EnvVariable{
+		Name:           "PASSKEYS_RP_ID",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"domain"},
+		Validator:      ValidateRPIDOrEmpty,
+	}
+
+	// PasskeysRPName is the relying party name browsers show; empty uses LOGIN_PAGE_TITLE
+	PasskeysRPName = EnvVariable{
+		Name:           "PASSKEYS_RP_NAME",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateAny,
+	}
+
+	// PasskeysOrigins are the page origins passkey ceremonies may run on; empty uses https://{AUTH_HOST}
+	PasskeysOrigins = EnvVariable{
+		Name:           "PASSKEYS_ORIGINS",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"https://auth.example.com,..."},
+		Validator:      ValidateOrigins,
+	}
+
+	// PasskeysUserVerification asks authenticators for a PIN or biometric check
+	PasskeysUserVerification = EnvVariable{
+		Name:           "PASSKEYS_USER_VERIFICATION",
+		Required:       false,
+		DefaultValue:   "preferred",
+		PossibleValues: []string{"required", "preferred", "discouraged"},
+		Validator:      ValidateCaseInsensitivePossibleValues,
+	}
+
+	// PasskeysFile stores the passkeys in a JSON file; empty uses the Redis session storage
+	PasskeysFile = EnvVariable{
+		Name:           "PASSKEYS_FILE",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"path"},
+		Validator:      ValidateStoreFile,
+	}
+
+	// BearerJWTEnabled makes /_auth accept JWTs from an external issuer as Bearer tokens
+	BearerJWTEnabled = EnvVariable{
+		Name:           "BEARER_JWT_ENABLED",
+		Required:       false,
+		DefaultValue:   "false",
+		PossibleValues: []string{"true", "false"},
+		Validator:      ValidateCaseInsensitivePossibleValues,
+	}
+
+	// BearerJWTJWKSURL is where the issuer publishes its verification keys
+	BearerJWTJWKSURL = EnvVariable{
+		Name:           "BEARER_JWT_JWKS_URL",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"url"},
+		Validator:      ValidateURLOrEmpty,
+	}
+
+	// BearerJWTJWKSFile is a local copy of the issuer's verification keys, used instead of BEARER_JWT_JWKS_URL
+	BearerJWTJWKSFile = EnvVariable{
+		Name:           "BEARER_JWT_JWKS_FILE",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"path"},
+		Validator:      ValidateJWKSFile,
+	}
+
+	// BearerJWTIssuer is the required "iss"; Bearer JWTs naming another issuer are left to the upstream
+	BearerJWTIssuer = EnvVariable{
+		Name:           "BEARER_JWT_ISSUER",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateAny,
+	}
+
+	// BearerJWTAudience must be one of the token's "aud" values
+	BearerJWTAudience = EnvVariable{
+		Name:           "BEARER_JWT_AUDIENCE",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateAny,
+	}
+
+	// BearerJWTUserClaim is the claim forwarded as the user ID (X-Auth-User)
+	BearerJWTUserClaim = EnvVariable{
+		Name:           "BEARER_JWT_USER_CLAIM",
+		Required:       false,
+		DefaultValue:   "sub",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateNotEmptyString,
+	}
+
+	// BearerJWTScopesClaim is the claim forwarded as the scopes (X-Auth-Scopes): a space-separated string or an array
+	BearerJWTScopesClaim = EnvVariable{
+		Name:           "BEARER_JWT_SCOPES_CLAIM",
+		Required:       false,
+		DefaultValue:   "scope",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateNotEmptyString,
+	}
+
+	// BearerJWTRoleClaim is the claim forwarded as the role (X-Auth-Role)
+	BearerJWTRoleClaim = EnvVariable{
+		Name:           "BEARER_JWT_ROLE_CLAIM",
+		Required:       false,
+		DefaultValue:   "role",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateNotEmptyString,
+	}
+
+	// BearerJWTJWKSRefresh is how often the verification keys are reloaded in the background
+	BearerJWTJWKSRefresh = EnvVariable{
+		Name:           "BEARER_JWT_JWKS_REFRESH",
+		Required:       false,
+		DefaultValue:   "15m",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateDurationOrEmpty,
+	}
+
+	// SigningKeyFiles lists PEM private keys for signing tokens; the first signs, the others stay
+	// published in the JWKS. Empty generates a key at startup (per instance).
+	SigningKeyFiles = EnvVariable{
+		Name:           "SIGNING_KEY_FILES",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"path"},
+		Validator:      ValidateSigningKeyFiles,
+	}
+
+	// SigningKeyAlgorithm is the algorithm of generated signing keys
+	SigningKeyAlgorithm = EnvVariable{
+		Name:           "SIGNING_KEY_ALGORITHM",
+		Required:       false,
+		DefaultValue:   "ES256",
+		PossibleValues: []string{"ES256", "EdDSA", "RS256"},
+		Validator:      ValidateStrictPossibleValues,
+	}
+
+	// SigningKeyRotation replaces generated signing keys at this interval (0 = never); keep it
+	// longer than IDP_TOKEN_TTL and AUTH_JWT_TTL so the previous key covers every live token
+	SigningKeyRotation = EnvVariable{
+		Name:           "SIGNING_KEY_ROTATION",
+		Required:       false,
+		DefaultValue:   "24h",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateDurationOrEmpty,
+	}
+
+	// SessionAbsoluteTimeout is how long a session lasts after login, however active it is; it is
+	// also the lifetime of the session cookie and of the stored session
+	SessionAbsoluteTimeout = EnvVariable{
+		Name:           "SESSION_ABSOLUTE_TIMEOUT",
+		Required:       false,
+		DefaultValue:   "24h",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateDurationOrEmpty,
+	}
+
+	// SessionIdleTimeout ends a session unused for this long; empty or 0 disables it
+	SessionIdleTimeout = EnvVariable{
+		Name:           "SESSION_IDLE_TIMEOUT",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateDurationOrEmpty,
+	}
+
+	// SessionHostTimeouts shortens the timeouts for sensitive hosts, as a comma-separated list of
+	// host=idle[/absolute] entries (e.g. "admin.example.com=15m/4h,*.billing.example.com=5m")
+	SessionHostTimeouts = EnvVariable{
+		Name:           "SESSION_HOST_TIMEOUTS",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"host=idle", "host=idle/absolute"},
+		Validator:      ValidateSessionHostTimeouts,
+	}
+
+	// SingleLogoutEnabled makes /_logout clear the session cookie on every domain the session was
+	// exchanged to, redirecting through each domain's /_session_exchange with a one-time logout token
+	SingleLogoutEnabled = EnvVariable{
+		Name:           "SINGLE_LOGOUT_ENABLED",
+		Required:       false,
+		DefaultValue:   "false",
+		PossibleValues: []string{"true", "false"},
+		Validator:      ValidateCaseInsensitivePossibleValues,
+	}
+
 	SessionStorageEnabled = EnvVariable{
 		Name:           "SESSION_STORAGE_ENABLED",
 		Required:       false,
@@ -268,6 +716,69 @@ var (
 		Validator:      ValidateCaseInsensitivePossibleValues,
 	}
 
+	// AuditLogSinks selects where audit records are written: comma-separated list of stdout, file, redis.
+	// Empty disables persistence (records are dropped by a no-op storage).
+	AuditLogSinks = EnvVariable{
+		Name:           "AUDIT_LOG_SINKS",
+		Required:       false,
+		DefaultValue:   "stdout",
+		PossibleValues: []string{"stdout", "file", "redis"},
+		Validator:      ValidateAuditLogSinks,
+	}
+
+	AuditLogFilePath = EnvVariable{
+		Name:           "AUDIT_LOG_FILE_PATH",
+		Required:       false,
+		DefaultValue:   "./logs/audit.log",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateAny,
+	}
+
+	// AuditLogFileMaxSizeMB rotates the audit file once it grows beyond this size (megabytes, 0 = no size rotation)
+	AuditLogFileMaxSizeMB = EnvVariable{
+		Name:           "AUDIT_LOG_FILE_MAX_SIZE_MB",
+		Required:       false,
+		DefaultValue:   "100",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateNonNegativeInteger,
+	}
+
+	// AuditLogFileMaxAge rotates the audit file once it has been open longer than this duration (empty = no time rotation)
+	AuditLogFileMaxAge = EnvVariable{
+		Name:           "AUDIT_LOG_FILE_MAX_AGE",
+		Required:       false,
+		DefaultValue:   "24h",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateDurationOrEmpty,
+	}
+
+	// AuditLogFileMaxBackups is the number of rotated audit files to keep (0 = keep all)
+	AuditLogFileMaxBackups = EnvVariable{
+		Name:           "AUDIT_LOG_FILE_MAX_BACKUPS",
+		Required:       false,
+		DefaultValue:   "30",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateNonNegativeInteger,
+	}
+
+	// AuditLogRedisStream is the Redis stream key used by the redis sink (reuses the session Redis client)
+	AuditLogRedisStream = EnvVariable{
+		Name:           "AUDIT_LOG_REDIS_STREAM",
+		Required:       false,
+		DefaultValue:   "stargate:audit",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateNotEmptyString,
+	}
+
+	// AuditLogRedisMaxLen caps the Redis stream length (approximate trimming, 0 = unbounded)
+	AuditLogRedisMaxLen = EnvVariable{
+		Name:           "AUDIT_LOG_REDIS_MAX_LEN",
+		Required:       false,
+		DefaultValue:   "100000",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateNonNegativeInteger,
+	}
+
 	StepUpEnabled = EnvVariable{
 		Name:           "STEP_UP_ENABLED",
 		Required:       false,
@@ -284,6 +795,97 @@ var (
 		Validator:      ValidateAny,
 	}
 
+	// StepUpMaxAge is how long a completed step-up stays valid (e.g. "15m"); 0 keeps it for the whole session
+	StepUpMaxAge = EnvVariable{
+		Name:           "STEP_UP_MAX_AGE",
+		Required:       false,
+		DefaultValue:   "15m",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateDurationOrEmpty,
+	}
+
+	// PolicyFile is the path of the YAML/JSON access policy evaluated by /_auth
+	// (per host, path and method requirements); empty lets every authenticated session through
+	PolicyFile = EnvVariable{
+		Name:           "POLICY_FILE",
+		Required:       false,
+		DefaultValue:   "",
+		PossibleValues: []string{"path"},
+		Validator:      ValidatePolicyFile,
+	}
+
+	// RateLimitEnabled turns on per-IP and per-identifier limits for login and code sending
+	RateLimitEnabled = EnvVariable{
+		Name:           "RATE_LIMIT_ENABLED",
+		Required:       false,
+		DefaultValue:   "true",
+		PossibleValues: []string{"true", "false"},
+		Validator:      ValidateCaseInsensitivePossibleValues,
+	}
+
+	// RateLimitMaxFailures is the number of failed logins per identifier within RATE_LIMIT_WINDOW before a lockout (0 = no limit)
+	RateLimitMaxFailures = EnvVariable{
+		Name:           "RATE_LIMIT_MAX_FAILURES",
+		Required:       false,
+		DefaultValue:   "5",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateNonNegativeInteger,
+	}
+
+	// RateLimitIPMaxFailures is the number of failed logins per client IP within RATE_LIMIT_WINDOW before a lockout (0 = no limit)
+	RateLimitIPMaxFailures = EnvVariable{
+		Name:           "RATE_LIMIT_IP_MAX_FAILURES",
+		Required:       false,
+		DefaultValue:   "20",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateNonNegativeInteger,
+	}
+
+	// RateLimitMaxSends is the number of verification codes sent per identifier within RATE_LIMIT_WINDOW (0 = no limit)
+	RateLimitMaxSends = EnvVariable{
+		Name:           "RATE_LIMIT_MAX_SENDS",
+		Required:       false,
+		DefaultValue:   "5",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateNonNegativeInteger,
+	}
+
+	// RateLimitIPMaxSends is the number of verification codes sent per client IP within RATE_LIMIT_WINDOW (0 = no limit)
+	RateLimitIPMaxSends = EnvVariable{
+		Name:           "RATE_LIMIT_IP_MAX_SENDS",
+		Required:       false,
+		DefaultValue:   "20",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateNonNegativeInteger,
+	}
+
+	// RateLimitWindow is the period over which failures and sends are counted
+	RateLimitWindow = EnvVariable{
+		Name:           "RATE_LIMIT_WINDOW",
+		Required:       false,
+		DefaultValue:   "15m",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateDurationOrEmpty,
+	}
+
+	// RateLimitLockout is the first lockout duration; each further lockout doubles it
+	RateLimitLockout = EnvVariable{
+		Name:           "RATE_LIMIT_LOCKOUT",
+		Required:       false,
+		DefaultValue:   "1m",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateDurationOrEmpty,
+	}
+
+	// RateLimitLockoutMax caps the progressive lockout duration
+	RateLimitLockoutMax = EnvVariable{
+		Name:           "RATE_LIMIT_LOCKOUT_MAX",
+		Required:       false,
+		DefaultValue:   "1h",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateDurationOrEmpty,
+	}
+
 	// OpenTelemetry config
 	OTLPEnabled = EnvVariable{
 		Name:           "OTLP_ENABLED",
@@ -334,6 +936,35 @@ var (
 		PossibleValues: []string{"true", "false"},
 		Validator:      ValidateCaseInsensitivePossibleValues,
 	}
+
+	// Magic-link login: /_send_verify_code with mode=magic_link asks Herald to send a sign-in link
+	// to /_login/magic instead of a code. Herald needs a message template for the magic_link purpose.
+	LoginMagicLinkEnabled = EnvVariable{
+		Name:           "LOGIN_MAGIC_LINK_ENABLED",
+		Required:       false,
+		DefaultValue:   "false",
+		PossibleValues: []string{"true", "false"},
+		Validator:      ValidateCaseInsensitivePossibleValues,
+	}
+
+	// QRLoginEnabled shows a QR code on the login page that a user signed in on their phone can
+	// scan to approve the login
+	QRLoginEnabled = EnvVariable{
+		Name:           "QR_LOGIN_ENABLED",
+		Required:       false,
+		DefaultValue:   "false",
+		PossibleValues: []string{"true", "false"},
+		Validator:      ValidateCaseInsensitivePossibleValues,
+	}
+
+	// QRLoginTTL is how long a QR code can be approved after it is shown
+	QRLoginTTL = EnvVariable{
+		Name:           "QR_LOGIN_TTL",
+		Required:       false,
+		DefaultValue:   "2m",
+		PossibleValues: []string{"*"},
+		Validator:      ValidateDurationOrEmpty,
+	}
 )
 
 func Initialize(l *logger.Logger) error {
@@ -362,7 +993,7 @@ func Initialize(l *logger.Logger) error {
 	}
 
 	// Then validate all other configuration variables
-	var envVariables = []*EnvVariable{&Debug, &AuthHost, &LoginPageTitle, &LoginPageFooterText, &Passwords, &UserHeaderName, &CookieDomain, &Language, &Port, &WardenURL, &WardenAPIKey, &WardenEnabled, &WardenCacheTTL, &WardenOTPEnabled, &WardenOTPSecretKey, &HeraldURL, &HeraldAPIKey, &HeraldEnabled, &HeraldHMACSecret, &HeraldTLSCACertFile, &HeraldTLSClientCert, &HeraldTLSClientKey, &HeraldTLSServerName, &HeraldTOTPEnabled, &SessionStorageEnabled, &SessionStorageRedisAddr, &SessionStorageRedisPassword, &SessionStorageRedisDB, &SessionStorageRedisKeyPrefix, &AuditLogEnabled, &AuditLogFormat, &StepUpEnabled, &StepUpPaths, &OTLPEnabled, &OTLPEndpoint, &AuthRefreshEnabled, &AuthRefreshInterval, &LoginSMSEnabled, &LoginEmailEnabled}
+	var envVariables = []*EnvVariable{&Debug, &AuthHost, &LoginPageTitle, &LoginPageFooterText, &Passwords, &Users, &UsersFile, &PasswordCaseSensitive, &UserHeaderName, &CookieDomain, &CallbackAllowedDomains, &TrustedProxies, &Language, &Port, &WardenURL, &WardenAPIKey, &WardenEnabled, &WardenCacheTTL, &WardenOTPEnabled, &WardenOTPSecretKey, &HeraldURL, &HeraldAPIKey, &HeraldEnabled, &HeraldHMACSecret, &HeraldTLSCACertFile, &HeraldTLSClientCert, &HeraldTLSClientKey, &HeraldTLSServerName, &HeraldTOTPEnabled, &TOTPEnabled, &TOTPEncryptionKey, &TOTPFile, &OIDCEnabled, &OIDCIssuerURL, &OIDCClientID, &OIDCClientSecret, &OIDCRedirectURL, &OIDCScopes, &OIDCGroupsClaim, &OIDCProviderName, &IDPEnabled, &IDPClientsFile, &IDPIssuer, &IDPTokenTTL, &AuthJWTEnabled, &AuthJWTHeader, &AuthJWTTTL, &AuthJWTIssuer, &APITokensEnabled, &APITokensFile, &APITokensMaxTTL, &PasskeysEnabled, &PasskeysRPID, &PasskeysRPName, &PasskeysOrigins, &PasskeysUserVerification, &PasskeysFile, &BearerJWTEnabled, &BearerJWTJWKSURL, &BearerJWTJWKSFile, &BearerJWTIssuer, &BearerJWTAudience, &BearerJWTUserClaim, &BearerJWTScopesClaim, &BearerJWTRoleClaim, &BearerJWTJWKSRefresh, &SigningKeyFiles, &SigningKeyAlgorithm, &SigningKeyRotation, &SessionAbsoluteTimeout, &SessionIdleTimeout, &SessionHostTimeouts, &SingleLogoutEnabled, &SessionStorageEnabled, &SessionStorageRedisAddr, &SessionStorageRedisPassword, &SessionStorageRedisDB, &SessionStorageRedisKeyPrefix, &AuditLogEnabled, &AuditLogFormat, &AuditLogSinks, &AuditLogFilePath, &AuditLogFileMaxSizeMB, &AuditLogFileMaxAge, &AuditLogFileMaxBackups, &AuditLogRedisStream, &AuditLogRedisMaxLen, &StepUpEnabled, &StepUpPaths, &StepUpMaxAge, &PolicyFile, &RateLimitEnabled, &RateLimitMaxFailures, &RateLimitIPMaxFailures, &RateLimitMaxSends, &RateLimitIPMaxSends, &RateLimitWindow, &RateLimitLockout, &RateLimitLockoutMax, &OTLPEnabled, &OTLPEndpoint, &AuthRefreshEnabled, &AuthRefreshInterval, &LoginSMSEnabled, &LoginEmailEnabled, &LoginMagicLinkEnabled, &QRLoginEnabled, &QRLoginTTL}
 
 	for _, variable := range envVariables {
 		err := variable.Validate()
@@ -376,18 +1007,155 @@ func Initialize(l *logger.Logger) error {
 		}
 	}
 
-	// PASSWORDS is required when not using Warden (password-only mode). When WardenEnabled=true, pure Warden deployment may omit PASSWORDS.
-	if !WardenEnabled.ToBool() && Passwords.Value == "" {
+	// PASSWORDS is required when not using Warden, OIDC or named users (password-only mode); pure Warden or OIDC deployments may omit it.
+	if !WardenEnabled.ToBool() && !OIDCEnabled.ToBool() && Passwords.Value == "" && Users.Value == "" && UsersFile.Value == "" {
 		return NewValidationError(Passwords.Name, i18n.TStatic("error.config_required_not_set"), Passwords.PossibleValues)
 	}
 
+	// A user name must not be defined in both USERS and USERS_FILE
+	if Users.Value != "" && UsersFile.Value != "" {
+		if _, err := users.Load(Users.Value, UsersFile.Value); err != nil {
+			return NewValidationError(UsersFile.Name, UsersFile.Value, UsersFile.PossibleValues)
+		}
+	}
+
+	// Passwords stored for the normalized comparison stop matching once it is turned off
+	if PasswordCaseSensitive.ToBool() {
+		warnNormalizedPasswords()
+	}
+
+	// OIDC login needs a provider and a client registered with it
+	if OIDCEnabled.ToBool() {
+		for _, v := range []*EnvVariable{&OIDCIssuerURL, &OIDCClientID} {
+			if v.Value == "" {
+				return NewValidationError(v.Name, i18n.TStatic("error.config_required_not_set"), v.PossibleValues)
+			}
+		}
+	}
+
+	// The OpenID Connect provider needs registered clients
+	if IDPEnabled.ToBool() && IDPClientsFile.Value == "" {
+		return NewValidationError(IDPClientsFile.Name, i18n.TStatic("error.config_required_not_set"), IDPClientsFile.PossibleValues)
+	}
+
+	// Personal access tokens must outlive restarts: keep them in Redis or a file
+	if APITokensEnabled.ToBool() && APITokensFile.Value == "" && !SessionStorageEnabled.ToBool() {
+		return NewValidationError(APITokensFile.Name, i18n.TStatic("error.config_required_not_set"), APITokensFile.PossibleValues)
+	}
+
+	// Local TOTP secrets are encrypted and must outlive restarts; Herald TOTP takes precedence
+	if TOTPEnabled.ToBool() && !HeraldTOTPEnabled.ToBool() {
+		if TOTPEncryptionKey.Value == "" {
+			return NewValidationError(TOTPEncryptionKey.Name, i18n.TStatic("error.config_required_not_set"), TOTPEncryptionKey.PossibleValues)
+		}
+		if TOTPFile.Value == "" && !SessionStorageEnabled.ToBool() {
+			return NewValidationError(TOTPFile.Name, i18n.TStatic("error.config_required_not_set"), TOTPFile.PossibleValues)
+		}
+	}
+
+	// Passkeys must outlive restarts too, and the origins must be on the relying party ID
+	if PasskeysEnabled.ToBool() {
+		if PasskeysFile.Value == "" && !SessionStorageEnabled.ToBool() {
+			return NewValidationError(PasskeysFile.Name, i18n.TStatic("error.config_required_not_set"), PasskeysFile.PossibleValues)
+		}
+		if _, err := webauthn.New(PasskeysConfig(), nil); err != nil {
+			return NewValidationError(PasskeysOrigins.Name, err.Error(), PasskeysOrigins.PossibleValues)
+		}
+	}
+
+	// Bearer JWTs are checked against one issuer and audience, with keys from exactly one source
+	if BearerJWTEnabled.ToBool() {
+		for _, v := range []*EnvVariable{&BearerJWTIssuer, &BearerJWTAudience} {
+			if v.Value == "" {
+				return NewValidationError(v.Name, i18n.TStatic("error.config_required_not_set"), v.PossibleValues)
+			}
+		}
+		if BearerJWTJWKSURL.Value == "" && BearerJWTJWKSFile.Value == "" {
+			return NewValidationError(BearerJWTJWKSURL.Name, i18n.TStatic("error.config_required_not_set"), BearerJWTJWKSURL.PossibleValues)
+		}
+		if BearerJWTJWKSURL.Value != "" && BearerJWTJWKSFile.Value != "" {
+			return NewValidationError(BearerJWTJWKSFile.Name, BearerJWTJWKSFile.Value, BearerJWTJWKSFile.PossibleValues)
+		}
+	}
+
 	// Log language setting
 	if Language.Value != "" {
 		log.Info().Str("name", Language.Name).Str("value", Language.Value).Msg("Config loaded")
 	}
 
-	// Initialize step-up matcher after configuration is loaded
+	// Initialize step-up matcher, callback allowlist, trusted proxies and session timeouts after configuration is loaded
 	InitStepUpMatcher()
+	InitCallbackAllowlist()
+	InitTrustedProxySet()
+	InitSessionTimeouts()
 
 	return nil
 }
+
+// warnNormalizedPasswords logs the password entries that look like they were stored for the
+// normalized (upper case, no spaces) comparison, which PASSWORD_CASE_SENSITIVE turns off. Salted
+// hashes cannot be inspected; those made from the normalized password must be regenerated too.
+func warnNormalizedPasswords() {
+	if algorithm, values, ok := strings.Cut(Passwords.Value, ":"); ok {
+		var suspect int
+		for _, value := range strings.Split(values, "|") {
+			if looksNormalized(algorithm, strings.TrimSpace(value)) {
+				suspect++
+			}
+		}
+		if suspect > 0 {
+			log.Warn().Str("name", Passwords.Name).Int("entries", suspect).Msg("Passwords look stored in normalized form and only match when typed in upper case without spaces; regenerate them from the passwords as typed")
+		}
+	}
+
+	list, err := users.ParseList(Users.Value)
+	if err != nil {
+		return
+	}
+	if UsersFile.Value != "" {
+		fromFile, err := users.LoadFile(UsersFile.Value)
+		if err != nil {
+			return
+		}
+		list = append(list, fromFile...)
+	}
+	for _, u := range list {
+		if looksNormalized(u.Algorithm, u.Hash) {
+			log.Warn().Str("user", u.Name).Msg("Password looks stored in normalized form and only matches when typed in upper case without spaces; regenerate it from the password as typed")
+		}
+	}
+}
+
+// looksNormalized reports whether a stored password appears to be written for the normalized
+// comparison: plaintext already in upper case without spaces, or a hex digest in upper case, the
+// form the normalized comparison stored digests in.
+func looksNormalized(algorithm, value string) bool {
+	switch algorithm {
+	case "plaintext":
+		return value == strings.ToUpper(value) && value != strings.ToLower(value) && !strings.Contains(value, " ")
+	case "md5", "sha512":
+		return value != strings.ToLower(value)
+	}
+	return false
+}
+
+// PasskeysConfig returns the WebAuthn relying party settings. The RP ID defaults to the host name
+// of AUTH_HOST, the name to LOGIN_PAGE_TITLE and the origins to https://{AUTH_HOST}.
+func PasskeysConfig() webauthn.Config {
+	cfg := webauthn.Config{
+		RPID:             strings.ToLower(PasskeysRPID.String()),
+		RPName:           PasskeysRPName.String(),
+		Origins:          PasskeysOrigins.ToList(),
+		UserVerification: strings.ToLower(PasskeysUserVerification.String()),
+	}
+	if cfg.RPID == "" {
+		cfg.RPID = strings.ToLower(hostname(AuthHost.String()))
+	}
+	if cfg.RPName == "" {
+		cfg.RPName = LoginPageTitle.String()
+	}
+	if len(cfg.Origins) == 0 {
+		cfg.Origins = []string{"https://" + strings.ToLower(AuthHost.String())}
+	}
+	return cfg
+}
@@ -1,12 +1,18 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/MarvinJWendt/testza"
 	logger "github.com/soulteary/logger-kit"
+
+	"github.com/soulteary/stargate/src/internal/keyring"
 )
 
 // testLogger creates a logger instance for testing
@@ -245,6 +251,18 @@ func TestValidatePasswords_Plaintext_Valid(t *testing.T) {
 	}
 }
 
+func TestValidatePasswords_PHC(t *testing.T) {
+	for _, value := range []string{
+		"argon2id:$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$aGFzaA",
+		"scrypt:$scrypt$ln=17,r=8,p=1$c2FsdA$aGFzaA",
+		"pbkdf2-sha256:$pbkdf2-sha256$i=600000$c2FsdA$aGFzaA|$pbkdf2-sha256$i=600000$c2FsdA$aGFzaB",
+	} {
+		testza.AssertTrue(t, ValidatePasswords(EnvVariable{Value: value}), value)
+	}
+	testza.AssertTrue(t, ValidateUsers(EnvVariable{Value: "alice:$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$aGFzaA"}))
+	testza.AssertFalse(t, ValidateUsers(EnvVariable{Value: "alice:$argon2id$v=19$c2FsdA$aGFzaA"}))
+}
+
 func TestValidatePasswords_Invalid(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -256,6 +274,8 @@ func TestValidatePasswords_Invalid(t *testing.T) {
 		{"empty password", "plaintext:", false},
 		{"empty password in list", "plaintext:pass1||pass3", false},
 		{"missing colon", "plaintextpass1", false},
+		{"malformed PHC hash", "argon2id:$argon2id$v=19$m=65536$c2FsdA$aGFzaA", false},
+		{"PHC hash of another algorithm", "scrypt:$pbkdf2-sha256$i=1000$c2FsdA$aGFzaA", false},
 	}
 
 	for _, tt := range tests {
@@ -454,3 +474,431 @@ func TestValidationError_String_WithWildcard(t *testing.T) {
 	testza.AssertContains(t, errorStr, "TEST_VAR")
 	testza.AssertContains(t, errorStr, "invalid-value")
 }
+
+func TestEnvVariable_ToInt(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int
+	}{
+		{"", 0},
+		{"0", 0},
+		{"42", 42},
+		{" 7 ", 7},
+		{"-3", -3},
+		{"abc", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			v := EnvVariable{Value: tt.value}
+			testza.AssertEqual(t, tt.expected, v.ToInt())
+		})
+	}
+}
+
+func TestEnvVariable_ToList(t *testing.T) {
+	testza.AssertNil(t, (&EnvVariable{Value: ""}).ToList())
+	testza.AssertEqual(t, []string{"stdout"}, (&EnvVariable{Value: "stdout"}).ToList())
+	testza.AssertEqual(t, []string{"stdout", "file", "redis"}, (&EnvVariable{Value: " stdout, file ,,redis "}).ToList())
+}
+
+func TestValidateNonNegativeInteger(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected bool
+	}{
+		{"", true},
+		{"0", true},
+		{"100", true},
+		{"-1", false},
+		{"1.5", false},
+		{"ten", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			testza.AssertEqual(t, tt.expected, ValidateNonNegativeInteger(EnvVariable{Value: tt.value}))
+		})
+	}
+}
+
+func TestValidateDurationOrEmpty(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected bool
+	}{
+		{"", true},
+		{"30s", true},
+		{"24h", true},
+		{"-1h", false},
+		{"1 day", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			testza.AssertEqual(t, tt.expected, ValidateDurationOrEmpty(EnvVariable{Value: tt.value}))
+		})
+	}
+}
+
+func TestValidateAuditLogSinks(t *testing.T) {
+	possible := []string{"stdout", "file", "redis"}
+	tests := []struct {
+		value    string
+		expected bool
+	}{
+		{"", true},
+		{"stdout", true},
+		{"stdout,file,redis", true},
+		{"STDOUT, File", true},
+		{"stdout,kafka", false},
+		{"syslog", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			v := EnvVariable{Value: tt.value, PossibleValues: possible}
+			testza.AssertEqual(t, tt.expected, ValidateAuditLogSinks(v))
+		})
+	}
+}
+
+func TestValidateCallbackDomains(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected bool
+	}{
+		{"", true},
+		{"app.example.com", true},
+		{"app.example.com:8443, *.example.org, .example.net", true},
+		{"*", false},
+		{"*.", false},
+		{"https://app.example.com", false},
+		{"app.example.com/path", false},
+		{"a*.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			testza.AssertEqual(t, tt.expected, ValidateCallbackDomains(EnvVariable{Value: tt.value}))
+		})
+	}
+}
+
+func TestValidateTrustedProxies(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected bool
+	}{
+		{"", true},
+		{"10.0.0.1", true},
+		{"10.0.0.0/8, 192.168.1.10, ::1, fd00::/8", true},
+		{"10.0.0.0/33", false},
+		{"proxy.example.com", false},
+		{"10.0.0.1:8080", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			testza.AssertEqual(t, tt.expected, ValidateTrustedProxies(EnvVariable{Value: tt.value}))
+		})
+	}
+}
+
+func TestValidatePolicyFile(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "policy.yaml")
+	invalid := filepath.Join(dir, "invalid.yaml")
+	testza.AssertNoError(t, os.WriteFile(valid, []byte("rules:\n  - hosts: [\"admin.example.com\"]\n    roles: [admin]\n"), 0o600))
+	testza.AssertNoError(t, os.WriteFile(invalid, []byte("rules:\n  - action: allow\n"), 0o600))
+
+	testza.AssertTrue(t, ValidatePolicyFile(EnvVariable{Value: ""}))
+	testza.AssertTrue(t, ValidatePolicyFile(EnvVariable{Value: valid}))
+	testza.AssertFalse(t, ValidatePolicyFile(EnvVariable{Value: invalid}))
+	testza.AssertFalse(t, ValidatePolicyFile(EnvVariable{Value: filepath.Join(dir, "missing.yaml")}))
+}
+
+func TestValidateURLOrEmpty(t *testing.T) {
+	testza.AssertTrue(t, ValidateURLOrEmpty(EnvVariable{Value: ""}))
+	testza.AssertTrue(t, ValidateURLOrEmpty(EnvVariable{Value: "https://idp.example.com/realms/main"}))
+	testza.AssertTrue(t, ValidateURLOrEmpty(EnvVariable{Value: "http://localhost:8080"}))
+	testza.AssertFalse(t, ValidateURLOrEmpty(EnvVariable{Value: "idp.example.com"}))
+	testza.AssertFalse(t, ValidateURLOrEmpty(EnvVariable{Value: "ftp://idp.example.com"}))
+	testza.AssertFalse(t, ValidateURLOrEmpty(EnvVariable{Value: "https://"}))
+}
+
+func TestInitialize_OIDC(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "")
+	t.Setenv("OIDC_ENABLED", "true")
+
+	// Issuer and client ID are required
+	testza.AssertNotNil(t, Initialize(testLogger()))
+
+	// PASSWORDS may be omitted when OIDC is the login method
+	t.Setenv("OIDC_ISSUER_URL", "https://idp.example.com")
+	t.Setenv("OIDC_CLIENT_ID", "stargate")
+	testza.AssertNoError(t, Initialize(testLogger()))
+	testza.AssertEqual(t, []string{"openid", "profile", "email"}, OIDCScopes.ToList())
+
+	t.Setenv("OIDC_ISSUER_URL", "not a url")
+	testza.AssertNotNil(t, Initialize(testLogger()))
+}
+
+func TestValidateIDPClientsFile(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "clients.yaml")
+	invalid := filepath.Join(dir, "invalid.yaml")
+	testza.AssertNoError(t, os.WriteFile(valid, []byte("clients:\n  - id: wiki\n    secret: s3cret\n    redirect_uris: [\"https://wiki.example.com/callback\"]\n"), 0o600))
+	testza.AssertNoError(t, os.WriteFile(invalid, []byte("clients:\n  - id: wiki\n    redirect_uris: [\"https://wiki.example.com/callback\"]\n"), 0o600))
+
+	testza.AssertTrue(t, ValidateIDPClientsFile(EnvVariable{Value: ""}))
+	testza.AssertTrue(t, ValidateIDPClientsFile(EnvVariable{Value: valid}))
+	testza.AssertFalse(t, ValidateIDPClientsFile(EnvVariable{Value: invalid}))
+	testza.AssertFalse(t, ValidateIDPClientsFile(EnvVariable{Value: filepath.Join(dir, "missing.yaml")}))
+}
+
+func TestValidateAPITokensFile(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	testza.AssertNoError(t, os.WriteFile(invalid, []byte("tokens"), 0o600))
+
+	testza.AssertTrue(t, ValidateAPITokensFile(EnvVariable{Value: ""}))
+	testza.AssertTrue(t, ValidateAPITokensFile(EnvVariable{Value: filepath.Join(dir, "tokens.json")}))
+	testza.AssertFalse(t, ValidateAPITokensFile(EnvVariable{Value: invalid}))
+}
+
+func TestInitialize_APITokens(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("API_TOKENS_ENABLED", "true")
+
+	// Tokens need persistent storage: Redis sessions or a token file
+	testza.AssertNotNil(t, Initialize(testLogger()))
+
+	t.Setenv("API_TOKENS_FILE", filepath.Join(t.TempDir(), "tokens.json"))
+	testza.AssertNoError(t, Initialize(testLogger()))
+	testza.AssertEqual(t, 90*24*time.Hour, APITokensMaxTTL.ToDuration())
+}
+
+func TestInitialize_Passkeys(t *testing.T) {
+	t.Setenv("AUTH_HOST", "Auth.Example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("PASSKEYS_ENABLED", "true")
+
+	// Passkeys need persistent storage: Redis sessions or a passkey file
+	testza.AssertNotNil(t, Initialize(testLogger()))
+
+	t.Setenv("PASSKEYS_FILE", filepath.Join(t.TempDir(), "passkeys.json"))
+	testza.AssertNoError(t, Initialize(testLogger()))
+	cfg := PasskeysConfig()
+	testza.AssertEqual(t, "auth.example.com", cfg.RPID)
+	testza.AssertEqual(t, []string{"https://auth.example.com"}, cfg.Origins)
+	testza.AssertEqual(t, "preferred", cfg.UserVerification)
+
+	// A parent domain as RP ID lets passkeys work across subdomains
+	t.Setenv("PASSKEYS_RP_ID", "example.com")
+	t.Setenv("PASSKEYS_ORIGINS", "https://auth.example.com,https://login.example.com")
+	testza.AssertNoError(t, Initialize(testLogger()))
+	testza.AssertEqual(t, "example.com", PasskeysConfig().RPID)
+
+	// Origins must be on the RP ID
+	t.Setenv("PASSKEYS_ORIGINS", "https://auth.example.org")
+	testza.AssertNotNil(t, Initialize(testLogger()))
+	t.Setenv("PASSKEYS_ORIGINS", "https://auth.example.com/login")
+	testza.AssertNotNil(t, Initialize(testLogger()))
+	t.Setenv("PASSKEYS_ORIGINS", "")
+
+	t.Setenv("PASSKEYS_RP_ID", "example.com:443")
+	testza.AssertNotNil(t, Initialize(testLogger()))
+	t.Setenv("PASSKEYS_RP_ID", "")
+
+	t.Setenv("PASSKEYS_USER_VERIFICATION", "Required")
+	testza.AssertNoError(t, Initialize(testLogger()))
+	testza.AssertEqual(t, "required", PasskeysConfig().UserVerification)
+	t.Setenv("PASSKEYS_USER_VERIFICATION", "always")
+	testza.AssertNotNil(t, Initialize(testLogger()))
+}
+
+func TestInitialize_LocalTOTP(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("TOTP_ENABLED", "true")
+
+	// Secrets are encrypted with a 32 byte key and need persistent storage
+	testza.AssertNotNil(t, Initialize(testLogger()))
+	t.Setenv("TOTP_ENCRYPTION_KEY", "c2hvcnQ=")
+	testza.AssertNotNil(t, Initialize(testLogger()))
+	t.Setenv("TOTP_ENCRYPTION_KEY", "BwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwc=")
+	testza.AssertNotNil(t, Initialize(testLogger()))
+	t.Setenv("TOTP_FILE", filepath.Join(t.TempDir(), "totp.json"))
+	testza.AssertNoError(t, Initialize(testLogger()))
+
+	// Herald TOTP takes precedence, so the local settings are not required with it
+	t.Setenv("HERALD_TOTP_ENABLED", "true")
+	t.Setenv("TOTP_ENCRYPTION_KEY", "")
+	t.Setenv("TOTP_FILE", "")
+	testza.AssertNoError(t, Initialize(testLogger()))
+}
+
+func TestValidateJWKSFile(t *testing.T) {
+	dir := t.TempDir()
+	key, err := keyring.Generate(keyring.DefaultAlgorithm)
+	testza.AssertNoError(t, err)
+	data, err := json.Marshal(keyring.New(key).JWKS())
+	testza.AssertNoError(t, err)
+	valid := filepath.Join(dir, "jwks.json")
+	testza.AssertNoError(t, os.WriteFile(valid, data, 0o600))
+	empty := filepath.Join(dir, "empty.json")
+	testza.AssertNoError(t, os.WriteFile(empty, []byte(`{"keys":[]}`), 0o600))
+
+	testza.AssertTrue(t, ValidateJWKSFile(EnvVariable{Value: ""}))
+	testza.AssertTrue(t, ValidateJWKSFile(EnvVariable{Value: valid}))
+	testza.AssertFalse(t, ValidateJWKSFile(EnvVariable{Value: empty}))
+	testza.AssertFalse(t, ValidateJWKSFile(EnvVariable{Value: filepath.Join(dir, "missing.json")}))
+}
+
+func TestInitialize_BearerJWT(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("BEARER_JWT_ENABLED", "true")
+
+	// Issuer, audience and a key source are required
+	testza.AssertNotNil(t, Initialize(testLogger()))
+	t.Setenv("BEARER_JWT_ISSUER", "https://idp.example.com")
+	t.Setenv("BEARER_JWT_AUDIENCE", "https://api.example.com")
+	testza.AssertNotNil(t, Initialize(testLogger()))
+
+	t.Setenv("BEARER_JWT_JWKS_URL", "https://idp.example.com/jwks")
+	testza.AssertNoError(t, Initialize(testLogger()))
+	testza.AssertEqual(t, "sub", BearerJWTUserClaim.String())
+	testza.AssertEqual(t, "scope", BearerJWTScopesClaim.String())
+	testza.AssertEqual(t, 15*time.Minute, BearerJWTJWKSRefresh.ToDuration())
+
+	// Only one key source
+	key, err := keyring.Generate(keyring.DefaultAlgorithm)
+	testza.AssertNoError(t, err)
+	data, err := json.Marshal(keyring.New(key).JWKS())
+	testza.AssertNoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	testza.AssertNoError(t, os.WriteFile(path, data, 0o600))
+	t.Setenv("BEARER_JWT_JWKS_FILE", path)
+	testza.AssertNotNil(t, Initialize(testLogger()))
+}
+
+func TestValidateSigningKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for i, alg := range keyring.Algorithms {
+		key, err := keyring.Generate(alg)
+		testza.AssertNoError(t, err)
+		data, err := key.MarshalPEM()
+		testza.AssertNoError(t, err)
+		path := filepath.Join(dir, fmt.Sprintf("key-%d.pem", i))
+		testza.AssertNoError(t, os.WriteFile(path, data, 0o600))
+		paths = append(paths, path)
+	}
+	garbage := filepath.Join(dir, "garbage.pem")
+	testza.AssertNoError(t, os.WriteFile(garbage, []byte("not a key"), 0o600))
+
+	testza.AssertTrue(t, ValidateSigningKeyFiles(EnvVariable{Value: ""}))
+	testza.AssertTrue(t, ValidateSigningKeyFiles(EnvVariable{Value: strings.Join(paths, ", ")}))
+	testza.AssertFalse(t, ValidateSigningKeyFiles(EnvVariable{Value: paths[0] + "," + garbage}))
+	testza.AssertFalse(t, ValidateSigningKeyFiles(EnvVariable{Value: filepath.Join(dir, "missing.pem")}))
+}
+
+func TestInitialize_IDP(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("IDP_ENABLED", "true")
+
+	// A client registry is required
+	testza.AssertNotNil(t, Initialize(testLogger()))
+
+	path := filepath.Join(t.TempDir(), "clients.yaml")
+	testza.AssertNoError(t, os.WriteFile(path, []byte("clients:\n  - id: spa\n    public: true\n    redirect_uris: [\"https://spa.example.com/cb\"]\n"), 0o600))
+	t.Setenv("IDP_CLIENTS_FILE", path)
+	testza.AssertNoError(t, Initialize(testLogger()))
+	testza.AssertEqual(t, time.Hour, IDPTokenTTL.ToDuration())
+	testza.AssertEqual(t, "ES256", SigningKeyAlgorithm.String())
+
+	t.Setenv("SIGNING_KEY_ALGORITHM", "HS256")
+	testza.AssertNotNil(t, Initialize(testLogger()))
+}
+
+func TestInitialize_AuthJWT(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("AUTH_JWT_ENABLED", "true")
+
+	testza.AssertNoError(t, Initialize(testLogger()))
+	testza.AssertTrue(t, AuthJWTEnabled.ToBool())
+	testza.AssertEqual(t, "X-Auth-JWT", AuthJWTHeader.String())
+	testza.AssertEqual(t, 5*time.Minute, AuthJWTTTL.ToDuration())
+
+	t.Setenv("AUTH_JWT_TTL", "soon")
+	testza.AssertNotNil(t, Initialize(testLogger()))
+
+	t.Setenv("AUTH_JWT_TTL", "1m")
+	t.Setenv("AUTH_JWT_ISSUER", "not a url")
+	testza.AssertNotNil(t, Initialize(testLogger()))
+}
+
+func TestValidateUsers(t *testing.T) {
+	testza.AssertTrue(t, ValidateUsers(EnvVariable{Value: ""}))
+	testza.AssertTrue(t, ValidateUsers(EnvVariable{Value: "alice:plaintext:one|bob:sha512:abc"}))
+	testza.AssertFalse(t, ValidateUsers(EnvVariable{Value: "alice:plaintext:one|alice:plaintext:two"}), "duplicate")
+	testza.AssertFalse(t, ValidateUsers(EnvVariable{Value: "alice:rot13:one"}), "unsupported algorithm")
+	testza.AssertFalse(t, ValidateUsers(EnvVariable{Value: "alice"}))
+
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "users")
+	testza.AssertNoError(t, os.WriteFile(valid, []byte("# team\nalice:plaintext:one\n"), 0o600))
+	broken := filepath.Join(dir, "broken")
+	testza.AssertNoError(t, os.WriteFile(broken, []byte("alice\n"), 0o600))
+
+	testza.AssertTrue(t, ValidateUsersFile(EnvVariable{Value: ""}))
+	testza.AssertTrue(t, ValidateUsersFile(EnvVariable{Value: valid}))
+	testza.AssertFalse(t, ValidateUsersFile(EnvVariable{Value: broken}))
+	testza.AssertFalse(t, ValidateUsersFile(EnvVariable{Value: filepath.Join(dir, "missing")}))
+}
+
+func TestInitialize_Users(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "")
+
+	// Named users replace the shared passwords
+	testza.AssertNotNil(t, Initialize(testLogger()))
+	t.Setenv("USERS", "alice:plaintext:one")
+	testza.AssertNoError(t, Initialize(testLogger()))
+
+	// A name may only be defined once across USERS and USERS_FILE
+	path := filepath.Join(t.TempDir(), "users")
+	testza.AssertNoError(t, os.WriteFile(path, []byte("alice:plaintext:two\n"), 0o600))
+	t.Setenv("USERS_FILE", path)
+	testza.AssertNotNil(t, Initialize(testLogger()))
+
+	t.Setenv("USERS", "")
+	testza.AssertNoError(t, Initialize(testLogger()))
+}
+
+func TestLooksNormalized(t *testing.T) {
+	testza.AssertTrue(t, looksNormalized("plaintext", "HUNTER2"))
+	testza.AssertFalse(t, looksNormalized("plaintext", "Hunter2"))
+	testza.AssertFalse(t, looksNormalized("plaintext", "HUNTER 2"), "the normalized form has no spaces")
+	testza.AssertFalse(t, looksNormalized("plaintext", "123456"), "nothing to upper-case")
+	testza.AssertTrue(t, looksNormalized("sha512", "79C377501595E6A0"))
+	testza.AssertFalse(t, looksNormalized("sha512", "79c377501595e6a0"))
+	testza.AssertFalse(t, looksNormalized("argon2id", "$argon2id$v=19$m=65536,t=3,p=4$C2FSDA$AGFZAA"), "salted hashes cannot be inspected")
+}
+
+func TestInitialize_PasswordCaseSensitive(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:HUNTER2|Hunter 2")
+	t.Setenv("USERS", "alice:plaintext:WONDERLAND")
+
+	testza.AssertNoError(t, Initialize(testLogger()))
+	testza.AssertFalse(t, PasswordCaseSensitive.ToBool())
+
+	// Suspect passwords are warned about, not rejected
+	t.Setenv("PASSWORD_CASE_SENSITIVE", "true")
+	testza.AssertNoError(t, Initialize(testLogger()))
+	testza.AssertTrue(t, PasswordCaseSensitive.ToBool())
+
+	t.Setenv("PASSWORD_CASE_SENSITIVE", "sometimes")
+	testza.AssertNotNil(t, Initialize(testLogger()))
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// TrustedProxySet holds the networks whose forwarded headers are honored. An empty set trusts
+// no peer.
+type TrustedProxySet struct {
+	nets []*net.IPNet
+}
+
+// DefaultTrustedProxies are trusted when TRUSTED_PROXIES is empty: loopback and private networks,
+// where a reverse proxy in front of Stargate usually runs. A peer on a public address cannot
+// spoof forwarded headers or its client IP unless it is listed explicitly.
+var DefaultTrustedProxies = []string{
+	"127.0.0.0/8",
+	"::1/128",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+}
+
+var trustedProxySet *TrustedProxySet
+
+// InitTrustedProxySet builds the trusted proxy set from TRUSTED_PROXIES, or from
+// DefaultTrustedProxies when it is empty. Invalid entries are rejected by validation, so they
+// are skipped here.
+func InitTrustedProxySet() {
+	entries := TrustedProxies.ToList()
+	if len(entries) == 0 {
+		entries = DefaultTrustedProxies
+	}
+	set, err := NewTrustedProxySet(entries...)
+	if err != nil {
+		set = &TrustedProxySet{}
+	}
+	trustedProxySet = set
+}
+
+// GetTrustedProxySet returns the trusted proxy set instance
+func GetTrustedProxySet() *TrustedProxySet {
+	if trustedProxySet == nil {
+		InitTrustedProxySet()
+	}
+	return trustedProxySet
+}
+
+// NewTrustedProxySet creates a set from IP addresses ("10.0.0.1", "::1") and CIDR ranges ("10.0.0.0/8").
+func NewTrustedProxySet(entries ...string) (*TrustedProxySet, error) {
+	set := &TrustedProxySet{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			set.nets = append(set.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		set.nets = append(set.nets, network)
+	}
+	return set, nil
+}
+
+// Contains reports whether ip belongs to a trusted proxy network.
+func (s *TrustedProxySet) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range s.nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Strings returns the configured networks in CIDR notation, for logging.
+func (s *TrustedProxySet) Strings() []string {
+	result := make([]string, len(s.nets))
+	for i, network := range s.nets {
+		result[i] = network.String()
+	}
+	return result
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"net"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+)
+
+func TestTrustedProxySet_Contains(t *testing.T) {
+	set, err := NewTrustedProxySet("10.0.0.0/8", "192.168.1.10", "fd00::/8")
+	testza.AssertNoError(t, err)
+
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true}, // IPv4-mapped IPv6
+		{"192.168.1.10", true},
+		{"192.168.1.11", false},
+		{"fd12::1", true},
+		{"2001:db8::1", false},
+		{"203.0.113.7", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			testza.AssertEqual(t, tt.expected, set.Contains(net.ParseIP(tt.ip)))
+		})
+	}
+	testza.AssertFalse(t, set.Contains(nil))
+	testza.AssertEqual(t, []string{"10.0.0.0/8", "192.168.1.10/32", "fd00::/8"}, set.Strings())
+}
+
+func TestNewTrustedProxySet_Invalid(t *testing.T) {
+	_, err := NewTrustedProxySet("10.0.0.0/8", "not-an-ip")
+	testza.AssertNotNil(t, err)
+
+	set, err := NewTrustedProxySet()
+	testza.AssertNoError(t, err)
+	testza.AssertFalse(t, set.Contains(net.ParseIP("127.0.0.1")))
+}
+
+func TestInitTrustedProxySet(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("TRUSTED_PROXIES", "172.16.0.0/12")
+	testza.AssertNoError(t, Initialize(testLogger()))
+
+	testza.AssertTrue(t, GetTrustedProxySet().Contains(net.ParseIP("172.20.0.5")))
+	testza.AssertFalse(t, GetTrustedProxySet().Contains(net.ParseIP("10.0.0.1")))
+
+	t.Run("empty trusts loopback and private networks", func(t *testing.T) {
+		t.Setenv("TRUSTED_PROXIES", "")
+		testza.AssertNoError(t, Initialize(testLogger()))
+
+		for _, ip := range []string{"127.0.0.1", "::1", "10.1.2.3", "172.20.0.5", "192.168.1.1", "fd12::1"} {
+			testza.AssertTrue(t, GetTrustedProxySet().Contains(net.ParseIP(ip)), ip)
+		}
+		for _, ip := range []string{"203.0.113.7", "2001:db8::1", "0.0.0.0"} {
+			testza.AssertFalse(t, GetTrustedProxySet().Contains(net.ParseIP(ip)), ip)
+		}
+	})
+}
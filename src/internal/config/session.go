@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SessionTimeouts are the lifetimes of a session. Idle ends a session unused for that long and
+// Absolute one that old, counted from login; zero disables a timeout.
+type SessionTimeouts struct {
+	Idle     time.Duration
+	Absolute time.Duration
+}
+
+// tighten returns t with each timeout shortened to the one of other when that is set and shorter.
+func (t SessionTimeouts) tighten(other SessionTimeouts) SessionTimeouts {
+	if other.Idle > 0 && (t.Idle == 0 || other.Idle < t.Idle) {
+		t.Idle = other.Idle
+	}
+	if other.Absolute > 0 && (t.Absolute == 0 || other.Absolute < t.Absolute) {
+		t.Absolute = other.Absolute
+	}
+	return t
+}
+
+// HostSessionTimeouts is an entry of SESSION_HOST_TIMEOUTS: the timeouts of sessions used on
+// Host, which is a host name, a "*.domain" wildcard or a ".domain" entry.
+type HostSessionTimeouts struct {
+	Host     string
+	Timeouts SessionTimeouts
+
+	hosts *CallbackAllowlist
+}
+
+// SessionTimeoutTable resolves the session timeouts of a protected host.
+type SessionTimeoutTable struct {
+	defaults SessionTimeouts
+	hosts    []HostSessionTimeouts
+}
+
+var sessionTimeouts *SessionTimeoutTable
+
+// ParseSessionHostTimeouts parses a comma-separated list of host=idle[/absolute] entries, such as
+// "admin.example.com=15m/4h,*.billing.example.com=5m" or "reports.example.com=/1h".
+func ParseSessionHostTimeouts(value string) ([]HostSessionTimeouts, error) {
+	var entries []HostSessionTimeouts
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		host, spec, ok := strings.Cut(item, "=")
+		host = strings.TrimSpace(host)
+		name := strings.TrimPrefix(strings.TrimPrefix(host, "*"), ".")
+		if !ok || name == "" || strings.ContainsAny(name, "*/\\?#@ ") {
+			return nil, fmt.Errorf("invalid session timeout entry %q", item)
+		}
+		idle, absolute, _ := strings.Cut(spec, "/")
+		var timeouts SessionTimeouts
+		for _, field := range []struct {
+			value string
+			dest  *time.Duration
+		}{{idle, &timeouts.Idle}, {absolute, &timeouts.Absolute}} {
+			if field.value = strings.TrimSpace(field.value); field.value == "" {
+				continue
+			}
+			d, err := time.ParseDuration(field.value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid session timeout %q for %s", field.value, host)
+			}
+			*field.dest = d
+		}
+		if timeouts.Idle == 0 && timeouts.Absolute == 0 {
+			return nil, fmt.Errorf("session timeout entry %q sets no timeout", item)
+		}
+		entries = append(entries, HostSessionTimeouts{Host: host, Timeouts: timeouts, hosts: NewCallbackAllowlist(host)})
+	}
+	return entries, nil
+}
+
+// NewSessionTimeoutTable returns a table applying defaults to every host and the first matching
+// entry of hosts on top. Host entries can only shorten the defaults.
+func NewSessionTimeoutTable(defaults SessionTimeouts, hosts ...HostSessionTimeouts) *SessionTimeoutTable {
+	for i := range hosts {
+		if hosts[i].hosts == nil {
+			hosts[i].hosts = NewCallbackAllowlist(hosts[i].Host)
+		}
+	}
+	return &SessionTimeoutTable{defaults: defaults, hosts: hosts}
+}
+
+// For returns the timeouts of sessions used on host (optionally with a port).
+func (t *SessionTimeoutTable) For(host string) SessionTimeouts {
+	for _, entry := range t.hosts {
+		if entry.hosts.Allows(host) {
+			return t.defaults.tighten(entry.Timeouts)
+		}
+	}
+	return t.defaults
+}
+
+// SessionLifetime returns the absolute session lifetime: SESSION_ABSOLUTE_TIMEOUT, or
+// DefaultSessionLifetime when it is empty or 0.
+func SessionLifetime() time.Duration {
+	if d := SessionAbsoluteTimeout.ToDuration(); d > 0 {
+		return d
+	}
+	return DefaultSessionLifetime
+}
+
+// InitSessionTimeouts builds the session timeout table from SESSION_ABSOLUTE_TIMEOUT,
+// SESSION_IDLE_TIMEOUT and SESSION_HOST_TIMEOUTS.
+func InitSessionTimeouts() {
+	// Validated when the configuration was loaded
+	hosts, _ := ParseSessionHostTimeouts(SessionHostTimeouts.Value)
+	sessionTimeouts = NewSessionTimeoutTable(SessionTimeouts{
+		Idle:     SessionIdleTimeout.ToDuration(),
+		Absolute: SessionLifetime(),
+	}, hosts...)
+}
+
+// GetSessionTimeouts returns the session timeout table instance
+func GetSessionTimeouts() *SessionTimeoutTable {
+	if sessionTimeouts == nil {
+		InitSessionTimeouts()
+	}
+	return sessionTimeouts
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+)
+
+func TestParseSessionHostTimeouts(t *testing.T) {
+	entries, err := ParseSessionHostTimeouts("admin.example.com=15m/4h, *.billing.example.com=5m, reports.example.com=/1h")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, entries, 3)
+	testza.AssertEqual(t, "admin.example.com", entries[0].Host)
+	testza.AssertEqual(t, SessionTimeouts{Idle: 15 * time.Minute, Absolute: 4 * time.Hour}, entries[0].Timeouts)
+	testza.AssertEqual(t, SessionTimeouts{Idle: 5 * time.Minute}, entries[1].Timeouts)
+	testza.AssertEqual(t, SessionTimeouts{Absolute: time.Hour}, entries[2].Timeouts)
+
+	entries, err = ParseSessionHostTimeouts("")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, entries, 0)
+
+	for _, invalid := range []string{
+		"admin.example.com",
+		"admin.example.com=",
+		"admin.example.com=/",
+		"admin.example.com=soon",
+		"admin.example.com=-5m",
+		"=15m",
+		"*=15m",
+		"https://admin.example.com=15m",
+	} {
+		_, err := ParseSessionHostTimeouts(invalid)
+		testza.AssertNotNil(t, err, invalid)
+		testza.AssertFalse(t, ValidateSessionHostTimeouts(EnvVariable{Value: invalid}), invalid)
+	}
+}
+
+func TestSessionTimeoutTable_For(t *testing.T) {
+	hosts, err := ParseSessionHostTimeouts("admin.example.com=15m/4h,*.billing.example.com=2h/48h,.reports.example.com=/1h")
+	testza.AssertNoError(t, err)
+	table := NewSessionTimeoutTable(SessionTimeouts{Idle: time.Hour, Absolute: 24 * time.Hour}, hosts...)
+
+	tests := []struct {
+		host     string
+		expected SessionTimeouts
+	}{
+		{"app.example.com", SessionTimeouts{Idle: time.Hour, Absolute: 24 * time.Hour}},
+		{"Admin.Example.com:8443", SessionTimeouts{Idle: 15 * time.Minute, Absolute: 4 * time.Hour}},
+		// Host entries never lengthen the defaults
+		{"eu.billing.example.com", SessionTimeouts{Idle: time.Hour, Absolute: 24 * time.Hour}},
+		{"reports.example.com", SessionTimeouts{Idle: time.Hour, Absolute: time.Hour}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			testza.AssertEqual(t, tt.expected, table.For(tt.host))
+		})
+	}
+
+	// A host entry sets an idle timeout even when there is none by default
+	table = NewSessionTimeoutTable(SessionTimeouts{Absolute: 24 * time.Hour}, hosts...)
+	testza.AssertEqual(t, SessionTimeouts{Idle: 15 * time.Minute, Absolute: 4 * time.Hour}, table.For("admin.example.com"))
+}
+
+func TestInitialize_SessionTimeouts(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+
+	testza.AssertNoError(t, Initialize(testLogger()))
+	testza.AssertEqual(t, DefaultSessionLifetime, SessionLifetime())
+	testza.AssertEqual(t, SessionTimeouts{Absolute: DefaultSessionLifetime}, GetSessionTimeouts().For("app.example.com"))
+
+	t.Setenv("SESSION_ABSOLUTE_TIMEOUT", "8h")
+	t.Setenv("SESSION_IDLE_TIMEOUT", "30m")
+	t.Setenv("SESSION_HOST_TIMEOUTS", "admin.example.com=10m")
+	testza.AssertNoError(t, Initialize(testLogger()))
+	testza.AssertEqual(t, 8*time.Hour, SessionLifetime())
+	testza.AssertEqual(t, SessionTimeouts{Idle: 30 * time.Minute, Absolute: 8 * time.Hour}, GetSessionTimeouts().For("app.example.com"))
+	testza.AssertEqual(t, SessionTimeouts{Idle: 10 * time.Minute, Absolute: 8 * time.Hour}, GetSessionTimeouts().For("admin.example.com"))
+
+	t.Setenv("SESSION_HOST_TIMEOUTS", "admin.example.com=soon")
+	testza.AssertNotNil(t, Initialize(testLogger()))
+}
@@ -1,13 +1,25 @@
 package config
 
 import (
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/soulteary/cli-kit/env"
 	"github.com/soulteary/cli-kit/validator"
 	secure "github.com/soulteary/secure-kit"
+	"github.com/soulteary/stargate/src/internal/apitoken"
+	"github.com/soulteary/stargate/src/internal/filestore"
 	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/idp"
+	"github.com/soulteary/stargate/src/internal/jose"
+	"github.com/soulteary/stargate/src/internal/keyring"
+	"github.com/soulteary/stargate/src/internal/passhash"
+	"github.com/soulteary/stargate/src/internal/policy"
+	"github.com/soulteary/stargate/src/internal/totpstore"
+	"github.com/soulteary/stargate/src/internal/users"
 )
 
 type EnvVariable struct {
@@ -41,6 +53,32 @@ func (v *EnvVariable) ToDuration() time.Duration {
 	return duration
 }
 
+// ToInt parses the value as a base-10 integer.
+// Returns the parsed integer, or 0 if parsing fails
+func (v *EnvVariable) ToInt() int {
+	n, err := strconv.Atoi(strings.TrimSpace(v.Value))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// ToList splits a comma-separated value into trimmed, non-empty items.
+func (v *EnvVariable) ToList() []string {
+	if v.Value == "" {
+		return nil
+	}
+	parts := strings.Split(v.Value, ",")
+	result := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
 func (v *EnvVariable) Validate() error {
 	if v.Trimmed {
 		v.Value = env.GetTrimmed(v.Name, v.DefaultValue)
@@ -65,6 +103,10 @@ var (
 		"bcrypt":    &secure.BcryptResolver{},
 		"md5":       &secure.MD5Resolver{},
 		"sha512":    &secure.SHA512Resolver{},
+
+		passhash.Argon2id:     &passhash.Resolver{Algorithm: passhash.Argon2id},
+		passhash.Scrypt:       &passhash.Resolver{Algorithm: passhash.Scrypt},
+		passhash.PBKDF2SHA256: &passhash.Resolver{Algorithm: passhash.PBKDF2SHA256},
 	}
 
 	ValidateNotEmptyString = func(v EnvVariable) bool {
@@ -121,14 +163,190 @@ var (
 		}
 
 		for _, password := range passwords {
-			if password == "" {
+			if password == "" || !validHash(algorithm, strings.TrimSpace(password)) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	// ValidateUsers accepts an empty value or "|"-separated "name:hash" entries whose hash uses a
+	// supported algorithm.
+	ValidateUsers = func(v EnvVariable) bool {
+		list, err := users.ParseList(v.Value)
+		return err == nil && validUsers(list)
+	}
+
+	// ValidateUsersFile accepts an empty value or an htpasswd-style file of "name:hash" entries whose
+	// hash uses a supported algorithm.
+	ValidateUsersFile = func(v EnvVariable) bool {
+		if v.Value == "" {
+			return true
+		}
+		list, err := users.LoadFile(v.Value)
+		return err == nil && validUsers(list)
+	}
+
+	// ValidateNonNegativeInteger accepts an empty value or a base-10 integer >= 0.
+	ValidateNonNegativeInteger = func(v EnvVariable) bool {
+		if v.Value == "" {
+			return true
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v.Value))
+		return err == nil && n >= 0
+	}
+
+	// ValidateDurationOrEmpty accepts an empty value or a Go duration string (e.g. "30s", "24h").
+	ValidateDurationOrEmpty = func(v EnvVariable) bool {
+		if v.Value == "" {
+			return true
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(v.Value))
+		return err == nil && d >= 0
+	}
+
+	// ValidateSessionHostTimeouts accepts a comma-separated list of host=idle[/absolute] entries,
+	// hosts as in CALLBACK_ALLOWED_DOMAINS and timeouts as Go durations; either timeout may be
+	// empty, but not both.
+	ValidateSessionHostTimeouts = func(v EnvVariable) bool {
+		_, err := ParseSessionHostTimeouts(v.Value)
+		return err == nil
+	}
+
+	// ValidateAuditLogSinks accepts a comma-separated list drawn from PossibleValues (case-insensitive).
+	// An empty value is valid and disables audit persistence.
+	ValidateAuditLogSinks = func(v EnvVariable) bool {
+		for _, sink := range strings.Split(v.Value, ",") {
+			sink = strings.TrimSpace(sink)
+			if sink == "" {
+				continue
+			}
+			if err := validator.ValidateEnum(sink, v.PossibleValues, false); err != nil {
 				return false
 			}
 		}
+		return true
+	}
 
+	// ValidateCallbackDomains accepts a comma-separated list of host names, "*.domain" wildcards
+	// and ".domain" entries. Schemes, paths and bare "*" are rejected.
+	ValidateCallbackDomains = func(v EnvVariable) bool {
+		for _, entry := range strings.Split(v.Value, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			name := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+			if name == "" || strings.ContainsAny(name, "*/\\?#@ ") {
+				return false
+			}
+		}
 		return true
 	}
 
+	// ValidateTrustedProxies accepts a comma-separated list of IP addresses and CIDR ranges.
+	ValidateTrustedProxies = func(v EnvVariable) bool {
+		_, err := NewTrustedProxySet(v.ToList()...)
+		return err == nil
+	}
+
+	// ValidateURLOrEmpty accepts an empty value or an absolute http(s) URL.
+	ValidateURLOrEmpty = func(v EnvVariable) bool {
+		if v.Value == "" {
+			return true
+		}
+		u, err := url.Parse(v.Value)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+	}
+
+	// ValidatePolicyFile accepts an empty value or the path of a policy file that parses.
+	ValidatePolicyFile = func(v EnvVariable) bool {
+		if v.Value == "" {
+			return true
+		}
+		_, err := policy.LoadFile(v.Value)
+		return err == nil
+	}
+
+	// ValidateIDPClientsFile accepts an empty value or the path of a client registry that parses.
+	ValidateIDPClientsFile = func(v EnvVariable) bool {
+		if v.Value == "" {
+			return true
+		}
+		_, err := idp.LoadClients(v.Value)
+		return err == nil
+	}
+
+	// ValidateSigningKeyFiles accepts an empty value or a comma-separated list of PEM private keys.
+	ValidateSigningKeyFiles = func(v EnvVariable) bool {
+		for _, path := range v.ToList() {
+			if _, err := keyring.LoadFile(path); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	// ValidateAPITokensFile accepts an empty value, a missing file (created on first write) or a
+	// token file that parses.
+	ValidateAPITokensFile = func(v EnvVariable) bool {
+		if v.Value == "" {
+			return true
+		}
+		_, err := apitoken.NewFileStorage(v.Value)
+		return err == nil
+	}
+
+	// ValidateStoreFile accepts an empty value, a missing file (created on first write) or a
+	// key-value store file (passkeys, TOTP secrets) that parses.
+	ValidateStoreFile = func(v EnvVariable) bool {
+		if v.Value == "" {
+			return true
+		}
+		_, err := filestore.Open(v.Value)
+		return err == nil
+	}
+
+	// ValidateTOTPEncryptionKey accepts an empty value or a base64-encoded 32 byte key.
+	ValidateTOTPEncryptionKey = func(v EnvVariable) bool {
+		if v.Value == "" {
+			return true
+		}
+		_, err := totpstore.ParseKey(v.Value)
+		return err == nil
+	}
+
+	// ValidateRPIDOrEmpty accepts an empty value or a bare domain name, without scheme or port.
+	ValidateRPIDOrEmpty = func(v EnvVariable) bool {
+		return v.Value == "" || !strings.ContainsAny(v.Value, ":/ *")
+	}
+
+	// ValidateOrigins accepts a comma-separated list of bare http(s) origins, e.g.
+	// "https://auth.example.com".
+	ValidateOrigins = func(v EnvVariable) bool {
+		for _, origin := range v.ToList() {
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+				return false
+			}
+		}
+		return true
+	}
+
+	// ValidateJWKSFile accepts an empty value or the path of a JWKS document with at least one key.
+	ValidateJWKSFile = func(v EnvVariable) bool {
+		if v.Value == "" {
+			return true
+		}
+		data, err := os.ReadFile(v.Value)
+		if err != nil {
+			return false
+		}
+		set, err := jose.ParseJWKS(data)
+		return err == nil && len(set.Keys) > 0
+	}
+
 	// ValidatePasswordsOrEmpty allows empty value (for pure Warden deployment); otherwise same as ValidatePasswords.
 	ValidatePasswordsOrEmpty = func(v EnvVariable) bool {
 		if v.Value == "" {
@@ -138,6 +356,28 @@ var (
 	}
 )
 
+// validHash reports whether hash is well-formed for algorithm. Only PHC hashes have a structure
+// that can be checked up front.
+func validHash(algorithm, hash string) bool {
+	for _, phc := range passhash.Algorithms {
+		if algorithm == phc {
+			return passhash.Validate(algorithm, hash) == nil
+		}
+	}
+	return true
+}
+
+// validUsers reports whether every hash in list can be checked and no name is repeated.
+func validUsers(list []users.User) bool {
+	for _, u := range list {
+		if _, ok := SupportedAlgorithms[u.Algorithm]; !ok || !validHash(u.Algorithm, u.Hash) {
+			return false
+		}
+	}
+	_, err := users.New(list...)
+	return err == nil
+}
+
 type ValidationError struct {
 	KeyName        string
 	AcceptedValues []string
@@ -0,0 +1,110 @@
+// Package filestore is a small key-value store persisted as a JSON document. It stands in for the
+// Redis session storage in single-instance deployments, for the stores of personal access tokens,
+// passkeys and TOTP secrets.
+package filestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Storage is a key-value store persisted as a JSON document, with the Get/Set/Delete methods of
+// the Fiber session storage. Every write rewrites the file atomically.
+type Storage struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]fileEntry
+	now     func() time.Time
+}
+
+// fileEntry is a stored value with its expiry (zero for none).
+type fileEntry struct {
+	Value     []byte    `json:"value"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// Open opens (or creates on first write) the file at path.
+func Open(path string) (*Storage, error) {
+	s := &Storage{path: path, entries: map[string]fileEntry{}, now: time.Now}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.entries); err != nil {
+			return nil, fmt.Errorf("invalid storage file %s: %w", path, err)
+		}
+	}
+	return s, nil
+}
+
+// Get returns the value of key, or nil when it is missing or expired.
+func (s *Storage) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || s.expired(e) {
+		return nil, nil
+	}
+	return e.Value, nil
+}
+
+// Set stores val under key; exp <= 0 keeps it until deleted.
+func (s *Storage) Set(key string, val []byte, exp time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := fileEntry{Value: val}
+	if exp > 0 {
+		e.ExpiresAt = s.now().Add(exp)
+	}
+	s.entries[key] = e
+	return s.flush()
+}
+
+// Delete removes key.
+func (s *Storage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[key]; !ok {
+		return nil
+	}
+	delete(s.entries, key)
+	return s.flush()
+}
+
+func (s *Storage) expired(e fileEntry) bool {
+	return !e.ExpiresAt.IsZero() && !s.now().Before(e.ExpiresAt)
+}
+
+// flush drops expired entries and writes the file through a temporary file and rename.
+func (s *Storage) flush() error {
+	for key, e := range s.entries {
+		if s.expired(e) {
+			delete(s.entries, key)
+		}
+	}
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
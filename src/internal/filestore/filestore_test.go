@@ -0,0 +1,46 @@
+package filestore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+)
+
+func TestStorage_ExpiryAndPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	s, err := Open(path)
+	testza.AssertNoError(t, err)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	testza.AssertNoError(t, s.Set("kept", []byte("a"), 0))
+	testza.AssertNoError(t, s.Set("short", []byte("b"), time.Minute))
+	value, err := s.Get("short")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, []byte("b"), value)
+
+	now = now.Add(time.Minute)
+	value, err = s.Get("short")
+	testza.AssertNoError(t, err)
+	testza.AssertNil(t, value)
+
+	// Writes drop expired entries from the file
+	testza.AssertNoError(t, s.Delete("missing"))
+	testza.AssertNoError(t, s.Set("other", []byte("c"), 0))
+	reopened, err := Open(path)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, 2, len(reopened.entries))
+	value, err = reopened.Get("kept")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, []byte("a"), value)
+}
+
+func TestOpen_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	testza.AssertNoError(t, os.WriteFile(path, []byte("not json"), 0o600))
+	_, err := Open(path)
+	testza.AssertNotNil(t, err)
+}
@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/soulteary/stargate/src/internal/apitoken"
+	"github.com/soulteary/stargate/src/internal/auditlog"
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/idp"
+	"github.com/soulteary/stargate/src/internal/metrics"
+	"github.com/soulteary/stargate/src/internal/policy"
+)
+
+const (
+	// authMethodAPIToken is the audit method and metrics label for personal access tokens.
+	authMethodAPIToken = "api_token"
+	// apiTokenDefaultDays is the lifetime of a new token when the request does not give one.
+	apiTokenDefaultDays = 30
+)
+
+// bearerToken returns the credentials of an "Authorization: Bearer" header, or "".
+func bearerToken(ctx *fiber.Ctx) string {
+	if header := ctx.Get(fiber.HeaderAuthorization); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return ""
+}
+
+// setIdentityHeaders sets the user headers of a successful /_auth response for identity.
+func setIdentityHeaders(ctx *fiber.Ctx, identity idp.Identity) {
+	ctx.Set(config.UserHeaderName.String(), identity.Subject)
+	ctx.Set(authUserHeader, identity.Subject)
+	for header, value := range map[string]string{
+		authEmailHeader:  identity.Email,
+		authNameHeader:   identity.Name,
+		authRoleHeader:   identity.Role,
+		authScopesHeader: strings.Join(identity.Groups, ","),
+		authAMRHeader:    strings.Join(identity.AMR, ","),
+	} {
+		if value != "" {
+			ctx.Set(header, value)
+		}
+	}
+}
+
+// checkAPIToken authenticates a /_auth request carrying a personal access token. The token acts
+// for its owner with the token's scopes and no amr, so it never satisfies step-up.
+func checkAPIToken(ctx *fiber.Ctx, tokens *apitoken.Store, value string, req policy.Request, span trace.Span) error {
+	token, err := tokens.Authenticate(value)
+	if err != nil {
+		span.SetAttributes(attribute.Bool("auth.authenticated", false))
+		if !errors.Is(err, apitoken.ErrInvalidToken) {
+			log.Error().Err(err).Msg("Failed to read API token")
+			return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.api_token_store_failed"))
+		}
+		metrics.RecordAuthRequest(authMethodAPIToken, "failure")
+		auditlog.LogLogin(ctx.Context(), "", authMethodAPIToken, GetClientIP(ctx), false, "invalid_token")
+		ctx.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.api_token_invalid"))
+	}
+
+	return acceptRequestIdentity(ctx, idp.Identity{
+		Subject: token.Owner.UserID,
+		Email:   token.Owner.Email,
+		Name:    token.Owner.Name,
+		Role:    token.Owner.Role,
+		Groups:  token.Scopes,
+	}, authMethodAPIToken, req, span)
+}
+
+// acceptRequestIdentity finishes a /_auth request authenticated by its own credentials (a Bearer
+// token or HTTP Basic): identity is checked against the access policy and forwarded to the
+// upstream. Step-up paths are refused, as such credentials are no proof of a recent interactive
+// step-up.
+func acceptRequestIdentity(ctx *fiber.Ctx, identity idp.Identity, method string, req policy.Request, span trace.Span) error {
+	subject := policy.Subject{UserID: identity.Subject, Role: identity.Role, Scopes: identity.Groups, AMR: identity.AMR}
+	if decision := policy.Get().Authorize(req, subject); !decision.Allowed {
+		span.SetAttributes(
+			attribute.Bool("auth.authenticated", true),
+			attribute.Bool("auth.policy_denied", true),
+			attribute.String("auth.policy_rule", decision.Rule),
+		)
+		return handlePolicyDenied(ctx, subject, decision)
+	}
+	if RequiresStepUp(ctx) {
+		span.SetAttributes(attribute.Bool("auth.step_up_required", true))
+		return SendErrorResponse(ctx, fiber.StatusForbidden, i18n.T(ctx, "error.step_up_required"))
+	}
+
+	setIdentityHeaders(ctx, identity)
+	if err := setIdentityAssertion(ctx, identity); err != nil {
+		log.Error().Err(err).Msg("Failed to sign identity JWT")
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.auth_jwt_failed"))
+	}
+	metrics.RecordAuthRequest(method, "success")
+	span.SetAttributes(
+		attribute.Bool("auth.authenticated", true),
+		attribute.String("auth.user_id", identity.Subject),
+		attribute.String("auth.method", method),
+	)
+	return ctx.SendStatus(fiber.StatusOK)
+}
+
+// apiTokenView is a token as listed to its owner; the hash stays on the server.
+type apiTokenView struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newAPITokenView(t *apitoken.Token) apiTokenView {
+	scopes := t.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+	return apiTokenView{ID: t.ID, Name: t.Name, Scopes: scopes, CreatedAt: t.CreatedAt, ExpiresAt: t.ExpiresAt}
+}
+
+// apiTokenRequest is the body of POST /_tokens.
+type apiTokenRequest struct {
+	Name          string   `json:"name" form:"name"`
+	Scopes        []string `json:"scopes" form:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days" form:"expires_in_days"`
+}
+
+// apiTokensPageHandler is the internal handler that can be tested with mocked dependencies.
+func apiTokensPageHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, tokens *apitoken.Store) error {
+	if tokens == nil {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.api_tokens_disabled"))
+	}
+	sess, userID, err := loggedInSession(ctx, sessionGetter)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	if !auth.IsAuthenticated(sess) {
+		if IsHTMLRequest(ctx) {
+			return ctx.Redirect(authHostLoginURL(ctx), fiber.StatusFound)
+		}
+		return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.auth_required"))
+	}
+	if userID == "" {
+		return SendErrorResponse(ctx, fiber.StatusForbidden, i18n.T(ctx, "error.api_token_no_user"))
+	}
+
+	list, err := tokens.List(userID)
+	if err != nil {
+		log.Error().Err(err).Str("user_id", userID).Msg("Failed to list API tokens")
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.api_token_store_failed"))
+	}
+	views := make([]apiTokenView, 0, len(list))
+	for _, t := range list {
+		views = append(views, newAPITokenView(t))
+	}
+	if !IsHTMLRequest(ctx) {
+		return ctx.JSON(fiber.Map{"tokens": views})
+	}
+	return ctx.Render("api_tokens", fiber.Map{
+		"Title":   config.LoginPageTitle.Value,
+		"Tokens":  views,
+		"Scopes":  sessionStrings(sess.Get("user_scope")),
+		"MaxDays": int(tokens.MaxTTL() / (24 * time.Hour)),
+	})
+}
+
+// apiTokenCreateHandler is the internal handler that can be tested with mocked dependencies.
+func apiTokenCreateHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, tokens *apitoken.Store) error {
+	if tokens == nil {
+		return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{"ok": false, "error": "disabled"})
+	}
+	sess, userID, err := loggedInSession(ctx, sessionGetter)
+	if err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "session_store_failed"})
+	}
+	if !auth.IsAuthenticated(sess) {
+		return ctx.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ok": false, "error": "unauthorized"})
+	}
+	if userID == "" {
+		return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{"ok": false, "error": "no_user_id"})
+	}
+
+	var body apiTokenRequest
+	if err := ctx.BodyParser(&body); err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ok": false, "error": "invalid_request"})
+	}
+	if body.ExpiresInDays == 0 {
+		body.ExpiresInDays = apiTokenDefaultDays
+		if maxDays := int(tokens.MaxTTL() / (24 * time.Hour)); maxDays > 0 && body.ExpiresInDays > maxDays {
+			body.ExpiresInDays = maxDays
+		}
+	}
+	scopes := make([]string, 0, len(body.Scopes))
+	for _, scope := range body.Scopes {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	str := func(key string) string {
+		s, _ := sess.Get(key).(string)
+		return s
+	}
+	owner := apitoken.Owner{UserID: userID, Email: str("user_mail"), Name: str("user_name"), Role: str("user_role")}
+	ttl := time.Duration(body.ExpiresInDays) * 24 * time.Hour
+	secret, token, err := tokens.Mint(owner, body.Name, scopes, sessionStrings(sess.Get("user_scope")), ttl)
+	switch {
+	case errors.Is(err, apitoken.ErrInvalidName):
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ok": false, "error": "invalid_name"})
+	case errors.Is(err, apitoken.ErrInvalidTTL):
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ok": false, "error": "invalid_expiry"})
+	case errors.Is(err, apitoken.ErrInvalidScope):
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ok": false, "error": "invalid_scope"})
+	case errors.Is(err, apitoken.ErrTooManyTokens):
+		return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{"ok": false, "error": "too_many_tokens"})
+	case err != nil:
+		log.Error().Err(err).Str("user_id", userID).Msg("Failed to create API token")
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "store_failed"})
+	}
+
+	auditlog.LogAPIToken(ctx.Context(), userID, token.ID, "api_token_create", GetClientIP(ctx))
+	log.Info().Str("user_id", userID).Str("token_id", token.ID).Time("expires_at", token.ExpiresAt).Msg("API token created")
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"ok":    true,
+		"token": secret,
+		"info":  newAPITokenView(token),
+	})
+}
+
+// apiTokenRevokeHandler is the internal handler that can be tested with mocked dependencies.
+func apiTokenRevokeHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, tokens *apitoken.Store) error {
+	if tokens == nil {
+		return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{"ok": false, "error": "disabled"})
+	}
+	sess, userID, err := loggedInSession(ctx, sessionGetter)
+	if err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "session_store_failed"})
+	}
+	if !auth.IsAuthenticated(sess) {
+		return ctx.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ok": false, "error": "unauthorized"})
+	}
+	if userID == "" {
+		return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{"ok": false, "error": "no_user_id"})
+	}
+
+	id := ctx.FormValue("id")
+	if id == "" {
+		var body struct {
+			ID string `json:"id"`
+		}
+		_ = ctx.BodyParser(&body)
+		id = body.ID
+	}
+	if _, err := tokens.Revoke(userID, id); err != nil {
+		if errors.Is(err, apitoken.ErrNotFound) {
+			return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{"ok": false, "error": "not_found"})
+		}
+		log.Error().Err(err).Str("user_id", userID).Msg("Failed to revoke API token")
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "store_failed"})
+	}
+
+	auditlog.LogAPIToken(ctx.Context(), userID, id, "api_token_revoke", GetClientIP(ctx))
+	log.Info().Str("user_id", userID).Str("token_id", id).Msg("API token revoked")
+	return ctx.JSON(fiber.Map{"ok": true, "id": id})
+}
+
+// APITokensRoute handles GET /_tokens: the self-service page listing the user's personal access
+// tokens, or the list as JSON for non-HTML requests.
+func APITokensRoute(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return apiTokensPageHandler(ctx, sessionGetter, apitoken.Get())
+	}
+}
+
+// APITokenCreateAPI handles POST /_tokens, minting a token for the logged-in user. The token is
+// returned once and cannot be retrieved again.
+func APITokenCreateAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return apiTokenCreateHandler(ctx, sessionGetter, apitoken.Get())
+	}
+}
+
+// APITokenRevokeAPI handles POST /_tokens/revoke, deleting one of the logged-in user's tokens.
+func APITokenRevokeAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return apiTokenRevokeHandler(ctx, sessionGetter, apitoken.Get())
+	}
+}
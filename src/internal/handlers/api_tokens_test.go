@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/stargate/src/internal/apitoken"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+)
+
+// apiTokenTestApp serves the /_tokens routes, plus /test_login creating a session for user-1 and
+// /test_login_password creating a password-only session without a user ID.
+func apiTokenTestApp(t *testing.T, tokens *apitoken.Store) *fiber.App {
+	t.Helper()
+	store := setupTestStore()
+	sessionGetter := &SessionStoreAdapter{store: store}
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("i18n-bundle", i18n.GetBundle())
+		c.Locals("i18n-language", i18n.LangEN)
+		return c.Next()
+	})
+	app.Get("/_tokens", func(c *fiber.Ctx) error {
+		return apiTokensPageHandler(c, sessionGetter, tokens)
+	})
+	app.Post("/_tokens", func(c *fiber.Ctx) error {
+		return apiTokenCreateHandler(c, sessionGetter, tokens)
+	})
+	app.Post("/_tokens/revoke", func(c *fiber.Ctx) error {
+		return apiTokenRevokeHandler(c, sessionGetter, tokens)
+	})
+	app.Get("/test_login", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("user_id", "user-1")
+		sess.Set("user_mail", "alice@example.com")
+		sess.Set("user_role", "admin")
+		sess.Set("user_scope", []string{"read", "write"})
+		return (&AuthAuthenticator{}).Authenticate(sess)
+	})
+	app.Get("/test_login_password", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		return (&AuthAuthenticator{}).Authenticate(sess)
+	})
+	return app
+}
+
+func setupAPITokenTest(t *testing.T) (*apitoken.Store, *fiber.App, *http.Cookie) {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+	InitForwardAuthHandler(testLogger())
+
+	tokens := apitoken.New(setupTestStore().Storage, 0)
+	apitoken.Init(tokens)
+	t.Cleanup(func() { apitoken.Init(nil) })
+	app := apiTokenTestApp(t, tokens)
+
+	cookie := sessionCookie(oidcRequest(t, app, "/test_login", nil))
+	testza.AssertNotNil(t, cookie)
+	return tokens, app, cookie
+}
+
+func apiTokenCall(t *testing.T, app *fiber.App, method, target, body string, cookie *http.Cookie) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	var decoded map[string]interface{}
+	testza.AssertNoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+	return resp, decoded
+}
+
+func TestAPITokens_CreateListRevoke(t *testing.T) {
+	tokens, app, cookie := setupAPITokenTest(t)
+
+	resp, body := apiTokenCall(t, app, http.MethodPost, "/_tokens", `{"name":"ci","scopes":["read"],"expires_in_days":7}`, cookie)
+	testza.AssertEqual(t, fiber.StatusCreated, resp.StatusCode)
+	testza.AssertEqual(t, "no-store", resp.Header.Get("Cache-Control"))
+	secret := body["token"].(string)
+	testza.AssertTrue(t, strings.HasPrefix(secret, apitoken.Prefix))
+	id := body["info"].(map[string]interface{})["id"].(string)
+
+	token, err := tokens.Authenticate(secret)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, apitoken.Owner{UserID: "user-1", Email: "alice@example.com", Role: "admin"}, token.Owner)
+
+	resp, body = apiTokenCall(t, app, http.MethodGet, "/_tokens", "", cookie)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	list := body["tokens"].([]interface{})
+	testza.AssertLen(t, list, 1)
+	listed := list[0].(map[string]interface{})
+	testza.AssertEqual(t, id, listed["id"])
+	testza.AssertNil(t, listed["hash"])
+
+	resp, _ = apiTokenCall(t, app, http.MethodPost, "/_tokens/revoke", `{"id":"`+id+`"}`, cookie)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	_, err = tokens.Authenticate(secret)
+	testza.AssertEqual(t, apitoken.ErrInvalidToken, err)
+
+	resp, body = apiTokenCall(t, app, http.MethodPost, "/_tokens/revoke", `{"id":"`+id+`"}`, cookie)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+	testza.AssertEqual(t, "not_found", body["error"])
+}
+
+func TestAPITokens_CreateValidation(t *testing.T) {
+	_, app, cookie := setupAPITokenTest(t)
+
+	for body, want := range map[string]string{
+		`{"name":""}`:                            "invalid_name",
+		`{"name":"ci","scopes":["admin"]}`:       "invalid_scope",
+		`{"name":"ci","expires_in_days":100000}`: "invalid_expiry",
+		`{"name":"ci","expires_in_days":-1}`:     "invalid_expiry",
+	} {
+		resp, decoded := apiTokenCall(t, app, http.MethodPost, "/_tokens", body, cookie)
+		testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode, body)
+		testza.AssertEqual(t, want, decoded["error"], body)
+	}
+}
+
+func TestAPITokens_RequiresUser(t *testing.T) {
+	_, app, _ := setupAPITokenTest(t)
+
+	resp, body := apiTokenCall(t, app, http.MethodPost, "/_tokens", `{"name":"ci"}`, nil)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	testza.AssertEqual(t, "unauthorized", body["error"])
+
+	password := sessionCookie(oidcRequest(t, app, "/test_login_password", nil))
+	resp, body = apiTokenCall(t, app, http.MethodPost, "/_tokens", `{"name":"ci"}`, password)
+	testza.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode)
+	testza.AssertEqual(t, "no_user_id", body["error"])
+}
+
+func TestAPITokens_Disabled(t *testing.T) {
+	app := apiTokenTestApp(t, nil)
+	resp, _ := apiTokenCall(t, app, http.MethodPost, "/_tokens", `{"name":"ci"}`, nil)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+}
+
+func TestCheckRoute_APIToken(t *testing.T) {
+	tokens, _, _ := setupAPITokenTest(t)
+	secret, _, err := tokens.Mint(apitoken.Owner{UserID: "user-1", Email: "alice@example.com"}, "ci", []string{"read"}, []string{"read"}, apitoken.DefaultMaxTTL)
+	testza.AssertNoError(t, err)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":           "application/json",
+		"Authorization":    "Bearer " + secret,
+		"X-Forwarded-Host": "app.example.com",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	checkWithSession(t, ctx, nil)
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "user-1", string(ctx.Response().Header.Peek("X-Auth-User")))
+	testza.AssertEqual(t, "user-1", string(ctx.Response().Header.Peek(config.UserHeaderName.String())))
+	testza.AssertEqual(t, "alice@example.com", string(ctx.Response().Header.Peek("X-Auth-Email")))
+	testza.AssertEqual(t, "read", string(ctx.Response().Header.Peek("X-Auth-Scopes")))
+}
+
+func TestCheckRoute_APIToken_Invalid(t *testing.T) {
+	setupAPITokenTest(t)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":           "application/json",
+		"Authorization":    "Bearer stg_AAAAAAAAAAAA_wrong",
+		"X-Forwarded-Host": "app.example.com",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	checkWithSession(t, ctx, nil)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, ctx.Response().StatusCode())
+	testza.AssertEqual(t, `Bearer error="invalid_token"`, string(ctx.Response().Header.Peek("WWW-Authenticate")))
+}
+
+func TestCheckRoute_APIToken_PolicyUsesTokenScopes(t *testing.T) {
+	tokens, _, _ := setupAPITokenTest(t)
+	useTestPolicy(t, `
+rules:
+  - name: writers
+    hosts: ["app.example.com"]
+    scopes: [write]
+`)
+	secret, _, err := tokens.Mint(apitoken.Owner{UserID: "user-1"}, "ci", []string{"read"}, []string{"read", "write"}, apitoken.DefaultMaxTTL)
+	testza.AssertNoError(t, err)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":           "application/json",
+		"Authorization":    "Bearer " + secret,
+		"X-Forwarded-Host": "app.example.com",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	checkWithSession(t, ctx, nil)
+	testza.AssertEqual(t, fiber.StatusForbidden, ctx.Response().StatusCode())
+}
+
+func TestCheckRoute_OtherBearerFallsThrough(t *testing.T) {
+	setupAPITokenTest(t)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":           "application/json",
+		"Authorization":    "Bearer upstream-token",
+		"X-Forwarded-Host": "app.example.com",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	// The upstream's own Bearer token does not replace the session
+	checkWithSession(t, ctx, map[string]interface{}{"user_id": "user-1"})
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/idp"
+	"github.com/soulteary/stargate/src/internal/keyring"
+)
+
+// DefaultAssertionTTL is the lifetime of the identity JWT when AUTH_JWT_TTL is not positive.
+const DefaultAssertionTTL = 5 * time.Minute
+
+// assertionIssuer returns the "iss" of the identity JWT: AUTH_JWT_ISSUER, or https://{AUTH_HOST}.
+func assertionIssuer() string {
+	if issuer := config.AuthJWTIssuer.String(); issuer != "" {
+		return issuer
+	}
+	return "https://" + config.AuthHost.String()
+}
+
+// identityAssertion signs the identity JWT forwarded to the upstream with the /_auth response.
+// The audience is the forwarded host, so a token captured by one upstream is not accepted by another.
+func identityAssertion(ctx *fiber.Ctx, identity idp.Identity, ring *keyring.KeyRing, now time.Time) (string, error) {
+	if ring == nil {
+		return "", keyring.ErrNoKeys
+	}
+	ttl := config.AuthJWTTTL.ToDuration()
+	if ttl <= 0 {
+		ttl = DefaultAssertionTTL
+	}
+
+	sub := identity.Subject
+	if sub == "" {
+		// Password logins carry no user ID; use the same value as the user header
+		sub = "authenticated"
+	}
+	claims := map[string]interface{}{
+		"iss": assertionIssuer(),
+		"sub": sub,
+		"aud": GetForwardedHost(ctx),
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+	}
+	if identity.Email != "" {
+		claims["email"] = identity.Email
+	}
+	if identity.Name != "" {
+		claims["name"] = identity.Name
+	}
+	if identity.Role != "" {
+		claims["role"] = identity.Role
+	}
+	if len(identity.Groups) > 0 {
+		claims["scopes"] = identity.Groups
+	}
+	if len(identity.AMR) > 0 {
+		claims["amr"] = identity.AMR
+	}
+	return ring.Sign(claims)
+}
+
+// setIdentityAssertion adds the identity JWT to the /_auth response when AUTH_JWT_ENABLED is set.
+func setIdentityAssertion(ctx *fiber.Ctx, identity idp.Identity) error {
+	if !config.AuthJWTEnabled.ToBool() {
+		return nil
+	}
+	token, err := identityAssertion(ctx, identity, keyring.Get(), time.Now())
+	if err != nil {
+		return err
+	}
+	ctx.Set(config.AuthJWTHeader.String(), token)
+	return nil
+}
+
+// JWKSRoute handles GET requests to /.well-known/jwks.json, publishing the keys upstreams use to
+// verify the identity JWT forwarded by /_auth.
+func JWKSRoute() func(c *fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		ring := keyring.Get()
+		if ring == nil {
+			return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.signing_keys_not_configured"))
+		}
+		return ctx.JSON(ring.JWKS())
+	}
+}
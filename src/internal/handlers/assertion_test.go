@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/idp"
+	"github.com/soulteary/stargate/src/internal/jose"
+	"github.com/soulteary/stargate/src/internal/keyring"
+)
+
+// setupAssertionConfig enables AUTH_JWT_ENABLED with a fresh signing key and returns the ring.
+func setupAssertionConfig(t *testing.T) *keyring.KeyRing {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("AUTH_JWT_ENABLED", "true")
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+	InitForwardAuthHandler(testLogger())
+
+	key, err := keyring.Generate(jose.ES256)
+	testza.AssertNoError(t, err)
+	ring := keyring.New(key)
+	keyring.Init(ring)
+	t.Cleanup(func() {
+		keyring.Init(nil)
+		config.AuthJWTEnabled.Value = "false"
+	})
+	return ring
+}
+
+func TestIdentityAssertion(t *testing.T) {
+	ring := setupAssertionConfig(t)
+	store := setupTestStore()
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{"X-Forwarded-Host": "app.example.com"}, "")
+	defer app.ReleaseCtx(ctx)
+
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+	sess.Set("user_id", "u-1")
+	sess.Set("user_mail", "alice@example.com")
+	sess.Set("user_role", "admin")
+	sess.Set("user_scope", []string{"read", "write"})
+	sess.Set(amrSessionKey, []string{"pwd", "otp"})
+
+	now := time.Now()
+	token, err := identityAssertion(ctx, sessionIdentity(sess), ring, now)
+	testza.AssertNoError(t, err)
+
+	parsed, err := jose.Verify(token, ring.JWKS())
+	testza.AssertNoError(t, err)
+	testza.AssertNoError(t, parsed.Claims.Validate(jose.Expected{
+		Issuer:        "https://auth.example.com",
+		Audience:      "app.example.com",
+		RequireExpiry: true,
+	}))
+	testza.AssertEqual(t, "u-1", parsed.Claims.String("sub"))
+	testza.AssertEqual(t, "alice@example.com", parsed.Claims.String("email"))
+	testza.AssertEqual(t, "admin", parsed.Claims.String("role"))
+	testza.AssertEqual(t, []string{"read", "write"}, parsed.Claims.Strings("scopes"))
+	testza.AssertEqual(t, []string{"pwd", "otp"}, parsed.Claims.Strings("amr"))
+	exp, ok := parsed.Claims.Time("exp")
+	testza.AssertTrue(t, ok)
+	testza.AssertEqual(t, now.Add(DefaultAssertionTTL).Unix(), exp.Unix())
+
+	// Expired outside the TTL and bound to the forwarded host
+	testza.AssertEqual(t, jose.ErrExpired, parsed.Claims.Validate(jose.Expected{Now: now.Add(DefaultAssertionTTL + time.Second)}))
+	testza.AssertEqual(t, jose.ErrInvalidAudience, parsed.Claims.Validate(jose.Expected{Audience: "other.example.com"}))
+}
+
+func TestIdentityAssertion_NoKeys(t *testing.T) {
+	ctx, app := createTestContext("GET", "/_auth", nil, "")
+	defer app.ReleaseCtx(ctx)
+
+	_, err := identityAssertion(ctx, idp.Identity{Subject: "u-1"}, nil, time.Now())
+	testza.AssertEqual(t, keyring.ErrNoKeys, err)
+}
+
+func TestCheckRoute_IdentityJWT(t *testing.T) {
+	ring := setupAssertionConfig(t)
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":           "application/json",
+		"X-Forwarded-Host": "app.example.com",
+		"X-Forwarded-Uri":  "/",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	checkWithSession(t, ctx, map[string]interface{}{"user_id": "u-1"})
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+
+	token := string(ctx.Response().Header.Peek("X-Auth-JWT"))
+	parsed, err := jose.Verify(token, ring.JWKS())
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "u-1", parsed.Claims.String("sub"))
+	testza.AssertEqual(t, []string{"app.example.com"}, parsed.Claims.Strings("aud"))
+}
+
+func TestCheckRoute_IdentityJWT_FailsClosedWithoutKeys(t *testing.T) {
+	setupAssertionConfig(t)
+	keyring.Init(nil)
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":           "application/json",
+		"X-Forwarded-Host": "app.example.com",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	checkWithSession(t, ctx, map[string]interface{}{"user_id": "u-1"})
+	testza.AssertEqual(t, fiber.StatusInternalServerError, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "", string(ctx.Response().Header.Peek("X-Auth-JWT")))
+}
+
+func TestJWKSRoute(t *testing.T) {
+	app := fiber.New()
+	app.Get("/.well-known/jwks.json", JWKSRoute())
+
+	keyring.Init(nil)
+	resp, err := app.Test(httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+
+	ring := setupAssertionConfig(t)
+	resp, err = app.Test(httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	testza.AssertNoError(t, err)
+	var set jose.JWKS
+	testza.AssertNoError(t, json.Unmarshal(body, &set))
+	testza.AssertEqual(t, ring.JWKS().Keys[0].Kid, set.Keys[0].Kid)
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/soulteary/stargate/src/internal/auditlog"
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/idp"
+	"github.com/soulteary/stargate/src/internal/metrics"
+	"github.com/soulteary/stargate/src/internal/policy"
+	"github.com/soulteary/stargate/src/internal/ratelimit"
+)
+
+const (
+	// authMethodBasic is the audit method and metrics label for HTTP Basic credentials of named users.
+	authMethodBasic = "basic"
+	// basicChallenge is the WWW-Authenticate header of a rejected Basic request.
+	basicChallenge = `Basic realm="stargate", charset="UTF-8"`
+
+	// basicAuthCacheTTL is how long verified Basic credentials are accepted without hashing the
+	// password again. CLI clients send them with every request.
+	basicAuthCacheTTL = time.Minute
+	// basicAuthCacheSize bounds the verified credentials kept in memory.
+	basicAuthCacheSize = 1024
+	// maxBasicAuthChecks bounds the Basic password checks running at once: each may be a
+	// memory-hard hash (64 MiB for argon2id).
+	maxBasicAuthChecks = 4
+)
+
+// basicAuthCache remembers recently verified Basic credentials. Entries are keyed by an HMAC of
+// the user name and password under a random per-process key, so the cache holds neither the
+// password nor a fast unsalted digest of it.
+type basicAuthCache struct {
+	mu      sync.Mutex
+	key     []byte
+	entries map[string]time.Time
+	now     func() time.Time
+}
+
+// newBasicAuthCache creates an empty cache with a fresh key.
+func newBasicAuthCache() *basicAuthCache {
+	key := make([]byte, 32)
+	// crypto/rand.Read never returns an error
+	_, _ = rand.Read(key)
+	return &basicAuthCache{key: key, entries: make(map[string]time.Time), now: time.Now}
+}
+
+// digest returns the cache key of a user name and password.
+func (c *basicAuthCache) digest(username, password string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return string(mac.Sum(nil))
+}
+
+// Contains reports whether username and password were verified less than basicAuthCacheTTL ago.
+func (c *basicAuthCache) Contains(username, password string) bool {
+	digest := c.digest(username, password)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.entries[digest]
+	return ok && c.now().Before(expires)
+}
+
+// Add records verified credentials. When the cache is full, expired entries are dropped first,
+// then an arbitrary one.
+func (c *basicAuthCache) Add(username, password string) {
+	digest := c.digest(username, password)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.entries) >= basicAuthCacheSize {
+		for key, expires := range c.entries {
+			if !now.Before(expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	if len(c.entries) >= basicAuthCacheSize {
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[digest] = now.Add(basicAuthCacheTTL)
+}
+
+var (
+	// verifiedBasicCredentials holds the Basic credentials that recently passed a password check.
+	verifiedBasicCredentials = newBasicAuthCache()
+	// basicAuthChecks holds a token per Basic password check in progress.
+	basicAuthChecks = make(chan struct{}, maxBasicAuthChecks)
+	// basicAuthCheckWait is how long a Basic request waits for a free check before it is refused.
+	basicAuthCheckWait = 5 * time.Second
+)
+
+// basicCredentials returns the username and password of an "Authorization: Basic" header.
+func basicCredentials(ctx *fiber.Ctx) (username, password string, ok bool) {
+	header := ctx.Get(fiber.HeaderAuthorization)
+	if len(header) < len("Basic ") || !strings.EqualFold(header[:len("Basic ")], "Basic ") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len("Basic "):]))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// checkBasicAuth authenticates a /_auth request carrying HTTP Basic credentials of a named user.
+// Recently verified credentials are accepted from a short-lived cache; other requests wait for
+// one of maxBasicAuthChecks password checks. Failures count towards the login rate limit like
+// form logins, and are answered with a Basic challenge instead of a login redirect.
+func checkBasicAuth(ctx *fiber.Ctx, username, password string, req policy.Request, span trace.Span) error {
+	// Only credentials that passed a check are cached, so a lockout caused by someone else's
+	// failures does not cut off a client that knows the password
+	if username != "" && verifiedBasicCredentials.Contains(username, password) {
+		return acceptRequestIdentity(ctx, idp.Identity{Subject: username}, authMethodBasic, req, span)
+	}
+
+	limitKeys := ratelimit.LoginKeys(GetClientIP(ctx), username)
+	if retryAfter := rateLimitRetryAfter(ctx, ratelimit.ScopeLogin, username, limitKeys...); retryAfter > 0 {
+		span.SetAttributes(attribute.Bool("auth.authenticated", false))
+		metrics.RecordAuthRequest(authMethodBasic, "rate_limited")
+		setRetryAfter(ctx, retryAfter)
+		return SendErrorResponse(ctx, fiber.StatusTooManyRequests, i18n.T(ctx, "error.rate_limited_retry"))
+	}
+
+	wait := time.NewTimer(basicAuthCheckWait)
+	defer wait.Stop()
+	select {
+	case basicAuthChecks <- struct{}{}:
+	case <-wait.C:
+		span.SetAttributes(attribute.Bool("auth.authenticated", false))
+		metrics.RecordAuthRequest(authMethodBasic, "busy")
+		setRetryAfter(ctx, time.Second)
+		return SendErrorResponse(ctx, fiber.StatusServiceUnavailable, i18n.T(ctx, "error.rate_limited_retry"))
+	}
+	valid := username != "" && auth.CheckUserPassword(username, password)
+	<-basicAuthChecks
+
+	if !valid {
+		span.SetAttributes(attribute.Bool("auth.authenticated", false))
+		metrics.RecordAuthRequest(authMethodBasic, "failure")
+		auditlog.LogLogin(ctx.Context(), "", authMethodBasic, GetClientIP(ctx), false, "invalid_credentials")
+		recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, username, limitKeys...)
+		ctx.Set(fiber.HeaderWWWAuthenticate, basicChallenge)
+		return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.basic_auth_invalid"))
+	}
+
+	verifiedBasicCredentials.Add(username, password)
+	resetRateLimit(ctx, ratelimit.LoginIdentifierKey(username))
+	return acceptRequestIdentity(ctx, idp.Identity{Subject: username}, authMethodBasic, req, span)
+}
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/users"
+)
+
+// setupUsersTest configures the named users alice and bob next to a shared password.
+func setupUsersTest(t *testing.T) {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("USERS", "alice:plaintext:Wonderland|bob:plaintext:builder")
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+	InitForwardAuthHandler(testLogger())
+
+	db, err := users.Load(config.Users.String(), "")
+	testza.AssertNoError(t, err)
+	users.Init(db)
+	verifiedBasicCredentials = newBasicAuthCache()
+	t.Cleanup(func() { users.Init(nil) })
+}
+
+// holdBasicAuthChecks takes every Basic password check slot until the test ends.
+func holdBasicAuthChecks(t *testing.T) {
+	t.Helper()
+	for i := 0; i < maxBasicAuthChecks; i++ {
+		basicAuthChecks <- struct{}{}
+	}
+	t.Cleanup(func() {
+		for i := 0; i < maxBasicAuthChecks; i++ {
+			<-basicAuthChecks
+		}
+	})
+}
+
+func basicCheck(t *testing.T, username, password string, session map[string]interface{}) *fiber.Ctx {
+	t.Helper()
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":           "application/json",
+		"Authorization":    "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)),
+		"X-Forwarded-Host": "app.example.com",
+	}, "")
+	t.Cleanup(func() { app.ReleaseCtx(ctx) })
+	checkWithSession(t, ctx, session)
+	return ctx
+}
+
+func TestBasicCredentials(t *testing.T) {
+	for header, want := range map[string][]string{
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:a:b")): {"alice", "a:b"},
+		"basic " + base64.StdEncoding.EncodeToString([]byte("alice:")):    {"alice", ""},
+	} {
+		ctx, app := createTestContext("GET", "/_auth", map[string]string{"Authorization": header}, "")
+		username, password, ok := basicCredentials(ctx)
+		app.ReleaseCtx(ctx)
+		testza.AssertTrue(t, ok, header)
+		testza.AssertEqual(t, want, []string{username, password}, header)
+	}
+
+	for _, header := range []string{"", "Bearer abc", "Basic !!!", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice"))} {
+		ctx, app := createTestContext("GET", "/_auth", map[string]string{"Authorization": header}, "")
+		_, _, ok := basicCredentials(ctx)
+		app.ReleaseCtx(ctx)
+		testza.AssertFalse(t, ok, header)
+	}
+}
+
+func TestCheckRoute_Basic(t *testing.T) {
+	setupUsersTest(t)
+
+	ctx := basicCheck(t, "alice", "Wonderland", nil)
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "alice", string(ctx.Response().Header.Peek("X-Auth-User")))
+	testza.AssertEqual(t, "alice", string(ctx.Response().Header.Peek(config.UserHeaderName.String())))
+}
+
+func TestCheckRoute_Basic_Invalid(t *testing.T) {
+	setupUsersTest(t)
+
+	for name, creds := range map[string][]string{
+		"wrong password":  {"alice", "wonderland"},
+		"unknown user":    {"carol", "Wonderland"},
+		"shared password": {"", "test123"},
+	} {
+		// Basic credentials are never replaced by the session
+		ctx := basicCheck(t, creds[0], creds[1], map[string]interface{}{"user_id": "user-1"})
+		testza.AssertEqual(t, fiber.StatusUnauthorized, ctx.Response().StatusCode(), name)
+		testza.AssertEqual(t, basicChallenge, string(ctx.Response().Header.Peek("WWW-Authenticate")), name)
+	}
+}
+
+func TestCheckRoute_Basic_Cached(t *testing.T) {
+	setupUsersTest(t)
+
+	ctx := basicCheck(t, "alice", "Wonderland", nil)
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+	testza.AssertTrue(t, verifiedBasicCredentials.Contains("alice", "Wonderland"))
+
+	ctx = basicCheck(t, "alice", "wonderland", nil)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, ctx.Response().StatusCode())
+	testza.AssertFalse(t, verifiedBasicCredentials.Contains("alice", "wonderland"), "failures are not cached")
+
+	// Cached credentials need no password check
+	holdBasicAuthChecks(t)
+	ctx = basicCheck(t, "alice", "Wonderland", nil)
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "alice", string(ctx.Response().Header.Peek("X-Auth-User")))
+}
+
+func TestBasicAuthCache(t *testing.T) {
+	cache := newBasicAuthCache()
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.Add("alice", "Wonderland")
+	testza.AssertTrue(t, cache.Contains("alice", "Wonderland"))
+	testza.AssertFalse(t, cache.Contains("alice", "wonderland"))
+	testza.AssertFalse(t, cache.Contains("aliceW", "onderland"), "the name and password are separated")
+
+	now = now.Add(basicAuthCacheTTL)
+	testza.AssertFalse(t, cache.Contains("alice", "Wonderland"), "expired")
+
+	for i := 0; i < basicAuthCacheSize+10; i++ {
+		cache.Add("user", strconv.Itoa(i))
+	}
+	testza.AssertEqual(t, basicAuthCacheSize, len(cache.entries))
+}
+
+func TestCheckRoute_Basic_Busy(t *testing.T) {
+	setupUsersTest(t)
+	holdBasicAuthChecks(t)
+	prev := basicAuthCheckWait
+	basicAuthCheckWait = 10 * time.Millisecond
+	t.Cleanup(func() { basicAuthCheckWait = prev })
+
+	ctx := basicCheck(t, "alice", "Wonderland", nil)
+	testza.AssertEqual(t, fiber.StatusServiceUnavailable, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "1", string(ctx.Response().Header.Peek(fiber.HeaderRetryAfter)))
+}
+
+func TestCheckRoute_Basic_RateLimited(t *testing.T) {
+	t.Setenv("RATE_LIMIT_MAX_FAILURES", "3")
+	setupUsersTest(t)
+	useTestRateLimiter(t)
+
+	for i := 0; i < 3; i++ {
+		ctx := basicCheck(t, "bob", "wrong", nil)
+		testza.AssertEqual(t, fiber.StatusUnauthorized, ctx.Response().StatusCode())
+	}
+
+	// Locked out: the right password is refused without being checked
+	holdBasicAuthChecks(t)
+	ctx := basicCheck(t, "bob", "builder", nil)
+	testza.AssertEqual(t, fiber.StatusTooManyRequests, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "60", string(ctx.Response().Header.Peek(fiber.HeaderRetryAfter)))
+}
+
+func TestCheckRoute_Basic_WithoutUsers(t *testing.T) {
+	setupUsersTest(t)
+	users.Init(nil)
+
+	// Basic credentials belong to the upstream, the session decides
+	ctx := basicCheck(t, "alice", "Wonderland", map[string]interface{}{"user_id": "user-1"})
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "user-1", string(ctx.Response().Header.Peek(config.UserHeaderName.String())))
+
+	ctx = basicCheck(t, "alice", "Wonderland", nil)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "", string(ctx.Response().Header.Peek("WWW-Authenticate")))
+}
+
+func TestCheckRoute_Basic_Policy(t *testing.T) {
+	setupUsersTest(t)
+	useTestPolicy(t, `
+rules:
+  - name: alice-only
+    hosts: ["app.example.com"]
+    user_ids: [alice]
+`)
+
+	ctx := basicCheck(t, "bob", "builder", nil)
+	testza.AssertEqual(t, fiber.StatusForbidden, ctx.Response().StatusCode())
+
+	ctx = basicCheck(t, "alice", "Wonderland", nil)
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+}
+
+func TestLoginAPI_NamedUser(t *testing.T) {
+	setupUsersTest(t)
+
+	login := func(body string) (*fiber.Ctx, *session.Session) {
+		ctx, app := createTestContext("POST", "/_login", map[string]string{
+			"Content-Type": "application/x-www-form-urlencoded",
+			"Accept":       "application/json",
+		}, body)
+		t.Cleanup(func() { app.ReleaseCtx(ctx) })
+		sess, err := setupTestStore().Get(ctx)
+		testza.AssertNoError(t, err)
+		getter := &MockSessionGetter{GetFunc: func(*fiber.Ctx) (*session.Session, error) { return sess, nil }}
+		testza.AssertNoError(t, loginAPIHandler(ctx, getter, &MockAuthenticator{}, newStorageExchangeCodes(setupTestStore().Storage)))
+		return ctx, sess
+	}
+
+	ctx, sess := login("username=alice&password=Wonderland")
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "alice", sess.Get("user_id"))
+
+	// The shared password is not a named user's password, nor the other way round
+	ctx, _ = login("username=alice&password=test123")
+	testza.AssertEqual(t, fiber.StatusUnauthorized, ctx.Response().StatusCode())
+	ctx, _ = login("password=Wonderland")
+	testza.AssertEqual(t, fiber.StatusUnauthorized, ctx.Response().StatusCode())
+
+	ctx, sess = login("password=test123")
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+	testza.AssertNil(t, sess.Get("user_id"))
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/soulteary/stargate/src/internal/auditlog"
+	"github.com/soulteary/stargate/src/internal/bearerjwt"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/idp"
+	"github.com/soulteary/stargate/src/internal/metrics"
+	"github.com/soulteary/stargate/src/internal/policy"
+)
+
+// authMethodBearerJWT is the audit method and metrics label for JWTs from BEARER_JWT_ISSUER.
+const authMethodBearerJWT = "bearer_jwt"
+
+// checkBearerJWT authenticates a /_auth request carrying a JWT from the configured issuer. The
+// mapped claims are the identity; its scopes and amr are what the access policy sees.
+func checkBearerJWT(ctx *fiber.Ctx, validator *bearerjwt.Validator, raw string, req policy.Request, span trace.Span) error {
+	caller, err := validator.Validate(ctx.UserContext(), raw)
+	if err != nil {
+		span.SetAttributes(attribute.Bool("auth.authenticated", false))
+		if errors.Is(err, bearerjwt.ErrNoKeys) {
+			log.Error().Err(err).Str("source", validator.Source()).Msg("Bearer JWT keys unavailable")
+			return SendErrorResponse(ctx, fiber.StatusServiceUnavailable, i18n.T(ctx, "error.bearer_jwt_keys_unavailable"))
+		}
+		log.Debug().Err(err).Msg("Rejected Bearer JWT")
+		metrics.RecordAuthRequest(authMethodBearerJWT, "failure")
+		auditlog.LogLogin(ctx.Context(), "", authMethodBearerJWT, GetClientIP(ctx), false, "invalid_token")
+		ctx.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.bearer_jwt_invalid"))
+	}
+
+	return acceptRequestIdentity(ctx, idp.Identity{
+		Subject: caller.Subject,
+		Email:   caller.Email,
+		Name:    caller.Name,
+		Role:    caller.Role,
+		Groups:  caller.Scopes,
+		AMR:     caller.AMR,
+	}, authMethodBearerJWT, req, span)
+}
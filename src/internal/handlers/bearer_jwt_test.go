@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/stargate/src/internal/bearerjwt"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/oidc/oidctest"
+)
+
+// setupBearerJWTTest enables Bearer JWT validation against a local issuer.
+func setupBearerJWTTest(t *testing.T) *oidctest.Server {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+	InitForwardAuthHandler(testLogger())
+
+	issuer := oidctest.NewServer("stargate", "")
+	t.Cleanup(issuer.Close)
+	bearerjwt.Init(bearerjwt.New(bearerjwt.Config{
+		JWKSURL:  issuer.URL + "/jwks",
+		Issuer:   issuer.Issuer(),
+		Audience: "https://api.example.com",
+	}))
+	t.Cleanup(func() { bearerjwt.Init(nil) })
+	return issuer
+}
+
+// bearerJWT signs a token for sub from issuer, with extra claims merged in.
+func bearerJWT(issuer *oidctest.Server, extra map[string]interface{}) string {
+	claims := map[string]interface{}{
+		"iss": issuer.Issuer(),
+		"sub": "svc-billing",
+		"aud": "https://api.example.com",
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return issuer.SignIDToken(claims)
+}
+
+func bearerJWTCheck(t *testing.T, token string, session map[string]interface{}) *fiber.Ctx {
+	t.Helper()
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":           "application/json",
+		"Authorization":    "Bearer " + token,
+		"X-Forwarded-Host": "api.example.com",
+	}, "")
+	t.Cleanup(func() { app.ReleaseCtx(ctx) })
+	checkWithSession(t, ctx, session)
+	return ctx
+}
+
+func TestCheckRoute_BearerJWT(t *testing.T) {
+	issuer := setupBearerJWTTest(t)
+
+	ctx := bearerJWTCheck(t, bearerJWT(issuer, map[string]interface{}{"scope": "read write", "role": "service"}), nil)
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "svc-billing", string(ctx.Response().Header.Peek("X-Auth-User")))
+	testza.AssertEqual(t, "svc-billing", string(ctx.Response().Header.Peek(config.UserHeaderName.String())))
+	testza.AssertEqual(t, "read,write", string(ctx.Response().Header.Peek("X-Auth-Scopes")))
+	testza.AssertEqual(t, "service", string(ctx.Response().Header.Peek("X-Auth-Role")))
+}
+
+func TestCheckRoute_BearerJWT_Invalid(t *testing.T) {
+	issuer := setupBearerJWTTest(t)
+
+	for name, token := range map[string]string{
+		"expired":        bearerJWT(issuer, map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}),
+		"wrong audience": bearerJWT(issuer, map[string]interface{}{"aud": "https://other.example.com"}),
+	} {
+		ctx := bearerJWTCheck(t, token, map[string]interface{}{"user_id": "user-1"})
+		// A token from the issuer is never replaced by the session
+		testza.AssertEqual(t, fiber.StatusUnauthorized, ctx.Response().StatusCode(), name)
+		testza.AssertEqual(t, `Bearer error="invalid_token"`, string(ctx.Response().Header.Peek("WWW-Authenticate")), name)
+	}
+}
+
+func TestCheckRoute_BearerJWT_OtherIssuerFallsThrough(t *testing.T) {
+	issuer := setupBearerJWTTest(t)
+	token := bearerJWT(issuer, map[string]interface{}{"iss": "https://upstream.example.com"})
+
+	ctx := bearerJWTCheck(t, token, map[string]interface{}{"user_id": "user-1"})
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "user-1", string(ctx.Response().Header.Peek(config.UserHeaderName.String())))
+
+	ctx = bearerJWTCheck(t, token, nil)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "", string(ctx.Response().Header.Peek("WWW-Authenticate")))
+}
+
+func TestCheckRoute_BearerJWT_Policy(t *testing.T) {
+	issuer := setupBearerJWTTest(t)
+	useTestPolicy(t, `
+rules:
+  - name: admin
+    hosts: ["api.example.com"]
+    scopes: [admin]
+    amr: [mfa]
+`)
+
+	ctx := bearerJWTCheck(t, bearerJWT(issuer, map[string]interface{}{"scope": "admin"}), nil)
+	testza.AssertEqual(t, fiber.StatusForbidden, ctx.Response().StatusCode())
+
+	ctx = bearerJWTCheck(t, bearerJWT(issuer, map[string]interface{}{"scope": "admin", "amr": []string{"pwd", "mfa"}}), nil)
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "pwd,mfa", string(ctx.Response().Header.Peek("X-Auth-AMR")))
+}
+
+func TestCheckRoute_BearerJWT_KeysUnavailable(t *testing.T) {
+	issuer := setupBearerJWTTest(t)
+	token := bearerJWT(issuer, nil)
+	issuer.Close()
+
+	ctx := bearerJWTCheck(t, token, nil)
+	testza.AssertEqual(t, fiber.StatusServiceUnavailable, ctx.Response().StatusCode())
+}
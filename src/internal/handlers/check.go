@@ -2,11 +2,18 @@ package handlers
 
 import (
 	"context"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
 	forwardauth "github.com/soulteary/forwardauth-kit"
+	"github.com/soulteary/stargate/src/internal/apitoken"
+	"github.com/soulteary/stargate/src/internal/bearerjwt"
+	"github.com/soulteary/stargate/src/internal/config"
 	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/policy"
+	"github.com/soulteary/stargate/src/internal/users"
 	"github.com/soulteary/tracing-kit"
 	"go.opentelemetry.io/otel/attribute"
 )
@@ -22,6 +29,15 @@ type SessionStoreForCheck interface {
 //
 // On successful authentication, it sets the X-Forwarded-User header (or configured header name)
 // and returns 200 OK. On failure, it either redirects to login (HTML) or returns 401 (API).
+// With AUTH_JWT_ENABLED a signed identity JWT is added in AUTH_JWT_HEADER. With API_TOKENS_ENABLED
+// a personal access token in "Authorization: Bearer" authenticates the request as the token's owner;
+// with BEARER_JWT_ENABLED so does a JWT from BEARER_JWT_ISSUER, as the subject of its claims.
+// With USERS or USERS_FILE set, "Authorization: Basic" credentials of a named user are accepted too.
+// Paths matching STEP_UP_PATHS additionally require a step-up within STEP_UP_MAX_AGE.
+// Sessions past SESSION_IDLE_TIMEOUT or SESSION_ABSOLUTE_TIMEOUT are destroyed and browsers sent
+// back to login with a "session expired" notice.
+// When POLICY_FILE is set, public routes are let through without a session and authenticated
+// users who do not meet the matching rule get 403 instead of a login redirect.
 //
 // Parameters:
 //   - store: Session store (or mock implementing SessionStoreForCheck) for managing user sessions
@@ -57,6 +73,33 @@ func CheckRoute(store SessionStoreForCheck) func(c *fiber.Ctx) error {
 		// Store trace context for forwardauth-kit to use
 		ctx.Locals("trace_context", spanCtx)
 
+		// Public routes in the access policy need no session
+		accessPolicy := policy.Get()
+		req := policyRequest(ctx)
+		if accessPolicy.IsPublic(req) {
+			forwardAuthSpan.SetAttributes(attribute.Bool("auth.public", true))
+			return ctx.SendStatus(fiber.StatusOK)
+		}
+
+		// Personal access tokens and JWTs from BEARER_JWT_ISSUER authenticate machine clients
+		// without a session. Other Bearer tokens belong to the upstream and fall through to the
+		// session check.
+		if bearer := bearerToken(ctx); bearer != "" {
+			if tokens := apitoken.Get(); tokens != nil && strings.HasPrefix(bearer, apitoken.Prefix) {
+				return checkAPIToken(ctx, tokens, bearer, req, forwardAuthSpan)
+			}
+			if validator := bearerjwt.Get(); validator != nil && validator.Owns(bearer) {
+				return checkBearerJWT(ctx, validator, bearer, req, forwardAuthSpan)
+			}
+		}
+
+		// Basic credentials are only Stargate's when named users are configured
+		if users.Get() != nil {
+			if username, password, ok := basicCredentials(ctx); ok {
+				return checkBasicAuth(ctx, username, password, req, forwardAuthSpan)
+			}
+		}
+
 		// Get session
 		sess, err := store.Get(ctx)
 		if err != nil {
@@ -75,18 +118,54 @@ func CheckRoute(store SessionStoreForCheck) func(c *fiber.Ctx) error {
 
 			switch err {
 			case forwardauth.ErrNotAuthenticated, forwardauth.ErrInvalidPassword, forwardauth.ErrUserNotFound:
-				return handler.HandleNotAuthenticated(faCtx)
+				return handleNotAuthenticated(ctx, handler, faCtx)
 			case forwardauth.ErrStepUpRequired:
-				return handler.HandleStepUpRequired(faCtx)
+				return handleStepUpRequired(ctx)
 			case forwardauth.ErrSessionRequired:
-				return handler.HandleNotAuthenticated(faCtx)
+				return handleNotAuthenticated(ctx, handler, faCtx)
 			default:
-				return handler.HandleNotAuthenticated(faCtx)
+				return handleNotAuthenticated(ctx, handler, faCtx)
 			}
 		}
 
+		// Sessions past their idle or absolute timeout (shorter for hosts in SESSION_HOST_TIMEOUTS)
+		// end here, before they are checked against anything else
+		now := time.Now()
+		if reason := sessionTimeoutReason(sess, config.GetSessionTimeouts().For(GetForwardedHost(ctx)), now); reason != "" {
+			forwardAuthSpan.SetAttributes(
+				attribute.Bool("auth.authenticated", false),
+				attribute.String("auth.session_expired", reason),
+			)
+			return handleSessionExpired(ctx, sess, reason)
+		}
+
+		// Authorize the user against the access policy before anything else is asked of them
+		subject := policySubject(sess, result.UserID)
+		if decision := accessPolicy.Authorize(req, subject); !decision.Allowed {
+			forwardAuthSpan.SetAttributes(
+				attribute.Bool("auth.authenticated", true),
+				attribute.Bool("auth.policy_denied", true),
+				attribute.String("auth.policy_rule", decision.Rule),
+			)
+			return handlePolicyDenied(ctx, subject, decision)
+		}
+
+		// Step-up is enforced here rather than in forwardauth-kit so the marker can expire after STEP_UP_MAX_AGE
+		if RequiresStepUp(ctx) && !IsStepUpFresh(sess, now) {
+			forwardAuthSpan.SetAttributes(attribute.Bool("auth.step_up_required", true))
+			return handleStepUpRequired(ctx)
+		}
+
 		// Set authentication headers
 		handler.SetAuthHeaders(faCtx, result)
+		identity := sessionIdentity(sess)
+		identity.Subject = subject.UserID
+		if err := setIdentityAssertion(ctx, identity); err != nil {
+			// Fail closed: upstreams relying on the JWT must not see a request without it
+			tracing.RecordError(forwardAuthSpan, err)
+			log.Error().Err(err).Msg("Failed to sign identity JWT")
+			return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.auth_jwt_failed"))
+		}
 
 		// Record tracing attributes
 		forwardAuthSpan.SetAttributes(attribute.Bool("auth.authenticated", true))
@@ -96,7 +175,17 @@ func CheckRoute(store SessionStoreForCheck) func(c *fiber.Ctx) error {
 		if result.AuthMethod.String() != "none" {
 			forwardAuthSpan.SetAttributes(attribute.String("auth.method", result.AuthMethod.String()))
 		}
+		recordSessionAccess(sess, now)
 
 		return ctx.SendStatus(fiber.StatusOK)
 	}
 }
+
+// handleNotAuthenticated redirects browsers to the login page with the full original URL as callback,
+// so the user lands back on the page they asked for. API clients get forwardauth-kit's 401 response.
+func handleNotAuthenticated(ctx *fiber.Ctx, handler *forwardauth.Handler, faCtx forwardauth.Context) error {
+	if IsHTMLRequest(ctx) {
+		return ctx.Redirect(BuildCallbackURL(ctx), fiber.StatusFound)
+	}
+	return handler.HandleNotAuthenticated(faCtx)
+}
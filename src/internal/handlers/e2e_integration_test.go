@@ -409,7 +409,7 @@ func TestE2E_CompleteLoginFlow(t *testing.T) {
 	})
 
 	app := fiber.New()
-	app.Post("/_send_verify_code", SendVerifyCodeAPI())
+	app.Post("/_send_verify_code", SendVerifyCodeAPI(session.New()))
 	app.Post("/_login", LoginAPI(store))
 	app.Get("/_auth", CheckRoute(store))
 
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// ExchangeCodeParam is the /_session_exchange query parameter carrying the one-time code.
+	ExchangeCodeParam = "code"
+	// ExchangeCodeTTL is how long an exchange code can be redeemed after login.
+	ExchangeCodeTTL = 60 * time.Second
+
+	// exchangeCodeKeyPrefix namespaces exchange codes in the session storage.
+	exchangeCodeKeyPrefix = "exchange_code:"
+
+	// LogoutTokenTTL is how long the logout tokens minted by single logout can be redeemed.
+	LogoutTokenTTL = 5 * time.Minute
+
+	// logoutTokenKeyPrefix namespaces logout tokens in the session storage.
+	logoutTokenKeyPrefix = "logout_token:"
+
+	// ReissueTokenTTL is how long the tokens carrying a rotated session ID to exchanged domains
+	// can be redeemed.
+	ReissueTokenTTL = 5 * time.Minute
+
+	// reissueTokenKeyPrefix namespaces reissue tokens in the session storage.
+	reissueTokenKeyPrefix = "reissue_token:"
+)
+
+var (
+	// errInvalidExchangeCode is returned for unknown, expired, already used or wrong-host codes.
+	errInvalidExchangeCode = errors.New("invalid exchange code")
+	// errInvalidLogoutToken is returned for unknown, expired, already used or wrong-host logout tokens.
+	errInvalidLogoutToken = errors.New("invalid logout token")
+	// errInvalidReissueToken is returned for unknown, expired, already used or wrong-host reissue tokens.
+	errInvalidReissueToken = errors.New("invalid reissue token")
+)
+
+// ExchangeCodeStore mints and redeems one-time codes that stand in for a session ID
+// on the way from the auth host to a callback host.
+type ExchangeCodeStore interface {
+	// Mint returns a new code that can be redeemed once, on host, for sessionID.
+	Mint(sessionID, host string) (string, error)
+	// Redeem consumes code and returns its session ID if it was minted for host.
+	Redeem(code, host string) (string, error)
+}
+
+// exchangeCodeRecord is the value stored for an exchange code.
+type exchangeCodeRecord struct {
+	SessionID string `json:"session_id"`
+	Host      string `json:"host"`
+}
+
+// storageExchangeCodes keeps exchange codes in the session storage (memory or Redis),
+// so that every Stargate instance sharing sessions can also redeem codes.
+type storageExchangeCodes struct {
+	storage fiber.Storage
+	ttl     time.Duration
+}
+
+// newStorageExchangeCodes creates an ExchangeCodeStore backed by storage.
+func newStorageExchangeCodes(storage fiber.Storage) *storageExchangeCodes {
+	return &storageExchangeCodes{storage: storage, ttl: ExchangeCodeTTL}
+}
+
+// Mint implements ExchangeCodeStore.
+func (s *storageExchangeCodes) Mint(sessionID, host string) (string, error) {
+	code, err := newOneTimeCode()
+	if err != nil {
+		return "", err
+	}
+	value, err := json.Marshal(exchangeCodeRecord{SessionID: sessionID, Host: exchangeCodeHost(host)})
+	if err != nil {
+		return "", err
+	}
+	if err := s.storage.Set(exchangeCodeKeyPrefix+code, value, s.ttl); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// Redeem implements ExchangeCodeStore. The code is deleted before the host is checked,
+// so a code presented to the wrong host cannot be retried elsewhere.
+func (s *storageExchangeCodes) Redeem(code, host string) (string, error) {
+	if code == "" {
+		return "", errInvalidExchangeCode
+	}
+	key := exchangeCodeKeyPrefix + code
+	value, err := s.storage.Get(key)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", errInvalidExchangeCode
+	}
+	if err := s.storage.Delete(key); err != nil {
+		return "", err
+	}
+
+	var record exchangeCodeRecord
+	if err := json.Unmarshal(value, &record); err != nil || record.SessionID == "" {
+		return "", errInvalidExchangeCode
+	}
+	if record.Host != exchangeCodeHost(host) {
+		return "", errInvalidExchangeCode
+	}
+	return record.SessionID, nil
+}
+
+// logoutTokenRecord is the value stored for a logout token.
+type logoutTokenRecord struct {
+	Host string `json:"host"`
+	Next string `json:"next,omitempty"`
+}
+
+// logoutTokens mints and redeems the one-time tokens that let single logout clear the session
+// cookie of an exchanged domain. Like exchange codes they are kept in the session storage and
+// bound to a host; each also carries the URL to continue to, so the chain of redirects through
+// the domains is fixed when it is minted.
+type logoutTokens struct {
+	storage fiber.Storage
+	ttl     time.Duration
+}
+
+// newLogoutTokens creates a logout token store backed by storage.
+func newLogoutTokens(storage fiber.Storage) *logoutTokens {
+	return &logoutTokens{storage: storage, ttl: LogoutTokenTTL}
+}
+
+// Mint returns a new token that can be redeemed once, on host, for next.
+func (t *logoutTokens) Mint(host, next string) (string, error) {
+	token, err := newOneTimeCode()
+	if err != nil {
+		return "", err
+	}
+	value, err := json.Marshal(logoutTokenRecord{Host: exchangeCodeHost(host), Next: next})
+	if err != nil {
+		return "", err
+	}
+	if err := t.storage.Set(logoutTokenKeyPrefix+token, value, t.ttl); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Redeem consumes token and returns the URL to continue to if it was minted for host. As with
+// exchange codes, the token is deleted before the host is checked.
+func (t *logoutTokens) Redeem(token, host string) (string, error) {
+	if token == "" {
+		return "", errInvalidLogoutToken
+	}
+	key := logoutTokenKeyPrefix + token
+	value, err := t.storage.Get(key)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", errInvalidLogoutToken
+	}
+	if err := t.storage.Delete(key); err != nil {
+		return "", err
+	}
+
+	var record logoutTokenRecord
+	if err := json.Unmarshal(value, &record); err != nil || record.Host != exchangeCodeHost(host) {
+		return "", errInvalidLogoutToken
+	}
+	return record.Next, nil
+}
+
+// reissueTokenRecord is the value stored for a reissue token.
+type reissueTokenRecord struct {
+	SessionID string `json:"session_id"`
+	Host      string `json:"host"`
+	Next      string `json:"next"`
+}
+
+// reissueTokens mints and redeems the one-time tokens that install a rotated session ID on a
+// domain the session was exchanged to. They combine an exchange code, standing in for the new
+// session ID, with the URL to continue to, like a logout token.
+type reissueTokens struct {
+	storage fiber.Storage
+	ttl     time.Duration
+}
+
+// newReissueTokens creates a reissue token store backed by storage.
+func newReissueTokens(storage fiber.Storage) *reissueTokens {
+	return &reissueTokens{storage: storage, ttl: ReissueTokenTTL}
+}
+
+// Mint returns a new token that can be redeemed once, on host, for sessionID and next.
+func (t *reissueTokens) Mint(sessionID, host, next string) (string, error) {
+	token, err := newOneTimeCode()
+	if err != nil {
+		return "", err
+	}
+	value, err := json.Marshal(reissueTokenRecord{SessionID: sessionID, Host: exchangeCodeHost(host), Next: next})
+	if err != nil {
+		return "", err
+	}
+	if err := t.storage.Set(reissueTokenKeyPrefix+token, value, t.ttl); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Redeem consumes token and returns its session ID and the URL to continue to if it was minted
+// for host. As with exchange codes, the token is deleted before the host is checked.
+func (t *reissueTokens) Redeem(token, host string) (string, string, error) {
+	if token == "" {
+		return "", "", errInvalidReissueToken
+	}
+	key := reissueTokenKeyPrefix + token
+	value, err := t.storage.Get(key)
+	if err != nil {
+		return "", "", err
+	}
+	if value == nil {
+		return "", "", errInvalidReissueToken
+	}
+	if err := t.storage.Delete(key); err != nil {
+		return "", "", err
+	}
+
+	var record reissueTokenRecord
+	if err := json.Unmarshal(value, &record); err != nil || record.SessionID == "" || record.Host != exchangeCodeHost(host) {
+		return "", "", errInvalidReissueToken
+	}
+	return record.SessionID, record.Next, nil
+}
+
+// newOneTimeCode returns a random, URL-safe code for exchange codes, logout and reissue tokens.
+func newOneTimeCode() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// exchangeCodeHost normalizes a host for binding: lower-cased, without port.
+func exchangeCodeHost(host string) string {
+	return strings.ToLower(normalizeHost(host))
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+func TestStorageExchangeCodes_MintAndRedeem(t *testing.T) {
+	codes := newStorageExchangeCodes(session.New().Storage)
+
+	code, err := codes.Mint("sid-1", "App.Example.com:8443")
+	testza.AssertNoError(t, err)
+	testza.AssertNotContains(t, code, "sid-1")
+	testza.AssertTrue(t, len(code) >= 43, "code should carry 256 bits of entropy")
+
+	other, err := codes.Mint("sid-1", "app.example.com")
+	testza.AssertNoError(t, err)
+	testza.AssertNotEqual(t, code, other)
+
+	// Host binding ignores case and port
+	sessionID, err := codes.Redeem(code, "app.example.com")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "sid-1", sessionID)
+
+	// Single use
+	_, err = codes.Redeem(code, "app.example.com")
+	testza.AssertErrorIs(t, err, errInvalidExchangeCode)
+}
+
+func TestStorageExchangeCodes_WrongHostBurnsCode(t *testing.T) {
+	codes := newStorageExchangeCodes(session.New().Storage)
+
+	code, err := codes.Mint("sid-1", "app.example.com")
+	testza.AssertNoError(t, err)
+
+	_, err = codes.Redeem(code, "evil.example.com")
+	testza.AssertErrorIs(t, err, errInvalidExchangeCode)
+
+	_, err = codes.Redeem(code, "app.example.com")
+	testza.AssertErrorIs(t, err, errInvalidExchangeCode)
+}
+
+func TestStorageExchangeCodes_UnknownCode(t *testing.T) {
+	codes := newStorageExchangeCodes(session.New().Storage)
+
+	_, err := codes.Redeem("", "app.example.com")
+	testza.AssertErrorIs(t, err, errInvalidExchangeCode)
+	_, err = codes.Redeem("does-not-exist", "app.example.com")
+	testza.AssertErrorIs(t, err, errInvalidExchangeCode)
+}
+
+func TestStorageExchangeCodes_Expires(t *testing.T) {
+	codes := newStorageExchangeCodes(session.New().Storage)
+	codes.ttl = time.Second
+
+	code, err := codes.Mint("sid-1", "app.example.com")
+	testza.AssertNoError(t, err)
+
+	time.Sleep(1100 * time.Millisecond)
+	_, err = codes.Redeem(code, "app.example.com")
+	testza.AssertErrorIs(t, err, errInvalidExchangeCode)
+}
+
+func TestReissueTokens_MintAndRedeem(t *testing.T) {
+	store := setupTestStore()
+	tokens := newReissueTokens(store.Storage)
+
+	token, err := tokens.Mint("session-2", "App.Example.com:8443", "https://auth.example.com/admin")
+	testza.AssertNoError(t, err)
+
+	// Bound to the host: a wrong host burns the token
+	_, _, err = tokens.Redeem(token, "evil.example.com")
+	testza.AssertErrorIs(t, err, errInvalidReissueToken)
+	_, _, err = tokens.Redeem(token, "app.example.com")
+	testza.AssertErrorIs(t, err, errInvalidReissueToken)
+
+	token, err = tokens.Mint("session-2", "app.example.com", "https://auth.example.com/admin")
+	testza.AssertNoError(t, err)
+	sessionID, next, err := tokens.Redeem(token, "app.example.com")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "session-2", sessionID)
+	testza.AssertEqual(t, "https://auth.example.com/admin", next)
+
+	// Single-use
+	_, _, err = tokens.Redeem(token, "app.example.com")
+	testza.AssertErrorIs(t, err, errInvalidReissueToken)
+	_, _, err = tokens.Redeem("", "app.example.com")
+	testza.AssertErrorIs(t, err, errInvalidReissueToken)
+}
@@ -16,6 +16,16 @@ import (
 	"github.com/soulteary/stargate/src/internal/i18n"
 )
 
+// Identity headers set on successful /_auth responses.
+const (
+	authUserHeader   = "X-Auth-User"
+	authEmailHeader  = "X-Auth-Email"
+	authNameHeader   = "X-Auth-Name"
+	authScopesHeader = "X-Auth-Scopes"
+	authRoleHeader   = "X-Auth-Role"
+	authAMRHeader    = "X-Auth-AMR"
+)
+
 // forwardAuthHandler is the global ForwardAuth handler instance.
 var forwardAuthHandler *forwardauth.Handler
 
@@ -114,11 +124,12 @@ func InitForwardAuthHandler(l *logger.Logger) {
 			}
 		},
 
-		// Step-up authentication
-		StepUpEnabled:    config.StepUpEnabled.ToBool(),
+		// Step-up authentication is enforced by CheckRoute (see step_up.go) so that the
+		// session marker carries a timestamp and expires after STEP_UP_MAX_AGE.
+		StepUpEnabled:    false,
 		StepUpPaths:      parseStepUpPaths(),
-		StepUpURL:        "/_step_up",
-		StepUpSessionKey: "step_up_verified",
+		StepUpURL:        StepUpPath,
+		StepUpSessionKey: StepUpSessionKey,
 
 		// Auth refresh
 		AuthRefreshEnabled:  config.AuthRefreshEnabled.ToBool(),
@@ -126,12 +137,12 @@ func InitForwardAuthHandler(l *logger.Logger) {
 
 		// Response headers
 		UserHeaderName:   config.UserHeaderName.String(),
-		AuthUserHeader:   "X-Auth-User",
-		AuthEmailHeader:  "X-Auth-Email",
-		AuthNameHeader:   "X-Auth-Name",
-		AuthScopesHeader: "X-Auth-Scopes",
-		AuthRoleHeader:   "X-Auth-Role",
-		AuthAMRHeader:    "X-Auth-AMR",
+		AuthUserHeader:   authUserHeader,
+		AuthEmailHeader:  authEmailHeader,
+		AuthNameHeader:   authNameHeader,
+		AuthScopesHeader: authScopesHeader,
+		AuthRoleHeader:   authRoleHeader,
+		AuthAMRHeader:    authAMRHeader,
 
 		// Login redirect
 		AuthHost:      config.AuthHost.String(),
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/stargate/src/internal/config"
+)
+
+// HeaderForwarded is the RFC 7239 Forwarded request header.
+const HeaderForwarded = "Forwarded"
+
+// forwardedHeaders are the headers a reverse proxy uses to describe the original request.
+// They are removed from requests that do not come from a trusted proxy.
+var forwardedHeaders = []string{
+	HeaderForwarded,
+	fiber.HeaderXForwardedFor,
+	fiber.HeaderXForwardedHost,
+	fiber.HeaderXForwardedProto,
+	fiber.HeaderXForwardedProtocol,
+	fiber.HeaderXForwardedSsl,
+	fiber.HeaderXUrlScheme,
+	"X-Forwarded-Uri",
+	"X-Forwarded-Method",
+	"X-Forwarded-Port",
+	"X-Forwarded-Prefix",
+	"X-Real-Ip",
+}
+
+// TrustedProxyMiddleware strips forwarded headers from requests whose connection peer is not
+// in TRUSTED_PROXIES, so that everything downstream (GetForwardedHost, the forward auth handler,
+// Fiber's Hostname and Protocol) only sees values set by a trusted proxy.
+// When TRUSTED_PROXIES is empty, loopback and private networks are trusted.
+func TrustedProxyMiddleware() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		if !config.GetTrustedProxySet().Contains(ctx.Context().RemoteIP()) {
+			for _, name := range forwardedHeaders {
+				ctx.Request().Header.Del(name)
+			}
+		}
+		return ctx.Next()
+	}
+}
+
+// GetClientIP returns the IP address of the client that made the request.
+//
+// When the connection comes from a trusted proxy, the X-Forwarded-For chain (or RFC 7239
+// Forwarded "for" values) is walked from the right, skipping trusted proxies, and the first
+// untrusted address is the client. Otherwise the connection peer is the client. Use this instead
+// of ctx.IP() for audit records, rate limiting and anything passed on to Herald.
+func GetClientIP(ctx *fiber.Ctx) string {
+	peer := ctx.Context().RemoteIP()
+	proxies := config.GetTrustedProxySet()
+	if !proxies.Contains(peer) {
+		return peer.String()
+	}
+
+	client := peer
+	chain := forwardedForChain(ctx)
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseForwardedNode(chain[i])
+		if ip == nil {
+			// Unknown or obfuscated hop: the last trusted hop is the best we know
+			break
+		}
+		client = ip
+		if !proxies.Contains(ip) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedForChain returns the forwarded client addresses in order, from X-Forwarded-For
+// when present, otherwise from the "for" parameters of the Forwarded header.
+func forwardedForChain(ctx *fiber.Ctx) []string {
+	var chain []string
+	for _, value := range ctx.Request().Header.PeekAll(fiber.HeaderXForwardedFor) {
+		for _, part := range strings.Split(string(value), ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				chain = append(chain, part)
+			}
+		}
+	}
+	if len(chain) > 0 {
+		return chain
+	}
+	for _, element := range parseForwarded(ctx) {
+		if node, ok := element["for"]; ok {
+			chain = append(chain, node)
+		}
+	}
+	return chain
+}
+
+// parseForwardedNode parses a node as found in X-Forwarded-For or a Forwarded "for" parameter:
+// "192.0.2.1", "192.0.2.1:8080", "2001:db8::1" or "[2001:db8::1]:8080". It returns nil for
+// "unknown", obfuscated identifiers ("_hidden") and malformed values.
+func parseForwardedNode(node string) net.IP {
+	node = strings.TrimSpace(node)
+	if strings.HasPrefix(node, "[") {
+		end := strings.Index(node, "]")
+		if end < 0 {
+			return nil
+		}
+		return net.ParseIP(node[1:end])
+	}
+	if ip := net.ParseIP(node); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// forwardedParam returns a parameter ("host", "proto") of the last Forwarded element that
+// carries it, i.e. the one added by the proxy closest to Stargate.
+func forwardedParam(ctx *fiber.Ctx, name string) string {
+	elements := parseForwarded(ctx)
+	for i := len(elements) - 1; i >= 0; i-- {
+		if value := elements[i][name]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// parseForwarded parses all RFC 7239 Forwarded headers of the request into elements,
+// each a map of lower-cased parameter names to unquoted values.
+func parseForwarded(ctx *fiber.Ctx) []map[string]string {
+	var elements []map[string]string
+	for _, value := range ctx.Request().Header.PeekAll(HeaderForwarded) {
+		elements = append(elements, parseForwardedValue(string(value))...)
+	}
+	return elements
+}
+
+// parseForwardedValue parses one Forwarded header value:
+// element *( "," element ), element = pair *( ";" pair ), pair = token "=" ( token / quoted-string ).
+func parseForwardedValue(value string) []map[string]string {
+	var elements []map[string]string
+	element := map[string]string{}
+	var name, buf strings.Builder
+	inValue, quoted, escaped := false, false, false
+
+	flushPair := func() {
+		key := strings.ToLower(strings.TrimSpace(name.String()))
+		if key != "" {
+			element[key] = strings.TrimSpace(buf.String())
+		}
+		name.Reset()
+		buf.Reset()
+		inValue = false
+	}
+
+	for _, r := range value {
+		switch {
+		case escaped:
+			buf.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"' && inValue:
+			quoted = !quoted
+		case quoted:
+			buf.WriteRune(r)
+		case r == '=' && !inValue:
+			inValue = true
+		case r == ';':
+			flushPair()
+		case r == ',':
+			flushPair()
+			if len(element) > 0 {
+				elements = append(elements, element)
+			}
+			element = map[string]string{}
+		case inValue:
+			buf.WriteRune(r)
+		default:
+			name.WriteRune(r)
+		}
+	}
+	flushPair()
+	if len(element) > 0 {
+		elements = append(elements, element)
+	}
+	return elements
+}
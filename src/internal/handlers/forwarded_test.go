@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/stargate/src/internal/config"
+)
+
+// setTrustedProxies initializes the configuration with TRUSTED_PROXIES set to value.
+func setTrustedProxies(t *testing.T, value string) {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("TRUSTED_PROXIES", value)
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+}
+
+// createTestContextFrom is createTestContext with the connection peer set to peer.
+func createTestContextFrom(peer string, headers map[string]string) (*fiber.Ctx, *fiber.App) {
+	ctx, app := createTestContext("GET", "/", headers, "")
+	ctx.Context().SetRemoteAddr(&net.TCPAddr{IP: net.ParseIP(peer), Port: 40000})
+	return ctx, app
+}
+
+func TestParseForwardedValue(t *testing.T) {
+	elements := parseForwardedValue(`for=192.0.2.60;proto=http;by=203.0.113.43, For="[2001:db8:cafe::17]:4711";Host="app.example.com", for=unknown`)
+
+	testza.AssertEqual(t, []map[string]string{
+		{"for": "192.0.2.60", "proto": "http", "by": "203.0.113.43"},
+		{"for": "[2001:db8:cafe::17]:4711", "host": "app.example.com"},
+		{"for": "unknown"},
+	}, elements)
+
+	// Separators inside quoted strings do not split elements
+	elements = parseForwardedValue(`for="_a,b;c";proto=https`)
+	testza.AssertEqual(t, []map[string]string{{"for": "_a,b;c", "proto": "https"}}, elements)
+
+	testza.AssertEqual(t, 0, len(parseForwardedValue("")))
+}
+
+func TestParseForwardedNode(t *testing.T) {
+	tests := []struct {
+		node     string
+		expected string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{" 192.0.2.1:8080 ", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]:4711", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"unknown", ""},
+		{"_hidden", ""},
+		{"[2001:db8::1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.node, func(t *testing.T) {
+			ip := parseForwardedNode(tt.node)
+			if tt.expected == "" {
+				testza.AssertNil(t, ip)
+				return
+			}
+			testza.AssertEqual(t, tt.expected, ip.String())
+		})
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	t.Run("unconfigured trusts a private peer", func(t *testing.T) {
+		setTrustedProxies(t, "")
+		ctx, app := createTestContextFrom("10.0.0.2", map[string]string{"X-Forwarded-For": "203.0.113.7"})
+		defer app.ReleaseCtx(ctx)
+		testza.AssertEqual(t, "203.0.113.7", GetClientIP(ctx))
+	})
+
+	t.Run("unconfigured ignores X-Forwarded-For from a public peer", func(t *testing.T) {
+		setTrustedProxies(t, "")
+		ctx, app := createTestContextFrom("198.51.100.9", map[string]string{"X-Forwarded-For": "203.0.113.7"})
+		defer app.ReleaseCtx(ctx)
+		testza.AssertEqual(t, "198.51.100.9", GetClientIP(ctx))
+	})
+
+	t.Run("untrusted peer is the client", func(t *testing.T) {
+		setTrustedProxies(t, "10.0.0.0/8")
+		ctx, app := createTestContextFrom("198.51.100.9", map[string]string{"X-Forwarded-For": "203.0.113.7"})
+		defer app.ReleaseCtx(ctx)
+		testza.AssertEqual(t, "198.51.100.9", GetClientIP(ctx))
+	})
+
+	t.Run("skips trusted hops from the right", func(t *testing.T) {
+		setTrustedProxies(t, "10.0.0.0/8")
+		// The client tried to spoof 1.1.1.1; the edge proxy appended the real address
+		ctx, app := createTestContextFrom("10.0.0.2", map[string]string{"X-Forwarded-For": "1.1.1.1, 203.0.113.7, 10.0.0.5"})
+		defer app.ReleaseCtx(ctx)
+		testza.AssertEqual(t, "203.0.113.7", GetClientIP(ctx))
+	})
+
+	t.Run("all hops trusted", func(t *testing.T) {
+		setTrustedProxies(t, "10.0.0.0/8")
+		ctx, app := createTestContextFrom("10.0.0.2", map[string]string{"X-Forwarded-For": "10.1.1.1, 10.0.0.5"})
+		defer app.ReleaseCtx(ctx)
+		testza.AssertEqual(t, "10.1.1.1", GetClientIP(ctx))
+	})
+
+	t.Run("stops at an unknown hop", func(t *testing.T) {
+		setTrustedProxies(t, "10.0.0.0/8")
+		ctx, app := createTestContextFrom("10.0.0.2", map[string]string{"X-Forwarded-For": "203.0.113.7, unknown, 10.0.0.5"})
+		defer app.ReleaseCtx(ctx)
+		testza.AssertEqual(t, "10.0.0.5", GetClientIP(ctx))
+	})
+
+	t.Run("RFC 7239 Forwarded", func(t *testing.T) {
+		setTrustedProxies(t, "10.0.0.0/8")
+		ctx, app := createTestContextFrom("10.0.0.2", map[string]string{"Forwarded": `for="[2001:db8::7]:4711";proto=https, for=10.0.0.5`})
+		defer app.ReleaseCtx(ctx)
+		testza.AssertEqual(t, "2001:db8::7", GetClientIP(ctx))
+	})
+}
+
+func TestGetForwardedHostAndProto_RFC7239(t *testing.T) {
+	setTrustedProxies(t, "")
+	ctx, app := createTestContext("GET", "/", map[string]string{
+		"Host":      "stargate.internal",
+		"Forwarded": `host=evil.example.com;proto=http, for=192.0.2.1;host=app.example.com;proto=HTTPS`,
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	testza.AssertEqual(t, "app.example.com", GetForwardedHost(ctx))
+	testza.AssertEqual(t, "https", GetForwardedProto(ctx))
+
+	// X-Forwarded-* take precedence
+	ctx.Request().Header.Set("X-Forwarded-Host", "other.example.com")
+	testza.AssertEqual(t, "other.example.com", GetForwardedHost(ctx))
+}
+
+func TestTrustedProxyMiddleware(t *testing.T) {
+	newApp := func() *fiber.App {
+		app := fiber.New()
+		app.Use(TrustedProxyMiddleware())
+		app.Get("/", func(ctx *fiber.Ctx) error {
+			return ctx.SendString(GetForwardedProto(ctx) + "://" + GetForwardedHost(ctx) + GetForwardedURI(ctx) + " " + ctx.Get("X-Forwarded-For") + ctx.Get("Forwarded"))
+		})
+		return app
+	}
+	request := func(app *fiber.App) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "stargate.internal"
+		req.Header.Set("X-Forwarded-Host", "evil.example.com")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Uri", "/admin")
+		req.Header.Set("X-Forwarded-For", "1.1.1.1")
+		req.Header.Set("Forwarded", "for=1.1.1.1")
+		resp, err := app.Test(req)
+		testza.AssertNoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		testza.AssertNoError(t, err)
+		return string(body)
+	}
+
+	t.Run("untrusted peer", func(t *testing.T) {
+		// app.Test connections come from 0.0.0.0
+		setTrustedProxies(t, "10.0.0.0/8")
+		testza.AssertEqual(t, "http://stargate.internal/ ", request(newApp()))
+	})
+
+	t.Run("trusted peer", func(t *testing.T) {
+		setTrustedProxies(t, "0.0.0.0/32")
+		testza.AssertEqual(t, "https://evil.example.com/admin 1.1.1.1for=1.1.1.1", request(newApp()))
+	})
+
+	t.Run("unconfigured does not trust a public peer", func(t *testing.T) {
+		setTrustedProxies(t, "")
+		testza.AssertEqual(t, "http://stargate.internal/ ", request(newApp()))
+	})
+}
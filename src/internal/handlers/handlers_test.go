@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
@@ -349,15 +350,27 @@ func TestIndexRoute_NotAuthenticated(t *testing.T) {
 	testza.AssertEqual(t, "Not authenticated", string(ctx.Response().Body()))
 }
 
-func TestSessionShareRoute_WithID(t *testing.T) {
-	handler := SessionShareRoute()
+// mintTestExchangeCode mints an exchange code for sessionID on app.example.com in store.
+func mintTestExchangeCode(t *testing.T, store *session.Store, sessionID string) string {
+	t.Helper()
+	code, err := newStorageExchangeCodes(store.Storage).Mint(sessionID, "app.example.com")
+	testza.AssertNoError(t, err)
+	return code
+}
 
-	ctx, app := createTestContext("GET", "/_session_exchange?id=test-session-id", nil, "")
+func TestSessionShareRoute_WithCode(t *testing.T) {
+	store := setupTestStore()
+	handler := SessionShareRoute(store)
+	code := mintTestExchangeCode(t, store, "test-session-id")
+
+	ctx, app := createTestContext("GET", "/_session_exchange?code="+code, map[string]string{
+		"Host": "app.example.com",
+	}, "")
 	defer app.ReleaseCtx(ctx)
 
 	err := handler(ctx)
-	// Should redirect, but we can't easily test redirect in unit test
 	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusFound, ctx.Response().StatusCode())
 
 	// Check that cookie was set
 	cookies := ctx.Response().Header.Peek("Set-Cookie")
@@ -366,15 +379,96 @@ func TestSessionShareRoute_WithID(t *testing.T) {
 	testza.AssertContains(t, string(cookies), "test-session-id")
 }
 
-func TestSessionShareRoute_WithoutID(t *testing.T) {
-	handler := SessionShareRoute()
+func TestSessionShareRoute_CodeIsSingleUse(t *testing.T) {
+	store := setupTestStore()
+	handler := SessionShareRoute(store)
+	code := mintTestExchangeCode(t, store, "test-session-id")
+
+	for i, expected := range []int{fiber.StatusFound, fiber.StatusBadRequest} {
+		ctx, app := createTestContext("GET", "/_session_exchange?code="+code, map[string]string{
+			"Host": "app.example.com",
+		}, "")
+
+		err := handler(ctx)
+		testza.AssertNoError(t, err)
+		testza.AssertEqual(t, expected, ctx.Response().StatusCode(), "attempt %d", i+1)
+		app.ReleaseCtx(ctx)
+	}
+}
+
+func TestSessionShareRoute_CodeBoundToHost(t *testing.T) {
+	store := setupTestStore()
+	handler := SessionShareRoute(store)
+	code := mintTestExchangeCode(t, store, "test-session-id")
+
+	ctx, app := createTestContext("GET", "/_session_exchange?code="+code, map[string]string{
+		"Host": "other.example.com",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	err := handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusBadRequest, ctx.Response().StatusCode())
+	testza.AssertNotContains(t, string(ctx.Response().Header.Peek("Set-Cookie")), "test-session-id")
+}
+
+func TestSessionShareRoute_RejectsRawSessionID(t *testing.T) {
+	store := setupTestStore()
+	handler := SessionShareRoute(store)
+
+	ctx, app := createTestContext("GET", "/_session_exchange?id=test-session-id", map[string]string{
+		"Host": "app.example.com",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	err := handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusBadRequest, ctx.Response().StatusCode())
+	testza.AssertNotContains(t, string(ctx.Response().Header.Peek("Set-Cookie")), "test-session-id")
+}
+
+func TestSessionShareRoute_RestoresReturnPath(t *testing.T) {
+	store := setupTestStore()
+	handler := SessionShareRoute(store)
+	code := mintTestExchangeCode(t, store, "test-session-id")
+
+	ctx, app := createTestContext("GET", "/_session_exchange?code="+code+"&return_to=%2Freports%2F42%3Ftab%3Dx", map[string]string{
+		"Host": "app.example.com",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	err := handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusFound, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "/reports/42?tab=x", string(ctx.Response().Header.Peek("Location")))
+}
+
+func TestSessionShareRoute_RejectsNonLocalReturnPath(t *testing.T) {
+	store := setupTestStore()
+	handler := SessionShareRoute(store)
+
+	for _, returnTo := range []string{"https%3A%2F%2Fevil.com%2F", "%2F%2Fevil.com", "reports"} {
+		code := mintTestExchangeCode(t, store, "test-session-id")
+		ctx, app := createTestContext("GET", "/_session_exchange?code="+code+"&return_to="+returnTo, map[string]string{
+			"Host": "app.example.com",
+		}, "")
+
+		err := handler(ctx)
+		testza.AssertNoError(t, err)
+		testza.AssertEqual(t, "/", string(ctx.Response().Header.Peek("Location")))
+		app.ReleaseCtx(ctx)
+	}
+}
+
+func TestSessionShareRoute_WithoutCode(t *testing.T) {
+	handler := SessionShareRoute(setupTestStore())
 
 	ctx, app := createTestContext("GET", "/_session_exchange", nil, "")
 	defer app.ReleaseCtx(ctx)
 
 	err := handler(ctx)
 	testza.AssertNoError(t, err)
-	// SessionShareRoute returns StatusBadRequest (400) for missing session ID
+	// SessionShareRoute returns StatusBadRequest (400) for missing exchange code
 	testza.AssertEqual(t, fiber.StatusBadRequest, ctx.Response().StatusCode())
 }
 
@@ -416,6 +510,31 @@ func TestCheckRoute_NotAuthenticated_HTMLRequest(t *testing.T) {
 	testza.AssertTrue(t, ctx.Response().StatusCode() == fiber.StatusFound || ctx.Response().StatusCode() == fiber.StatusMovedPermanently)
 }
 
+func TestCheckRoute_NotAuthenticated_HTMLRequest_CarriesOriginalURL(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	err := config.Initialize(testLogger())
+	testza.AssertNoError(t, err)
+
+	store := setupTestStore()
+	handler := CheckRoute(store)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"X-Forwarded-Host":  "app.example.com",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Uri":   "/reports/42?tab=x",
+		"Accept":            "text/html",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	err = handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusFound, ctx.Response().StatusCode())
+	testza.AssertEqual(t,
+		"https://auth.example.com/_login?callback=https%3A%2F%2Fapp.example.com%2Freports%2F42%3Ftab%3Dx",
+		string(ctx.Response().Header.Peek("Location")))
+}
+
 func TestCheckRoute_NotAuthenticated_APIRequest(t *testing.T) {
 	t.Setenv("AUTH_HOST", "auth.example.com")
 	t.Setenv("PASSWORDS", "plaintext:test123")
@@ -494,6 +613,24 @@ func TestLoginRoute_WithCallback(t *testing.T) {
 	_ = err
 }
 
+func TestLoginRoute_CallbackNotAllowed(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	err := config.Initialize(testLogger())
+	testza.AssertNoError(t, err)
+
+	store := setupTestStore()
+	handler := LoginRoute(store)
+
+	ctx, app := createTestContext("GET", "/_login?callback=evil.com", nil, "")
+	defer app.ReleaseCtx(ctx)
+
+	err = handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusBadRequest, ctx.Response().StatusCode())
+	testza.AssertNotContains(t, string(ctx.Response().Header.Peek("Set-Cookie")), CallbackCookieName)
+}
+
 func TestLoginRoute_WithoutCallback(t *testing.T) {
 	t.Setenv("AUTH_HOST", "auth.example.com")
 	t.Setenv("PASSWORDS", "plaintext:test123")
@@ -560,9 +697,13 @@ func TestSessionShareRoute_WithCookieDomain(t *testing.T) {
 	err := config.Initialize(testLogger())
 	testza.AssertNoError(t, err)
 
-	handler := SessionShareRoute()
+	store := setupTestStore()
+	handler := SessionShareRoute(store)
+	code := mintTestExchangeCode(t, store, "test-session-id")
 
-	ctx, app := createTestContext("GET", "/_session_exchange?id=test-session-id", nil, "")
+	ctx, app := createTestContext("GET", "/_session_exchange?code="+code, map[string]string{
+		"Host": "app.example.com",
+	}, "")
 	defer app.ReleaseCtx(ctx)
 
 	err = handler(ctx)
@@ -584,9 +725,13 @@ func TestSessionShareRoute_WithoutCookieDomain(t *testing.T) {
 	err := config.Initialize(testLogger())
 	testza.AssertNoError(t, err)
 
-	handler := SessionShareRoute()
+	store := setupTestStore()
+	handler := SessionShareRoute(store)
+	code := mintTestExchangeCode(t, store, "test-session-id")
 
-	ctx, app := createTestContext("GET", "/_session_exchange?id=test-session-id", nil, "")
+	ctx, app := createTestContext("GET", "/_session_exchange?code="+code, map[string]string{
+		"Host": "app.example.com",
+	}, "")
 	defer app.ReleaseCtx(ctx)
 
 	err = handler(ctx)
@@ -886,15 +1031,127 @@ func TestLoginAPI_RedirectsToSessionExchange(t *testing.T) {
 	// Check redirect location format
 	location := string(ctx.Response().Header.Peek("Location"))
 	testza.AssertContains(t, location, "https://app.example.com/_session_exchange")
-	testza.AssertContains(t, location, "id=")
+	testza.AssertContains(t, location, "code=")
 
-	// Extract session ID from location
-	// Location format: https://app.example.com/_session_exchange?id=<session_id>
-	sess, err := store.Get(ctx)
+	// The session ID itself must not travel in the URL; the code redeems to it on the callback host
+	// Location format: https://app.example.com/_session_exchange?code=<exchange_code>
+	// Login rotated the session ID, so it is read from the session cookie
+	sessionID := responseSessionID(t, ctx)
+	testza.AssertNotEqual(t, "", sessionID)
+	testza.AssertNotContains(t, location, sessionID)
+
+	u, err := url.Parse(location)
+	testza.AssertNoError(t, err)
+	redeemed, err := newStorageExchangeCodes(store.Storage).Redeem(u.Query().Get(ExchangeCodeParam), "app.example.com")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, sessionID, redeemed)
+}
+
+// TestLoginAPI_WithFullURLCallback_PreservesPath tests that a full original URL callback
+// (as built by BuildCallbackURL) is restored through the session exchange.
+func TestLoginAPI_WithFullURLCallback_PreservesPath(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	err := config.Initialize(testLogger())
+	testza.AssertNoError(t, err)
+
+	store := setupTestStore()
+	handler := LoginAPI(store)
+
+	ctx, app := createTestContext("POST", "/_login", map[string]string{
+		"Content-Type":      "application/x-www-form-urlencoded",
+		"X-Forwarded-Proto": "http",
+		"Host":              "auth.example.com",
+		"Cookie":            CallbackCookieName + "=https%3A%2F%2Fapp.example.com%2Freports%2F42%3Ftab%3Dx",
+	}, "password=test123")
+	defer app.ReleaseCtx(ctx)
+
+	err = handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusFound, ctx.Response().StatusCode())
+
+	u, err := url.Parse(string(ctx.Response().Header.Peek("Location")))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "https", u.Scheme)
+	testza.AssertEqual(t, "app.example.com", u.Host)
+	testza.AssertEqual(t, SessionExchangePath, u.Path)
+	testza.AssertNotEqual(t, "", u.Query().Get(ExchangeCodeParam))
+	testza.AssertEqual(t, "/reports/42?tab=x", u.Query().Get(ReturnToParam))
+}
+
+// TestLoginAPI_CallbackNotAllowed tests that login refuses to send a session to a host outside the allowlist
+func TestLoginAPI_CallbackNotAllowed(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	err := config.Initialize(testLogger())
+	testza.AssertNoError(t, err)
+
+	for _, callback := range []string{"evil.com", "https%3A%2F%2Fevil.com%2Fsteal", "https%3A%2F%2Fapp.example.com.evil.com%2F"} {
+		store := setupTestStore()
+		handler := LoginAPI(store)
+
+		ctx, app := createTestContext("POST", "/_login", map[string]string{
+			"Content-Type": "application/x-www-form-urlencoded",
+			"Host":         "auth.example.com",
+		}, "password=test123&callback="+callback)
+
+		err = handler(ctx)
+		testza.AssertNoError(t, err)
+		testza.AssertEqual(t, fiber.StatusBadRequest, ctx.Response().StatusCode())
+		testza.AssertEqual(t, "", string(ctx.Response().Header.Peek("Location")))
+
+		// No session is created for a refused callback
+		sess, err := store.Get(ctx)
+		testza.AssertNoError(t, err)
+		testza.AssertFalse(t, auth.IsAuthenticated(sess))
+		app.ReleaseCtx(ctx)
+	}
+}
+
+// TestLoginAPI_CallbackNotAllowed_FromCookie tests that a disallowed callback cookie is refused and cleared
+func TestLoginAPI_CallbackNotAllowed_FromCookie(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	err := config.Initialize(testLogger())
+	testza.AssertNoError(t, err)
+
+	store := setupTestStore()
+	handler := LoginAPI(store)
+
+	ctx, app := createTestContext("POST", "/_login", map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+		"Host":         "auth.example.com",
+		"Cookie":       CallbackCookieName + "=evil.com",
+	}, "password=test123")
+	defer app.ReleaseCtx(ctx)
+
+	err = handler(ctx)
 	testza.AssertNoError(t, err)
-	sessionID := sess.ID()
-	testza.AssertNotNil(t, sessionID)
-	testza.AssertContains(t, location, sessionID)
+	testza.AssertEqual(t, fiber.StatusBadRequest, ctx.Response().StatusCode())
+	testza.AssertContains(t, string(ctx.Response().Header.Peek("Set-Cookie")), CallbackCookieName+"=;")
+}
+
+// TestLoginAPI_CallbackAllowedDomains tests an explicit CALLBACK_ALLOWED_DOMAINS list
+func TestLoginAPI_CallbackAllowedDomains(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("CALLBACK_ALLOWED_DOMAINS", "*.apps.example.org")
+	err := config.Initialize(testLogger())
+	testza.AssertNoError(t, err)
+
+	store := setupTestStore()
+	handler := LoginAPI(store)
+
+	ctx, app := createTestContext("POST", "/_login", map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+		"Host":         "auth.example.com",
+	}, "password=test123&callback=grafana.apps.example.org")
+	defer app.ReleaseCtx(ctx)
+
+	err = handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusFound, ctx.Response().StatusCode())
+	testza.AssertContains(t, string(ctx.Response().Header.Peek("Location")), "grafana.apps.example.org/_session_exchange")
 }
 
 // TestLoginAPI_WithCallback_AcceptJSON_Returns200WithRedirect tests that when client sends
@@ -934,7 +1191,7 @@ func TestLoginAPI_WithCallback_AcceptJSON_Returns200WithRedirect(t *testing.T) {
 	testza.AssertNoError(t, err)
 	testza.AssertTrue(t, result.Success)
 	testza.AssertContains(t, result.Redirect, "app.example.com/_session_exchange")
-	testza.AssertContains(t, result.Redirect, "id=")
+	testza.AssertContains(t, result.Redirect, "code=")
 }
 
 // TestLoginAPI_NoCallback_APIRequest tests that API request returns JSON when no callback
@@ -1084,7 +1341,7 @@ func TestLogoutRoute_SessionStoreError(t *testing.T) {
 	}
 	mockUnauthenticator := &MockUnauthenticator{}
 
-	err := logoutHandler(ctx, mockSessionGetter, mockUnauthenticator)
+	err := logoutHandler(ctx, mockSessionGetter, mockUnauthenticator, nil)
 	testza.AssertNoError(t, err)
 	testza.AssertEqual(t, fiber.StatusInternalServerError, ctx.Response().StatusCode())
 
@@ -1113,7 +1370,7 @@ func TestLogoutRoute_UnauthenticateError(t *testing.T) {
 		},
 	}
 
-	err = logoutHandler(ctx, mockSessionGetter, mockUnauthenticator)
+	err = logoutHandler(ctx, mockSessionGetter, mockUnauthenticator, nil)
 	testza.AssertNoError(t, err)
 	testza.AssertEqual(t, fiber.StatusInternalServerError, ctx.Response().StatusCode())
 
@@ -1142,7 +1399,7 @@ func TestLogoutHandler_Success(t *testing.T) {
 		},
 	}
 
-	err = logoutHandler(ctx, mockSessionGetter, mockUnauthenticator)
+	err = logoutHandler(ctx, mockSessionGetter, mockUnauthenticator, nil)
 	testza.AssertNoError(t, err)
 	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
 	testza.AssertEqual(t, "Logged out", string(ctx.Response().Body()))
@@ -1285,9 +1542,8 @@ func TestLogoutRoute_AfterLogin(t *testing.T) {
 	err = loginHandler(ctx1)
 	testza.AssertNoError(t, err)
 
-	// Verify session is authenticated
-	sess, err := store.Get(ctx1)
-	testza.AssertNoError(t, err)
+	// Verify session is authenticated; login rotated its ID, so it is read from the session cookie
+	sess := responseSession(t, store, ctx1)
 	testza.AssertTrue(t, auth.IsAuthenticated(sess), "session should be authenticated after login")
 
 	// Then logout
@@ -1451,7 +1707,7 @@ func TestLoginAPI_SessionStoreError(t *testing.T) {
 	}
 	mockAuthenticator := &MockAuthenticator{}
 
-	err = loginAPIHandler(ctx, mockSessionGetter, mockAuthenticator)
+	err = loginAPIHandler(ctx, mockSessionGetter, mockAuthenticator, newStorageExchangeCodes(setupTestStore().Storage))
 	testza.AssertNoError(t, err)
 	testza.AssertEqual(t, fiber.StatusInternalServerError, ctx.Response().StatusCode())
 
@@ -1487,7 +1743,7 @@ func TestLoginAPI_AuthenticateError(t *testing.T) {
 		},
 	}
 
-	err = loginAPIHandler(ctx, mockSessionGetter, mockAuthenticator)
+	err = loginAPIHandler(ctx, mockSessionGetter, mockAuthenticator, newStorageExchangeCodes(setupTestStore().Storage))
 	testza.AssertNoError(t, err)
 	testza.AssertEqual(t, fiber.StatusInternalServerError, ctx.Response().StatusCode())
 
@@ -1542,7 +1798,7 @@ func TestLoginRoute_SessionStoreError(t *testing.T) {
 		},
 	}
 
-	err = loginRouteHandler(ctx, mockSessionGetter)
+	err = loginRouteHandler(ctx, mockSessionGetter, newStorageExchangeCodes(setupTestStore().Storage))
 	testza.AssertNoError(t, err)
 	testza.AssertEqual(t, fiber.StatusInternalServerError, ctx.Response().StatusCode())
 
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+
+	"github.com/soulteary/stargate/src/internal/auditlog"
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/idp"
+	"github.com/soulteary/stargate/src/internal/metrics"
+)
+
+// sessionIdentity reads the identity released to OpenID Connect clients from the session.
+func sessionIdentity(sess *session.Session) idp.Identity {
+	str := func(key string) string {
+		s, _ := sess.Get(key).(string)
+		return s
+	}
+	return idp.Identity{
+		Subject: str("user_id"),
+		Email:   str("user_mail"),
+		Phone:   str("user_phone"),
+		Name:    str("user_name"),
+		Role:    str("user_role"),
+		Groups:  sessionStrings(sess.Get("user_scope")),
+		AMR:     sessionStrings(sess.Get(amrSessionKey)),
+	}
+}
+
+// idpRedirect sends the authorization response to the client's redirect URI, keeping its query.
+func idpRedirect(ctx *fiber.Ctx, redirectURI string, params url.Values) error {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.idp_invalid_client"))
+	}
+	query := u.Query()
+	for key, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query[key] = values
+		}
+	}
+	u.RawQuery = query.Encode()
+	return ctx.Redirect(u.String(), fiber.StatusFound)
+}
+
+// authHostLoginURL returns the login page URL that brings the user back to this request, for
+// pages served on AUTH_HOST itself.
+func authHostLoginURL(ctx *fiber.Ctx) string {
+	proto := GetForwardedProto(ctx)
+	authorizeURL := fmt.Sprintf("%s://%s%s", proto, config.AuthHost.String(), ctx.OriginalURL())
+	return fmt.Sprintf("%s://%s/_login?callback=%s", proto, config.AuthHost.String(), url.QueryEscape(authorizeURL))
+}
+
+// idpAuthorizeHandler is the internal handler that can be tested with mocked dependencies.
+func idpAuthorizeHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, provider *idp.Provider) error {
+	if provider == nil {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.idp_not_configured"))
+	}
+
+	req := idp.AuthorizationRequest{
+		ResponseType:        ctx.Query("response_type"),
+		ClientID:            ctx.Query("client_id"),
+		RedirectURI:         ctx.Query("redirect_uri"),
+		Scope:               ctx.Query("scope"),
+		State:               ctx.Query("state"),
+		Nonce:               ctx.Query("nonce"),
+		CodeChallenge:       ctx.Query("code_challenge"),
+		CodeChallengeMethod: ctx.Query("code_challenge_method"),
+	}
+	// An unknown client or redirect URI is reported to the user, never redirected
+	client, err := provider.CheckClient(req)
+	if err != nil {
+		log.Warn().Err(err).Str("client_id", req.ClientID).Str("redirect_uri", req.RedirectURI).Msg("Rejected OIDC authorization request")
+		return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.idp_invalid_client"))
+	}
+	fail := func(oerr *idp.Error) error {
+		return idpRedirect(ctx, req.RedirectURI, url.Values{
+			"error":             {oerr.Code},
+			"error_description": {oerr.Description},
+			"state":             {req.State},
+		})
+	}
+	if oerr := provider.ValidateRequest(client, req); oerr != nil {
+		return fail(oerr)
+	}
+
+	sess, err := sessionGetter.Get(ctx)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	if !auth.IsAuthenticated(sess) {
+		if ctx.Query("prompt") == "none" {
+			return fail(&idp.Error{Code: "login_required"})
+		}
+		return ctx.Redirect(authHostLoginURL(ctx), fiber.StatusFound)
+	}
+
+	code, oerr := provider.Authorize(client, req, sessionIdentity(sess))
+	if oerr != nil {
+		return fail(oerr)
+	}
+	return idpRedirect(ctx, req.RedirectURI, url.Values{"code": {code}, "state": {req.State}})
+}
+
+// idpClientCredentials returns the client ID and secret from HTTP Basic authentication
+// (client_secret_basic) or the form (client_secret_post, or client_id alone for public clients).
+func idpClientCredentials(ctx *fiber.Ctx) (string, string) {
+	if header := ctx.Get(fiber.HeaderAuthorization); strings.HasPrefix(header, "Basic ") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Basic "))
+		if err == nil {
+			if id, secret, ok := strings.Cut(string(decoded), ":"); ok {
+				// RFC 6749 section 2.3.1: both parts are form-urlencoded
+				id, errID := url.QueryUnescape(id)
+				secret, errSecret := url.QueryUnescape(secret)
+				if errID == nil && errSecret == nil {
+					return id, secret
+				}
+			}
+		}
+		return "", ""
+	}
+	return ctx.FormValue("client_id"), ctx.FormValue("client_secret")
+}
+
+// sendOAuthError writes an OAuth 2.0 error response.
+func sendOAuthError(ctx *fiber.Ctx, status int, oerr *idp.Error) error {
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.Status(status).JSON(oerr)
+}
+
+// idpTokenHandler is the internal handler that can be tested with mocked dependencies.
+func idpTokenHandler(ctx *fiber.Ctx, provider *idp.Provider) error {
+	if provider == nil {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.idp_not_configured"))
+	}
+
+	clientID, secret := idpClientCredentials(ctx)
+	// Label metrics with registered client IDs only, so arbitrary values cannot grow the series
+	clientLabel := "unknown"
+	if provider.Client(clientID) != nil {
+		clientLabel = clientID
+	}
+
+	resp, identity, err := provider.Exchange(idp.TokenRequest{
+		GrantType:    ctx.FormValue("grant_type"),
+		Code:         ctx.FormValue("code"),
+		RedirectURI:  ctx.FormValue("redirect_uri"),
+		CodeVerifier: ctx.FormValue("code_verifier"),
+		ClientID:     clientID,
+		ClientSecret: secret,
+	})
+	if err != nil {
+		var oerr *idp.Error
+		if !errors.As(err, &oerr) {
+			log.Error().Err(err).Str("client_id", clientLabel).Msg("Failed to issue OIDC tokens")
+			oerr = &idp.Error{Code: "server_error"}
+		}
+		metrics.RecordIDPToken(clientLabel, oerr.Code)
+		auditlog.LogIDPToken(ctx.Context(), "", clientLabel, GetClientIP(ctx), false, oerr.Code)
+		switch oerr.Code {
+		case "server_error":
+			return sendOAuthError(ctx, fiber.StatusInternalServerError, oerr)
+		case "invalid_client":
+			ctx.Set(fiber.HeaderWWWAuthenticate, `Basic realm="stargate"`)
+			return sendOAuthError(ctx, fiber.StatusUnauthorized, oerr)
+		default:
+			return sendOAuthError(ctx, fiber.StatusBadRequest, oerr)
+		}
+	}
+
+	metrics.RecordIDPToken(clientLabel, "success")
+	auditlog.LogIDPToken(ctx.Context(), identity.Subject, clientLabel, GetClientIP(ctx), true, "")
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	ctx.Set(fiber.HeaderPragma, "no-cache")
+	return ctx.JSON(resp)
+}
+
+// idpUserInfoHandler is the internal handler that can be tested with mocked dependencies.
+func idpUserInfoHandler(ctx *fiber.Ctx, provider *idp.Provider) error {
+	if provider == nil {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.idp_not_configured"))
+	}
+
+	claims, err := provider.UserInfo(bearerToken(ctx))
+	if err != nil {
+		var oerr *idp.Error
+		if !errors.As(err, &oerr) {
+			log.Error().Err(err).Msg("Failed to read OIDC access token")
+			return sendOAuthError(ctx, fiber.StatusInternalServerError, &idp.Error{Code: "server_error"})
+		}
+		ctx.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		return sendOAuthError(ctx, fiber.StatusUnauthorized, oerr)
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.JSON(claims)
+}
+
+// IDPDiscoveryRoute handles GET requests to /.well-known/openid-configuration.
+func IDPDiscoveryRoute() func(c *fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		provider := idp.Get()
+		if provider == nil {
+			return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.idp_not_configured"))
+		}
+		return ctx.JSON(provider.Discovery())
+	}
+}
+
+// IDPAuthorizeRoute handles GET requests to /authorize. Users without a session are sent to the
+// login page and come back here; logged-in users are redirected to the client with a code.
+func IDPAuthorizeRoute(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return idpAuthorizeHandler(ctx, sessionGetter, idp.Get())
+	}
+}
+
+// IDPTokenRoute handles POST requests to /token, redeeming authorization codes for ID and access tokens.
+func IDPTokenRoute() func(c *fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		return idpTokenHandler(ctx, idp.Get())
+	}
+}
+
+// IDPUserInfoRoute handles GET and POST requests to /userinfo with a Bearer access token.
+func IDPUserInfoRoute() func(c *fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		return idpUserInfoHandler(ctx, idp.Get())
+	}
+}
+
+// IDPJWKSRoute handles GET requests to /jwks.json, publishing the ID token signing keys.
+func IDPJWKSRoute() func(c *fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		provider := idp.Get()
+		if provider == nil {
+			return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.idp_not_configured"))
+		}
+		return ctx.JSON(provider.JWKS())
+	}
+}
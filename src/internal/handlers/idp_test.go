@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/idp"
+	"github.com/soulteary/stargate/src/internal/jose"
+	"github.com/soulteary/stargate/src/internal/keyring"
+)
+
+const idpTestClients = `
+clients:
+  - id: wiki
+    secret: wiki-secret
+    redirect_uris: ["https://wiki.example.com/callback?tenant=1"]
+  - id: spa
+    public: true
+    redirect_uris: ["https://spa.example.com/cb"]
+`
+
+// idpTestApp serves the provider routes, plus /test_login creating a session for user-1.
+func idpTestApp(t *testing.T, provider *idp.Provider) *fiber.App {
+	t.Helper()
+	store := setupTestStore()
+	sessionGetter := &SessionStoreAdapter{store: store}
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("i18n-bundle", i18n.GetBundle())
+		c.Locals("i18n-language", i18n.LangEN)
+		return c.Next()
+	})
+	app.Get(idp.AuthorizePath, func(c *fiber.Ctx) error {
+		return idpAuthorizeHandler(c, sessionGetter, provider)
+	})
+	app.Post(idp.TokenPath, func(c *fiber.Ctx) error {
+		return idpTokenHandler(c, provider)
+	})
+	app.Get(idp.UserInfoPath, func(c *fiber.Ctx) error {
+		return idpUserInfoHandler(c, provider)
+	})
+	app.Get("/test_login", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("user_id", "user-1")
+		sess.Set("user_mail", "alice@example.com")
+		sess.Set("user_name", "Alice")
+		sess.Set("user_role", "admin")
+		sess.Set("user_scope", []string{"read", "write"})
+		sess.Set(amrSessionKey, []string{"pwd", "otp"})
+		return (&AuthAuthenticator{}).Authenticate(sess)
+	})
+	return app
+}
+
+func setupIDPTest(t *testing.T) (*idp.Provider, *fiber.App, *http.Cookie) {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+
+	clients, err := idp.ParseClients([]byte(idpTestClients))
+	testza.AssertNoError(t, err)
+	key, err := keyring.Generate(jose.ES256)
+	testza.AssertNoError(t, err)
+	provider := idp.New("https://auth.example.com", clients, keyring.New(key), setupTestStore().Storage, 0)
+	app := idpTestApp(t, provider)
+
+	resp := oidcRequest(t, app, "/test_login", nil)
+	cookie := sessionCookie(resp)
+	testza.AssertNotNil(t, cookie)
+	return provider, app, cookie
+}
+
+func idpTokenRequest(t *testing.T, app *fiber.App, form url.Values, user, password string) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, idp.TokenPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	var body map[string]interface{}
+	testza.AssertNoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	return resp, body
+}
+
+func TestIDPAuthorize_FullFlow(t *testing.T) {
+	provider, app, cookie := setupIDPTest(t)
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {"wiki"},
+		"redirect_uri":  {"https://wiki.example.com/callback?tenant=1"},
+		"scope":         {"openid email groups"},
+		"state":         {"s-1"},
+		"nonce":         {"n-1"},
+	}
+	resp := oidcRequest(t, app, idp.AuthorizePath+"?"+query.Encode(), cookie)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "wiki.example.com", location.Host)
+	testza.AssertEqual(t, "1", location.Query().Get("tenant"))
+	testza.AssertEqual(t, "s-1", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	testza.AssertNotEqual(t, "", code)
+
+	resp, body := idpTokenRequest(t, app, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {"https://wiki.example.com/callback?tenant=1"},
+	}, "wiki", "wiki-secret")
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	testza.AssertEqual(t, "no-store", resp.Header.Get("Cache-Control"))
+	testza.AssertEqual(t, "Bearer", body["token_type"])
+
+	token, err := jose.Verify(body["id_token"].(string), provider.JWKS())
+	testza.AssertNoError(t, err)
+	testza.AssertNoError(t, token.Claims.Validate(jose.Expected{Issuer: "https://auth.example.com", Audience: "wiki", RequireExpiry: true}))
+	testza.AssertEqual(t, "user-1", token.Claims.String("sub"))
+	testza.AssertEqual(t, "n-1", token.Claims.String("nonce"))
+	testza.AssertEqual(t, "alice@example.com", token.Claims.String("email"))
+	testza.AssertEqual(t, "admin", token.Claims.String("role"))
+	testza.AssertEqual(t, []string{"read", "write"}, token.Claims.Strings("groups"))
+	testza.AssertEqual(t, []string{"pwd", "otp"}, token.Claims.Strings("amr"))
+	testza.AssertEqual(t, "", token.Claims.String("name"))
+
+	req := httptest.NewRequest(http.MethodGet, idp.UserInfoPath, nil)
+	req.Header.Set("Authorization", "Bearer "+body["access_token"].(string))
+	resp, err = app.Test(req)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	var userinfo map[string]interface{}
+	testza.AssertNoError(t, json.NewDecoder(resp.Body).Decode(&userinfo))
+	testza.AssertEqual(t, "user-1", userinfo["sub"])
+	testza.AssertEqual(t, "alice@example.com", userinfo["email"])
+
+	// The code cannot be redeemed twice
+	resp, body = idpTokenRequest(t, app, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {"https://wiki.example.com/callback?tenant=1"},
+	}, "wiki", "wiki-secret")
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+	testza.AssertEqual(t, "invalid_grant", body["error"])
+}
+
+func TestIDPAuthorize_RedirectsToLogin(t *testing.T) {
+	_, app, _ := setupIDPTest(t)
+
+	target := idp.AuthorizePath + "?response_type=code&client_id=wiki&scope=openid&redirect_uri=" + url.QueryEscape("https://wiki.example.com/callback?tenant=1")
+	resp := oidcRequest(t, app, target, nil)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "auth.example.com", location.Host)
+	testza.AssertEqual(t, "/_login", location.Path)
+	testza.AssertEqual(t, location.Scheme+"://auth.example.com"+target, location.Query().Get("callback"))
+
+	// prompt=none reports login_required to the client instead
+	resp = oidcRequest(t, app, target+"&prompt=none&state=s-2", nil)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	location, err = url.Parse(resp.Header.Get("Location"))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "wiki.example.com", location.Host)
+	testza.AssertEqual(t, "login_required", location.Query().Get("error"))
+	testza.AssertEqual(t, "s-2", location.Query().Get("state"))
+}
+
+func TestIDPAuthorize_InvalidRequests(t *testing.T) {
+	_, app, cookie := setupIDPTest(t)
+
+	// Unknown clients and redirect URIs are never redirected to
+	for _, query := range []string{
+		"response_type=code&scope=openid&client_id=other&redirect_uri=" + url.QueryEscape("https://wiki.example.com/callback?tenant=1"),
+		"response_type=code&scope=openid&client_id=wiki&redirect_uri=" + url.QueryEscape("https://evil.example.com/callback"),
+	} {
+		resp := oidcRequest(t, app, idp.AuthorizePath+"?"+query, cookie)
+		testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+		testza.AssertEqual(t, "", resp.Header.Get("Location"))
+	}
+
+	// Other errors go back to the client
+	cases := map[string]string{
+		"response_type=token&scope=openid&client_id=wiki&redirect_uri=" + url.QueryEscape("https://wiki.example.com/callback?tenant=1"): "unsupported_response_type",
+		"response_type=code&scope=email&client_id=wiki&redirect_uri=" + url.QueryEscape("https://wiki.example.com/callback?tenant=1"):   "invalid_scope",
+		"response_type=code&scope=openid&client_id=spa&redirect_uri=" + url.QueryEscape("https://spa.example.com/cb"):                   "invalid_request",
+	}
+	for query, expected := range cases {
+		resp := oidcRequest(t, app, idp.AuthorizePath+"?"+query, cookie)
+		testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+		location, err := url.Parse(resp.Header.Get("Location"))
+		testza.AssertNoError(t, err)
+		testza.AssertEqual(t, expected, location.Query().Get("error"))
+	}
+}
+
+func TestIDPToken_PublicClient(t *testing.T) {
+	_, app, cookie := setupIDPTest(t)
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"spa"},
+		"redirect_uri":          {"https://spa.example.com/cb"},
+		"scope":                 {"openid"},
+		"code_challenge":        {"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+		"code_challenge_method": {"S256"},
+	}
+	resp := oidcRequest(t, app, idp.AuthorizePath+"?"+query.Encode(), cookie)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	testza.AssertNoError(t, err)
+
+	resp, body := idpTokenRequest(t, app, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {location.Query().Get("code")},
+		"redirect_uri":  {"https://spa.example.com/cb"},
+		"client_id":     {"spa"},
+		"code_verifier": {verifier},
+	}, "", "")
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	testza.AssertNotEqual(t, "", body["id_token"])
+}
+
+func TestIDPToken_InvalidClient(t *testing.T) {
+	_, app, _ := setupIDPTest(t)
+
+	resp, body := idpTokenRequest(t, app, url.Values{"grant_type": {"authorization_code"}, "code": {"x"}}, "wiki", "wrong")
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	testza.AssertEqual(t, "invalid_client", body["error"])
+	testza.AssertTrue(t, strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic"))
+}
+
+func TestIDPUserInfo_InvalidToken(t *testing.T) {
+	_, app, _ := setupIDPTest(t)
+
+	req := httptest.NewRequest(http.MethodGet, idp.UserInfoPath, nil)
+	req.Header.Set("Authorization", "Bearer unknown")
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	testza.AssertEqual(t, `Bearer error="invalid_token"`, resp.Header.Get("WWW-Authenticate"))
+}
+
+func TestIDP_NotConfigured(t *testing.T) {
+	setupIDPTest(t)
+	app := idpTestApp(t, nil)
+
+	resp := oidcRequest(t, app, idp.AuthorizePath+"?client_id=wiki", nil)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+	resp = oidcRequest(t, app, idp.UserInfoPath, nil)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+}
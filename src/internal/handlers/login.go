@@ -21,6 +21,10 @@ import (
 	"github.com/soulteary/stargate/src/internal/config"
 	"github.com/soulteary/stargate/src/internal/i18n"
 	"github.com/soulteary/stargate/src/internal/metrics"
+	"github.com/soulteary/stargate/src/internal/oidc"
+	"github.com/soulteary/stargate/src/internal/ratelimit"
+	"github.com/soulteary/stargate/src/internal/users"
+	"github.com/soulteary/stargate/src/internal/webauthn"
 	"github.com/soulteary/tracing-kit"
 	"github.com/soulteary/warden/pkg/warden"
 )
@@ -136,7 +140,7 @@ func (a *AuthAuthenticator) Authenticate(sess *session.Session) error {
 }
 
 // loginAPIHandler is the internal handler that can be tested with mocked dependencies.
-func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator Authenticator) error {
+func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator Authenticator, codes ExchangeCodeStore) error {
 	// Get trace context from middleware
 	traceCtx := ctx.Locals("trace_context")
 	if traceCtx == nil {
@@ -148,8 +152,33 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 	loginCtx, loginSpan := tracing.StartSpan(spanCtx, "auth.login")
 	defer loginSpan.End()
 
+	// Get callback parameter (priority: cookie, form data, query parameter).
+	// It is checked against the allowlist before authenticating, so a session is never sent to an unknown host.
+	callbackFromCookie := GetCallbackFromCookie(ctx)
+	callback := callbackFromCookie
+	if callback == "" {
+		callback = ctx.FormValue("callback")
+	}
+	if callback == "" {
+		callback = ctx.Query("callback")
+	}
+	target, err := resolveCallback(ctx, callback)
+	if err != nil {
+		tracing.RecordError(loginSpan, err)
+		if callbackFromCookie != "" {
+			ClearCallbackCookie(ctx)
+		}
+		return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.callback_not_allowed"))
+	}
+
 	password := ctx.FormValue("password")
-	authMethod := ctx.FormValue("auth_method") // "password" or "warden"
+	username := strings.TrimSpace(ctx.FormValue("username"))
+	authMethod := ctx.FormValue("auth_method") // "password", "warden" or "oidc"
+
+	// OIDC logins are completed by the provider, which authenticates the user and calls back
+	if authMethod == authMethodOIDC {
+		return startOIDCLogin(ctx, sessionGetter, oidc.Get(), callback)
+	}
 	userPhone := auth.NormalizePhone(ctx.FormValue("phone"))
 	userMail := ctx.FormValue("mail")
 
@@ -159,6 +188,7 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 
 	var userID string                        // Declare userID at function scope
 	var verifyRespAMR []string               // Store AMR from Herald response
+	var loginReason string                   // Audit reason of a successful login, when notable
 	var wardenUserInfo *warden.AllowListUser // Reused across warden branch to avoid repeated GetUserInfo
 
 	// Determine authentication method
@@ -169,6 +199,21 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 
 	var authenticated bool
 
+	// Failed logins are counted per client IP and, for Warden and named-user logins, per identifier
+	var identifier string
+	if authMethod == "warden" {
+		identifier = rateLimitIdentifier(userPhone, userMail)
+	} else if username != "" {
+		identifier = username
+	}
+	limitKeys := ratelimit.LoginKeys(GetClientIP(ctx), identifier)
+	if retryAfter := rateLimitRetryAfter(ctx, ratelimit.ScopeLogin, identifier, limitKeys...); retryAfter > 0 {
+		tracing.RecordError(loginSpan, errRateLimited)
+		metrics.RecordAuthRequest(authMethod, "rate_limited")
+		setRetryAfter(ctx, retryAfter)
+		return SendErrorResponse(ctx, fiber.StatusTooManyRequests, i18n.T(ctx, "error.rate_limited_retry"))
+	}
+
 	if authMethod == "warden" {
 		// 手机号规范化后校验格式（如系统自动填充 "138 0013 8000" 已去空格，此处校验是否为有效号码）
 		if userPhone != "" && !auth.IsValidPhone(userPhone) {
@@ -206,7 +251,8 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 			metrics.RecordWardenCall("get_user_info", "failure", wardenDuration)
 			metrics.RecordAuthRequest("warden", "failure")
 			log.Warn().Str("phone", secure.MaskPhone(userPhone)).Str("mail", secure.MaskEmail(userMail)).Msg("Warden authentication failed")
-			auditlog.LogLogin(ctx.Context(), "", "warden", ctx.IP(), false, "user_not_in_list")
+			auditlog.LogLogin(ctx.Context(), "", "warden", GetClientIP(ctx), false, "user_not_in_list")
+			recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, identifier, limitKeys...)
 			return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.user_not_in_list"))
 		}
 		wardenSpan.SetAttributes(
@@ -228,12 +274,38 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 		challengeID := ctx.FormValue("challenge_id")
 		otpCode := ctx.FormValue("otp_code")
 		useOTP := ctx.FormValue("use_otp") == "true"
+		useBackupCode := ctx.FormValue("use_backup_code") == "true"
 
-		// OTP enabled: Warden global OTP or Herald TOTP (per-user, via Herald proxy) when configured
-		otpEnabled := config.WardenOTPEnabled.ToBool() || config.HeraldTOTPEnabled.ToBool()
+		// OTP enabled: Warden global OTP or per-user TOTP (Herald proxy or local store) when configured
+		otpEnabled := config.WardenOTPEnabled.ToBool() || userTOTPEnabled()
 
-		// Step 4: Verify code via Herald (if not using OTP)
-		if !useOTP {
+		// Step 4: Verify a TOTP backup code, a code via Herald (if not using OTP) or the OTP code
+		if useBackupCode {
+			backend := getTOTPBackend()
+			if backend == nil || !userTOTPEnabled() {
+				return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.backup_code_unavailable"))
+			}
+			backupCode := strings.TrimSpace(ctx.FormValue("backup_code"))
+			if backupCode == "" {
+				return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.backup_code_required"))
+			}
+			ok, err := backend.RedeemBackupCode(loginCtx, userID, backupCode)
+			if err != nil {
+				log.Warn().Err(err).Str("user_id", userID).Msg("Backup code check failed")
+				return totpUnavailable(ctx, backend)
+			}
+			if !ok {
+				metrics.RecordAuthRequest(authMethodBackupCode, "failure")
+				log.Warn().Str("phone", secure.MaskPhone(userPhone)).Str("mail", secure.MaskEmail(userMail)).Msg("Backup code verification failed")
+				auditlog.LogLogin(ctx.Context(), userID, authMethodBackupCode, GetClientIP(ctx), false, "backup_code_invalid")
+				recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, identifier, limitKeys...)
+				return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.backup_code_invalid"))
+			}
+			metrics.RecordAuthRequest(authMethodBackupCode, "success")
+			log.Info().Str("user_id", userID).Msg("Backup code used for login")
+			verifyRespAMR = []string{amrBackupCode}
+			loginReason = auditBackupCodeUsed
+		} else if !useOTP {
 			// Check if Herald is enabled
 			if !config.HeraldEnabled.ToBool() {
 				// If Herald is not enabled and OTP is also not enabled, return error
@@ -257,7 +329,7 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 			verifyReq := &herald.VerifyChallengeRequest{
 				ChallengeID: challengeID,
 				Code:        verifyCode,
-				ClientIP:    ctx.IP(),
+				ClientIP:    GetClientIP(ctx),
 			}
 
 			// Start span for Herald verify challenge
@@ -288,33 +360,9 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 					if (heraldErr.StatusCode == http.StatusUnauthorized || heraldErr.StatusCode == http.StatusBadRequest) &&
 						verifyResp != nil && !verifyResp.OK && verifyResp.Reason != "" {
 						reason := verifyResp.Reason
-						auditlog.LogVerifyCodeCheck(ctx.Context(), userID, ctx.IP(), false, reason)
-						var errorMsg string
-						switch reason {
-						case "expired":
-							errorMsg = i18n.T(ctx, "error.verify_code_expired")
-						case "invalid":
-							errorMsg = i18n.T(ctx, "error.verify_code_invalid")
-							if verifyResp.RemainingAttempts != nil {
-								errorMsg = i18n.Tf(ctx, "error.verify_code_invalid_with_attempts", *verifyResp.RemainingAttempts)
-							}
-						case "locked":
-							errorMsg = i18n.T(ctx, "error.verify_code_locked")
-						case "too_many_attempts":
-							errorMsg = i18n.T(ctx, "error.verify_code_too_many")
-						case "rate_limited":
-							errorMsg = i18n.T(ctx, "error.verify_code_rate_limited")
-							if verifyResp.NextResendIn != nil {
-								errorMsg = i18n.Tf(ctx, "error.verify_code_rate_limited_with_wait", *verifyResp.NextResendIn)
-							}
-						case "send_failed":
-							errorMsg = i18n.T(ctx, "error.verify_code_send_failed")
-						case "unauthorized":
-							errorMsg = i18n.T(ctx, "error.verify_code_unauthorized")
-						default:
-							errorMsg = i18n.T(ctx, "error.verify_code_failed")
-						}
-						return SendErrorResponse(ctx, fiber.StatusUnauthorized, errorMsg)
+						auditlog.LogVerifyCodeCheck(ctx.Context(), userID, GetClientIP(ctx), false, reason)
+						recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, identifier, limitKeys...)
+						return SendErrorResponse(ctx, fiber.StatusUnauthorized, verifyCodeErrorMessage(ctx, reason, verifyResp))
 					}
 					// Real auth failure (e.g. bad HMAC), not verification failure
 					if heraldErr.StatusCode == http.StatusUnauthorized {
@@ -338,37 +386,10 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 					reason = "invalid"
 				}
 				log.Warn().Str("reason", reason).Msg("Challenge verification failed")
-				auditlog.LogVerifyCodeCheck(ctx.Context(), userID, ctx.IP(), false, reason)
-
-				// Provide detailed error message based on reason
-				var errorMsg string
-				switch reason {
-				case "expired":
-					errorMsg = i18n.T(ctx, "error.verify_code_expired")
-				case "invalid":
-					errorMsg = i18n.T(ctx, "error.verify_code_invalid")
-					// Add remaining attempts if available
-					if verifyResp.RemainingAttempts != nil {
-						errorMsg = i18n.Tf(ctx, "error.verify_code_invalid_with_attempts", *verifyResp.RemainingAttempts)
-					}
-				case "locked":
-					errorMsg = i18n.T(ctx, "error.verify_code_locked")
-				case "too_many_attempts":
-					errorMsg = i18n.T(ctx, "error.verify_code_too_many")
-				case "rate_limited":
-					errorMsg = i18n.T(ctx, "error.verify_code_rate_limited")
-					// Add wait time if available
-					if verifyResp.NextResendIn != nil {
-						errorMsg = i18n.Tf(ctx, "error.verify_code_rate_limited_with_wait", *verifyResp.NextResendIn)
-					}
-				case "send_failed":
-					errorMsg = i18n.T(ctx, "error.verify_code_send_failed")
-				case "unauthorized":
-					errorMsg = i18n.T(ctx, "error.verify_code_unauthorized")
-				default:
-					errorMsg = i18n.T(ctx, "error.verify_code_failed")
-				}
-				return SendErrorResponse(ctx, fiber.StatusUnauthorized, errorMsg)
+				auditlog.LogVerifyCodeCheck(ctx.Context(), userID, GetClientIP(ctx), false, reason)
+				recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, identifier, limitKeys...)
+
+				return SendErrorResponse(ctx, fiber.StatusUnauthorized, verifyCodeErrorMessage(ctx, reason, verifyResp))
 			}
 
 			// Log successful verification
@@ -378,11 +399,12 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 			)
 			heraldSpan.End()
 			metrics.RecordHeraldCall("verify_challenge", "success", duration)
-			auditlog.LogVerifyCodeCheck(ctx.Context(), userID, ctx.IP(), true, "")
+			auditlog.LogVerifyCodeCheck(ctx.Context(), userID, GetClientIP(ctx), true, "")
 
 			// Verify user ID matches
 			if verifyResp.UserID != userID {
 				log.Warn().Str("expected", userID).Str("got", verifyResp.UserID).Msg("User ID mismatch")
+				recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, identifier, limitKeys...)
 				return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.verify_failed"))
 			}
 
@@ -396,32 +418,25 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 				return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.otp_code_required"))
 			}
 
-			// Herald TOTP (per-user, via Herald proxy) when configured
-			heraldClient := getHeraldClient()
-			if heraldClient != nil && config.HeraldTOTPEnabled.ToBool() {
+			// Per-user TOTP (Herald proxy, or the local store when Herald TOTP is off) when configured
+			if backend := getTOTPBackend(); backend != nil && userTOTPEnabled() {
 				// Check if user has TOTP enrolled; if not, require verification code login first, then bind in settings
-				statusResp, err := heraldClient.TOTPStatus(loginCtx, userID)
+				enrolled, err := backend.Enabled(loginCtx, userID)
 				if err != nil {
-					log.Warn().Err(err).Str("user_id", userID).Msg("Herald TOTP status check failed")
-					return SendErrorResponse(ctx, fiber.StatusBadGateway, i18n.T(ctx, "error.herald_unavailable_retry"))
+					log.Warn().Err(err).Str("user_id", userID).Msg("TOTP status check failed")
+					return totpUnavailable(ctx, backend)
 				}
-				if statusResp == nil || !statusResp.TotpEnabled {
+				if !enrolled {
 					metrics.RecordAuthRequest("warden_otp", "failure")
-					auditlog.LogLogin(ctx.Context(), userID, "warden_otp", ctx.IP(), false, "totp_not_enrolled")
+					auditlog.LogLogin(ctx.Context(), userID, "warden_otp", GetClientIP(ctx), false, "totp_not_enrolled")
 					return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.totp_not_enrolled"))
 				}
-				verifyReq := &herald.TOTPVerifyRequest{
-					Subject: userID,
-					Code:    otpCode,
-				}
-				if challengeID != "" {
-					verifyReq.ChallengeID = challengeID
-				}
-				verifyResp, err := heraldClient.TOTPVerify(loginCtx, verifyReq)
-				if err != nil || verifyResp == nil || !verifyResp.OK {
+				ok, err := backend.Verify(loginCtx, userID, otpCode, challengeID)
+				if err != nil || !ok {
 					metrics.RecordAuthRequest("warden_otp", "failure")
 					log.Warn().Err(err).Str("phone", secure.MaskPhone(userPhone)).Str("mail", secure.MaskEmail(userMail)).Msg("TOTP verification failed")
-					auditlog.LogLogin(ctx.Context(), userID, "warden_otp", ctx.IP(), false, "otp_verification_failed")
+					auditlog.LogLogin(ctx.Context(), userID, "warden_otp", GetClientIP(ctx), false, "otp_verification_failed")
+					recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, identifier, limitKeys...)
 					return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.otp_code_invalid"))
 				}
 				metrics.RecordAuthRequest("warden_otp", "success")
@@ -432,10 +447,11 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 					log.Warn().Msg("OTP secret is not configured")
 					return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.otp_config_error"))
 				}
-				if !auth.VerifyOTP(otpSecret, otpCode) {
+				if !auth.VerifyOTPFor(userID, otpSecret, otpCode) {
 					metrics.RecordAuthRequest("warden_otp", "failure")
 					log.Warn().Str("phone", secure.MaskPhone(userPhone)).Str("mail", secure.MaskEmail(userMail)).Msg("OTP verification failed")
-					auditlog.LogLogin(ctx.Context(), userID, "warden_otp", ctx.IP(), false, "otp_verification_failed")
+					auditlog.LogLogin(ctx.Context(), userID, "warden_otp", GetClientIP(ctx), false, "otp_verification_failed")
+					recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, identifier, limitKeys...)
 					return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.otp_code_invalid"))
 				}
 				metrics.RecordAuthRequest("warden_otp", "success")
@@ -456,14 +472,24 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 		// Password authentication (default)
 		if password == "" {
 			metrics.RecordAuthRequest("password", "failure")
-			auditlog.LogLogin(ctx.Context(), "", "password", ctx.IP(), false, "empty_password")
+			auditlog.LogLogin(ctx.Context(), "", "password", GetClientIP(ctx), false, "empty_password")
 			return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.invalid_password"))
 		}
-		if !auth.CheckPassword(password) {
+		// A username selects a named user from USERS/USERS_FILE; without one the password is
+		// checked against the shared PASSWORDS
+		var valid bool
+		if username != "" {
+			valid = auth.CheckUserPassword(username, password)
+		} else {
+			valid = auth.CheckPassword(password)
+		}
+		if !valid {
 			metrics.RecordAuthRequest("password", "failure")
-			auditlog.LogLogin(ctx.Context(), "", "password", ctx.IP(), false, "invalid_password")
+			auditlog.LogLogin(ctx.Context(), "", "password", GetClientIP(ctx), false, "invalid_password")
+			recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, identifier, limitKeys...)
 			return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.invalid_password"))
 		}
+		userID = username
 		authenticated = true
 	}
 
@@ -471,6 +497,15 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 		return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.authentication_failed"))
 	}
 
+	// A successful Warden or named-user login clears the identifier's failures but not the IP's, so
+	// signing in to one account does not reset an IP that is guessing others. Shared-password logins
+	// only have the IP key.
+	if identifier != "" {
+		resetRateLimit(ctx, ratelimit.LoginIdentifierKey(identifier))
+	} else {
+		resetRateLimit(ctx, ratelimit.LoginIPKey(GetClientIP(ctx)))
+	}
+
 	sess, err := sessionGetter.Get(ctx)
 	if err != nil {
 		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
@@ -479,53 +514,21 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 	// Set user information to session for warden authentication before authenticating
 	if authMethod == "warden" {
 		// Reuse wardenUserInfo from earlier in the request to avoid repeated GetUserInfo
-		if wardenUserInfo != nil {
-			// Store complete user information in session
-			if wardenUserInfo.UserID != "" {
-				sess.Set("user_id", wardenUserInfo.UserID)
-			}
-			if wardenUserInfo.Phone != "" {
-				sess.Set("user_phone", wardenUserInfo.Phone)
-			}
-			if wardenUserInfo.Mail != "" {
-				sess.Set("user_mail", wardenUserInfo.Mail)
-			}
-			if wardenUserInfo.Status != "" {
-				sess.Set("user_status", wardenUserInfo.Status)
-			}
-			// Store scope and role for authorization headers
-			if len(wardenUserInfo.Scope) > 0 {
-				sess.Set("user_scope", wardenUserInfo.Scope)
-			}
-			if wardenUserInfo.Role != "" {
-				sess.Set("user_role", wardenUserInfo.Role)
-			}
-			if wardenUserInfo.Name != "" {
-				sess.Set("user_name", wardenUserInfo.Name)
-			}
-			log.Debug().
-				Str("user_id", wardenUserInfo.UserID).
-				Str("phone", secure.MaskPhone(wardenUserInfo.Phone)).
-				Str("mail", secure.MaskEmail(wardenUserInfo.Mail)).
-				Strs("scope", wardenUserInfo.Scope).
-				Str("role", wardenUserInfo.Role).
-				Msg("Stored user info in session")
-		} else {
-			// Fallback: store basic info if wardenUserInfo was not set (should not happen after successful warden auth)
-			if userPhone != "" {
-				sess.Set("user_phone", userPhone)
-			}
-			if userMail != "" {
-				sess.Set("user_mail", userMail)
-			}
-		}
+		setWardenSession(sess, wardenUserInfo, userPhone, userMail)
 
 		// Store AMR (Authentication Method Reference) from Herald response if available
 		if len(verifyRespAMR) > 0 {
 			sess.Set("user_amr", verifyRespAMR)
 		}
+	} else if userID != "" {
+		// Named users are identified by their username
+		sess.Set("user_id", userID)
 	}
 
+	if err := rotateSessionID(sess); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	indexSession(ctx, sess)
 	// Authenticate and save session (this will save all session data including user info)
 	err = authenticator.Authenticate(sess)
 	if err != nil {
@@ -541,23 +544,14 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 			loggedUserID = userID
 		}
 		metrics.RecordAuthRequest(authMethod, "success")
-		auditlog.LogLogin(ctx.Context(), loggedUserID, authMethod, ctx.IP(), true, "")
+		auditlog.LogLogin(ctx.Context(), loggedUserID, authMethod, GetClientIP(ctx), true, loginReason)
 	} else {
+		loggedUserID = userID
 		metrics.RecordAuthRequest("password", "success")
-		auditlog.LogLogin(ctx.Context(), "", "password", ctx.IP(), true, "")
+		auditlog.LogLogin(ctx.Context(), loggedUserID, "password", GetClientIP(ctx), true, "")
 	}
 	metrics.RecordSessionCreated()
-	auditlog.LogSessionCreate(ctx.Context(), loggedUserID, ctx.IP())
-
-	// Get callback parameter (priority: cookie, form data, query parameter)
-	callbackFromCookie := GetCallbackFromCookie(ctx)
-	callback := callbackFromCookie
-	if callback == "" {
-		callback = ctx.FormValue("callback")
-	}
-	if callback == "" {
-		callback = ctx.Query("callback")
-	}
+	auditlog.LogSessionCreate(ctx.Context(), loggedUserID, GetClientIP(ctx))
 
 	// If callback was retrieved from cookie, clear the cookie after successful login
 	if callbackFromCookie != "" {
@@ -565,16 +559,17 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 	}
 
 	// If no callback, try using origin host as callback
-	if callback == "" {
+	hasCallback := target.host != ""
+	if !hasCallback {
 		originHost := GetForwardedHost(ctx)
-		// Only use origin host as callback if it's different from auth service domain
-		if IsDifferentDomain(ctx) {
-			callback = originHost
+		// Only use origin host as callback if it's different from auth service domain and allowed
+		if originHost != "" && IsDifferentDomain(ctx) && isAllowedRedirectHost(originHost) {
+			target, hasCallback = callbackTarget{host: originHost}, true
 		}
 	}
 
 	// If callback exists, redirect to session exchange endpoint
-	if callback != "" {
+	if hasCallback {
 		// Get session ID (should already exist)
 		sessionID := sess.ID()
 		if sessionID == "" {
@@ -607,11 +602,13 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 				return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.missing_session_id"))
 			}
 		}
-		proto := GetForwardedProto(ctx)
-		if proto == "" {
-			proto = ctx.Protocol()
+		// Hand the callback host a one-time code rather than the session ID itself
+		code, err := codes.Mint(sessionID, target.host)
+		if err != nil {
+			tracing.RecordError(loginSpan, err)
+			return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
 		}
-		redirectURL := fmt.Sprintf("%s://%s/_session_exchange?id=%s", proto, callback, sessionID)
+		redirectURL := buildSessionExchangeURL(ctx, target, code)
 		// When client accepts JSON (e.g. fetch with Accept: application/json), return 200 + redirect URL
 		// so the client can navigate; with redirect: 'manual', 302 Location is opaque and unreadable.
 		if strings.Contains(ctx.Get("Accept"), "application/json") {
@@ -670,21 +667,30 @@ func loginAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator
 func LoginAPI(store *session.Store) func(c *fiber.Ctx) error {
 	sessionGetter := &SessionStoreAdapter{store: store}
 	authenticator := &AuthAuthenticator{}
+	codes := newStorageExchangeCodes(store.Storage)
 	return func(ctx *fiber.Ctx) error {
-		return loginAPIHandler(ctx, sessionGetter, authenticator)
+		return loginAPIHandler(ctx, sessionGetter, authenticator, codes)
 	}
 }
 
 // loginRouteHandler is the internal handler that can be tested with mocked dependencies.
-func loginRouteHandler(ctx *fiber.Ctx, sessionGetter SessionGetter) error {
+func loginRouteHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, codes ExchangeCodeStore) error {
 	// Get callback parameter (priority: URL query parameter, then cookie)
 	// URL parameter takes priority as it represents the explicit intent of the current request
 	callback := ctx.Query("callback")
-	if callback == "" {
-		callback = GetCallbackFromCookie(ctx)
-	} else {
+	if callback != "" {
+		// Refuse callbacks to hosts outside the allowlist instead of rendering a login form for them
+		if _, err := resolveCallback(ctx, callback); err != nil {
+			return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.callback_not_allowed"))
+		}
 		// If URL has callback parameter, update cookie (if domain is different)
 		SetCallbackCookie(ctx, callback)
+	} else if callback = GetCallbackFromCookie(ctx); callback != "" {
+		// A cookie set for another host (e.g. by a sibling subdomain) is dropped rather than trusted
+		if _, err := resolveCallback(ctx, callback); err != nil {
+			ClearCallbackCookie(ctx)
+			callback = ""
+		}
 	}
 
 	sess, err := sessionGetter.Get(ctx)
@@ -698,16 +704,19 @@ func loginRouteHandler(ctx *fiber.Ctx, sessionGetter SessionGetter) error {
 		if sessionID == "" {
 			return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.missing_session_id"))
 		}
+		// If callback exists, redirect to callback's _session_exchange endpoint
+		// If no callback, redirect to current host's root path
+		if target, ok := parseCallback(callback); ok {
+			code, err := codes.Mint(sessionID, target.host)
+			if err != nil {
+				return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+			}
+			return ctx.Redirect(buildSessionExchangeURL(ctx, target, code))
+		}
 		proto := GetForwardedProto(ctx)
 		if proto == "" {
 			proto = ctx.Protocol()
 		}
-		// If callback exists, redirect to callback's _session_exchange endpoint
-		// If no callback, redirect to current host's root path
-		if callback != "" {
-			redirectURL := fmt.Sprintf("%s://%s/_session_exchange?id=%s", proto, callback, sessionID)
-			return ctx.Redirect(redirectURL)
-		}
 		// When no callback, redirect to current host's root path
 		host := GetForwardedHost(ctx)
 		redirectURL := fmt.Sprintf("%s://%s/", proto, host)
@@ -721,19 +730,26 @@ func loginRouteHandler(ctx *fiber.Ctx, sessionGetter SessionGetter) error {
 	}
 
 	heraldEnabled := config.HeraldEnabled.ToBool()
-	otpEnabled := config.WardenOTPEnabled.ToBool() || config.HeraldTOTPEnabled.ToBool()
+	otpEnabled := config.WardenOTPEnabled.ToBool() || userTOTPEnabled()
 
 	return ctx.Render(templateName, fiber.Map{
 		"Callback":          callback,
-		"SessionID":         sess.ID(),
+		"Notice":            loginNotice(ctx),
 		"Title":             config.LoginPageTitle.Value,
 		"FooterText":        config.LoginPageFooterText.Value,
 		"WardenEnabled":     config.WardenEnabled.ToBool(),
 		"HeraldEnabled":     heraldEnabled,
 		"OTPEnabled":        otpEnabled,
-		"HeraldTOTPEnabled": config.HeraldTOTPEnabled.ToBool(),
+		"UserTOTPEnabled":   userTOTPEnabled(),
 		"LoginSMSEnabled":   config.LoginSMSEnabled.ToBool(),
 		"LoginEmailEnabled": config.LoginEmailEnabled.ToBool(),
+		"MagicLinkEnabled":  heraldEnabled && config.LoginMagicLinkEnabled.ToBool(),
+		"OIDCEnabled":       config.OIDCEnabled.ToBool(),
+		"OIDCProviderName":  config.OIDCProviderName.String(),
+		"OIDCLoginURL":      oidcLoginURL(callback),
+		"UsersEnabled":      users.Get() != nil,
+		"PasskeysEnabled":   webauthn.Get() != nil,
+		"QRLoginEnabled":    config.QRLoginEnabled.ToBool(),
 		"Debug":             config.Debug.ToBool(),
 	})
 }
@@ -748,10 +764,54 @@ func loginRouteHandler(ctx *fiber.Ctx, sessionGetter SessionGetter) error {
 // Returns a Fiber handler function.
 func LoginRoute(store *session.Store) func(c *fiber.Ctx) error {
 	sessionGetter := &SessionStoreAdapter{store: store}
+	codes := newStorageExchangeCodes(store.Storage)
 	return func(ctx *fiber.Ctx) error {
-		return loginRouteHandler(ctx, sessionGetter)
+		return loginRouteHandler(ctx, sessionGetter, codes)
 	}
 }
 
 // Note: SendVerifyCodeAPI and sendVerifyCodeHandler have been removed.
 // Verification code sending is now handled by the Herald service via the login flow.
+
+// setWardenSession stores the Warden user's profile in sess. phone and mail are kept as the
+// identity when info is nil, which should not happen after a successful Warden login.
+func setWardenSession(sess *session.Session, info *warden.AllowListUser, phone, mail string) {
+	if info == nil {
+		if phone != "" {
+			sess.Set("user_phone", phone)
+		}
+		if mail != "" {
+			sess.Set("user_mail", mail)
+		}
+		return
+	}
+	if info.UserID != "" {
+		sess.Set("user_id", info.UserID)
+	}
+	if info.Phone != "" {
+		sess.Set("user_phone", info.Phone)
+	}
+	if info.Mail != "" {
+		sess.Set("user_mail", info.Mail)
+	}
+	if info.Status != "" {
+		sess.Set("user_status", info.Status)
+	}
+	// Store scope and role for authorization headers
+	if len(info.Scope) > 0 {
+		sess.Set("user_scope", info.Scope)
+	}
+	if info.Role != "" {
+		sess.Set("user_role", info.Role)
+	}
+	if info.Name != "" {
+		sess.Set("user_name", info.Name)
+	}
+	log.Debug().
+		Str("user_id", info.UserID).
+		Str("phone", secure.MaskPhone(info.Phone)).
+		Str("mail", secure.MaskEmail(info.Mail)).
+		Strs("scope", info.Scope).
+		Str("role", info.Role).
+		Msg("Stored user info in session")
+}
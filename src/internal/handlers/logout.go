@@ -6,10 +6,15 @@ import (
 
 	"github.com/soulteary/stargate/src/internal/auditlog"
 	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
 	"github.com/soulteary/stargate/src/internal/i18n"
 	"github.com/soulteary/stargate/src/internal/metrics"
 )
 
+// LogoutRedirectParam is the query parameter carrying where to go after logout: a local path or
+// a URL on an allowed callback domain.
+const LogoutRedirectParam = "redirect"
+
 // SessionGetter defines an interface for getting sessions from a context.
 // This interface allows for easier testing by enabling mock implementations.
 type SessionGetter interface {
@@ -41,7 +46,8 @@ func (a *AuthUnauthenticator) Unauthenticate(sess *session.Session) error {
 }
 
 // logoutHandler is the internal handler that can be tested with mocked dependencies.
-func logoutHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, unauthenticator Unauthenticator) error {
+// A nil slo disables single logout.
+func logoutHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, unauthenticator Unauthenticator, slo *singleLogout) error {
 	sess, err := sessionGetter.Get(ctx)
 	if err != nil {
 		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
@@ -55,6 +61,19 @@ func logoutHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, unauthenticator
 		}
 	}
 
+	// Read before the session is destroyed
+	var exchanged []string
+	if slo != nil && config.SingleLogoutEnabled.ToBool() {
+		sessionID := sess.ID()
+		if exchanged, err = slo.origins.List(sessionID); err != nil {
+			log.Warn().Err(err).Msg("Failed to read exchanged session origins")
+		}
+		if err := slo.origins.Delete(sessionID); err != nil {
+			log.Warn().Err(err).Msg("Failed to delete exchanged session origins")
+		}
+	}
+
+	unindexSession(sess)
 	err = unauthenticator.Unauthenticate(sess)
 	if err != nil {
 		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.authenticate_failed"))
@@ -62,14 +81,35 @@ func logoutHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, unauthenticator
 
 	// Log logout and session destruction
 	metrics.RecordSessionDestroyed()
-	auditlog.LogLogout(ctx.Context(), userID, ctx.IP())
-	auditlog.LogSessionDestroy(ctx.Context(), userID, ctx.IP())
+	auditlog.LogLogout(ctx.Context(), userID, GetClientIP(ctx))
+	auditlog.LogSessionDestroy(ctx.Context(), userID, GetClientIP(ctx))
 
+	ClearCallbackCookie(ctx)
+	redirect := SanitizeReturnURL(ctx.Query(LogoutRedirectParam), "")
+	if len(exchanged) > 0 && IsHTMLRequest(ctx) {
+		// The chain ends on another domain, so a local redirect is made absolute first. The session
+		// is already destroyed, so a failed chain only leaves stale cookies behind.
+		final := redirect
+		if isLocalPath(final) {
+			final = requestOrigin(ctx) + final
+		}
+		if next, err := slo.chain(exchanged, final); err != nil {
+			log.Warn().Err(err).Msg("Failed to start single logout")
+		} else {
+			redirect = next
+		}
+	}
+	if redirect != "" {
+		return ctx.Redirect(redirect, fiber.StatusFound)
+	}
 	return ctx.SendString("Logged out")
 }
 
 // LogoutRoute handles GET requests to /_logout for user logout.
-// It destroys the user's session and returns a confirmation message.
+// It destroys the user's session and clears the callback cookie, then redirects to the validated
+// redirect query parameter or returns a confirmation message. With SINGLE_LOGOUT_ENABLED, browsers
+// are first sent through every domain the session was exchanged to, each clearing its session
+// cookie before redirecting to the next.
 //
 // Parameters:
 //   - store: Session store for managing user sessions
@@ -78,7 +118,8 @@ func logoutHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, unauthenticator
 func LogoutRoute(store *session.Store) func(c *fiber.Ctx) error {
 	sessionGetter := &SessionStoreAdapter{store: store}
 	unauthenticator := &AuthUnauthenticator{}
+	slo := newSingleLogout(store.Storage)
 	return func(ctx *fiber.Ctx) error {
-		return logoutHandler(ctx, sessionGetter, unauthenticator)
+		return logoutHandler(ctx, sessionGetter, unauthenticator, slo)
 	}
 }
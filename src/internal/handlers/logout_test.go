@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+)
+
+// setupLogoutTest serves /_logout and /_session_exchange, plus /test_login signing in user-1 and
+// /test_whoami answering 200 only for signed-in sessions.
+func setupLogoutTest(t *testing.T, singleLogout bool) (*fiber.App, fiber.Storage) {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("CALLBACK_ALLOWED_DOMAINS", "app.example.com,shop.example.org")
+	if singleLogout {
+		t.Setenv("SINGLE_LOGOUT_ENABLED", "true")
+	}
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+
+	store := setupTestStore()
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("i18n-bundle", i18n.GetBundle())
+		c.Locals("i18n-language", i18n.LangEN)
+		return c.Next()
+	})
+	app.Get("/_logout", LogoutRoute(store))
+	app.Get(SessionExchangePath, SessionShareRoute(store))
+	app.Get("/test_login", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("user_id", "user-1")
+		return auth.Authenticate(sess)
+	})
+	app.Get("/test_whoami", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		if !auth.IsAuthenticated(sess) {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		return c.SendStatus(fiber.StatusOK)
+	})
+	return app, store.Storage
+}
+
+// logoutTestRequest sends a browser GET to target on host.
+func logoutTestRequest(t *testing.T, app *fiber.App, host, target string, cookie *http.Cookie) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("X-Forwarded-Host", host)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	return resp
+}
+
+// exchangeTestSession installs the session of cookie on host through /_session_exchange.
+func exchangeTestSession(t *testing.T, app *fiber.App, storage fiber.Storage, cookie *http.Cookie, host string) {
+	t.Helper()
+	code, err := newStorageExchangeCodes(storage).Mint(cookie.Value, host)
+	testza.AssertNoError(t, err)
+	resp := logoutTestRequest(t, app, host, SessionExchangePath+"?"+ExchangeCodeParam+"="+url.QueryEscape(code), nil)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	testza.AssertEqual(t, cookie.Value, sessionCookie(resp).Value)
+}
+
+func responseCookie(resp *http.Response, name string) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestLogout_Redirect(t *testing.T) {
+	app, _ := setupLogoutTest(t, false)
+	cookie := sessionCookie(logoutTestRequest(t, app, "auth.example.com", "/test_login", nil))
+	testza.AssertNotNil(t, cookie)
+
+	resp := logoutTestRequest(t, app, "auth.example.com", "/_logout?redirect="+url.QueryEscape("https://app.example.com/bye"), cookie)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	testza.AssertEqual(t, "https://app.example.com/bye", resp.Header.Get("Location"))
+	callback := responseCookie(resp, CallbackCookieName)
+	testza.AssertNotNil(t, callback)
+	testza.AssertEqual(t, "", callback.Value)
+
+	// Redirects outside the allowed callback domains are ignored
+	for _, redirect := range []string{"https://evil.com/", "//evil.com/", "javascript:alert(1)"} {
+		resp = logoutTestRequest(t, app, "auth.example.com", "/_logout?redirect="+url.QueryEscape(redirect), nil)
+		testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode, redirect)
+		testza.AssertEqual(t, "", resp.Header.Get("Location"), redirect)
+	}
+
+	resp = logoutTestRequest(t, app, "auth.example.com", "/_logout?redirect=%2Fsigned-out", nil)
+	testza.AssertEqual(t, "/signed-out", resp.Header.Get("Location"))
+}
+
+// followLogoutHop requests location, a hop of the single logout chain, on its host.
+func followLogoutHop(t *testing.T, app *fiber.App, location string) *http.Response {
+	t.Helper()
+	u, err := url.Parse(location)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "https", u.Scheme)
+	testza.AssertEqual(t, SessionExchangePath, u.Path)
+	return logoutTestRequest(t, app, u.Host, u.RequestURI(), nil)
+}
+
+// assertSessionCookieCleared checks that resp expires the session cookie.
+func assertSessionCookieCleared(t *testing.T, resp *http.Response) {
+	t.Helper()
+	cleared := responseCookie(resp, auth.SessionCookieName)
+	testza.AssertNotNil(t, cleared)
+	testza.AssertEqual(t, "", cleared.Value)
+}
+
+func TestLogout_SingleLogoutChain(t *testing.T) {
+	app, storage := setupLogoutTest(t, true)
+	cookie := sessionCookie(logoutTestRequest(t, app, "auth.example.com", "/test_login", nil))
+	exchangeTestSession(t, app, storage, cookie, "app.example.com")
+	exchangeTestSession(t, app, storage, cookie, "shop.example.org")
+	// Exchanging again does not add a domain twice
+	exchangeTestSession(t, app, storage, cookie, "shop.example.org")
+
+	resp := logoutTestRequest(t, app, "auth.example.com", "/_logout?redirect="+url.QueryEscape("https://app.example.com/bye"), cookie)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	first := resp.Header.Get("Location")
+	testza.AssertTrue(t, strings.HasPrefix(first, "https://app.example.com"+SessionExchangePath+"?"+ExchangeLogoutParam+"="), first)
+
+	// Each domain clears its cookie and sends the browser on to the next one
+	resp = followLogoutHop(t, app, first)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	assertSessionCookieCleared(t, resp)
+	second := resp.Header.Get("Location")
+	testza.AssertTrue(t, strings.HasPrefix(second, "https://shop.example.org"+SessionExchangePath+"?"+ExchangeLogoutParam+"="), second)
+
+	resp = followLogoutHop(t, app, second)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	assertSessionCookieCleared(t, resp)
+	testza.AssertEqual(t, "https://app.example.com/bye", resp.Header.Get("Location"))
+
+	// Logout tokens are single use
+	testza.AssertEqual(t, fiber.StatusBadRequest, followLogoutHop(t, app, first).StatusCode)
+
+	// The session is gone on every domain
+	testza.AssertEqual(t, fiber.StatusUnauthorized, logoutTestRequest(t, app, "shop.example.org", "/test_whoami", cookie).StatusCode)
+}
+
+func TestLogout_SingleLogoutChain_LocalRedirect(t *testing.T) {
+	app, storage := setupLogoutTest(t, true)
+	cookie := sessionCookie(logoutTestRequest(t, app, "auth.example.com", "/test_login", nil))
+	exchangeTestSession(t, app, storage, cookie, "shop.example.org")
+
+	resp := logoutTestRequest(t, app, "auth.example.com", "/_logout?redirect=%2Fsigned-out", cookie)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+
+	// The chain ends on another domain, so the local redirect returns to the auth host
+	resp = followLogoutHop(t, app, resp.Header.Get("Location"))
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	testza.AssertEqual(t, "https://auth.example.com/signed-out", resp.Header.Get("Location"))
+}
+
+func TestLogout_SingleLogoutWithoutExchangedDomains(t *testing.T) {
+	app, _ := setupLogoutTest(t, true)
+	cookie := sessionCookie(logoutTestRequest(t, app, "auth.example.com", "/test_login", nil))
+
+	resp := logoutTestRequest(t, app, "auth.example.com", "/_logout?redirect=%2Fsigned-out", cookie)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	testza.AssertEqual(t, "/signed-out", resp.Header.Get("Location"))
+}
+
+func TestLogout_SingleLogoutDisabled(t *testing.T) {
+	app, storage := setupLogoutTest(t, false)
+	cookie := sessionCookie(logoutTestRequest(t, app, "auth.example.com", "/test_login", nil))
+	exchangeTestSession(t, app, storage, cookie, "app.example.com")
+
+	resp := logoutTestRequest(t, app, "auth.example.com", "/_logout?redirect=%2Fsigned-out", cookie)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	testza.AssertEqual(t, "/signed-out", resp.Header.Get("Location"))
+}
+
+func TestSessionShareRoute_Logout(t *testing.T) {
+	app, storage := setupLogoutTest(t, true)
+	tokens := newLogoutTokens(storage)
+
+	token, err := tokens.Mint("shop.example.org", "")
+	testza.AssertNoError(t, err)
+	resp := logoutTestRequest(t, app, "shop.example.org", SessionExchangePath+"?"+ExchangeLogoutParam+"="+token, nil)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	testza.AssertEqual(t, "no-store", resp.Header.Get("Cache-Control"))
+	assertSessionCookieCleared(t, resp)
+}
+
+func TestSessionShareRoute_LogoutRequiresToken(t *testing.T) {
+	app, storage := setupLogoutTest(t, true)
+	tokens := newLogoutTokens(storage)
+	otherHost, err := tokens.Mint("app.example.com", "")
+	testza.AssertNoError(t, err)
+
+	// A link from another site cannot sign the user out: unknown tokens and tokens minted for
+	// another domain are rejected without touching the cookie
+	for _, token := range []string{"1", "forged", otherHost} {
+		resp := logoutTestRequest(t, app, "shop.example.org", SessionExchangePath+"?"+ExchangeLogoutParam+"="+url.QueryEscape(token), nil)
+		testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode, token)
+		testza.AssertNil(t, responseCookie(resp, auth.SessionCookieName), token)
+	}
+}
+
+func TestExchangedOrigins(t *testing.T) {
+	store := setupTestStore()
+	origins := newExchangedOrigins(store.Storage)
+
+	list, err := origins.List("session-1")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 0)
+
+	testza.AssertNoError(t, origins.Add("session-1", "https://app.example.com"))
+	testza.AssertNoError(t, origins.Add("session-1", "https://shop.example.org"))
+	testza.AssertNoError(t, origins.Add("session-1", "https://app.example.com"))
+	list, err = origins.List("session-1")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, []string{"https://app.example.com", "https://shop.example.org"}, list)
+
+	// Lists are per session
+	list, err = origins.List("session-2")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 0)
+
+	for i := 0; i < maxExchangedOrigins+5; i++ {
+		testza.AssertNoError(t, origins.Add("session-2", fmt.Sprintf("https://app%d.example.com", i)))
+	}
+	list, err = origins.List("session-2")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, maxExchangedOrigins)
+
+	testza.AssertNoError(t, origins.Delete("session-1"))
+	list, err = origins.List("session-1")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 0)
+}
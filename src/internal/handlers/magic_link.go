@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/soulteary/herald/pkg/herald"
+
+	"github.com/soulteary/stargate/src/internal/auditlog"
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/metrics"
+	"github.com/soulteary/stargate/src/internal/ratelimit"
+)
+
+const (
+	// MagicLinkPath is the endpoint sign-in links point to; magicLinkURL builds them.
+	MagicLinkPath = "/_login/magic"
+	// MagicLinkCookieName holds the nonce that binds a sign-in link to the browser that asked for it.
+	MagicLinkCookieName = "stargate_magic_link"
+
+	// magicLinkMode is the /_send_verify_code mode field value that sends a link instead of a code.
+	magicLinkMode = "magic_link"
+	// magicLinkPurpose is the Herald challenge purpose of sign-in links.
+	magicLinkPurpose = "magic_link"
+	// authMethodMagicLink is the auth method reported in metrics and the audit log.
+	authMethodMagicLink = "magic_link"
+	// magicLinkKeyPrefix namespaces pending magic links in the session storage.
+	magicLinkKeyPrefix = "magic_link:"
+	// magicLinkDefaultTTL is used when Herald does not report how long the challenge is valid.
+	magicLinkDefaultTTL = 10 * time.Minute
+)
+
+// magicLinkRecord is a sign-in link that was sent but not used yet. The link's challenge is bound
+// to the nonce of the requesting browser and to the callback validated when it was sent.
+type magicLinkRecord struct {
+	ChallengeID string `json:"challenge_id"`
+	UserID      string `json:"user_id"`
+	Phone       string `json:"phone,omitempty"`
+	Mail        string `json:"mail,omitempty"`
+	Callback    string `json:"callback,omitempty"`
+	// NonceHash is the SHA-256 of the nonce; the nonce itself only lives in the browser cookie.
+	NonceHash string `json:"nonce_hash"`
+}
+
+// MagicLinkStore keeps sent sign-in links until they are used, keyed by their challenge ID.
+type MagicLinkStore interface {
+	// Start stores record for ttl and returns the nonce for the browser cookie.
+	Start(record magicLinkRecord, ttl time.Duration) (string, error)
+	// Take removes and returns the record of challengeID when nonce is the one Start returned for
+	// it. It returns nil, leaving the record in place, for an unknown challenge or another nonce.
+	Take(challengeID, nonce string) (*magicLinkRecord, error)
+}
+
+// magicLinkURL builds the sign-in link of a challenge on AUTH_HOST. Herald renders the message, so
+// its template for the magic_link purpose must produce this exact URL; in debug mode the link is
+// returned by /_send_verify_code to check the template against.
+func magicLinkURL(ctx *fiber.Ctx, challengeID, code string) string {
+	query := url.Values{"challenge_id": {challengeID}, "code": {code}}
+	return fmt.Sprintf("%s://%s%s?%s", GetForwardedProto(ctx), config.AuthHost.String(), MagicLinkPath, query.Encode())
+}
+
+// hashMagicLinkNonce returns the digest of nonce kept in the pending link.
+func hashMagicLinkNonce(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// storageMagicLinks keeps pending magic links in the session storage (memory or Redis), so that
+// the link works on any Stargate instance sharing sessions.
+type storageMagicLinks struct {
+	storage fiber.Storage
+}
+
+// newStorageMagicLinks creates a MagicLinkStore backed by storage.
+func newStorageMagicLinks(storage fiber.Storage) *storageMagicLinks {
+	return &storageMagicLinks{storage: storage}
+}
+
+// Start implements MagicLinkStore.
+func (s *storageMagicLinks) Start(record magicLinkRecord, ttl time.Duration) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(buf)
+	record.NonceHash = hashMagicLinkNonce(nonce)
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	if err := s.storage.Set(magicLinkKeyPrefix+record.ChallengeID, value, ttl); err != nil {
+		return "", err
+	}
+	return nonce, nil
+}
+
+// Take implements MagicLinkStore. The record is deleted before it is returned, so every link can
+// be tried once by the browser it was sent to.
+func (s *storageMagicLinks) Take(challengeID, nonce string) (*magicLinkRecord, error) {
+	if challengeID == "" || nonce == "" {
+		return nil, nil
+	}
+	key := magicLinkKeyPrefix + challengeID
+	value, err := s.storage.Get(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	var record magicLinkRecord
+	if err := json.Unmarshal(value, &record); err != nil || record.ChallengeID != challengeID {
+		return nil, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(record.NonceHash), []byte(hashMagicLinkNonce(nonce))) != 1 {
+		return nil, nil
+	}
+	if err := s.storage.Delete(key); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// setMagicLinkCookie binds a sent link to this browser. The cookie is only sent to MagicLinkPath
+// and uses SameSite=Lax, so it comes along when the link is opened from a mail client.
+func setMagicLinkCookie(ctx *fiber.Ctx, nonce string, ttl time.Duration) {
+	ctx.Cookie(&fiber.Cookie{
+		Name:     MagicLinkCookieName,
+		Value:    nonce,
+		Path:     MagicLinkPath,
+		Expires:  time.Now().Add(ttl),
+		SameSite: fiber.CookieSameSiteLaxMode,
+		HTTPOnly: true,
+		Secure:   GetForwardedProto(ctx) == "https",
+	})
+}
+
+// clearMagicLinkCookie removes the magic link cookie.
+func clearMagicLinkCookie(ctx *fiber.Ctx) {
+	ctx.Cookie(&fiber.Cookie{
+		Name:     MagicLinkCookieName,
+		Value:    "",
+		Path:     MagicLinkPath,
+		Expires:  time.Now().Add(-1 * time.Hour),
+		SameSite: fiber.CookieSameSiteLaxMode,
+		HTTPOnly: true,
+		Secure:   GetForwardedProto(ctx) == "https",
+	})
+}
+
+// magicLinkHandler signs the user in with a link sent by /_send_verify_code in magic-link mode.
+// The link is only accepted in the browser holding the nonce cookie set when it was sent, and its
+// code is verified (and consumed) by Herald like a typed verification code. Opened elsewhere, the
+// link is refused but stays valid for the browser that asked for it.
+func magicLinkHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator Authenticator, codes ExchangeCodeStore, links MagicLinkStore) error {
+	if !config.LoginMagicLinkEnabled.ToBool() || !config.HeraldEnabled.ToBool() {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.magic_link_disabled"))
+	}
+
+	var userID string
+	fail := func(status int, message, reason string) error {
+		metrics.RecordAuthRequest(authMethodMagicLink, "failure")
+		auditlog.LogLogin(ctx.Context(), userID, authMethodMagicLink, GetClientIP(ctx), false, reason)
+		return SendErrorResponse(ctx, status, message)
+	}
+
+	challengeID := ctx.Query("challenge_id")
+	code := ctx.Query("code")
+	if challengeID == "" || code == "" {
+		return fail(fiber.StatusBadRequest, i18n.T(ctx, "error.magic_link_invalid"), "malformed_link")
+	}
+	nonce := ctx.Cookies(MagicLinkCookieName)
+	if nonce == "" {
+		return fail(fiber.StatusBadRequest, i18n.T(ctx, "error.magic_link_other_browser"), "missing_nonce")
+	}
+	record, err := links.Take(challengeID, nonce)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	if record == nil {
+		return fail(fiber.StatusBadRequest, i18n.T(ctx, "error.magic_link_invalid"), "unknown_link")
+	}
+	// The link is used up: whatever happens next, it cannot be tried again
+	clearMagicLinkCookie(ctx)
+	userID = record.UserID
+
+	identifier := rateLimitIdentifier(record.Phone, record.Mail)
+	limitKeys := ratelimit.LoginKeys(GetClientIP(ctx), identifier)
+	if retryAfter := rateLimitRetryAfter(ctx, ratelimit.ScopeLogin, identifier, limitKeys...); retryAfter > 0 {
+		metrics.RecordAuthRequest(authMethodMagicLink, "rate_limited")
+		setRetryAfter(ctx, retryAfter)
+		return SendErrorResponse(ctx, fiber.StatusTooManyRequests, i18n.T(ctx, "error.rate_limited_retry"))
+	}
+
+	heraldClient := getHeraldClient()
+	if heraldClient == nil {
+		return SendErrorResponse(ctx, fiber.StatusServiceUnavailable, i18n.T(ctx, "error.herald_unavailable_retry"))
+	}
+	startTime := time.Now()
+	verifyResp, err := heraldClient.VerifyChallenge(ctx.UserContext(), &herald.VerifyChallengeRequest{
+		ChallengeID: challengeID,
+		Code:        code,
+		ClientIP:    GetClientIP(ctx),
+	})
+	duration := time.Since(startTime)
+	if err == nil && verifyResp != nil && verifyResp.OK {
+		metrics.RecordHeraldCall("verify_challenge", "success", duration)
+	} else {
+		metrics.RecordHeraldCall("verify_challenge", "failure", duration)
+		if heraldErr, ok := err.(*herald.HeraldError); ok && (heraldErr.StatusCode == 0 || heraldErr.Reason == "connection_failed") {
+			log.Error().Err(err).Msg("Failed to verify magic link challenge")
+			return SendErrorResponse(ctx, fiber.StatusServiceUnavailable, i18n.T(ctx, "error.herald_unavailable_retry"))
+		}
+		reason := "invalid"
+		if verifyResp != nil && verifyResp.Reason != "" {
+			reason = verifyResp.Reason
+		}
+		auditlog.LogVerifyCodeCheck(ctx.Context(), userID, GetClientIP(ctx), false, reason)
+		recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, identifier, limitKeys...)
+		return fail(fiber.StatusUnauthorized, verifyCodeErrorMessage(ctx, reason, verifyResp), reason)
+	}
+	auditlog.LogVerifyCodeCheck(ctx.Context(), userID, GetClientIP(ctx), true, "")
+	if verifyResp.UserID != record.UserID {
+		log.Warn().Str("expected", record.UserID).Str("got", verifyResp.UserID).Msg("User ID mismatch")
+		recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, identifier, limitKeys...)
+		return fail(fiber.StatusUnauthorized, i18n.T(ctx, "error.verify_failed"), "user_mismatch")
+	}
+
+	// Load the profile again so that role and scope reflect Warden at sign-in, not at send time
+	userInfo := auth.GetUserInfo(ctx.UserContext(), record.Phone, record.Mail)
+	if userInfo == nil {
+		return fail(fiber.StatusUnauthorized, i18n.T(ctx, "error.user_not_in_list"), "user_not_in_list")
+	}
+	if userInfo.UserID != "" {
+		userID = userInfo.UserID
+	}
+	resetRateLimit(ctx, ratelimit.LoginIdentifierKey(identifier))
+
+	sess, err := sessionGetter.Get(ctx)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	setWardenSession(sess, userInfo, record.Phone, record.Mail)
+	if len(verifyResp.AMR) > 0 {
+		sess.Set(amrSessionKey, verifyResp.AMR)
+	}
+	if err := rotateSessionID(sess); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	indexSession(ctx, sess)
+	// Saving releases the session, so keep its ID for the exchange code
+	sessionID := sess.ID()
+	if err := authenticator.Authenticate(sess); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.authenticate_failed"))
+	}
+
+	metrics.RecordAuthRequest(authMethodMagicLink, "success")
+	auditlog.LogLogin(ctx.Context(), userID, authMethodMagicLink, GetClientIP(ctx), true, "")
+	metrics.RecordSessionCreated()
+	auditlog.LogSessionCreate(ctx.Context(), userID, GetClientIP(ctx))
+
+	if GetCallbackFromCookie(ctx) != "" {
+		ClearCallbackCookie(ctx)
+	}
+
+	// The callback was validated when the link was sent; check again in case the allowlist changed
+	target, err := resolveCallback(ctx, record.Callback)
+	if err != nil || target.host == "" {
+		return ctx.Redirect("/")
+	}
+	exchangeCode, err := codes.Mint(sessionID, target.host)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	return ctx.Redirect(buildSessionExchangeURL(ctx, target, exchangeCode))
+}
+
+// MagicLinkRoute handles GET requests to /_login/magic, the target of sign-in links.
+func MagicLinkRoute(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	authenticator := &AuthAuthenticator{}
+	codes := newStorageExchangeCodes(store.Storage)
+	links := newStorageMagicLinks(store.Storage)
+	return func(ctx *fiber.Ctx) error {
+		return magicLinkHandler(ctx, sessionGetter, authenticator, codes, links)
+	}
+}
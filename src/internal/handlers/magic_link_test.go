@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/herald/pkg/herald"
+
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+)
+
+// magicLinkHerald is a Herald mock issuing challenge "challenge-1" with code "secret" for user-1.
+// Codes are single-use, like in Herald.
+type magicLinkHerald struct {
+	mu       sync.Mutex
+	purposes []string
+	verifies int
+	used     bool
+}
+
+func (h *magicLinkHerald) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/v1/otp/challenges":
+		var req herald.CreateChallengeRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		h.purposes = append(h.purposes, req.Purpose)
+		h.used = false
+		_ = json.NewEncoder(w).Encode(herald.CreateChallengeResponse{ChallengeID: "challenge-1", ExpiresIn: 300, DebugCode: "secret"})
+	case "/v1/otp/verifications":
+		var req herald.VerifyChallengeRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		h.verifies++
+		if h.used || req.ChallengeID != "challenge-1" || req.Code != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(herald.VerifyChallengeResponse{Reason: "invalid"})
+			return
+		}
+		h.used = true
+		_ = json.NewEncoder(w).Encode(herald.VerifyChallengeResponse{OK: true, UserID: "user-1", AMR: []string{"otp"}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func setupMagicLinkTest(t *testing.T, enabled string) (*magicLinkHerald, *fiber.App) {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("HERALD_ENABLED", "true")
+	t.Setenv("HERALD_API_KEY", "api-key")
+	t.Setenv("WARDEN_ENABLED", "true")
+	t.Setenv("LOGIN_MAGIC_LINK_ENABLED", enabled)
+
+	wardenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"user_id": "user-1",
+			"mail":    "alice@example.com",
+			"status":  "active",
+			"role":    "admin",
+			"scope":   []string{"read"},
+		})
+	}))
+	t.Cleanup(wardenServer.Close)
+	mock := &magicLinkHerald{}
+	heraldServer := httptest.NewServer(mock)
+	t.Cleanup(heraldServer.Close)
+
+	t.Setenv("WARDEN_URL", wardenServer.URL)
+	t.Setenv("HERALD_URL", heraldServer.URL)
+	auth.ResetWardenClientForTesting()
+	resetHeraldClientForTesting()
+	t.Cleanup(resetHeraldClientForTesting)
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+	auth.InitWardenClient(testLogger())
+	InitHeraldClient(testLogger())
+	InitForwardAuthHandler(testLogger())
+
+	store := setupTestStore()
+	sessionGetter := &SessionStoreAdapter{store: store}
+	codes := newStorageExchangeCodes(store.Storage)
+	links := newStorageMagicLinks(store.Storage)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("i18n-bundle", i18n.GetBundle())
+		c.Locals("i18n-language", i18n.LangEN)
+		return c.Next()
+	})
+	app.Post("/_send_verify_code", SendVerifyCodeAPI(store))
+	app.Get(MagicLinkPath, func(c *fiber.Ctx) error {
+		return magicLinkHandler(c, sessionGetter, &AuthAuthenticator{}, codes, links)
+	})
+	app.Get("/whoami", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(fiber.Map{
+			"authenticated": auth.IsAuthenticated(sess),
+			"user_id":       sess.Get("user_id"),
+			"user_mail":     sess.Get("user_mail"),
+			"user_role":     sess.Get("user_role"),
+			"user_amr":      sess.Get(amrSessionKey),
+		})
+	})
+	return mock, app
+}
+
+// requestMagicLink asks for a sign-in link and returns the nonce cookie bound to the browser.
+func requestMagicLink(t *testing.T, app *fiber.App, form url.Values) (*http.Response, *http.Cookie) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/_send_verify_code", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	for _, c := range resp.Cookies() {
+		if c.Name == MagicLinkCookieName {
+			return resp, c
+		}
+	}
+	return resp, nil
+}
+
+// openMagicLink opens a sign-in link with the given cookies.
+func openMagicLink(t *testing.T, app *fiber.App, query string, cookies ...*http.Cookie) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, MagicLinkPath+query, nil)
+	req.Header.Set("Accept", "text/html")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	return resp
+}
+
+func TestMagicLink_SignsInRequestingBrowser(t *testing.T) {
+	mock, app := setupMagicLinkTest(t, "true")
+
+	resp, nonce := requestMagicLink(t, app, url.Values{
+		"mode":     {"magic_link"},
+		"mail":     {"alice@example.com"},
+		"callback": {"https://app.example.com/dashboard"},
+	})
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	testza.AssertNotNil(t, nonce)
+	testza.AssertEqual(t, MagicLinkPath, nonce.Path)
+	testza.AssertTrue(t, nonce.HttpOnly)
+	testza.AssertEqual(t, []string{"magic_link"}, mock.purposes)
+
+	resp = openMagicLink(t, app, "?challenge_id=challenge-1&code=secret", nonce)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	exchange, err := url.Parse(resp.Header.Get("Location"))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "app.example.com", exchange.Host)
+	testza.AssertEqual(t, "/_session_exchange", exchange.Path)
+	testza.AssertNotEqual(t, "", exchange.Query().Get("code"))
+
+	session := whoami(t, app, sessionCookie(resp))
+	testza.AssertEqual(t, true, session["authenticated"])
+	testza.AssertEqual(t, "user-1", session["user_id"])
+	testza.AssertEqual(t, "alice@example.com", session["user_mail"])
+	testza.AssertEqual(t, "admin", session["user_role"])
+	testza.AssertEqual(t, []interface{}{"otp"}, session["user_amr"])
+
+	// The link is single-use
+	resp = openMagicLink(t, app, "?challenge_id=challenge-1&code=secret", nonce)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+	testza.AssertEqual(t, 1, mock.verifies)
+}
+
+func TestMagicLink_DifferentBrowser(t *testing.T) {
+	mock, app := setupMagicLinkTest(t, "true")
+	_, nonce := requestMagicLink(t, app, url.Values{
+		"mode":     {"magic_link"},
+		"mail":     {"alice@example.com"},
+		"callback": {"https://app.example.com/dashboard"},
+	})
+	testza.AssertNotNil(t, nonce)
+
+	// Clicked in another browser, which has no nonce cookie: refused before Herald sees the code
+	resp := openMagicLink(t, app, "?challenge_id=challenge-1&code=secret")
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+	testza.AssertNil(t, sessionCookie(resp))
+	message, err := io.ReadAll(resp.Body)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, i18n.TWithLang(i18n.LangEN, "error.magic_link_other_browser"), string(message))
+	testza.AssertEqual(t, 0, mock.verifies)
+
+	// A nonce of another browser does not unlock the link either
+	resp = openMagicLink(t, app, "?challenge_id=challenge-1&code=secret", &http.Cookie{Name: MagicLinkCookieName, Value: "forged"})
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+	testza.AssertEqual(t, 0, mock.verifies)
+
+	// The link still works in the browser that asked for it
+	resp = openMagicLink(t, app, "?challenge_id=challenge-1&code=secret", nonce)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	exchange, err := url.Parse(resp.Header.Get("Location"))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "app.example.com", exchange.Host)
+	testza.AssertEqual(t, 1, mock.verifies)
+}
+
+func TestMagicLink_NonceUnlocksItsChallengeOnly(t *testing.T) {
+	mock, app := setupMagicLinkTest(t, "true")
+	_, nonce := requestMagicLink(t, app, url.Values{"mode": {"magic_link"}, "mail": {"alice@example.com"}})
+	testza.AssertNotNil(t, nonce)
+
+	resp := openMagicLink(t, app, "?challenge_id=challenge-2&code=secret", nonce)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+	resp = openMagicLink(t, app, "?challenge_id=challenge-1", nonce)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+	testza.AssertEqual(t, 0, mock.verifies)
+}
+
+func TestSendVerifyCodeAPI_MagicLinkDebugLink(t *testing.T) {
+	t.Setenv("DEBUG", "true")
+	_, app := setupMagicLinkTest(t, "true")
+
+	resp, nonce := requestMagicLink(t, app, url.Values{"mode": {"magic_link"}, "mail": {"alice@example.com"}})
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	var body map[string]interface{}
+	testza.AssertNoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	testza.AssertEqual(t, "http://auth.example.com/_login/magic?challenge_id=challenge-1&code=secret", body["debug_link"])
+
+	// The link Stargate builds is the one it accepts
+	link, err := url.Parse(body["debug_link"].(string))
+	testza.AssertNoError(t, err)
+	resp = openMagicLink(t, app, "?"+link.RawQuery, nonce)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+}
+
+func TestMagicLink_WrongCode(t *testing.T) {
+	mock, app := setupMagicLinkTest(t, "true")
+	_, nonce := requestMagicLink(t, app, url.Values{"mode": {"magic_link"}, "mail": {"alice@example.com"}})
+
+	resp := openMagicLink(t, app, "?challenge_id=challenge-1&code=guess", nonce)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	testza.AssertEqual(t, 1, mock.verifies)
+	if cookie := sessionCookie(resp); cookie != nil {
+		testza.AssertEqual(t, false, whoami(t, app, cookie)["authenticated"])
+	}
+}
+
+func TestMagicLink_Disabled(t *testing.T) {
+	mock, app := setupMagicLinkTest(t, "false")
+
+	resp, nonce := requestMagicLink(t, app, url.Values{"mode": {"magic_link"}, "mail": {"alice@example.com"}})
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+	testza.AssertNil(t, nonce)
+	var body map[string]interface{}
+	testza.AssertNoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	testza.AssertEqual(t, "magic_link_disabled", body["reason"])
+	testza.AssertLen(t, mock.purposes, 0)
+
+	resp = openMagicLink(t, app, "?challenge_id=challenge-1&code=secret")
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+}
+
+func TestSendVerifyCodeAPI_MagicLinkRejectsForeignCallback(t *testing.T) {
+	mock, app := setupMagicLinkTest(t, "true")
+
+	resp, nonce := requestMagicLink(t, app, url.Values{
+		"mode":     {"magic_link"},
+		"mail":     {"alice@example.com"},
+		"callback": {"https://evil.example.net/"},
+	})
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+	testza.AssertNil(t, nonce)
+	testza.AssertLen(t, mock.purposes, 0)
+}
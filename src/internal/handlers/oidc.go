@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+
+	"github.com/soulteary/stargate/src/internal/auditlog"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/metrics"
+	"github.com/soulteary/stargate/src/internal/oidc"
+)
+
+const (
+	// OIDCLoginPath starts a login with the upstream OpenID Connect provider.
+	OIDCLoginPath = "/_oidc/login"
+	// OIDCCallbackPath receives the authorization response from the provider.
+	OIDCCallbackPath = "/_oidc/callback"
+
+	// oidcLoginTTL bounds the time between starting a login and the provider callback.
+	oidcLoginTTL = 10 * time.Minute
+	// authMethodOIDC is the auth_method value and audit method for OIDC logins.
+	authMethodOIDC = "oidc"
+)
+
+// Session keys holding a pending OIDC login until the provider redirects back.
+const (
+	oidcStateSessionKey       = "oidc_state"
+	oidcNonceSessionKey       = "oidc_nonce"
+	oidcVerifierSessionKey    = "oidc_verifier"
+	oidcRedirectURISessionKey = "oidc_redirect_uri"
+	oidcCallbackSessionKey    = "oidc_callback"
+	oidcStartedAtSessionKey   = "oidc_started_at"
+)
+
+var oidcSessionKeys = []string{
+	oidcStateSessionKey, oidcNonceSessionKey, oidcVerifierSessionKey,
+	oidcRedirectURISessionKey, oidcCallbackSessionKey, oidcStartedAtSessionKey,
+}
+
+// oidcRedirectURI returns OIDC_REDIRECT_URL, or the callback route on the auth host.
+func oidcRedirectURI(ctx *fiber.Ctx) string {
+	if redirectURI := config.OIDCRedirectURL.String(); redirectURI != "" {
+		return redirectURI
+	}
+	return fmt.Sprintf("%s://%s%s", GetForwardedProto(ctx), config.AuthHost.String(), OIDCCallbackPath)
+}
+
+// oidcLoginURL returns the login page link to OIDCLoginPath, carrying callback.
+func oidcLoginURL(callback string) string {
+	if callback == "" {
+		return OIDCLoginPath
+	}
+	return OIDCLoginPath + "?callback=" + url.QueryEscape(callback)
+}
+
+// startOIDCLogin stores state, nonce and PKCE verifier in the session and sends the user to the
+// provider. callback must already be validated with resolveCallback.
+func startOIDCLogin(ctx *fiber.Ctx, sessionGetter SessionGetter, client *oidc.Client, callback string) error {
+	if client == nil {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.oidc_not_configured"))
+	}
+
+	var values [3]string
+	for i := range values {
+		token, err := oidc.RandomToken()
+		if err != nil {
+			return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.oidc_failed"))
+		}
+		values[i] = token
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+	redirectURI := oidcRedirectURI(ctx)
+
+	authURL, err := client.AuthCodeURL(ctx.UserContext(), redirectURI, state, nonce, verifier)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start OIDC login")
+		return SendErrorResponse(ctx, fiber.StatusBadGateway, i18n.T(ctx, "error.oidc_failed"))
+	}
+
+	sess, err := sessionGetter.Get(ctx)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	sess.Set(oidcStateSessionKey, state)
+	sess.Set(oidcNonceSessionKey, nonce)
+	sess.Set(oidcVerifierSessionKey, verifier)
+	sess.Set(oidcRedirectURISessionKey, redirectURI)
+	sess.Set(oidcCallbackSessionKey, callback)
+	sess.Set(oidcStartedAtSessionKey, time.Now().Unix())
+	if err := sess.Save(); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+
+	if strings.Contains(ctx.Get("Accept"), "application/json") {
+		return ctx.Status(fiber.StatusOK).JSON(fiber.Map{
+			"success":  true,
+			"redirect": authURL,
+		})
+	}
+	return ctx.Redirect(authURL)
+}
+
+// oidcLoginRouteHandler is the internal handler that can be tested with mocked dependencies.
+func oidcLoginRouteHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, client *oidc.Client) error {
+	callback := ctx.Query("callback")
+	if callback == "" {
+		callback = GetCallbackFromCookie(ctx)
+	}
+	if _, err := resolveCallback(ctx, callback); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.callback_not_allowed"))
+	}
+	return startOIDCLogin(ctx, sessionGetter, client, callback)
+}
+
+// pendingOIDCLogin is the login state saved by startOIDCLogin.
+type pendingOIDCLogin struct {
+	state, nonce, verifier, redirectURI, callback string
+	startedAt                                     time.Time
+}
+
+// takePendingOIDCLogin reads and removes the pending login from the session, so a state value
+// can only be used once.
+func takePendingOIDCLogin(sess *session.Session) pendingOIDCLogin {
+	str := func(key string) string {
+		s, _ := sess.Get(key).(string)
+		return s
+	}
+	p := pendingOIDCLogin{
+		state:       str(oidcStateSessionKey),
+		nonce:       str(oidcNonceSessionKey),
+		verifier:    str(oidcVerifierSessionKey),
+		redirectURI: str(oidcRedirectURISessionKey),
+		callback:    str(oidcCallbackSessionKey),
+	}
+	if startedAt, ok := sess.Get(oidcStartedAtSessionKey).(int64); ok {
+		p.startedAt = time.Unix(startedAt, 0)
+	}
+	for _, key := range oidcSessionKeys {
+		sess.Delete(key)
+	}
+	return p
+}
+
+// oidcCallbackHandler is the internal handler that can be tested with mocked dependencies.
+func oidcCallbackHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator Authenticator, codes ExchangeCodeStore, client *oidc.Client) error {
+	if client == nil {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.oidc_not_configured"))
+	}
+
+	sess, err := sessionGetter.Get(ctx)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	pending := takePendingOIDCLogin(sess)
+
+	// Failures still save the session, so the pending login cannot be retried
+	fail := func(status int, key, reason string) error {
+		if err := sess.Save(); err != nil {
+			return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+		}
+		metrics.RecordAuthRequest(authMethodOIDC, "failure")
+		auditlog.LogLogin(ctx.Context(), "", authMethodOIDC, GetClientIP(ctx), false, reason)
+		return SendErrorResponse(ctx, status, i18n.T(ctx, key))
+	}
+
+	state := ctx.Query("state")
+	if pending.state == "" || state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(pending.state)) != 1 {
+		return fail(fiber.StatusBadRequest, "error.oidc_state_invalid", "state_mismatch")
+	}
+	if time.Since(pending.startedAt) > oidcLoginTTL {
+		return fail(fiber.StatusBadRequest, "error.oidc_state_invalid", "state_expired")
+	}
+	if providerErr := ctx.Query("error"); providerErr != "" {
+		log.Warn().Str("error", providerErr).Str("description", ctx.Query("error_description")).Msg("OIDC provider returned an error")
+		return fail(fiber.StatusUnauthorized, "error.oidc_failed", "provider_error")
+	}
+	code := ctx.Query("code")
+	if code == "" {
+		return fail(fiber.StatusBadRequest, "error.oidc_failed", "missing_code")
+	}
+
+	identity, err := client.Exchange(ctx.UserContext(), code, pending.redirectURI, pending.verifier, pending.nonce)
+	if err != nil {
+		log.Warn().Err(err).Msg("OIDC login failed")
+		return fail(fiber.StatusUnauthorized, "error.oidc_failed", "token_invalid")
+	}
+
+	// Map the ID token claims onto the session fields CheckRoute forwards as X-Auth-* headers
+	sess.Set("user_id", identity.Subject)
+	if identity.Email != "" {
+		sess.Set("user_mail", identity.Email)
+	}
+	if identity.Name != "" {
+		sess.Set("user_name", identity.Name)
+	}
+	if len(identity.Groups) > 0 {
+		sess.Set("user_scope", identity.Groups)
+	}
+	if len(identity.AMR) > 0 {
+		sess.Set(amrSessionKey, identity.AMR)
+	}
+	if err := rotateSessionID(sess); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	indexSession(ctx, sess)
+	// Saving releases the session, so keep its ID for the exchange code
+	sessionID := sess.ID()
+	if err := authenticator.Authenticate(sess); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.authenticate_failed"))
+	}
+
+	metrics.RecordAuthRequest(authMethodOIDC, "success")
+	auditlog.LogLogin(ctx.Context(), identity.Subject, authMethodOIDC, GetClientIP(ctx), true, "")
+	metrics.RecordSessionCreated()
+	auditlog.LogSessionCreate(ctx.Context(), identity.Subject, GetClientIP(ctx))
+
+	if GetCallbackFromCookie(ctx) != "" {
+		ClearCallbackCookie(ctx)
+	}
+
+	// The callback was validated when the login started; check again in case the allowlist changed
+	target, err := resolveCallback(ctx, pending.callback)
+	if err != nil || target.host == "" {
+		return ctx.Redirect("/")
+	}
+	exchangeCode, err := codes.Mint(sessionID, target.host)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	return ctx.Redirect(buildSessionExchangeURL(ctx, target, exchangeCode))
+}
+
+// OIDCLoginRoute handles GET requests to /_oidc/login by redirecting to the configured
+// OpenID Connect provider. An optional callback query parameter selects where the user
+// lands after login, as for /_login.
+func OIDCLoginRoute(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return oidcLoginRouteHandler(ctx, sessionGetter, oidc.Get())
+	}
+}
+
+// OIDCCallbackRoute handles GET requests to /_oidc/callback. It validates state, redeems the
+// authorization code, verifies the ID token and creates the session.
+func OIDCCallbackRoute(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	authenticator := &AuthAuthenticator{}
+	codes := newStorageExchangeCodes(store.Storage)
+	return func(ctx *fiber.Ctx) error {
+		return oidcCallbackHandler(ctx, sessionGetter, authenticator, codes, oidc.Get())
+	}
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/oidc"
+	"github.com/soulteary/stargate/src/internal/oidc/oidctest"
+)
+
+// oidcTestApp serves the OIDC routes backed by a mock provider, plus /whoami dumping the session.
+func oidcTestApp(t *testing.T, client *oidc.Client) *fiber.App {
+	t.Helper()
+	store := setupTestStore()
+	sessionGetter := &SessionStoreAdapter{store: store}
+	codes := newStorageExchangeCodes(store.Storage)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("i18n-bundle", i18n.GetBundle())
+		c.Locals("i18n-language", i18n.LangEN)
+		return c.Next()
+	})
+	app.Get(OIDCLoginPath, func(c *fiber.Ctx) error {
+		return oidcLoginRouteHandler(c, sessionGetter, client)
+	})
+	app.Get(OIDCCallbackPath, func(c *fiber.Ctx) error {
+		return oidcCallbackHandler(c, sessionGetter, &AuthAuthenticator{}, codes, client)
+	})
+	app.Post("/_login", func(c *fiber.Ctx) error {
+		return loginAPIHandler(c, sessionGetter, &AuthAuthenticator{}, codes)
+	})
+	app.Get("/whoami", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(fiber.Map{
+			"authenticated": auth.IsAuthenticated(sess),
+			"user_id":       sess.Get("user_id"),
+			"user_mail":     sess.Get("user_mail"),
+			"user_name":     sess.Get("user_name"),
+			"user_scope":    sess.Get("user_scope"),
+			"user_amr":      sess.Get(amrSessionKey),
+		})
+	})
+	return app
+}
+
+func setupOIDCTest(t *testing.T) (*oidctest.Server, *fiber.App) {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("OIDC_ENABLED", "true")
+	t.Setenv("OIDC_CLIENT_ID", "stargate")
+	t.Setenv("OIDC_ISSUER_URL", "https://idp.example.com")
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+
+	idp := oidctest.NewServer("stargate", "secret")
+	t.Cleanup(idp.Close)
+	client := oidc.NewClient(oidc.Config{Issuer: idp.Issuer(), ClientID: "stargate", ClientSecret: "secret"})
+	oidc.Init(client)
+	t.Cleanup(func() { oidc.Init(nil) })
+	return idp, oidcTestApp(t, client)
+}
+
+// oidcRequest sends a GET request to app carrying the session cookie, if any.
+func oidcRequest(t *testing.T, app *fiber.App, target string, cookie *http.Cookie) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Accept", "text/html")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	return resp
+}
+
+func sessionCookie(resp *http.Response) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == auth.SessionCookieName {
+			return c
+		}
+	}
+	return nil
+}
+
+// startOIDCTestLogin starts a login and returns the provider's redirect back to Stargate.
+func startOIDCTestLogin(t *testing.T, idp *oidctest.Server, app *fiber.App, query string) (*url.URL, *http.Cookie) {
+	t.Helper()
+	resp := oidcRequest(t, app, OIDCLoginPath+query, nil)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	authURL := resp.Header.Get("Location")
+	testza.AssertTrue(t, strings.HasPrefix(authURL, idp.Issuer()+"/authorize?"))
+	cookie := sessionCookie(resp)
+	testza.AssertNotNil(t, cookie)
+
+	location, err := idp.Authorize(authURL)
+	testza.AssertNoError(t, err)
+	back, err := url.Parse(location)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "auth.example.com", back.Host)
+	testza.AssertEqual(t, OIDCCallbackPath, back.Path)
+	return back, cookie
+}
+
+func whoami(t *testing.T, app *fiber.App, cookie *http.Cookie) map[string]interface{} {
+	t.Helper()
+	resp := oidcRequest(t, app, "/whoami", cookie)
+	body, err := io.ReadAll(resp.Body)
+	testza.AssertNoError(t, err)
+	var result map[string]interface{}
+	testza.AssertNoError(t, json.Unmarshal(body, &result))
+	return result
+}
+
+func TestOIDCLogin_FullFlow(t *testing.T) {
+	idp, app := setupOIDCTest(t)
+	idp.SetClaims(map[string]interface{}{
+		"sub":    "oidc-user-1",
+		"email":  "alice@example.com",
+		"name":   "Alice",
+		"groups": []string{"admin", "dev"},
+		"amr":    []string{"pwd", "mfa"},
+	})
+
+	back, cookie := startOIDCTestLogin(t, idp, app, "?callback="+url.QueryEscape("https://app.example.com/dashboard"))
+	resp := oidcRequest(t, app, back.RequestURI(), cookie)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+
+	// The user is sent to the callback host's session exchange with a one-time code
+	exchange, err := url.Parse(resp.Header.Get("Location"))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "app.example.com", exchange.Host)
+	testza.AssertEqual(t, "/_session_exchange", exchange.Path)
+	testza.AssertNotEqual(t, "", exchange.Query().Get("code"))
+
+	if renewed := sessionCookie(resp); renewed != nil {
+		cookie = renewed
+	}
+	session := whoami(t, app, cookie)
+	testza.AssertEqual(t, true, session["authenticated"])
+	testza.AssertEqual(t, "oidc-user-1", session["user_id"])
+	testza.AssertEqual(t, "alice@example.com", session["user_mail"])
+	testza.AssertEqual(t, "Alice", session["user_name"])
+	testza.AssertEqual(t, []interface{}{"admin", "dev"}, session["user_scope"])
+	testza.AssertEqual(t, []interface{}{"pwd", "mfa"}, session["user_amr"])
+}
+
+func TestOIDCLogin_WithoutCallback(t *testing.T) {
+	idp, app := setupOIDCTest(t)
+
+	back, cookie := startOIDCTestLogin(t, idp, app, "")
+	resp := oidcRequest(t, app, back.RequestURI(), cookie)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	testza.AssertEqual(t, "/", resp.Header.Get("Location"))
+	testza.AssertEqual(t, "user-1", whoami(t, app, cookie)["user_id"])
+}
+
+func TestOIDCLogin_RejectsCallbackOutsideAllowlist(t *testing.T) {
+	_, app := setupOIDCTest(t)
+
+	resp := oidcRequest(t, app, OIDCLoginPath+"?callback="+url.QueryEscape("https://evil.example.net/"), nil)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+func TestOIDCCallback_StateMismatch(t *testing.T) {
+	idp, app := setupOIDCTest(t)
+
+	back, cookie := startOIDCTestLogin(t, idp, app, "")
+	query := back.Query()
+	query.Set("state", "forged")
+	resp := oidcRequest(t, app, OIDCCallbackPath+"?"+query.Encode(), cookie)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	// The pending login is consumed by the failed attempt, so the genuine response is refused too
+	resp = oidcRequest(t, app, back.RequestURI(), cookie)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+	testza.AssertEqual(t, 0, idp.TokenRequests)
+	testza.AssertEqual(t, false, whoami(t, app, cookie)["authenticated"])
+}
+
+func TestOIDCCallback_WithoutPendingLogin(t *testing.T) {
+	idp, app := setupOIDCTest(t)
+
+	back, _ := startOIDCTestLogin(t, idp, app, "")
+	// Another browser (without the session that started the login) cannot complete it
+	resp := oidcRequest(t, app, back.RequestURI(), nil)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+func TestOIDCCallback_ProviderError(t *testing.T) {
+	idp, app := setupOIDCTest(t)
+
+	back, cookie := startOIDCTestLogin(t, idp, app, "")
+	query := url.Values{"state": {back.Query().Get("state")}, "error": {"access_denied"}}
+	resp := oidcRequest(t, app, OIDCCallbackPath+"?"+query.Encode(), cookie)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	testza.AssertEqual(t, 0, idp.TokenRequests)
+}
+
+func TestOIDCCallback_InvalidToken(t *testing.T) {
+	idp, app := setupOIDCTest(t)
+	// The provider issues tokens without a subject
+	idp.SetClaims(map[string]interface{}{})
+
+	back, cookie := startOIDCTestLogin(t, idp, app, "")
+	resp := oidcRequest(t, app, back.RequestURI(), cookie)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	testza.AssertEqual(t, false, whoami(t, app, cookie)["authenticated"])
+}
+
+func TestOIDC_NotConfigured(t *testing.T) {
+	setupOIDCTest(t)
+	app := oidcTestApp(t, nil)
+
+	resp := oidcRequest(t, app, OIDCLoginPath, nil)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+	resp = oidcRequest(t, app, OIDCCallbackPath+"?state=x&code=y", nil)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+}
+
+func TestLoginAPI_OIDCMethod(t *testing.T) {
+	idp, app := setupOIDCTest(t)
+
+	form := url.Values{"auth_method": {"oidc"}, "callback": {"app.example.com"}}
+	req := httptest.NewRequest(http.MethodPost, "/_login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	var body map[string]interface{}
+	testza.AssertNoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	testza.AssertEqual(t, true, body["success"])
+	redirect, _ := body["redirect"].(string)
+	testza.AssertTrue(t, strings.HasPrefix(redirect, idp.Issuer()+"/authorize?"))
+}
+
+func TestOIDCLoginURL(t *testing.T) {
+	testza.AssertEqual(t, OIDCLoginPath, oidcLoginURL(""))
+	testza.AssertEqual(t, OIDCLoginPath+"?callback=https%3A%2F%2Fapp.example.com%2F%3Fa%3D1", oidcLoginURL("https://app.example.com/?a=1"))
+}
@@ -0,0 +1,529 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+
+	"github.com/soulteary/stargate/src/internal/auditlog"
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/metrics"
+	"github.com/soulteary/stargate/src/internal/webauthn"
+)
+
+const (
+	// PasskeysPath is the self-service page listing the user's passkeys.
+	PasskeysPath = "/_passkeys"
+	// PasskeyRegisterOptionsPath returns the options for registering a new passkey.
+	PasskeyRegisterOptionsPath = "/_passkeys/register/options"
+	// PasskeyRegisterPath stores the passkey created by the browser.
+	PasskeyRegisterPath = "/_passkeys/register"
+	// PasskeyRemovePath deletes one of the user's passkeys.
+	PasskeyRemovePath = "/_passkeys/remove"
+	// PasskeyLoginOptionsPath returns the options for signing in with a passkey.
+	PasskeyLoginOptionsPath = "/_passkeys/login/options"
+	// PasskeyLoginPath signs in with the passkey assertion from the browser.
+	PasskeyLoginPath = "/_passkeys/login"
+	// StepUpPasskeyOptionsPath returns the options for a step-up with one of the user's passkeys.
+	StepUpPasskeyOptionsPath = "/_step_up/passkey/options"
+
+	// authMethodPasskey is the audit method and metrics label for passkey logins.
+	authMethodPasskey = "passkey"
+	// passkeyDefaultName names passkeys registered without a name.
+	passkeyDefaultName = "Passkey"
+)
+
+// Passkey ceremonies a challenge is issued for. A challenge is only accepted by the ceremony
+// it was issued for.
+const (
+	passkeyCeremonyRegister = "register"
+	passkeyCeremonyLogin    = "login"
+	passkeyCeremonyStepUp   = "step_up"
+)
+
+// Session keys holding a pending passkey ceremony until the browser answers.
+const (
+	passkeyChallengeSessionKey = "passkey_challenge"
+	passkeyCeremonySessionKey  = "passkey_ceremony"
+	passkeyStartedAtSessionKey = "passkey_started_at"
+	passkeyCallbackSessionKey  = "passkey_callback"
+)
+
+var passkeySessionKeys = []string{
+	passkeyChallengeSessionKey, passkeyCeremonySessionKey, passkeyStartedAtSessionKey, passkeyCallbackSessionKey,
+}
+
+// startPasskeyCeremony stores a new challenge for ceremony in the session and returns it. The
+// session is saved by the caller.
+func startPasskeyCeremony(sess *session.Session, ceremony string) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	sess.Set(passkeyChallengeSessionKey, challenge)
+	sess.Set(passkeyCeremonySessionKey, ceremony)
+	sess.Set(passkeyStartedAtSessionKey, time.Now().Unix())
+	return challenge, nil
+}
+
+// takePasskeyChallenge reads and removes the pending ceremony from the session, so a challenge
+// can only be answered once. It returns "" when no challenge of ceremony is pending or it has
+// expired, along with the callback stored for a login.
+func takePasskeyChallenge(sess *session.Session, ceremony string) (challenge, callback string) {
+	challenge, _ = sess.Get(passkeyChallengeSessionKey).(string)
+	callback, _ = sess.Get(passkeyCallbackSessionKey).(string)
+	pending, _ := sess.Get(passkeyCeremonySessionKey).(string)
+	startedAt, _ := sess.Get(passkeyStartedAtSessionKey).(int64)
+	for _, key := range passkeySessionKeys {
+		sess.Delete(key)
+	}
+	if pending != ceremony || time.Since(time.Unix(startedAt, 0)) > webauthn.Timeout {
+		return "", ""
+	}
+	return challenge, callback
+}
+
+// passkeyOwner returns the identity of the session a passkey is registered for.
+func passkeyOwner(sess *session.Session, userID string) webauthn.Owner {
+	str := func(key string) string {
+		s, _ := sess.Get(key).(string)
+		return s
+	}
+	return webauthn.Owner{
+		UserID: userID,
+		Email:  str("user_mail"),
+		Phone:  str("user_phone"),
+		Name:   str("user_name"),
+		Role:   str("user_role"),
+		Scopes: sessionStrings(sess.Get("user_scope")),
+	}
+}
+
+// passkeyView is a passkey as listed to its owner; the public key stays on the server.
+type passkeyView struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Synced     bool      `json:"synced"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+func newPasskeyView(c *webauthn.Credential) passkeyView {
+	return passkeyView{ID: c.ID, Name: c.Name, Synced: c.BackupEligible, CreatedAt: c.CreatedAt, LastUsedAt: c.LastUsedAt}
+}
+
+// passkeysPageHandler is the internal handler that can be tested with mocked dependencies.
+func passkeysPageHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, rp *webauthn.RelyingParty) error {
+	if rp == nil {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.passkeys_disabled"))
+	}
+	// Passkeys belong to a user, like API tokens
+	sess, userID, err := loggedInSession(ctx, sessionGetter)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	if !auth.IsAuthenticated(sess) {
+		if IsHTMLRequest(ctx) {
+			return ctx.Redirect(authHostLoginURL(ctx), fiber.StatusFound)
+		}
+		return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.auth_required"))
+	}
+	if userID == "" {
+		return SendErrorResponse(ctx, fiber.StatusForbidden, i18n.T(ctx, "error.passkey_no_user"))
+	}
+
+	list, err := rp.Store().List(userID)
+	if err != nil {
+		log.Error().Err(err).Str("user_id", userID).Msg("Failed to list passkeys")
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.passkey_store_failed"))
+	}
+	views := make([]passkeyView, 0, len(list))
+	for _, c := range list {
+		views = append(views, newPasskeyView(c))
+	}
+	if !IsHTMLRequest(ctx) {
+		return ctx.JSON(fiber.Map{"passkeys": views})
+	}
+	return ctx.Render("passkeys", fiber.Map{
+		"Title":    config.LoginPageTitle.Value,
+		"Passkeys": views,
+	})
+}
+
+// passkeyRegisterOptionsHandler is the internal handler that can be tested with mocked dependencies.
+func passkeyRegisterOptionsHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, rp *webauthn.RelyingParty) error {
+	if rp == nil {
+		return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{"ok": false, "error": "disabled"})
+	}
+	sess, userID, err := loggedInSession(ctx, sessionGetter)
+	if err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "session_store_failed"})
+	}
+	if !auth.IsAuthenticated(sess) {
+		return ctx.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ok": false, "error": "unauthorized"})
+	}
+	if userID == "" {
+		return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{"ok": false, "error": "no_user_id"})
+	}
+
+	existing, err := rp.Store().List(userID)
+	if err != nil {
+		log.Error().Err(err).Str("user_id", userID).Msg("Failed to list passkeys")
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "store_failed"})
+	}
+	if len(existing) >= webauthn.MaxCredentialsPerUser {
+		return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{"ok": false, "error": "too_many_passkeys"})
+	}
+	challenge, err := startPasskeyCeremony(sess, passkeyCeremonyRegister)
+	if err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "challenge_failed"})
+	}
+	// Saving releases the session, so read the owner first
+	owner := passkeyOwner(sess, userID)
+	if err := sess.Save(); err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "session_store_failed"})
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.JSON(fiber.Map{
+		"ok":        true,
+		"publicKey": rp.CreationOptions(challenge, owner, existing),
+	})
+}
+
+// passkeyRegisterRequest is the body of POST /_passkeys/register.
+type passkeyRegisterRequest struct {
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+// passkeyRegisterHandler is the internal handler that can be tested with mocked dependencies.
+func passkeyRegisterHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, rp *webauthn.RelyingParty) error {
+	if rp == nil {
+		return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{"ok": false, "error": "disabled"})
+	}
+	sess, userID, err := loggedInSession(ctx, sessionGetter)
+	if err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "session_store_failed"})
+	}
+	if !auth.IsAuthenticated(sess) {
+		return ctx.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ok": false, "error": "unauthorized"})
+	}
+	if userID == "" {
+		return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{"ok": false, "error": "no_user_id"})
+	}
+
+	challenge, _ := takePasskeyChallenge(sess, passkeyCeremonyRegister)
+	owner := passkeyOwner(sess, userID)
+	if err := sess.Save(); err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "session_store_failed"})
+	}
+	if challenge == "" {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ok": false, "error": "challenge_expired"})
+	}
+	var body passkeyRegisterRequest
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ok": false, "error": "invalid_request"})
+	}
+	resp, err := webauthn.ParseResponse(body.Credential)
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ok": false, "error": "invalid_credential"})
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		name = passkeyDefaultName
+	}
+
+	cred, err := rp.FinishRegistration(challenge, resp, owner, name)
+	switch {
+	case errors.Is(err, webauthn.ErrInvalidResponse), errors.Is(err, webauthn.ErrUnsupportedKey):
+		log.Warn().Err(err).Str("user_id", userID).Msg("Passkey registration rejected")
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ok": false, "error": "invalid_credential"})
+	case errors.Is(err, webauthn.ErrInvalidName):
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ok": false, "error": "invalid_name"})
+	case errors.Is(err, webauthn.ErrDuplicate):
+		return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{"ok": false, "error": "already_registered"})
+	case errors.Is(err, webauthn.ErrTooManyCredentials):
+		return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{"ok": false, "error": "too_many_passkeys"})
+	case err != nil:
+		log.Error().Err(err).Str("user_id", userID).Msg("Failed to store passkey")
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "store_failed"})
+	}
+
+	auditlog.LogPasskey(ctx.Context(), userID, cred.ID, "passkey_register", GetClientIP(ctx))
+	log.Info().Str("user_id", userID).Str("credential_id", cred.ID).Bool("synced", cred.BackupEligible).Msg("Passkey registered")
+	return ctx.Status(fiber.StatusCreated).JSON(fiber.Map{"ok": true, "passkey": newPasskeyView(cred)})
+}
+
+// passkeyRemoveHandler is the internal handler that can be tested with mocked dependencies.
+func passkeyRemoveHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, rp *webauthn.RelyingParty) error {
+	if rp == nil {
+		return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{"ok": false, "error": "disabled"})
+	}
+	sess, userID, err := loggedInSession(ctx, sessionGetter)
+	if err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "session_store_failed"})
+	}
+	if !auth.IsAuthenticated(sess) {
+		return ctx.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ok": false, "error": "unauthorized"})
+	}
+	if userID == "" {
+		return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{"ok": false, "error": "no_user_id"})
+	}
+
+	id := ctx.FormValue("id")
+	if id == "" {
+		var body struct {
+			ID string `json:"id"`
+		}
+		_ = ctx.BodyParser(&body)
+		id = body.ID
+	}
+	if _, err := rp.Store().Remove(userID, id); err != nil {
+		if errors.Is(err, webauthn.ErrNotFound) {
+			return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{"ok": false, "error": "not_found"})
+		}
+		log.Error().Err(err).Str("user_id", userID).Msg("Failed to remove passkey")
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "store_failed"})
+	}
+
+	auditlog.LogPasskey(ctx.Context(), userID, id, "passkey_remove", GetClientIP(ctx))
+	log.Info().Str("user_id", userID).Str("credential_id", id).Msg("Passkey removed")
+	return ctx.JSON(fiber.Map{"ok": true, "id": id})
+}
+
+// passkeyLoginOptionsHandler is the internal handler that can be tested with mocked dependencies.
+func passkeyLoginOptionsHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, rp *webauthn.RelyingParty) error {
+	if rp == nil {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.passkeys_disabled"))
+	}
+	callback := ctx.Query("callback")
+	if callback == "" {
+		callback = GetCallbackFromCookie(ctx)
+	}
+	if _, err := resolveCallback(ctx, callback); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.callback_not_allowed"))
+	}
+
+	sess, err := sessionGetter.Get(ctx)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	challenge, err := startPasskeyCeremony(sess, passkeyCeremonyLogin)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.passkey_invalid"))
+	}
+	sess.Set(passkeyCallbackSessionKey, callback)
+	if err := sess.Save(); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.JSON(fiber.Map{
+		"success":   true,
+		"publicKey": rp.RequestOptions(challenge, nil),
+	})
+}
+
+// passkeyLoginHandler is the internal handler that can be tested with mocked dependencies.
+func passkeyLoginHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator Authenticator, codes ExchangeCodeStore, rp *webauthn.RelyingParty) error {
+	if rp == nil {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.passkeys_disabled"))
+	}
+	sess, err := sessionGetter.Get(ctx)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	challenge, callback := takePasskeyChallenge(sess, passkeyCeremonyLogin)
+
+	// Failures still save the session, so the challenge cannot be answered again
+	fail := func(status int, key, reason string) error {
+		if err := sess.Save(); err != nil {
+			return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+		}
+		metrics.RecordAuthRequest(authMethodPasskey, "failure")
+		auditlog.LogLogin(ctx.Context(), "", authMethodPasskey, GetClientIP(ctx), false, reason)
+		return SendErrorResponse(ctx, status, i18n.T(ctx, key))
+	}
+
+	if challenge == "" {
+		return fail(fiber.StatusBadRequest, "error.passkey_expired", "challenge_expired")
+	}
+	resp, err := webauthn.ParseResponse(ctx.Body())
+	if err != nil {
+		return fail(fiber.StatusBadRequest, "error.passkey_invalid", "invalid_request")
+	}
+	cred, err := rp.FinishLogin(challenge, resp, "")
+	if err != nil {
+		if !errors.Is(err, webauthn.ErrInvalidResponse) && !errors.Is(err, webauthn.ErrUnknownCredential) && !errors.Is(err, webauthn.ErrUnsupportedKey) {
+			log.Error().Err(err).Msg("Failed to read passkey")
+			return fail(fiber.StatusInternalServerError, "error.passkey_store_failed", "store_failed")
+		}
+		log.Warn().Err(err).Msg("Passkey login failed")
+		return fail(fiber.StatusUnauthorized, "error.passkey_invalid", "passkey_invalid")
+	}
+
+	// The passkey logs in as the identity it was registered for
+	owner := cred.Owner
+	sess.Set("user_id", owner.UserID)
+	for key, value := range map[string]string{
+		"user_mail":  owner.Email,
+		"user_phone": owner.Phone,
+		"user_name":  owner.Name,
+		"user_role":  owner.Role,
+	} {
+		if value != "" {
+			sess.Set(key, value)
+		}
+	}
+	if len(owner.Scopes) > 0 {
+		sess.Set("user_scope", owner.Scopes)
+	}
+	sess.Set(amrSessionKey, []string{cred.AMR()})
+	if err := rotateSessionID(sess); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	indexSession(ctx, sess)
+	// Saving releases the session, so keep its ID for the exchange code
+	sessionID := sess.ID()
+	if err := authenticator.Authenticate(sess); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.authenticate_failed"))
+	}
+
+	metrics.RecordAuthRequest(authMethodPasskey, "success")
+	auditlog.LogLogin(ctx.Context(), owner.UserID, authMethodPasskey, GetClientIP(ctx), true, "")
+	metrics.RecordSessionCreated()
+	auditlog.LogSessionCreate(ctx.Context(), owner.UserID, GetClientIP(ctx))
+
+	if GetCallbackFromCookie(ctx) != "" {
+		ClearCallbackCookie(ctx)
+	}
+
+	// The callback was validated when the login started; check again in case the allowlist changed
+	redirect := "/"
+	if target, err := resolveCallback(ctx, callback); err == nil && target.host != "" {
+		code, err := codes.Mint(sessionID, target.host)
+		if err != nil {
+			return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+		}
+		redirect = buildSessionExchangeURL(ctx, target, code)
+	}
+	return ctx.JSON(fiber.Map{
+		"success":  true,
+		"redirect": redirect,
+		"message":  i18n.T(ctx, "success.login"),
+	})
+}
+
+// stepUpPasskeyOptionsHandler is the internal handler that can be tested with mocked dependencies.
+func stepUpPasskeyOptionsHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, rp *webauthn.RelyingParty) error {
+	if rp == nil {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.passkeys_disabled"))
+	}
+	sess, userID, err := loggedInSession(ctx, sessionGetter)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	if !auth.IsAuthenticated(sess) {
+		return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.auth_required"))
+	}
+	list, err := userPasskeys(rp, userID)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.passkey_store_failed"))
+	}
+	if len(list) == 0 {
+		return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.step_up_unavailable"))
+	}
+	challenge, err := startPasskeyCeremony(sess, passkeyCeremonyStepUp)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.passkey_invalid"))
+	}
+	if err := sess.Save(); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.JSON(fiber.Map{
+		"success":   true,
+		"publicKey": rp.RequestOptions(challenge, list),
+	})
+}
+
+// userPasskeys returns the passkeys of userID, or none when passkeys are disabled or the session
+// has no user ID.
+func userPasskeys(rp *webauthn.RelyingParty, userID string) ([]*webauthn.Credential, error) {
+	if rp == nil || userID == "" {
+		return nil, nil
+	}
+	list, err := rp.Store().List(userID)
+	if err != nil {
+		log.Error().Err(err).Str("user_id", userID).Msg("Failed to list passkeys")
+	}
+	return list, err
+}
+
+// PasskeysRoute handles GET /_passkeys: the self-service page listing the user's passkeys, or
+// the list as JSON for non-HTML requests.
+func PasskeysRoute(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return passkeysPageHandler(ctx, sessionGetter, webauthn.Get())
+	}
+}
+
+// PasskeyRegisterOptionsAPI handles POST /_passkeys/register/options, starting the registration
+// of a passkey for the logged-in user.
+func PasskeyRegisterOptionsAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return passkeyRegisterOptionsHandler(ctx, sessionGetter, webauthn.Get())
+	}
+}
+
+// PasskeyRegisterAPI handles POST /_passkeys/register, verifying and storing the new passkey.
+func PasskeyRegisterAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return passkeyRegisterHandler(ctx, sessionGetter, webauthn.Get())
+	}
+}
+
+// PasskeyRemoveAPI handles POST /_passkeys/remove, deleting one of the logged-in user's passkeys.
+func PasskeyRemoveAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return passkeyRemoveHandler(ctx, sessionGetter, webauthn.Get())
+	}
+}
+
+// PasskeyLoginOptionsAPI handles POST /_passkeys/login/options, starting a passkey login that
+// returns to the callback of the query or the callback cookie.
+func PasskeyLoginOptionsAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return passkeyLoginOptionsHandler(ctx, sessionGetter, webauthn.Get())
+	}
+}
+
+// PasskeyLoginAPI handles POST /_passkeys/login, creating a session for the owner of the passkey
+// and returning the URL to continue to.
+func PasskeyLoginAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	authenticator := &AuthAuthenticator{}
+	codes := newStorageExchangeCodes(store.Storage)
+	return func(ctx *fiber.Ctx) error {
+		return passkeyLoginHandler(ctx, sessionGetter, authenticator, codes, webauthn.Get())
+	}
+}
+
+// StepUpPasskeyOptionsAPI handles POST /_step_up/passkey/options, starting a step-up with one of
+// the logged-in user's passkeys. The answer is posted to /_step_up with method=passkey.
+func StepUpPasskeyOptionsAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return stepUpPasskeyOptionsHandler(ctx, sessionGetter, webauthn.Get())
+	}
+}
@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/filestore"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/webauthn"
+	"github.com/soulteary/stargate/src/internal/webauthn/webauthntest"
+)
+
+const passkeyTestOrigin = "https://auth.example.com"
+
+// passkeyTestApp serves the passkey and step-up routes, plus /test_login creating a session for
+// user-1, /test_login_password creating one without a user ID and /whoami dumping the session.
+func passkeyTestApp(t *testing.T, rp *webauthn.RelyingParty) *fiber.App {
+	t.Helper()
+	store := setupTestStore()
+	sessionGetter := &SessionStoreAdapter{store: store}
+	codes := newStorageExchangeCodes(store.Storage)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("i18n-bundle", i18n.GetBundle())
+		c.Locals("i18n-language", i18n.LangEN)
+		return c.Next()
+	})
+	app.Get(PasskeysPath, func(c *fiber.Ctx) error {
+		return passkeysPageHandler(c, sessionGetter, rp)
+	})
+	app.Post(PasskeyRegisterOptionsPath, func(c *fiber.Ctx) error {
+		return passkeyRegisterOptionsHandler(c, sessionGetter, rp)
+	})
+	app.Post(PasskeyRegisterPath, func(c *fiber.Ctx) error {
+		return passkeyRegisterHandler(c, sessionGetter, rp)
+	})
+	app.Post(PasskeyRemovePath, func(c *fiber.Ctx) error {
+		return passkeyRemoveHandler(c, sessionGetter, rp)
+	})
+	app.Post(PasskeyLoginOptionsPath, func(c *fiber.Ctx) error {
+		return passkeyLoginOptionsHandler(c, sessionGetter, rp)
+	})
+	app.Post(PasskeyLoginPath, func(c *fiber.Ctx) error {
+		return passkeyLoginHandler(c, sessionGetter, &AuthAuthenticator{}, codes, rp)
+	})
+	app.Post(StepUpPasskeyOptionsPath, func(c *fiber.Ctx) error {
+		return stepUpPasskeyOptionsHandler(c, sessionGetter, rp)
+	})
+	app.Post(StepUpPath, func(c *fiber.Ctx) error {
+		return stepUpAPIHandler(c, sessionGetter, nil)
+	})
+	app.Get("/test_login", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("user_id", "user-1")
+		sess.Set("user_mail", "alice@example.com")
+		sess.Set("user_role", "admin")
+		sess.Set("user_scope", []string{"read", "write"})
+		sess.Set(amrSessionKey, []string{"pwd"})
+		return (&AuthAuthenticator{}).Authenticate(sess)
+	})
+	app.Get("/test_login_password", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		return (&AuthAuthenticator{}).Authenticate(sess)
+	})
+	app.Get("/whoami", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(fiber.Map{
+			"authenticated":  auth.IsAuthenticated(sess),
+			"user_id":        sess.Get("user_id"),
+			"user_mail":      sess.Get("user_mail"),
+			"user_role":      sess.Get("user_role"),
+			"user_scope":     sess.Get("user_scope"),
+			"user_amr":       sess.Get(amrSessionKey),
+			"step_up_method": sess.Get(stepUpMethodSessionKey),
+		})
+	})
+	return app
+}
+
+func setupPasskeyTest(t *testing.T) (*webauthn.RelyingParty, *fiber.App) {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+	InitForwardAuthHandler(testLogger())
+
+	storage, err := filestore.Open(filepath.Join(t.TempDir(), "passkeys.json"))
+	testza.AssertNoError(t, err)
+	rp, err := webauthn.New(webauthn.Config{RPID: "auth.example.com", Origins: []string{passkeyTestOrigin}}, webauthn.NewStore(storage))
+	testza.AssertNoError(t, err)
+	webauthn.Init(rp)
+	t.Cleanup(func() { webauthn.Init(nil) })
+	return rp, passkeyTestApp(t, rp)
+}
+
+// passkeyCall sends a JSON request and decodes the JSON answer. A renewed session cookie replaces
+// *cookie.
+func passkeyCall(t *testing.T, app *fiber.App, target string, body interface{}, cookie **http.Cookie) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	data, err := json.Marshal(body)
+	testza.AssertNoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(string(data)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if *cookie != nil {
+		req.AddCookie(*cookie)
+	}
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	if renewed := sessionCookie(resp); renewed != nil {
+		*cookie = renewed
+	}
+	var decoded map[string]interface{}
+	testza.AssertNoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+	return resp, decoded
+}
+
+// decodeOptions converts the publicKey options of a JSON answer into v.
+func decodeOptions(t *testing.T, body map[string]interface{}, v interface{}) {
+	t.Helper()
+	data, err := json.Marshal(body["publicKey"])
+	testza.AssertNoError(t, err)
+	testza.AssertNoError(t, json.Unmarshal(data, v))
+}
+
+// registerTestPasskey logs in as user-1 and registers a passkey on authenticator a.
+func registerTestPasskey(t *testing.T, app *fiber.App, a *webauthntest.Authenticator) *http.Cookie {
+	t.Helper()
+	cookie := sessionCookie(oidcRequest(t, app, "/test_login", nil))
+	testza.AssertNotNil(t, cookie)
+
+	resp, body := passkeyCall(t, app, PasskeyRegisterOptionsPath, nil, &cookie)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	var options webauthn.CreationOptions
+	decodeOptions(t, body, &options)
+	testza.AssertEqual(t, "alice@example.com", options.User.Name)
+
+	credential, err := a.Create(options)
+	testza.AssertNoError(t, err)
+	resp, body = passkeyCall(t, app, PasskeyRegisterPath, fiber.Map{"name": "Laptop", "credential": credential}, &cookie)
+	testza.AssertEqual(t, fiber.StatusCreated, resp.StatusCode)
+	testza.AssertEqual(t, "Laptop", body["passkey"].(map[string]interface{})["name"])
+	return cookie
+}
+
+// passkeyLogin signs in with a on a fresh session and returns the answer and session cookie.
+func passkeyLogin(t *testing.T, app *fiber.App, a *webauthntest.Authenticator, query string) (*http.Response, map[string]interface{}, *http.Cookie) {
+	t.Helper()
+	var cookie *http.Cookie
+	resp, body := passkeyCall(t, app, PasskeyLoginOptionsPath+query, nil, &cookie)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	var options webauthn.RequestOptions
+	decodeOptions(t, body, &options)
+	testza.AssertEqual(t, 0, len(options.AllowCredentials))
+
+	credential, err := a.Get(options)
+	testza.AssertNoError(t, err)
+	resp, body = passkeyCall(t, app, PasskeyLoginPath, credential, &cookie)
+	return resp, body, cookie
+}
+
+func TestPasskeys_RegisterAndLogin(t *testing.T) {
+	rp, app := setupPasskeyTest(t)
+	a := webauthntest.New(passkeyTestOrigin)
+	cookie := registerTestPasskey(t, app, a)
+
+	list, err := rp.Store().List("user-1")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 1)
+	testza.AssertEqual(t, webauthn.Owner{UserID: "user-1", Email: "alice@example.com", Role: "admin", Scopes: []string{"read", "write"}}, list[0].Owner)
+
+	req := httptest.NewRequest(http.MethodGet, PasskeysPath, nil)
+	req.Header.Set("Accept", "application/json")
+	req.AddCookie(cookie)
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	var listed map[string][]map[string]interface{}
+	testza.AssertNoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+	testza.AssertLen(t, listed["passkeys"], 1)
+	testza.AssertNil(t, listed["passkeys"][0]["public_key"])
+
+	// The passkey signs in as its owner, with a one-time code for the callback host
+	resp, body, loginCookie := passkeyLogin(t, app, a, "?callback="+url.QueryEscape("https://app.example.com/dashboard"))
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode, body)
+	exchange, err := url.Parse(body["redirect"].(string))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "app.example.com", exchange.Host)
+	testza.AssertEqual(t, "/_session_exchange", exchange.Path)
+	testza.AssertNotEqual(t, "", exchange.Query().Get("code"))
+
+	session := whoami(t, app, loginCookie)
+	testza.AssertEqual(t, true, session["authenticated"])
+	testza.AssertEqual(t, "user-1", session["user_id"])
+	testza.AssertEqual(t, "alice@example.com", session["user_mail"])
+	testza.AssertEqual(t, "admin", session["user_role"])
+	testza.AssertEqual(t, []interface{}{"read", "write"}, session["user_scope"])
+	testza.AssertEqual(t, []interface{}{webauthn.AMRHardwareKey}, session["user_amr"])
+}
+
+func TestPasskeys_SyncedLoginRecordsSWK(t *testing.T) {
+	_, app := setupPasskeyTest(t)
+	a := webauthntest.New(passkeyTestOrigin)
+	a.Synced = true
+	registerTestPasskey(t, app, a)
+
+	resp, body, cookie := passkeyLogin(t, app, a, "")
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode, body)
+	testza.AssertEqual(t, "/", body["redirect"])
+	testza.AssertEqual(t, []interface{}{webauthn.AMRSoftwareKey}, whoami(t, app, cookie)["user_amr"])
+}
+
+func TestPasskeys_LoginRejects(t *testing.T) {
+	_, app := setupPasskeyTest(t)
+	a := webauthntest.New(passkeyTestOrigin)
+
+	// Unknown passkey
+	unknown := webauthntest.New(passkeyTestOrigin)
+	_, err := unknown.Create(webauthn.CreationOptions{RP: webauthn.RPEntity{ID: "auth.example.com"}, User: webauthn.UserEntity{ID: "x"}, Challenge: "x"})
+	testza.AssertNoError(t, err)
+	resp, _, cookie := passkeyLogin(t, app, unknown, "")
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	testza.AssertEqual(t, false, whoami(t, app, cookie)["authenticated"])
+
+	registerTestPasskey(t, app, a)
+
+	// Callback outside the allowlist
+	var none *http.Cookie
+	resp, _ = passkeyCall(t, app, PasskeyLoginOptionsPath+"?callback="+url.QueryEscape("https://evil.example.net/"), nil, &none)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	// No pending challenge
+	challenge, _ := webauthn.NewChallenge()
+	credential, err := a.Get(webauthn.RequestOptions{Challenge: challenge, RPID: "auth.example.com"})
+	testza.AssertNoError(t, err)
+	resp, _ = passkeyCall(t, app, PasskeyLoginPath, credential, &none)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	// A challenge answers once
+	var replay *http.Cookie
+	resp, body := passkeyCall(t, app, PasskeyLoginOptionsPath, nil, &replay)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	var options webauthn.RequestOptions
+	decodeOptions(t, body, &options)
+	credential, err = a.Get(options)
+	testza.AssertNoError(t, err)
+	resp, _ = passkeyCall(t, app, PasskeyLoginPath, credential, &replay)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	resp, _ = passkeyCall(t, app, PasskeyLoginPath, credential, &replay)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPasskeys_RegisterRequiresUser(t *testing.T) {
+	_, app := setupPasskeyTest(t)
+
+	var anonymous *http.Cookie
+	resp, _ := passkeyCall(t, app, PasskeyRegisterOptionsPath, nil, &anonymous)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+	cookie := sessionCookie(oidcRequest(t, app, "/test_login_password", nil))
+	resp, body := passkeyCall(t, app, PasskeyRegisterOptionsPath, nil, &cookie)
+	testza.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode)
+	testza.AssertEqual(t, "no_user_id", body["error"])
+
+	// Registration needs the challenge from the options
+	cookie = sessionCookie(oidcRequest(t, app, "/test_login", nil))
+	credential, err := webauthntest.New(passkeyTestOrigin).Create(webauthn.CreationOptions{RP: webauthn.RPEntity{ID: "auth.example.com"}, User: webauthn.UserEntity{ID: "x"}, Challenge: "x"})
+	testza.AssertNoError(t, err)
+	resp, body = passkeyCall(t, app, PasskeyRegisterPath, fiber.Map{"name": "Laptop", "credential": credential}, &cookie)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+	testza.AssertEqual(t, "challenge_expired", body["error"])
+}
+
+func TestPasskeys_Remove(t *testing.T) {
+	rp, app := setupPasskeyTest(t)
+	a := webauthntest.New(passkeyTestOrigin)
+	cookie := registerTestPasskey(t, app, a)
+	list, err := rp.Store().List("user-1")
+	testza.AssertNoError(t, err)
+
+	resp, _ := passkeyCall(t, app, PasskeyRemovePath, fiber.Map{"id": list[0].ID}, &cookie)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	resp, _ = passkeyCall(t, app, PasskeyRemovePath, fiber.Map{"id": list[0].ID}, &cookie)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+
+	resp, _, _ = passkeyLogin(t, app, a, "")
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestPasskeys_StepUp(t *testing.T) {
+	_, app := setupPasskeyTest(t)
+	a := webauthntest.New(passkeyTestOrigin)
+	cookie := registerTestPasskey(t, app, a)
+
+	resp, body := passkeyCall(t, app, StepUpPasskeyOptionsPath, nil, &cookie)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	var options webauthn.RequestOptions
+	decodeOptions(t, body, &options)
+	testza.AssertLen(t, options.AllowCredentials, 1)
+	credential, err := a.Get(options)
+	testza.AssertNoError(t, err)
+	data, err := json.Marshal(credential)
+	testza.AssertNoError(t, err)
+
+	form := url.Values{"method": {"passkey"}, "credential": {string(data)}, "return_to": {"/admin"}}
+	stepUp := func() *http.Response {
+		req := httptest.NewRequest(http.MethodPost, StepUpPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		req.AddCookie(cookie)
+		resp, err := app.Test(req)
+		testza.AssertNoError(t, err)
+		return resp
+	}
+	resp = stepUp()
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	// Step-up rotated the session ID
+	cookie = sessionCookie(resp)
+	testza.AssertNotNil(t, cookie)
+	session := whoami(t, app, cookie)
+	testza.AssertEqual(t, "passkey", session["step_up_method"])
+	testza.AssertEqual(t, []interface{}{"pwd", webauthn.AMRHardwareKey}, session["user_amr"])
+
+	// The challenge is spent
+	resp = stepUp()
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPasskeys_StepUpUnavailableWithoutPasskey(t *testing.T) {
+	_, app := setupPasskeyTest(t)
+	cookie := sessionCookie(oidcRequest(t, app, "/test_login", nil))
+	resp, _ := passkeyCall(t, app, StepUpPasskeyOptionsPath, nil, &cookie)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPasskeys_Disabled(t *testing.T) {
+	app := passkeyTestApp(t, nil)
+	var cookie *http.Cookie
+	resp, _ := passkeyCall(t, app, PasskeyLoginOptionsPath, nil, &cookie)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+	resp, _ = passkeyCall(t, app, PasskeyRegisterOptionsPath, nil, &cookie)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+}
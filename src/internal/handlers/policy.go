@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+
+	"github.com/soulteary/stargate/src/internal/auditlog"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/metrics"
+	"github.com/soulteary/stargate/src/internal/policy"
+)
+
+// policyRequest describes the forwarded request for policy evaluation: the original host, URI
+// and method as reported by the reverse proxy (X-Forwarded-Method, falling back to the request method).
+func policyRequest(ctx *fiber.Ctx) policy.Request {
+	method := ctx.Get("X-Forwarded-Method")
+	if method == "" {
+		method = ctx.Method()
+	}
+	return policy.Request{
+		Host:   GetForwardedHost(ctx),
+		Path:   GetForwardedURI(ctx),
+		Method: method,
+	}
+}
+
+// policySubject reads the user's identity, role, scopes and AMR from the session.
+// userID is the authenticated user ID from forwardauth-kit, used when the session has none.
+func policySubject(sess *session.Session, userID string) policy.Subject {
+	s := policy.Subject{UserID: userID}
+	if id, _ := sess.Get("user_id").(string); id != "" {
+		s.UserID = id
+	}
+	s.Role, _ = sess.Get("user_role").(string)
+	s.Scopes = sessionStrings(sess.Get("user_scope"))
+	s.AMR = sessionStrings(sess.Get(amrSessionKey))
+	return s
+}
+
+// sessionStrings converts a session value holding a list of strings to []string.
+// Depending on the storage backend a list may come back as []string, []interface{} or a
+// comma-separated string.
+func sessionStrings(v interface{}) []string {
+	switch values := v.(type) {
+	case []string:
+		return values
+	case []interface{}:
+		result := make([]string, 0, len(values))
+		for _, value := range values {
+			if s, ok := value.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	case string:
+		if values == "" {
+			return nil
+		}
+		result := strings.Split(values, ",")
+		for i := range result {
+			result[i] = strings.TrimSpace(result[i])
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+// handlePolicyDenied answers a request refused by the access policy with 403: a localized page
+// for browsers (signing in again would not help, so there is no login redirect) and an error
+// body for API clients.
+func handlePolicyDenied(ctx *fiber.Ctx, subject policy.Subject, decision policy.Decision) error {
+	originalURL := getOriginalURL(ctx)
+	metrics.RecordPolicyDenied(decision.Reason)
+	auditlog.LogPolicyDenied(ctx.Context(), subject.UserID, originalURL, GetClientIP(ctx), decision.Rule, decision.Reason)
+	log.Info().
+		Str("user_id", subject.UserID).
+		Str("url", originalURL).
+		Str("rule", decision.Rule).
+		Str("reason", decision.Reason).
+		Msg("Request denied by access policy")
+
+	if !IsHTMLRequest(ctx) {
+		return SendErrorResponse(ctx, fiber.StatusForbidden, i18n.T(ctx, "error.access_denied"))
+	}
+	ctx.Status(fiber.StatusForbidden)
+	return ctx.Render("forbidden", fiber.Map{
+		"Title":         config.LoginPageTitle.Value,
+		"Heading":       i18n.T(ctx, "info.access_denied_title"),
+		"Message":       i18n.T(ctx, "error.access_denied"),
+		"SwitchAccount": i18n.T(ctx, "info.switch_account"),
+		"LogoutURL":     fmt.Sprintf("%s://%s/_logout", GetForwardedProto(ctx), config.AuthHost.String()),
+	})
+}
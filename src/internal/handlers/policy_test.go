@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/template/html"
+	"github.com/valyala/fasthttp"
+
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/policy"
+)
+
+const testAccessPolicy = `
+rules:
+  - name: public
+    hosts: ["status.example.com"]
+    action: public
+  - name: admins
+    hosts: ["admin.example.com"]
+    roles: [admin]
+  - name: ops-writes
+    hosts: ["ops.example.com"]
+    methods: [POST]
+    scopes: [ops]
+    amr: [otp]
+`
+
+// useTestPolicy installs the policy document for the test.
+func useTestPolicy(t *testing.T, doc string) {
+	t.Helper()
+	p, err := policy.Parse([]byte(doc))
+	testza.AssertNoError(t, err)
+	policy.Init(p)
+	t.Cleanup(func() { policy.Init(nil) })
+}
+
+// checkWithSession runs CheckRoute for a forwarded request, with an authenticated session
+// holding values when values is not nil.
+func checkWithSession(t *testing.T, ctx *fiber.Ctx, values map[string]interface{}) {
+	t.Helper()
+	store := setupTestStore()
+	if values != nil {
+		sess, err := store.Get(ctx)
+		testza.AssertNoError(t, err)
+		for k, v := range values {
+			sess.Set(k, v)
+		}
+		testza.AssertNoError(t, auth.Authenticate(sess))
+	}
+	testza.AssertNoError(t, CheckRoute(store)(ctx))
+}
+
+func TestCheckRoute_Policy_PublicWithoutSession(t *testing.T) {
+	useTestPolicy(t, testAccessPolicy)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":           "text/html",
+		"X-Forwarded-Host": "status.example.com",
+		"X-Forwarded-Uri":  "/",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	checkWithSession(t, ctx, nil)
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+}
+
+func TestCheckRoute_Policy_UnauthenticatedStillRedirects(t *testing.T) {
+	useTestPolicy(t, testAccessPolicy)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":           "text/html",
+		"X-Forwarded-Host": "admin.example.com",
+		"X-Forwarded-Uri":  "/",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	checkWithSession(t, ctx, nil)
+	testza.AssertEqual(t, fiber.StatusFound, ctx.Response().StatusCode())
+}
+
+func TestCheckRoute_Policy_RoleAllowed(t *testing.T) {
+	useTestPolicy(t, testAccessPolicy)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":           "application/json",
+		"X-Forwarded-Host": "admin.example.com",
+		"X-Forwarded-Uri":  "/",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	checkWithSession(t, ctx, map[string]interface{}{"user_id": "u-1", "user_role": "admin"})
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+}
+
+func TestCheckRoute_Policy_DeniedAPI(t *testing.T) {
+	useTestPolicy(t, testAccessPolicy)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":           "application/json",
+		"X-Forwarded-Host": "admin.example.com",
+		"X-Forwarded-Uri":  "/",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	checkWithSession(t, ctx, map[string]interface{}{"user_id": "u-2", "user_role": "viewer"})
+	testza.AssertEqual(t, fiber.StatusForbidden, ctx.Response().StatusCode())
+	testza.AssertContains(t, string(ctx.Response().Body()), i18n.TStatic("error.access_denied"))
+	testza.AssertEqual(t, "", string(ctx.Response().Header.Peek("Location")))
+}
+
+func TestCheckRoute_Policy_DeniedHTML(t *testing.T) {
+	useTestPolicy(t, testAccessPolicy)
+
+	app := fiber.New(fiber.Config{Views: html.New("../web/templates", ".html")})
+	ctx := app.AcquireCtx(&fasthttp.RequestCtx{})
+	defer app.ReleaseCtx(ctx)
+	ctx.Request().SetRequestURI("/_auth")
+	ctx.Request().Header.Set("Accept", "text/html")
+	ctx.Request().Header.Set("X-Forwarded-Proto", "https")
+	ctx.Request().Header.Set("X-Forwarded-Host", "admin.example.com")
+	ctx.Request().Header.Set("X-Forwarded-Uri", "/settings")
+	ctx.Locals("i18n-bundle", i18n.GetBundle())
+	ctx.Locals("i18n-language", i18n.LangEN)
+
+	checkWithSession(t, ctx, map[string]interface{}{"user_id": "u-2"})
+	testza.AssertEqual(t, fiber.StatusForbidden, ctx.Response().StatusCode())
+	body := string(ctx.Response().Body())
+	testza.AssertContains(t, body, i18n.TStatic("info.access_denied_title"))
+	testza.AssertContains(t, body, "https://auth.example.com/_logout")
+}
+
+func TestCheckRoute_Policy_ScopesAndAMR(t *testing.T) {
+	useTestPolicy(t, testAccessPolicy)
+
+	tests := []struct {
+		name     string
+		method   string
+		values   map[string]interface{}
+		expected int
+	}{
+		{"read needs nothing extra", "GET", map[string]interface{}{"user_id": "u-1"}, fiber.StatusOK},
+		{"write with scope and otp", "POST", map[string]interface{}{"user_scope": []string{"read", "ops"}, amrSessionKey: []string{"sms", "otp"}}, fiber.StatusOK},
+		{"write without otp", "POST", map[string]interface{}{"user_scope": []string{"ops"}, amrSessionKey: []string{"sms"}}, fiber.StatusForbidden},
+		{"write without scope", "POST", map[string]interface{}{"user_scope": []string{"read"}, amrSessionKey: []string{"otp"}}, fiber.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, app := createTestContext("GET", "/_auth", map[string]string{
+				"Accept":             "application/json",
+				"X-Forwarded-Host":   "ops.example.com",
+				"X-Forwarded-Method": tt.method,
+				"X-Forwarded-Uri":    "/deploy",
+			}, "")
+			defer app.ReleaseCtx(ctx)
+
+			checkWithSession(t, ctx, tt.values)
+			testza.AssertEqual(t, tt.expected, ctx.Response().StatusCode())
+		})
+	}
+}
+
+func TestSessionStrings(t *testing.T) {
+	testza.AssertEqual(t, []string{"a", "b"}, sessionStrings([]string{"a", "b"}))
+	testza.AssertEqual(t, []string{"a", "b"}, sessionStrings([]interface{}{"a", 1, "b"}))
+	testza.AssertEqual(t, []string{"a", "b"}, sessionStrings("a, b"))
+	testza.AssertNil(t, sessionStrings(""))
+	testza.AssertNil(t, sessionStrings(nil))
+}
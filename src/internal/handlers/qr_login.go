@@ -0,0 +1,408 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+
+	"github.com/soulteary/stargate/src/internal/auditlog"
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/metrics"
+)
+
+const (
+	// QRLoginStartPath starts a QR login on the device that wants to sign in.
+	QRLoginStartPath = "/_login/qr"
+	// QRLoginStatusPath is polled by that device until the login is approved.
+	QRLoginStatusPath = "/_login/qr/status"
+	// QRLoginApprovePath is the page the QR code points to, and where the phone posts its decision.
+	QRLoginApprovePath = "/_login/qr/approve"
+	// QRLoginPollInterval is how often the login page polls QRLoginStatusPath.
+	QRLoginPollInterval = 2 * time.Second
+
+	// qrLoginDefaultTTL is used when QR_LOGIN_TTL is empty.
+	qrLoginDefaultTTL = 2 * time.Minute
+	// qrLoginKeyPrefix namespaces pending QR logins in the session storage.
+	qrLoginKeyPrefix = "qr_login:"
+	// qrLoginTokenSessionKey binds a pending QR login to the session of the device showing the code.
+	qrLoginTokenSessionKey = "qr_login_token"
+	// authMethodQR is the auth method reported in metrics and the audit log.
+	authMethodQR = "qr"
+	// amrMultiChannel is the RFC 8176 "mca" method: the login was approved over a second channel.
+	amrMultiChannel = "mca"
+
+	qrLoginPending  = "pending"
+	qrLoginApproved = "approved"
+	qrLoginDenied   = "denied"
+	qrLoginExpired  = "expired"
+)
+
+// qrLogin is a QR login waiting for approval, stored under its token. Once approved it carries
+// the identity of the approving session.
+type qrLogin struct {
+	Status    string    `json:"status"`
+	Callback  string    `json:"callback,omitempty"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	UserID string   `json:"user_id,omitempty"`
+	Mail   string   `json:"mail,omitempty"`
+	Phone  string   `json:"phone,omitempty"`
+	Name   string   `json:"name,omitempty"`
+	Role   string   `json:"role,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// qrLogins keeps pending QR logins in the session storage (memory or Redis), so that the phone and
+// the device showing the code may reach different Stargate instances.
+type qrLogins struct {
+	storage fiber.Storage
+}
+
+func newQRLogins(storage fiber.Storage) *qrLogins {
+	return &qrLogins{storage: storage}
+}
+
+// qrLoginTTL returns how long a QR code can be approved.
+func qrLoginTTL() time.Duration {
+	if ttl := config.QRLoginTTL.ToDuration(); ttl > 0 {
+		return ttl
+	}
+	return qrLoginDefaultTTL
+}
+
+// create stores login under a new random token.
+func (s *qrLogins) create(login *qrLogin) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, s.save(token, login)
+}
+
+// save stores login until it expires.
+func (s *qrLogins) save(token string, login *qrLogin) error {
+	ttl := time.Until(login.ExpiresAt)
+	if ttl <= 0 {
+		return s.storage.Delete(qrLoginKeyPrefix + token)
+	}
+	value, err := json.Marshal(login)
+	if err != nil {
+		return err
+	}
+	return s.storage.Set(qrLoginKeyPrefix+token, value, ttl)
+}
+
+// get returns the login stored under token, or nil if there is none or it expired.
+func (s *qrLogins) get(token string) (*qrLogin, error) {
+	if token == "" {
+		return nil, nil
+	}
+	value, err := s.storage.Get(qrLoginKeyPrefix + token)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var login qrLogin
+	if err := json.Unmarshal(value, &login); err != nil || time.Now().After(login.ExpiresAt) {
+		return nil, nil
+	}
+	return &login, nil
+}
+
+// remove deletes the login stored under token.
+func (s *qrLogins) remove(token string) error {
+	return s.storage.Delete(qrLoginKeyPrefix + token)
+}
+
+// qrLoginApproveURL is the URL encoded in the QR code.
+func qrLoginApproveURL(ctx *fiber.Ctx, token string) string {
+	return fmt.Sprintf("%s://%s%s?token=%s", GetForwardedProto(ctx), config.AuthHost.String(), QRLoginApprovePath, url.QueryEscape(token))
+}
+
+// qrLoginStartHandler creates a pending QR login for the device showing the login page. The token
+// is kept in that device's session, so only it can collect the approved login.
+func qrLoginStartHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, logins *qrLogins) error {
+	if !config.QRLoginEnabled.ToBool() {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.qr_login_disabled"))
+	}
+	callback := ctx.Query("callback")
+	if callback == "" {
+		callback = GetCallbackFromCookie(ctx)
+	}
+	if _, err := resolveCallback(ctx, callback); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.callback_not_allowed"))
+	}
+
+	sess, err := sessionGetter.Get(ctx)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	// A new code replaces the one shown before
+	if previous, _ := sess.Get(qrLoginTokenSessionKey).(string); previous != "" {
+		_ = logins.remove(previous)
+	}
+
+	now := time.Now()
+	ttl := qrLoginTTL()
+	token, err := logins.create(&qrLogin{
+		Status:    qrLoginPending,
+		Callback:  callback,
+		ClientIP:  GetClientIP(ctx),
+		UserAgent: ctx.Get("User-Agent"),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to store QR login")
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	sess.Set(qrLoginTokenSessionKey, token)
+	if err := sess.Save(); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+
+	return ctx.JSON(fiber.Map{
+		"success":     true,
+		"approve_url": qrLoginApproveURL(ctx, token),
+		"expires_in":  int(ttl.Seconds()),
+		"interval":    int(QRLoginPollInterval.Seconds()),
+	})
+}
+
+// qrLoginStatusHandler reports the state of the QR login started by this session, and signs the
+// session in once a phone approved it.
+func qrLoginStatusHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, authenticator Authenticator, codes ExchangeCodeStore, logins *qrLogins) error {
+	if !config.QRLoginEnabled.ToBool() {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.qr_login_disabled"))
+	}
+	sess, err := sessionGetter.Get(ctx)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	token, _ := sess.Get(qrLoginTokenSessionKey).(string)
+	login, err := logins.get(token)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	if login != nil && login.Status == qrLoginPending {
+		return ctx.JSON(fiber.Map{"status": qrLoginPending})
+	}
+
+	// Whatever happened, this code is done: the page has to show a new one
+	sess.Delete(qrLoginTokenSessionKey)
+	if login == nil || login.Status != qrLoginApproved {
+		if err := sess.Save(); err != nil {
+			return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+		}
+		status := qrLoginExpired
+		if login != nil {
+			status = login.Status
+			_ = logins.remove(token)
+		}
+		return ctx.JSON(fiber.Map{"status": status})
+	}
+	// Remove the approval before using it, so that it signs in one session only
+	if err := logins.remove(token); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+
+	sess.Set("user_id", login.UserID)
+	for key, value := range map[string]string{
+		"user_mail":  login.Mail,
+		"user_phone": login.Phone,
+		"user_name":  login.Name,
+		"user_role":  login.Role,
+	} {
+		if value != "" {
+			sess.Set(key, value)
+		}
+	}
+	if len(login.Scopes) > 0 {
+		sess.Set("user_scope", login.Scopes)
+	}
+	sess.Set(amrSessionKey, []string{amrMultiChannel})
+	if err := rotateSessionID(sess); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	indexSession(ctx, sess)
+	// Saving releases the session, so keep its ID for the exchange code
+	sessionID := sess.ID()
+	if err := authenticator.Authenticate(sess); err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.authenticate_failed"))
+	}
+
+	metrics.RecordAuthRequest(authMethodQR, "success")
+	auditlog.LogLogin(ctx.Context(), login.UserID, authMethodQR, GetClientIP(ctx), true, "")
+	metrics.RecordSessionCreated()
+	auditlog.LogSessionCreate(ctx.Context(), login.UserID, GetClientIP(ctx))
+
+	if GetCallbackFromCookie(ctx) != "" {
+		ClearCallbackCookie(ctx)
+	}
+
+	// The callback was validated when the login started; check again in case the allowlist changed
+	redirect := "/"
+	if target, err := resolveCallback(ctx, login.Callback); err == nil && target.host != "" {
+		code, err := codes.Mint(sessionID, target.host)
+		if err != nil {
+			return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+		}
+		redirect = buildSessionExchangeURL(ctx, target, code)
+	}
+	return ctx.JSON(fiber.Map{
+		"status":   qrLoginApproved,
+		"success":  true,
+		"redirect": redirect,
+		"message":  i18n.T(ctx, "success.login"),
+	})
+}
+
+// qrLoginApprover returns the session and user ID of the phone approving a QR login, or writes the
+// response for a phone that cannot approve and returns a nil session.
+func qrLoginApprover(ctx *fiber.Ctx, sessionGetter SessionGetter) (*session.Session, string, error) {
+	sess, userID, err := loggedInSession(ctx, sessionGetter)
+	if err != nil {
+		return nil, "", SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	if !auth.IsAuthenticated(sess) {
+		if IsHTMLRequest(ctx) {
+			return nil, "", ctx.Redirect(authHostLoginURL(ctx), fiber.StatusFound)
+		}
+		return nil, "", SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.auth_required"))
+	}
+	// Shared-password sessions have no identity to hand over
+	if userID == "" {
+		return nil, "", SendErrorResponse(ctx, fiber.StatusForbidden, i18n.T(ctx, "error.qr_login_no_user"))
+	}
+	return sess, userID, nil
+}
+
+// qrLoginApprovePageHandler shows the phone which device asks to sign in, with buttons to approve
+// or deny.
+func qrLoginApprovePageHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, logins *qrLogins) error {
+	if !config.QRLoginEnabled.ToBool() {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.qr_login_disabled"))
+	}
+	sess, userID, err := qrLoginApprover(ctx, sessionGetter)
+	if sess == nil {
+		return err
+	}
+	token := ctx.Query("token")
+	login, err := logins.get(token)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	if login == nil || login.Status != qrLoginPending {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.qr_login_expired"))
+	}
+
+	if !IsHTMLRequest(ctx) {
+		return ctx.JSON(fiber.Map{
+			"status":     login.Status,
+			"client_ip":  login.ClientIP,
+			"user_agent": login.UserAgent,
+			"created_at": login.CreatedAt,
+			"expires_at": login.ExpiresAt,
+		})
+	}
+	return ctx.Render("qr_approve", fiber.Map{
+		"Title":     config.LoginPageTitle.Value,
+		"Token":     token,
+		"UserID":    userID,
+		"ClientIP":  login.ClientIP,
+		"UserAgent": login.UserAgent,
+		"CreatedAt": login.CreatedAt,
+	})
+}
+
+// qrLoginApproveHandler records the phone's decision. Approving copies the phone session's identity
+// into the pending login, for the device showing the code to collect.
+func qrLoginApproveHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, logins *qrLogins) error {
+	if !config.QRLoginEnabled.ToBool() {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.qr_login_disabled"))
+	}
+	sess, userID, err := qrLoginApprover(ctx, sessionGetter)
+	if sess == nil {
+		return err
+	}
+	token := ctx.FormValue("token")
+	login, err := logins.get(token)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	if login == nil || login.Status != qrLoginPending {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.qr_login_expired"))
+	}
+
+	action := "qr_login_deny"
+	login.Status = qrLoginDenied
+	if ctx.FormValue("decision") == "approve" {
+		action = "qr_login_approve"
+		str := func(key string) string {
+			s, _ := sess.Get(key).(string)
+			return s
+		}
+		login.Status = qrLoginApproved
+		login.UserID = userID
+		login.Mail = str("user_mail")
+		login.Phone = str("user_phone")
+		login.Name = str("user_name")
+		login.Role = str("user_role")
+		login.Scopes = sessionStrings(sess.Get("user_scope"))
+	}
+	if err := logins.save(token, login); err != nil {
+		log.Error().Err(err).Msg("Failed to store QR login")
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	auditlog.LogQRLogin(ctx.Context(), userID, action, GetClientIP(ctx), login.ClientIP)
+	return ctx.JSON(fiber.Map{"success": true, "status": login.Status})
+}
+
+// QRLoginStartAPI handles POST requests to /_login/qr.
+func QRLoginStartAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	logins := newQRLogins(store.Storage)
+	return func(ctx *fiber.Ctx) error {
+		return qrLoginStartHandler(ctx, sessionGetter, logins)
+	}
+}
+
+// QRLoginStatusAPI handles GET requests to /_login/qr/status.
+func QRLoginStatusAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	authenticator := &AuthAuthenticator{}
+	codes := newStorageExchangeCodes(store.Storage)
+	logins := newQRLogins(store.Storage)
+	return func(ctx *fiber.Ctx) error {
+		return qrLoginStatusHandler(ctx, sessionGetter, authenticator, codes, logins)
+	}
+}
+
+// QRLoginApproveRoute handles GET requests to /_login/qr/approve.
+func QRLoginApproveRoute(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	logins := newQRLogins(store.Storage)
+	return func(ctx *fiber.Ctx) error {
+		return qrLoginApprovePageHandler(ctx, sessionGetter, logins)
+	}
+}
+
+// QRLoginApproveAPI handles POST requests to /_login/qr/approve.
+func QRLoginApproveAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	logins := newQRLogins(store.Storage)
+	return func(ctx *fiber.Ctx) error {
+		return qrLoginApproveHandler(ctx, sessionGetter, logins)
+	}
+}
@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+)
+
+// qrLoginTestApp serves the QR login routes, plus /test_login creating a session for user-1,
+// /test_login_password creating one without a user ID and /whoami dumping the session.
+func qrLoginTestApp(t *testing.T) (*fiber.App, *qrLogins) {
+	t.Helper()
+	store := setupTestStore()
+	sessionGetter := &SessionStoreAdapter{store: store}
+	codes := newStorageExchangeCodes(store.Storage)
+	logins := newQRLogins(store.Storage)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("i18n-bundle", i18n.GetBundle())
+		c.Locals("i18n-language", i18n.LangEN)
+		return c.Next()
+	})
+	app.Post(QRLoginStartPath, func(c *fiber.Ctx) error {
+		return qrLoginStartHandler(c, sessionGetter, logins)
+	})
+	app.Get(QRLoginStatusPath, func(c *fiber.Ctx) error {
+		return qrLoginStatusHandler(c, sessionGetter, &AuthAuthenticator{}, codes, logins)
+	})
+	app.Get(QRLoginApprovePath, func(c *fiber.Ctx) error {
+		return qrLoginApprovePageHandler(c, sessionGetter, logins)
+	})
+	app.Post(QRLoginApprovePath, func(c *fiber.Ctx) error {
+		return qrLoginApproveHandler(c, sessionGetter, logins)
+	})
+	app.Get("/test_login", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("user_id", "user-1")
+		sess.Set("user_mail", "alice@example.com")
+		sess.Set("user_role", "admin")
+		sess.Set("user_scope", []string{"read", "write"})
+		sess.Set(amrSessionKey, []string{"pwd"})
+		return (&AuthAuthenticator{}).Authenticate(sess)
+	})
+	app.Get("/test_login_password", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		return (&AuthAuthenticator{}).Authenticate(sess)
+	})
+	app.Get("/whoami", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(fiber.Map{
+			"authenticated": auth.IsAuthenticated(sess),
+			"user_id":       sess.Get("user_id"),
+			"user_mail":     sess.Get("user_mail"),
+			"user_role":     sess.Get("user_role"),
+			"user_scope":    sess.Get("user_scope"),
+			"user_amr":      sess.Get(amrSessionKey),
+		})
+	})
+	return app, logins
+}
+
+func setupQRLoginTest(t *testing.T, enabled string) (*fiber.App, *qrLogins) {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("QR_LOGIN_ENABLED", enabled)
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+	InitForwardAuthHandler(testLogger())
+	return qrLoginTestApp(t)
+}
+
+// qrCall sends a request with cookie and decodes the JSON answer. A renewed session cookie
+// replaces *cookie.
+func qrCall(t *testing.T, app *fiber.App, method, target string, form url.Values, cookie **http.Cookie) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	req.Header.Set("Accept", "application/json")
+	if *cookie != nil {
+		req.AddCookie(*cookie)
+	}
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	if c := sessionCookie(resp); c != nil {
+		*cookie = c
+	}
+	var body map[string]interface{}
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	return resp, body
+}
+
+// startQRLogin starts a QR login on a new desktop session and returns that session's cookie
+// and the token from the approval URL.
+func startQRLogin(t *testing.T, app *fiber.App, query string) (*http.Cookie, string) {
+	t.Helper()
+	var desktop *http.Cookie
+	resp, body := qrCall(t, app, http.MethodPost, QRLoginStartPath+query, nil, &desktop)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode, body)
+	testza.AssertNotNil(t, desktop)
+	approve, err := url.Parse(body["approve_url"].(string))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "auth.example.com", approve.Host)
+	testza.AssertEqual(t, QRLoginApprovePath, approve.Path)
+	return desktop, approve.Query().Get("token")
+}
+
+// phoneSession returns the cookie of a session signed in through route.
+func phoneSession(t *testing.T, app *fiber.App, route string) *http.Cookie {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, route, nil))
+	testza.AssertNoError(t, err)
+	cookie := sessionCookie(resp)
+	testza.AssertNotNil(t, cookie)
+	return cookie
+}
+
+func TestQRLogin_ApproveOnPhone(t *testing.T) {
+	app, _ := setupQRLoginTest(t, "true")
+	desktop, token := startQRLogin(t, app, "?callback="+url.QueryEscape("https://app.example.com/dashboard"))
+
+	_, body := qrCall(t, app, http.MethodGet, QRLoginStatusPath, nil, &desktop)
+	testza.AssertEqual(t, "pending", body["status"])
+
+	// The phone sees which device asks before approving
+	phone := phoneSession(t, app, "/test_login")
+	resp, body := qrCall(t, app, http.MethodGet, QRLoginApprovePath+"?token="+url.QueryEscape(token), nil, &phone)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode, body)
+	testza.AssertEqual(t, "pending", body["status"])
+	testza.AssertNotNil(t, body["client_ip"])
+
+	resp, body = qrCall(t, app, http.MethodPost, QRLoginApprovePath, url.Values{"token": {token}, "decision": {"approve"}}, &phone)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode, body)
+	testza.AssertEqual(t, "approved", body["status"])
+
+	resp, body = qrCall(t, app, http.MethodGet, QRLoginStatusPath, nil, &desktop)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode, body)
+	testza.AssertEqual(t, "approved", body["status"])
+	exchange, err := url.Parse(body["redirect"].(string))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "app.example.com", exchange.Host)
+	testza.AssertEqual(t, "/_session_exchange", exchange.Path)
+
+	session := whoami(t, app, desktop)
+	testza.AssertEqual(t, true, session["authenticated"])
+	testza.AssertEqual(t, "user-1", session["user_id"])
+	testza.AssertEqual(t, "alice@example.com", session["user_mail"])
+	testza.AssertEqual(t, "admin", session["user_role"])
+	testza.AssertEqual(t, []interface{}{"read", "write"}, session["user_scope"])
+	testza.AssertEqual(t, []interface{}{amrMultiChannel}, session["user_amr"])
+
+	// The approval signs in one session only
+	_, body = qrCall(t, app, http.MethodGet, QRLoginStatusPath, nil, &desktop)
+	testza.AssertEqual(t, "expired", body["status"])
+	resp, _ = qrCall(t, app, http.MethodPost, QRLoginApprovePath, url.Values{"token": {token}, "decision": {"approve"}}, &phone)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+}
+
+func TestQRLogin_Deny(t *testing.T) {
+	app, _ := setupQRLoginTest(t, "true")
+	desktop, token := startQRLogin(t, app, "")
+
+	phone := phoneSession(t, app, "/test_login")
+	_, body := qrCall(t, app, http.MethodPost, QRLoginApprovePath, url.Values{"token": {token}, "decision": {"deny"}}, &phone)
+	testza.AssertEqual(t, "denied", body["status"])
+
+	_, body = qrCall(t, app, http.MethodGet, QRLoginStatusPath, nil, &desktop)
+	testza.AssertEqual(t, "denied", body["status"])
+	testza.AssertEqual(t, false, whoami(t, app, desktop)["authenticated"])
+}
+
+func TestQRLogin_OnlyStartingBrowserCollects(t *testing.T) {
+	app, _ := setupQRLoginTest(t, "true")
+	desktop, token := startQRLogin(t, app, "")
+	phone := phoneSession(t, app, "/test_login")
+	qrCall(t, app, http.MethodPost, QRLoginApprovePath, url.Values{"token": {token}, "decision": {"approve"}}, &phone)
+
+	// Another browser polling has no pending login of its own
+	var other *http.Cookie
+	_, body := qrCall(t, app, http.MethodGet, QRLoginStatusPath, nil, &other)
+	testza.AssertEqual(t, "expired", body["status"])
+
+	_, body = qrCall(t, app, http.MethodGet, QRLoginStatusPath, nil, &desktop)
+	testza.AssertEqual(t, "approved", body["status"])
+	testza.AssertEqual(t, "/", body["redirect"])
+}
+
+func TestQRLogin_ApproverNeedsUser(t *testing.T) {
+	app, _ := setupQRLoginTest(t, "true")
+	_, token := startQRLogin(t, app, "")
+	form := url.Values{"token": {token}, "decision": {"approve"}}
+
+	var anonymous *http.Cookie
+	resp, _ := qrCall(t, app, http.MethodPost, QRLoginApprovePath, form, &anonymous)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+	password := phoneSession(t, app, "/test_login_password")
+	resp, _ = qrCall(t, app, http.MethodPost, QRLoginApprovePath, form, &password)
+	testza.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode)
+
+	// Unknown tokens are reported as expired
+	phone := phoneSession(t, app, "/test_login")
+	resp, _ = qrCall(t, app, http.MethodGet, QRLoginApprovePath+"?token=unknown", nil, &phone)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+}
+
+func TestQRLogin_Expired(t *testing.T) {
+	app, logins := setupQRLoginTest(t, "true")
+	desktop, token := startQRLogin(t, app, "")
+
+	login, err := logins.get(token)
+	testza.AssertNoError(t, err)
+	login.ExpiresAt = time.Now().Add(-time.Second)
+	testza.AssertNoError(t, logins.storage.Set(qrLoginKeyPrefix+token, mustJSON(t, login), time.Minute))
+
+	phone := phoneSession(t, app, "/test_login")
+	resp, _ := qrCall(t, app, http.MethodPost, QRLoginApprovePath, url.Values{"token": {token}, "decision": {"approve"}}, &phone)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+	_, body := qrCall(t, app, http.MethodGet, QRLoginStatusPath, nil, &desktop)
+	testza.AssertEqual(t, "expired", body["status"])
+}
+
+func TestQRLogin_Disabled(t *testing.T) {
+	app, _ := setupQRLoginTest(t, "false")
+	var cookie *http.Cookie
+	resp, _ := qrCall(t, app, http.MethodPost, QRLoginStartPath, nil, &cookie)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+	resp, _ = qrCall(t, app, http.MethodGet, QRLoginStatusPath, nil, &cookie)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+}
+
+func TestQRLogin_RejectsForeignCallback(t *testing.T) {
+	app, _ := setupQRLoginTest(t, "true")
+	var cookie *http.Cookie
+	resp, _ := qrCall(t, app, http.MethodPost, QRLoginStartPath+"?callback="+url.QueryEscape("https://evil.example.net/"), nil, &cookie)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	testza.AssertNoError(t, err)
+	return b
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	secure "github.com/soulteary/secure-kit"
+	"github.com/soulteary/stargate/src/internal/auditlog"
+	"github.com/soulteary/stargate/src/internal/metrics"
+	"github.com/soulteary/stargate/src/internal/ratelimit"
+)
+
+// errRateLimited is recorded on spans of requests refused by the rate limiter.
+var errRateLimited = errors.New("rate limited")
+
+// rateLimitIdentifier returns the identifier a login or code send is counted against:
+// the phone number when given, otherwise the lower-cased email address.
+func rateLimitIdentifier(phone, mail string) string {
+	if phone != "" {
+		return phone
+	}
+	return strings.ToLower(strings.TrimSpace(mail))
+}
+
+// maskIdentifier masks an identifier for logs and audit records.
+func maskIdentifier(identifier string) string {
+	if identifier == "" {
+		return ""
+	}
+	if strings.Contains(identifier, "@") {
+		return secure.MaskEmail(identifier)
+	}
+	return secure.MaskPhone(identifier)
+}
+
+// rateLimitRetryAfter returns how long any of keys is still locked out, or 0 when the request may proceed.
+// A refused request is counted in metrics and audited. Store errors are logged and the request is allowed,
+// so an unavailable Redis does not lock every user out.
+func rateLimitRetryAfter(ctx *fiber.Ctx, scope, identifier string, keys ...ratelimit.Key) time.Duration {
+	limiter := ratelimit.Get()
+	if limiter == nil {
+		return 0
+	}
+	retryAfter, err := limiter.Check(ctx.Context(), keys...)
+	if err != nil {
+		log.Warn().Err(err).Str("scope", scope).Msg("Rate limit check failed, allowing request")
+		return 0
+	}
+	if retryAfter > 0 {
+		metrics.RecordRateLimit(scope, "blocked")
+		auditlog.LogRateLimited(ctx.Context(), scope, maskIdentifier(identifier), GetClientIP(ctx), "rate_limited", retryAfter)
+	}
+	return retryAfter
+}
+
+// recordRateLimitAttempt counts a failed login (or a code send) against keys.
+// A lockout started by this attempt is counted in metrics, audited and logged.
+func recordRateLimitAttempt(ctx *fiber.Ctx, scope, identifier string, keys ...ratelimit.Key) {
+	limiter := ratelimit.Get()
+	if limiter == nil {
+		return
+	}
+	lockout, err := limiter.Record(ctx.Context(), keys...)
+	if err != nil {
+		log.Warn().Err(err).Str("scope", scope).Msg("Failed to record rate limit attempt")
+		return
+	}
+	if lockout > 0 {
+		metrics.RecordRateLimit(scope, "lockout")
+		auditlog.LogRateLimited(ctx.Context(), scope, maskIdentifier(identifier), GetClientIP(ctx), "locked_out", lockout)
+		log.Warn().
+			Str("scope", scope).
+			Str("identifier", maskIdentifier(identifier)).
+			Str("ip", GetClientIP(ctx)).
+			Dur("lockout", lockout).
+			Msg("Too many attempts, locking out")
+	}
+}
+
+// resetRateLimit clears keys after a successful login.
+func resetRateLimit(ctx *fiber.Ctx, keys ...ratelimit.Key) {
+	limiter := ratelimit.Get()
+	if limiter == nil {
+		return
+	}
+	if err := limiter.Reset(ctx.Context(), keys...); err != nil {
+		log.Warn().Err(err).Msg("Failed to reset rate limit counters")
+	}
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounded up.
+func setRetryAfter(ctx *fiber.Ctx, retryAfter time.Duration) {
+	ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
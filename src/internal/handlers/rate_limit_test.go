@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/ratelimit"
+)
+
+// useTestRateLimiter installs an in-memory limiter with a one minute base lockout for the test.
+func useTestRateLimiter(t *testing.T) {
+	t.Helper()
+	ratelimit.Init(ratelimit.New(ratelimit.NewMemoryStore(), ratelimit.Policy{Lockout: time.Minute, MaxLockout: time.Hour}))
+	t.Cleanup(func() { ratelimit.Init(nil) })
+}
+
+// postLogin sends a login form to handler and returns the status code, Retry-After header and body.
+func postLogin(t *testing.T, handler fiber.Handler, body string) (int, string, string) {
+	t.Helper()
+	ctx, app := createTestContext("POST", "/_login", map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	}, body)
+	defer app.ReleaseCtx(ctx)
+
+	testza.AssertNoError(t, handler(ctx))
+	return ctx.Response().StatusCode(), string(ctx.Response().Header.Peek(fiber.HeaderRetryAfter)), string(ctx.Response().Body())
+}
+
+func TestLoginAPI_RateLimit_PasswordLockout(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("RATE_LIMIT_IP_MAX_FAILURES", "3")
+	err := config.Initialize(testLogger())
+	testza.AssertNoError(t, err)
+	useTestRateLimiter(t)
+
+	handler := LoginAPI(setupTestStore())
+	for i := 0; i < 3; i++ {
+		status, _, _ := postLogin(t, handler, "password=wrong")
+		testza.AssertEqual(t, fiber.StatusUnauthorized, status)
+	}
+
+	// Locked out: even the right password is refused until the lockout ends
+	status, retryAfter, body := postLogin(t, handler, "password=test123")
+	testza.AssertEqual(t, fiber.StatusTooManyRequests, status)
+	testza.AssertEqual(t, "60", retryAfter)
+	testza.AssertContains(t, body, i18n.TStatic("error.rate_limited_retry"))
+}
+
+func TestLoginAPI_RateLimit_SuccessResetsPasswordFailures(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("RATE_LIMIT_IP_MAX_FAILURES", "3")
+	err := config.Initialize(testLogger())
+	testza.AssertNoError(t, err)
+	useTestRateLimiter(t)
+
+	handler := LoginAPI(setupTestStore())
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 2; i++ {
+			status, _, _ := postLogin(t, handler, "password=wrong")
+			testza.AssertEqual(t, fiber.StatusUnauthorized, status)
+		}
+		status, _, _ := postLogin(t, handler, "password=test123")
+		testza.AssertEqual(t, fiber.StatusOK, status)
+	}
+}
+
+func TestLoginAPI_RateLimit_Disabled(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("RATE_LIMIT_IP_MAX_FAILURES", "1")
+	err := config.Initialize(testLogger())
+	testza.AssertNoError(t, err)
+	ratelimit.Init(nil)
+
+	handler := LoginAPI(setupTestStore())
+	for i := 0; i < 3; i++ {
+		status, _, _ := postLogin(t, handler, "password=wrong")
+		testza.AssertEqual(t, fiber.StatusUnauthorized, status)
+	}
+}
+
+func TestLoginAPI_RateLimit_WardenIdentifier(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("WARDEN_ENABLED", "true")
+	t.Setenv("RATE_LIMIT_MAX_FAILURES", "2")
+
+	wardenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer wardenServer.Close()
+	t.Setenv("WARDEN_URL", wardenServer.URL)
+
+	auth.ResetWardenClientForTesting()
+	testLog := testLogger()
+	err := config.Initialize(testLog)
+	testza.AssertNoError(t, err)
+	auth.InitWardenClient(testLog)
+	SetLogger(testLog)
+	useTestRateLimiter(t)
+
+	handler := LoginAPI(setupTestStore())
+	for i := 0; i < 2; i++ {
+		status, _, _ := postLogin(t, handler, "auth_method=warden&mail=probe@example.com")
+		testza.AssertEqual(t, fiber.StatusUnauthorized, status)
+	}
+
+	// Same identifier, different case: locked out
+	status, retryAfter, _ := postLogin(t, handler, "auth_method=warden&mail=Probe@Example.com")
+	testza.AssertEqual(t, fiber.StatusTooManyRequests, status)
+	testza.AssertEqual(t, "60", retryAfter)
+
+	// Another identifier from the same IP is still below the IP limit
+	status, _, _ = postLogin(t, handler, "auth_method=warden&mail=other@example.com")
+	testza.AssertEqual(t, fiber.StatusUnauthorized, status)
+}
+
+func TestSendVerifyCodeAPI_RateLimited(t *testing.T) {
+	setupSendVerifyCodeBaseEnv(t)
+	t.Setenv("HERALD_ENABLED", "true")
+	t.Setenv("WARDEN_ENABLED", "true")
+	t.Setenv("RATE_LIMIT_MAX_SENDS", "2")
+
+	wardenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer wardenServer.Close()
+	t.Setenv("WARDEN_URL", wardenServer.URL)
+
+	auth.ResetWardenClientForTesting()
+	resetHeraldClientForTesting()
+	testLog := testLoggerSendVerifyCode()
+	err := config.Initialize(testLog)
+	testza.AssertNoError(t, err)
+	auth.InitWardenClient(testLog)
+	SetLogger(testLog)
+	useTestRateLimiter(t)
+
+	handler := SendVerifyCodeAPI(session.New())
+	send := func() (int, string, string) {
+		ctx, app := createTestContext("POST", "/_send_verify_code", map[string]string{
+			"Content-Type": "application/x-www-form-urlencoded",
+			"Accept":       "application/json",
+		}, "phone=13800138000")
+		defer app.ReleaseCtx(ctx)
+		testza.AssertNoError(t, handler(ctx))
+		return ctx.Response().StatusCode(), string(ctx.Response().Header.Peek(fiber.HeaderRetryAfter)), string(ctx.Response().Body())
+	}
+
+	// Unknown users count too, so the endpoint cannot be used to probe the allowlist
+	for i := 0; i < 2; i++ {
+		status, _, _ := send()
+		testza.AssertEqual(t, fiber.StatusUnauthorized, status)
+	}
+
+	status, retryAfter, body := send()
+	testza.AssertEqual(t, fiber.StatusTooManyRequests, status)
+	testza.AssertEqual(t, "60", retryAfter)
+	testza.AssertContains(t, body, `"reason":"rate_limited"`)
+	testza.AssertContains(t, body, i18n.TStatic("error.rate_limited_retry"))
+}
+
+func TestRateLimitIdentifier(t *testing.T) {
+	testza.AssertEqual(t, "13800138000", rateLimitIdentifier("13800138000", "user@example.com"))
+	testza.AssertEqual(t, "user@example.com", rateLimitIdentifier("", " User@Example.com "))
+	testza.AssertEqual(t, "", rateLimitIdentifier("", ""))
+	testza.AssertEqual(t, "", maskIdentifier(""))
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
 	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/soulteary/herald/pkg/herald"
@@ -17,6 +18,7 @@ import (
 	"github.com/soulteary/stargate/src/internal/config"
 	"github.com/soulteary/stargate/src/internal/i18n"
 	"github.com/soulteary/stargate/src/internal/metrics"
+	"github.com/soulteary/stargate/src/internal/ratelimit"
 	"github.com/soulteary/tracing-kit"
 )
 
@@ -56,8 +58,11 @@ func getLocaleFromConfig() string {
 	}
 }
 
-// SendVerifyCodeAPI handles POST requests to /_send_verify_code for sending verification codes via Herald
-func SendVerifyCodeAPI() func(c *fiber.Ctx) error {
+// SendVerifyCodeAPI handles POST requests to /_send_verify_code for sending verification codes via Herald.
+// With mode=magic_link, Herald sends a sign-in link in the format of magicLinkURL instead, which only works
+// in the browser that asked for it; the pending link is kept in the session storage of store.
+func SendVerifyCodeAPI(store *session.Store) func(c *fiber.Ctx) error {
+	links := newStorageMagicLinks(store.Storage)
 	return func(ctx *fiber.Ctx) error {
 		// Get trace context from middleware
 		traceCtx := ctx.Locals("trace_context")
@@ -87,6 +92,34 @@ func SendVerifyCodeAPI() func(c *fiber.Ctx) error {
 			return sendVerifyCodeErrorJSON(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.herald_not_configured"), "herald_not_configured")
 		}
 
+		// Magic links carry the callback themselves, since they may be opened after the callback cookie expired
+		purpose := "login"
+		var callback string
+		magicLink := ctx.FormValue("mode") == magicLinkMode
+		if magicLink {
+			if !config.LoginMagicLinkEnabled.ToBool() {
+				return sendVerifyCodeErrorJSON(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.magic_link_disabled"), "magic_link_disabled")
+			}
+			purpose = magicLinkPurpose
+			if callback = GetCallbackFromCookie(ctx); callback == "" {
+				callback = ctx.FormValue("callback")
+			}
+			if _, err := resolveCallback(ctx, callback); err != nil {
+				return sendVerifyCodeErrorJSON(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.callback_not_allowed"), "callback_not_allowed")
+			}
+		}
+
+		// Every send request counts against the client IP and the identifier, including unknown users,
+		// so the endpoint can be used neither to flood a destination nor to probe the allowlist
+		identifier := rateLimitIdentifier(userPhone, userMail)
+		limitKeys := ratelimit.SendKeys(GetClientIP(ctx), identifier)
+		if retryAfter := rateLimitRetryAfter(ctx, ratelimit.ScopeSend, identifier, limitKeys...); retryAfter > 0 {
+			tracing.RecordError(sendCodeSpan, errRateLimited)
+			setRetryAfter(ctx, retryAfter)
+			return sendVerifyCodeErrorJSON(ctx, fiber.StatusTooManyRequests, i18n.T(ctx, "error.rate_limited_retry"), "rate_limited")
+		}
+		recordRateLimitAttempt(ctx, ratelimit.ScopeSend, identifier, limitKeys...)
+
 		// Step 1: Get complete user information from Warden
 		// This ensures we use the official email/phone from Warden, not user input
 		wardenCtx, wardenSpan := tracing.StartSpan(sendCodeCtx, "warden.get_user_info")
@@ -256,7 +289,7 @@ func SendVerifyCodeAPI() func(c *fiber.Ctx) error {
 		heraldSpan.SetAttributes(
 			attribute.String("herald.user_id", userID),
 			attribute.String("herald.channel", channel),
-			attribute.String("herald.purpose", "login"),
+			attribute.String("herald.purpose", purpose),
 		)
 		// Pass through Idempotency-Key so Herald can deduplicate (CLAUDE.md §13.4)
 		if idemKey := ctx.Get("Idempotency-Key"); idemKey != "" {
@@ -267,9 +300,9 @@ func SendVerifyCodeAPI() func(c *fiber.Ctx) error {
 			UserID:      userID,
 			Channel:     channel,
 			Destination: destination,
-			Purpose:     "login",
+			Purpose:     purpose,
 			Locale:      locale,
-			ClientIP:    ctx.IP(),
+			ClientIP:    GetClientIP(ctx),
 			UA:          ctx.Get("User-Agent"),
 		}
 
@@ -289,29 +322,29 @@ func SendVerifyCodeAPI() func(c *fiber.Ctx) error {
 					// Herald service is unavailable, suggest OTP fallback if enabled
 					otpEnabled := config.WardenOTPEnabled.ToBool()
 					if otpEnabled {
-						auditlog.LogVerifyCodeSend(ctx.Context(), userID, channel, destination, ctx.IP(), false, reason)
+						auditlog.LogVerifyCodeSend(ctx.Context(), userID, channel, destination, GetClientIP(ctx), false, reason)
 						return sendVerifyCodeErrorJSON(ctx, fiber.StatusServiceUnavailable, i18n.T(ctx, "error.herald_unavailable_use_otp"), reason)
 					}
-					auditlog.LogVerifyCodeSend(ctx.Context(), userID, channel, destination, ctx.IP(), false, reason)
+					auditlog.LogVerifyCodeSend(ctx.Context(), userID, channel, destination, GetClientIP(ctx), false, reason)
 					return sendVerifyCodeErrorJSON(ctx, fiber.StatusServiceUnavailable, i18n.T(ctx, "error.herald_unavailable_retry"), reason)
 				}
 				// Other errors (rate limit, etc.)
 				if heraldErr.StatusCode == http.StatusTooManyRequests {
 					reason = "rate_limited"
-					auditlog.LogVerifyCodeSend(ctx.Context(), userID, channel, destination, ctx.IP(), false, reason)
+					auditlog.LogVerifyCodeSend(ctx.Context(), userID, channel, destination, GetClientIP(ctx), false, reason)
 					return sendVerifyCodeErrorJSON(ctx, fiber.StatusTooManyRequests, i18n.T(ctx, "error.rate_limited_retry"), reason)
 				}
 				reason = heraldErr.Reason
 			}
 
 			// Default error handling
-			auditlog.LogVerifyCodeSend(ctx.Context(), userID, channel, destination, ctx.IP(), false, reason)
+			auditlog.LogVerifyCodeSend(ctx.Context(), userID, channel, destination, GetClientIP(ctx), false, reason)
 			return sendVerifyCodeErrorJSON(ctx, fiber.StatusInternalServerError, i18n.Tf(ctx, "error.send_verify_code_failed", err.Error()), reason)
 		}
 
 		// Log successful verification code send
 		metrics.RecordHeraldCall("create_challenge", "success", heraldDuration)
-		auditlog.LogVerifyCodeSend(ctx.Context(), userID, channel, destination, ctx.IP(), true, "")
+		auditlog.LogVerifyCodeSend(ctx.Context(), userID, channel, destination, GetClientIP(ctx), true, "")
 
 		heraldSpan.SetAttributes(
 			attribute.String("herald.challenge_id", createResp.ChallengeID),
@@ -326,10 +359,31 @@ func SendVerifyCodeAPI() func(c *fiber.Ctx) error {
 			attribute.String("auth.result", "success"),
 		)
 
+		message := i18n.T(ctx, "success.verify_code_sent")
+		if magicLink {
+			ttl := time.Duration(createResp.ExpiresIn) * time.Second
+			if ttl <= 0 {
+				ttl = magicLinkDefaultTTL
+			}
+			nonce, err := links.Start(magicLinkRecord{
+				ChallengeID: createResp.ChallengeID,
+				UserID:      userID,
+				Phone:       userPhone,
+				Mail:        userMail,
+				Callback:    callback,
+			}, ttl)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to store magic link")
+				return sendVerifyCodeErrorJSON(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"), "session_store_failed")
+			}
+			setMagicLinkCookie(ctx, nonce, ttl)
+			message = i18n.T(ctx, "success.magic_link_sent")
+		}
+
 		// Return success response with challenge_id and next_resend_in (for frontend resend cooldown)
 		resp := fiber.Map{
 			"success":      true,
-			"message":      i18n.T(ctx, "success.verify_code_sent"),
+			"message":      message,
 			"challenge_id": createResp.ChallengeID,
 			"expires_in":   createResp.ExpiresIn,
 		}
@@ -339,6 +393,9 @@ func SendVerifyCodeAPI() func(c *fiber.Ctx) error {
 		// When DEBUG=true and Herald returns debug_code (HERALD_TEST_MODE), pass through for display/autofill
 		if config.Debug.ToBool() && createResp.DebugCode != "" {
 			resp["debug_code"] = createResp.DebugCode
+			if magicLink {
+				resp["debug_link"] = magicLinkURL(ctx, createResp.ChallengeID, createResp.DebugCode)
+			}
 		}
 		ctx.Set("Content-Type", "application/json")
 		return ctx.Status(fiber.StatusOK).JSON(resp)
@@ -11,6 +11,7 @@ import (
 
 	"github.com/MarvinJWendt/testza"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
 	"github.com/soulteary/herald/pkg/herald"
 	logger "github.com/soulteary/logger-kit"
 	"github.com/soulteary/stargate/src/internal/auth"
@@ -53,7 +54,7 @@ func TestSendVerifyCodeAPI_NoIdentifier(t *testing.T) {
 	}, "")
 	defer app.ReleaseCtx(ctx)
 
-	handler := SendVerifyCodeAPI()
+	handler := SendVerifyCodeAPI(session.New())
 	err = handler(ctx)
 	testza.AssertNoError(t, err)
 	testza.AssertEqual(t, fiber.StatusBadRequest, ctx.Response().StatusCode())
@@ -75,7 +76,7 @@ func TestSendVerifyCodeAPI_HeraldDisabled(t *testing.T) {
 	}, "phone=13800138000")
 	defer app.ReleaseCtx(ctx)
 
-	handler := SendVerifyCodeAPI()
+	handler := SendVerifyCodeAPI(session.New())
 	err = handler(ctx)
 	testza.AssertNoError(t, err)
 	testza.AssertEqual(t, fiber.StatusBadRequest, ctx.Response().StatusCode())
@@ -111,7 +112,7 @@ func TestSendVerifyCodeAPI_WardenUserNotFound(t *testing.T) {
 	}, "phone=13800138000")
 	defer app.ReleaseCtx(ctx)
 
-	handler := SendVerifyCodeAPI()
+	handler := SendVerifyCodeAPI(session.New())
 	err = handler(ctx)
 	testza.AssertNoError(t, err)
 	testza.AssertEqual(t, fiber.StatusUnauthorized, ctx.Response().StatusCode())
@@ -185,7 +186,7 @@ func TestSendVerifyCodeAPI_Success(t *testing.T) {
 	InitHeraldClient(testLog)
 
 	app := fiber.New()
-	app.Post("/_send_verify_code", SendVerifyCodeAPI())
+	app.Post("/_send_verify_code", SendVerifyCodeAPI(session.New()))
 
 	req := httptest.NewRequest("POST", "/_send_verify_code", strings.NewReader("phone=13800138000"))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -267,7 +268,7 @@ func TestSendVerifyCodeAPI_IdempotencyKeyPassthrough(t *testing.T) {
 	InitHeraldClient(testLog)
 
 	app := fiber.New()
-	app.Post("/_send_verify_code", SendVerifyCodeAPI())
+	app.Post("/_send_verify_code", SendVerifyCodeAPI(session.New()))
 
 	idemKey := "req-uuid-12345"
 	req := httptest.NewRequest("POST", "/_send_verify_code", strings.NewReader("phone=13800138000"))
@@ -340,7 +341,7 @@ func TestSendVerifyCodeAPI_LocaleFromConfig(t *testing.T) {
 	InitHeraldClient(testLog)
 
 	app := fiber.New()
-	app.Post("/_send_verify_code", SendVerifyCodeAPI())
+	app.Post("/_send_verify_code", SendVerifyCodeAPI(session.New()))
 
 	// No Accept-Language header so locale comes from config (LANGUAGE=de -> de-DE)
 	req := httptest.NewRequest("POST", "/_send_verify_code", strings.NewReader("phone=13800138000"))
@@ -425,7 +426,7 @@ func TestSendVerifyCodeAPI_GetLocaleFromConfig_AllLanguages(t *testing.T) {
 			InitHeraldClient(testLog)
 
 			app := fiber.New()
-			app.Post("/_send_verify_code", SendVerifyCodeAPI())
+			app.Post("/_send_verify_code", SendVerifyCodeAPI(session.New()))
 			req := httptest.NewRequest("POST", "/_send_verify_code", strings.NewReader("phone=13800138000"))
 			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 			req.Header.Set("Accept", "application/json")
@@ -488,7 +489,7 @@ func TestSendVerifyCodeAPI_HeraldRateLimited(t *testing.T) {
 	InitHeraldClient(testLog)
 
 	app := fiber.New()
-	app.Post("/_send_verify_code", SendVerifyCodeAPI())
+	app.Post("/_send_verify_code", SendVerifyCodeAPI(session.New()))
 	req := httptest.NewRequest("POST", "/_send_verify_code", strings.NewReader("phone=13800138000"))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("Accept", "application/json")
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/valyala/fasthttp"
+
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/sessionindex"
+)
+
+// responseSessionID returns the session ID the response of ctx set in the session cookie.
+func responseSessionID(t *testing.T, ctx *fiber.Ctx) string {
+	t.Helper()
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+	cookie.SetKey(auth.SessionCookieName)
+	testza.AssertTrue(t, ctx.Response().Header.Cookie(cookie))
+	return string(cookie.Value())
+}
+
+// responseSession loads the session the response of ctx set in the session cookie.
+func responseSession(t *testing.T, store *session.Store, ctx *fiber.Ctx) *session.Session {
+	t.Helper()
+	next, app := createTestContext("GET", "/", map[string]string{
+		"Cookie": auth.SessionCookieName + "=" + responseSessionID(t, ctx),
+	}, "")
+	t.Cleanup(func() { app.ReleaseCtx(next) })
+	sess, err := store.Get(next)
+	testza.AssertNoError(t, err)
+	return sess
+}
+
+func TestRotateSessionID(t *testing.T) {
+	store := setupTestStore()
+	index := sessionindex.New(store.Storage, config.SessionLifetime())
+	sessionindex.Init(index)
+	t.Cleanup(func() { sessionindex.Init(nil) })
+
+	ctx, app := createTestContext("GET", "/", nil, "")
+	defer app.ReleaseCtx(ctx)
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+	sess.Set("user_id", "user-1")
+	sess.Set(amrSessionKey, []string{"pwd"})
+	indexSession(ctx, sess)
+	testza.AssertNoError(t, auth.Authenticate(sess))
+	oldID := responseSessionID(t, ctx)
+
+	sess, err = store.Get(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertNoError(t, rotateSessionID(sess))
+	newID := sess.ID()
+	testza.AssertNotEqual(t, oldID, newID)
+	testza.AssertNoError(t, sess.Save())
+
+	// The old ID is gone from the storage, the data moved to the new one
+	data, err := store.Storage.Get(oldID)
+	testza.AssertNoError(t, err)
+	testza.AssertNil(t, data)
+	testza.AssertEqual(t, newID, responseSessionID(t, ctx))
+	rotated := responseSession(t, store, ctx)
+	testza.AssertTrue(t, auth.IsAuthenticated(rotated))
+	testza.AssertEqual(t, "user-1", rotated.Get("user_id"))
+
+	list, err := index.List("user-1")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 1)
+	testza.AssertEqual(t, newID, list[0].ID)
+}
+
+func TestLoginAPI_RotatesSessionID(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+
+	store := setupTestStore()
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("i18n-bundle", i18n.GetBundle())
+		c.Locals("i18n-language", i18n.LangEN)
+		return c.Next()
+	})
+	// /test_plant saves an anonymous session, as an attacker would to fix its ID on a victim
+	app.Get("/test_plant", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("planted", true)
+		return sess.Save()
+	})
+	app.Post("/_login", LoginAPI(store))
+	app.Get("/test_whoami", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		if !auth.IsAuthenticated(sess) {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	planted := sessionCookie(oidcRequest(t, app, "/test_plant", nil))
+	testza.AssertNotNil(t, planted)
+
+	req := httptest.NewRequest(http.MethodPost, "/_login", strings.NewReader("password=test123"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Forwarded-Host", "auth.example.com")
+	req.AddCookie(planted)
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	loggedIn := sessionCookie(resp)
+	testza.AssertNotNil(t, loggedIn)
+	testza.AssertNotEqual(t, planted.Value, loggedIn.Value)
+
+	testza.AssertEqual(t, fiber.StatusUnauthorized, oidcRequest(t, app, "/test_whoami", planted).StatusCode)
+	testza.AssertEqual(t, fiber.StatusOK, oidcRequest(t, app, "/test_whoami", loggedIn).StatusCode)
+}
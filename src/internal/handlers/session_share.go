@@ -1,7 +1,13 @@
 package handlers
 
 import (
+	"encoding/json"
+	"net/url"
+	"slices"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
+	fibersession "github.com/gofiber/fiber/v2/middleware/session"
 
 	session "github.com/soulteary/session-kit"
 	"github.com/soulteary/stargate/src/internal/auth"
@@ -9,33 +15,249 @@ import (
 	"github.com/soulteary/stargate/src/internal/i18n"
 )
 
+const (
+	// SessionExchangePath is the route that installs a session cookie on a callback domain.
+	SessionExchangePath = "/_session_exchange"
+
+	// ExchangeLogoutParam, set on SessionExchangePath, carries a one-time logout token minted by
+	// /_logout: the session cookie of the host is cleared instead of installed, and the browser
+	// continues to the next exchanged domain.
+	ExchangeLogoutParam = "logout"
+
+	// ExchangeReissueParam, set on SessionExchangePath, carries a one-time reissue token minted when
+	// the session ID is rotated: the host's session cookie is replaced with the new ID, and the
+	// browser continues to the next exchanged domain.
+	ExchangeReissueParam = "reissue"
+
+	// exchangedOriginsKeyPrefix namespaces the origin lists of exchanged sessions in the session storage.
+	exchangedOriginsKeyPrefix = "exchanged_origins:"
+
+	// maxExchangedOrigins bounds the origins remembered per session.
+	maxExchangedOrigins = 32
+)
+
 // SessionShareRoute handles GET requests to /_session_exchange for cross-domain session sharing.
-// It sets a session cookie with the provided session ID and redirects to the root path.
-// This allows sessions to be shared across different domains/subdomains.
+// It redeems a one-time exchange code minted at login for the session ID, sets the session cookie
+// and redirects to the original path (or the root path when none was carried through login).
+// This allows sessions to be shared across different domains/subdomains without the session ID
+// appearing in URLs, logs or Referer headers. The domain is recorded for the session, so that a
+// rotated session ID can be carried to it and single logout can clear the cookie there too.
 //
 // Query parameters:
-//   - id: Session ID to set in the cookie
+//   - code: One-time exchange code, bound to the host it was minted for
+//   - return_to: Path and query to restore; only local paths are accepted
+//   - logout: One-time logout token; clears the session cookie of this domain instead (single logout)
+//   - reissue: One-time reissue token; replaces the session cookie of this domain with a rotated ID
+//
+// Parameters:
+//   - store: Session store whose storage holds the exchange codes, exchanged origins, logout and reissue tokens
 //
 // Returns a Fiber handler function.
-func SessionShareRoute() func(c *fiber.Ctx) error {
+func SessionShareRoute(store *fibersession.Store) func(c *fiber.Ctx) error {
+	return sessionShareHandler(newStorageExchangeCodes(store.Storage), newSingleLogout(store.Storage), newSessionReissue(store.Storage))
+}
+
+// sessionShareHandler is the internal handler that can be tested with a mocked code store.
+func sessionShareHandler(codes ExchangeCodeStore, slo *singleLogout, reissue *sessionReissue) func(c *fiber.Ctx) error {
 	// Create session config for cookie creation
 	sessionConfig := session.DefaultConfig().
 		WithCookieName(auth.SessionCookieName).
-		WithExpiration(config.SessionExpiration).
+		WithExpiration(config.SessionLifetime()).
 		WithCookieDomain(config.CookieDomain.Value).
 		WithSameSite("Lax").
 		WithHTTPOnly(true)
 
 	return func(ctx *fiber.Ctx) error {
-		sessionID := ctx.Query("id")
-		if sessionID == "" {
-			return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.missing_session_id"))
+		if token := ctx.Query(ExchangeLogoutParam); token != "" {
+			// Only a token minted by /_logout clears the cookie, so other sites cannot sign the
+			// user out by linking here
+			next, err := slo.tokens.Redeem(token, GetForwardedHost(ctx))
+			if err != nil {
+				return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.invalid_logout_token"))
+			}
+			clearSessionCookie(ctx)
+			ctx.Set(fiber.HeaderCacheControl, "no-store")
+			if next != "" {
+				return ctx.Redirect(next, fiber.StatusFound)
+			}
+			return ctx.SendString("Logged out")
+		}
+
+		if token := ctx.Query(ExchangeReissueParam); token != "" {
+			sessionID, next, err := reissue.tokens.Redeem(token, GetForwardedHost(ctx))
+			if err != nil {
+				return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.invalid_exchange_code"))
+			}
+			recordExchangedOrigin(ctx, reissue.origins, sessionID)
+			ctx.Cookie(session.CreateCookie(sessionConfig, sessionID))
+			ctx.Set(fiber.HeaderCacheControl, "no-store")
+			return ctx.Redirect(next, fiber.StatusFound)
 		}
 
+		code := ctx.Query(ExchangeCodeParam)
+		if code == "" {
+			return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.missing_exchange_code"))
+		}
+
+		sessionID, err := codes.Redeem(code, GetForwardedHost(ctx))
+		if err != nil {
+			return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.invalid_exchange_code"))
+		}
+		recordExchangedOrigin(ctx, slo.origins, sessionID)
+
 		// Use session-kit's CreateCookie for consistent cookie creation
 		cookie := session.CreateCookie(sessionConfig, sessionID)
 		ctx.Cookie(cookie)
 
-		return ctx.Redirect("/")
+		returnTo := ctx.Query(ReturnToParam)
+		if !isLocalPath(returnTo) {
+			returnTo = "/"
+		}
+		return ctx.Redirect(returnTo)
+	}
+}
+
+// recordExchangedOrigin adds the origin of the request to the exchanged origins of sessionID.
+// Failures are logged and do not fail the exchange.
+func recordExchangedOrigin(ctx *fiber.Ctx, origins *exchangedOrigins, sessionID string) {
+	origin := requestOrigin(ctx)
+	if err := origins.Add(sessionID, origin); err != nil {
+		log.Warn().Err(err).Str("origin", origin).Msg("Failed to record exchanged session origin")
+	}
+}
+
+// requestOrigin returns the scheme and host the request was made to, e.g. "https://app.example.com".
+func requestOrigin(ctx *fiber.Ctx) string {
+	return GetForwardedProto(ctx) + "://" + GetForwardedHost(ctx)
+}
+
+// exchangedOrigins keeps, per session ID, the origins the session cookie was installed on, so a
+// rotated ID can be reissued there and single logout can clear it there. The list is stored in the session storage next to the session
+// rather than in it, so an exchange does not load and rewrite the whole session.
+type exchangedOrigins struct {
+	storage fiber.Storage
+	ttl     time.Duration
+}
+
+// newExchangedOrigins creates an origin list store backed by storage, keeping lists as long as
+// a session lives.
+func newExchangedOrigins(storage fiber.Storage) *exchangedOrigins {
+	return &exchangedOrigins{storage: storage, ttl: config.SessionLifetime()}
+}
+
+// List returns the origins recorded for sessionID.
+func (o *exchangedOrigins) List(sessionID string) ([]string, error) {
+	value, err := o.storage.Get(exchangedOriginsKeyPrefix + sessionID)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var origins []string
+	if err := json.Unmarshal(value, &origins); err != nil {
+		return nil, err
+	}
+	return origins, nil
+}
+
+// Add records origin for sessionID. Origins already recorded are not written again, and at most
+// maxExchangedOrigins are kept.
+func (o *exchangedOrigins) Add(sessionID, origin string) error {
+	origins, err := o.List(sessionID)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(origins, origin) || len(origins) >= maxExchangedOrigins {
+		return nil
+	}
+	value, err := json.Marshal(append(origins, origin))
+	if err != nil {
+		return err
+	}
+	return o.storage.Set(exchangedOriginsKeyPrefix+sessionID, value, o.ttl)
+}
+
+// Delete forgets the origins of sessionID.
+func (o *exchangedOrigins) Delete(sessionID string) error {
+	return o.storage.Delete(exchangedOriginsKeyPrefix + sessionID)
+}
+
+// clearSessionCookie expires the session cookie of this domain.
+func clearSessionCookie(ctx *fiber.Ctx) {
+	ctx.Cookie(&fiber.Cookie{
+		Name:     auth.SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		Domain:   config.CookieDomain.Value,
+		Expires:  time.Now().Add(-1 * time.Hour), // Set to past time to delete cookie
+		SameSite: fiber.CookieSameSiteLaxMode,
+		HTTPOnly: true,
+	})
+}
+
+// singleLogout holds what single logout keeps in the session storage: the origins each session
+// was exchanged to, and the one-time tokens that clear the session cookie on them.
+type singleLogout struct {
+	origins *exchangedOrigins
+	tokens  *logoutTokens
+}
+
+// newSingleLogout creates the single logout stores backed by storage.
+func newSingleLogout(storage fiber.Storage) *singleLogout {
+	return &singleLogout{origins: newExchangedOrigins(storage), tokens: newLogoutTokens(storage)}
+}
+
+// chain mints a logout token for each of origins, continuing from one origin to the next and
+// from the last to redirect, and returns the URL starting the chain (redirect when no origin is
+// left). Each domain clears its cookie in a top-level navigation, which browsers blocking
+// third-party cookies still allow.
+func (s *singleLogout) chain(origins []string, redirect string) (string, error) {
+	return exchangeChain(origins, redirect, ExchangeLogoutParam, s.tokens.Mint)
+}
+
+// sessionReissue holds what reissuing a rotated session ID keeps in the session storage: the
+// origins each session was exchanged to, and the one-time tokens that install the new ID there.
+type sessionReissue struct {
+	origins *exchangedOrigins
+	tokens  *reissueTokens
+}
+
+// newSessionReissue creates the session reissue stores backed by storage.
+func newSessionReissue(storage fiber.Storage) *sessionReissue {
+	return &sessionReissue{origins: newExchangedOrigins(storage), tokens: newReissueTokens(storage)}
+}
+
+// chain hands the origins oldID was exchanged to over to newID, after rotateSessionID replaced
+// the one with the other. It mints a reissue token of newID for each origin and returns the URL
+// starting the chain through them, ending at redirect (redirect when there is no origin). The
+// origins are recorded for newID again as the browser passes through them.
+func (r *sessionReissue) chain(oldID, newID, redirect string) (string, error) {
+	origins, err := r.origins.List(oldID)
+	if err != nil {
+		return "", err
+	}
+	if err := r.origins.Delete(oldID); err != nil {
+		return "", err
+	}
+	return exchangeChain(origins, redirect, ExchangeReissueParam, func(host, next string) (string, error) {
+		return r.tokens.Mint(newID, host, next)
+	})
+}
+
+// exchangeChain mints a token for each of origins with mint, continuing from one origin to the
+// next and from the last to redirect, and returns the URL starting the chain (redirect when no
+// origin is left). Each hop is SessionExchangePath on the origin with the token in param. Origins
+// that are no longer allowed callback domains are skipped.
+func exchangeChain(origins []string, redirect, param string, mint func(host, next string) (string, error)) (string, error) {
+	next := redirect
+	for i := len(origins) - 1; i >= 0; i-- {
+		target, ok := parseCallback(origins[i])
+		if !ok || target.proto == "" || !isAllowedRedirectHost(target.host) {
+			continue
+		}
+		token, err := mint(target.host, next)
+		if err != nil {
+			return "", err
+		}
+		next = target.proto + "://" + target.host + SessionExchangePath + "?" + url.Values{param: {token}}.Encode()
 	}
+	return next, nil
 }
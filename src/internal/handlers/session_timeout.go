@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+
+	"github.com/soulteary/stargate/src/internal/auditlog"
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/metrics"
+)
+
+const (
+	// lastAccessWriteInterval is how often /_auth saves the last access of a session. Idle timeouts
+	// are therefore only accurate to this interval.
+	lastAccessWriteInterval = time.Minute
+
+	// ExpiredParam is the login page query parameter set when a session timed out.
+	ExpiredParam = "expired"
+
+	// Session timeout reasons, as audited.
+	sessionTimeoutIdle     = "idle_timeout"
+	sessionTimeoutAbsolute = "absolute_timeout"
+)
+
+// sessionTime reads a Unix time (seconds) stored in the session under key, or the zero time.
+func sessionTime(sess *session.Session, key string) time.Time {
+	switch v := sess.Get(key).(type) {
+	case int64:
+		return time.Unix(v, 0)
+	case int:
+		return time.Unix(int64(v), 0)
+	case float64:
+		return time.Unix(int64(v), 0)
+	default:
+		return time.Time{}
+	}
+}
+
+// sessionTimeoutReason reports whether sess outlived timeouts at now: "" while it is valid,
+// otherwise the reason it ended. Sessions from before the timestamps were recorded only expire
+// with the storage.
+func sessionTimeoutReason(sess *session.Session, timeouts config.SessionTimeouts, now time.Time) string {
+	if authTime := sessionTime(sess, auth.AuthTimeSessionKey); timeouts.Absolute > 0 && !authTime.IsZero() && now.Sub(authTime) >= timeouts.Absolute {
+		return sessionTimeoutAbsolute
+	}
+	if lastAccess := sessionTime(sess, auth.LastAccessSessionKey); timeouts.Idle > 0 && !lastAccess.IsZero() && now.Sub(lastAccess) >= timeouts.Idle {
+		return sessionTimeoutIdle
+	}
+	return ""
+}
+
+// recordSessionAccess records that sess was used at now, in the session itself and in the session
+// index. The session is saved at most once per lastAccessWriteInterval; saving releases it, so this
+// is the last use of sess. Failures are logged and do not fail the request.
+func recordSessionAccess(sess *session.Session, now time.Time) {
+	touchSession(sess)
+	if now.Sub(sessionTime(sess, auth.LastAccessSessionKey)) < lastAccessWriteInterval {
+		return
+	}
+	sess.Set(auth.LastAccessSessionKey, now.Unix())
+	if err := sess.Save(); err != nil {
+		log.Warn().Err(err).Msg("Failed to save session last access")
+	}
+}
+
+// handleSessionExpired destroys a session that timed out and sends the user back to login:
+// browsers are redirected to the login page with a "session expired" notice, API clients get 401.
+func handleSessionExpired(ctx *fiber.Ctx, sess *session.Session, reason string) error {
+	userID, _ := sess.Get("user_id").(string)
+	unindexSession(sess)
+	if err := auth.Unauthenticate(sess); err != nil {
+		log.Error().Err(err).Str("user_id", userID).Msg("Failed to destroy expired session")
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	metrics.RecordSessionDestroyed()
+	auditlog.LogSessionTimeout(ctx.Context(), userID, reason, GetForwardedHost(ctx), GetClientIP(ctx))
+	log.Info().Str("user_id", userID).Str("reason", reason).Str("host", GetForwardedHost(ctx)).Msg("Session expired")
+
+	if IsHTMLRequest(ctx) {
+		return ctx.Redirect(fmt.Sprintf("%s&%s=1", BuildCallbackURL(ctx), ExpiredParam), fiber.StatusFound)
+	}
+	return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.session_expired"))
+}
+
+// loginNotice returns the message shown above the login form, if any.
+func loginNotice(ctx *fiber.Ctx) string {
+	if ctx.Query(ExpiredParam) != "" {
+		return i18n.T(ctx, "error.session_expired")
+	}
+	return ""
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+)
+
+func setupSessionTimeoutConfig(t *testing.T) {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("SESSION_ABSOLUTE_TIMEOUT", "8h")
+	t.Setenv("SESSION_IDLE_TIMEOUT", "30m")
+	t.Setenv("SESSION_HOST_TIMEOUTS", "admin.example.com=5m")
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+	InitForwardAuthHandler(testLogger())
+}
+
+// checkWithSessionAge runs /_auth with a session signed in authAge ago and last used lastAccessAge ago.
+func checkWithSessionAge(t *testing.T, ctx *fiber.Ctx, authAge, lastAccessAge time.Duration) {
+	t.Helper()
+	store := setupTestStore()
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertNoError(t, auth.Authenticate(sess))
+
+	sess, err = store.Get(ctx)
+	testza.AssertNoError(t, err)
+	now := time.Now()
+	sess.Set(auth.AuthTimeSessionKey, now.Add(-authAge).Unix())
+	sess.Set(auth.LastAccessSessionKey, now.Add(-lastAccessAge).Unix())
+	testza.AssertNoError(t, sess.Save())
+
+	testza.AssertNoError(t, CheckRoute(store)(ctx))
+}
+
+func TestSessionTimeoutReason(t *testing.T) {
+	store := setupTestStore()
+	ctx, app := createTestContext("GET", "/", nil, "")
+	defer app.ReleaseCtx(ctx)
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+
+	now := time.Now()
+	timeouts := config.SessionTimeouts{Idle: 30 * time.Minute, Absolute: 8 * time.Hour}
+
+	// Sessions without timestamps never time out here
+	testza.AssertEqual(t, "", sessionTimeoutReason(sess, timeouts, now))
+
+	sess.Set(auth.AuthTimeSessionKey, now.Add(-time.Hour).Unix())
+	sess.Set(auth.LastAccessSessionKey, now.Add(-time.Minute).Unix())
+	testza.AssertEqual(t, "", sessionTimeoutReason(sess, timeouts, now))
+
+	sess.Set(auth.LastAccessSessionKey, now.Add(-time.Hour).Unix())
+	testza.AssertEqual(t, sessionTimeoutIdle, sessionTimeoutReason(sess, timeouts, now))
+	testza.AssertEqual(t, "", sessionTimeoutReason(sess, config.SessionTimeouts{Absolute: 8 * time.Hour}, now))
+
+	sess.Set(auth.AuthTimeSessionKey, now.Add(-9*time.Hour).Unix())
+	testza.AssertEqual(t, sessionTimeoutAbsolute, sessionTimeoutReason(sess, timeouts, now))
+}
+
+func TestCheckRoute_SessionTimeouts(t *testing.T) {
+	tests := []struct {
+		name          string
+		host          string
+		accept        string
+		authAge       time.Duration
+		lastAccessAge time.Duration
+		expected      int
+	}{
+		{"active session", "app.example.com", "application/json", time.Hour, time.Minute, fiber.StatusOK},
+		{"idle session", "app.example.com", "application/json", time.Hour, 45 * time.Minute, fiber.StatusUnauthorized},
+		{"old session", "app.example.com", "application/json", 9 * time.Hour, time.Minute, fiber.StatusUnauthorized},
+		{"host idle timeout", "admin.example.com", "application/json", time.Hour, 10 * time.Minute, fiber.StatusUnauthorized},
+		{"idle session from a browser", "app.example.com", "text/html", time.Hour, 45 * time.Minute, fiber.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupSessionTimeoutConfig(t)
+			ctx, app := createTestContext("GET", "/_auth", map[string]string{
+				"Accept":           tt.accept,
+				"X-Forwarded-Host": tt.host,
+				"X-Forwarded-Uri":  "/",
+			}, "")
+			defer app.ReleaseCtx(ctx)
+
+			checkWithSessionAge(t, ctx, tt.authAge, tt.lastAccessAge)
+			testza.AssertEqual(t, tt.expected, ctx.Response().StatusCode())
+			if tt.expected == fiber.StatusFound {
+				location := string(ctx.Response().Header.Peek("Location"))
+				testza.AssertTrue(t, strings.Contains(location, "auth.example.com/_login?callback="), location)
+				testza.AssertTrue(t, strings.HasSuffix(location, "&"+ExpiredParam+"=1"), location)
+			}
+		})
+	}
+}
+
+func TestLoginNotice(t *testing.T) {
+	ctx, app := createTestContext("GET", "/_login?expired=1", nil, "")
+	defer app.ReleaseCtx(ctx)
+	testza.AssertNotEqual(t, "", loginNotice(ctx))
+
+	ctx2, app2 := createTestContext("GET", "/_login", nil, "")
+	defer app2.ReleaseCtx(ctx2)
+	testza.AssertEqual(t, "", loginNotice(ctx2))
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+
+	"github.com/soulteary/stargate/src/internal/auditlog"
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/metrics"
+	"github.com/soulteary/stargate/src/internal/sessionindex"
+)
+
+// loggedInSession returns the session of the request and the ID of its signed-in user. The user
+// ID is empty when the session is not authenticated or has no user (password-only logins), so
+// handlers acting for a user check it as well.
+func loggedInSession(ctx *fiber.Ctx, sessionGetter SessionGetter) (*session.Session, string, error) {
+	sess, err := sessionGetter.Get(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if !auth.IsAuthenticated(sess) {
+		return sess, "", nil
+	}
+	userID, _ := sess.Get("user_id").(string)
+	return sess, userID, nil
+}
+
+// indexSession records sess, about to be saved as a signed-in session, in the session index of
+// its user. Call it before saving: saving releases the session. Sessions without a user ID
+// (shared password logins) are not indexed. Index failures are logged and do not fail the login.
+func indexSession(ctx *fiber.Ctx, sess *session.Session) {
+	index := sessionindex.Get()
+	if index == nil {
+		return
+	}
+	userID, _ := sess.Get("user_id").(string)
+	err := index.Add(userID, sessionindex.Session{
+		ID:        sess.ID(),
+		IP:        GetClientIP(ctx),
+		UserAgent: ctx.Get(fiber.HeaderUserAgent),
+		AMR:       sessionStrings(sess.Get(amrSessionKey)),
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("user_id", userID).Msg("Failed to index session")
+	}
+}
+
+// rotateSessionID gives sess a new ID, carrying its data over, when it gains privileges (login,
+// step-up, TOTP enrollment), so an ID planted or leaked before does not gain them too. The old ID
+// is deleted from the session storage and renamed in the session index. Call it before indexing
+// and saving the session; after step-up and TOTP enrollment, reissueExchangedSession carries the
+// new ID to the domains the session was exchanged to.
+func rotateSessionID(sess *session.Session) error {
+	oldID := sess.ID()
+	if err := sess.Regenerate(); err != nil {
+		return err
+	}
+	index := sessionindex.Get()
+	if index == nil {
+		return nil
+	}
+	userID, _ := sess.Get("user_id").(string)
+	if err := index.Rename(userID, oldID, sess.ID()); err != nil {
+		log.Warn().Err(err).Str("user_id", userID).Msg("Failed to rename session in index")
+	}
+	return nil
+}
+
+// reissueExchangedSession returns the URL that takes the browser through the domains oldID was
+// exchanged to, installing newID on each, before it continues to redirect (made absolute when
+// local). It returns redirect unchanged when there is no such domain or the chain cannot be
+// started; those domains then have to sign in again.
+func reissueExchangedSession(ctx *fiber.Ctx, reissue *sessionReissue, oldID, newID, redirect string) string {
+	final := redirect
+	if isLocalPath(final) {
+		final = requestOrigin(ctx) + final
+	}
+	next, err := reissue.chain(oldID, newID, final)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to reissue the session to exchanged domains")
+		return redirect
+	}
+	if next == final {
+		return redirect
+	}
+	return next
+}
+
+// touchSession records in the session index that sess was just used.
+func touchSession(sess *session.Session) {
+	index := sessionindex.Get()
+	if index == nil {
+		return
+	}
+	userID, _ := sess.Get("user_id").(string)
+	if err := index.Touch(userID, sess.ID()); err != nil {
+		log.Debug().Err(err).Str("user_id", userID).Msg("Failed to update session last access")
+	}
+}
+
+// unindexSession forgets sess, which is being destroyed, in the session index.
+func unindexSession(sess *session.Session) {
+	index := sessionindex.Get()
+	if index == nil {
+		return
+	}
+	userID, _ := sess.Get("user_id").(string)
+	if err := index.Remove(userID, sess.ID()); err != nil {
+		log.Warn().Err(err).Str("user_id", userID).Msg("Failed to remove session from index")
+	}
+}
+
+// sessionView is a session as listed to its user. ID is the session handle; the session ID is a
+// credential and never leaves the server.
+type sessionView struct {
+	ID         string    `json:"id"`
+	Current    bool      `json:"current"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastAccess time.Time `json:"last_access"`
+	IP         string    `json:"ip,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	AMR        []string  `json:"amr"`
+}
+
+func newSessionView(s sessionindex.Session, currentID string) sessionView {
+	amr := s.AMR
+	if amr == nil {
+		amr = []string{}
+	}
+	return sessionView{
+		ID:         sessionindex.Handle(s.ID),
+		Current:    s.ID == currentID,
+		CreatedAt:  s.CreatedAt,
+		LastAccess: s.LastAccess,
+		IP:         s.IP,
+		UserAgent:  s.UserAgent,
+		AMR:        amr,
+	}
+}
+
+// sessionsPageHandler is the internal handler that can be tested with mocked dependencies.
+func sessionsPageHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, index *sessionindex.Index) error {
+	if index == nil {
+		return SendErrorResponse(ctx, fiber.StatusNotFound, i18n.T(ctx, "error.sessions_disabled"))
+	}
+	sess, userID, err := loggedInSession(ctx, sessionGetter)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	if !auth.IsAuthenticated(sess) {
+		if IsHTMLRequest(ctx) {
+			return ctx.Redirect(authHostLoginURL(ctx), fiber.StatusFound)
+		}
+		return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.auth_required"))
+	}
+	if userID == "" {
+		return SendErrorResponse(ctx, fiber.StatusForbidden, i18n.T(ctx, "error.sessions_no_user"))
+	}
+
+	list, err := index.List(userID)
+	if err != nil {
+		log.Error().Err(err).Str("user_id", userID).Msg("Failed to list sessions")
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_index_failed"))
+	}
+	views := make([]sessionView, 0, len(list))
+	for _, s := range list {
+		views = append(views, newSessionView(s, sess.ID()))
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	if !IsHTMLRequest(ctx) {
+		return ctx.JSON(fiber.Map{"sessions": views})
+	}
+	return ctx.Render("sessions", fiber.Map{
+		"Title":    config.LoginPageTitle.Value,
+		"Sessions": views,
+	})
+}
+
+// sessionRevokeHandler is the internal handler that can be tested with mocked dependencies.
+// With others set every session of the user but the current one is revoked, otherwise the one
+// whose handle is in the "id" field.
+func sessionRevokeHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, index *sessionindex.Index, others bool) error {
+	if index == nil {
+		return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{"ok": false, "error": "disabled"})
+	}
+	sess, userID, err := loggedInSession(ctx, sessionGetter)
+	if err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "session_store_failed"})
+	}
+	if !auth.IsAuthenticated(sess) {
+		return ctx.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ok": false, "error": "unauthorized"})
+	}
+	if userID == "" {
+		return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{"ok": false, "error": "no_user_id"})
+	}
+
+	var revoked []string
+	if others {
+		revoked, err = index.RevokeOthers(userID, sess.ID())
+	} else {
+		handle := ctx.FormValue("id")
+		if handle == "" {
+			var body struct {
+				ID string `json:"id"`
+			}
+			_ = ctx.BodyParser(&body)
+			handle = body.ID
+		}
+		var id string
+		id, err = index.Revoke(userID, handle)
+		if id != "" {
+			revoked = []string{id}
+		}
+	}
+	// Sessions revoked before a failure are gone, so they are recorded either way
+	handles := make([]string, 0, len(revoked))
+	for _, id := range revoked {
+		handle := sessionindex.Handle(id)
+		handles = append(handles, handle)
+		metrics.RecordSessionDestroyed()
+		auditlog.LogSessionRevoke(ctx.Context(), userID, handle, GetClientIP(ctx))
+	}
+	if err != nil {
+		if errors.Is(err, sessionindex.ErrNotFound) {
+			return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{"ok": false, "error": "not_found"})
+		}
+		log.Error().Err(err).Str("user_id", userID).Msg("Failed to revoke sessions")
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"ok": false, "error": "store_failed"})
+	}
+
+	log.Info().Str("user_id", userID).Strs("sessions", handles).Msg("Sessions revoked")
+	return ctx.JSON(fiber.Map{"ok": true, "revoked": handles})
+}
+
+// SessionsRoute handles GET /_sessions: the self-service page listing where the user is signed
+// in, or the list as JSON for non-HTML requests.
+func SessionsRoute(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return sessionsPageHandler(ctx, sessionGetter, sessionindex.Get())
+	}
+}
+
+// SessionRevokeAPI handles POST /_sessions/revoke, signing out one of the user's sessions.
+func SessionRevokeAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return sessionRevokeHandler(ctx, sessionGetter, sessionindex.Get(), false)
+	}
+}
+
+// SessionRevokeOthersAPI handles POST /_sessions/revoke_others, signing out every session of the
+// user but the current one.
+func SessionRevokeOthersAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return sessionRevokeHandler(ctx, sessionGetter, sessionindex.Get(), true)
+	}
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/sessionindex"
+)
+
+// sessionsTestApp serves the /_sessions routes, with session management enabled or not, plus
+// /test_login signing in user-1 with an indexed session, /test_login_password creating a
+// password-only session and /test_whoami answering 200 only for signed-in sessions.
+func sessionsTestApp(t *testing.T, enabled bool) *fiber.App {
+	t.Helper()
+	store := setupTestStore()
+	var index *sessionindex.Index
+	if enabled {
+		index = sessionindex.New(store.Storage, config.SessionLifetime())
+	}
+	sessionindex.Init(index)
+	t.Cleanup(func() { sessionindex.Init(nil) })
+	sessionGetter := &SessionStoreAdapter{store: store}
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("i18n-bundle", i18n.GetBundle())
+		c.Locals("i18n-language", i18n.LangEN)
+		return c.Next()
+	})
+	app.Get("/_sessions", func(c *fiber.Ctx) error {
+		return sessionsPageHandler(c, sessionGetter, index)
+	})
+	app.Post("/_sessions/revoke", func(c *fiber.Ctx) error {
+		return sessionRevokeHandler(c, sessionGetter, index, false)
+	})
+	app.Post("/_sessions/revoke_others", func(c *fiber.Ctx) error {
+		return sessionRevokeHandler(c, sessionGetter, index, true)
+	})
+	app.Get("/_logout", func(c *fiber.Ctx) error {
+		return logoutHandler(c, sessionGetter, &AuthUnauthenticator{}, nil)
+	})
+	app.Get("/test_login", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("user_id", "user-1")
+		sess.Set(amrSessionKey, []string{"pwd"})
+		indexSession(c, sess)
+		return (&AuthAuthenticator{}).Authenticate(sess)
+	})
+	app.Get("/test_login_password", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		indexSession(c, sess)
+		return (&AuthAuthenticator{}).Authenticate(sess)
+	})
+	app.Get("/test_whoami", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		if !auth.IsAuthenticated(sess) {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		return c.SendStatus(fiber.StatusOK)
+	})
+	return app
+}
+
+func setupSessionsTest(t *testing.T) *fiber.App {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+	InitForwardAuthHandler(testLogger())
+	return sessionsTestApp(t, true)
+}
+
+// sessionsTestLogin signs in user-1 from a browser with the given user agent.
+func sessionsTestLogin(t *testing.T, app *fiber.App, userAgent string) *http.Cookie {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, "/test_login", nil)
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	cookie := sessionCookie(resp)
+	testza.AssertNotNil(t, cookie)
+	return cookie
+}
+
+func sessionsTestList(t *testing.T, app *fiber.App, cookie *http.Cookie) []map[string]interface{} {
+	t.Helper()
+	resp, body := apiTokenCall(t, app, http.MethodGet, "/_sessions", "", cookie)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	testza.AssertEqual(t, "no-store", resp.Header.Get("Cache-Control"))
+	raw := body["sessions"].([]interface{})
+	list := make([]map[string]interface{}, 0, len(raw))
+	for _, s := range raw {
+		list = append(list, s.(map[string]interface{}))
+	}
+	return list
+}
+
+func TestSessions_ListAndRevoke(t *testing.T) {
+	app := setupSessionsTest(t)
+	laptop := sessionsTestLogin(t, app, "Laptop")
+	time.Sleep(time.Millisecond)
+	phone := sessionsTestLogin(t, app, "Phone")
+
+	list := sessionsTestList(t, app, laptop)
+	testza.AssertLen(t, list, 2)
+	testza.AssertEqual(t, "Phone", list[0]["user_agent"])
+	testza.AssertEqual(t, false, list[0]["current"])
+	testza.AssertEqual(t, "Laptop", list[1]["user_agent"])
+	testza.AssertEqual(t, true, list[1]["current"])
+	testza.AssertEqual(t, []interface{}{"pwd"}, list[1]["amr"])
+	// Sessions are listed by handle, never by ID
+	testza.AssertEqual(t, sessionindex.Handle(phone.Value), list[0]["id"])
+
+	resp, body := apiTokenCall(t, app, http.MethodPost, "/_sessions/revoke", `{"id":"`+list[0]["id"].(string)+`"}`, laptop)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	testza.AssertEqual(t, []interface{}{list[0]["id"]}, body["revoked"])
+
+	testza.AssertEqual(t, fiber.StatusUnauthorized, oidcRequest(t, app, "/test_whoami", phone).StatusCode)
+	testza.AssertEqual(t, fiber.StatusOK, oidcRequest(t, app, "/test_whoami", laptop).StatusCode)
+	testza.AssertLen(t, sessionsTestList(t, app, laptop), 1)
+
+	resp, body = apiTokenCall(t, app, http.MethodPost, "/_sessions/revoke", `{"id":"`+list[0]["id"].(string)+`"}`, laptop)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+	testza.AssertEqual(t, "not_found", body["error"])
+}
+
+func TestSessions_RevokeOthers(t *testing.T) {
+	app := setupSessionsTest(t)
+	current := sessionsTestLogin(t, app, "Laptop")
+	other1 := sessionsTestLogin(t, app, "Phone")
+	other2 := sessionsTestLogin(t, app, "Tablet")
+
+	resp, body := apiTokenCall(t, app, http.MethodPost, "/_sessions/revoke_others", `{}`, current)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	testza.AssertLen(t, body["revoked"], 2)
+
+	testza.AssertEqual(t, fiber.StatusOK, oidcRequest(t, app, "/test_whoami", current).StatusCode)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, oidcRequest(t, app, "/test_whoami", other1).StatusCode)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, oidcRequest(t, app, "/test_whoami", other2).StatusCode)
+
+	list := sessionsTestList(t, app, current)
+	testza.AssertLen(t, list, 1)
+	testza.AssertEqual(t, true, list[0]["current"])
+}
+
+func TestSessions_LogoutRemovesSession(t *testing.T) {
+	app := setupSessionsTest(t)
+	laptop := sessionsTestLogin(t, app, "Laptop")
+	phone := sessionsTestLogin(t, app, "Phone")
+
+	oidcRequest(t, app, "/_logout", phone)
+	list := sessionsTestList(t, app, laptop)
+	testza.AssertLen(t, list, 1)
+	testza.AssertEqual(t, "Laptop", list[0]["user_agent"])
+}
+
+func TestSessions_RequiresUser(t *testing.T) {
+	app := setupSessionsTest(t)
+
+	resp, body := apiTokenCall(t, app, http.MethodPost, "/_sessions/revoke_others", `{}`, nil)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	testza.AssertEqual(t, "unauthorized", body["error"])
+
+	password := sessionCookie(oidcRequest(t, app, "/test_login_password", nil))
+	resp, body = apiTokenCall(t, app, http.MethodPost, "/_sessions/revoke_others", `{}`, password)
+	testza.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode)
+	testza.AssertEqual(t, "no_user_id", body["error"])
+}
+
+func TestSessions_Disabled(t *testing.T) {
+	app := sessionsTestApp(t, false)
+	resp, _ := apiTokenCall(t, app, http.MethodPost, "/_sessions/revoke", `{"id":"x"}`, nil)
+	testza.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/soulteary/herald/pkg/herald"
+	"github.com/soulteary/stargate/src/internal/auditlog"
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/metrics"
+	"github.com/soulteary/stargate/src/internal/ratelimit"
+	"github.com/soulteary/stargate/src/internal/webauthn"
+	"github.com/soulteary/tracing-kit"
+)
+
+const (
+	// StepUpPath is the route serving the step-up page (GET) and verification API (POST).
+	StepUpPath = "/_step_up"
+	// StepUpSessionKey holds the Unix time (seconds) of the last successful step-up.
+	StepUpSessionKey = "step_up_verified"
+	// StepUpReturnParam is the query parameter carrying the URL to return to after step-up.
+	StepUpReturnParam = ReturnToParam
+
+	// stepUpMethodSessionKey holds the method used for the last step-up ("code", "totp" or "passkey").
+	stepUpMethodSessionKey = "step_up_method"
+	// amrSessionKey holds the session's authentication method references (RFC 8176).
+	amrSessionKey = "user_amr"
+)
+
+// Step-up verification methods accepted by StepUpAPI.
+const (
+	stepUpMethodCode    = "code"
+	stepUpMethodTOTP    = "totp"
+	stepUpMethodPasskey = "passkey"
+)
+
+// StepUpVerifiedAt returns when the session last completed step-up, or the zero time if never.
+func StepUpVerifiedAt(sess *session.Session) time.Time {
+	switch v := sess.Get(StepUpSessionKey).(type) {
+	case int64:
+		return time.Unix(v, 0)
+	case int:
+		return time.Unix(int64(v), 0)
+	default:
+		// Missing, or a legacy boolean marker without timestamp: treat as not verified
+		return time.Time{}
+	}
+}
+
+// IsStepUpFresh reports whether the session's step-up is still within STEP_UP_MAX_AGE.
+// A max age of 0 keeps the step-up valid for the rest of the session.
+func IsStepUpFresh(sess *session.Session, now time.Time) bool {
+	verifiedAt := StepUpVerifiedAt(sess)
+	if verifiedAt.IsZero() {
+		return false
+	}
+	maxAge := config.StepUpMaxAge.ToDuration()
+	if maxAge <= 0 {
+		return true
+	}
+	return now.Sub(verifiedAt) < maxAge
+}
+
+// RequiresStepUp reports whether the forwarded request path matches STEP_UP_PATHS.
+func RequiresStepUp(ctx *fiber.Ctx) bool {
+	path := GetForwardedURI(ctx)
+	if idx := strings.IndexAny(path, "?#"); idx >= 0 {
+		path = path[:idx]
+	}
+	return config.GetStepUpMatcher().RequiresStepUp(path)
+}
+
+// BuildStepUpURL constructs the step-up page URL on the auth host, carrying the original URL.
+//
+// The URL format is: {protocol}://{authHost}/_step_up?return_to={originalURL}
+func BuildStepUpURL(ctx *fiber.Ctx) string {
+	return fmt.Sprintf("%s://%s%s?%s=%s",
+		GetForwardedProto(ctx), config.AuthHost.String(), StepUpPath,
+		StepUpReturnParam, url.QueryEscape(getOriginalURL(ctx)))
+}
+
+// handleStepUpRequired redirects browsers to the step-up page and returns 401 to API clients.
+func handleStepUpRequired(ctx *fiber.Ctx) error {
+	if IsHTMLRequest(ctx) {
+		return ctx.Redirect(BuildStepUpURL(ctx), fiber.StatusFound)
+	}
+	return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.step_up_required"))
+}
+
+// appendAMR adds methods to the session AMR, keeping existing entries and skipping duplicates.
+func appendAMR(sess *session.Session, methods ...string) {
+	existing, _ := sess.Get(amrSessionKey).([]string)
+	amr := make([]string, 0, len(existing)+len(methods))
+	seen := make(map[string]bool, len(existing)+len(methods))
+	for _, m := range append(existing, methods...) {
+		if m == "" || seen[m] {
+			continue
+		}
+		seen[m] = true
+		amr = append(amr, m)
+	}
+	sess.Set(amrSessionKey, amr)
+}
+
+// stepUpOptions describes which step-up methods are available for the session's user.
+type stepUpOptions struct {
+	userID  string
+	phone   string
+	mail    string
+	code    bool
+	totp    bool
+	passkey bool
+}
+
+// getStepUpOptions determines the available step-up methods from config and session data.
+// Herald codes need a known phone or mail; per-user TOTP needs a user_id; the legacy global
+// OTP secret works for any session. Passkeys need a user_id with at least one passkey registered.
+func getStepUpOptions(sess *session.Session) stepUpOptions {
+	opts := stepUpOptions{}
+	opts.userID, _ = sess.Get("user_id").(string)
+	opts.phone, _ = sess.Get("user_phone").(string)
+	opts.mail, _ = sess.Get("user_mail").(string)
+
+	opts.code = config.HeraldEnabled.ToBool() && opts.userID != "" && (opts.phone != "" || opts.mail != "")
+	if userTOTPEnabled() {
+		opts.totp = opts.userID != ""
+	} else if config.WardenOTPEnabled.ToBool() {
+		opts.totp = auth.GetOTPSecret() != ""
+	}
+	passkeys, _ := userPasskeys(webauthn.Get(), opts.userID)
+	opts.passkey = len(passkeys) > 0
+	return opts
+}
+
+// stepUpRouteHandler is the internal handler that can be tested with mocked dependencies.
+func stepUpRouteHandler(ctx *fiber.Ctx, sessionGetter SessionGetter) error {
+	sess, err := sessionGetter.Get(ctx)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	if !auth.IsAuthenticated(sess) {
+		return ctx.Redirect("/_login", fiber.StatusFound)
+	}
+
+	returnTo := SanitizeReturnURL(ctx.Query(StepUpReturnParam), "/")
+
+	// Nothing to do if the user already stepped up recently
+	if IsStepUpFresh(sess, time.Now()) {
+		return ctx.Redirect(returnTo, fiber.StatusFound)
+	}
+
+	opts := getStepUpOptions(sess)
+	if !opts.code && !opts.totp && !opts.passkey {
+		return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.step_up_unavailable"))
+	}
+
+	return ctx.Render("step_up", fiber.Map{
+		"Title":           config.LoginPageTitle.Value,
+		"FooterText":      config.LoginPageFooterText.Value,
+		"ReturnTo":        returnTo,
+		"CodeEnabled":     opts.code,
+		"OTPEnabled":      opts.totp,
+		"PasskeyEnabled":  opts.passkey,
+		"UserTOTPEnabled": userTOTPEnabled(),
+		"Phone":           opts.phone,
+		"Mail":            opts.mail,
+		"Debug":           config.Debug.ToBool(),
+	})
+}
+
+// StepUpRoute handles GET /_step_up - shows the step-up page (requires auth).
+// If the session already has a fresh step-up, it redirects straight back to return_to.
+//
+// Parameters:
+//   - store: Session store for managing user sessions
+//
+// Returns a Fiber handler function.
+func StepUpRoute(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	return func(ctx *fiber.Ctx) error {
+		return stepUpRouteHandler(ctx, sessionGetter)
+	}
+}
+
+// verifyCodeErrorMessage maps a Herald verification failure reason to a localized message.
+func verifyCodeErrorMessage(ctx *fiber.Ctx, reason string, resp *herald.VerifyChallengeResponse) string {
+	switch reason {
+	case "expired":
+		return i18n.T(ctx, "error.verify_code_expired")
+	case "invalid":
+		if resp != nil && resp.RemainingAttempts != nil {
+			return i18n.Tf(ctx, "error.verify_code_invalid_with_attempts", *resp.RemainingAttempts)
+		}
+		return i18n.T(ctx, "error.verify_code_invalid")
+	case "locked":
+		return i18n.T(ctx, "error.verify_code_locked")
+	case "too_many_attempts":
+		return i18n.T(ctx, "error.verify_code_too_many")
+	case "rate_limited":
+		if resp != nil && resp.NextResendIn != nil {
+			return i18n.Tf(ctx, "error.verify_code_rate_limited_with_wait", *resp.NextResendIn)
+		}
+		return i18n.T(ctx, "error.verify_code_rate_limited")
+	case "send_failed":
+		return i18n.T(ctx, "error.verify_code_send_failed")
+	case "unauthorized":
+		return i18n.T(ctx, "error.verify_code_unauthorized")
+	default:
+		return i18n.T(ctx, "error.verify_code_failed")
+	}
+}
+
+// stepUpFailed records a failed step-up attempt and sends the error response.
+func stepUpFailed(ctx *fiber.Ctx, userID, method, reason string, statusCode int, message string) error {
+	metrics.RecordAuthRequest("step_up_"+method, "failure")
+	auditlog.LogStepUp(ctx.Context(), userID, method, GetClientIP(ctx), false, reason)
+	return SendErrorResponse(ctx, statusCode, message)
+}
+
+// stepUpAPIHandler is the internal handler that can be tested with mocked dependencies.
+// A nil reissue leaves the domains the session was exchanged to with the old session ID.
+func stepUpAPIHandler(ctx *fiber.Ctx, sessionGetter SessionGetter, reissue *sessionReissue) error {
+	// Get trace context from middleware
+	traceCtx := ctx.Locals("trace_context")
+	if traceCtx == nil {
+		traceCtx = ctx.Context()
+	}
+	spanCtx := traceCtx.(context.Context)
+
+	stepUpCtx, stepUpSpan := tracing.StartSpan(spanCtx, "auth.step_up")
+	defer stepUpSpan.End()
+
+	sess, err := sessionGetter.Get(ctx)
+	if err != nil {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	if !auth.IsAuthenticated(sess) {
+		return SendErrorResponse(ctx, fiber.StatusUnauthorized, i18n.T(ctx, "error.auth_required"))
+	}
+
+	opts := getStepUpOptions(sess)
+	method := ctx.FormValue("method")
+	if method == "" {
+		method = stepUpMethodCode
+		if ctx.FormValue("otp_code") != "" {
+			method = stepUpMethodTOTP
+		}
+	}
+	stepUpSpan.SetAttributes(attribute.String("auth.step_up_method", method))
+
+	// Wrong codes count against the same login limits as a sign-in, per client IP and per user ID
+	limitKeys := ratelimit.LoginKeys(GetClientIP(ctx), opts.userID)
+	if retryAfter := rateLimitRetryAfter(ctx, ratelimit.ScopeLogin, opts.userID, limitKeys...); retryAfter > 0 {
+		tracing.RecordError(stepUpSpan, errRateLimited)
+		metrics.RecordAuthRequest("step_up_"+method, "rate_limited")
+		setRetryAfter(ctx, retryAfter)
+		return SendErrorResponse(ctx, fiber.StatusTooManyRequests, i18n.T(ctx, "error.rate_limited_retry"))
+	}
+
+	var amr []string
+	switch method {
+	case stepUpMethodCode:
+		if !opts.code {
+			return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.step_up_unavailable"))
+		}
+		challengeID := ctx.FormValue("challenge_id")
+		verifyCode := ctx.FormValue("verify_code")
+		if challengeID == "" || verifyCode == "" {
+			return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.verify_code_and_challenge_required"))
+		}
+		heraldClient := getHeraldClient()
+		if heraldClient == nil {
+			return SendErrorResponse(ctx, fiber.StatusServiceUnavailable, i18n.T(ctx, "error.herald_unavailable"))
+		}
+
+		heraldCtx, heraldSpan := tracing.StartSpan(stepUpCtx, "herald.verify_challenge")
+		startTime := time.Now()
+		verifyResp, err := heraldClient.VerifyChallenge(heraldCtx, &herald.VerifyChallengeRequest{
+			ChallengeID: challengeID,
+			Code:        verifyCode,
+			ClientIP:    GetClientIP(ctx),
+		})
+		duration := time.Since(startTime)
+		heraldSpan.End()
+		if err != nil || verifyResp == nil || !verifyResp.OK {
+			metrics.RecordHeraldCall("verify_challenge", "failure", duration)
+			reason := "invalid"
+			if verifyResp != nil && verifyResp.Reason != "" {
+				reason = verifyResp.Reason
+			} else if heraldErr, ok := err.(*herald.HeraldError); ok && (heraldErr.StatusCode == 0 || heraldErr.Reason == "connection_failed") {
+				return stepUpFailed(ctx, opts.userID, method, "connection_failed", fiber.StatusServiceUnavailable, i18n.T(ctx, "error.herald_unavailable_retry"))
+			}
+			auditlog.LogVerifyCodeCheck(ctx.Context(), opts.userID, GetClientIP(ctx), false, reason)
+			recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, opts.userID, limitKeys...)
+			return stepUpFailed(ctx, opts.userID, method, reason, fiber.StatusUnauthorized, verifyCodeErrorMessage(ctx, reason, verifyResp))
+		}
+		metrics.RecordHeraldCall("verify_challenge", "success", duration)
+		auditlog.LogVerifyCodeCheck(ctx.Context(), opts.userID, GetClientIP(ctx), true, "")
+
+		// The code must belong to the user of this session
+		if verifyResp.UserID != opts.userID {
+			log.Warn().Str("expected", opts.userID).Str("got", verifyResp.UserID).Msg("Step-up user ID mismatch")
+			recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, opts.userID, limitKeys...)
+			return stepUpFailed(ctx, opts.userID, method, "user_mismatch", fiber.StatusUnauthorized, i18n.T(ctx, "error.verify_failed"))
+		}
+		amr = verifyResp.AMR
+		if len(amr) == 0 {
+			amr = []string{"otp"}
+		}
+
+	case stepUpMethodTOTP:
+		if !opts.totp {
+			return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.step_up_unavailable"))
+		}
+		otpCode := ctx.FormValue("otp_code")
+		if otpCode == "" {
+			return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.otp_code_required"))
+		}
+		if userTOTPEnabled() {
+			backend := getTOTPBackend()
+			if backend == nil {
+				return SendErrorResponse(ctx, fiber.StatusServiceUnavailable, i18n.T(ctx, "error.herald_unavailable"))
+			}
+			ok, err := backend.Verify(stepUpCtx, opts.userID, otpCode, "")
+			if err != nil || !ok {
+				log.Warn().Err(err).Str("user_id", opts.userID).Msg("Step-up TOTP verification failed")
+				recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, opts.userID, limitKeys...)
+				return stepUpFailed(ctx, opts.userID, method, "otp_verification_failed", fiber.StatusUnauthorized, i18n.T(ctx, "error.otp_code_invalid"))
+			}
+		} else if !auth.VerifyOTPFor(opts.userID, auth.GetOTPSecret(), otpCode) {
+			recordRateLimitAttempt(ctx, ratelimit.ScopeLogin, opts.userID, limitKeys...)
+			return stepUpFailed(ctx, opts.userID, method, "otp_verification_failed", fiber.StatusUnauthorized, i18n.T(ctx, "error.otp_code_invalid"))
+		}
+		amr = []string{"otp"}
+
+	case stepUpMethodPasskey:
+		if !opts.passkey {
+			return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.step_up_unavailable"))
+		}
+		// Failures still save the session, so the challenge cannot be answered again
+		challenge, _ := takePasskeyChallenge(sess, passkeyCeremonyStepUp)
+		fail := func(reason string, statusCode int, key string) error {
+			if err := sess.Save(); err != nil {
+				return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+			}
+			return stepUpFailed(ctx, opts.userID, method, reason, statusCode, i18n.T(ctx, key))
+		}
+		if challenge == "" {
+			return fail("challenge_expired", fiber.StatusBadRequest, "error.passkey_expired")
+		}
+		resp, err := webauthn.ParseResponse([]byte(ctx.FormValue("credential")))
+		if err != nil {
+			return fail("invalid_request", fiber.StatusBadRequest, "error.passkey_invalid")
+		}
+		// Only the session user's own passkeys are accepted
+		cred, err := webauthn.Get().FinishLogin(challenge, resp, opts.userID)
+		if err != nil {
+			log.Warn().Err(err).Str("user_id", opts.userID).Msg("Step-up passkey verification failed")
+			return fail("passkey_invalid", fiber.StatusUnauthorized, "error.passkey_invalid")
+		}
+		amr = []string{cred.AMR()}
+
+	default:
+		return SendErrorResponse(ctx, fiber.StatusBadRequest, i18n.T(ctx, "error.choose_verify_method"))
+	}
+
+	if opts.userID != "" {
+		resetRateLimit(ctx, ratelimit.LoginIdentifierKey(opts.userID))
+	}
+
+	sess.Set(StepUpSessionKey, time.Now().Unix())
+	sess.Set(stepUpMethodSessionKey, method)
+	appendAMR(sess, amr...)
+	oldID := sess.ID()
+	if err := rotateSessionID(sess); err != nil {
+		tracing.RecordError(stepUpSpan, err)
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	indexSession(ctx, sess)
+	// Saving releases the session, so keep its ID for the exchanged domains
+	sessionID := sess.ID()
+	if err := sess.Save(); err != nil {
+		tracing.RecordError(stepUpSpan, err)
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+
+	metrics.RecordAuthRequest("step_up_"+method, "success")
+	auditlog.LogStepUp(ctx.Context(), opts.userID, method, GetClientIP(ctx), true, "")
+	stepUpSpan.SetAttributes(attribute.String("auth.result", "success"))
+
+	returnTo := SanitizeReturnURL(ctx.FormValue(StepUpReturnParam), "/")
+	if reissue != nil {
+		returnTo = reissueExchangedSession(ctx, reissue, oldID, sessionID, returnTo)
+	}
+	if strings.Contains(ctx.Get("Accept"), "application/json") {
+		return ctx.Status(fiber.StatusOK).JSON(fiber.Map{
+			"success":  true,
+			"redirect": returnTo,
+			"message":  i18n.T(ctx, "success.step_up"),
+		})
+	}
+	return ctx.Redirect(returnTo, fiber.StatusFound)
+}
+
+// StepUpAPI handles POST /_step_up - re-verifies the signed-in user with a Herald code, TOTP or a
+// passkey. On success it records the step-up time and method in the session, adds the method to
+// the session AMR, gives the session a new ID, and returns the user to return_to by way of the
+// domains the session was exchanged to, which receive the new ID.
+//
+// Parameters:
+//   - store: Session store for managing user sessions
+//
+// Returns a Fiber handler function.
+func StepUpAPI(store *session.Store) func(c *fiber.Ctx) error {
+	sessionGetter := &SessionStoreAdapter{store: store}
+	reissue := newSessionReissue(store.Storage)
+	return func(ctx *fiber.Ctx) error {
+		return stepUpAPIHandler(ctx, sessionGetter, reissue)
+	}
+}
@@ -0,0 +1,453 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pquerna/otp/totp"
+
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+)
+
+const testStepUpOTPSecret = "JBSWY3DPEHPK3PXP"
+
+func setupStepUpConfig(t *testing.T) {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("COOKIE_DOMAIN", ".example.com")
+	t.Setenv("STEP_UP_ENABLED", "true")
+	t.Setenv("STEP_UP_PATHS", "/admin*")
+	t.Setenv("STEP_UP_MAX_AGE", "10m")
+	t.Setenv("WARDEN_OTP_ENABLED", "true")
+	t.Setenv("WARDEN_OTP_SECRET_KEY", testStepUpOTPSecret)
+	err := config.Initialize(testLogger())
+	testza.AssertNoError(t, err)
+	InitForwardAuthHandler(testLogger())
+	auth.InitWardenClient(testLogger())
+}
+
+func TestIsStepUpFresh(t *testing.T) {
+	setupStepUpConfig(t)
+	store := setupTestStore()
+	ctx, app := createTestContext("GET", "/", nil, "")
+	defer app.ReleaseCtx(ctx)
+
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+	now := time.Now()
+
+	testza.AssertFalse(t, IsStepUpFresh(sess, now), "missing marker")
+
+	sess.Set(StepUpSessionKey, true)
+	testza.AssertFalse(t, IsStepUpFresh(sess, now), "legacy boolean marker has no timestamp")
+
+	sess.Set(StepUpSessionKey, now.Add(-5*time.Minute).Unix())
+	testza.AssertTrue(t, IsStepUpFresh(sess, now))
+
+	sess.Set(StepUpSessionKey, now.Add(-11*time.Minute).Unix())
+	testza.AssertFalse(t, IsStepUpFresh(sess, now), "older than STEP_UP_MAX_AGE")
+
+	config.StepUpMaxAge.Value = "0"
+	testza.AssertTrue(t, IsStepUpFresh(sess, now), "max age 0 keeps step-up for the session")
+}
+
+func TestAppendAMR(t *testing.T) {
+	store := setupTestStore()
+	ctx, app := createTestContext("GET", "/", nil, "")
+	defer app.ReleaseCtx(ctx)
+
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+
+	appendAMR(sess, "sms")
+	appendAMR(sess, "otp", "sms", "")
+	testza.AssertEqual(t, []string{"sms", "otp"}, sess.Get(amrSessionKey))
+}
+
+func TestRequiresStepUp(t *testing.T) {
+	setupStepUpConfig(t)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{"X-Forwarded-Uri": "/admin/users?page=2"}, "")
+	defer app.ReleaseCtx(ctx)
+	testza.AssertTrue(t, RequiresStepUp(ctx))
+
+	ctx2, app2 := createTestContext("GET", "/_auth", map[string]string{"X-Forwarded-Uri": "/reports?next=/admin"}, "")
+	defer app2.ReleaseCtx(ctx2)
+	testza.AssertFalse(t, RequiresStepUp(ctx2))
+}
+
+func TestBuildStepUpURL(t *testing.T) {
+	setupStepUpConfig(t)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "app.example.com",
+		"X-Forwarded-Uri":   "/admin/42?tab=x",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	u, err := url.Parse(BuildStepUpURL(ctx))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "auth.example.com", u.Host)
+	testza.AssertEqual(t, StepUpPath, u.Path)
+	testza.AssertEqual(t, "https://app.example.com/admin/42?tab=x", u.Query().Get(StepUpReturnParam))
+}
+
+func TestCheckRoute_StepUpRequired_RedirectsToStepUp(t *testing.T) {
+	setupStepUpConfig(t)
+	store := setupTestStore()
+	handler := CheckRoute(store)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":            "text/html",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "app.example.com",
+		"X-Forwarded-Uri":   "/admin",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertNoError(t, auth.Authenticate(sess))
+
+	err = handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusFound, ctx.Response().StatusCode())
+	testza.AssertContains(t, string(ctx.Response().Header.Peek("Location")), "https://auth.example.com/_step_up?return_to=")
+}
+
+func TestCheckRoute_StepUpRequired_APIRequest(t *testing.T) {
+	setupStepUpConfig(t)
+	store := setupTestStore()
+	handler := CheckRoute(store)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":          "application/json",
+		"X-Forwarded-Uri": "/admin",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertNoError(t, auth.Authenticate(sess))
+
+	err = handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, ctx.Response().StatusCode())
+}
+
+func TestCheckRoute_StepUpFresh_Allows(t *testing.T) {
+	setupStepUpConfig(t)
+	store := setupTestStore()
+	handler := CheckRoute(store)
+
+	ctx, app := createTestContext("GET", "/_auth", map[string]string{
+		"Accept":          "application/json",
+		"X-Forwarded-Uri": "/admin",
+	}, "")
+	defer app.ReleaseCtx(ctx)
+
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+	sess.Set(StepUpSessionKey, time.Now().Unix())
+	testza.AssertNoError(t, auth.Authenticate(sess))
+
+	err = handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+}
+
+func TestStepUpRoute_NotAuthenticated_RedirectsToLogin(t *testing.T) {
+	setupStepUpConfig(t)
+	handler := StepUpRoute(setupTestStore())
+
+	ctx, app := createTestContext("GET", "/_step_up", nil, "")
+	defer app.ReleaseCtx(ctx)
+
+	err := handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusFound, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "/_login", string(ctx.Response().Header.Peek("Location")))
+}
+
+func TestStepUpRoute_AlreadyFresh_RedirectsBack(t *testing.T) {
+	setupStepUpConfig(t)
+	store := setupTestStore()
+	handler := StepUpRoute(store)
+
+	ctx, app := createTestContext("GET", "/_step_up?return_to="+url.QueryEscape("https://app.example.com/admin"), nil, "")
+	defer app.ReleaseCtx(ctx)
+
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+	sess.Set(StepUpSessionKey, time.Now().Unix())
+	testza.AssertNoError(t, auth.Authenticate(sess))
+
+	err = handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusFound, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "https://app.example.com/admin", string(ctx.Response().Header.Peek("Location")))
+}
+
+func TestStepUpRoute_NoMethodAvailable(t *testing.T) {
+	setupStepUpConfig(t)
+	config.WardenOTPEnabled.Value = "false"
+	store := setupTestStore()
+	handler := StepUpRoute(store)
+
+	ctx, app := createTestContext("GET", "/_step_up", nil, "")
+	defer app.ReleaseCtx(ctx)
+
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertNoError(t, auth.Authenticate(sess))
+
+	err = handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusBadRequest, ctx.Response().StatusCode())
+}
+
+func TestStepUpAPI_OTP_Success(t *testing.T) {
+	setupStepUpConfig(t)
+	store := setupTestStore()
+	handler := StepUpAPI(store)
+
+	code, err := totp.GenerateCode(testStepUpOTPSecret, time.Now())
+	testza.AssertNoError(t, err)
+	body := url.Values{
+		"method":    {"totp"},
+		"otp_code":  {code},
+		"return_to": {"https://app.example.com/admin/42?tab=x"},
+	}.Encode()
+
+	ctx, app := createTestContext("POST", "/_step_up", map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+		"Accept":       "application/json",
+	}, body)
+	defer app.ReleaseCtx(ctx)
+
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+	sess.Set(amrSessionKey, []string{"pwd"})
+	testza.AssertNoError(t, auth.Authenticate(sess))
+
+	err = handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusOK, ctx.Response().StatusCode())
+
+	var resp map[string]interface{}
+	testza.AssertNoError(t, json.Unmarshal(ctx.Response().Body(), &resp))
+	testza.AssertEqual(t, true, resp["success"])
+	testza.AssertEqual(t, "https://app.example.com/admin/42?tab=x", resp["redirect"])
+
+	// Step-up rotated the session ID
+	sess = responseSession(t, store, ctx)
+	testza.AssertTrue(t, IsStepUpFresh(sess, time.Now()))
+	testza.AssertEqual(t, "totp", sess.Get(stepUpMethodSessionKey))
+	testza.AssertEqual(t, []string{"pwd", "otp"}, sess.Get(amrSessionKey))
+}
+
+func TestStepUpAPI_OTP_Invalid(t *testing.T) {
+	setupStepUpConfig(t)
+	store := setupTestStore()
+	handler := StepUpAPI(store)
+
+	ctx, app := createTestContext("POST", "/_step_up", map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+		"Accept":       "application/json",
+	}, "method=totp&otp_code=000000")
+	defer app.ReleaseCtx(ctx)
+
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertNoError(t, auth.Authenticate(sess))
+
+	err = handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, ctx.Response().StatusCode())
+	testza.AssertFalse(t, IsStepUpFresh(sess, time.Now()))
+}
+
+func TestStepUpAPI_ReissuesExchangedDomains(t *testing.T) {
+	t.Setenv("CALLBACK_ALLOWED_DOMAINS", "app.example.org")
+	setupStepUpConfig(t)
+	store := setupTestStore()
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("i18n-bundle", i18n.GetBundle())
+		c.Locals("i18n-language", i18n.LangEN)
+		return c.Next()
+	})
+	app.Get("/test_login", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("user_id", "user-1")
+		return auth.Authenticate(sess)
+	})
+	app.Get(SessionExchangePath, SessionShareRoute(store))
+	app.Post(StepUpPath, StepUpAPI(store))
+	app.Get("/test_whoami", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		if !auth.IsAuthenticated(sess) {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		if !IsStepUpFresh(sess, time.Now()) {
+			return c.SendStatus(fiber.StatusForbidden)
+		}
+		return c.SendStatus(fiber.StatusOK)
+	})
+	exchangeRequest := func(host, target string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Forwarded-Host", host)
+		resp, err := app.Test(req)
+		testza.AssertNoError(t, err)
+		return resp
+	}
+
+	loggedIn := sessionCookie(oidcRequest(t, app, "/test_login", nil))
+	testza.AssertNotNil(t, loggedIn)
+
+	// Share the session with another domain
+	code, err := newStorageExchangeCodes(store.Storage).Mint(loggedIn.Value, "app.example.org")
+	testza.AssertNoError(t, err)
+	resp := exchangeRequest("app.example.org", SessionExchangePath+"?"+ExchangeCodeParam+"="+url.QueryEscape(code))
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	exchanged := sessionCookie(resp)
+	testza.AssertNotNil(t, exchanged)
+	testza.AssertEqual(t, fiber.StatusForbidden, oidcRequest(t, app, "/test_whoami", exchanged).StatusCode)
+
+	// Step up on the auth domain
+	otpCode, err := totp.GenerateCode(testStepUpOTPSecret, time.Now())
+	testza.AssertNoError(t, err)
+	form := url.Values{"method": {"totp"}, "otp_code": {otpCode}, "return_to": {"/admin"}}
+	req := httptest.NewRequest(http.MethodPost, StepUpPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Forwarded-Host", "auth.example.com")
+	req.AddCookie(loggedIn)
+	resp, err = app.Test(req)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	steppedUp := sessionCookie(resp)
+	testza.AssertNotNil(t, steppedUp)
+	testza.AssertNotEqual(t, loggedIn.Value, steppedUp.Value)
+	var body map[string]interface{}
+	testza.AssertNoError(t, json.NewDecoder(resp.Body).Decode(&body))
+
+	// The pre-step-up ID no longer authenticates anywhere
+	testza.AssertEqual(t, fiber.StatusUnauthorized, oidcRequest(t, app, "/test_whoami", loggedIn).StatusCode)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, oidcRequest(t, app, "/test_whoami", exchanged).StatusCode)
+	testza.AssertEqual(t, fiber.StatusOK, oidcRequest(t, app, "/test_whoami", steppedUp).StatusCode)
+
+	// The browser is sent through the exchanged domain, which receives the new ID, before it
+	// returns to return_to
+	hop, err := url.Parse(body["redirect"].(string))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "app.example.org", hop.Host)
+	testza.AssertEqual(t, SessionExchangePath, hop.Path)
+	resp = exchangeRequest(hop.Host, hop.RequestURI())
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	testza.AssertEqual(t, "http://auth.example.com/admin", resp.Header.Get("Location"))
+	testza.AssertEqual(t, "no-store", resp.Header.Get("Cache-Control"))
+	reissued := sessionCookie(resp)
+	testza.AssertNotNil(t, reissued)
+	testza.AssertEqual(t, steppedUp.Value, reissued.Value)
+	testza.AssertEqual(t, fiber.StatusOK, oidcRequest(t, app, "/test_whoami", reissued).StatusCode)
+
+	// The domain is recorded for the new ID, and the reissue token is single-use
+	origins, err := newExchangedOrigins(store.Storage).List(steppedUp.Value)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, []string{"http://app.example.org"}, origins)
+	resp = exchangeRequest(hop.Host, hop.RequestURI())
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+func TestStepUpAPI_RateLimited(t *testing.T) {
+	t.Setenv("RATE_LIMIT_MAX_FAILURES", "3")
+	setupStepUpConfig(t)
+	useTestRateLimiter(t)
+	store := setupTestStore()
+	handler := StepUpAPI(store)
+
+	stepUp := func(otpCode string) (int, string) {
+		ctx, app := createTestContext("POST", "/_step_up", map[string]string{
+			"Content-Type": "application/x-www-form-urlencoded",
+			"Accept":       "application/json",
+		}, url.Values{"method": {"totp"}, "otp_code": {otpCode}}.Encode())
+		defer app.ReleaseCtx(ctx)
+
+		sess, err := store.Get(ctx)
+		testza.AssertNoError(t, err)
+		sess.Set("user_id", "alice")
+		testza.AssertNoError(t, auth.Authenticate(sess))
+
+		testza.AssertNoError(t, handler(ctx))
+		return ctx.Response().StatusCode(), string(ctx.Response().Header.Peek(fiber.HeaderRetryAfter))
+	}
+
+	for i := 0; i < 3; i++ {
+		status, _ := stepUp("000000")
+		testza.AssertEqual(t, fiber.StatusUnauthorized, status)
+	}
+
+	// Locked out: even a valid code is refused until the lockout ends
+	code, err := totp.GenerateCode(testStepUpOTPSecret, time.Now())
+	testza.AssertNoError(t, err)
+	status, retryAfter := stepUp(code)
+	testza.AssertEqual(t, fiber.StatusTooManyRequests, status)
+	testza.AssertEqual(t, "60", retryAfter)
+}
+
+func TestStepUpAPI_UntrustedReturnURL_FallsBack(t *testing.T) {
+	setupStepUpConfig(t)
+	store := setupTestStore()
+	handler := StepUpAPI(store)
+
+	code, err := totp.GenerateCode(testStepUpOTPSecret, time.Now())
+	testza.AssertNoError(t, err)
+	body := url.Values{"otp_code": {code}, "return_to": {"https://evil.example.net/"}}.Encode()
+
+	ctx, app := createTestContext("POST", "/_step_up", map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	}, body)
+	defer app.ReleaseCtx(ctx)
+
+	sess, err := store.Get(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertNoError(t, auth.Authenticate(sess))
+
+	err = handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusFound, ctx.Response().StatusCode())
+	testza.AssertEqual(t, "/", string(ctx.Response().Header.Peek("Location")))
+}
+
+func TestStepUpAPI_NotAuthenticated(t *testing.T) {
+	setupStepUpConfig(t)
+	handler := StepUpAPI(setupTestStore())
+
+	ctx, app := createTestContext("POST", "/_step_up", map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+		"Accept":       "application/json",
+	}, "method=totp&otp_code=123456")
+	defer app.ReleaseCtx(ctx)
+
+	err := handler(ctx)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, ctx.Response().StatusCode())
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/herald/pkg/herald"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/totpstore"
+)
+
+const (
+	// authMethodBackupCode is the auth method reported in metrics and the audit log for Warden
+	// logins completed with a TOTP backup code.
+	authMethodBackupCode = "warden_backup_code"
+	// amrBackupCode marks sessions whose second factor was a backup code rather than the
+	// authenticator app, so policies can tell them apart from "otp".
+	amrBackupCode = "backup_code"
+	// auditBackupCodeUsed is the audit reason of a successful backup-code login.
+	auditBackupCodeUsed = "backup_code_used"
+)
+
+// totpBackend keeps the per-user TOTP secrets: herald-totp behind Herald, or the local
+// encrypted store (TOTP_ENABLED).
+type totpBackend interface {
+	// Enabled reports whether userID has bound TOTP.
+	Enabled(ctx context.Context, userID string) (bool, error)
+	// EnrollStart starts binding TOTP for userID and returns the enrollment ID and otpauth:// URI.
+	EnrollStart(ctx context.Context, userID, label string) (enrollID, otpauthURI string, err error)
+	// EnrollConfirm finishes the enrollment with the first code and returns the backup codes, if any.
+	EnrollConfirm(ctx context.Context, userID, enrollID, code string) ([]string, error)
+	// Verify reports whether code is a valid TOTP code of userID.
+	Verify(ctx context.Context, userID, code, challengeID string) (bool, error)
+	// RedeemBackupCode reports whether code is an unused backup code of userID, and uses it up.
+	RedeemBackupCode(ctx context.Context, userID, code string) (bool, error)
+	// Revoke removes the TOTP binding of userID.
+	Revoke(ctx context.Context, userID string) error
+}
+
+// userTOTPEnabled reports whether per-user TOTP is configured, through Herald or locally.
+func userTOTPEnabled() bool {
+	return config.HeraldTOTPEnabled.ToBool() || totpstore.Get() != nil
+}
+
+// getTOTPBackend returns the backend of per-user TOTP, or nil when none is available. Herald TOTP
+// takes precedence; the local store is used when it is off. Without either, the /totp pages keep
+// using a configured Herald client.
+func getTOTPBackend() totpBackend {
+	if !config.HeraldTOTPEnabled.ToBool() {
+		if store := totpstore.Get(); store != nil {
+			return localTOTP{store: store}
+		}
+	}
+	if client := getHeraldClient(); client != nil {
+		return heraldTOTP{client: client}
+	}
+	return nil
+}
+
+// totpUnavailable answers a request whose TOTP backend failed.
+func totpUnavailable(ctx *fiber.Ctx, backend totpBackend) error {
+	if _, ok := backend.(localTOTP); ok {
+		return SendErrorResponse(ctx, fiber.StatusInternalServerError, i18n.T(ctx, "error.session_store_failed"))
+	}
+	return SendErrorResponse(ctx, fiber.StatusBadGateway, i18n.T(ctx, "error.herald_unavailable_retry"))
+}
+
+// heraldTOTP is herald-totp, reached through the Herald client.
+type heraldTOTP struct {
+	client *herald.Client
+}
+
+func (h heraldTOTP) Enabled(ctx context.Context, userID string) (bool, error) {
+	resp, err := h.client.TOTPStatus(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return resp != nil && resp.TotpEnabled, nil
+}
+
+func (h heraldTOTP) EnrollStart(ctx context.Context, userID, label string) (string, string, error) {
+	resp, err := h.client.TOTPEnrollStart(ctx, &herald.TOTPEnrollStartRequest{Subject: userID, Label: label})
+	if err != nil {
+		return "", "", err
+	}
+	return resp.EnrollID, resp.OtpauthURI, nil
+}
+
+func (h heraldTOTP) EnrollConfirm(ctx context.Context, _, enrollID, code string) ([]string, error) {
+	resp, err := h.client.TOTPEnrollConfirm(ctx, &herald.TOTPEnrollConfirmRequest{EnrollID: enrollID, Code: code})
+	if err != nil {
+		return nil, err
+	}
+	return resp.BackupCodes, nil
+}
+
+func (h heraldTOTP) Verify(ctx context.Context, userID, code, challengeID string) (bool, error) {
+	resp, err := h.client.TOTPVerify(ctx, &herald.TOTPVerifyRequest{Subject: userID, Code: code, ChallengeID: challengeID})
+	if err != nil {
+		return false, err
+	}
+	return resp != nil && resp.OK, nil
+}
+
+// RedeemBackupCode passes the code to herald-totp's verify endpoint, which accepts the backup
+// codes it issued and burns them.
+func (h heraldTOTP) RedeemBackupCode(ctx context.Context, userID, code string) (bool, error) {
+	return h.Verify(ctx, userID, code, "")
+}
+
+func (h heraldTOTP) Revoke(ctx context.Context, userID string) error {
+	_, err := h.client.TOTPRevoke(ctx, userID)
+	return err
+}
+
+// localTOTP is the encrypted store of TOTP_ENABLED.
+type localTOTP struct {
+	store *totpstore.Store
+}
+
+func (l localTOTP) Enabled(_ context.Context, userID string) (bool, error) {
+	return l.store.Enabled(userID)
+}
+
+func (l localTOTP) EnrollStart(_ context.Context, userID, label string) (string, string, error) {
+	return l.store.EnrollStart(userID, label)
+}
+
+func (l localTOTP) EnrollConfirm(_ context.Context, userID, enrollID, code string) ([]string, error) {
+	return l.store.EnrollConfirm(userID, enrollID, code)
+}
+
+func (l localTOTP) Verify(_ context.Context, userID, code, _ string) (bool, error) {
+	return l.store.Verify(userID, code)
+}
+
+func (l localTOTP) RedeemBackupCode(_ context.Context, userID, code string) (bool, error) {
+	return l.store.RedeemBackupCode(userID, code)
+}
+
+func (l localTOTP) Revoke(_ context.Context, userID string) error {
+	return l.store.Revoke(userID)
+}
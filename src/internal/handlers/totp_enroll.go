@@ -7,14 +7,13 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
 
-	"github.com/soulteary/herald/pkg/herald"
 	"github.com/soulteary/stargate/src/internal/auth"
 	"github.com/soulteary/stargate/src/internal/config"
 	"github.com/soulteary/stargate/src/internal/i18n"
 )
 
 // TOTPEnrollRoute handles GET /totp/enroll - shows TOTP bind page (requires auth).
-// Calls herald-totp enroll/start and renders page with QR (otpauth_uri) and enroll_id.
+// Starts an enrollment (herald-totp or the local store) and renders page with QR (otpauth_uri) and enroll_id.
 func TOTPEnrollRoute(store *session.Store) func(c *fiber.Ctx) error {
 	return func(ctx *fiber.Ctx) error {
 		sess, err := store.Get(ctx)
@@ -36,39 +35,39 @@ func TOTPEnrollRoute(store *session.Store) func(c *fiber.Ctx) error {
 			label = userID
 		}
 
-		client := getHeraldClient()
-		if client == nil {
+		backend := getTOTPBackend()
+		if backend == nil {
 			return SendErrorResponse(ctx, fiber.StatusServiceUnavailable, i18n.T(ctx, "error.herald_unavailable"))
 		}
 		// If already bound TOTP, redirect to revoke page
-		statusResp, err := client.TOTPStatus(context.Background(), userID)
+		enabled, err := backend.Enabled(context.Background(), userID)
 		if err != nil {
 			log.Warn().Err(err).Str("user_id", userID).Msg("TOTP status check failed")
 			return SendErrorResponse(ctx, fiber.StatusBadGateway, "TOTP status check failed")
 		}
-		if statusResp.TotpEnabled {
+		if enabled {
 			return ctx.Redirect("/totp/revoke", fiber.StatusFound)
 		}
-		startResp, err := client.TOTPEnrollStart(ctx.Context(), &herald.TOTPEnrollStartRequest{
-			Subject: userID,
-			Label:   label,
-		})
+		enrollID, otpauthURI, err := backend.EnrollStart(ctx.Context(), userID, label)
 		if err != nil {
-			log.Warn().Err(err).Str("user_id", userID).Msg("TOTP enroll start failed (check Herald and herald-totp)")
+			log.Warn().Err(err).Str("user_id", userID).Msg("TOTP enroll start failed (check Herald and herald-totp, or the TOTP storage)")
 			return SendErrorResponse(ctx, fiber.StatusBadGateway, "TOTP enroll start failed")
 		}
 		return ctx.Render("totp_enroll", fiber.Map{
-			"Title":             config.LoginPageTitle.Value,
-			"FooterText":        config.LoginPageFooterText.Value,
-			"EnrollID":          startResp.EnrollID,
-			"OtpauthURI":        template.URL(startResp.OtpauthURI), // avoid html/template sanitizing otpauth:// to #ZgotmplZ
-			"HeraldTOTPEnabled": config.HeraldTOTPEnabled.ToBool(),
+			"Title":           config.LoginPageTitle.Value,
+			"FooterText":      config.LoginPageFooterText.Value,
+			"EnrollID":        enrollID,
+			"OtpauthURI":      template.URL(otpauthURI), // avoid html/template sanitizing otpauth:// to #ZgotmplZ
+			"UserTOTPEnabled": userTOTPEnabled(),
 		})
 	}
 }
 
 // TOTPEnrollConfirmAPI handles POST /totp/enroll/confirm - confirms TOTP with code (requires auth).
+// On success the session gets a new ID; redirect leads through the domains the session was
+// exchanged to, which receive the new ID, back to the auth host.
 func TOTPEnrollConfirmAPI(store *session.Store) func(c *fiber.Ctx) error {
+	reissue := newSessionReissue(store.Storage)
 	return func(ctx *fiber.Ctx) error {
 		sess, err := store.Get(ctx)
 		if err != nil {
@@ -82,23 +81,37 @@ func TOTPEnrollConfirmAPI(store *session.Store) func(c *fiber.Ctx) error {
 		if enrollID == "" || code == "" {
 			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ok": false, "error": "enroll_id and code required"})
 		}
-		client := getHeraldClient()
-		if client == nil {
+		backend := getTOTPBackend()
+		if backend == nil {
 			return ctx.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"ok": false, "error": "TOTP service unavailable"})
 		}
-		confirmResp, err := client.TOTPEnrollConfirm(ctx.Context(), &herald.TOTPEnrollConfirmRequest{
-			EnrollID: enrollID,
-			Code:     code,
-		})
+		userID, _ := sess.Get("user_id").(string)
+		backupCodes, err := backend.EnrollConfirm(ctx.Context(), userID, enrollID, code)
 		if err != nil {
 			log.Warn().Err(err).Str("enroll_id", enrollID).Msg("TOTP enroll confirm failed")
 			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ok": false, "error": "invalid_code"})
 		}
+		// TOTP is enrolled either way, so a session that cannot be rotated does not withhold the
+		// backup codes
+		redirect := "/"
+		oldID := sess.ID()
+		err = rotateSessionID(sess)
+		if err == nil {
+			indexSession(ctx, sess)
+			sessionID := sess.ID()
+			if err = sess.Save(); err == nil {
+				redirect = reissueExchangedSession(ctx, reissue, oldID, sessionID, redirect)
+			}
+		}
+		if err != nil {
+			log.Error().Err(err).Str("user_id", userID).Msg("Failed to rotate session after TOTP enrollment")
+		}
 		return ctx.JSON(fiber.Map{
 			"ok":           true,
-			"subject":      confirmResp.Subject,
-			"totp_enabled": confirmResp.TotpEnabled,
-			"backup_codes": confirmResp.BackupCodes,
+			"subject":      userID,
+			"totp_enabled": true,
+			"backup_codes": backupCodes,
+			"redirect":     redirect,
 		})
 	}
 }
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/template/html"
+	"github.com/pquerna/otp/totp"
+
+	"github.com/soulteary/stargate/src/internal/auth"
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/filestore"
+	"github.com/soulteary/stargate/src/internal/i18n"
+	"github.com/soulteary/stargate/src/internal/totpstore"
+)
+
+const testTOTPEncryptionKey = "BwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwc="
+
+var (
+	enrollIDPattern   = regexp.MustCompile(`name="enroll_id" value="([^"]+)"`)
+	totpSecretPattern = regexp.MustCompile(`secret=([A-Z2-7]+)`)
+)
+
+// localTOTPTestApp serves the TOTP pages, Warden login and step-up with the local TOTP store,
+// plus /test_login?user=... creating a session for a Warden user and /whoami. Used codes are
+// remembered by a replay guard on the session storage.
+func localTOTPTestApp(t *testing.T) *fiber.App {
+	t.Helper()
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("WARDEN_ENABLED", "true")
+	t.Setenv("TOTP_ENABLED", "true")
+	t.Setenv("TOTP_ENCRYPTION_KEY", testTOTPEncryptionKey)
+	t.Setenv("TOTP_FILE", filepath.Join(t.TempDir(), "totp.json"))
+
+	wardenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"user_id": "user-1",
+			"mail":    "alice@example.com",
+			"status":  "active",
+		})
+	}))
+	t.Cleanup(wardenServer.Close)
+	t.Setenv("WARDEN_URL", wardenServer.URL)
+	auth.ResetWardenClientForTesting()
+	ResetHeraldClientForTest()
+	testza.AssertNoError(t, config.Initialize(testLogger()))
+	auth.InitWardenClient(testLogger())
+	InitForwardAuthHandler(testLogger())
+
+	storage, err := filestore.Open(config.TOTPFile.String())
+	testza.AssertNoError(t, err)
+	key, err := totpstore.ParseKey(config.TOTPEncryptionKey.String())
+	testza.AssertNoError(t, err)
+	s, err := totpstore.New(storage, key, "Stargate")
+	testza.AssertNoError(t, err)
+	totpstore.Init(s)
+	t.Cleanup(func() { totpstore.Init(nil) })
+
+	store := setupTestStore()
+	sessionGetter := &SessionStoreAdapter{store: store}
+	codes := newStorageExchangeCodes(store.Storage)
+	totpstore.InitReplayGuard(totpstore.NewReplayGuard(store.Storage))
+	t.Cleanup(func() { totpstore.InitReplayGuard(nil) })
+
+	app := fiber.New(fiber.Config{Views: html.New("../web/templates", ".html")})
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("i18n-bundle", i18n.GetBundle())
+		c.Locals("i18n-language", i18n.LangEN)
+		return c.Next()
+	})
+	app.Get("/totp/enroll", TOTPEnrollRoute(store))
+	app.Post("/totp/enroll/confirm", TOTPEnrollConfirmAPI(store))
+	app.Post("/totp/revoke", TOTPRevokeConfirmAPI(store))
+	app.Post("/_login", func(c *fiber.Ctx) error {
+		return loginAPIHandler(c, sessionGetter, &AuthAuthenticator{}, codes)
+	})
+	app.Post(StepUpPath, func(c *fiber.Ctx) error {
+		return stepUpAPIHandler(c, sessionGetter, nil)
+	})
+	app.Get("/test_login", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("user_id", c.Query("user"))
+		sess.Set("user_mail", "alice@example.com")
+		return (&AuthAuthenticator{}).Authenticate(sess)
+	})
+	app.Get("/whoami", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(fiber.Map{
+			"authenticated": auth.IsAuthenticated(sess),
+			"user_id":       sess.Get("user_id"),
+			"user_amr":      sess.Get(amrSessionKey),
+		})
+	})
+	return app
+}
+
+// totpRequest sends a form request with cookie.
+func totpRequest(t *testing.T, app *fiber.App, method, target string, form url.Values, cookie *http.Cookie) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	resp, err := app.Test(req)
+	testza.AssertNoError(t, err)
+	return resp
+}
+
+// startLocalEnrollment opens /totp/enroll and returns the enrollment ID and secret shown on the page.
+func startLocalEnrollment(t *testing.T, app *fiber.App, cookie *http.Cookie) (string, string) {
+	t.Helper()
+	resp := totpRequest(t, app, http.MethodGet, "/totp/enroll", nil, cookie)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	testza.AssertNoError(t, err)
+	enrollID := enrollIDPattern.FindStringSubmatch(string(body))
+	secret := totpSecretPattern.FindStringSubmatch(string(body))
+	testza.AssertLen(t, enrollID, 2)
+	testza.AssertLen(t, secret, 2)
+	return enrollID[1], secret[1]
+}
+
+// codeAt returns the TOTP code of secret at now plus offset. Every code is accepted once, so
+// tests use the neighbouring steps of the ±1 window for successive logins.
+func codeAt(t *testing.T, secret string, offset time.Duration) string {
+	t.Helper()
+	code, err := totp.GenerateCode(secret, time.Now().Add(offset))
+	testza.AssertNoError(t, err)
+	return code
+}
+
+// enrollLocalTOTP binds TOTP for the session user with the code of the previous step and returns
+// the secret, the backup codes and the session cookie, whose ID enrollment rotated.
+func enrollLocalTOTP(t *testing.T, app *fiber.App, cookie *http.Cookie) (string, []string, *http.Cookie) {
+	t.Helper()
+	enrollID, secret := startLocalEnrollment(t, app, cookie)
+	resp := totpRequest(t, app, http.MethodPost, "/totp/enroll/confirm", url.Values{"enroll_id": {enrollID}, "code": {codeAt(t, secret, -30*time.Second)}}, cookie)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	var body struct {
+		BackupCodes []string `json:"backup_codes"`
+	}
+	testza.AssertNoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	rotated := sessionCookie(resp)
+	testza.AssertNotNil(t, rotated)
+	return secret, body.BackupCodes, rotated
+}
+
+func TestLocalTOTP_EnrollLoginStepUpRevoke(t *testing.T) {
+	app := localTOTPTestApp(t)
+	cookie := phoneSession(t, app, "/test_login?user=user-1")
+
+	enrollID, secret := startLocalEnrollment(t, app, cookie)
+	resp := totpRequest(t, app, http.MethodPost, "/totp/enroll/confirm", url.Values{"enroll_id": {enrollID}, "code": {"000000"}}, cookie)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+	resp = totpRequest(t, app, http.MethodPost, "/totp/enroll/confirm", url.Values{"enroll_id": {enrollID}, "code": {codeAt(t, secret, -30*time.Second)}}, cookie)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	cookie = sessionCookie(resp)
+
+	// Bound users are sent to the revoke page
+	resp = totpRequest(t, app, http.MethodGet, "/totp/enroll", nil, cookie)
+	testza.AssertEqual(t, fiber.StatusFound, resp.StatusCode)
+	testza.AssertEqual(t, "/totp/revoke", resp.Header.Get("Location"))
+
+	// Warden login with the user's own TOTP code
+	login := url.Values{"auth_method": {"warden"}, "mail": {"alice@example.com"}, "use_otp": {"true"}}
+	login.Set("otp_code", "000000")
+	resp = totpRequest(t, app, http.MethodPost, "/_login", login, nil)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	login.Set("otp_code", codeAt(t, secret, 0))
+	resp = totpRequest(t, app, http.MethodPost, "/_login", login, nil)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	resp = totpRequest(t, app, http.MethodPost, StepUpPath, url.Values{"method": {"totp"}, "otp_code": {codeAt(t, secret, 30*time.Second)}}, cookie)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	cookie = sessionCookie(resp)
+
+	resp = totpRequest(t, app, http.MethodPost, "/totp/revoke", nil, cookie)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	login.Set("otp_code", codeAt(t, secret, 0))
+	resp = totpRequest(t, app, http.MethodPost, "/_login", login, nil)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+func TestLocalTOTP_EnrollmentRotatesSessionID(t *testing.T) {
+	app := localTOTPTestApp(t)
+	cookie := phoneSession(t, app, "/test_login?user=user-1")
+
+	enrollID, secret := startLocalEnrollment(t, app, cookie)
+	resp := totpRequest(t, app, http.MethodPost, "/totp/enroll/confirm", url.Values{"enroll_id": {enrollID}, "code": {codeAt(t, secret, 0)}}, cookie)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	var body map[string]interface{}
+	testza.AssertNoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	testza.AssertEqual(t, "/", body["redirect"])
+	rotated := sessionCookie(resp)
+	testza.AssertNotNil(t, rotated)
+	testza.AssertNotEqual(t, cookie.Value, rotated.Value)
+
+	// The pre-enrollment ID no longer authenticates
+	testza.AssertEqual(t, false, whoami(t, app, cookie)["authenticated"])
+	session := whoami(t, app, rotated)
+	testza.AssertEqual(t, true, session["authenticated"])
+	testza.AssertEqual(t, "user-1", session["user_id"])
+}
+
+func TestLocalTOTP_EnrollmentBoundToUser(t *testing.T) {
+	app := localTOTPTestApp(t)
+	alice := phoneSession(t, app, "/test_login?user=user-1")
+	mallory := phoneSession(t, app, "/test_login?user=user-2")
+
+	enrollID, secret := startLocalEnrollment(t, app, alice)
+	resp := totpRequest(t, app, http.MethodPost, "/totp/enroll/confirm", url.Values{"enroll_id": {enrollID}, "code": {codeAt(t, secret, 0)}}, mallory)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	enabled, err := totpstore.Get().Enabled("user-2")
+	testza.AssertNoError(t, err)
+	testza.AssertFalse(t, enabled)
+}
+
+func TestLocalTOTP_RejectsReplayedCode(t *testing.T) {
+	app := localTOTPTestApp(t)
+	cookie := phoneSession(t, app, "/test_login?user=user-1")
+	secret, _, cookie := enrollLocalTOTP(t, app, cookie)
+
+	login := url.Values{"auth_method": {"warden"}, "mail": {"alice@example.com"}, "use_otp": {"true"}, "otp_code": {codeAt(t, secret, 0)}}
+	resp := totpRequest(t, app, http.MethodPost, "/_login", login, nil)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	resp = totpRequest(t, app, http.MethodPost, "/_login", login, nil)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, "a captured code cannot be replayed")
+
+	// Nor can an older code of the window once a newer one was used
+	login.Set("otp_code", codeAt(t, secret, 30*time.Second))
+	resp = totpRequest(t, app, http.MethodPost, "/_login", login, nil)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	resp = totpRequest(t, app, http.MethodPost, StepUpPath, url.Values{"method": {"totp"}, "otp_code": {codeAt(t, secret, 0)}}, cookie)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestLocalTOTP_BackupCodeLogin(t *testing.T) {
+	app := localTOTPTestApp(t)
+	cookie := phoneSession(t, app, "/test_login?user=user-1")
+	_, backupCodes, _ := enrollLocalTOTP(t, app, cookie)
+	testza.AssertLen(t, backupCodes, totpstore.BackupCodeCount)
+
+	login := url.Values{"auth_method": {"warden"}, "mail": {"alice@example.com"}, "use_backup_code": {"true"}}
+	resp := totpRequest(t, app, http.MethodPost, "/_login", login, nil)
+	testza.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+	login.Set("backup_code", "aaaaa-aaaaa")
+	resp = totpRequest(t, app, http.MethodPost, "/_login", login, nil)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+	login.Set("backup_code", backupCodes[0])
+	resp = totpRequest(t, app, http.MethodPost, "/_login", login, nil)
+	testza.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	session := whoami(t, app, sessionCookie(resp))
+	testza.AssertEqual(t, true, session["authenticated"])
+	testza.AssertEqual(t, "user-1", session["user_id"])
+	testza.AssertEqual(t, []interface{}{amrBackupCode}, session["user_amr"])
+
+	resp = totpRequest(t, app, http.MethodPost, "/_login", login, nil)
+	testza.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, "backup codes are single-use")
+}
@@ -11,7 +11,7 @@ import (
 	"github.com/soulteary/stargate/src/internal/i18n"
 )
 
-// revokeErrorReason maps herald-totp revoke error to a frontend-safe reason code.
+// revokeErrorReason maps a herald-totp (or local store) revoke error to a frontend-safe reason code.
 func revokeErrorReason(err error) string {
 	if err == nil {
 		return ""
@@ -41,8 +41,7 @@ func TOTPRevokeRoute(store *session.Store) func(c *fiber.Ctx) error {
 		if !auth.IsAuthenticated(sess) {
 			return ctx.Redirect("/_login", fiber.StatusFound)
 		}
-		client := getHeraldClient()
-		if client == nil {
+		if getTOTPBackend() == nil {
 			return SendErrorResponse(ctx, fiber.StatusServiceUnavailable, i18n.T(ctx, "error.herald_unavailable"))
 		}
 		userID, _ := sess.Get("user_id").(string)
@@ -50,9 +49,9 @@ func TOTPRevokeRoute(store *session.Store) func(c *fiber.Ctx) error {
 			return SendErrorResponse(ctx, fiber.StatusBadRequest, "user_id not in session")
 		}
 		return ctx.Render("totp_revoke", fiber.Map{
-			"Title":             config.LoginPageTitle.Value,
-			"FooterText":        config.LoginPageFooterText.Value,
-			"HeraldTOTPEnabled": config.HeraldTOTPEnabled.ToBool(),
+			"Title":           config.LoginPageTitle.Value,
+			"FooterText":      config.LoginPageFooterText.Value,
+			"UserTOTPEnabled": userTOTPEnabled(),
 		})
 	}
 }
@@ -67,16 +66,15 @@ func TOTPRevokeConfirmAPI(store *session.Store) func(c *fiber.Ctx) error {
 		if !auth.IsAuthenticated(sess) {
 			return ctx.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"ok": false, "error": "unauthorized"})
 		}
-		client := getHeraldClient()
-		if client == nil {
+		backend := getTOTPBackend()
+		if backend == nil {
 			return ctx.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"ok": false, "error": "TOTP service unavailable"})
 		}
 		userID, _ := sess.Get("user_id").(string)
 		if userID == "" {
 			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"ok": false, "error": "user_id not in session"})
 		}
-		_, err = client.TOTPRevoke(ctx.Context(), userID)
-		if err != nil {
+		if err := backend.Revoke(ctx.Context(), userID); err != nil {
 			log.Warn().Err(err).Str("user_id", userID).Msg("TOTP revoke failed")
 			reason := revokeErrorReason(err)
 			return ctx.Status(fiber.StatusBadGateway).JSON(fiber.Map{"ok": false, "error": "revoke_failed", "reason": reason})
@@ -8,27 +8,39 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/soulteary/stargate/src/internal/auditlog"
 	"github.com/soulteary/stargate/src/internal/config"
 )
 
 // CallbackCookieName stores the cookie name for origin domain
 const CallbackCookieName = "stargate_callback"
 
+// ReturnToParam is the query parameter carrying the path to restore after authentication.
+const ReturnToParam = "return_to"
+
 // GetForwardedHost returns the forwarded hostname from the request.
-// It prioritizes the X-Forwarded-Host header if present, otherwise falls back to the request's Hostname.
+// It prioritizes the X-Forwarded-Host header if present, then the host of an RFC 7239 Forwarded
+// header, otherwise falls back to the request's Hostname.
 //
 // This is useful when the application is behind a reverse proxy (like Traefik)
-// that forwards the original hostname via headers.
+// that forwards the original hostname via headers. Forwarded headers from peers outside
+// TRUSTED_PROXIES are removed by TrustedProxyMiddleware before they get here.
 func GetForwardedHost(ctx *fiber.Ctx) string {
 	forwardedHost := ctx.Get("X-Forwarded-Host")
 	if forwardedHost != "" {
 		return forwardedHost
 	}
+	if forwardedHost = forwardedParam(ctx, "host"); forwardedHost != "" {
+		return forwardedHost
+	}
 	return ctx.Hostname()
 }
 
@@ -43,7 +55,8 @@ func GetForwardedURI(ctx *fiber.Ctx) string {
 }
 
 // GetForwardedProto returns the forwarded protocol from the request.
-// It prioritizes the X-Forwarded-Proto header if present, otherwise falls back to the request's Protocol.
+// It prioritizes the X-Forwarded-Proto header if present, then the proto of an RFC 7239 Forwarded
+// header, otherwise falls back to the request's Protocol.
 //
 // This is useful for determining whether the original request was HTTP or HTTPS
 // when behind a reverse proxy.
@@ -52,6 +65,9 @@ func GetForwardedProto(ctx *fiber.Ctx) string {
 	if forwardedProto != "" {
 		return forwardedProto
 	}
+	if forwardedProto = forwardedParam(ctx, "proto"); forwardedProto != "" {
+		return strings.ToLower(forwardedProto)
+	}
 	return ctx.Protocol()
 }
 
@@ -77,22 +93,24 @@ func normalizeHost(host string) string {
 	return host
 }
 
-// SetCallbackCookie stores the origin host in a cookie if it's different from the auth host.
+// SetCallbackCookie stores the callback in a cookie if its host is different from the auth host.
+// The callback is either the origin host or the full original URL (see BuildCallbackURL).
 // This allows the callback to persist even if the user refreshes the login page.
-func SetCallbackCookie(ctx *fiber.Ctx, callbackHost string) {
-	if callbackHost == "" {
+func SetCallbackCookie(ctx *fiber.Ctx, callback string) {
+	target, ok := parseCallback(callback)
+	if !ok {
 		return
 	}
 
 	// Normalize domain
-	callbackHost = normalizeHost(callbackHost)
+	callbackHost := normalizeHost(target.host)
 	authHost := normalizeHost(config.AuthHost.String())
 
 	// Only set cookie if domains are different
 	if callbackHost != authHost {
 		cookie := &fiber.Cookie{
 			Name:     CallbackCookieName,
-			Value:    callbackHost,
+			Value:    url.QueryEscape(callback),        // URLs may contain characters not allowed in cookie values
 			Expires:  time.Now().Add(10 * time.Minute), // 10 minutes expiration, enough to complete login flow
 			SameSite: fiber.CookieSameSiteLaxMode,
 			HTTPOnly: true,
@@ -108,9 +126,13 @@ func SetCallbackCookie(ctx *fiber.Ctx, callbackHost string) {
 	}
 }
 
-// GetCallbackFromCookie retrieves the callback host from cookie.
+// GetCallbackFromCookie retrieves the callback (origin host or original URL) from cookie.
 func GetCallbackFromCookie(ctx *fiber.Ctx) string {
-	return ctx.Cookies(CallbackCookieName)
+	value := ctx.Cookies(CallbackCookieName)
+	if unescaped, err := url.QueryUnescape(value); err == nil {
+		return unescaped
+	}
+	return value
 }
 
 // ClearCallbackCookie removes the callback cookie.
@@ -134,18 +156,138 @@ func ClearCallbackCookie(ctx *fiber.Ctx) {
 // BuildCallbackURL constructs a callback URL for authentication redirects.
 // It uses X-Forwarded-* headers to build the correct URL with protocol and host.
 //
-// The URL format is: {protocol}://{authHost}/_login?callback={originalHost}
+// The URL format is: {protocol}://{authHost}/_login?callback={originalURL}
+// When X-Forwarded-Uri is missing or "/", only the original host is carried as the callback.
 func BuildCallbackURL(ctx *fiber.Ctx) string {
-	callbackHost := GetForwardedHost(ctx)
+	callback := GetForwardedHost(ctx)
 	proto := GetForwardedProto(ctx)
 	authHost := config.AuthHost.String()
 
-	// If origin domain is different from auth service domain, store origin domain in cookie
+	if uri := ctx.Get("X-Forwarded-Uri"); uri != "" && uri != "/" {
+		callback = getOriginalURL(ctx)
+	}
+
+	// If origin domain is different from auth service domain, store callback in cookie
 	if IsDifferentDomain(ctx) {
-		SetCallbackCookie(ctx, callbackHost)
+		SetCallbackCookie(ctx, callback)
 	}
 
-	return fmt.Sprintf("%s://%s/_login?callback=%s", proto, authHost, callbackHost)
+	return fmt.Sprintf("%s://%s/_login?callback=%s", proto, authHost, url.QueryEscape(callback))
+}
+
+// getOriginalURL rebuilds the URL the user originally requested from X-Forwarded-* headers.
+func getOriginalURL(ctx *fiber.Ctx) string {
+	uri := GetForwardedURI(ctx)
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+	return fmt.Sprintf("%s://%s%s", GetForwardedProto(ctx), GetForwardedHost(ctx), uri)
+}
+
+// callbackTarget is a parsed callback value.
+type callbackTarget struct {
+	proto string // empty for host-only callbacks
+	host  string
+	path  string // path and query to restore on host, empty for host-only callbacks
+}
+
+// parseCallback parses a callback value, which is either a bare host (as sent by older
+// forward auth redirects) or an absolute http(s) URL. It returns false for malformed values.
+func parseCallback(raw string) (callbackTarget, bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return callbackTarget{}, false
+	}
+	if !strings.Contains(raw, "://") {
+		if strings.ContainsAny(raw, "/\\?#@ ") {
+			return callbackTarget{}, false
+		}
+		return callbackTarget{host: raw}, true
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil || u.Host == "" {
+		return callbackTarget{}, false
+	}
+	return callbackTarget{proto: u.Scheme, host: u.Host, path: u.RequestURI()}, true
+}
+
+// buildSessionExchangeURL builds the session exchange URL on the callback host.
+// The original path is passed along so that SessionShareRoute can restore it.
+//
+// The URL format is: {protocol}://{callbackHost}/_session_exchange?code={exchangeCode}&return_to={path}
+func buildSessionExchangeURL(ctx *fiber.Ctx, target callbackTarget, code string) string {
+	proto := target.proto
+	if proto == "" {
+		proto = GetForwardedProto(ctx)
+	}
+	if proto == "" {
+		proto = ctx.Protocol()
+	}
+	query := url.Values{}
+	query.Set(ExchangeCodeParam, code)
+	if target.path != "" && target.path != "/" {
+		query.Set(ReturnToParam, target.path)
+	}
+	return fmt.Sprintf("%s://%s%s?%s", proto, target.host, SessionExchangePath, query.Encode())
+}
+
+// isAllowedRedirectHost reports whether host may be used as a post-authentication redirect target.
+// See config.CallbackAllowlist for the matching rules.
+func isAllowedRedirectHost(host string) bool {
+	return config.GetCallbackAllowlist().Allows(host)
+}
+
+// errCallbackNotAllowed is returned when a callback is malformed or its host is not allowed.
+var errCallbackNotAllowed = errors.New("callback host not allowed")
+
+// resolveCallback parses callback and checks its host against CALLBACK_ALLOWED_DOMAINS,
+// so that a session ID is never sent to an arbitrary host. Rejections are audited.
+// An empty callback yields an empty target and no error.
+func resolveCallback(ctx *fiber.Ctx, callback string) (callbackTarget, error) {
+	if callback == "" {
+		return callbackTarget{}, nil
+	}
+	target, ok := parseCallback(callback)
+	if !ok || !isAllowedRedirectHost(target.host) {
+		auditlog.LogCallbackRejected(ctx.Context(), callback, GetClientIP(ctx))
+		return callbackTarget{}, errCallbackNotAllowed
+	}
+	return target, nil
+}
+
+// isLocalPath reports whether raw is a path on the current host.
+// Protocol-relative and backslash forms are rejected because browsers treat them as another host,
+// and so is any control character or whitespace, which browsers strip ("/\t/evil.com" becomes
+// "//evil.com").
+func isLocalPath(raw string) bool {
+	if !strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//") || strings.HasPrefix(raw, "/\\") {
+		return false
+	}
+	if strings.ContainsFunc(raw, func(r rune) bool { return r <= ' ' || r == 0x7f || unicode.IsSpace(r) }) {
+		return false
+	}
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
+
+// SanitizeReturnURL validates a post-authentication redirect target to prevent open redirects.
+// It returns raw unchanged when it is a local path (e.g. "/admin?tab=1") or an absolute
+// http(s) URL on an allowed host; otherwise it returns fallback.
+func SanitizeReturnURL(raw, fallback string) string {
+	if raw == "" {
+		return fallback
+	}
+	if isLocalPath(raw) {
+		return raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return fallback
+	}
+	if !isAllowedRedirectHost(u.Host) {
+		return fallback
+	}
+	return raw
 }
 
 // IsHTMLRequest checks if the request accepts HTML responses.
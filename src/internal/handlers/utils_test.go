@@ -159,6 +159,76 @@ func TestBuildCallbackURL_WithoutHeaders(t *testing.T) {
 	testza.AssertEqual(t, expected, result)
 }
 
+func TestBuildCallbackURL_WithForwardedURI(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	err := config.Initialize(testLoggerUtils())
+	testza.AssertNoError(t, err)
+
+	ctx, app := createTestContextForUtils("GET", "/_auth", map[string]string{
+		"X-Forwarded-Host":  "app.example.com",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Uri":   "/reports/42?tab=x",
+	})
+	defer app.ReleaseCtx(ctx)
+
+	result := BuildCallbackURL(ctx)
+	expected := "https://auth.example.com/_login?callback=https%3A%2F%2Fapp.example.com%2Freports%2F42%3Ftab%3Dx"
+	testza.AssertEqual(t, expected, result)
+
+	// The full URL is also kept in the callback cookie
+	testza.AssertContains(t, string(ctx.Response().Header.Peek("Set-Cookie")), "https%3A%2F%2Fapp.example.com%2Freports%2F42%3Ftab%3Dx")
+}
+
+func TestParseCallback(t *testing.T) {
+	tests := []struct {
+		raw      string
+		ok       bool
+		expected callbackTarget
+	}{
+		{"", false, callbackTarget{}},
+		{"app.example.com", true, callbackTarget{host: "app.example.com"}},
+		{"app.example.com:8443", true, callbackTarget{host: "app.example.com:8443"}},
+		{"https://app.example.com/reports/42?tab=x", true, callbackTarget{proto: "https", host: "app.example.com", path: "/reports/42?tab=x"}},
+		{"http://app.example.com", true, callbackTarget{proto: "http", host: "app.example.com", path: "/"}},
+		{"app.example.com/path", false, callbackTarget{}},
+		{"evil.com?x=app.example.com", false, callbackTarget{}},
+		{"javascript://app.example.com/", false, callbackTarget{}},
+		{"https://user@app.example.com/", false, callbackTarget{}},
+		{"https:///path", false, callbackTarget{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			target, ok := parseCallback(tt.raw)
+			testza.AssertEqual(t, tt.ok, ok)
+			testza.AssertEqual(t, tt.expected, target)
+		})
+	}
+}
+
+func TestBuildSessionExchangeURL(t *testing.T) {
+	ctx, app := createTestContextForUtils("POST", "/_login", map[string]string{
+		"X-Forwarded-Proto": "https",
+	})
+	defer app.ReleaseCtx(ctx)
+
+	testza.AssertEqual(t, "https://app.example.com/_session_exchange?code=abc",
+		buildSessionExchangeURL(ctx, callbackTarget{host: "app.example.com"}, "abc"))
+	testza.AssertEqual(t, "http://app.example.com/_session_exchange?code=abc&return_to=%2Freports%2F42%3Ftab%3Dx",
+		buildSessionExchangeURL(ctx, callbackTarget{proto: "http", host: "app.example.com", path: "/reports/42?tab=x"}, "abc"))
+	testza.AssertEqual(t, "https://app.example.com/_session_exchange?code=abc",
+		buildSessionExchangeURL(ctx, callbackTarget{proto: "https", host: "app.example.com", path: "/"}, "abc"))
+}
+
+func TestGetCallbackFromCookie_Unescapes(t *testing.T) {
+	ctx, app := createTestContextForUtils("GET", "/_login", map[string]string{
+		"Cookie": CallbackCookieName + "=https%3A%2F%2Fapp.example.com%2Freports%3Ftab%3Dx",
+	})
+	defer app.ReleaseCtx(ctx)
+
+	testza.AssertEqual(t, "https://app.example.com/reports?tab=x", GetCallbackFromCookie(ctx))
+}
+
 func TestIsHTMLRequest_EmptyAccept(t *testing.T) {
 	ctx, app := createTestContextForUtils("GET", "/test", nil)
 	defer app.ReleaseCtx(ctx)
@@ -467,3 +537,67 @@ func TestIsDifferentDomain_SameDomain(t *testing.T) {
 	result := IsDifferentDomain(ctx)
 	testza.AssertFalse(t, result, "should detect same domain")
 }
+
+func TestIsLocalPath(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected bool
+	}{
+		{"/", true},
+		{"/reports/42?tab=x#top", true},
+		{"/search?q=a%20b", true},
+		{"", false},
+		{"reports", false},
+		{"//evil.com", false},
+		{"/\\evil.com", false},
+		{"/\t/evil.com", false},
+		{"/\n/evil.com", false},
+		{"/\r/evil.com", false},
+		{"/\t\t/evil.com", false},
+		{"/\v/evil.com", false},
+		{"/reports\x7f", false},
+		{"/ /evil.com", false},
+		{"/\u00a0/evil.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			testza.AssertEqual(t, tt.expected, isLocalPath(tt.raw))
+		})
+	}
+}
+
+func TestSanitizeReturnURL(t *testing.T) {
+	t.Setenv("AUTH_HOST", "auth.example.com")
+	t.Setenv("PASSWORDS", "plaintext:test123")
+	t.Setenv("COOKIE_DOMAIN", ".example.com")
+	err := config.Initialize(testLoggerUtils())
+	testza.AssertNoError(t, err)
+
+	tests := []struct {
+		raw      string
+		expected string
+	}{
+		{"", "/"},
+		{"/admin?tab=1", "/admin?tab=1"},
+		{"//evil.com/path", "/"},
+		{"/\\evil.com", "/"},
+		{"/\t/evil.com", "/"},
+		{"/\n/evil.com", "/"},
+		{"/\r/evil.com", "/"},
+		{"/\r\n/evil.com", "/"},
+		{"/ /evil.com", "/"},
+		{"/admin\x00", "/"},
+		{"https://auth.example.com/_login", "https://auth.example.com/_login"},
+		{"https://app.example.com/reports/42?tab=x", "https://app.example.com/reports/42?tab=x"},
+		{"http://example.com:8080/", "http://example.com:8080/"},
+		{"https://evil.com/", "/"},
+		{"https://notexample.com/", "/"},
+		{"https://user@app.example.com/", "/"},
+		{"javascript:alert(1)", "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			testza.AssertEqual(t, tt.expected, SanitizeReturnURL(tt.raw, "/"))
+		})
+	}
+}
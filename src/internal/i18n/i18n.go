@@ -77,6 +77,48 @@ func init() {
 		"success.login":                                  "Login successful",
 		"success.verify_code_sent":                       "Verification code sent",
 		"info.click_if_no_redirect":                      "Click here if the page does not redirect automatically",
+		"error.step_up_unavailable":                      "No step-up method is available for this account. Please contact your administrator.",
+		"success.step_up":                                "Verification successful",
+		"error.callback_not_allowed":                     "The callback domain is not allowed",
+		"error.missing_exchange_code":                    "Missing exchange code",
+		"error.invalid_exchange_code":                    "Invalid or expired exchange code, please sign in again",
+		"error.access_denied":                            "You do not have permission to access this resource.",
+		"info.access_denied_title":                       "Access denied",
+		"info.switch_account":                            "Sign in with a different account",
+		"error.oidc_not_configured":                      "Single sign-on is not configured",
+		"error.oidc_failed":                              "Sign-in with the identity provider failed, please try again",
+		"error.oidc_state_invalid":                       "The sign-in request is invalid or has expired, please start again",
+		"error.idp_not_configured":                       "OpenID Connect provider is not enabled",
+		"error.idp_invalid_client":                       "Unknown client or unregistered redirect URI",
+		"error.auth_jwt_failed":                          "Failed to sign identity token",
+		"error.signing_keys_not_configured":              "Signing keys are not configured",
+		"error.api_tokens_disabled":                      "Personal access tokens are not enabled",
+		"error.api_token_invalid":                        "Invalid or expired API token",
+		"error.api_token_store_failed":                   "Failed to access API token storage",
+		"error.api_token_no_user":                        "API tokens require an account with a user ID",
+		"error.bearer_jwt_invalid":                       "Invalid or expired token",
+		"error.bearer_jwt_keys_unavailable":              "Token verification keys are unavailable",
+		"error.basic_auth_invalid":                       "Invalid username or password",
+		"error.passkeys_disabled":                        "Passkeys are not enabled",
+		"error.passkey_invalid":                          "Passkey verification failed",
+		"error.passkey_expired":                          "The passkey request is invalid or has expired, please try again",
+		"error.passkey_store_failed":                     "Failed to access passkey storage",
+		"error.passkey_no_user":                          "Passkeys require an account with a user ID",
+		"error.magic_link_disabled":                      "Sign-in links are not enabled.",
+		"error.magic_link_invalid":                       "This sign-in link is invalid, expired or already used. Please request a new one.",
+		"error.magic_link_other_browser":                 "Open the sign-in link in the same browser you requested it from.",
+		"success.magic_link_sent":                        "Sign-in link sent. Open it in this browser to continue.",
+		"error.qr_login_disabled":                        "QR code login is not enabled.",
+		"error.qr_login_expired":                         "This QR code has expired or was already used. Show a new one on the other device.",
+		"error.qr_login_no_user":                         "QR logins can only be approved from an account with a user ID.",
+		"error.backup_code_required":                     "Please enter a backup code.",
+		"error.backup_code_invalid":                      "Invalid or already used backup code.",
+		"error.backup_code_unavailable":                  "Backup codes are not available. Please sign in another way.",
+		"error.sessions_disabled":                        "Session management is not enabled",
+		"error.session_index_failed":                     "Failed to access the session list",
+		"error.sessions_no_user":                         "Session management requires an account with a user ID",
+		"error.session_expired":                          "Your session has expired. Please sign in again.",
+		"error.invalid_logout_token":                     "Invalid or expired sign-out link",
 	})
 
 	// Add Chinese translations
@@ -129,6 +171,48 @@ func init() {
 		"success.login":                                  "登录成功",
 		"success.verify_code_sent":                       "验证码已发送",
 		"info.click_if_no_redirect":                      "点击这里如果页面没有自动跳转",
+		"error.step_up_unavailable":                      "当前账号没有可用的二次验证方式，请联系管理员。",
+		"success.step_up":                                "验证成功",
+		"error.callback_not_allowed":                     "回调域名不在允许列表中",
+		"error.missing_exchange_code":                    "缺少交换码",
+		"error.invalid_exchange_code":                    "交换码无效或已过期，请重新登录",
+		"error.access_denied":                            "您没有访问此资源的权限。",
+		"info.access_denied_title":                       "拒绝访问",
+		"info.switch_account":                            "使用其他账号登录",
+		"error.oidc_not_configured":                      "未配置单点登录",
+		"error.oidc_failed":                              "身份提供方登录失败，请重试",
+		"error.oidc_state_invalid":                       "登录请求无效或已过期，请重新开始",
+		"error.idp_not_configured":                       "未启用 OpenID Connect 提供方",
+		"error.idp_invalid_client":                       "未知的客户端或未注册的重定向 URI",
+		"error.auth_jwt_failed":                          "签发身份令牌失败",
+		"error.signing_keys_not_configured":              "未配置签名密钥",
+		"error.api_tokens_disabled":                      "未启用个人访问令牌",
+		"error.api_token_invalid":                        "API 令牌无效或已过期",
+		"error.api_token_store_failed":                   "访问 API 令牌存储失败",
+		"error.api_token_no_user":                        "API 令牌需要带有用户 ID 的账户",
+		"error.bearer_jwt_invalid":                       "令牌无效或已过期",
+		"error.bearer_jwt_keys_unavailable":              "令牌验证密钥不可用",
+		"error.basic_auth_invalid":                       "用户名或密码错误",
+		"error.passkeys_disabled":                        "未启用通行密钥",
+		"error.passkey_invalid":                          "通行密钥验证失败",
+		"error.passkey_expired":                          "通行密钥请求无效或已过期，请重试",
+		"error.passkey_store_failed":                     "访问通行密钥存储失败",
+		"error.passkey_no_user":                          "通行密钥需要带有用户 ID 的账户",
+		"error.magic_link_disabled":                      "未启用登录链接。",
+		"error.magic_link_invalid":                       "登录链接无效、已过期或已被使用，请重新获取。",
+		"error.magic_link_other_browser":                 "请在申请登录链接的同一浏览器中打开该链接。",
+		"success.magic_link_sent":                        "登录链接已发送，请在此浏览器中打开以继续。",
+		"error.qr_login_disabled":                        "未启用扫码登录。",
+		"error.qr_login_expired":                         "二维码已过期或已被使用，请在另一台设备上重新生成。",
+		"error.qr_login_no_user":                         "只有带用户 ID 的账户才能批准扫码登录。",
+		"error.backup_code_required":                     "请输入备用码",
+		"error.backup_code_invalid":                      "备用码错误或已被使用",
+		"error.backup_code_unavailable":                  "未启用备用码，请使用其他方式登录",
+		"error.sessions_disabled":                        "未启用会话管理",
+		"error.session_index_failed":                     "访问会话列表失败",
+		"error.sessions_no_user":                         "会话管理需要带有用户 ID 的账户",
+		"error.session_expired":                          "您的会话已过期，请重新登录。",
+		"error.invalid_logout_token":                     "登出链接无效或已过期",
 	})
 
 	// Add French translations
@@ -180,6 +264,48 @@ func init() {
 		"success.login":                                  "Connexion réussie",
 		"success.verify_code_sent":                       "Code de vérification envoyé",
 		"info.click_if_no_redirect":                      "Cliquez ici si la page ne redirige pas automatiquement",
+		"error.step_up_unavailable":                      "Aucune méthode d'authentification supplémentaire n'est disponible pour ce compte. Veuillez contacter votre administrateur.",
+		"success.step_up":                                "Vérification réussie",
+		"error.callback_not_allowed":                     "Le domaine de rappel n'est pas autorisé",
+		"error.missing_exchange_code":                    "Code d'échange manquant",
+		"error.invalid_exchange_code":                    "Code d'échange invalide ou expiré, veuillez vous reconnecter",
+		"error.access_denied":                            "Vous n'avez pas l'autorisation d'accéder à cette ressource.",
+		"info.access_denied_title":                       "Accès refusé",
+		"info.switch_account":                            "Se connecter avec un autre compte",
+		"error.oidc_not_configured":                      "L'authentification unique n'est pas configurée",
+		"error.oidc_failed":                              "La connexion auprès du fournisseur d'identité a échoué, veuillez réessayer",
+		"error.oidc_state_invalid":                       "La demande de connexion est invalide ou a expiré, veuillez recommencer",
+		"error.idp_not_configured":                       "Le fournisseur OpenID Connect n'est pas activé",
+		"error.idp_invalid_client":                       "Client inconnu ou URI de redirection non enregistrée",
+		"error.auth_jwt_failed":                          "Échec de la signature du jeton d'identité",
+		"error.signing_keys_not_configured":              "Les clés de signature ne sont pas configurées",
+		"error.api_tokens_disabled":                      "Les jetons d'accès personnels ne sont pas activés",
+		"error.api_token_invalid":                        "Jeton d'API invalide ou expiré",
+		"error.api_token_store_failed":                   "Échec de l'accès au stockage des jetons d'API",
+		"error.api_token_no_user":                        "Les jetons d'API nécessitent un compte avec un identifiant utilisateur",
+		"error.bearer_jwt_invalid":                       "Jeton invalide ou expiré",
+		"error.bearer_jwt_keys_unavailable":              "Les clés de vérification des jetons sont indisponibles",
+		"error.basic_auth_invalid":                       "Nom d'utilisateur ou mot de passe invalide",
+		"error.passkeys_disabled":                        "Les clés d'accès ne sont pas activées",
+		"error.passkey_invalid":                          "La vérification de la clé d'accès a échoué",
+		"error.passkey_expired":                          "La demande de clé d'accès est invalide ou a expiré, veuillez réessayer",
+		"error.passkey_store_failed":                     "Échec de l'accès au stockage des clés d'accès",
+		"error.passkey_no_user":                          "Les clés d'accès nécessitent un compte avec un identifiant utilisateur",
+		"error.magic_link_disabled":                      "Les liens de connexion ne sont pas activés.",
+		"error.magic_link_invalid":                       "Ce lien de connexion est invalide, expiré ou déjà utilisé. Veuillez en demander un nouveau.",
+		"error.magic_link_other_browser":                 "Ouvrez le lien de connexion dans le navigateur depuis lequel vous l'avez demandé.",
+		"success.magic_link_sent":                        "Lien de connexion envoyé. Ouvrez-le dans ce navigateur pour continuer.",
+		"error.qr_login_disabled":                        "La connexion par code QR n'est pas activée.",
+		"error.qr_login_expired":                         "Ce code QR a expiré ou a déjà été utilisé. Affichez-en un nouveau sur l'autre appareil.",
+		"error.qr_login_no_user":                         "Les connexions par code QR ne peuvent être approuvées que depuis un compte disposant d'un identifiant utilisateur.",
+		"error.backup_code_required":                     "Veuillez saisir un code de secours.",
+		"error.backup_code_invalid":                      "Code de secours invalide ou déjà utilisé.",
+		"error.backup_code_unavailable":                  "Les codes de secours ne sont pas disponibles. Veuillez vous connecter autrement.",
+		"error.sessions_disabled":                        "La gestion des sessions n'est pas activée",
+		"error.session_index_failed":                     "Échec de l'accès à la liste des sessions",
+		"error.sessions_no_user":                         "La gestion des sessions nécessite un compte avec un identifiant utilisateur",
+		"error.session_expired":                          "Votre session a expiré. Veuillez vous reconnecter.",
+		"error.invalid_logout_token":                     "Lien de déconnexion invalide ou expiré",
 	})
 
 	// Add Italian translations
@@ -231,6 +357,48 @@ func init() {
 		"success.login":                                  "Accesso riuscito",
 		"success.verify_code_sent":                       "Codice di verifica inviato",
 		"info.click_if_no_redirect":                      "Clicca qui se la pagina non reindirizza automaticamente",
+		"error.step_up_unavailable":                      "Nessun metodo di autenticazione aggiuntiva disponibile per questo account. Contatta l'amministratore.",
+		"success.step_up":                                "Verifica riuscita",
+		"error.callback_not_allowed":                     "Il dominio di callback non è consentito",
+		"error.missing_exchange_code":                    "Codice di scambio mancante",
+		"error.invalid_exchange_code":                    "Codice di scambio non valido o scaduto, effettua di nuovo l'accesso",
+		"error.access_denied":                            "Non hai l'autorizzazione per accedere a questa risorsa.",
+		"info.access_denied_title":                       "Accesso negato",
+		"info.switch_account":                            "Accedi con un altro account",
+		"error.oidc_not_configured":                      "Il single sign-on non è configurato",
+		"error.oidc_failed":                              "Accesso tramite il provider di identità non riuscito, riprova",
+		"error.oidc_state_invalid":                       "La richiesta di accesso non è valida o è scaduta, ricomincia",
+		"error.idp_not_configured":                       "Il provider OpenID Connect non è abilitato",
+		"error.idp_invalid_client":                       "Client sconosciuto o URI di reindirizzamento non registrato",
+		"error.auth_jwt_failed":                          "Impossibile firmare il token di identità",
+		"error.signing_keys_not_configured":              "Le chiavi di firma non sono configurate",
+		"error.api_tokens_disabled":                      "I token di accesso personali non sono abilitati",
+		"error.api_token_invalid":                        "Token API non valido o scaduto",
+		"error.api_token_store_failed":                   "Impossibile accedere all'archivio dei token API",
+		"error.api_token_no_user":                        "I token API richiedono un account con un ID utente",
+		"error.bearer_jwt_invalid":                       "Token non valido o scaduto",
+		"error.bearer_jwt_keys_unavailable":              "Le chiavi di verifica dei token non sono disponibili",
+		"error.basic_auth_invalid":                       "Nome utente o password non validi",
+		"error.passkeys_disabled":                        "Le passkey non sono abilitate",
+		"error.passkey_invalid":                          "Verifica della passkey non riuscita",
+		"error.passkey_expired":                          "La richiesta della passkey non è valida o è scaduta, riprova",
+		"error.passkey_store_failed":                     "Impossibile accedere all'archivio delle passkey",
+		"error.passkey_no_user":                          "Le passkey richiedono un account con un ID utente",
+		"error.magic_link_disabled":                      "I link di accesso non sono abilitati.",
+		"error.magic_link_invalid":                       "Questo link di accesso non è valido, è scaduto o è già stato usato. Richiedine uno nuovo.",
+		"error.magic_link_other_browser":                 "Apri il link di accesso nello stesso browser da cui lo hai richiesto.",
+		"success.magic_link_sent":                        "Link di accesso inviato. Aprilo in questo browser per continuare.",
+		"error.qr_login_disabled":                        "L'accesso tramite codice QR non è abilitato.",
+		"error.qr_login_expired":                         "Questo codice QR è scaduto o è già stato usato. Mostrane uno nuovo sull'altro dispositivo.",
+		"error.qr_login_no_user":                         "Gli accessi tramite codice QR possono essere approvati solo da un account con un ID utente.",
+		"error.backup_code_required":                     "Inserisci un codice di backup.",
+		"error.backup_code_invalid":                      "Codice di backup non valido o già utilizzato.",
+		"error.backup_code_unavailable":                  "I codici di backup non sono disponibili. Accedi in un altro modo.",
+		"error.sessions_disabled":                        "La gestione delle sessioni non è abilitata",
+		"error.session_index_failed":                     "Impossibile accedere all'elenco delle sessioni",
+		"error.sessions_no_user":                         "La gestione delle sessioni richiede un account con un ID utente",
+		"error.session_expired":                          "La sessione è scaduta. Accedi di nuovo.",
+		"error.invalid_logout_token":                     "Link di disconnessione non valido o scaduto",
 	})
 
 	// Add Japanese translations
@@ -282,6 +450,48 @@ func init() {
 		"success.login":                                  "ログイン成功",
 		"success.verify_code_sent":                       "確認コードを送信しました",
 		"info.click_if_no_redirect":                      "ページが自動的にリダイレクトしない場合はここをクリックしてください",
+		"error.step_up_unavailable":                      "このアカウントで利用できる追加認証の方法がありません。管理者に連絡してください。",
+		"success.step_up":                                "認証に成功しました",
+		"error.callback_not_allowed":                     "コールバックドメインは許可されていません",
+		"error.missing_exchange_code":                    "交換コードがありません",
+		"error.invalid_exchange_code":                    "交換コードが無効または期限切れです。再度ログインしてください",
+		"error.access_denied":                            "このリソースにアクセスする権限がありません。",
+		"info.access_denied_title":                       "アクセスが拒否されました",
+		"info.switch_account":                            "別のアカウントでサインイン",
+		"error.oidc_not_configured":                      "シングルサインオンが設定されていません",
+		"error.oidc_failed":                              "IDプロバイダーでのサインインに失敗しました。もう一度お試しください",
+		"error.oidc_state_invalid":                       "サインイン要求が無効か期限切れです。最初からやり直してください",
+		"error.idp_not_configured":                       "OpenID Connect プロバイダーが有効になっていません",
+		"error.idp_invalid_client":                       "不明なクライアント、または未登録のリダイレクト URI です",
+		"error.auth_jwt_failed":                          "ID トークンの署名に失敗しました",
+		"error.signing_keys_not_configured":              "署名鍵が設定されていません",
+		"error.api_tokens_disabled":                      "個人アクセストークンは有効になっていません",
+		"error.api_token_invalid":                        "API トークンが無効か期限切れです",
+		"error.api_token_store_failed":                   "API トークンストレージへのアクセスに失敗しました",
+		"error.api_token_no_user":                        "API トークンにはユーザー ID を持つアカウントが必要です",
+		"error.bearer_jwt_invalid":                       "トークンが無効か期限切れです",
+		"error.bearer_jwt_keys_unavailable":              "トークン検証鍵を利用できません",
+		"error.basic_auth_invalid":                       "ユーザー名またはパスワードが正しくありません",
+		"error.passkeys_disabled":                        "パスキーは有効になっていません",
+		"error.passkey_invalid":                          "パスキーの検証に失敗しました",
+		"error.passkey_expired":                          "パスキーのリクエストが無効か期限切れです。もう一度お試しください",
+		"error.passkey_store_failed":                     "パスキーストレージへのアクセスに失敗しました",
+		"error.passkey_no_user":                          "パスキーにはユーザー ID を持つアカウントが必要です",
+		"error.magic_link_disabled":                      "ログインリンクは有効になっていません。",
+		"error.magic_link_invalid":                       "このログインリンクは無効、期限切れ、または使用済みです。新しいリンクをリクエストしてください。",
+		"error.magic_link_other_browser":                 "ログインリンクは、リクエストしたときと同じブラウザで開いてください。",
+		"success.magic_link_sent":                        "ログインリンクを送信しました。続行するにはこのブラウザで開いてください。",
+		"error.qr_login_disabled":                        "QR コードログインは有効になっていません。",
+		"error.qr_login_expired":                         "この QR コードは期限切れか使用済みです。もう一方のデバイスで新しいコードを表示してください。",
+		"error.qr_login_no_user":                         "QR ログインはユーザー ID を持つアカウントからのみ承認できます。",
+		"error.backup_code_required":                     "バックアップコードを入力してください。",
+		"error.backup_code_invalid":                      "バックアップコードが無効か、既に使用されています。",
+		"error.backup_code_unavailable":                  "バックアップコードは利用できません。別の方法でサインインしてください。",
+		"error.sessions_disabled":                        "セッション管理は有効になっていません",
+		"error.session_index_failed":                     "セッション一覧へのアクセスに失敗しました",
+		"error.sessions_no_user":                         "セッション管理にはユーザー ID を持つアカウントが必要です",
+		"error.session_expired":                          "セッションの有効期限が切れました。もう一度サインインしてください。",
+		"error.invalid_logout_token":                     "サインアウトリンクが無効または期限切れです",
 	})
 
 	// Add German translations
@@ -333,6 +543,48 @@ func init() {
 		"success.login":                                  "Anmeldung erfolgreich",
 		"success.verify_code_sent":                       "Bestätigungscode gesendet",
 		"info.click_if_no_redirect":                      "Klicken Sie hier, wenn die Seite nicht automatisch weitergeleitet wird",
+		"error.step_up_unavailable":                      "Für dieses Konto ist keine zusätzliche Authentifizierungsmethode verfügbar. Bitte wenden Sie sich an Ihren Administrator.",
+		"success.step_up":                                "Verifizierung erfolgreich",
+		"error.callback_not_allowed":                     "Die Callback-Domain ist nicht erlaubt",
+		"error.missing_exchange_code":                    "Austauschcode fehlt",
+		"error.invalid_exchange_code":                    "Ungültiger oder abgelaufener Austauschcode, bitte erneut anmelden",
+		"error.access_denied":                            "Sie haben keine Berechtigung, auf diese Ressource zuzugreifen.",
+		"info.access_denied_title":                       "Zugriff verweigert",
+		"info.switch_account":                            "Mit einem anderen Konto anmelden",
+		"error.oidc_not_configured":                      "Single Sign-On ist nicht konfiguriert",
+		"error.oidc_failed":                              "Anmeldung beim Identitätsanbieter fehlgeschlagen, bitte erneut versuchen",
+		"error.oidc_state_invalid":                       "Die Anmeldeanfrage ist ungültig oder abgelaufen, bitte erneut beginnen",
+		"error.idp_not_configured":                       "Der OpenID-Connect-Anbieter ist nicht aktiviert",
+		"error.idp_invalid_client":                       "Unbekannter Client oder nicht registrierte Weiterleitungs-URI",
+		"error.auth_jwt_failed":                          "Identitätstoken konnte nicht signiert werden",
+		"error.signing_keys_not_configured":              "Signaturschlüssel sind nicht konfiguriert",
+		"error.api_tokens_disabled":                      "Persönliche Zugriffstoken sind nicht aktiviert",
+		"error.api_token_invalid":                        "Ungültiges oder abgelaufenes API-Token",
+		"error.api_token_store_failed":                   "Zugriff auf den API-Token-Speicher fehlgeschlagen",
+		"error.api_token_no_user":                        "API-Token erfordern ein Konto mit Benutzer-ID",
+		"error.bearer_jwt_invalid":                       "Ungültiges oder abgelaufenes Token",
+		"error.bearer_jwt_keys_unavailable":              "Schlüssel zur Tokenprüfung sind nicht verfügbar",
+		"error.basic_auth_invalid":                       "Ungültiger Benutzername oder ungültiges Passwort",
+		"error.passkeys_disabled":                        "Passkeys sind nicht aktiviert",
+		"error.passkey_invalid":                          "Überprüfung des Passkeys fehlgeschlagen",
+		"error.passkey_expired":                          "Die Passkey-Anfrage ist ungültig oder abgelaufen, bitte versuchen Sie es erneut",
+		"error.passkey_store_failed":                     "Zugriff auf den Passkey-Speicher fehlgeschlagen",
+		"error.passkey_no_user":                          "Passkeys erfordern ein Konto mit einer Benutzer-ID",
+		"error.magic_link_disabled":                      "Anmeldelinks sind nicht aktiviert.",
+		"error.magic_link_invalid":                       "Dieser Anmeldelink ist ungültig, abgelaufen oder wurde bereits verwendet. Bitte fordern Sie einen neuen an.",
+		"error.magic_link_other_browser":                 "Öffnen Sie den Anmeldelink in demselben Browser, in dem Sie ihn angefordert haben.",
+		"success.magic_link_sent":                        "Anmeldelink gesendet. Öffnen Sie ihn in diesem Browser, um fortzufahren.",
+		"error.qr_login_disabled":                        "Die Anmeldung per QR-Code ist nicht aktiviert.",
+		"error.qr_login_expired":                         "Dieser QR-Code ist abgelaufen oder wurde bereits verwendet. Zeigen Sie auf dem anderen Gerät einen neuen an.",
+		"error.qr_login_no_user":                         "QR-Anmeldungen können nur von einem Konto mit Benutzer-ID bestätigt werden.",
+		"error.backup_code_required":                     "Bitte geben Sie einen Backup-Code ein.",
+		"error.backup_code_invalid":                      "Ungültiger oder bereits verwendeter Backup-Code.",
+		"error.backup_code_unavailable":                  "Backup-Codes sind nicht verfügbar. Bitte melden Sie sich auf andere Weise an.",
+		"error.sessions_disabled":                        "Sitzungsverwaltung ist nicht aktiviert",
+		"error.session_index_failed":                     "Zugriff auf die Sitzungsliste fehlgeschlagen",
+		"error.sessions_no_user":                         "Die Sitzungsverwaltung erfordert ein Konto mit Benutzer-ID",
+		"error.session_expired":                          "Ihre Sitzung ist abgelaufen. Bitte melden Sie sich erneut an.",
+		"error.invalid_logout_token":                     "Ungültiger oder abgelaufener Abmeldelink",
 	})
 
 	// Add Korean translations
@@ -384,6 +636,48 @@ func init() {
 		"success.login":                                  "로그인 성공",
 		"success.verify_code_sent":                       "인증 코드가 전송되었습니다",
 		"info.click_if_no_redirect":                      "페이지가 자동으로 리디렉션되지 않으면 여기를 클릭하세요",
+		"error.step_up_unavailable":                      "이 계정에 사용할 수 있는 추가 인증 방법이 없습니다. 관리자에게 문의하세요.",
+		"success.step_up":                                "인증에 성공했습니다",
+		"error.callback_not_allowed":                     "허용되지 않은 콜백 도메인입니다",
+		"error.missing_exchange_code":                    "교환 코드가 없습니다",
+		"error.invalid_exchange_code":                    "교환 코드가 유효하지 않거나 만료되었습니다. 다시 로그인하세요",
+		"error.access_denied":                            "이 리소스에 접근할 권한이 없습니다.",
+		"info.access_denied_title":                       "접근 거부됨",
+		"info.switch_account":                            "다른 계정으로 로그인",
+		"error.oidc_not_configured":                      "싱글 사인온이 구성되지 않았습니다",
+		"error.oidc_failed":                              "ID 공급자 로그인에 실패했습니다. 다시 시도하세요",
+		"error.oidc_state_invalid":                       "로그인 요청이 잘못되었거나 만료되었습니다. 다시 시작하세요",
+		"error.idp_not_configured":                       "OpenID Connect 공급자가 활성화되지 않았습니다",
+		"error.idp_invalid_client":                       "알 수 없는 클라이언트이거나 등록되지 않은 리디렉션 URI입니다",
+		"error.auth_jwt_failed":                          "ID 토큰 서명에 실패했습니다",
+		"error.signing_keys_not_configured":              "서명 키가 구성되지 않았습니다",
+		"error.api_tokens_disabled":                      "개인 액세스 토큰이 활성화되어 있지 않습니다",
+		"error.api_token_invalid":                        "API 토큰이 유효하지 않거나 만료되었습니다",
+		"error.api_token_store_failed":                   "API 토큰 저장소에 접근하지 못했습니다",
+		"error.api_token_no_user":                        "API 토큰을 사용하려면 사용자 ID가 있는 계정이 필요합니다",
+		"error.bearer_jwt_invalid":                       "토큰이 유효하지 않거나 만료되었습니다",
+		"error.bearer_jwt_keys_unavailable":              "토큰 검증 키를 사용할 수 없습니다",
+		"error.basic_auth_invalid":                       "사용자 이름 또는 비밀번호가 올바르지 않습니다",
+		"error.passkeys_disabled":                        "패스키가 활성화되어 있지 않습니다",
+		"error.passkey_invalid":                          "패스키 확인에 실패했습니다",
+		"error.passkey_expired":                          "패스키 요청이 유효하지 않거나 만료되었습니다. 다시 시도하세요",
+		"error.passkey_store_failed":                     "패스키 저장소에 접근하지 못했습니다",
+		"error.passkey_no_user":                          "패스키를 사용하려면 사용자 ID가 있는 계정이 필요합니다",
+		"error.magic_link_disabled":                      "로그인 링크가 활성화되어 있지 않습니다.",
+		"error.magic_link_invalid":                       "이 로그인 링크는 유효하지 않거나 만료되었거나 이미 사용되었습니다. 새 링크를 요청하세요.",
+		"error.magic_link_other_browser":                 "로그인 링크를 요청한 브라우저와 같은 브라우저에서 여세요.",
+		"success.magic_link_sent":                        "로그인 링크를 보냈습니다. 계속하려면 이 브라우저에서 여세요.",
+		"error.qr_login_disabled":                        "QR 코드 로그인이 활성화되어 있지 않습니다.",
+		"error.qr_login_expired":                         "이 QR 코드는 만료되었거나 이미 사용되었습니다. 다른 기기에서 새 코드를 표시하세요.",
+		"error.qr_login_no_user":                         "QR 로그인은 사용자 ID가 있는 계정에서만 승인할 수 있습니다.",
+		"error.backup_code_required":                     "백업 코드를 입력하세요.",
+		"error.backup_code_invalid":                      "백업 코드가 잘못되었거나 이미 사용되었습니다.",
+		"error.backup_code_unavailable":                  "백업 코드를 사용할 수 없습니다. 다른 방법으로 로그인하세요.",
+		"error.sessions_disabled":                        "세션 관리가 활성화되어 있지 않습니다",
+		"error.session_index_failed":                     "세션 목록에 접근하지 못했습니다",
+		"error.sessions_no_user":                         "세션 관리를 사용하려면 사용자 ID가 있는 계정이 필요합니다",
+		"error.session_expired":                          "세션이 만료되었습니다. 다시 로그인하세요.",
+		"error.invalid_logout_token":                     "로그아웃 링크가 유효하지 않거나 만료되었습니다",
 	})
 }
 
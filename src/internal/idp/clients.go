@@ -0,0 +1,116 @@
+package idp
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/url"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Client is an application registered to log users in through Stargate.
+type Client struct {
+	ID   string `yaml:"id" json:"id"`
+	Name string `yaml:"name" json:"name"`
+	// Secret authenticates confidential clients at the token endpoint.
+	Secret string `yaml:"secret" json:"secret"`
+	// Public clients (SPAs, native apps) have no secret and must use PKCE.
+	Public bool `yaml:"public" json:"public"`
+	// RedirectURIs are compared exactly with the redirect_uri of authorization requests.
+	RedirectURIs []string `yaml:"redirect_uris" json:"redirect_uris"`
+}
+
+// AllowsRedirect reports whether uri is one of the client's registered redirect URIs.
+func (c *Client) AllowsRedirect(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate checks the secret presented by a confidential client.
+func (c *Client) Authenticate(secret string) bool {
+	if c.Public {
+		return secret == ""
+	}
+	return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(c.Secret)) == 1
+}
+
+// Clients is the set of registered clients.
+type Clients struct {
+	byID map[string]*Client
+}
+
+// clientsFile is the document format of OIDC_PROVIDER_CLIENTS_FILE.
+type clientsFile struct {
+	Clients []*Client `yaml:"clients" json:"clients"`
+}
+
+// ParseClients parses a YAML (or JSON) client registry.
+func ParseClients(data []byte) (*Clients, error) {
+	var doc clientsFile
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid clients file: %w", err)
+	}
+	if len(doc.Clients) == 0 {
+		return nil, fmt.Errorf("invalid clients file: no clients")
+	}
+
+	clients := &Clients{byID: make(map[string]*Client, len(doc.Clients))}
+	for i, c := range doc.Clients {
+		if c == nil || c.ID == "" {
+			return nil, fmt.Errorf("client %d: missing id", i+1)
+		}
+		if clients.byID[c.ID] != nil {
+			return nil, fmt.Errorf("client %q: duplicate id", c.ID)
+		}
+		if c.Public && c.Secret != "" {
+			return nil, fmt.Errorf("client %q: public clients cannot have a secret", c.ID)
+		}
+		if !c.Public && c.Secret == "" {
+			return nil, fmt.Errorf("client %q: missing secret (set public: true for clients without one)", c.ID)
+		}
+		if len(c.RedirectURIs) == 0 {
+			return nil, fmt.Errorf("client %q: no redirect_uris", c.ID)
+		}
+		for _, uri := range c.RedirectURIs {
+			u, err := url.Parse(uri)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Fragment != "" {
+				return nil, fmt.Errorf("client %q: invalid redirect URI %q", c.ID, uri)
+			}
+		}
+		if c.Name == "" {
+			c.Name = c.ID
+		}
+		clients.byID[c.ID] = c
+	}
+	return clients, nil
+}
+
+// LoadClients reads a client registry from path.
+func LoadClients(path string) (*Clients, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseClients(data)
+}
+
+// Get returns the client with id, or nil.
+func (c *Clients) Get(id string) *Client {
+	if c == nil {
+		return nil
+	}
+	return c.byID[id]
+}
+
+// Len returns the number of registered clients.
+func (c *Clients) Len() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.byID)
+}
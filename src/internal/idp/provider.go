@@ -0,0 +1,421 @@
+// Package idp implements a minimal OpenID Connect provider backed by Stargate sessions: the
+// authorization code flow (with PKCE) for registered clients, ID tokens signed with the key ring,
+// opaque access tokens for the userinfo endpoint, and the discovery and JWKS documents.
+package idp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/soulteary/stargate/src/internal/jose"
+	"github.com/soulteary/stargate/src/internal/keyring"
+)
+
+// Endpoint paths, relative to the issuer.
+const (
+	DiscoveryPath = "/.well-known/openid-configuration"
+	AuthorizePath = "/authorize"
+	TokenPath     = "/token"
+	UserInfoPath  = "/userinfo"
+	JWKSPath      = "/jwks.json"
+)
+
+// Supported scopes. openid is required; the others add claims.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+	ScopePhone   = "phone"
+	ScopeGroups  = "groups"
+)
+
+var supportedScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopePhone, ScopeGroups}
+
+const (
+	// CodeTTL is how long an authorization code can be redeemed.
+	CodeTTL = 60 * time.Second
+	// DefaultTokenTTL is the lifetime of ID and access tokens.
+	DefaultTokenTTL = time.Hour
+
+	codeKeyPrefix  = "idp_code:"
+	tokenKeyPrefix = "idp_token:"
+)
+
+// Errors for authorization requests that must not be redirected back to the client,
+// because the client or its redirect URI cannot be trusted.
+var (
+	ErrUnknownClient      = errors.New("unknown client")
+	ErrInvalidRedirectURI = errors.New("redirect_uri is not registered for the client")
+)
+
+// Error is an OAuth 2.0 error response (RFC 6749 sections 4.1.2.1 and 5.2).
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func oauthError(code, description string) *Error {
+	return &Error{Code: code, Description: description}
+}
+
+// Storage keeps authorization codes and access tokens. The session storage (memory or Redis)
+// implements it, so every Stargate instance sharing sessions can redeem them.
+type Storage interface {
+	Get(key string) ([]byte, error)
+	Set(key string, val []byte, exp time.Duration) error
+	Delete(key string) error
+}
+
+// Identity is the logged-in user, taken from the session.
+type Identity struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email,omitempty"`
+	Phone   string   `json:"phone,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Role    string   `json:"role,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	AMR     []string `json:"amr,omitempty"`
+}
+
+// AuthorizationRequest holds the parameters of an authorization request.
+type AuthorizationRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// TokenRequest holds the parameters of a token request. The client credentials come from
+// HTTP Basic authentication or the form.
+type TokenRequest struct {
+	GrantType    string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	ClientID     string
+	ClientSecret string
+}
+
+// TokenResponse is a successful token response.
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// grant is stored for an authorization code.
+type grant struct {
+	ClientID      string   `json:"client_id"`
+	RedirectURI   string   `json:"redirect_uri"`
+	Scopes        []string `json:"scopes"`
+	Nonce         string   `json:"nonce,omitempty"`
+	CodeChallenge string   `json:"code_challenge,omitempty"`
+	Identity      Identity `json:"identity"`
+}
+
+// accessToken is stored for an access token.
+type accessToken struct {
+	ClientID string   `json:"client_id"`
+	Scopes   []string `json:"scopes"`
+	Identity Identity `json:"identity"`
+}
+
+// Provider is an OpenID Connect provider.
+type Provider struct {
+	issuer   string
+	clients  *Clients
+	keys     *keyring.KeyRing
+	storage  Storage
+	tokenTTL time.Duration
+	now      func() time.Time
+}
+
+// New creates a provider. tokenTTL <= 0 uses DefaultTokenTTL.
+func New(issuer string, clients *Clients, keys *keyring.KeyRing, storage Storage, tokenTTL time.Duration) *Provider {
+	if tokenTTL <= 0 {
+		tokenTTL = DefaultTokenTTL
+	}
+	return &Provider{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		clients:  clients,
+		keys:     keys,
+		storage:  storage,
+		tokenTTL: tokenTTL,
+		now:      time.Now,
+	}
+}
+
+// Issuer returns the issuer identifier.
+func (p *Provider) Issuer() string {
+	return p.issuer
+}
+
+// Client returns the registered client with id, or nil.
+func (p *Provider) Client(id string) *Client {
+	return p.clients.Get(id)
+}
+
+// CheckClient verifies the client and redirect URI of an authorization request. Errors from
+// CheckClient must be shown to the user instead of being redirected.
+func (p *Provider) CheckClient(req AuthorizationRequest) (*Client, error) {
+	client := p.clients.Get(req.ClientID)
+	if client == nil {
+		return nil, ErrUnknownClient
+	}
+	if !client.AllowsRedirect(req.RedirectURI) {
+		return nil, ErrInvalidRedirectURI
+	}
+	return client, nil
+}
+
+// ValidateRequest checks the parameters of an authorization request from a client checked with
+// CheckClient. The returned *Error is meant for the client's redirect URI.
+func (p *Provider) ValidateRequest(client *Client, req AuthorizationRequest) *Error {
+	if req.ResponseType != "code" {
+		return oauthError("unsupported_response_type", "only the authorization code flow is supported")
+	}
+	if !contains(grantedScopes(req.Scope), ScopeOpenID) {
+		return oauthError("invalid_scope", "the openid scope is required")
+	}
+	if req.CodeChallenge != "" && req.CodeChallengeMethod != "S256" {
+		return oauthError("invalid_request", "code_challenge_method must be S256")
+	}
+	if req.CodeChallenge == "" && client.Public {
+		return oauthError("invalid_request", "public clients must use PKCE")
+	}
+	return nil
+}
+
+// Authorize validates an authorization request from a client checked with CheckClient and issues a
+// one-time code for identity. The returned *Error is meant for the client's redirect URI.
+func (p *Provider) Authorize(client *Client, req AuthorizationRequest, identity Identity) (string, *Error) {
+	if err := p.ValidateRequest(client, req); err != nil {
+		return "", err
+	}
+	if identity.Subject == "" {
+		return "", oauthError("access_denied", "the session does not identify a user")
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		return "", oauthError("server_error", "")
+	}
+	value, err := json.Marshal(grant{
+		ClientID:      client.ID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        grantedScopes(req.Scope),
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		Identity:      identity,
+	})
+	if err != nil {
+		return "", oauthError("server_error", "")
+	}
+	if err := p.storage.Set(codeKeyPrefix+code, value, CodeTTL); err != nil {
+		return "", oauthError("server_error", "")
+	}
+	return code, nil
+}
+
+// Exchange redeems an authorization code for an ID token and an access token, and returns the
+// identity they were issued for. Request errors are *Error; other errors are server failures.
+func (p *Provider) Exchange(req TokenRequest) (*TokenResponse, *Identity, error) {
+	if req.GrantType != "authorization_code" {
+		return nil, nil, oauthError("unsupported_grant_type", "only authorization_code is supported")
+	}
+	client := p.clients.Get(req.ClientID)
+	if client == nil || !client.Authenticate(req.ClientSecret) {
+		return nil, nil, oauthError("invalid_client", "")
+	}
+	if req.Code == "" {
+		return nil, nil, oauthError("invalid_request", "missing code")
+	}
+
+	// The code is deleted before it is checked, so it cannot be retried
+	key := codeKeyPrefix + req.Code
+	value, err := p.storage.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if value == nil {
+		return nil, nil, oauthError("invalid_grant", "unknown or expired code")
+	}
+	if err := p.storage.Delete(key); err != nil {
+		return nil, nil, err
+	}
+	var g grant
+	if err := json.Unmarshal(value, &g); err != nil {
+		return nil, nil, oauthError("invalid_grant", "unknown or expired code")
+	}
+	if g.ClientID != client.ID || g.RedirectURI != req.RedirectURI {
+		return nil, nil, oauthError("invalid_grant", "code was issued to another client or redirect_uri")
+	}
+	if g.CodeChallenge != "" || req.CodeVerifier != "" {
+		sum := sha256.Sum256([]byte(req.CodeVerifier))
+		challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+		if req.CodeVerifier == "" || subtle.ConstantTimeCompare([]byte(challenge), []byte(g.CodeChallenge)) != 1 {
+			return nil, nil, oauthError("invalid_grant", "PKCE verification failed")
+		}
+	}
+
+	now := p.now()
+	idClaims := UserClaims(g.Identity, g.Scopes)
+	idClaims["iss"] = p.issuer
+	idClaims["aud"] = client.ID
+	idClaims["iat"] = now.Unix()
+	idClaims["exp"] = now.Add(p.tokenTTL).Unix()
+	if len(g.Identity.AMR) > 0 {
+		idClaims["amr"] = g.Identity.AMR
+	}
+	if g.Nonce != "" {
+		idClaims["nonce"] = g.Nonce
+	}
+	idToken, err := p.keys.Sign(idClaims)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err = json.Marshal(accessToken{ClientID: client.ID, Scopes: g.Scopes, Identity: g.Identity})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := p.storage.Set(tokenKeyPrefix+token, value, p.tokenTTL); err != nil {
+		return nil, nil, err
+	}
+
+	return &TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(p.tokenTTL.Seconds()),
+		IDToken:     idToken,
+		Scope:       strings.Join(g.Scopes, " "),
+	}, &g.Identity, nil
+}
+
+// UserInfo returns the claims for an access token.
+func (p *Provider) UserInfo(token string) (map[string]interface{}, error) {
+	if token == "" {
+		return nil, oauthError("invalid_token", "")
+	}
+	value, err := p.storage.Get(tokenKeyPrefix + token)
+	if err != nil {
+		return nil, err
+	}
+	var t accessToken
+	if value == nil || json.Unmarshal(value, &t) != nil {
+		return nil, oauthError("invalid_token", "unknown or expired access token")
+	}
+	return UserClaims(t.Identity, t.Scopes), nil
+}
+
+// UserClaims returns the standard claims for identity released by scopes.
+func UserClaims(identity Identity, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": identity.Subject}
+	if contains(scopes, ScopeProfile) && identity.Name != "" {
+		claims["name"] = identity.Name
+	}
+	if contains(scopes, ScopeEmail) && identity.Email != "" {
+		claims["email"] = identity.Email
+	}
+	if contains(scopes, ScopePhone) && identity.Phone != "" {
+		claims["phone_number"] = identity.Phone
+	}
+	if contains(scopes, ScopeGroups) {
+		if len(identity.Groups) > 0 {
+			claims["groups"] = identity.Groups
+		}
+		if identity.Role != "" {
+			claims["role"] = identity.Role
+		}
+	}
+	return claims
+}
+
+// Discovery returns the provider metadata document (OpenID Connect Discovery 1.0).
+func (p *Provider) Discovery() map[string]interface{} {
+	return map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + AuthorizePath,
+		"token_endpoint":                        p.issuer + TokenPath,
+		"userinfo_endpoint":                     p.issuer + UserInfoPath,
+		"jwks_uri":                              p.issuer + JWKSPath,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": p.keys.Algorithms(),
+		"scopes_supported":                      supportedScopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "nonce", "amr", "name", "email", "phone_number", "groups", "role"},
+	}
+}
+
+// JWKS returns the public signing keys.
+func (p *Provider) JWKS() *jose.JWKS {
+	return p.keys.JWKS()
+}
+
+// grantedScopes returns the supported scopes of a space-separated scope parameter.
+// Unknown scopes are ignored, as OpenID Connect allows.
+func grantedScopes(scope string) []string {
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if contains(supportedScopes, s) && !contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+var provider *Provider
+
+// Init sets the provider served by the /authorize, /token, /userinfo and /jwks.json routes;
+// nil disables them.
+func Init(p *Provider) {
+	provider = p
+}
+
+// Get returns the provider, or nil when it is disabled.
+func Get() *Provider {
+	return provider
+}
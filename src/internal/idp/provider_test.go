@@ -0,0 +1,339 @@
+package idp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+
+	"github.com/soulteary/stargate/src/internal/jose"
+	"github.com/soulteary/stargate/src/internal/keyring"
+)
+
+// memoryStorage is a Storage honouring expirations against a settable clock.
+type memoryStorage struct {
+	mu      sync.Mutex
+	now     time.Time
+	values  map[string][]byte
+	expires map[string]time.Time
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{now: time.Now(), values: map[string][]byte{}, expires: map[string]time.Time{}}
+}
+
+func (s *memoryStorage) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if exp, ok := s.expires[key]; ok && !s.now.Before(exp) {
+		return nil, nil
+	}
+	return s.values[key], nil
+}
+
+func (s *memoryStorage) Set(key string, val []byte, exp time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = val
+	if exp > 0 {
+		s.expires[key] = s.now.Add(exp)
+	}
+	return nil
+}
+
+func (s *memoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	delete(s.expires, key)
+	return nil
+}
+
+const testClients = `
+clients:
+  - id: wiki
+    name: Team Wiki
+    secret: wiki-secret
+    redirect_uris: ["https://wiki.example.com/callback"]
+  - id: spa
+    public: true
+    redirect_uris: ["https://spa.example.com/cb", "http://localhost:3000/cb"]
+`
+
+func newTestProvider(t *testing.T) (*Provider, *memoryStorage) {
+	t.Helper()
+	clients, err := ParseClients([]byte(testClients))
+	testza.AssertNoError(t, err)
+	key, err := keyring.Generate(jose.ES256)
+	testza.AssertNoError(t, err)
+	storage := newMemoryStorage()
+	return New("https://auth.example.com/", clients, keyring.New(key), storage, 0), storage
+}
+
+var testIdentity = Identity{
+	Subject: "user-1",
+	Email:   "alice@example.com",
+	Phone:   "+15550100",
+	Name:    "Alice",
+	Role:    "admin",
+	Groups:  []string{"read", "write"},
+	AMR:     []string{"pwd", "otp"},
+}
+
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func authorize(t *testing.T, p *Provider, req AuthorizationRequest) string {
+	t.Helper()
+	client, err := p.CheckClient(req)
+	testza.AssertNoError(t, err)
+	code, oerr := p.Authorize(client, req, testIdentity)
+	testza.AssertNil(t, oerr)
+	return code
+}
+
+func assertOAuthError(t *testing.T, err error, code string) {
+	t.Helper()
+	var oerr *Error
+	testza.AssertTrue(t, errors.As(err, &oerr), "expected an OAuth error, got %v", err)
+	testza.AssertEqual(t, code, oerr.Code)
+}
+
+func TestParseClients(t *testing.T) {
+	clients, err := ParseClients([]byte(testClients))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, 2, clients.Len())
+	testza.AssertEqual(t, "Team Wiki", clients.Get("wiki").Name)
+	testza.AssertEqual(t, "spa", clients.Get("spa").Name)
+	testza.AssertNil(t, clients.Get("missing"))
+
+	testza.AssertTrue(t, clients.Get("wiki").AllowsRedirect("https://wiki.example.com/callback"))
+	testza.AssertFalse(t, clients.Get("wiki").AllowsRedirect("https://wiki.example.com/callback/"))
+	testza.AssertTrue(t, clients.Get("wiki").Authenticate("wiki-secret"))
+	testza.AssertFalse(t, clients.Get("wiki").Authenticate(""))
+	testza.AssertTrue(t, clients.Get("spa").Authenticate(""))
+	testza.AssertFalse(t, clients.Get("spa").Authenticate("anything"))
+
+	invalid := map[string]string{
+		"empty":             `clients: []`,
+		"missing id":        `clients: [{secret: s, redirect_uris: ["https://a.example.com/cb"]}]`,
+		"duplicate id":      `clients: [{id: a, secret: s, redirect_uris: ["https://a.example.com/cb"]}, {id: a, secret: s, redirect_uris: ["https://a.example.com/cb"]}]`,
+		"public secret":     `clients: [{id: a, public: true, secret: s, redirect_uris: ["https://a.example.com/cb"]}]`,
+		"missing secret":    `clients: [{id: a, redirect_uris: ["https://a.example.com/cb"]}]`,
+		"no redirect uris":  `clients: [{id: a, secret: s}]`,
+		"relative redirect": `clients: [{id: a, secret: s, redirect_uris: ["/cb"]}]`,
+		"fragment redirect": `clients: [{id: a, secret: s, redirect_uris: ["https://a.example.com/cb#x"]}]`,
+		"custom scheme":     `clients: [{id: a, secret: s, redirect_uris: ["javascript://a.example.com/cb"]}]`,
+		"not yaml":          `clients: [`,
+	}
+	for name, doc := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseClients([]byte(doc))
+			testza.AssertNotNil(t, err)
+		})
+	}
+}
+
+func TestExchange_ConfidentialClient(t *testing.T) {
+	p, _ := newTestProvider(t)
+	code := authorize(t, p, AuthorizationRequest{
+		ResponseType: "code",
+		ClientID:     "wiki",
+		RedirectURI:  "https://wiki.example.com/callback",
+		Scope:        "openid profile email phone groups unknown",
+		Nonce:        "n-1",
+	})
+
+	resp, identity, err := p.Exchange(TokenRequest{
+		GrantType:    "authorization_code",
+		Code:         code,
+		RedirectURI:  "https://wiki.example.com/callback",
+		ClientID:     "wiki",
+		ClientSecret: "wiki-secret",
+	})
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "user-1", identity.Subject)
+	testza.AssertEqual(t, "Bearer", resp.TokenType)
+	testza.AssertEqual(t, 3600, resp.ExpiresIn)
+	testza.AssertEqual(t, "openid profile email phone groups", resp.Scope)
+
+	token, err := jose.Verify(resp.IDToken, p.JWKS())
+	testza.AssertNoError(t, err)
+	testza.AssertNoError(t, token.Claims.Validate(jose.Expected{Issuer: "https://auth.example.com", Audience: "wiki", RequireExpiry: true}))
+	testza.AssertEqual(t, "user-1", token.Claims.String("sub"))
+	testza.AssertEqual(t, "n-1", token.Claims.String("nonce"))
+	testza.AssertEqual(t, "Alice", token.Claims.String("name"))
+	testza.AssertEqual(t, "alice@example.com", token.Claims.String("email"))
+	testza.AssertEqual(t, "+15550100", token.Claims.String("phone_number"))
+	testza.AssertEqual(t, "admin", token.Claims.String("role"))
+	testza.AssertEqual(t, []string{"read", "write"}, token.Claims.Strings("groups"))
+	testza.AssertEqual(t, []string{"pwd", "otp"}, token.Claims.Strings("amr"))
+
+	userinfo, err := p.UserInfo(resp.AccessToken)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "user-1", userinfo["sub"])
+	testza.AssertEqual(t, "alice@example.com", userinfo["email"])
+
+	// Codes are single use
+	_, _, err = p.Exchange(TokenRequest{
+		GrantType:    "authorization_code",
+		Code:         code,
+		RedirectURI:  "https://wiki.example.com/callback",
+		ClientID:     "wiki",
+		ClientSecret: "wiki-secret",
+	})
+	assertOAuthError(t, err, "invalid_grant")
+}
+
+func TestExchange_ScopesLimitClaims(t *testing.T) {
+	p, _ := newTestProvider(t)
+	code := authorize(t, p, AuthorizationRequest{
+		ResponseType: "code",
+		ClientID:     "wiki",
+		RedirectURI:  "https://wiki.example.com/callback",
+		Scope:        "openid",
+	})
+	resp, _, err := p.Exchange(TokenRequest{GrantType: "authorization_code", Code: code, RedirectURI: "https://wiki.example.com/callback", ClientID: "wiki", ClientSecret: "wiki-secret"})
+	testza.AssertNoError(t, err)
+
+	token, err := jose.Verify(resp.IDToken, p.JWKS())
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "user-1", token.Claims.String("sub"))
+	testza.AssertEqual(t, "", token.Claims.String("email"))
+	testza.AssertEqual(t, "", token.Claims.String("name"))
+	testza.AssertNil(t, token.Claims["groups"])
+
+	userinfo, err := p.UserInfo(resp.AccessToken)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, map[string]interface{}{"sub": "user-1"}, userinfo)
+}
+
+func TestExchange_PublicClientPKCE(t *testing.T) {
+	p, _ := newTestProvider(t)
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	req := AuthorizationRequest{
+		ResponseType:        "code",
+		ClientID:            "spa",
+		RedirectURI:         "http://localhost:3000/cb",
+		Scope:               "openid",
+		CodeChallenge:       challenge(verifier),
+		CodeChallengeMethod: "S256",
+	}
+
+	code := authorize(t, p, req)
+	_, _, err := p.Exchange(TokenRequest{GrantType: "authorization_code", Code: code, RedirectURI: req.RedirectURI, ClientID: "spa", CodeVerifier: "wrong"})
+	assertOAuthError(t, err, "invalid_grant")
+
+	code = authorize(t, p, req)
+	_, _, err = p.Exchange(TokenRequest{GrantType: "authorization_code", Code: code, RedirectURI: req.RedirectURI, ClientID: "spa"})
+	assertOAuthError(t, err, "invalid_grant")
+
+	code = authorize(t, p, req)
+	resp, _, err := p.Exchange(TokenRequest{GrantType: "authorization_code", Code: code, RedirectURI: req.RedirectURI, ClientID: "spa", CodeVerifier: verifier})
+	testza.AssertNoError(t, err)
+	testza.AssertNotEqual(t, "", resp.IDToken)
+}
+
+func TestExchange_Errors(t *testing.T) {
+	p, storage := newTestProvider(t)
+	req := AuthorizationRequest{ResponseType: "code", ClientID: "wiki", RedirectURI: "https://wiki.example.com/callback", Scope: "openid"}
+	valid := func() TokenRequest {
+		return TokenRequest{GrantType: "authorization_code", Code: authorize(t, p, req), RedirectURI: req.RedirectURI, ClientID: "wiki", ClientSecret: "wiki-secret"}
+	}
+
+	tr := valid()
+	tr.GrantType = "refresh_token"
+	_, _, err := p.Exchange(tr)
+	assertOAuthError(t, err, "unsupported_grant_type")
+
+	tr = valid()
+	tr.ClientSecret = "wrong"
+	_, _, err = p.Exchange(tr)
+	assertOAuthError(t, err, "invalid_client")
+
+	tr = valid()
+	tr.ClientID, tr.ClientSecret = "spa", ""
+	_, _, err = p.Exchange(tr)
+	assertOAuthError(t, err, "invalid_grant")
+
+	tr = valid()
+	tr.RedirectURI = "https://wiki.example.com/other"
+	_, _, err = p.Exchange(tr)
+	assertOAuthError(t, err, "invalid_grant")
+
+	tr = valid()
+	tr.Code = ""
+	_, _, err = p.Exchange(tr)
+	assertOAuthError(t, err, "invalid_request")
+
+	// Codes expire after CodeTTL
+	tr = valid()
+	storage.now = storage.now.Add(CodeTTL)
+	_, _, err = p.Exchange(tr)
+	assertOAuthError(t, err, "invalid_grant")
+}
+
+func TestAuthorize_Errors(t *testing.T) {
+	p, _ := newTestProvider(t)
+
+	_, err := p.CheckClient(AuthorizationRequest{ClientID: "missing", RedirectURI: "https://wiki.example.com/callback"})
+	testza.AssertErrorIs(t, err, ErrUnknownClient)
+	_, err = p.CheckClient(AuthorizationRequest{ClientID: "wiki", RedirectURI: "https://evil.example.com/callback"})
+	testza.AssertErrorIs(t, err, ErrInvalidRedirectURI)
+
+	wiki, spa := p.Client("wiki"), p.Client("spa")
+	base := AuthorizationRequest{ResponseType: "code", ClientID: "wiki", RedirectURI: "https://wiki.example.com/callback", Scope: "openid"}
+	cases := []struct {
+		name   string
+		client *Client
+		modify func(*AuthorizationRequest)
+		code   string
+	}{
+		{"implicit flow", wiki, func(r *AuthorizationRequest) { r.ResponseType = "token" }, "unsupported_response_type"},
+		{"missing openid", wiki, func(r *AuthorizationRequest) { r.Scope = "profile email" }, "invalid_scope"},
+		{"plain PKCE", wiki, func(r *AuthorizationRequest) { r.CodeChallenge, r.CodeChallengeMethod = "abc", "plain" }, "invalid_request"},
+		{"public without PKCE", spa, func(r *AuthorizationRequest) { r.ClientID, r.RedirectURI = "spa", "http://localhost:3000/cb" }, "invalid_request"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := base
+			tc.modify(&req)
+			_, oerr := p.Authorize(tc.client, req, testIdentity)
+			testza.AssertNotNil(t, oerr)
+			testza.AssertEqual(t, tc.code, oerr.Code)
+		})
+	}
+
+	_, oerr := p.Authorize(wiki, base, Identity{})
+	testza.AssertEqual(t, "access_denied", oerr.Code)
+}
+
+func TestUserInfo_Expired(t *testing.T) {
+	p, storage := newTestProvider(t)
+	code := authorize(t, p, AuthorizationRequest{ResponseType: "code", ClientID: "wiki", RedirectURI: "https://wiki.example.com/callback", Scope: "openid"})
+	resp, _, err := p.Exchange(TokenRequest{GrantType: "authorization_code", Code: code, RedirectURI: "https://wiki.example.com/callback", ClientID: "wiki", ClientSecret: "wiki-secret"})
+	testza.AssertNoError(t, err)
+
+	storage.now = storage.now.Add(DefaultTokenTTL)
+	_, err = p.UserInfo(resp.AccessToken)
+	assertOAuthError(t, err, "invalid_token")
+	_, err = p.UserInfo("")
+	assertOAuthError(t, err, "invalid_token")
+}
+
+func TestDiscovery(t *testing.T) {
+	p, _ := newTestProvider(t)
+	doc := p.Discovery()
+	testza.AssertEqual(t, "https://auth.example.com", doc["issuer"])
+	testza.AssertEqual(t, "https://auth.example.com/authorize", doc["authorization_endpoint"])
+	testza.AssertEqual(t, "https://auth.example.com/token", doc["token_endpoint"])
+	testza.AssertEqual(t, "https://auth.example.com/userinfo", doc["userinfo_endpoint"])
+	testza.AssertEqual(t, "https://auth.example.com/jwks.json", doc["jwks_uri"])
+	testza.AssertEqual(t, []string{jose.ES256}, doc["id_token_signing_alg_values_supported"])
+}
@@ -0,0 +1,169 @@
+// Package jose implements the subset of JSON Web Key (RFC 7517) and JSON Web Token (RFC 7519)
+// handling Stargate needs: parsing and publishing public keys, and signing and verifying
+// compact JWS tokens with RSA, ECDSA and Ed25519 keys.
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// JWK is a public JSON Web Key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// ErrUnsupportedKey is returned for key types and curves that are not supported.
+var ErrUnsupportedKey = errors.New("unsupported key")
+
+var b64 = base64.RawURLEncoding
+
+// ParseJWKS parses a JSON Web Key Set document.
+func ParseJWKS(data []byte) (*JWKS, error) {
+	set := &JWKS{}
+	if err := json.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	return set, nil
+}
+
+// NewJWK describes pub as a JWK for signature verification with alg.
+// When kid is empty, the RFC 7638 thumbprint of the key is used.
+func NewJWK(pub crypto.PublicKey, kid, alg string) (JWK, error) {
+	var k JWK
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		k = JWK{Kty: "RSA", N: b64.EncodeToString(key.N.Bytes()), E: b64.EncodeToString(big.NewInt(int64(key.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		if curveByName(key.Curve.Params().Name) == nil {
+			return JWK{}, ErrUnsupportedKey
+		}
+		point, err := key.Bytes()
+		if err != nil {
+			return JWK{}, err
+		}
+		size := (len(point) - 1) / 2
+		k = JWK{Kty: "EC", Crv: key.Curve.Params().Name, X: b64.EncodeToString(point[1 : 1+size]), Y: b64.EncodeToString(point[1+size:])}
+	case ed25519.PublicKey:
+		k = JWK{Kty: "OKP", Crv: "Ed25519", X: b64.EncodeToString(key)}
+	default:
+		return JWK{}, ErrUnsupportedKey
+	}
+	k.Use = "sig"
+	k.Alg = alg
+	k.Kid = kid
+	if k.Kid == "" {
+		k.Kid = k.Thumbprint()
+	}
+	return k, nil
+}
+
+// Thumbprint returns the base64url-encoded RFC 7638 SHA-256 thumbprint of the key.
+func (k JWK) Thumbprint() string {
+	var members string
+	switch k.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	default:
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, k.Crv, k.Kty, k.X)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return b64.EncodeToString(sum[:])
+}
+
+// PublicKey returns the Go public key described by the JWK.
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA exponent: %w", err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		curve := curveByName(k.Crv)
+		if curve == nil {
+			return nil, fmt.Errorf("%w: curve %q", ErrUnsupportedKey, k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC x coordinate: %w", err)
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC y coordinate: %w", err)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC key")
+		}
+		// ParseUncompressedPublicKey rejects points that are not on the curve
+		point := append(append([]byte{4}, x...), y...)
+		key, err := ecdsa.ParseUncompressedPublicKey(curve, point)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC key: %w", err)
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("%w: curve %q", ErrUnsupportedKey, k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("%w: kty %q", ErrUnsupportedKey, k.Kty)
+	}
+}
+
+// curveByName maps a JWK "crv" value to an elliptic curve.
+func curveByName(name string) elliptic.Curve {
+	switch name {
+	case "P-256":
+		return elliptic.P256()
+	case "P-384":
+		return elliptic.P384()
+	case "P-521":
+		return elliptic.P521()
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,80 @@
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+)
+
+func TestJWK_RoundTrip(t *testing.T) {
+	for _, alg := range []string{RS256, ES256, ES384, ES512, EdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			key := generateKey(t, alg)
+			jwk, err := NewJWK(key.Public(), "", alg)
+			testza.AssertNoError(t, err)
+			testza.AssertEqual(t, "sig", jwk.Use)
+			testza.AssertEqual(t, jwk.Thumbprint(), jwk.Kid)
+
+			data, err := json.Marshal(JWKS{Keys: []JWK{jwk}})
+			testza.AssertNoError(t, err)
+			set, err := ParseJWKS(data)
+			testza.AssertNoError(t, err)
+			testza.AssertEqual(t, 1, len(set.Keys))
+
+			pub, err := set.Keys[0].PublicKey()
+			testza.AssertNoError(t, err)
+			testza.AssertTrue(t, pub.(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()))
+		})
+	}
+}
+
+func TestJWK_Thumbprint(t *testing.T) {
+	// Example key from RFC 7638 section 3.1
+	k := JWK{
+		Kty: "RSA",
+		E:   "AQAB",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn6" +
+			"4tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91Cb" +
+			"OpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+	}
+	testza.AssertEqual(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", k.Thumbprint())
+}
+
+func TestJWK_PublicKeyErrors(t *testing.T) {
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testza.AssertNoError(t, err)
+	valid, err := NewJWK(&ec.PublicKey, "k", ES256)
+	testza.AssertNoError(t, err)
+
+	offCurve := valid
+	offCurve.Y = valid.X
+	wrongCurve := valid
+	wrongCurve.Crv = "P-384"
+
+	tests := map[string]JWK{
+		"unknown kty":      {Kty: "oct"},
+		"unknown curve":    {Kty: "EC", Crv: "secp256k1"},
+		"point off curve":  offCurve,
+		"curve size":       wrongCurve,
+		"short Ed25519":    {Kty: "OKP", Crv: "Ed25519", X: "AAAA"},
+		"X25519 key":       {Kty: "OKP", Crv: "X25519", X: valid.X},
+		"empty RSA":        {Kty: "RSA", E: "AQAB"},
+		"bad RSA exponent": {Kty: "RSA", N: valid.X, E: "AQ"},
+	}
+	for name, k := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := k.PublicKey()
+			testza.AssertNotNil(t, err)
+		})
+	}
+}
+
+func TestParseJWKS_Invalid(t *testing.T) {
+	_, err := ParseJWKS([]byte("not json"))
+	testza.AssertNotNil(t, err)
+}
@@ -0,0 +1,331 @@
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256" // register SHA-256 for crypto.Hash
+	_ "crypto/sha512" // register SHA-384 and SHA-512 for crypto.Hash
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Supported signature algorithms (RFC 7518, RFC 8037).
+const (
+	RS256 = "RS256"
+	RS384 = "RS384"
+	RS512 = "RS512"
+	PS256 = "PS256"
+	PS384 = "PS384"
+	PS512 = "PS512"
+	ES256 = "ES256"
+	ES384 = "ES384"
+	ES512 = "ES512"
+	EdDSA = "EdDSA"
+)
+
+// Token validation errors.
+var (
+	ErrMalformed        = errors.New("malformed token")
+	ErrUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	ErrUnknownKey       = errors.New("no matching key")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpired          = errors.New("token expired")
+	ErrNotYetValid      = errors.New("token not yet valid")
+	ErrInvalidIssuer    = errors.New("invalid issuer")
+	ErrInvalidAudience  = errors.New("invalid audience")
+)
+
+// Header is the JOSE header of a signed token.
+type Header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Claims are the decoded claims of a token.
+type Claims map[string]interface{}
+
+// Token is a parsed, not yet verified, compact JWS.
+type Token struct {
+	Header Header
+	Claims Claims
+
+	signingInput string
+	signature    []byte
+}
+
+// algorithm describes how an "alg" value signs and which keys it accepts.
+type algorithm struct {
+	hash crypto.Hash
+	kty  string
+	crv  string // required curve for EC and OKP keys
+	pss  bool
+}
+
+var algorithms = map[string]algorithm{
+	RS256: {hash: crypto.SHA256, kty: "RSA"},
+	RS384: {hash: crypto.SHA384, kty: "RSA"},
+	RS512: {hash: crypto.SHA512, kty: "RSA"},
+	PS256: {hash: crypto.SHA256, kty: "RSA", pss: true},
+	PS384: {hash: crypto.SHA384, kty: "RSA", pss: true},
+	PS512: {hash: crypto.SHA512, kty: "RSA", pss: true},
+	ES256: {hash: crypto.SHA256, kty: "EC", crv: "P-256"},
+	ES384: {hash: crypto.SHA384, kty: "EC", crv: "P-384"},
+	ES512: {hash: crypto.SHA512, kty: "EC", crv: "P-521"},
+	EdDSA: {kty: "OKP", crv: "Ed25519"},
+}
+
+// Sign serializes claims and signs them with key (an *rsa.PrivateKey, *ecdsa.PrivateKey or
+// ed25519.PrivateKey) using alg, returning a compact JWS with typ "JWT".
+func Sign(claims interface{}, key crypto.PrivateKey, alg, kid string) (string, error) {
+	a, ok := algorithms[alg]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedAlg, alg)
+	}
+	header, err := json.Marshal(Header{Alg: alg, Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if a.kty != "RSA" {
+			return "", fmt.Errorf("%w: %s with RSA key", ErrUnsupportedAlg, alg)
+		}
+		digest := hashOf(a.hash, signingInput)
+		if a.pss {
+			signature, err = rsa.SignPSS(rand.Reader, k, a.hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, k, a.hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		if a.kty != "EC" || k.Curve.Params().Name != a.crv {
+			return "", fmt.Errorf("%w: %s with %s key", ErrUnsupportedAlg, alg, k.Curve.Params().Name)
+		}
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, hashOf(a.hash, signingInput))
+		if err == nil {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			signature = make([]byte, 2*size)
+			r.FillBytes(signature[:size])
+			s.FillBytes(signature[size:])
+		}
+	case ed25519.PrivateKey:
+		if a.kty != "OKP" {
+			return "", fmt.Errorf("%w: %s with Ed25519 key", ErrUnsupportedAlg, alg)
+		}
+		signature = ed25519.Sign(k, []byte(signingInput))
+	default:
+		return "", ErrUnsupportedKey
+	}
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + b64.EncodeToString(signature), nil
+}
+
+// Parse decodes a compact JWS without verifying it.
+func Parse(token string) (*Token, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	header, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	t := &Token{signingInput: parts[0] + "." + parts[1], signature: signature}
+	if err := json.Unmarshal(header, &t.Header); err != nil {
+		return nil, ErrMalformed
+	}
+	if err := json.Unmarshal(payload, &t.Claims); err != nil || t.Claims == nil {
+		return nil, ErrMalformed
+	}
+	return t, nil
+}
+
+// Verify parses token and checks its signature against the keys of set. The key is selected by
+// "kid" when the token has one; otherwise every key compatible with the algorithm is tried.
+// Claims are not validated, see Claims.Validate.
+func Verify(token string, set *JWKS) (*Token, error) {
+	t, err := Parse(token)
+	if err != nil {
+		return nil, err
+	}
+	a, ok := algorithms[t.Header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAlg, t.Header.Alg)
+	}
+
+	tried := false
+	for _, k := range set.Keys {
+		if t.Header.Kid != "" && k.Kid != t.Header.Kid {
+			continue
+		}
+		if k.Kty != a.kty || (a.crv != "" && k.Crv != a.crv) || (k.Alg != "" && k.Alg != t.Header.Alg) || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		pub, err := k.PublicKey()
+		if err != nil {
+			continue
+		}
+		tried = true
+		if t.verify(a, pub) {
+			return t, nil
+		}
+	}
+	if !tried {
+		return nil, ErrUnknownKey
+	}
+	return nil, ErrInvalidSignature
+}
+
+// verify checks the token signature with pub.
+func (t *Token) verify(a algorithm, pub crypto.PublicKey) bool {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		digest := hashOf(a.hash, t.signingInput)
+		if a.pss {
+			return rsa.VerifyPSS(k, a.hash, digest, t.signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+		return rsa.VerifyPKCS1v15(k, a.hash, digest, t.signature) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		return ecdsa.Verify(k, hashOf(a.hash, t.signingInput), r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, []byte(t.signingInput), t.signature)
+	default:
+		return false
+	}
+}
+
+func hashOf(h crypto.Hash, input string) []byte {
+	hasher := h.New()
+	hasher.Write([]byte(input))
+	return hasher.Sum(nil)
+}
+
+// Expected describes the registered claims a token must carry.
+type Expected struct {
+	// Issuer is the required "iss"; empty skips the check.
+	Issuer string
+	// Audience must be one of the token's "aud" values; empty skips the check.
+	Audience string
+	// Now is the validation time; zero means time.Now.
+	Now time.Time
+	// Leeway tolerates clock skew for "exp" and "nbf".
+	Leeway time.Duration
+	// RequireExpiry rejects tokens without "exp".
+	RequireExpiry bool
+}
+
+// Validate checks iss, aud, exp and nbf against e.
+func (c Claims) Validate(e Expected) error {
+	now := e.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if e.Issuer != "" && c.String("iss") != e.Issuer {
+		return ErrInvalidIssuer
+	}
+	if e.Audience != "" && !contains(c.Strings("aud"), e.Audience) {
+		return ErrInvalidAudience
+	}
+	if exp, ok := c.Time("exp"); ok {
+		if !now.Before(exp.Add(e.Leeway)) {
+			return ErrExpired
+		}
+	} else if e.RequireExpiry {
+		return ErrExpired
+	}
+	if nbf, ok := c.Time("nbf"); ok && now.Add(e.Leeway).Before(nbf) {
+		return ErrNotYetValid
+	}
+	return nil
+}
+
+// String returns a string claim, or "" when it is missing or not a string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim holding a string or an array of strings (like "aud" or "groups").
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	case []string:
+		return v
+	default:
+		return nil
+	}
+}
+
+// Time returns a NumericDate claim such as "exp".
+func (c Claims) Time(name string) (time.Time, bool) {
+	var seconds float64
+	switch v := c[name].(type) {
+	case float64:
+		seconds = v
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		seconds = f
+	case int64:
+		seconds = float64(v)
+	case int:
+		seconds = float64(v)
+	default:
+		return time.Time{}, false
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9)), true
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
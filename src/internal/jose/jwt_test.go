@@ -0,0 +1,184 @@
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+)
+
+func generateKey(t *testing.T, alg string) crypto.Signer {
+	t.Helper()
+	var (
+		key crypto.Signer
+		err error
+	)
+	switch alg {
+	case ES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ES384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case ES512:
+		key, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case EdDSA:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	testza.AssertNoError(t, err)
+	return key
+}
+
+func keySet(t *testing.T, key crypto.Signer, kid, alg string) *JWKS {
+	t.Helper()
+	jwk, err := NewJWK(key.Public(), kid, alg)
+	testza.AssertNoError(t, err)
+	return &JWKS{Keys: []JWK{jwk}}
+}
+
+func TestSignVerify_AllAlgorithms(t *testing.T) {
+	rsaKey := generateKey(t, RS256)
+	for _, alg := range []string{RS256, RS384, RS512, PS256, PS384, PS512, ES256, ES384, ES512, EdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			key := rsaKey
+			if !strings.HasPrefix(alg, "RS") && !strings.HasPrefix(alg, "PS") {
+				key = generateKey(t, alg)
+			}
+			token, err := Sign(Claims{"sub": "user-1"}, key, alg, "k1")
+			testza.AssertNoError(t, err)
+
+			parsed, err := Verify(token, keySet(t, key, "k1", alg))
+			testza.AssertNoError(t, err)
+			testza.AssertEqual(t, alg, parsed.Header.Alg)
+			testza.AssertEqual(t, "k1", parsed.Header.Kid)
+			testza.AssertEqual(t, "user-1", parsed.Claims.String("sub"))
+		})
+	}
+}
+
+func TestSign_KeyMismatch(t *testing.T) {
+	_, err := Sign(Claims{}, generateKey(t, ES256), RS256, "")
+	testza.AssertErrorIs(t, err, ErrUnsupportedAlg)
+
+	_, err = Sign(Claims{}, generateKey(t, ES256), ES384, "")
+	testza.AssertErrorIs(t, err, ErrUnsupportedAlg)
+
+	_, err = Sign(Claims{}, generateKey(t, RS256), "HS256", "")
+	testza.AssertErrorIs(t, err, ErrUnsupportedAlg)
+}
+
+func TestVerify_Rejects(t *testing.T) {
+	key := generateKey(t, ES256)
+	set := keySet(t, key, "k1", ES256)
+	token, err := Sign(Claims{"sub": "user-1"}, key, ES256, "k1")
+	testza.AssertNoError(t, err)
+	parts := strings.Split(token, ".")
+
+	t.Run("tampered payload", func(t *testing.T) {
+		payload := b64.EncodeToString([]byte(`{"sub":"admin"}`))
+		_, err := Verify(parts[0]+"."+payload+"."+parts[2], set)
+		testza.AssertErrorIs(t, err, ErrInvalidSignature)
+	})
+
+	t.Run("other key", func(t *testing.T) {
+		_, err := Verify(token, keySet(t, generateKey(t, ES256), "k1", ES256))
+		testza.AssertErrorIs(t, err, ErrInvalidSignature)
+	})
+
+	t.Run("unknown kid", func(t *testing.T) {
+		_, err := Verify(token, keySet(t, key, "k2", ES256))
+		testza.AssertErrorIs(t, err, ErrUnknownKey)
+	})
+
+	t.Run("alg none", func(t *testing.T) {
+		header := b64.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`))
+		_, err := Verify(header+"."+parts[1]+".", set)
+		testza.AssertErrorIs(t, err, ErrUnsupportedAlg)
+	})
+
+	t.Run("key restricted to another alg", func(t *testing.T) {
+		rsaKey := generateKey(t, RS256)
+		signed, err := Sign(Claims{}, rsaKey, PS256, "")
+		testza.AssertNoError(t, err)
+		_, err = Verify(signed, keySet(t, rsaKey, "", RS256))
+		testza.AssertErrorIs(t, err, ErrUnknownKey)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, bad := range []string{"", "a.b", "a.b.c.d", "!.!.!", parts[0] + ".bm90IGpzb24." + parts[2]} {
+			_, err := Verify(bad, set)
+			testza.AssertErrorIs(t, err, ErrMalformed)
+		}
+	})
+}
+
+func TestVerify_WithoutKid(t *testing.T) {
+	key := generateKey(t, EdDSA)
+	token, err := Sign(Claims{"sub": "user-1"}, key, EdDSA, "")
+	testza.AssertNoError(t, err)
+
+	set := keySet(t, generateKey(t, EdDSA), "old", "")
+	set.Keys = append(set.Keys, keySet(t, key, "new", "").Keys...)
+	_, err = Verify(token, set)
+	testza.AssertNoError(t, err)
+}
+
+func TestClaims_Validate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	claims := Claims{
+		"iss": "https://idp.example.com",
+		"aud": []interface{}{"stargate", "other"},
+		"exp": float64(now.Add(time.Minute).Unix()),
+		"nbf": float64(now.Add(-time.Minute).Unix()),
+	}
+	expected := Expected{Issuer: "https://idp.example.com", Audience: "stargate", Now: now, RequireExpiry: true}
+	testza.AssertNoError(t, claims.Validate(expected))
+
+	e := expected
+	e.Issuer = "https://evil.example.com"
+	testza.AssertErrorIs(t, claims.Validate(e), ErrInvalidIssuer)
+
+	e = expected
+	e.Audience = "someone-else"
+	testza.AssertErrorIs(t, claims.Validate(e), ErrInvalidAudience)
+
+	e = expected
+	e.Now = now.Add(2 * time.Minute)
+	testza.AssertErrorIs(t, claims.Validate(e), ErrExpired)
+	e.Leeway = 2 * time.Minute
+	testza.AssertNoError(t, claims.Validate(e))
+
+	e = expected
+	e.Now = now.Add(-2 * time.Minute)
+	testza.AssertErrorIs(t, claims.Validate(e), ErrNotYetValid)
+
+	noExpiry := Claims{"iss": "https://idp.example.com", "aud": "stargate"}
+	testza.AssertErrorIs(t, noExpiry.Validate(expected), ErrExpired)
+	expected.RequireExpiry = false
+	testza.AssertNoError(t, noExpiry.Validate(expected))
+}
+
+func TestClaims_Accessors(t *testing.T) {
+	var claims Claims
+	testza.AssertNoError(t, json.Unmarshal([]byte(`{"sub":"u","groups":["a",1,"b"],"role":"admin","exp":1700000000.5,"n":3}`), &claims))
+
+	testza.AssertEqual(t, "u", claims.String("sub"))
+	testza.AssertEqual(t, "", claims.String("n"))
+	testza.AssertEqual(t, []string{"a", "b"}, claims.Strings("groups"))
+	testza.AssertEqual(t, []string{"admin"}, claims.Strings("role"))
+	testza.AssertNil(t, claims.Strings("missing"))
+
+	exp, ok := claims.Time("exp")
+	testza.AssertTrue(t, ok)
+	testza.AssertEqual(t, int64(1700000000), exp.Unix())
+	_, ok = claims.Time("sub")
+	testza.AssertFalse(t, ok)
+}
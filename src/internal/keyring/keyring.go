@@ -0,0 +1,247 @@
+// Package keyring holds the keys Stargate signs tokens with. The first key signs; the others are
+// still published so tokens signed before a rotation keep verifying until they expire.
+package keyring
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/soulteary/stargate/src/internal/jose"
+)
+
+// DefaultAlgorithm is used for generated keys.
+const DefaultAlgorithm = jose.ES256
+
+// Algorithms lists the algorithms keys can be generated for.
+var Algorithms = []string{jose.ES256, jose.EdDSA, jose.RS256}
+
+// ErrNoKeys is returned when signing with an empty key ring.
+var ErrNoKeys = errors.New("no signing key")
+
+// Key is a private signing key.
+type Key struct {
+	// ID is the "kid" of tokens signed with the key: the RFC 7638 thumbprint of its public key.
+	ID        string
+	Algorithm string
+	Signer    crypto.Signer
+	// JWK is the public key as published in the JWKS.
+	JWK jose.JWK
+}
+
+// NewKey wraps signer for use with alg.
+func NewKey(signer crypto.Signer, alg string) (*Key, error) {
+	jwk, err := jose.NewJWK(signer.Public(), "", alg)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{ID: jwk.Kid, Algorithm: alg, Signer: signer, JWK: jwk}, nil
+}
+
+// Generate creates a new key for alg (ES256, EdDSA or RS256).
+func Generate(alg string) (*Key, error) {
+	var (
+		signer crypto.Signer
+		err    error
+	)
+	switch alg {
+	case jose.ES256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jose.EdDSA:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case jose.RS256:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("%w: %q", jose.ErrUnsupportedAlg, alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(signer, alg)
+}
+
+// ParsePEM parses a PEM-encoded private key (PKCS #8, SEC 1 EC or PKCS #1 RSA). The algorithm
+// follows from the key: ES256/ES384/ES512 for P-256/P-384/P-521, EdDSA for Ed25519, RS256 for RSA.
+func ParsePEM(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var (
+		parsed interface{}
+		err    error
+	)
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	switch k := parsed.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return NewKey(k, jose.ES256)
+		case elliptic.P384():
+			return NewKey(k, jose.ES384)
+		case elliptic.P521():
+			return NewKey(k, jose.ES512)
+		}
+	case ed25519.PrivateKey:
+		return NewKey(k, jose.EdDSA)
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return NewKey(k, jose.RS256)
+	}
+	return nil, jose.ErrUnsupportedKey
+}
+
+// LoadFile reads a PEM private key from path.
+func LoadFile(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// MarshalPEM encodes the private key as PKCS #8 PEM.
+func (k *Key) MarshalPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.Signer)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// KeyRing is a set of signing keys. It is safe for concurrent use.
+type KeyRing struct {
+	mu   sync.RWMutex
+	keys []*Key
+	// retain is how many previous keys Rotate keeps published.
+	retain int
+}
+
+// New creates a key ring; keys[0] signs. Rotate keeps one previous key.
+func New(keys ...*Key) *KeyRing {
+	return &KeyRing{keys: keys, retain: 1}
+}
+
+// Active returns the signing key, or nil when the ring is empty.
+func (r *KeyRing) Active() *Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.keys) == 0 {
+		return nil
+	}
+	return r.keys[0]
+}
+
+// Sign signs claims with the active key.
+func (r *KeyRing) Sign(claims interface{}) (string, error) {
+	key := r.Active()
+	if key == nil {
+		return "", ErrNoKeys
+	}
+	return jose.Sign(claims, key.Signer, key.Algorithm, key.ID)
+}
+
+// JWKS returns the public keys of the ring, active key first.
+func (r *KeyRing) JWKS() *jose.JWKS {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	set := &jose.JWKS{Keys: make([]jose.JWK, 0, len(r.keys))}
+	for _, k := range r.keys {
+		set.Keys = append(set.Keys, k.JWK)
+	}
+	return set
+}
+
+// Algorithms returns the distinct algorithms of the ring's keys.
+func (r *KeyRing) Algorithms() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var algs []string
+	seen := map[string]bool{}
+	for _, k := range r.keys {
+		if !seen[k.Algorithm] {
+			seen[k.Algorithm] = true
+			algs = append(algs, k.Algorithm)
+		}
+	}
+	return algs
+}
+
+// Rotate makes key the signing key. The previous signing key stays published; older ones are dropped.
+func (r *KeyRing) Rotate(key *Key) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := append([]*Key{key}, r.keys...)
+	if len(keys) > r.retain+1 {
+		keys = keys[:r.retain+1]
+	}
+	r.keys = keys
+}
+
+// StartRotation generates a new alg key every interval until ctx is done. With an interval at least
+// as long as the lifetime of the tokens signed, the retained previous key covers every live token.
+func (r *KeyRing) StartRotation(ctx context.Context, interval time.Duration, alg string, onError func(error)) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				key, err := Generate(alg)
+				if err != nil {
+					if onError != nil {
+						onError(err)
+					}
+					continue
+				}
+				r.Rotate(key)
+			}
+		}
+	}()
+}
+
+var ring *KeyRing
+
+// Init sets the key ring used to sign tokens; nil disables token signing.
+func Init(r *KeyRing) {
+	ring = r
+}
+
+// Get returns the key ring, or nil when no feature needs signing keys.
+func Get() *KeyRing {
+	return ring
+}
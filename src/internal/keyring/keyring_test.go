@@ -0,0 +1,152 @@
+package keyring
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+
+	"github.com/soulteary/stargate/src/internal/jose"
+)
+
+func TestGenerate(t *testing.T) {
+	for _, alg := range Algorithms {
+		t.Run(alg, func(t *testing.T) {
+			key, err := Generate(alg)
+			testza.AssertNoError(t, err)
+			testza.AssertEqual(t, alg, key.Algorithm)
+			testza.AssertEqual(t, key.JWK.Thumbprint(), key.ID)
+
+			ring := New(key)
+			token, err := ring.Sign(jose.Claims{"sub": "user-1"})
+			testza.AssertNoError(t, err)
+			parsed, err := jose.Verify(token, ring.JWKS())
+			testza.AssertNoError(t, err)
+			testza.AssertEqual(t, key.ID, parsed.Header.Kid)
+		})
+	}
+
+	_, err := Generate("HS256")
+	testza.AssertErrorIs(t, err, jose.ErrUnsupportedAlg)
+}
+
+func TestParsePEM(t *testing.T) {
+	for _, alg := range Algorithms {
+		t.Run(alg, func(t *testing.T) {
+			key, err := Generate(alg)
+			testza.AssertNoError(t, err)
+			data, err := key.MarshalPEM()
+			testza.AssertNoError(t, err)
+
+			parsed, err := ParsePEM(data)
+			testza.AssertNoError(t, err)
+			testza.AssertEqual(t, alg, parsed.Algorithm)
+			testza.AssertEqual(t, key.ID, parsed.ID)
+		})
+	}
+
+	t.Run("SEC 1 EC key", func(t *testing.T) {
+		ec, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		testza.AssertNoError(t, err)
+		der, err := x509.MarshalECPrivateKey(ec)
+		testza.AssertNoError(t, err)
+		key, err := ParsePEM(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+		testza.AssertNoError(t, err)
+		testza.AssertEqual(t, jose.ES384, key.Algorithm)
+	})
+
+	t.Run("short RSA key", func(t *testing.T) {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		testza.AssertNoError(t, err)
+		_, err = ParsePEM(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+		testza.AssertNotNil(t, err)
+	})
+
+	t.Run("not PEM", func(t *testing.T) {
+		_, err := ParsePEM([]byte("not a key"))
+		testza.AssertNotNil(t, err)
+	})
+}
+
+func TestLoadFile(t *testing.T) {
+	key, err := Generate(jose.EdDSA)
+	testza.AssertNoError(t, err)
+	data, err := key.MarshalPEM()
+	testza.AssertNoError(t, err)
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	testza.AssertNoError(t, os.WriteFile(path, data, 0o600))
+
+	loaded, err := LoadFile(path)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, key.ID, loaded.ID)
+
+	_, err = LoadFile(filepath.Join(t.TempDir(), "missing.pem"))
+	testza.AssertNotNil(t, err)
+}
+
+func TestKeyRing_Rotate(t *testing.T) {
+	first, err := Generate(jose.ES256)
+	testza.AssertNoError(t, err)
+	ring := New(first)
+	oldToken, err := ring.Sign(jose.Claims{"sub": "user-1"})
+	testza.AssertNoError(t, err)
+
+	second, err := Generate(jose.EdDSA)
+	testza.AssertNoError(t, err)
+	ring.Rotate(second)
+	testza.AssertEqual(t, second, ring.Active())
+	testza.AssertEqual(t, []string{jose.EdDSA, jose.ES256}, ring.Algorithms())
+
+	// Tokens signed before the rotation still verify
+	_, err = jose.Verify(oldToken, ring.JWKS())
+	testza.AssertNoError(t, err)
+
+	// Only one previous key is kept
+	third, err := Generate(jose.ES256)
+	testza.AssertNoError(t, err)
+	ring.Rotate(third)
+	testza.AssertEqual(t, 2, len(ring.JWKS().Keys))
+	_, err = jose.Verify(oldToken, ring.JWKS())
+	testza.AssertErrorIs(t, err, jose.ErrUnknownKey)
+}
+
+func TestKeyRing_StartRotation(t *testing.T) {
+	first, err := Generate(jose.ES256)
+	testza.AssertNoError(t, err)
+	ring := New(first)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ring.StartRotation(ctx, 10*time.Millisecond, jose.ES256, nil)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for ring.Active() == first && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	testza.AssertNotEqual(t, first.ID, ring.Active().ID)
+}
+
+func TestKeyRing_Empty(t *testing.T) {
+	ring := New()
+	testza.AssertNil(t, ring.Active())
+	_, err := ring.Sign(jose.Claims{})
+	testza.AssertErrorIs(t, err, ErrNoKeys)
+	testza.AssertEqual(t, 0, len(ring.JWKS().Keys))
+}
+
+func TestInitGet(t *testing.T) {
+	t.Cleanup(func() { Init(nil) })
+	testza.AssertNil(t, Get())
+	ring := New()
+	Init(ring)
+	testza.AssertEqual(t, ring, Get())
+}
@@ -25,6 +25,15 @@ var (
 
 	// AuthRefreshDuration measures auth refresh operation duration
 	AuthRefreshDuration *prometheus.HistogramVec
+
+	// RateLimitTotal counts requests rejected by rate limiting and lockouts started
+	RateLimitTotal *prometheus.CounterVec
+
+	// PolicyDeniedTotal counts /_auth requests refused by the access policy
+	PolicyDeniedTotal *prometheus.CounterVec
+
+	// IDPTokensTotal counts token requests to the OpenID Connect provider
+	IDPTokensTotal *prometheus.CounterVec
 )
 
 func init() {
@@ -51,6 +60,21 @@ func Init() {
 		Labels("result").
 		Buckets(metricskit.HTTPDurationBuckets()).
 		BuildVec()
+
+	RateLimitTotal = Registry.Counter("rate_limit_total").
+		Help("Total number of rate limit events (blocked requests and lockouts)").
+		Labels("scope", "event").
+		BuildVec()
+
+	PolicyDeniedTotal = Registry.Counter("policy_denied_total").
+		Help("Total number of requests denied by the access policy").
+		Labels("reason").
+		BuildVec()
+
+	IDPTokensTotal = Registry.Counter("idp_tokens_total").
+		Help("Total number of OpenID Connect provider token requests").
+		Labels("client", "result").
+		BuildVec()
 }
 
 // RecordAuthRequest records an authentication request
@@ -83,3 +107,18 @@ func RecordAuthRefresh(result string, duration time.Duration) {
 	AuthRefreshTotal.WithLabelValues(result).Inc()
 	AuthRefreshDuration.WithLabelValues(result).Observe(duration.Seconds())
 }
+
+// RecordRateLimit records a rate limit event: "blocked" for a rejected request, "lockout" for a new lockout
+func RecordRateLimit(scope, event string) {
+	RateLimitTotal.WithLabelValues(scope, event).Inc()
+}
+
+// RecordPolicyDenied records a request denied by the access policy; reason is the unmet requirement
+func RecordPolicyDenied(reason string) {
+	PolicyDeniedTotal.WithLabelValues(reason).Inc()
+}
+
+// RecordIDPToken records a token request from an OpenID Connect client; result is "success" or the OAuth error code
+func RecordIDPToken(client, result string) {
+	IDPTokensTotal.WithLabelValues(client, result).Inc()
+}
@@ -24,6 +24,9 @@ func TestInit_RegistersMetrics(t *testing.T) {
 	if AuthRefreshDuration == nil {
 		t.Error("AuthRefreshDuration must not be nil after init")
 	}
+	if RateLimitTotal == nil {
+		t.Error("RateLimitTotal must not be nil after init")
+	}
 }
 
 func TestRecordAuthRequest_DoesNotPanic(t *testing.T) {
@@ -52,3 +55,18 @@ func TestRecordAuthRefresh_DoesNotPanic(t *testing.T) {
 	RecordAuthRefresh("success", 50*time.Millisecond)
 	RecordAuthRefresh("skipped", 0)
 }
+
+func TestRecordRateLimit_DoesNotPanic(t *testing.T) {
+	RecordRateLimit("login", "blocked")
+	RecordRateLimit("send", "lockout")
+}
+
+func TestRecordPolicyDenied_DoesNotPanic(t *testing.T) {
+	RecordPolicyDenied("role")
+	RecordPolicyDenied("denied")
+}
+
+func TestRecordIDPToken_DoesNotPanic(t *testing.T) {
+	RecordIDPToken("wiki", "success")
+	RecordIDPToken("wiki", "invalid_grant")
+}
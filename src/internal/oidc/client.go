@@ -0,0 +1,351 @@
+// Package oidc implements an OpenID Connect relying party: authorization code flow with PKCE
+// against an upstream identity provider, with ID tokens validated against the provider's JWKS.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/jose"
+)
+
+const (
+	// DefaultGroupsClaim is the ID token claim mapped to the session scopes.
+	DefaultGroupsClaim = "groups"
+	// clockSkew tolerates clock differences between Stargate and the provider.
+	clockSkew = time.Minute
+	// keysMaxAge is how long a fetched JWKS is used before it is fetched again.
+	keysMaxAge = time.Hour
+	// keysMinRefresh limits JWKS refetches triggered by unknown key IDs.
+	keysMinRefresh = time.Minute
+	// maxResponseSize limits provider responses.
+	maxResponseSize = 1 << 20
+)
+
+// Errors returned by the client.
+var (
+	ErrDiscovery     = errors.New("oidc discovery failed")
+	ErrTokenExchange = errors.New("oidc token exchange failed")
+	ErrInvalidToken  = errors.New("invalid id token")
+)
+
+// Config configures a Client.
+type Config struct {
+	// Issuer is the provider issuer URL; discovery is read from {Issuer}/.well-known/openid-configuration.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes requested from the provider; "openid" is always included.
+	Scopes []string
+	// GroupsClaim is the claim holding the user's groups (default "groups").
+	GroupsClaim string
+	// HTTPClient is used for provider requests (default: 10 second timeout).
+	HTTPClient *http.Client
+}
+
+// Discovery is the subset of the provider metadata the client uses.
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint,omitempty"`
+}
+
+// Identity is the user described by a validated ID token.
+type Identity struct {
+	Subject string
+	// Email is empty when the provider marks it as not verified.
+	Email  string
+	Name   string
+	Groups []string
+	AMR    []string
+	Claims jose.Claims
+}
+
+// Client is an OpenID Connect relying party for one provider.
+// Discovery and keys are fetched lazily and cached, so Stargate starts even when the provider is down.
+type Client struct {
+	cfg  Config
+	http *http.Client
+	now  func() time.Time
+
+	mu          sync.Mutex
+	discovery   *Discovery
+	keys        *jose.JWKS
+	keysFetched time.Time
+}
+
+// NewClient creates a client for the provider described by cfg.
+func NewClient(cfg Config) *Client {
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = DefaultGroupsClaim
+	}
+	hasOpenID := false
+	for _, s := range cfg.Scopes {
+		hasOpenID = hasOpenID || s == "openid"
+	}
+	if !hasOpenID {
+		cfg.Scopes = append([]string{"openid"}, cfg.Scopes...)
+	}
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Client{cfg: cfg, http: httpClient, now: time.Now}
+}
+
+// ClientID returns the configured client ID.
+func (c *Client) ClientID() string {
+	return c.cfg.ClientID
+}
+
+// Discover returns the provider metadata, fetching it on first use.
+func (c *Client) Discover(ctx context.Context) (*Discovery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.discovery != nil {
+		return c.discovery, nil
+	}
+
+	d := &Discovery{}
+	if err := c.getJSON(ctx, c.cfg.Issuer+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != c.cfg.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q does not match %q", ErrDiscovery, d.Issuer, c.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: incomplete provider metadata", ErrDiscovery)
+	}
+	c.discovery = d
+	return d, nil
+}
+
+// AuthCodeURL returns the provider authorization URL for an authorization code request with
+// PKCE (S256). The caller keeps state, nonce and the code verifier until the callback.
+func (c *Client) AuthCodeURL(ctx context.Context, redirectURI, state, nonce, verifier string) (string, error) {
+	d, err := c.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid authorization endpoint", ErrDiscovery)
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", c.cfg.ClientID)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("scope", strings.Join(c.cfg.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", CodeChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// tokenResponse is the token endpoint response (RFC 6749 section 5).
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	TokenType        string `json:"token_type"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange redeems an authorization code and returns the identity from the validated ID token.
+// redirectURI and verifier must be the values used for AuthCodeURL; nonce must match the token.
+func (c *Client) Exchange(ctx context.Context, code, redirectURI, verifier, nonce string) (*Identity, error) {
+	d, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("code_verifier", verifier)
+	if c.cfg.ClientSecret == "" {
+		// Public client: PKCE alone proves the code belongs to us
+		form.Set("client_id", c.cfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenExchange, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.cfg.ClientSecret != "" {
+		// client_secret_basic: credentials are form-encoded before base64 (RFC 6749 section 2.3.1)
+		req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.cfg.ClientSecret))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenExchange, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	tr := &tokenResponse{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(tr); err != nil {
+		return nil, fmt.Errorf("%w: status %d", ErrTokenExchange, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return nil, fmt.Errorf("%w: %s %s", ErrTokenExchange, tr.Error, tr.ErrorDescription)
+	}
+	if tr.IDToken == "" {
+		return nil, fmt.Errorf("%w: no id_token in response", ErrTokenExchange)
+	}
+
+	claims, err := c.VerifyIDToken(ctx, tr.IDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return c.identity(claims), nil
+}
+
+// VerifyIDToken checks the signature of an ID token against the provider JWKS and validates
+// iss, aud, azp, exp, nbf and nonce.
+func (c *Client) VerifyIDToken(ctx context.Context, raw, nonce string) (jose.Claims, error) {
+	d, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := c.keySet(ctx, d.JWKSURI, false)
+	if err != nil {
+		return nil, err
+	}
+	token, err := jose.Verify(raw, keys)
+	if errors.Is(err, jose.ErrUnknownKey) {
+		// The provider may have rotated its keys since the last fetch
+		if keys, err = c.keySet(ctx, d.JWKSURI, true); err != nil {
+			return nil, err
+		}
+		token, err = jose.Verify(raw, keys)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	claims := token.Claims
+	if err := claims.Validate(jose.Expected{
+		Issuer:        d.Issuer,
+		Audience:      c.cfg.ClientID,
+		Now:           c.now(),
+		Leeway:        clockSkew,
+		RequireExpiry: true,
+	}); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if aud := claims.Strings("aud"); len(aud) > 1 && claims.String("azp") != c.cfg.ClientID {
+		return nil, fmt.Errorf("%w: azp does not match client", ErrInvalidToken)
+	}
+	if claims.String("nonce") != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+	if claims.String("sub") == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// identity maps ID token claims to an Identity.
+func (c *Client) identity(claims jose.Claims) *Identity {
+	id := &Identity{
+		Subject: claims.String("sub"),
+		Name:    claims.String("name"),
+		Groups:  claims.Strings(c.cfg.GroupsClaim),
+		AMR:     claims.Strings("amr"),
+		Claims:  claims,
+	}
+	if id.Name == "" {
+		id.Name = claims.String("preferred_username")
+	}
+	if verified, ok := claims["email_verified"].(bool); !ok || verified {
+		id.Email = claims.String("email")
+	}
+	return id
+}
+
+// keySet returns the provider keys, fetching them when missing, stale or when refresh is
+// requested (at most once per keysMinRefresh).
+func (c *Client) keySet(ctx context.Context, jwksURI string, refresh bool) (*jose.JWKS, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	age := now.Sub(c.keysFetched)
+	if c.keys != nil && age < keysMaxAge && (!refresh || age < keysMinRefresh) {
+		return c.keys, nil
+	}
+
+	keys := &jose.JWKS{}
+	if err := c.getJSON(ctx, jwksURI, keys); err != nil {
+		if c.keys != nil {
+			// Keep using the previous keys while the provider is unreachable
+			return c.keys, nil
+		}
+		return nil, fmt.Errorf("%w: fetching JWKS: %v", ErrInvalidToken, err)
+	}
+	c.keys = keys
+	c.keysFetched = now
+	return keys, nil
+}
+
+// getJSON fetches a JSON document from the provider.
+func (c *Client) getJSON(ctx context.Context, rawURL string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, rawURL)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+}
+
+var client *Client
+
+// Init sets the client used by the login handlers; nil disables OIDC login.
+func Init(c *Client) {
+	client = c
+}
+
+// Get returns the OIDC client, or nil when OIDC login is disabled.
+func Get() *Client {
+	return client
+}
+
+// NewFromConfig builds the client from OIDC_* settings. It returns nil when OIDC_ENABLED is false.
+func NewFromConfig() *Client {
+	if !config.OIDCEnabled.ToBool() {
+		return nil
+	}
+	return NewClient(Config{
+		Issuer:       config.OIDCIssuerURL.String(),
+		ClientID:     config.OIDCClientID.String(),
+		ClientSecret: config.OIDCClientSecret.String(),
+		Scopes:       config.OIDCScopes.ToList(),
+		GroupsClaim:  config.OIDCGroupsClaim.String(),
+	})
+}
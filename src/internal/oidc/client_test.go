@@ -0,0 +1,237 @@
+package oidc
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+
+	"github.com/soulteary/stargate/src/internal/config"
+	"github.com/soulteary/stargate/src/internal/oidc/oidctest"
+)
+
+const testRedirectURI = "https://auth.example.com/_oidc/callback"
+
+func newTestProvider(t *testing.T, clientSecret string) (*oidctest.Server, *Client) {
+	t.Helper()
+	idp := oidctest.NewServer("stargate", clientSecret)
+	t.Cleanup(idp.Close)
+	client := NewClient(Config{
+		Issuer:       idp.Issuer() + "/",
+		ClientID:     "stargate",
+		ClientSecret: clientSecret,
+		Scopes:       []string{"profile", "email"},
+	})
+	return idp, client
+}
+
+// login runs the authorization code flow against idp and returns the authorization code.
+func login(t *testing.T, idp *oidctest.Server, client *Client, nonce, verifier string) string {
+	t.Helper()
+	authURL, err := client.AuthCodeURL(context.Background(), testRedirectURI, "state-1", nonce, verifier)
+	testza.AssertNoError(t, err)
+
+	location, err := idp.Authorize(authURL)
+	testza.AssertNoError(t, err)
+	back, err := url.Parse(location)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "state-1", back.Query().Get("state"))
+	return back.Query().Get("code")
+}
+
+func TestNewClient_AddsOpenIDScope(t *testing.T) {
+	c := NewClient(Config{Issuer: "https://idp.example.com/", Scopes: []string{"email"}})
+	testza.AssertEqual(t, []string{"openid", "email"}, c.cfg.Scopes)
+	testza.AssertEqual(t, "https://idp.example.com", c.cfg.Issuer)
+	testza.AssertEqual(t, DefaultGroupsClaim, c.cfg.GroupsClaim)
+
+	c = NewClient(Config{Scopes: []string{"email", "openid"}})
+	testza.AssertEqual(t, []string{"email", "openid"}, c.cfg.Scopes)
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp, client := newTestProvider(t, "secret")
+
+	authURL, err := client.AuthCodeURL(context.Background(), testRedirectURI, "state-1", "nonce-1", "verifier-1")
+	testza.AssertNoError(t, err)
+
+	u, err := url.Parse(authURL)
+	testza.AssertNoError(t, err)
+	q := u.Query()
+	testza.AssertEqual(t, idp.Issuer()+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	testza.AssertEqual(t, "code", q.Get("response_type"))
+	testza.AssertEqual(t, "stargate", q.Get("client_id"))
+	testza.AssertEqual(t, "openid profile email", q.Get("scope"))
+	testza.AssertEqual(t, "nonce-1", q.Get("nonce"))
+	testza.AssertEqual(t, "S256", q.Get("code_challenge_method"))
+	testza.AssertEqual(t, CodeChallenge("verifier-1"), q.Get("code_challenge"))
+}
+
+func TestExchange(t *testing.T) {
+	idp, client := newTestProvider(t, "secret")
+	idp.SetClaims(map[string]interface{}{
+		"sub":            "user-42",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+		"groups":         []string{"admin", "dev"},
+		"amr":            []string{"pwd", "otp"},
+	})
+
+	code := login(t, idp, client, "nonce-1", "verifier-1")
+	identity, err := client.Exchange(context.Background(), code, testRedirectURI, "verifier-1", "nonce-1")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "user-42", identity.Subject)
+	testza.AssertEqual(t, "alice@example.com", identity.Email)
+	testza.AssertEqual(t, "Alice", identity.Name)
+	testza.AssertEqual(t, []string{"admin", "dev"}, identity.Groups)
+	testza.AssertEqual(t, []string{"pwd", "otp"}, identity.AMR)
+
+	// Codes are single use
+	_, err = client.Exchange(context.Background(), code, testRedirectURI, "verifier-1", "nonce-1")
+	testza.AssertErrorIs(t, err, ErrTokenExchange)
+}
+
+func TestExchange_PublicClient(t *testing.T) {
+	idp, client := newTestProvider(t, "")
+
+	code := login(t, idp, client, "nonce-1", "verifier-1")
+	identity, err := client.Exchange(context.Background(), code, testRedirectURI, "verifier-1", "nonce-1")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "user-1", identity.Subject)
+}
+
+func TestExchange_Rejects(t *testing.T) {
+	t.Run("wrong PKCE verifier", func(t *testing.T) {
+		idp, client := newTestProvider(t, "secret")
+		code := login(t, idp, client, "nonce-1", "verifier-1")
+		_, err := client.Exchange(context.Background(), code, testRedirectURI, "verifier-2", "nonce-1")
+		testza.AssertErrorIs(t, err, ErrTokenExchange)
+	})
+
+	t.Run("wrong client secret", func(t *testing.T) {
+		idp, client := newTestProvider(t, "secret")
+		client.cfg.ClientSecret = "guess"
+		code := login(t, idp, client, "nonce-1", "verifier-1")
+		_, err := client.Exchange(context.Background(), code, testRedirectURI, "verifier-1", "nonce-1")
+		testza.AssertErrorIs(t, err, ErrTokenExchange)
+	})
+
+	t.Run("nonce mismatch", func(t *testing.T) {
+		idp, client := newTestProvider(t, "secret")
+		code := login(t, idp, client, "nonce-1", "verifier-1")
+		_, err := client.Exchange(context.Background(), code, testRedirectURI, "verifier-1", "nonce-2")
+		testza.AssertErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("unverified email is dropped", func(t *testing.T) {
+		idp, client := newTestProvider(t, "secret")
+		idp.SetClaims(map[string]interface{}{"sub": "user-1", "email": "alice@example.com", "email_verified": false, "preferred_username": "alice"})
+		code := login(t, idp, client, "nonce-1", "verifier-1")
+		identity, err := client.Exchange(context.Background(), code, testRedirectURI, "verifier-1", "nonce-1")
+		testza.AssertNoError(t, err)
+		testza.AssertEqual(t, "", identity.Email)
+		testza.AssertEqual(t, "alice", identity.Name)
+	})
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp, client := newTestProvider(t, "secret")
+	now := time.Now()
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   idp.Issuer(),
+			"aud":   "stargate",
+			"sub":   "user-1",
+			"nonce": "n",
+			"exp":   now.Add(time.Minute).Unix(),
+		}
+	}
+
+	_, err := client.VerifyIDToken(context.Background(), idp.SignIDToken(valid()), "n")
+	testza.AssertNoError(t, err)
+
+	tests := map[string]func(map[string]interface{}){
+		"wrong issuer":         func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"wrong audience":       func(c map[string]interface{}) { c["aud"] = "other-client" },
+		"expired":              func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() },
+		"no expiry":            func(c map[string]interface{}) { delete(c, "exp") },
+		"not yet valid":        func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() },
+		"missing subject":      func(c map[string]interface{}) { delete(c, "sub") },
+		"azp for other client": func(c map[string]interface{}) { c["aud"] = []string{"stargate", "other"}; c["azp"] = "other" },
+		"multiple aud, no azp": func(c map[string]interface{}) { c["aud"] = []string{"stargate", "other"} },
+		"nonce missing":        func(c map[string]interface{}) { delete(c, "nonce") },
+	}
+	for name, mutate := range tests {
+		t.Run(name, func(t *testing.T) {
+			claims := valid()
+			mutate(claims)
+			_, err := client.VerifyIDToken(context.Background(), idp.SignIDToken(claims), "n")
+			testza.AssertErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+}
+
+func TestVerifyIDToken_KeyRotation(t *testing.T) {
+	idp, client := newTestProvider(t, "secret")
+	now := time.Now()
+	client.now = func() time.Time { return now }
+	claims := func() map[string]interface{} {
+		return map[string]interface{}{"iss": idp.Issuer(), "aud": "stargate", "sub": "user-1", "exp": now.Add(time.Minute).Unix()}
+	}
+
+	_, err := client.VerifyIDToken(context.Background(), idp.SignIDToken(claims()), "")
+	testza.AssertNoError(t, err)
+
+	// Refetches are rate limited: a rotation right after the keys were fetched is not picked up yet
+	idp.RotateKey()
+	_, err = client.VerifyIDToken(context.Background(), idp.SignIDToken(claims()), "")
+	testza.AssertErrorIs(t, err, ErrInvalidToken)
+
+	// Once keysMinRefresh has passed, a token signed with an unknown key triggers a JWKS refetch
+	now = now.Add(keysMinRefresh)
+	_, err = client.VerifyIDToken(context.Background(), idp.SignIDToken(claims()), "")
+	testza.AssertNoError(t, err)
+}
+
+func TestDiscover_Errors(t *testing.T) {
+	idp, _ := newTestProvider(t, "secret")
+
+	// Issuer in the metadata must match the configured issuer
+	c := NewClient(Config{Issuer: idp.Issuer() + "/.well-known/..", ClientID: "stargate"})
+	_, err := c.Discover(context.Background())
+	testza.AssertErrorIs(t, err, ErrDiscovery)
+
+	c = NewClient(Config{Issuer: idp.Issuer() + "/missing", ClientID: "stargate"})
+	_, err = c.Discover(context.Background())
+	testza.AssertErrorIs(t, err, ErrDiscovery)
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// Example from RFC 7636 appendix B
+	testza.AssertEqual(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+
+	a, err := RandomToken()
+	testza.AssertNoError(t, err)
+	b, err := RandomToken()
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, 43, len(a))
+	testza.AssertNotEqual(t, a, b)
+}
+
+func TestNewFromConfig(t *testing.T) {
+	t.Cleanup(func() { Init(nil) })
+	original := config.OIDCEnabled.Value
+	t.Cleanup(func() { config.OIDCEnabled.Value = original })
+
+	config.OIDCEnabled.Value = "false"
+	testza.AssertNil(t, NewFromConfig())
+
+	config.OIDCEnabled.Value = "true"
+	client := NewFromConfig()
+	testza.AssertNotNil(t, client)
+	Init(client)
+	testza.AssertEqual(t, client, Get())
+}
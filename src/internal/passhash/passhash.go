@@ -0,0 +1,216 @@
+// Package passhash checks and creates password hashes in the PHC string format
+// ("$id$params$salt$hash") for argon2id, scrypt and PBKDF2-SHA256. Salts and hashes are base64
+// without padding, so hashes are case-sensitive.
+package passhash
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Algorithm names, as used in PASSWORDS and as the PHC identifiers.
+const (
+	Argon2id     = "argon2id"
+	Scrypt       = "scrypt"
+	PBKDF2SHA256 = "pbkdf2-sha256"
+)
+
+// Parameters of new hashes: the RFC 9106 second recommendation for argon2id, and the OWASP
+// Password Storage Cheat Sheet minimums for scrypt and PBKDF2-SHA256.
+const (
+	argon2Memory     = 64 * 1024 // KiB
+	argon2Time       = 3
+	argon2Threads    = 4
+	scryptLogN       = 17
+	scryptR          = 8
+	scryptP          = 1
+	pbkdf2Iterations = 600000
+
+	saltLength = 16
+	keyLength  = 32
+)
+
+// ErrInvalidHash is returned for strings that are not a PHC hash of the expected algorithm.
+var ErrInvalidHash = errors.New("invalid password hash")
+
+var encoding = base64.RawStdEncoding
+
+// Algorithms lists the supported algorithms.
+var Algorithms = []string{Argon2id, Scrypt, PBKDF2SHA256}
+
+// Detect returns the algorithm of a PHC hash ("$argon2id$...").
+func Detect(hash string) (string, bool) {
+	for _, algorithm := range Algorithms {
+		if strings.HasPrefix(hash, "$"+algorithm+"$") {
+			return algorithm, true
+		}
+	}
+	return "", false
+}
+
+// phc is a parsed PHC string.
+type phc struct {
+	id      string
+	version string
+	params  map[string]int
+	salt    []byte
+	hash    []byte
+}
+
+// parse splits a PHC string of algorithm. The version field is only present for argon2.
+func parse(algorithm, s string) (*phc, error) {
+	fields := strings.Split(s, "$")
+	if len(fields) < 5 || fields[0] != "" || fields[1] != algorithm {
+		return nil, ErrInvalidHash
+	}
+	p := &phc{id: fields[1], params: map[string]int{}}
+	rest := fields[2:]
+	if strings.HasPrefix(rest[0], "v=") {
+		p.version = strings.TrimPrefix(rest[0], "v=")
+		rest = rest[1:]
+	}
+	if len(rest) != 3 {
+		return nil, ErrInvalidHash
+	}
+	for _, param := range strings.Split(rest[0], ",") {
+		name, value, ok := strings.Cut(param, "=")
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil || n <= 0 {
+			return nil, ErrInvalidHash
+		}
+		p.params[name] = n
+	}
+	var err error
+	if p.salt, err = encoding.DecodeString(rest[1]); err != nil || len(p.salt) == 0 {
+		return nil, ErrInvalidHash
+	}
+	if p.hash, err = encoding.DecodeString(rest[2]); err != nil || len(p.hash) == 0 {
+		return nil, ErrInvalidHash
+	}
+	return p, nil
+}
+
+// validate checks the parameters of p.
+func (p *phc) validate() error {
+	ok := false
+	switch p.id {
+	case Argon2id:
+		ok = p.version == strconv.Itoa(argon2.Version) && p.params["m"] > 0 && p.params["t"] > 0 && p.params["p"] > 0 && p.params["p"] <= 255
+	case Scrypt:
+		ok = p.params["ln"] > 0 && p.params["ln"] <= 30 && p.params["r"] > 0 && p.params["p"] > 0
+	case PBKDF2SHA256:
+		ok = p.params["i"] > 0
+	}
+	if !ok {
+		return ErrInvalidHash
+	}
+	return nil
+}
+
+// derive computes the key of password with the parameters and salt of p, sized like p.hash.
+func (p *phc) derive(password string) ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	keyLen := len(p.hash)
+	switch p.id {
+	case Argon2id:
+		return argon2.IDKey([]byte(password), p.salt, uint32(p.params["t"]), uint32(p.params["m"]), uint8(p.params["p"]), uint32(keyLen)), nil
+	case Scrypt:
+		return scrypt.Key([]byte(password), p.salt, 1<<p.params["ln"], p.params["r"], p.params["p"], keyLen)
+	default:
+		return pbkdf2.Key(sha256.New, password, p.salt, p.params["i"], keyLen)
+	}
+}
+
+// Validate reports whether hash is a well-formed PHC hash of algorithm, without deriving a key.
+func Validate(algorithm, hash string) error {
+	p, err := parse(algorithm, hash)
+	if err != nil {
+		return err
+	}
+	return p.validate()
+}
+
+// Check reports whether password matches the PHC hash of algorithm. The derived key is compared
+// in constant time.
+func Check(algorithm, hash, password string) bool {
+	p, err := parse(algorithm, hash)
+	if err != nil {
+		return false
+	}
+	key, err := p.derive(password)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, p.hash) == 1
+}
+
+// Hash returns a PHC hash of password with algorithm, a fresh salt and the default parameters.
+func Hash(algorithm, password string) (string, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	var p *phc
+	switch algorithm {
+	case Argon2id:
+		p = &phc{id: Argon2id, version: strconv.Itoa(argon2.Version), params: map[string]int{"m": argon2Memory, "t": argon2Time, "p": argon2Threads}}
+	case Scrypt:
+		p = &phc{id: Scrypt, params: map[string]int{"ln": scryptLogN, "r": scryptR, "p": scryptP}}
+	case PBKDF2SHA256:
+		p = &phc{id: PBKDF2SHA256, params: map[string]int{"i": pbkdf2Iterations}}
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	p.salt, p.hash = salt, make([]byte, keyLength)
+	key, err := p.derive(password)
+	if err != nil {
+		return "", err
+	}
+	p.hash = key
+	return p.String(), nil
+}
+
+// String formats p as a PHC string, with the parameters in the order of the algorithm's spec.
+func (p *phc) String() string {
+	var order []string
+	switch p.id {
+	case Argon2id:
+		order = []string{"m", "t", "p"}
+	case Scrypt:
+		order = []string{"ln", "r", "p"}
+	case PBKDF2SHA256:
+		order = []string{"i"}
+	}
+	params := make([]string, 0, len(order))
+	for _, name := range order {
+		params = append(params, name+"="+strconv.Itoa(p.params[name]))
+	}
+	fields := []string{"", p.id}
+	if p.version != "" {
+		fields = append(fields, "v="+p.version)
+	}
+	fields = append(fields, strings.Join(params, ","), encoding.EncodeToString(p.salt), encoding.EncodeToString(p.hash))
+	return strings.Join(fields, "$")
+}
+
+// Resolver checks hashes of one algorithm. It implements the resolver interface of PASSWORDS.
+type Resolver struct {
+	Algorithm string
+}
+
+// Check reports whether password matches hash.
+func (r *Resolver) Check(hash, password string) bool {
+	return Check(r.Algorithm, hash, password)
+}
@@ -0,0 +1,81 @@
+package passhash
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+)
+
+// Hashes of "password", made with Python's hashlib for interoperability
+const (
+	testPBKDF2 = "$pbkdf2-sha256$i=1000$c3RhcmdhdGUtc2FsdC0wMQ$TGg6aCj1wliObuZrfw7kDKnORv5XTc9ZZ6QnanuK1oA"
+	testScrypt = "$scrypt$ln=10,r=8,p=1$c3RhcmdhdGUtc2FsdC0wMQ$pXMlByhsaxVem/vnEI5wfQ35bVjZy42mBz+vyGGVWhg"
+)
+
+func TestCheck_KnownHashes(t *testing.T) {
+	testza.AssertTrue(t, Check(PBKDF2SHA256, testPBKDF2, "password"))
+	testza.AssertFalse(t, Check(PBKDF2SHA256, testPBKDF2, "Password"))
+	testza.AssertTrue(t, Check(Scrypt, testScrypt, "password"))
+	testza.AssertFalse(t, Check(Scrypt, testScrypt, "PASSWORD"))
+
+	// The hash must be of the resolver's algorithm
+	testza.AssertFalse(t, Check(Scrypt, testPBKDF2, "password"))
+	testza.AssertTrue(t, (&Resolver{Algorithm: PBKDF2SHA256}).Check(testPBKDF2, "password"))
+}
+
+func TestHash(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		hash, err := Hash(algorithm, "correct horse")
+		testza.AssertNoError(t, err, algorithm)
+		testza.AssertTrue(t, strings.HasPrefix(hash, "$"+algorithm+"$"), hash)
+		testza.AssertNoError(t, Validate(algorithm, hash), algorithm)
+		testza.AssertTrue(t, Check(algorithm, hash, "correct horse"), algorithm)
+		testza.AssertFalse(t, Check(algorithm, hash, "correct horse "), algorithm)
+
+		again, err := Hash(algorithm, "correct horse")
+		testza.AssertNoError(t, err)
+		testza.AssertNotEqual(t, hash, again, "fresh salt")
+	}
+
+	hash, err := Hash(Argon2id, "x")
+	testza.AssertNoError(t, err)
+	testza.AssertTrue(t, strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=4$"), hash)
+
+	_, err = Hash("md5", "x")
+	testza.AssertNotNil(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	testza.AssertNoError(t, Validate(PBKDF2SHA256, testPBKDF2))
+	for _, hash := range []string{
+		"",
+		"pbkdf2-sha256$i=1000$c2FsdA$aGFzaA",
+		"$pbkdf2-sha256$i=1000$c2FsdA",
+		"$pbkdf2-sha256$i=0$c2FsdA$aGFzaA",
+		"$pbkdf2-sha256$i=x$c2FsdA$aGFzaA",
+		"$pbkdf2-sha256$n=1000$c2FsdA$aGFzaA",
+		"$pbkdf2-sha256$i=1000$!!$aGFzaA",
+		"$pbkdf2-sha256$i=1000$c2FsdA$",
+		"$scrypt$ln=10,r=8,p=1$c2FsdA$aGFzaA",
+	} {
+		testza.AssertErrorIs(t, Validate(PBKDF2SHA256, hash), ErrInvalidHash, hash)
+	}
+
+	testza.AssertNoError(t, Validate(Scrypt, testScrypt))
+	testza.AssertErrorIs(t, Validate(Scrypt, "$scrypt$ln=31,r=8,p=1$c2FsdA$aGFzaA"), ErrInvalidHash)
+	testza.AssertErrorIs(t, Validate(Argon2id, "$argon2id$v=16$m=65536,t=3,p=4$c2FsdA$aGFzaA"), ErrInvalidHash)
+	testza.AssertErrorIs(t, Validate(Argon2id, "$argon2id$m=65536,t=3,p=4$c2FsdA$aGFzaA"), ErrInvalidHash)
+	testza.AssertNoError(t, Validate(Argon2id, "$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$aGFzaA"))
+}
+
+func TestDetect(t *testing.T) {
+	algorithm, ok := Detect(testScrypt)
+	testza.AssertTrue(t, ok)
+	testza.AssertEqual(t, Scrypt, algorithm)
+
+	for _, hash := range []string{"", "$2y$10$abc", "argon2id$v=19", "$argon2$v=19$"} {
+		_, ok := Detect(hash)
+		testza.AssertFalse(t, ok, hash)
+	}
+}
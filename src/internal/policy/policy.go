@@ -0,0 +1,305 @@
+// Package policy implements the declarative per-host/per-path access policy evaluated by /_auth.
+//
+// A policy is an ordered list of rules. Each rule matches requests by host glob, path glob and
+// HTTP method; the first matching rule decides. A rule either makes the route public (no session
+// needed), denies it outright, or requires an authenticated session that satisfies its role,
+// scope, user ID and AMR requirements. Requests that match no rule fall back to the default action.
+package policy
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule actions.
+const (
+	// ActionAuthenticated requires an authenticated session meeting the rule's requirements.
+	ActionAuthenticated = "authenticated"
+	// ActionPublic lets the request through without a session.
+	ActionPublic = "public"
+	// ActionBypass is an alias of ActionPublic.
+	ActionBypass = "bypass"
+	// ActionDeny refuses the request even for authenticated users.
+	ActionDeny = "deny"
+)
+
+// Deny reasons reported by Decision.Reason.
+const (
+	ReasonDenied = "denied"
+	ReasonRole   = "role"
+	ReasonScope  = "scope"
+	ReasonUserID = "user_id"
+	ReasonAMR    = "amr"
+)
+
+// Rule maps hosts, paths and methods to an access requirement.
+//
+// Within a requirement list any entry is enough (the user has one of the roles, one of the
+// scopes, is one of the user IDs); across lists all requirements apply. Every listed AMR value
+// must be present in the session.
+type Rule struct {
+	Name    string   `yaml:"name" json:"name"`
+	Hosts   []string `yaml:"hosts" json:"hosts"`
+	Paths   []string `yaml:"paths" json:"paths"`
+	Methods []string `yaml:"methods" json:"methods"`
+	Action  string   `yaml:"action" json:"action"`
+	Roles   []string `yaml:"roles" json:"roles"`
+	Scopes  []string `yaml:"scopes" json:"scopes"`
+	UserIDs []string `yaml:"user_ids" json:"user_ids"`
+	AMR     []string `yaml:"amr" json:"amr"`
+
+	hosts []*regexp.Regexp
+	paths []*regexp.Regexp
+}
+
+// Policy is an ordered rule set with a default action for unmatched requests.
+type Policy struct {
+	DefaultAction string `yaml:"default_action" json:"default_action"`
+	Rules         []Rule `yaml:"rules" json:"rules"`
+}
+
+// Request is the forwarded request a policy is evaluated against.
+type Request struct {
+	Host   string
+	Path   string
+	Method string
+}
+
+// Subject is the authenticated user as stored in the session.
+type Subject struct {
+	UserID string
+	Role   string
+	Scopes []string
+	AMR    []string
+}
+
+// Decision is the outcome of evaluating a policy for an authenticated subject.
+type Decision struct {
+	// Allowed reports whether the request may proceed.
+	Allowed bool
+	// Rule is the name of the matching rule, or "" when the default action applied.
+	Rule string
+	// Reason is the requirement that was not met when the request is denied.
+	Reason string
+}
+
+// Parse parses and compiles a policy document. JSON is accepted as well, being valid YAML.
+func Parse(data []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadFile reads and parses the policy file at path.
+func LoadFile(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+	return Parse(data)
+}
+
+// compile normalizes actions and methods and compiles host and path globs.
+func (p *Policy) compile() error {
+	switch p.DefaultAction = strings.ToLower(strings.TrimSpace(p.DefaultAction)); p.DefaultAction {
+	case "":
+		p.DefaultAction = ActionAuthenticated
+	case ActionAuthenticated, ActionDeny:
+	default:
+		return fmt.Errorf("invalid policy default_action %q (must be %s or %s)", p.DefaultAction, ActionAuthenticated, ActionDeny)
+	}
+
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		switch r.Action = strings.ToLower(strings.TrimSpace(r.Action)); r.Action {
+		case "":
+			r.Action = ActionAuthenticated
+		case ActionBypass:
+			r.Action = ActionPublic
+		case ActionAuthenticated, ActionPublic, ActionDeny:
+		default:
+			return fmt.Errorf("policy rule %q: invalid action %q", r.Name, r.Action)
+		}
+		if r.Action != ActionAuthenticated && (len(r.Roles) > 0 || len(r.Scopes) > 0 || len(r.UserIDs) > 0 || len(r.AMR) > 0) {
+			return fmt.Errorf("policy rule %q: roles, scopes, user_ids and amr only apply to action %s", r.Name, ActionAuthenticated)
+		}
+
+		r.hosts = make([]*regexp.Regexp, 0, len(r.Hosts))
+		for _, host := range r.Hosts {
+			re, err := compileGlob(strings.ToLower(stripPort(strings.TrimSpace(host))))
+			if err != nil {
+				return fmt.Errorf("policy rule %q: invalid host %q: %w", r.Name, host, err)
+			}
+			r.hosts = append(r.hosts, re)
+		}
+		r.paths = make([]*regexp.Regexp, 0, len(r.Paths))
+		for _, path := range r.Paths {
+			re, err := compileGlob(strings.TrimSpace(path))
+			if err != nil {
+				return fmt.Errorf("policy rule %q: invalid path %q: %w", r.Name, path, err)
+			}
+			r.paths = append(r.paths, re)
+		}
+		for j, method := range r.Methods {
+			r.Methods[j] = strings.ToUpper(strings.TrimSpace(method))
+		}
+	}
+	return nil
+}
+
+// compileGlob converts a glob (* matches any run of characters, ? a single one) to an anchored regexp.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	return regexp.Compile("^" + strings.ReplaceAll(
+		strings.ReplaceAll(regexp.QuoteMeta(glob), "\\*", ".*"),
+		"\\?", ".",
+	) + "$")
+}
+
+// stripPort removes a trailing port from host, leaving bracketless IPv6 addresses intact.
+func stripPort(host string) string {
+	if strings.HasPrefix(host, "[") {
+		if end := strings.Index(host, "]"); end > 0 {
+			return host[1:end]
+		}
+		return host
+	}
+	if idx := strings.LastIndex(host, ":"); idx >= 0 && strings.Count(host, ":") == 1 {
+		return host[:idx]
+	}
+	return host
+}
+
+// Matches reports whether the rule applies to req. Empty hosts, paths or methods match anything.
+func (r *Rule) Matches(req Request) bool {
+	if len(r.hosts) > 0 && !matchAny(r.hosts, strings.ToLower(stripPort(req.Host))) {
+		return false
+	}
+	if len(r.paths) > 0 && !matchAny(r.paths, stripQuery(req.Path)) {
+		return false
+	}
+	if len(r.Methods) > 0 && !contains(r.Methods, strings.ToUpper(req.Method)) {
+		return false
+	}
+	return true
+}
+
+// stripQuery removes the query string and fragment from path.
+func stripQuery(path string) string {
+	if idx := strings.IndexAny(path, "?#"); idx >= 0 {
+		return path[:idx]
+	}
+	return path
+}
+
+func matchAny(patterns []*regexp.Regexp, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAny reports whether any value is in list.
+func containsAny(list, values []string) bool {
+	for _, v := range values {
+		if contains(list, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the first rule matching req, or nil when none does.
+func (p *Policy) Match(req Request) *Rule {
+	if p == nil {
+		return nil
+	}
+	for i := range p.Rules {
+		if p.Rules[i].Matches(req) {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+// IsPublic reports whether req may proceed without a session. A nil policy has no public routes.
+func (p *Policy) IsPublic(req Request) bool {
+	rule := p.Match(req)
+	return rule != nil && rule.Action == ActionPublic
+}
+
+// Authorize decides whether an authenticated subject may access req.
+// A nil policy allows every authenticated request.
+func (p *Policy) Authorize(req Request, s Subject) Decision {
+	if p == nil {
+		return Decision{Allowed: true}
+	}
+	rule := p.Match(req)
+	if rule == nil {
+		if p.DefaultAction == ActionDeny {
+			return Decision{Reason: ReasonDenied}
+		}
+		return Decision{Allowed: true}
+	}
+
+	d := Decision{Rule: rule.Name}
+	switch {
+	case rule.Action == ActionPublic:
+	case rule.Action == ActionDeny:
+		d.Reason = ReasonDenied
+	case len(rule.UserIDs) > 0 && !contains(rule.UserIDs, s.UserID):
+		d.Reason = ReasonUserID
+	case len(rule.Roles) > 0 && !contains(rule.Roles, s.Role):
+		d.Reason = ReasonRole
+	case len(rule.Scopes) > 0 && !containsAny(rule.Scopes, s.Scopes):
+		d.Reason = ReasonScope
+	case len(rule.AMR) > 0 && !containsAll(s.AMR, rule.AMR):
+		d.Reason = ReasonAMR
+	}
+	d.Allowed = d.Reason == ""
+	return d
+}
+
+// containsAll reports whether every value is in list.
+func containsAll(list, values []string) bool {
+	for _, v := range values {
+		if !contains(list, v) {
+			return false
+		}
+	}
+	return true
+}
+
+var current *Policy
+
+// Init sets the policy evaluated by /_auth; nil disables policy evaluation.
+func Init(p *Policy) {
+	current = p
+}
+
+// Get returns the active policy, or nil when no policy is configured.
+func Get() *Policy {
+	return current
+}
@@ -0,0 +1,187 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+)
+
+const testPolicy = `
+default_action: authenticated
+rules:
+  - name: health
+    paths: ["/healthz", "/static/*"]
+    action: bypass
+  - name: admin-api-writes
+    hosts: ["admin.example.com"]
+    paths: ["/api/*"]
+    methods: [post, delete]
+    roles: [admin]
+    scopes: ["admin:write", "admin"]
+    amr: [otp]
+  - name: admin
+    hosts: ["admin.example.com"]
+    roles: [admin, operator]
+  - name: reports
+    hosts: ["*.reports.example.com"]
+    user_ids: ["u-1", "u-2"]
+  - name: legacy
+    hosts: ["legacy.example.com"]
+    action: deny
+`
+
+func mustParse(t *testing.T, doc string) *Policy {
+	t.Helper()
+	p, err := Parse([]byte(doc))
+	testza.AssertNoError(t, err)
+	return p
+}
+
+func TestParse_Normalizes(t *testing.T) {
+	p := mustParse(t, testPolicy)
+
+	testza.AssertEqual(t, ActionAuthenticated, p.DefaultAction)
+	testza.AssertEqual(t, 5, len(p.Rules))
+	testza.AssertEqual(t, ActionPublic, p.Rules[0].Action)
+	testza.AssertEqual(t, ActionAuthenticated, p.Rules[1].Action)
+	testza.AssertEqual(t, []string{"POST", "DELETE"}, p.Rules[1].Methods)
+
+	// Unnamed rules get a positional name
+	p = mustParse(t, `rules: [{paths: ["/"]}]`)
+	testza.AssertEqual(t, "rule-1", p.Rules[0].Name)
+}
+
+func TestParse_JSON(t *testing.T) {
+	p := mustParse(t, `{"default_action": "deny", "rules": [{"name": "public", "paths": ["/"], "action": "public"}]}`)
+
+	testza.AssertEqual(t, ActionDeny, p.DefaultAction)
+	testza.AssertTrue(t, p.IsPublic(Request{Host: "app.example.com", Path: "/", Method: "GET"}))
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := map[string]string{
+		"syntax":                 "rules: [",
+		"default action":         "default_action: public",
+		"rule action":            "rules: [{action: allow}]",
+		"requirements on deny":   "rules: [{action: deny, roles: [admin]}]",
+		"requirements on public": "rules: [{action: public, amr: [otp]}]",
+		"rules not a list":       "rules: {name: x}",
+	}
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(doc))
+			testza.AssertNotNil(t, err)
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	testza.AssertNoError(t, os.WriteFile(path, []byte(testPolicy), 0o600))
+
+	p, err := LoadFile(path)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, 5, len(p.Rules))
+
+	_, err = LoadFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	testza.AssertNotNil(t, err)
+}
+
+func TestPolicy_Match(t *testing.T) {
+	p := mustParse(t, testPolicy)
+
+	tests := []struct {
+		name     string
+		req      Request
+		expected string
+	}{
+		{"path glob", Request{Host: "app.example.com", Path: "/static/app.js", Method: "GET"}, "health"},
+		{"query is ignored", Request{Host: "app.example.com", Path: "/healthz?full=1", Method: "GET"}, "health"},
+		{"method filter", Request{Host: "admin.example.com", Path: "/api/users", Method: "post"}, "admin-api-writes"},
+		{"method mismatch falls through", Request{Host: "admin.example.com", Path: "/api/users", Method: "GET"}, "admin"},
+		{"host is case-insensitive and port is ignored", Request{Host: "Admin.Example.com:8443", Path: "/", Method: "GET"}, "admin"},
+		{"host glob", Request{Host: "eu.reports.example.com", Path: "/", Method: "GET"}, "reports"},
+		{"host glob needs a subdomain", Request{Host: "reports.example.com", Path: "/", Method: "GET"}, ""},
+		{"no match", Request{Host: "app.example.com", Path: "/", Method: "GET"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := p.Match(tt.req)
+			if tt.expected == "" {
+				testza.AssertNil(t, rule)
+				return
+			}
+			testza.AssertNotNil(t, rule)
+			testza.AssertEqual(t, tt.expected, rule.Name)
+		})
+	}
+}
+
+func TestPolicy_Authorize(t *testing.T) {
+	p := mustParse(t, testPolicy)
+	adminWrite := Request{Host: "admin.example.com", Path: "/api/users", Method: "DELETE"}
+	admin := Request{Host: "admin.example.com", Path: "/", Method: "GET"}
+	reports := Request{Host: "eu.reports.example.com", Path: "/", Method: "GET"}
+
+	tests := []struct {
+		name    string
+		req     Request
+		subject Subject
+		allowed bool
+		reason  string
+	}{
+		{"all requirements met", adminWrite, Subject{Role: "admin", Scopes: []string{"read", "admin"}, AMR: []string{"sms", "otp"}}, true, ""},
+		{"wrong role", adminWrite, Subject{Role: "operator", Scopes: []string{"admin:write"}, AMR: []string{"otp"}}, false, ReasonRole},
+		{"missing scope", adminWrite, Subject{Role: "admin", Scopes: []string{"read"}, AMR: []string{"otp"}}, false, ReasonScope},
+		{"missing AMR", adminWrite, Subject{Role: "admin", Scopes: []string{"admin:write"}, AMR: []string{"sms"}}, false, ReasonAMR},
+		{"any listed role", admin, Subject{Role: "operator"}, true, ""},
+		{"no role", admin, Subject{UserID: "u-1"}, false, ReasonRole},
+		{"listed user", reports, Subject{UserID: "u-2"}, true, ""},
+		{"other user", reports, Subject{UserID: "u-3", Role: "admin"}, false, ReasonUserID},
+		{"deny rule", Request{Host: "legacy.example.com", Path: "/"}, Subject{Role: "admin"}, false, ReasonDenied},
+		{"public rule", Request{Host: "app.example.com", Path: "/healthz"}, Subject{}, true, ""},
+		{"default authenticated", Request{Host: "app.example.com", Path: "/"}, Subject{}, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := p.Authorize(tt.req, tt.subject)
+			testza.AssertEqual(t, tt.allowed, d.Allowed)
+			testza.AssertEqual(t, tt.reason, d.Reason)
+		})
+	}
+}
+
+func TestPolicy_DefaultDeny(t *testing.T) {
+	p := mustParse(t, `
+default_action: deny
+rules:
+  - hosts: ["app.example.com"]
+`)
+
+	testza.AssertTrue(t, p.Authorize(Request{Host: "app.example.com", Path: "/"}, Subject{}).Allowed)
+
+	d := p.Authorize(Request{Host: "other.example.com", Path: "/"}, Subject{Role: "admin"})
+	testza.AssertFalse(t, d.Allowed)
+	testza.AssertEqual(t, "", d.Rule)
+	testza.AssertEqual(t, ReasonDenied, d.Reason)
+}
+
+func TestPolicy_Nil(t *testing.T) {
+	var p *Policy
+	req := Request{Host: "app.example.com", Path: "/", Method: "GET"}
+
+	testza.AssertNil(t, p.Match(req))
+	testza.AssertFalse(t, p.IsPublic(req))
+	testza.AssertTrue(t, p.Authorize(req, Subject{}).Allowed)
+}
+
+func TestInitGet(t *testing.T) {
+	t.Cleanup(func() { Init(nil) })
+
+	testza.AssertNil(t, Get())
+	p := mustParse(t, testPolicy)
+	Init(p)
+	testza.AssertEqual(t, p, Get())
+}
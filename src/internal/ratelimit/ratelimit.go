@@ -0,0 +1,235 @@
+// Package ratelimit counts failed logins and code sends per client IP and per identifier,
+// and locks a key out for progressively longer periods once it exceeds its limit.
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/soulteary/stargate/src/internal/config"
+)
+
+// Scopes group counters by the action being limited.
+const (
+	ScopeLogin = "login"
+	ScopeSend  = "send"
+)
+
+// Key kinds: what a counter is keyed by.
+const (
+	KindIP         = "ip"
+	KindIdentifier = "identifier"
+)
+
+// Default policy values, used when the corresponding setting is empty or zero.
+const (
+	DefaultWindow     = 15 * time.Minute
+	DefaultLockout    = time.Minute
+	DefaultMaxLockout = time.Hour
+)
+
+// Key identifies one counter and the number of attempts it allows per window.
+type Key struct {
+	Scope string
+	Kind  string
+	Value string
+	// Max is the number of attempts allowed within the window; 0 disables the key.
+	Max int
+}
+
+// id returns the storage key. The value is hashed so identifiers (phone numbers,
+// email addresses) are not written to the store in clear text.
+func (k Key) id() string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(k.Value))))
+	return k.Scope + ":" + k.Kind + ":" + hex.EncodeToString(sum[:16])
+}
+
+// active reports whether the key should be counted.
+func (k Key) active() bool {
+	return k.Max > 0 && k.Value != ""
+}
+
+// Policy controls the counting window and lockout durations.
+type Policy struct {
+	// Window is the period over which attempts are counted.
+	Window time.Duration
+	// Lockout is the first lockout duration; each consecutive lockout doubles it.
+	Lockout time.Duration
+	// MaxLockout caps the lockout duration.
+	MaxLockout time.Duration
+}
+
+// lockoutFor returns the lockout duration for the nth consecutive lockout (n >= 1).
+func (p Policy) lockoutFor(n int64) time.Duration {
+	d := p.Lockout
+	for i := int64(1); i < n && d < p.MaxLockout; i++ {
+		d *= 2
+	}
+	if d > p.MaxLockout {
+		d = p.MaxLockout
+	}
+	return d
+}
+
+// Limiter applies a Policy to counters kept in a Store.
+//
+// For each key it keeps three counters: attempts in the current window, a lock while
+// the key is locked out, and the number of consecutive lockouts. The lockout count is
+// remembered for one window after a lock ends, so a key that keeps failing is locked
+// out for twice as long each time, up to MaxLockout.
+type Limiter struct {
+	store  Store
+	policy Policy
+}
+
+// New creates a limiter. Zero policy fields fall back to the defaults.
+func New(store Store, policy Policy) *Limiter {
+	if policy.Window <= 0 {
+		policy.Window = DefaultWindow
+	}
+	if policy.Lockout <= 0 {
+		policy.Lockout = DefaultLockout
+	}
+	if policy.MaxLockout < policy.Lockout {
+		policy.MaxLockout = policy.Lockout
+	}
+	return &Limiter{store: store, policy: policy}
+}
+
+// Check returns how long the most restrictive of keys is still locked out (0 when none is).
+func (l *Limiter) Check(ctx context.Context, keys ...Key) (time.Duration, error) {
+	var retryAfter time.Duration
+	for _, key := range keys {
+		if !key.active() {
+			continue
+		}
+		_, ttl, err := l.store.Get(ctx, "lock:"+key.id())
+		if err != nil {
+			return 0, err
+		}
+		if ttl > retryAfter {
+			retryAfter = ttl
+		}
+	}
+	return retryAfter, nil
+}
+
+// Record counts an attempt against keys. When a key reaches its limit it is locked out,
+// and Record returns the longest lockout started by this attempt (0 when none was).
+func (l *Limiter) Record(ctx context.Context, keys ...Key) (time.Duration, error) {
+	var lockout time.Duration
+	for _, key := range keys {
+		if !key.active() {
+			continue
+		}
+		id := key.id()
+		n, err := l.store.Incr(ctx, "count:"+id, l.policy.Window)
+		if err != nil {
+			return 0, err
+		}
+		if n < int64(key.Max) {
+			continue
+		}
+
+		strikes, _, err := l.store.Get(ctx, "strikes:"+id)
+		if err != nil {
+			return 0, err
+		}
+		strikes++
+		d := l.policy.lockoutFor(strikes)
+		if err := l.store.Set(ctx, "lock:"+id, 1, d); err != nil {
+			return 0, err
+		}
+		if err := l.store.Set(ctx, "strikes:"+id, strikes, d+l.policy.Window); err != nil {
+			return 0, err
+		}
+		if err := l.store.Delete(ctx, "count:"+id); err != nil {
+			return 0, err
+		}
+		if d > lockout {
+			lockout = d
+		}
+	}
+	return lockout, nil
+}
+
+// Reset clears the counters and lockout history of keys, e.g. after a successful login.
+func (l *Limiter) Reset(ctx context.Context, keys ...Key) error {
+	var ids []string
+	for _, key := range keys {
+		if key.Value == "" {
+			continue
+		}
+		id := key.id()
+		ids = append(ids, "count:"+id, "lock:"+id, "strikes:"+id)
+	}
+	return l.store.Delete(ctx, ids...)
+}
+
+var limiter *Limiter
+
+// Init sets the limiter used by the handlers; nil disables rate limiting.
+func Init(l *Limiter) {
+	limiter = l
+}
+
+// Get returns the limiter instance, or nil when rate limiting is disabled.
+func Get() *Limiter {
+	return limiter
+}
+
+// NewFromConfig builds the limiter selected by RATE_LIMIT_* settings.
+//
+// Parameters:
+//   - redisClient: the session Redis client (nil when session storage is in memory)
+//
+// Counters are kept in Redis when SESSION_STORAGE_ENABLED is on so limits hold across
+// replicas, and in memory otherwise. Redis keys share SESSION_STORAGE_REDIS_KEY_PREFIX with the
+// sessions. Returns nil when RATE_LIMIT_ENABLED is false.
+func NewFromConfig(redisClient *redis.Client) *Limiter {
+	if !config.RateLimitEnabled.ToBool() {
+		return nil
+	}
+
+	var store Store = NewMemoryStore()
+	if config.SessionStorageEnabled.ToBool() && redisClient != nil {
+		store = NewRedisStore(redisClient, config.SessionStorageRedisKeyPrefix.Value)
+	}
+	return New(store, PolicyFromConfig())
+}
+
+// PolicyFromConfig reads the policy from RATE_LIMIT_WINDOW, RATE_LIMIT_LOCKOUT and RATE_LIMIT_LOCKOUT_MAX.
+func PolicyFromConfig() Policy {
+	return Policy{
+		Window:     config.RateLimitWindow.ToDuration(),
+		Lockout:    config.RateLimitLockout.ToDuration(),
+		MaxLockout: config.RateLimitLockoutMax.ToDuration(),
+	}
+}
+
+// LoginKeys returns the login failure keys for a client IP and an optional identifier.
+func LoginKeys(ip, identifier string) []Key {
+	return []Key{LoginIPKey(ip), LoginIdentifierKey(identifier)}
+}
+
+// LoginIPKey returns the login failure key for a client IP (RATE_LIMIT_IP_MAX_FAILURES).
+func LoginIPKey(ip string) Key {
+	return Key{Scope: ScopeLogin, Kind: KindIP, Value: ip, Max: config.RateLimitIPMaxFailures.ToInt()}
+}
+
+// LoginIdentifierKey returns the login failure key for a phone number, email or user ID (RATE_LIMIT_MAX_FAILURES).
+func LoginIdentifierKey(identifier string) Key {
+	return Key{Scope: ScopeLogin, Kind: KindIdentifier, Value: identifier, Max: config.RateLimitMaxFailures.ToInt()}
+}
+
+// SendKeys returns the verification code send keys for a client IP and an identifier.
+func SendKeys(ip, identifier string) []Key {
+	return []Key{
+		{Scope: ScopeSend, Kind: KindIP, Value: ip, Max: config.RateLimitIPMaxSends.ToInt()},
+		{Scope: ScopeSend, Kind: KindIdentifier, Value: identifier, Max: config.RateLimitMaxSends.ToInt()},
+	}
+}
@@ -0,0 +1,240 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/redis/go-redis/v9"
+	"github.com/soulteary/stargate/src/internal/config"
+)
+
+// fakeClock returns a store whose clock is advanced by the returned function.
+func fakeClock() (*MemoryStore, func(time.Duration)) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	return store, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestMemoryStore_IncrKeepsExpiry(t *testing.T) {
+	store, advance := fakeClock()
+	ctx := context.Background()
+
+	n, err := store.Incr(ctx, "k", time.Minute)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, int64(1), n)
+
+	advance(40 * time.Second)
+	n, _ = store.Incr(ctx, "k", time.Minute)
+	testza.AssertEqual(t, int64(2), n)
+
+	value, ttl, err := store.Get(ctx, "k")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, int64(2), value)
+	testza.AssertEqual(t, 20*time.Second, ttl)
+
+	// The window started at the first increment
+	advance(20 * time.Second)
+	value, ttl, _ = store.Get(ctx, "k")
+	testza.AssertEqual(t, int64(0), value)
+	testza.AssertEqual(t, time.Duration(0), ttl)
+
+	n, _ = store.Incr(ctx, "k", time.Minute)
+	testza.AssertEqual(t, int64(1), n)
+}
+
+func TestMemoryStore_SetAndDelete(t *testing.T) {
+	store, advance := fakeClock()
+	ctx := context.Background()
+
+	testza.AssertNoError(t, store.Set(ctx, "a", 3, time.Minute))
+	testza.AssertNoError(t, store.Set(ctx, "b", 1, time.Minute))
+	value, _, _ := store.Get(ctx, "a")
+	testza.AssertEqual(t, int64(3), value)
+
+	testza.AssertNoError(t, store.Delete(ctx, "a", "missing"))
+	value, _, _ = store.Get(ctx, "a")
+	testza.AssertEqual(t, int64(0), value)
+
+	// Expired entries are swept on later writes
+	advance(2 * time.Minute)
+	testza.AssertNoError(t, store.Set(ctx, "c", 1, time.Minute))
+	testza.AssertEqual(t, 1, len(store.entries))
+}
+
+func TestPolicy_LockoutFor(t *testing.T) {
+	p := Policy{Lockout: time.Minute, MaxLockout: 10 * time.Minute}
+
+	testza.AssertEqual(t, time.Minute, p.lockoutFor(1))
+	testza.AssertEqual(t, 2*time.Minute, p.lockoutFor(2))
+	testza.AssertEqual(t, 8*time.Minute, p.lockoutFor(4))
+	testza.AssertEqual(t, 10*time.Minute, p.lockoutFor(5))
+	testza.AssertEqual(t, 10*time.Minute, p.lockoutFor(100))
+}
+
+func TestNew_Defaults(t *testing.T) {
+	l := New(NewMemoryStore(), Policy{})
+
+	testza.AssertEqual(t, DefaultWindow, l.policy.Window)
+	testza.AssertEqual(t, DefaultLockout, l.policy.Lockout)
+	testza.AssertEqual(t, DefaultLockout, l.policy.MaxLockout)
+}
+
+func TestLimiter_LocksOutAfterMax(t *testing.T) {
+	store, advance := fakeClock()
+	l := New(store, Policy{Window: 15 * time.Minute, Lockout: time.Minute, MaxLockout: time.Hour})
+	ctx := context.Background()
+	key := Key{Scope: ScopeLogin, Kind: KindIdentifier, Value: "user@example.com", Max: 3}
+
+	for i := 0; i < 2; i++ {
+		lockout, err := l.Record(ctx, key)
+		testza.AssertNoError(t, err)
+		testza.AssertEqual(t, time.Duration(0), lockout)
+	}
+	retryAfter, err := l.Check(ctx, key)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, time.Duration(0), retryAfter)
+
+	lockout, err := l.Record(ctx, key)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, time.Minute, lockout)
+
+	retryAfter, _ = l.Check(ctx, key)
+	testza.AssertEqual(t, time.Minute, retryAfter)
+
+	advance(time.Minute)
+	retryAfter, _ = l.Check(ctx, key)
+	testza.AssertEqual(t, time.Duration(0), retryAfter)
+}
+
+func TestLimiter_ProgressiveLockout(t *testing.T) {
+	store, advance := fakeClock()
+	l := New(store, Policy{Window: 15 * time.Minute, Lockout: time.Minute, MaxLockout: 3 * time.Minute})
+	ctx := context.Background()
+	key := Key{Scope: ScopeLogin, Kind: KindIP, Value: "203.0.113.7", Max: 2}
+
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}
+	for _, want := range expected {
+		_, _ = l.Record(ctx, key)
+		lockout, err := l.Record(ctx, key)
+		testza.AssertNoError(t, err)
+		testza.AssertEqual(t, want, lockout)
+		advance(lockout)
+	}
+
+	// A quiet window after the last lockout forgets the history
+	advance(15 * time.Minute)
+	_, _ = l.Record(ctx, key)
+	lockout, _ := l.Record(ctx, key)
+	testza.AssertEqual(t, time.Minute, lockout)
+}
+
+func TestLimiter_CheckReturnsLongestLock(t *testing.T) {
+	l := New(NewMemoryStore(), Policy{Lockout: time.Minute, MaxLockout: time.Hour})
+	ctx := context.Background()
+	ip := Key{Scope: ScopeLogin, Kind: KindIP, Value: "203.0.113.7", Max: 1}
+	user := Key{Scope: ScopeLogin, Kind: KindIdentifier, Value: "alice", Max: 1}
+
+	_, _ = l.Record(ctx, ip)
+	_, _ = l.Record(ctx, ip) // second lockout: 2m
+
+	retryAfter, err := l.Check(ctx, user, ip)
+	testza.AssertNoError(t, err)
+	testza.AssertTrue(t, retryAfter > time.Minute)
+
+	retryAfter, _ = l.Check(ctx, user)
+	testza.AssertEqual(t, time.Duration(0), retryAfter)
+}
+
+func TestLimiter_InactiveKeysAreIgnored(t *testing.T) {
+	store := NewMemoryStore()
+	l := New(store, Policy{})
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		lockout, err := l.Record(ctx,
+			Key{Scope: ScopeLogin, Kind: KindIdentifier, Value: "", Max: 1},
+			Key{Scope: ScopeLogin, Kind: KindIP, Value: "203.0.113.7", Max: 0},
+		)
+		testza.AssertNoError(t, err)
+		testza.AssertEqual(t, time.Duration(0), lockout)
+	}
+	testza.AssertEqual(t, 0, len(store.entries))
+}
+
+func TestLimiter_Reset(t *testing.T) {
+	l := New(NewMemoryStore(), Policy{Lockout: time.Minute, MaxLockout: time.Hour})
+	ctx := context.Background()
+	key := Key{Scope: ScopeLogin, Kind: KindIdentifier, Value: "alice", Max: 1}
+
+	_, _ = l.Record(ctx, key)
+	testza.AssertNoError(t, l.Reset(ctx, key))
+
+	retryAfter, _ := l.Check(ctx, key)
+	testza.AssertEqual(t, time.Duration(0), retryAfter)
+
+	// Lockout history is cleared too: the next lockout starts again at the base duration
+	lockout, _ := l.Record(ctx, key)
+	testza.AssertEqual(t, time.Minute, lockout)
+}
+
+func TestKey_IDDoesNotContainIdentifier(t *testing.T) {
+	a := Key{Scope: ScopeSend, Kind: KindIdentifier, Value: "Alice@Example.com"}
+	b := Key{Scope: ScopeSend, Kind: KindIdentifier, Value: "alice@example.com"}
+
+	testza.AssertFalse(t, strings.Contains(a.id(), "example"))
+	testza.AssertEqual(t, a.id(), b.id())
+	testza.AssertTrue(t, strings.HasPrefix(a.id(), "send:identifier:"))
+}
+
+// setRateLimitConfig sets rate limit settings for a test and restores them afterwards.
+func setRateLimitConfig(t *testing.T, enabled, window, lockout, lockoutMax string) {
+	t.Helper()
+	vars := []*config.EnvVariable{&config.RateLimitEnabled, &config.RateLimitWindow, &config.RateLimitLockout, &config.RateLimitLockoutMax}
+	values := []string{enabled, window, lockout, lockoutMax}
+	for i, v := range vars {
+		prev := v.Value
+		t.Cleanup(func() { v.Value = prev })
+		v.Value = values[i]
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		setRateLimitConfig(t, "false", "", "", "")
+		testza.AssertNil(t, NewFromConfig(nil))
+	})
+
+	t.Run("memory store with configured policy", func(t *testing.T) {
+		setRateLimitConfig(t, "true", "5m", "30s", "10m")
+
+		l := NewFromConfig(nil)
+		testza.AssertNotNil(t, l)
+		_, isMemory := l.store.(*MemoryStore)
+		testza.AssertTrue(t, isMemory)
+		testza.AssertEqual(t, Policy{Window: 5 * time.Minute, Lockout: 30 * time.Second, MaxLockout: 10 * time.Minute}, l.policy)
+	})
+
+	t.Run("redis store under the session key prefix", func(t *testing.T) {
+		setRateLimitConfig(t, "true", "", "", "")
+		for _, v := range []*config.EnvVariable{&config.SessionStorageEnabled, &config.SessionStorageRedisKeyPrefix} {
+			prev := v.Value
+			t.Cleanup(func() { v.Value = prev })
+		}
+		config.SessionStorageEnabled.Value = "true"
+		config.SessionStorageRedisKeyPrefix.Value = "tenant-a:"
+
+		// The client connects lazily, so no Redis server is needed here
+		client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"})
+		t.Cleanup(func() { _ = client.Close() })
+
+		l := NewFromConfig(client)
+		testza.AssertNotNil(t, l)
+		store, isRedis := l.store.(*RedisStore)
+		testza.AssertTrue(t, isRedis)
+		testza.AssertEqual(t, "tenant-a:ratelimit:", store.prefix)
+	})
+}
@@ -0,0 +1,180 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Store keeps expiring integer counters. Implementations must be safe for concurrent use.
+type Store interface {
+	// Incr increments key and returns the new value. A new key expires after ttl;
+	// incrementing an existing key keeps its expiry.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	// Get returns the value of key and its remaining time to live (0, 0 when missing).
+	Get(ctx context.Context, key string) (int64, time.Duration, error)
+	// Set stores value under key for ttl.
+	Set(ctx context.Context, key string, value int64, ttl time.Duration) error
+	// Delete removes keys; missing keys are ignored.
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// memoryEntry is a counter held by MemoryStore.
+type memoryEntry struct {
+	value   int64
+	expires time.Time
+}
+
+// memorySweepInterval bounds how often MemoryStore drops expired counters.
+const memorySweepInterval = time.Minute
+
+// MemoryStore is a process-local Store. Counters are not shared between replicas.
+type MemoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]memoryEntry), now: time.Now}
+}
+
+// Incr implements Store.
+func (s *MemoryStore) Incr(_ context.Context, key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+	entry, ok := s.entries[key]
+	if !ok || !now.Before(entry.expires) {
+		entry = memoryEntry{expires: now.Add(ttl)}
+	}
+	entry.value++
+	s.entries[key] = entry
+	return entry.value, nil
+}
+
+// Get implements Store.
+func (s *MemoryStore) Get(_ context.Context, key string) (int64, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	entry, ok := s.entries[key]
+	if !ok || !now.Before(entry.expires) {
+		return 0, 0, nil
+	}
+	return entry.value, entry.expires.Sub(now), nil
+}
+
+// Set implements Store.
+func (s *MemoryStore) Set(_ context.Context, key string, value int64, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+	s.entries[key] = memoryEntry{value: value, expires: now.Add(ttl)}
+	return nil
+}
+
+// Delete implements Store.
+func (s *MemoryStore) Delete(_ context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+// sweep drops expired entries at most once per memorySweepInterval. Callers hold s.mu.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < memorySweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, entry := range s.entries {
+		if !now.Before(entry.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// RedisKeyNamespace is appended to the Redis key prefix of a deployment to namespace its rate
+// limit counters.
+const RedisKeyNamespace = "ratelimit:"
+
+// incrScript increments a counter and sets its expiry only when the key is new, atomically.
+var incrScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then
+  redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// RedisStore keeps counters in Redis so limits hold across replicas.
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStore creates a store on client; keys are prefixed with keyPrefix followed by
+// RedisKeyNamespace, so deployments sharing a Redis with different prefixes keep separate counters.
+func NewRedisStore(client *redis.Client, keyPrefix string) *RedisStore {
+	return &RedisStore{client: client, prefix: keyPrefix + RedisKeyNamespace}
+}
+
+// Incr implements Store.
+func (s *RedisStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	return incrScript.Run(ctx, s.client, []string{s.prefix + key}, ttl.Milliseconds()).Int64()
+}
+
+// Get implements Store.
+func (s *RedisStore) Get(ctx context.Context, key string) (int64, time.Duration, error) {
+	pipe := s.client.Pipeline()
+	getCmd := pipe.Get(ctx, s.prefix+key)
+	ttlCmd := pipe.PTTL(ctx, s.prefix+key)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return 0, 0, err
+	}
+
+	value, err := getCmd.Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	ttl := ttlCmd.Val()
+	if ttl < 0 {
+		// -1 (no expiry) should not happen for counters written by this store; treat as expired
+		return 0, 0, nil
+	}
+	return value, ttl, nil
+}
+
+// Set implements Store.
+func (s *RedisStore) Set(ctx context.Context, key string, value int64, ttl time.Duration) error {
+	return s.client.Set(ctx, s.prefix+key, value, ttl).Err()
+}
+
+// Delete implements Store.
+func (s *RedisStore) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = s.prefix + key
+	}
+	return s.client.Del(ctx, prefixed...).Err()
+}
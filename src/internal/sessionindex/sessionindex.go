@@ -0,0 +1,336 @@
+// Package sessionindex keeps a per-user index of logged-in sessions, so users can see where they
+// are signed in and sign out other devices. The index lives next to the sessions in the session
+// storage; revoking a session deletes its data there, which logs it out on every domain.
+package sessionindex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// TouchInterval is how often the last access of a session is written back to the index.
+	TouchInterval = time.Minute
+	// MaxSessionsPerUser bounds the index; the least recently used sessions are forgotten first.
+	MaxSessionsPerUser = 50
+	// MaxUserAgentLength truncates stored user agents.
+	MaxUserAgentLength = 256
+
+	indexKeyPrefix = "session_user:"
+)
+
+// ErrNotFound is returned when revoking a session the user does not own.
+var ErrNotFound = errors.New("session not found")
+
+// Storage keeps the sessions and the index. The session storage (Redis) implements it.
+type Storage interface {
+	Get(key string) ([]byte, error)
+	Set(key string, val []byte, exp time.Duration) error
+	Delete(key string) error
+}
+
+// Handle returns the public name of session id. Session IDs are credentials, so listings and
+// revocations refer to sessions by handle instead.
+func Handle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:9])
+}
+
+// Session describes a logged-in session of a user.
+type Session struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastAccess time.Time `json:"last_access"`
+	IP         string    `json:"ip,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	AMR        []string  `json:"amr,omitempty"`
+}
+
+// Index records the sessions of each user.
+type Index struct {
+	storage Storage
+	// ttl is the session lifetime; the index of a user expires with their last session.
+	ttl time.Duration
+	now func() time.Time
+	// mu serializes updates of the per-user index within this instance.
+	mu sync.Mutex
+	// touched remembers when this instance last wrote the access time of a session, so /_auth
+	// does not read the index on every request.
+	touched map[string]time.Time
+}
+
+// New returns an index kept in storage, the storage of the sessions, whose lifetime is ttl.
+func New(storage Storage, ttl time.Duration) *Index {
+	return &Index{storage: storage, ttl: ttl, now: time.Now, touched: map[string]time.Time{}}
+}
+
+// Add records session s of userID, or refreshes it when it is already known (e.g. after a
+// step-up changed its AMR); the creation time of a known session is kept.
+func (x *Index) Add(userID string, s Session) error {
+	if userID == "" || s.ID == "" {
+		return nil
+	}
+	if len(s.UserAgent) > MaxUserAgentLength {
+		s.UserAgent = s.UserAgent[:MaxUserAgentLength]
+	}
+	now := x.now()
+	s.LastAccess = now
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	list, err := x.load(userID)
+	if err != nil {
+		return err
+	}
+	if i := find(list, s.ID); i >= 0 {
+		s.CreatedAt = list[i].CreatedAt
+		list[i] = s
+	} else {
+		if s.CreatedAt.IsZero() {
+			s.CreatedAt = now
+		}
+		list = append(list, s)
+	}
+	x.touched[s.ID] = now
+	return x.save(userID, list)
+}
+
+// Touch records that session id of userID was just used. Writes are throttled to one per
+// TouchInterval per session and instance; unknown sessions are ignored.
+func (x *Index) Touch(userID, id string) error {
+	if userID == "" || id == "" {
+		return nil
+	}
+	now := x.now()
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if last, ok := x.touched[id]; ok && now.Sub(last) < TouchInterval {
+		return nil
+	}
+	x.touched[id] = now
+	x.pruneTouched(now)
+
+	list, err := x.load(userID)
+	if err != nil {
+		return err
+	}
+	i := find(list, id)
+	if i < 0 {
+		return nil
+	}
+	list[i].LastAccess = now
+	return x.save(userID, list)
+}
+
+// List returns the live sessions of userID, most recently used first. Sessions that expired or
+// were destroyed are dropped from the index.
+func (x *Index) List(userID string) ([]Session, error) {
+	if userID == "" {
+		return nil, nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	list, err := x.load(userID)
+	if err != nil {
+		return nil, err
+	}
+	live, err := x.live(list)
+	if err != nil {
+		return nil, err
+	}
+	if len(live) != len(list) {
+		if err := x.save(userID, live); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].LastAccess.After(live[j].LastAccess) })
+	return live, nil
+}
+
+// Revoke destroys the session of userID with the given handle and returns its ID.
+func (x *Index) Revoke(userID, handle string) (string, error) {
+	if userID == "" || handle == "" {
+		return "", ErrNotFound
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	list, err := x.load(userID)
+	if err != nil {
+		return "", err
+	}
+	i := -1
+	for j, s := range list {
+		if Handle(s.ID) == handle {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		return "", ErrNotFound
+	}
+	id := list[i].ID
+	if err := x.storage.Delete(id); err != nil {
+		return "", err
+	}
+	delete(x.touched, id)
+	return id, x.save(userID, append(list[:i], list[i+1:]...))
+}
+
+// RevokeOthers destroys every session of userID but keep, and returns the IDs it destroyed.
+func (x *Index) RevokeOthers(userID, keep string) ([]string, error) {
+	if userID == "" {
+		return nil, nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	list, err := x.load(userID)
+	if err != nil {
+		return nil, err
+	}
+	var revoked []string
+	kept := list[:0]
+	for _, s := range list {
+		if s.ID == keep {
+			kept = append(kept, s)
+			continue
+		}
+		if err := x.storage.Delete(s.ID); err != nil {
+			return revoked, err
+		}
+		delete(x.touched, s.ID)
+		revoked = append(revoked, s.ID)
+	}
+	return revoked, x.save(userID, kept)
+}
+
+// Rename moves session oldID of userID to newID after its ID was regenerated, keeping what was
+// recorded about it; unknown sessions are ignored.
+func (x *Index) Rename(userID, oldID, newID string) error {
+	if userID == "" || oldID == "" || newID == "" || oldID == newID {
+		return nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	delete(x.touched, oldID)
+	list, err := x.load(userID)
+	if err != nil {
+		return err
+	}
+	i := find(list, oldID)
+	if i < 0 {
+		return nil
+	}
+	list[i].ID = newID
+	return x.save(userID, list)
+}
+
+// Remove forgets session id of userID, which was destroyed by logging out.
+func (x *Index) Remove(userID, id string) error {
+	if userID == "" || id == "" {
+		return nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	delete(x.touched, id)
+	list, err := x.load(userID)
+	if err != nil {
+		return err
+	}
+	i := find(list, id)
+	if i < 0 {
+		return nil
+	}
+	return x.save(userID, append(list[:i], list[i+1:]...))
+}
+
+// load returns the sessions recorded for userID.
+func (x *Index) load(userID string) ([]Session, error) {
+	value, err := x.storage.Get(indexKeyPrefix + userID)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var list []Session
+	if err := json.Unmarshal(value, &list); err != nil {
+		return nil, nil
+	}
+	return list, nil
+}
+
+// save stores the sessions of userID, keeping the MaxSessionsPerUser most recently used. The
+// index expires together with the newest session it could list.
+func (x *Index) save(userID string, list []Session) error {
+	if len(list) == 0 {
+		return x.storage.Delete(indexKeyPrefix + userID)
+	}
+	if len(list) > MaxSessionsPerUser {
+		sort.Slice(list, func(i, j int) bool { return list[i].LastAccess.After(list[j].LastAccess) })
+		list = list[:MaxSessionsPerUser]
+	}
+	value, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return x.storage.Set(indexKeyPrefix+userID, value, x.ttl)
+}
+
+// live returns the sessions of list whose data is still in the storage.
+func (x *Index) live(list []Session) ([]Session, error) {
+	live := make([]Session, 0, len(list))
+	for _, s := range list {
+		value, err := x.storage.Get(s.ID)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			live = append(live, s)
+		}
+	}
+	return live, nil
+}
+
+// pruneTouched forgets throttling entries older than TouchInterval once the map grows.
+func (x *Index) pruneTouched(now time.Time) {
+	if len(x.touched) < 10000 {
+		return
+	}
+	for id, t := range x.touched {
+		if now.Sub(t) >= TouchInterval {
+			delete(x.touched, id)
+		}
+	}
+}
+
+func find(list []Session, id string) int {
+	for i, s := range list {
+		if s.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+var index *Index
+
+// Init sets the index used by the login handlers and the /_sessions pages; nil disables session
+// management.
+func Init(x *Index) {
+	index = x
+}
+
+// Get returns the index, or nil when session management is disabled.
+func Get() *Index {
+	return index
+}
@@ -0,0 +1,258 @@
+package sessionindex
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+)
+
+// memoryStorage is a Storage keeping values in a map, ignoring expiry.
+type memoryStorage struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{values: map[string][]byte{}}
+}
+
+func (m *memoryStorage) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[key], nil
+}
+
+func (m *memoryStorage) Set(key string, val []byte, _ time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = val
+	return nil
+}
+
+func (m *memoryStorage) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+// newTestIndex returns an index on a memory storage holding the sessions ids, using the clock *now.
+func newTestIndex(now *time.Time, ids ...string) (*Index, *memoryStorage) {
+	storage := newMemoryStorage()
+	for _, id := range ids {
+		_ = storage.Set(id, []byte("data"), 0)
+	}
+	x := New(storage, 24*time.Hour)
+	x.now = func() time.Time { return *now }
+	return x, storage
+}
+
+func TestAddAndList(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	x, _ := newTestIndex(&now, "s1", "s2")
+
+	testza.AssertNoError(t, x.Add("u1", Session{ID: "s1", IP: "10.0.0.1", UserAgent: "Firefox", AMR: []string{"pwd"}}))
+	now = now.Add(time.Hour)
+	testza.AssertNoError(t, x.Add("u1", Session{ID: "s2", IP: "10.0.0.2"}))
+
+	list, err := x.List("u1")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 2)
+	testza.AssertEqual(t, "s2", list[0].ID)
+	testza.AssertEqual(t, "s1", list[1].ID)
+	testza.AssertEqual(t, "Firefox", list[1].UserAgent)
+	testza.AssertEqual(t, []string{"pwd"}, list[1].AMR)
+
+	// Other users see none of them
+	other, err := x.List("u2")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, other, 0)
+}
+
+func TestAddKeepsCreationTime(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	created := now
+	x, _ := newTestIndex(&now, "s1")
+
+	testza.AssertNoError(t, x.Add("u1", Session{ID: "s1", AMR: []string{"pwd"}}))
+	now = now.Add(time.Hour)
+	testza.AssertNoError(t, x.Add("u1", Session{ID: "s1", AMR: []string{"pwd", "otp"}}))
+
+	list, err := x.List("u1")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 1)
+	testza.AssertTrue(t, list[0].CreatedAt.Equal(created))
+	testza.AssertTrue(t, list[0].LastAccess.Equal(now))
+	testza.AssertEqual(t, []string{"pwd", "otp"}, list[0].AMR)
+}
+
+func TestAddIgnoresAnonymousSessions(t *testing.T) {
+	now := time.Now()
+	x, storage := newTestIndex(&now, "s1")
+
+	testza.AssertNoError(t, x.Add("", Session{ID: "s1"}))
+	testza.AssertLen(t, storage.values, 1)
+}
+
+func TestAddTruncatesUserAgent(t *testing.T) {
+	now := time.Now()
+	x, _ := newTestIndex(&now, "s1")
+
+	long := make([]byte, MaxUserAgentLength+10)
+	for i := range long {
+		long[i] = 'a'
+	}
+	testza.AssertNoError(t, x.Add("u1", Session{ID: "s1", UserAgent: string(long)}))
+	list, err := x.List("u1")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, MaxUserAgentLength, len(list[0].UserAgent))
+}
+
+func TestTouchIsThrottled(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	added := now
+	x, _ := newTestIndex(&now, "s1")
+	testza.AssertNoError(t, x.Add("u1", Session{ID: "s1"}))
+
+	now = now.Add(TouchInterval / 2)
+	testza.AssertNoError(t, x.Touch("u1", "s1"))
+	list, _ := x.List("u1")
+	testza.AssertTrue(t, list[0].LastAccess.Equal(added))
+
+	now = added.Add(TouchInterval)
+	testza.AssertNoError(t, x.Touch("u1", "s1"))
+	list, _ = x.List("u1")
+	testza.AssertTrue(t, list[0].LastAccess.Equal(now))
+
+	// Unknown sessions are not added
+	now = now.Add(TouchInterval)
+	testza.AssertNoError(t, x.Touch("u1", "unknown"))
+	list, _ = x.List("u1")
+	testza.AssertLen(t, list, 1)
+}
+
+func TestListDropsDestroyedSessions(t *testing.T) {
+	now := time.Now()
+	x, storage := newTestIndex(&now, "s1", "s2")
+	testza.AssertNoError(t, x.Add("u1", Session{ID: "s1"}))
+	testza.AssertNoError(t, x.Add("u1", Session{ID: "s2"}))
+
+	_ = storage.Delete("s1")
+	list, err := x.List("u1")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 1)
+	testza.AssertEqual(t, "s2", list[0].ID)
+
+	_ = storage.Delete("s2")
+	list, err = x.List("u1")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 0)
+	_, ok := storage.values[indexKeyPrefix+"u1"]
+	testza.AssertFalse(t, ok)
+}
+
+func TestRevoke(t *testing.T) {
+	now := time.Now()
+	x, storage := newTestIndex(&now, "s1", "s2")
+	testza.AssertNoError(t, x.Add("u1", Session{ID: "s1"}))
+	testza.AssertNoError(t, x.Add("u1", Session{ID: "s2"}))
+
+	id, err := x.Revoke("u1", Handle("s1"))
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "s1", id)
+	_, ok := storage.values["s1"]
+	testza.AssertFalse(t, ok)
+	_, ok = storage.values["s2"]
+	testza.AssertTrue(t, ok)
+
+	list, _ := x.List("u1")
+	testza.AssertLen(t, list, 1)
+
+	// Sessions of other users and unknown handles cannot be revoked
+	_, err = x.Revoke("u2", Handle("s2"))
+	testza.AssertErrorIs(t, err, ErrNotFound)
+	_, err = x.Revoke("u1", "nope")
+	testza.AssertErrorIs(t, err, ErrNotFound)
+	_, err = x.Revoke("u1", "s2")
+	testza.AssertErrorIs(t, err, ErrNotFound)
+}
+
+func TestRevokeOthers(t *testing.T) {
+	now := time.Now()
+	x, storage := newTestIndex(&now, "s1", "s2", "s3")
+	for _, id := range []string{"s1", "s2", "s3"} {
+		testza.AssertNoError(t, x.Add("u1", Session{ID: id}))
+	}
+
+	revoked, err := x.RevokeOthers("u1", "s2")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, []string{"s1", "s3"}, revoked)
+	testza.AssertLen(t, storage.values, 2) // s2 and the index
+
+	list, _ := x.List("u1")
+	testza.AssertLen(t, list, 1)
+	testza.AssertEqual(t, "s2", list[0].ID)
+}
+
+func TestRemove(t *testing.T) {
+	now := time.Now()
+	x, storage := newTestIndex(&now, "s1")
+	testza.AssertNoError(t, x.Add("u1", Session{ID: "s1"}))
+
+	testza.AssertNoError(t, x.Remove("u1", "s1"))
+	_, ok := storage.values[indexKeyPrefix+"u1"]
+	testza.AssertFalse(t, ok)
+	// The session data is left to the caller
+	_, ok = storage.values["s1"]
+	testza.AssertTrue(t, ok)
+}
+
+func TestRename(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	created := now
+	x, storage := newTestIndex(&now, "s1")
+	testza.AssertNoError(t, x.Add("u1", Session{ID: "s1", UserAgent: "Firefox", AMR: []string{"pwd"}}))
+
+	_ = storage.Set("s2", []byte("data"), 0)
+	now = now.Add(time.Hour)
+	testza.AssertNoError(t, x.Rename("u1", "s1", "s2"))
+	list, err := x.List("u1")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 1)
+	testza.AssertEqual(t, "s2", list[0].ID)
+	testza.AssertEqual(t, "Firefox", list[0].UserAgent)
+	testza.AssertTrue(t, list[0].CreatedAt.Equal(created))
+
+	// Unknown sessions are ignored
+	testza.AssertNoError(t, x.Rename("u1", "s9", "s10"))
+	list, err = x.List("u1")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 1)
+}
+
+func TestMaxSessionsPerUser(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	x, storage := newTestIndex(&now)
+	for i := 0; i <= MaxSessionsPerUser; i++ {
+		id := "s" + time.Duration(i).String()
+		_ = storage.Set(id, []byte("data"), 0)
+		testza.AssertNoError(t, x.Add("u1", Session{ID: id}))
+		now = now.Add(time.Second)
+	}
+
+	list, err := x.List("u1")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, MaxSessionsPerUser)
+	// The least recently used session was forgotten
+	for _, s := range list {
+		testza.AssertNotEqual(t, "s0s", s.ID)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	testza.AssertEqual(t, 18, len(Handle("s1")))
+	testza.AssertEqual(t, Handle("s1"), Handle("s1"))
+	testza.AssertNotEqual(t, Handle("s1"), Handle("s2"))
+}
@@ -0,0 +1,112 @@
+package totpstore
+
+import (
+	"crypto/subtle"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	// Period is the TOTP time step.
+	Period = 30 * time.Second
+	// Skew is the number of steps before and after the current one whose codes are accepted.
+	Skew = 1
+
+	replayKeyPrefix = "totp_step:"
+	// replayTTL outlives the acceptance window, after which old codes fail anyway.
+	replayTTL = (2*Skew + 2) * Period
+)
+
+// Match checks a 6-digit code against secret at t, allowing Skew steps of clock skew, and
+// returns the time step (counter) the code belongs to.
+func Match(secret, code string, t time.Time) (uint64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != 6 {
+		return 0, false
+	}
+	current := uint64(t.Unix()) / uint64(Period/time.Second)
+	for i := -Skew; i <= Skew; i++ {
+		step := current + uint64(i)
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(int64(step)*int64(Period/time.Second), 0), totp.ValidateOpts{
+			Period:    uint(Period / time.Second),
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// ReplayGuard remembers the last time step a TOTP code was accepted for, per subject, so every
+// code works once: a code of that step or an earlier one is rejected (RFC 6238 section 5.2).
+type ReplayGuard struct {
+	storage Storage
+	// mu serializes the read and update of a subject's step within this instance.
+	mu sync.Mutex
+}
+
+// NewReplayGuard returns a guard keeping the used steps in storage.
+func NewReplayGuard(storage Storage) *ReplayGuard {
+	return &ReplayGuard{storage: storage}
+}
+
+// Use records that subject used a code of step. It returns false when a code of that step or a
+// later one was used before.
+func (g *ReplayGuard) Use(subject string, step uint64) (bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := replayKeyPrefix + subject
+	value, err := g.storage.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if value != nil {
+		if last, err := strconv.ParseUint(string(value), 10, 64); err == nil && step <= last {
+			return false, nil
+		}
+	}
+	return true, g.storage.Set(key, []byte(strconv.FormatUint(step, 10)), replayTTL)
+}
+
+var replayGuard *ReplayGuard
+
+// InitReplayGuard sets the guard used by Store.Verify and auth.VerifyOTPFor; nil turns replay
+// protection off.
+func InitReplayGuard(g *ReplayGuard) {
+	replayGuard = g
+}
+
+// GetReplayGuard returns the replay guard, or nil when there is none.
+func GetReplayGuard() *ReplayGuard {
+	return replayGuard
+}
+
+// verifyOnce matches code against secret at t and, with a replay guard, accepts its step once
+// for subject.
+func verifyOnce(subject, secret, code string, t time.Time) (bool, error) {
+	step, ok := Match(secret, code, t)
+	if !ok {
+		return false, nil
+	}
+	if g := GetReplayGuard(); g != nil {
+		return g.Use(subject, step)
+	}
+	return true, nil
+}
+
+// VerifyOnce reports whether code is a valid TOTP code of secret that was not used before by
+// subject. It is the stateless counterpart of Store.Verify for secrets kept elsewhere.
+func VerifyOnce(subject, secret, code string) (bool, error) {
+	return verifyOnce(subject, secret, code, time.Now())
+}
@@ -0,0 +1,74 @@
+package totpstore
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/pquerna/otp/totp"
+
+	"github.com/soulteary/stargate/src/internal/filestore"
+)
+
+const testSecret = "JBSWY3DPEHPK3PXP"
+
+func TestMatch(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	step := uint64(now.Unix()) / 30
+
+	for i, offset := range []time.Duration{-Period, 0, Period} {
+		code, err := totp.GenerateCode(testSecret, now.Add(offset))
+		testza.AssertNoError(t, err)
+		got, ok := Match(testSecret, code, now)
+		testza.AssertTrue(t, ok)
+		testza.AssertEqual(t, step+uint64(i)-1, got)
+	}
+
+	code, err := totp.GenerateCode(testSecret, now.Add(-2*Period))
+	testza.AssertNoError(t, err)
+	_, ok := Match(testSecret, code, now)
+	testza.AssertFalse(t, ok)
+	_, ok = Match(testSecret, "12345", now)
+	testza.AssertFalse(t, ok)
+}
+
+func TestReplayGuard(t *testing.T) {
+	storage, err := filestore.Open(filepath.Join(t.TempDir(), "steps.json"))
+	testza.AssertNoError(t, err)
+	g := NewReplayGuard(storage)
+
+	ok, err := g.Use("alice", 100)
+	testza.AssertNoError(t, err)
+	testza.AssertTrue(t, ok)
+	ok, _ = g.Use("alice", 100)
+	testza.AssertFalse(t, ok, "a step is used once")
+	ok, _ = g.Use("alice", 99)
+	testza.AssertFalse(t, ok, "earlier steps are rejected after a later one was used")
+	ok, _ = g.Use("bob", 100)
+	testza.AssertTrue(t, ok, "steps are tracked per subject")
+	ok, _ = g.Use("alice", 101)
+	testza.AssertTrue(t, ok)
+}
+
+func TestVerifyOnce(t *testing.T) {
+	storage, err := filestore.Open(filepath.Join(t.TempDir(), "steps.json"))
+	testza.AssertNoError(t, err)
+	InitReplayGuard(NewReplayGuard(storage))
+	t.Cleanup(func() { InitReplayGuard(nil) })
+
+	code, err := totp.GenerateCode(testSecret, time.Now())
+	testza.AssertNoError(t, err)
+	ok, err := VerifyOnce("alice", testSecret, code)
+	testza.AssertNoError(t, err)
+	testza.AssertTrue(t, ok)
+	ok, err = VerifyOnce("alice", testSecret, code)
+	testza.AssertNoError(t, err)
+	testza.AssertFalse(t, ok, "a captured code cannot be replayed")
+	ok, _ = VerifyOnce("bob", testSecret, code)
+	testza.AssertTrue(t, ok)
+
+	InitReplayGuard(nil)
+	ok, _ = VerifyOnce("alice", testSecret, code)
+	testza.AssertTrue(t, ok, "without a guard codes are only matched")
+}
@@ -0,0 +1,350 @@
+// Package totpstore keeps per-user TOTP secrets for deployments without Herald TOTP. Secrets are
+// encrypted with AES-256-GCM before they reach the storage (Redis or a file), bound to the user
+// they belong to, so a copied record cannot be used for another account. Enrolling also issues
+// single-use backup codes, stored as keyed hashes.
+package totpstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	// KeySize is the size of the encryption key in bytes (AES-256).
+	KeySize = 32
+	// EnrollTTL is how long an enrollment can be confirmed after it was started.
+	EnrollTTL = 10 * time.Minute
+	// BackupCodeCount is the number of backup codes issued when enrolling.
+	BackupCodeCount = 10
+
+	secretKeyPrefix = "totp:"
+	enrollKeyPrefix = "totp_enroll:"
+)
+
+var (
+	// ErrEnrollmentNotFound is returned when confirming an enrollment that expired, was already
+	// confirmed, or belongs to another user.
+	ErrEnrollmentNotFound = errors.New("TOTP enrollment not found")
+	// ErrInvalidCode is returned when the code confirming an enrollment is wrong.
+	ErrInvalidCode = errors.New("invalid TOTP code")
+	// ErrInvalidKey is returned for encryption keys that are not KeySize bytes in base64.
+	ErrInvalidKey = errors.New("TOTP encryption key must be 32 bytes, base64-encoded")
+)
+
+// Storage keeps the encrypted secrets. The session storage (Redis) and filestore.Storage implement it.
+type Storage interface {
+	Get(key string) ([]byte, error)
+	Set(key string, val []byte, exp time.Duration) error
+	Delete(key string) error
+}
+
+// record is a stored secret, sealed for one user.
+type record struct {
+	// Secret is the base64 nonce and ciphertext of the base32 TOTP secret.
+	Secret string `json:"secret"`
+	// BackupCodes are the keyed hashes of the unused backup codes.
+	BackupCodes []string  `json:"backup_codes,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// enrollment is a started enrollment waiting for the first code.
+type enrollment struct {
+	UserID string `json:"user_id"`
+	Secret string `json:"secret"`
+}
+
+// Store enrolls, verifies and revokes TOTP secrets by user ID.
+type Store struct {
+	storage Storage
+	aead    cipher.AEAD
+	// macKey keys the hashes of backup codes.
+	macKey []byte
+	issuer string
+	now    func() time.Time
+	// mu serializes the updates of a record within this instance.
+	mu sync.Mutex
+}
+
+// ParseKey decodes a base64 (standard or URL alphabet, padded or not) encryption key.
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	key, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		key, err = base64.RawURLEncoding.DecodeString(s)
+	}
+	if err != nil || len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// New returns a store keeping secrets in storage, encrypted with key. issuer names the service in
+// authenticator apps.
+func New(storage Storage, key []byte, issuer string) (*Store, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	mac := sha256.Sum256(append([]byte("stargate totp backup codes:"), key...))
+	return &Store{storage: storage, aead: aead, macKey: mac[:], issuer: issuer, now: time.Now}, nil
+}
+
+// Enabled reports whether userID has a confirmed TOTP secret.
+func (s *Store) Enabled(userID string) (bool, error) {
+	secret, err := s.secret(userID)
+	return secret != "", err
+}
+
+// EnrollStart creates a secret for userID and returns the enrollment ID to confirm it with and the
+// otpauth:// URI to show as a QR code, with label as the account name. The secret replaces the
+// current one only once confirmed.
+func (s *Store) EnrollStart(userID, label string) (enrollID, otpauthURI string, err error) {
+	if userID == "" {
+		return "", "", errors.New("TOTP enrollment needs a user ID")
+	}
+	if label == "" {
+		label = userID
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: s.issuer, AccountName: label})
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err := s.seal(enrollKeyPrefix+userID, key.Secret())
+	if err != nil {
+		return "", "", err
+	}
+	enrollID, err = randomID()
+	if err != nil {
+		return "", "", err
+	}
+	value, err := json.Marshal(enrollment{UserID: userID, Secret: sealed})
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.storage.Set(enrollKeyPrefix+enrollID, value, EnrollTTL); err != nil {
+		return "", "", err
+	}
+	return enrollID, key.URL(), nil
+}
+
+// EnrollConfirm stores the secret of enrollment enrollID of userID once code matches it, and
+// returns new backup codes. They are only stored hashed, so this is the one time they are shown.
+func (s *Store) EnrollConfirm(userID, enrollID, code string) ([]string, error) {
+	value, err := s.storage.Get(enrollKeyPrefix + enrollID)
+	if err != nil {
+		return nil, err
+	}
+	var e enrollment
+	if value == nil || json.Unmarshal(value, &e) != nil || e.UserID != userID {
+		return nil, ErrEnrollmentNotFound
+	}
+	secret, err := s.open(enrollKeyPrefix+userID, e.Secret)
+	if err != nil {
+		return nil, ErrEnrollmentNotFound
+	}
+	ok, err := verifyOnce(userID, secret, code, s.now())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	if err := s.storage.Delete(enrollKeyPrefix + enrollID); err != nil {
+		return nil, err
+	}
+	sealed, err := s.seal(secretKeyPrefix+userID, secret)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, BackupCodeCount)
+	hashes := make([]string, BackupCodeCount)
+	for i := range codes {
+		if codes[i], err = newBackupCode(); err != nil {
+			return nil, err
+		}
+		hashes[i] = s.backupCodeHash(userID, codes[i])
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(userID, &record{Secret: sealed, BackupCodes: hashes, CreatedAt: s.now()}); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Verify reports whether code is a TOTP code of userID that was not used before (see
+// ReplayGuard). Users without a secret never verify.
+func (s *Store) Verify(userID, code string) (bool, error) {
+	secret, err := s.secret(userID)
+	if err != nil || secret == "" {
+		return false, err
+	}
+	return verifyOnce(userID, secret, code, s.now())
+}
+
+// RedeemBackupCode reports whether code is an unused backup code of userID, and uses it up.
+func (s *Store) RedeemBackupCode(userID, code string) (bool, error) {
+	if userID == "" || normalizeBackupCode(code) == "" {
+		return false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.record(userID)
+	if err != nil || r == nil {
+		return false, err
+	}
+	hash := s.backupCodeHash(userID, code)
+	for i, h := range r.BackupCodes {
+		if hmac.Equal([]byte(h), []byte(hash)) {
+			r.BackupCodes = append(r.BackupCodes[:i], r.BackupCodes[i+1:]...)
+			return true, s.save(userID, r)
+		}
+	}
+	return false, nil
+}
+
+// BackupCodesLeft returns the number of unused backup codes of userID.
+func (s *Store) BackupCodesLeft(userID string) (int, error) {
+	r, err := s.record(userID)
+	if err != nil || r == nil {
+		return 0, err
+	}
+	return len(r.BackupCodes), nil
+}
+
+// Revoke removes the secret of userID.
+func (s *Store) Revoke(userID string) error {
+	return s.storage.Delete(secretKeyPrefix + userID)
+}
+
+// record returns the record of userID, or nil when there is none.
+func (s *Store) record(userID string) (*record, error) {
+	if userID == "" {
+		return nil, nil
+	}
+	value, err := s.storage.Get(secretKeyPrefix + userID)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var r record
+	if err := json.Unmarshal(value, &r); err != nil {
+		return nil, fmt.Errorf("invalid TOTP record of %s: %w", userID, err)
+	}
+	return &r, nil
+}
+
+func (s *Store) save(userID string, r *record) error {
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.storage.Set(secretKeyPrefix+userID, value, 0)
+}
+
+// secret returns the decrypted secret of userID, or "" when there is none. A record that does
+// not decrypt (another key, or moved from another user) is an error rather than "not enrolled",
+// so a misconfigured key does not silently turn the second factor off.
+func (s *Store) secret(userID string) (string, error) {
+	r, err := s.record(userID)
+	if err != nil || r == nil {
+		return "", err
+	}
+	secret, err := s.open(secretKeyPrefix+userID, r.Secret)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt TOTP secret of %s: %w", userID, err)
+	}
+	return secret, nil
+}
+
+// seal encrypts secret, authenticating ad (the storage key of its owner) with it.
+func (s *Store) seal(ad, secret string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(secret), []byte(ad))
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value sealed with ad.
+func (s *Store) open(ad, value string) (string, error) {
+	sealed, err := base64.RawStdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < s.aead.NonceSize() {
+		return "", errors.New("sealed value too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, []byte(ad))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// backupCodeHash returns the keyed hash of a backup code of userID.
+func (s *Store) backupCodeHash(userID, code string) string {
+	mac := hmac.New(sha256.New, s.macKey)
+	mac.Write([]byte(userID + "\x00" + normalizeBackupCode(code)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newBackupCode returns a random backup code of 10 base32 characters (50 bits), formatted as
+// "xxxxx-xxxxx".
+func newBackupCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// normalizeBackupCode drops spaces and dashes and folds case, so codes can be typed loosely.
+func normalizeBackupCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code)))
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+var store *Store
+
+// Init sets the store used for per-user TOTP; nil disables it.
+func Init(s *Store) {
+	store = s
+}
+
+// Get returns the store, or nil when local per-user TOTP is disabled.
+func Get() *Store {
+	return store
+}
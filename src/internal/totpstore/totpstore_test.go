@@ -0,0 +1,176 @@
+package totpstore
+
+import (
+	"bytes"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MarvinJWendt/testza"
+	"github.com/pquerna/otp/totp"
+
+	"github.com/soulteary/stargate/src/internal/filestore"
+)
+
+var testKey = bytes.Repeat([]byte{7}, KeySize)
+
+func newTestStore(t *testing.T) (*Store, *filestore.Storage) {
+	t.Helper()
+	storage, err := filestore.Open(filepath.Join(t.TempDir(), "totp.json"))
+	testza.AssertNoError(t, err)
+	s, err := New(storage, testKey, "Stargate")
+	testza.AssertNoError(t, err)
+	return s, storage
+}
+
+// enroll enrolls userID and returns its secret and backup codes.
+func enroll(t *testing.T, s *Store, userID string) (string, []string) {
+	t.Helper()
+	enrollID, uri, err := s.EnrollStart(userID, userID+"@example.com")
+	testza.AssertNoError(t, err)
+	u, err := url.Parse(uri)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "otpauth", u.Scheme)
+	testza.AssertEqual(t, "Stargate", u.Query().Get("issuer"))
+	secret := u.Query().Get("secret")
+
+	code, err := totp.GenerateCode(secret, time.Now())
+	testza.AssertNoError(t, err)
+	backupCodes, err := s.EnrollConfirm(userID, enrollID, code)
+	testza.AssertNoError(t, err)
+	return secret, backupCodes
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := ParseKey("BwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwc=")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, testKey, key)
+	key, err = ParseKey("BwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwc")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, testKey, key)
+
+	_, err = ParseKey("c2hvcnQ=")
+	testza.AssertErrorIs(t, err, ErrInvalidKey)
+	_, err = ParseKey("not base64!")
+	testza.AssertErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestStore_EnrollVerifyRevoke(t *testing.T) {
+	s, storage := newTestStore(t)
+
+	enabled, err := s.Enabled("alice")
+	testza.AssertNoError(t, err)
+	testza.AssertFalse(t, enabled)
+
+	secret, _ := enroll(t, s, "alice")
+	enabled, err = s.Enabled("alice")
+	testza.AssertNoError(t, err)
+	testza.AssertTrue(t, enabled)
+
+	code, err := totp.GenerateCode(secret, time.Now().Add(Period))
+	testza.AssertNoError(t, err)
+	ok, err := s.Verify("alice", code)
+	testza.AssertNoError(t, err)
+	testza.AssertTrue(t, ok)
+	ok, _ = s.Verify("bob", code)
+	testza.AssertFalse(t, ok, "users without a secret never verify")
+	stale, err := totp.GenerateCode(secret, time.Now().Add(-5*time.Minute))
+	testza.AssertNoError(t, err)
+	ok, _ = s.Verify("alice", stale)
+	testza.AssertFalse(t, ok)
+
+	// The secret is not stored in the clear
+	value, err := storage.Get(secretKeyPrefix + "alice")
+	testza.AssertNoError(t, err)
+	testza.AssertFalse(t, bytes.Contains(value, []byte(secret)))
+
+	testza.AssertNoError(t, s.Revoke("alice"))
+	enabled, err = s.Enabled("alice")
+	testza.AssertNoError(t, err)
+	testza.AssertFalse(t, enabled)
+}
+
+func TestStore_EnrollConfirm(t *testing.T) {
+	s, _ := newTestStore(t)
+	enrollID, uri, err := s.EnrollStart("alice", "")
+	testza.AssertNoError(t, err)
+	u, _ := url.Parse(uri)
+	code, err := totp.GenerateCode(u.Query().Get("secret"), time.Now())
+	testza.AssertNoError(t, err)
+
+	_, err = s.EnrollConfirm("bob", enrollID, code)
+	testza.AssertErrorIs(t, err, ErrEnrollmentNotFound)
+	_, err = s.EnrollConfirm("alice", "unknown", code)
+	testza.AssertErrorIs(t, err, ErrEnrollmentNotFound)
+	_, err = s.EnrollConfirm("alice", enrollID, "000000")
+	testza.AssertErrorIs(t, err, ErrInvalidCode)
+	enabled, _ := s.Enabled("alice")
+	testza.AssertFalse(t, enabled, "a started enrollment does not enable TOTP")
+
+	backupCodes, err := s.EnrollConfirm("alice", enrollID, code)
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, backupCodes, BackupCodeCount)
+	_, err = s.EnrollConfirm("alice", enrollID, code)
+	testza.AssertErrorIs(t, err, ErrEnrollmentNotFound)
+}
+
+func TestStore_RecordsAreBoundToUserAndKey(t *testing.T) {
+	s, storage := newTestStore(t)
+	_, backupCodes := enroll(t, s, "alice")
+
+	// A record copied to another user does not decrypt
+	value, err := storage.Get(secretKeyPrefix + "alice")
+	testza.AssertNoError(t, err)
+	testza.AssertNoError(t, storage.Set(secretKeyPrefix+"mallory", value, 0))
+	_, err = s.Verify("mallory", "123456")
+	testza.AssertNotNil(t, err)
+	ok, err := s.RedeemBackupCode("mallory", backupCodes[0])
+	testza.AssertNoError(t, err)
+	testza.AssertFalse(t, ok, "backup codes are bound to their user")
+
+	// Neither does a record read with another key
+	other, err := New(storage, bytes.Repeat([]byte{8}, KeySize), "Stargate")
+	testza.AssertNoError(t, err)
+	_, err = other.Enabled("alice")
+	testza.AssertNotNil(t, err)
+}
+
+func TestStore_RedeemBackupCode(t *testing.T) {
+	s, storage := newTestStore(t)
+	_, backupCodes := enroll(t, s, "alice")
+	testza.AssertLen(t, backupCodes, BackupCodeCount)
+	testza.AssertRegexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, backupCodes[0])
+
+	// Codes are stored hashed
+	value, err := storage.Get(secretKeyPrefix + "alice")
+	testza.AssertNoError(t, err)
+	testza.AssertFalse(t, bytes.Contains(value, []byte(backupCodes[0])))
+
+	ok, err := s.RedeemBackupCode("alice", "aaaaa-aaaaa")
+	testza.AssertNoError(t, err)
+	testza.AssertFalse(t, ok)
+	ok, _ = s.RedeemBackupCode("alice", "")
+	testza.AssertFalse(t, ok)
+
+	// Typed loosely, once
+	ok, err = s.RedeemBackupCode("alice", " "+strings.ToUpper(strings.ReplaceAll(backupCodes[0], "-", " "))+" ")
+	testza.AssertNoError(t, err)
+	testza.AssertTrue(t, ok)
+	ok, err = s.RedeemBackupCode("alice", backupCodes[0])
+	testza.AssertNoError(t, err)
+	testza.AssertFalse(t, ok, "backup codes are single-use")
+	left, err := s.BackupCodesLeft("alice")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, BackupCodeCount-1, left)
+
+	ok, _ = s.RedeemBackupCode("bob", backupCodes[1])
+	testza.AssertFalse(t, ok)
+
+	// Revoking drops the codes with the secret
+	testza.AssertNoError(t, s.Revoke("alice"))
+	ok, err = s.RedeemBackupCode("alice", backupCodes[1])
+	testza.AssertNoError(t, err)
+	testza.AssertFalse(t, ok)
+}
@@ -0,0 +1,181 @@
+// Package users holds the named accounts for password logins, read from "name:hash" entries in
+// USERS and an htpasswd-style USERS_FILE. Hashes are checked by the resolvers of PASSWORDS.
+package users
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/soulteary/stargate/src/internal/passhash"
+)
+
+// AlgorithmBcrypt is the algorithm of bcrypt hashes written without an algorithm prefix, as
+// produced by "htpasswd -B".
+const AlgorithmBcrypt = "bcrypt"
+
+// bcryptPrefixes are the version prefixes of bcrypt hashes.
+var bcryptPrefixes = []string{"$2a$", "$2b$", "$2y$"}
+
+// Errors returned when parsing entries.
+var (
+	ErrInvalidEntry = errors.New("invalid user entry")
+	ErrDuplicate    = errors.New("duplicate user")
+)
+
+// User is a named account.
+type User struct {
+	Name string
+	// Algorithm names the resolver that checks Hash (e.g. "bcrypt", "argon2id").
+	Algorithm string
+	Hash      string
+}
+
+// IsBcryptHash reports whether hash starts with a bcrypt version prefix.
+func IsBcryptHash(hash string) bool {
+	for _, prefix := range bcryptPrefixes {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseEntry parses "name:hash". The hash is a bcrypt hash ("$2y$..."), a PHC hash
+// ("$argon2id$...") or "algorithm:value" with an algorithm of PASSWORDS, e.g. "alice:sha512:3c9909af...".
+func ParseEntry(entry string) (User, error) {
+	name, hash, ok := strings.Cut(strings.TrimSpace(entry), ":")
+	if !ok || name == "" || hash == "" || strings.ContainsAny(name, " \t") {
+		return User{}, fmt.Errorf("%w: expected name:hash", ErrInvalidEntry)
+	}
+	if IsBcryptHash(hash) {
+		return User{Name: name, Algorithm: AlgorithmBcrypt, Hash: hash}, nil
+	}
+	if algorithm, ok := passhash.Detect(hash); ok {
+		return User{Name: name, Algorithm: algorithm, Hash: hash}, nil
+	}
+	algorithm, value, ok := strings.Cut(hash, ":")
+	if !ok || algorithm == "" || value == "" {
+		return User{}, fmt.Errorf("%w: hash of %q needs an algorithm prefix", ErrInvalidEntry, name)
+	}
+	return User{Name: name, Algorithm: strings.ToLower(algorithm), Hash: value}, nil
+}
+
+// ParseList parses the "|"-separated entries of USERS.
+func ParseList(value string) ([]User, error) {
+	var list []User
+	for _, entry := range strings.Split(value, "|") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		u, err := ParseEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, u)
+	}
+	return list, nil
+}
+
+// LoadFile reads an htpasswd-style file: one "name:hash" per line, blank lines and lines starting
+// with "#" ignored.
+func LoadFile(path string) ([]User, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var list []User
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		u, err := ParseEntry(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		list = append(list, u)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// DB is a set of users by name. Names are case-sensitive.
+type DB struct {
+	users map[string]User
+}
+
+// New builds a DB, rejecting names that appear twice.
+func New(list ...User) (*DB, error) {
+	db := &DB{users: make(map[string]User, len(list))}
+	for _, u := range list {
+		if _, exists := db.users[u.Name]; exists {
+			return nil, fmt.Errorf("%w: %q", ErrDuplicate, u.Name)
+		}
+		db.users[u.Name] = u
+	}
+	return db, nil
+}
+
+// Load builds the DB from the USERS value and USERS_FILE path; either may be empty.
+func Load(list, path string) (*DB, error) {
+	all, err := ParseList(list)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		fromFile, err := LoadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, fromFile...)
+	}
+	return New(all...)
+}
+
+// Lookup returns the user called name.
+func (db *DB) Lookup(name string) (User, bool) {
+	u, ok := db.users[name]
+	return u, ok
+}
+
+// Len returns the number of users.
+func (db *DB) Len() int {
+	return len(db.users)
+}
+
+// dummy is the user checked in place of unknown names; see Dummy.
+var dummy = sync.OnceValue(func() User {
+	// Hashing only fails for unsupported algorithms
+	hash, _ := passhash.Hash(passhash.Argon2id, rand.Text())
+	return User{Algorithm: passhash.Argon2id, Hash: hash}
+})
+
+// Dummy returns a user whose hash is an argon2id hash (the default of hash-password) of a random
+// password. Password checks of unknown names run against it, so they take as long as a wrong
+// password of a real user and do not reveal which names exist. The hash is computed once, on
+// the first call.
+func Dummy() User {
+	return dummy()
+}
+
+var db *DB
+
+// Init sets the users for password logins; nil disables named users.
+func Init(d *DB) {
+	db = d
+}
+
+// Get returns the users, or nil when no named users are configured.
+func Get() *DB {
+	return db
+}
@@ -0,0 +1,110 @@
+package users
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+
+	"github.com/soulteary/stargate/src/internal/passhash"
+)
+
+const testBcrypt = "$2y$10$k8fBIpJInrE70BzYy5rO/OUSt1w2.IX0bWhiMdb2mJEhjheVHDhvK"
+
+func TestParseEntry(t *testing.T) {
+	u, err := ParseEntry("alice:" + testBcrypt)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, User{Name: "alice", Algorithm: AlgorithmBcrypt, Hash: testBcrypt}, u)
+
+	u, err = ParseEntry(" bob:SHA512:abc123 ")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, User{Name: "bob", Algorithm: "sha512", Hash: "abc123"}, u)
+
+	u, err = ParseEntry("dave:$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$aGFzaA")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "argon2id", u.Algorithm)
+	testza.AssertEqual(t, "$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$aGFzaA", u.Hash)
+
+	// Plaintext values may contain ":" themselves
+	u, err = ParseEntry("carol:plaintext:a:b")
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, "a:b", u.Hash)
+
+	for _, entry := range []string{"", "alice", "alice:", ":sha512:abc", "al ice:sha512:abc", "alice:abc123", "alice:sha512:"} {
+		_, err := ParseEntry(entry)
+		testza.AssertErrorIs(t, err, ErrInvalidEntry, entry)
+	}
+}
+
+func TestParseList(t *testing.T) {
+	list, err := ParseList("alice:plaintext:one| bob:plaintext:two |")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 2)
+	testza.AssertEqual(t, "bob", list[1].Name)
+
+	list, err = ParseList("")
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 0)
+
+	_, err = ParseList("alice:plaintext:one|bob")
+	testza.AssertErrorIs(t, err, ErrInvalidEntry)
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users")
+	testza.AssertNoError(t, os.WriteFile(path, []byte("# team\nalice:"+testBcrypt+"\n\nbob:md5:5f4dcc3b5aa765d61d8327deb882cf99\n"), 0o600))
+
+	list, err := LoadFile(path)
+	testza.AssertNoError(t, err)
+	testza.AssertLen(t, list, 2)
+	testza.AssertEqual(t, AlgorithmBcrypt, list[0].Algorithm)
+	testza.AssertEqual(t, "md5", list[1].Algorithm)
+
+	broken := filepath.Join(dir, "broken")
+	testza.AssertNoError(t, os.WriteFile(broken, []byte("alice:"+testBcrypt+"\nbob\n"), 0o600))
+	_, err = LoadFile(broken)
+	testza.AssertErrorIs(t, err, ErrInvalidEntry)
+	testza.AssertContains(t, err.Error(), ":2:")
+
+	_, err = LoadFile(filepath.Join(dir, "missing"))
+	testza.AssertNotNil(t, err)
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	testza.AssertNoError(t, os.WriteFile(path, []byte("bob:plaintext:two\n"), 0o600))
+
+	db, err := Load("alice:plaintext:one", path)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, 2, db.Len())
+	u, ok := db.Lookup("bob")
+	testza.AssertTrue(t, ok)
+	testza.AssertEqual(t, "two", u.Hash)
+	_, ok = db.Lookup("Bob")
+	testza.AssertFalse(t, ok)
+
+	_, err = Load("bob:plaintext:one", path)
+	testza.AssertErrorIs(t, err, ErrDuplicate)
+}
+
+func TestInit(t *testing.T) {
+	testza.AssertNil(t, Get())
+	d, err := New()
+	testza.AssertNoError(t, err)
+	Init(d)
+	defer Init(nil)
+	testza.AssertEqual(t, d, Get())
+}
+
+func TestDummy(t *testing.T) {
+	u := Dummy()
+	testza.AssertEqual(t, passhash.Argon2id, u.Algorithm)
+	testza.AssertNoError(t, passhash.Validate(passhash.Argon2id, u.Hash))
+	testza.AssertFalse(t, passhash.Check(passhash.Argon2id, u.Hash, ""))
+	testza.AssertEqual(t, "", u.Name)
+
+	// Computed once
+	testza.AssertEqual(t, u, Dummy())
+}
@@ -0,0 +1,73 @@
+// Browser side of the Stargate passkey routes. The server sends WebAuthn options with binary
+// fields base64url-encoded; create() and get() decode them, call the authenticator and return
+// the credential in the JSON form the server expects.
+(function() {
+  function decode(value) {
+    var s = value.replace(/-/g, '+').replace(/_/g, '/');
+    while (s.length % 4) s += '=';
+    var bin = atob(s);
+    var bytes = new Uint8Array(bin.length);
+    for (var i = 0; i < bin.length; i++) bytes[i] = bin.charCodeAt(i);
+    return bytes.buffer;
+  }
+
+  function encode(buffer) {
+    var bytes = new Uint8Array(buffer);
+    var bin = '';
+    for (var i = 0; i < bytes.length; i++) bin += String.fromCharCode(bytes[i]);
+    return btoa(bin).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+  }
+
+  function descriptors(list) {
+    return (list || []).map(function(c) {
+      return { type: c.type, id: decode(c.id), transports: c.transports };
+    });
+  }
+
+  function serialize(cred) {
+    var r = cred.response;
+    var out = { id: cred.id, rawId: encode(cred.rawId), type: cred.type, response: { clientDataJSON: encode(r.clientDataJSON) } };
+    if (r.attestationObject) {
+      out.response.attestationObject = encode(r.attestationObject);
+      if (r.getTransports) out.response.transports = r.getTransports();
+    }
+    if (r.authenticatorData) {
+      out.response.authenticatorData = encode(r.authenticatorData);
+      out.response.signature = encode(r.signature);
+      if (r.userHandle) out.response.userHandle = encode(r.userHandle);
+    }
+    return out;
+  }
+
+  window.StargatePasskey = {
+    supported: function() {
+      return !!(window.PublicKeyCredential && navigator.credentials);
+    },
+    // create registers a new passkey with the creation options from the server.
+    create: function(options) {
+      var publicKey = Object.assign({}, options, {
+        challenge: decode(options.challenge),
+        user: Object.assign({}, options.user, { id: decode(options.user.id) }),
+        excludeCredentials: descriptors(options.excludeCredentials)
+      });
+      return navigator.credentials.create({ publicKey: publicKey }).then(serialize);
+    },
+    // get signs in with a passkey using the request options from the server.
+    get: function(options) {
+      var publicKey = Object.assign({}, options, {
+        challenge: decode(options.challenge),
+        allowCredentials: descriptors(options.allowCredentials)
+      });
+      return navigator.credentials.get({ publicKey: publicKey }).then(serialize);
+    },
+    // post sends body as JSON and resolves with the parsed JSON answer.
+    post: function(url, body) {
+      return fetch(url, {
+        method: 'POST',
+        credentials: 'same-origin',
+        headers: { 'Content-Type': 'application/json', 'Accept': 'application/json' },
+        body: JSON.stringify(body || {})
+      }).then(function(r) { return r.json(); });
+    }
+  };
+})();
@@ -0,0 +1,63 @@
+// Cross-device login for the Stargate login pages. The button with id qrLoginBtn asks the server
+// for a QR code pointing at the approval page, shows it in qrLoginCode and polls until a phone
+// signed in to Stargate approves, then follows the redirect. Needs /assets/qrcode.min.js.
+(function() {
+  var btn = document.getElementById('qrLoginBtn');
+  var box = document.getElementById('qrLoginBox');
+  var code = document.getElementById('qrLoginCode');
+  var status = document.getElementById('qrLoginStatus');
+  if (!btn || !box || !code || !status) return;
+  var timer = null;
+
+  function show(msg, isError) {
+    status.textContent = msg;
+    status.style.color = isError ? '#dc2626' : '#6b7280';
+  }
+
+  function stop() {
+    if (timer) window.clearTimeout(timer);
+    timer = null;
+  }
+
+  function poll(interval) {
+    timer = window.setTimeout(function() {
+      fetch('/_login/qr/status', { credentials: 'same-origin', headers: { 'Accept': 'application/json' } })
+        .then(function(r) { return r.json(); })
+        .then(function(res) {
+          if (res.status === 'pending') {
+            poll(interval);
+          } else if (res.status === 'approved') {
+            show('Approved, signing in...', false);
+            window.location.href = res.redirect || '/';
+          } else {
+            code.innerHTML = '';
+            btn.style.display = '';
+            show(res.status === 'denied' ? 'The login was denied on the phone.' : 'The QR code expired. Show a new one to try again.', true);
+          }
+        })
+        .catch(function() { poll(interval); });
+    }, interval);
+  }
+
+  btn.addEventListener('click', function() {
+    stop();
+    var callback = btn.getAttribute('data-callback');
+    fetch('/_login/qr' + (callback ? '?callback=' + encodeURIComponent(callback) : ''), {
+      method: 'POST',
+      credentials: 'same-origin',
+      headers: { 'Accept': 'application/json' }
+    }).then(function(r) { return r.json(); }).then(function(res) {
+      if (!res.success) throw new Error(res.error || 'Could not start QR login');
+      code.innerHTML = '';
+      if (typeof QRCode === 'undefined') throw new Error('QR library failed to load. Please refresh the page.');
+      new QRCode(code, { text: res.approve_url, width: 200, height: 200 });
+      box.style.display = 'block';
+      btn.style.display = 'none';
+      show('Scan the code with a phone where you are signed in, then approve the login there.', false);
+      poll((res.interval || 2) * 1000);
+    }).catch(function(err) {
+      box.style.display = 'block';
+      show(err.message || 'Could not start QR login', true);
+    });
+  });
+})();
@@ -0,0 +1,61 @@
+package webauthn
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	// Examples from RFC 8949 appendix A
+	tests := map[string]interface{}{
+		"00":                 int64(0),
+		"17":                 int64(23),
+		"1818":               int64(24),
+		"1903e8":             int64(1000),
+		"20":                 int64(-1),
+		"3903e7":             int64(-1000),
+		"4401020304":         []byte{1, 2, 3, 4},
+		"6449455446":         "IETF",
+		"f4":                 false,
+		"f5":                 true,
+		"f6":                 nil,
+		"83010203":           []interface{}{int64(1), int64(2), int64(3)},
+		"a201020304":         map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)},
+		"a26161016162820203": map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}},
+		"c11a514b67b0":       int64(1363896240),
+	}
+	for input, want := range tests {
+		data, _ := hex.DecodeString(input)
+		got, rest, err := decodeCBOR(data)
+		testza.AssertNoError(t, err, input)
+		testza.AssertEqual(t, want, got, input)
+		testza.AssertEqual(t, 0, len(rest), input)
+	}
+
+	// The bytes after the first item are returned
+	_, rest, err := decodeCBOR([]byte{0x01, 0x02})
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, []byte{0x02}, rest)
+}
+
+func TestDecodeCBOR_Rejects(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"18",                 // missing argument
+		"1bffffffffffffffff", // beyond int64
+		"45010203",           // byte string longer than data
+		"9f0102ff",           // indefinite-length array
+		"f93c00",             // half-precision float
+		"9a7fffffff",         // array longer than data
+		"a1820102",           // map key that is an array
+		"a201020103",         // duplicate map key
+		"a101",               // map without value
+		"818181818181818181818181818181818181818100", // too deep
+	} {
+		data, _ := hex.DecodeString(input)
+		_, _, err := decodeCBOR(data)
+		testza.AssertNotNil(t, err, input)
+	}
+}
@@ -0,0 +1,110 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers (RFC 9053) of the supported credential keys, in order of preference.
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Algorithms lists the supported COSE algorithms, offered to authenticators in this order.
+var Algorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key parameters (RFC 9052 section 7, RFC 9053 section 7).
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1 // EC2 and OKP curve; RSA modulus
+	coseX   = -2 // EC2 and OKP x; RSA exponent
+	coseY   = -3
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+
+	minRSABits = 2048
+)
+
+// ErrUnsupportedKey is returned for credential keys of an unsupported type, curve or algorithm.
+var ErrUnsupportedKey = errors.New("unsupported credential key")
+
+// parseCOSEKey decodes a COSE_Key and returns the public key with its algorithm.
+func parseCOSEKey(data []byte) (crypto.PublicKey, int, error) {
+	item, rest, err := decodeCBOR(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, ok := item.(map[interface{}]interface{})
+	if !ok || len(rest) != 0 {
+		return nil, 0, errCBOR
+	}
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+	crv, _ := m[int64(coseCrv)].(int64)
+	x, _ := m[int64(coseX)].([]byte)
+
+	switch {
+	case kty == coseKtyEC2 && alg == AlgES256 && crv == coseCrvP256:
+		y, _ := m[int64(coseY)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, 0, ErrUnsupportedKey
+		}
+		point := append(append([]byte{4}, x...), y...)
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", ErrUnsupportedKey, err)
+		}
+		return key, AlgES256, nil
+	case kty == coseKtyOKP && alg == AlgEdDSA && crv == coseCrvEd25519:
+		if len(x) != ed25519.PublicKeySize {
+			return nil, 0, ErrUnsupportedKey
+		}
+		return ed25519.PublicKey(x), AlgEdDSA, nil
+	case kty == coseKtyRSA && alg == AlgRS256:
+		n, _ := m[int64(coseCrv)].([]byte)
+		e := new(big.Int).SetBytes(x)
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 || e.Bit(0) == 0 {
+			return nil, 0, ErrUnsupportedKey
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(e.Int64())}
+		if key.N.BitLen() < minRSABits {
+			return nil, 0, ErrUnsupportedKey
+		}
+		return key, AlgRS256, nil
+	default:
+		return nil, 0, ErrUnsupportedKey
+	}
+}
+
+// verifySignature checks sig over message with key and the COSE algorithm alg.
+func verifySignature(key crypto.PublicKey, alg int, message, sig []byte) bool {
+	digest := sha256.Sum256(message)
+	switch alg {
+	case AlgES256:
+		k, ok := key.(*ecdsa.PublicKey)
+		return ok && ecdsa.VerifyASN1(k, digest[:], sig)
+	case AlgEdDSA:
+		k, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(k, message, sig)
+	case AlgRS256:
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	default:
+		return false
+	}
+}
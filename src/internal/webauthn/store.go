@@ -0,0 +1,292 @@
+package webauthn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxCredentialsPerUser limits how many passkeys a user can register.
+	MaxCredentialsPerUser = 20
+
+	credentialKeyPrefix = "passkey:"
+	indexKeyPrefix      = "passkey_user:"
+)
+
+var (
+	// ErrUnknownCredential is returned for a login with a passkey that is not registered, or
+	// that belongs to another user.
+	ErrUnknownCredential = errors.New("unknown passkey")
+	// ErrNotFound is returned when removing a passkey the user does not own.
+	ErrNotFound = errors.New("passkey not found")
+	// ErrInvalidName is returned for empty or overlong passkey names.
+	ErrInvalidName = errors.New("invalid passkey name")
+	// ErrDuplicate is returned when registering a credential ID twice.
+	ErrDuplicate = errors.New("passkey already registered")
+	// ErrTooManyCredentials is returned when the user already has MaxCredentialsPerUser passkeys.
+	ErrTooManyCredentials = errors.New("too many passkeys")
+)
+
+// Storage keeps the passkeys. The session storage (Redis) and filestore.Storage implement it.
+type Storage interface {
+	Get(key string) ([]byte, error)
+	Set(key string, val []byte, exp time.Duration) error
+	Delete(key string) error
+}
+
+// Owner is the identity a passkey logs in as, captured when it is registered.
+type Owner struct {
+	UserID string   `json:"user_id"`
+	Email  string   `json:"email,omitempty"`
+	Phone  string   `json:"phone,omitempty"`
+	Name   string   `json:"name,omitempty"`
+	Role   string   `json:"role,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// Credential is a registered passkey.
+type Credential struct {
+	// ID is the base64url credential ID.
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Owner Owner  `json:"owner"`
+	// PublicKey is the COSE_Key of the credential.
+	PublicKey []byte `json:"public_key"`
+	Algorithm int    `json:"alg"`
+	SignCount uint32 `json:"sign_count"`
+	// BackupEligible is set for passkeys that can be synced to other devices.
+	BackupEligible bool      `json:"backup_eligible"`
+	Transports     []string  `json:"transports,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastUsedAt     time.Time `json:"last_used_at,omitempty"`
+}
+
+// AMR returns the authentication method reference of a login with c: "swk" for synced passkeys
+// and "hwk" for device-bound ones.
+func (c *Credential) AMR() string {
+	if c.BackupEligible {
+		return AMRSoftwareKey
+	}
+	return AMRHardwareKey
+}
+
+// Store keeps passkeys by credential ID, with an index of the IDs of each user.
+type Store struct {
+	storage Storage
+	// mu serializes updates of the per-user index within this instance.
+	mu sync.Mutex
+}
+
+// NewStore returns a store keeping passkeys in storage.
+func NewStore(storage Storage) *Store {
+	return &Store{storage: storage}
+}
+
+// List returns the passkeys of userID, newest first.
+func (s *Store) List(userID string) ([]*Credential, error) {
+	ids, err := s.indexIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	creds := make([]*Credential, 0, len(ids))
+	for _, id := range ids {
+		c, err := s.Lookup(id)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil && c.Owner.UserID == userID {
+			creds = append(creds, c)
+		}
+	}
+	sort.Slice(creds, func(i, j int) bool { return creds[i].CreatedAt.After(creds[j].CreatedAt) })
+	return creds, nil
+}
+
+// Lookup returns the passkey with credential ID id, or nil when there is none. IDs that are not
+// base64url are not looked up, so values from requests never reach arbitrary keys.
+func (s *Store) Lookup(id string) (*Credential, error) {
+	if !validID(id) {
+		return nil, nil
+	}
+	value, err := s.storage.Get(credentialKeyPrefix + id)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var c Credential
+	if err := json.Unmarshal(value, &c); err != nil {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// Add stores a newly registered passkey.
+func (s *Store) Add(c *Credential) error {
+	if c.Name == "" || len([]rune(c.Name)) > MaxNameLength {
+		return ErrInvalidName
+	}
+	if c.Owner.UserID == "" {
+		return errors.New("passkey owner has no user ID")
+	}
+	if !validID(c.ID) {
+		return fmt.Errorf("%w: invalid credential ID", ErrInvalidResponse)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.Lookup(c.ID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return ErrDuplicate
+	}
+	ids, err := s.liveIDs(c.Owner.UserID)
+	if err != nil {
+		return err
+	}
+	if len(ids) >= MaxCredentialsPerUser {
+		return ErrTooManyCredentials
+	}
+	if err := s.save(c); err != nil {
+		return err
+	}
+	return s.saveIndex(c.Owner.UserID, append(ids, c.ID))
+}
+
+// Update stores the signature counter and last use of a passkey after a login. A passkey removed
+// in the meantime stays removed.
+func (s *Store) Update(c *Credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.Lookup(c.ID)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return ErrUnknownCredential
+	}
+	return s.save(c)
+}
+
+// Remove deletes the passkey id of userID.
+func (s *Store) Remove(userID, id string) (*Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, err := s.Lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil || c.Owner.UserID != userID {
+		return nil, ErrNotFound
+	}
+	if err := s.storage.Delete(credentialKeyPrefix + id); err != nil {
+		return nil, err
+	}
+	ids, err := s.liveIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	return c, s.saveIndex(userID, ids)
+}
+
+func (s *Store) save(c *Credential) error {
+	value, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return s.storage.Set(credentialKeyPrefix+c.ID, value, 0)
+}
+
+// indexIDs returns the credential IDs recorded for userID.
+func (s *Store) indexIDs(userID string) ([]string, error) {
+	value, err := s.storage.Get(indexKeyPrefix + userID)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var ids []string
+	if err := json.Unmarshal(value, &ids); err != nil {
+		return nil, nil
+	}
+	return ids, nil
+}
+
+// liveIDs returns the index of userID without the passkeys that were removed.
+func (s *Store) liveIDs(userID string) ([]string, error) {
+	ids, err := s.indexIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	live := ids[:0]
+	for _, id := range ids {
+		c, err := s.Lookup(id)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil && c.Owner.UserID == userID {
+			live = append(live, id)
+		}
+	}
+	return live, nil
+}
+
+// saveIndex stores the credential IDs of userID.
+func (s *Store) saveIndex(userID string, ids []string) error {
+	if len(ids) == 0 {
+		return s.storage.Delete(indexKeyPrefix + userID)
+	}
+	value, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return s.storage.Set(indexKeyPrefix+userID, value, 0)
+}
+
+// validID reports whether id is a base64url credential ID of at most maxCredentialID bytes.
+func validID(id string) bool {
+	if id == "" || len(id) > b64.EncodedLen(maxCredentialID) {
+		return false
+	}
+	return strings.Trim(id, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") == ""
+}
+
+// FinishRegistration verifies the response to CreationOptions with challenge and stores the new
+// passkey of owner under name.
+func (rp *RelyingParty) FinishRegistration(challenge string, resp *Response, owner Owner, name string) (*Credential, error) {
+	c, err := rp.Register(challenge, resp, owner, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.store.Add(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// FinishLogin verifies the response to RequestOptions with challenge and returns the passkey
+// used, with its counter updated in the store. With a userID (a step-up), only that user's
+// passkeys are accepted.
+func (rp *RelyingParty) FinishLogin(challenge string, resp *Response, userID string) (*Credential, error) {
+	c, err := rp.store.Lookup(resp.RawID)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil || (userID != "" && c.Owner.UserID != userID) {
+		return nil, ErrUnknownCredential
+	}
+	c, err = rp.Verify(challenge, c, resp)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.store.Update(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,471 @@
+// Package webauthn implements the relying party side of Web Authentication (WebAuthn Level 2)
+// for passkeys: creating registration and login options, and verifying the responses of
+// authenticators. Attestation statements are not verified, as Stargate asks for "none"
+// attestation and trusts the user who registers the passkey rather than its maker.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Authentication method references (RFC 8176) of a passkey login. Passkeys that can be backed
+// up (synced to a cloud keychain) are software-secured keys; the others are bound to the
+// authenticator hardware.
+const (
+	AMRHardwareKey = "hwk"
+	AMRSoftwareKey = "swk"
+)
+
+// User verification requirements (WebAuthn section 5.8.6).
+const (
+	UserVerificationRequired    = "required"
+	UserVerificationPreferred   = "preferred"
+	UserVerificationDiscouraged = "discouraged"
+)
+
+const (
+	// Timeout is how long the browser waits for the user; challenges expire after it.
+	Timeout = 5 * time.Minute
+	// MaxNameLength limits the display name of a passkey.
+	MaxNameLength = 64
+
+	challengeLength  = 32
+	maxCredentialID  = 1023
+	clientDataCreate = "webauthn.create"
+	clientDataGet    = "webauthn.get"
+)
+
+// Authenticator data flags (WebAuthn section 6.1).
+const (
+	flagUserPresent    = 0x01
+	flagUserVerified   = 0x04
+	flagBackupEligible = 0x08
+	flagAttestedData   = 0x40
+)
+
+// ErrInvalidResponse is returned when an authenticator response does not verify. The wrapped
+// message tells which check failed.
+var ErrInvalidResponse = errors.New("invalid passkey response")
+
+var b64 = base64.RawURLEncoding
+
+// Config describes the relying party.
+type Config struct {
+	// RPID is the domain passkeys are scoped to: the auth host or a parent domain of it.
+	RPID string
+	// RPName is shown by the browser when creating a passkey.
+	RPName string
+	// Origins are the page origins ceremonies may run on, e.g. "https://auth.example.com".
+	Origins []string
+	// UserVerification is "required", "preferred" (default) or "discouraged".
+	UserVerification string
+}
+
+// RelyingParty creates ceremony options and verifies responses against its configuration, and
+// keeps the registered passkeys in a Store.
+type RelyingParty struct {
+	cfg      Config
+	rpIDHash [32]byte
+	store    *Store
+	now      func() time.Time
+}
+
+// New validates cfg and returns a relying party keeping passkeys in store.
+func New(cfg Config, store *Store) (*RelyingParty, error) {
+	if cfg.RPID == "" || strings.ContainsAny(cfg.RPID, ":/ ") {
+		return nil, fmt.Errorf("invalid relying party ID %q", cfg.RPID)
+	}
+	if len(cfg.Origins) == 0 {
+		return nil, errors.New("no allowed origins")
+	}
+	for _, origin := range cfg.Origins {
+		if err := checkOrigin(cfg.RPID, origin); err != nil {
+			return nil, err
+		}
+	}
+	switch cfg.UserVerification {
+	case "":
+		cfg.UserVerification = UserVerificationPreferred
+	case UserVerificationRequired, UserVerificationPreferred, UserVerificationDiscouraged:
+	default:
+		return nil, fmt.Errorf("invalid user verification %q", cfg.UserVerification)
+	}
+	if cfg.RPName == "" {
+		cfg.RPName = cfg.RPID
+	}
+	return &RelyingParty{cfg: cfg, rpIDHash: sha256.Sum256([]byte(cfg.RPID)), store: store, now: time.Now}, nil
+}
+
+// checkOrigin reports whether origin is a bare origin on rpID or one of its subdomains. Plain
+// http is only accepted for localhost, as browsers require.
+func checkOrigin(rpID, origin string) error {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return fmt.Errorf("invalid origin %q", origin)
+	}
+	host := u.Hostname()
+	if u.Scheme != "https" && !(u.Scheme == "http" && host == "localhost") {
+		return fmt.Errorf("origin %q must use https", origin)
+	}
+	if host != rpID && !strings.HasSuffix(host, "."+rpID) {
+		return fmt.Errorf("origin %q is not on relying party ID %q", origin, rpID)
+	}
+	return nil
+}
+
+// Store returns the store of registered passkeys.
+func (rp *RelyingParty) Store() *Store {
+	return rp.store
+}
+
+// NewChallenge returns a random challenge, base64url-encoded as in the ceremony options.
+func NewChallenge() (string, error) {
+	b := make([]byte, challengeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b64.EncodeToString(b), nil
+}
+
+// UserHandle returns the WebAuthn user handle of userID. It is a hash, so the user ID is not
+// stored on authenticators in the clear.
+func UserHandle(userID string) string {
+	sum := sha256.Sum256([]byte("stargate passkey user:" + userID))
+	return b64.EncodeToString(sum[:])
+}
+
+// CredentialDescriptor identifies a passkey in allow and exclude lists.
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// CredentialParameter is a key type the relying party accepts.
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// RPEntity names the relying party in creation options.
+type RPEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// UserEntity describes the account a passkey is created for.
+type UserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// AuthenticatorSelection states the requirements on the authenticator.
+type AuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// CreationOptions are the options of navigator.credentials.create(), in the JSON form of
+// PublicKeyCredentialCreationOptions: binary values are base64url strings.
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     RPEntity               `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the options of navigator.credentials.get(), in the JSON form of
+// PublicKeyCredentialRequestOptions.
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CreationOptions returns the options registering a discoverable passkey for owner. The user's
+// existing passkeys are excluded, so an authenticator is not registered twice.
+func (rp *RelyingParty) CreationOptions(challenge string, owner Owner, existing []*Credential) CreationOptions {
+	name := owner.UserID
+	if owner.Email != "" {
+		name = owner.Email
+	}
+	displayName := owner.Name
+	if displayName == "" {
+		displayName = name
+	}
+	params := make([]CredentialParameter, 0, len(Algorithms))
+	for _, alg := range Algorithms {
+		params = append(params, CredentialParameter{Type: "public-key", Alg: alg})
+	}
+	return CreationOptions{
+		Challenge:          challenge,
+		RP:                 RPEntity{ID: rp.cfg.RPID, Name: rp.cfg.RPName},
+		User:               UserEntity{ID: UserHandle(owner.UserID), Name: name, DisplayName: displayName},
+		PubKeyCredParams:   params,
+		Timeout:            Timeout.Milliseconds(),
+		ExcludeCredentials: descriptors(existing),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   rp.cfg.UserVerification,
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions returns the options of a login or step-up. Without allowed credentials the
+// browser offers every passkey it has for the relying party (a discoverable login).
+func (rp *RelyingParty) RequestOptions(challenge string, allowed []*Credential) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          Timeout.Milliseconds(),
+		RPID:             rp.cfg.RPID,
+		AllowCredentials: descriptors(allowed),
+		UserVerification: rp.cfg.UserVerification,
+	}
+}
+
+func descriptors(creds []*Credential) []CredentialDescriptor {
+	list := make([]CredentialDescriptor, 0, len(creds))
+	for _, c := range creds {
+		list = append(list, CredentialDescriptor{Type: "public-key", ID: c.ID, Transports: c.Transports})
+	}
+	return list
+}
+
+// Response is a PublicKeyCredential as serialized by PublicKeyCredential.toJSON(): the result of
+// a registration (attestationObject set) or of a login (authenticatorData and signature set).
+type Response struct {
+	ID       string                `json:"id"`
+	RawID    string                `json:"rawId"`
+	Type     string                `json:"type"`
+	Response AuthenticatorResponse `json:"response"`
+}
+
+// AuthenticatorResponse holds the base64url fields of an attestation or assertion response.
+type AuthenticatorResponse struct {
+	ClientDataJSON    string   `json:"clientDataJSON"`
+	AttestationObject string   `json:"attestationObject,omitempty"`
+	Transports        []string `json:"transports,omitempty"`
+	AuthenticatorData string   `json:"authenticatorData,omitempty"`
+	Signature         string   `json:"signature,omitempty"`
+	UserHandle        string   `json:"userHandle,omitempty"`
+}
+
+// ParseResponse decodes a JSON-serialized PublicKeyCredential.
+func ParseResponse(data []byte) (*Response, error) {
+	var resp Response
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	if resp.Type != "public-key" || resp.ID == "" || resp.RawID != resp.ID {
+		return nil, fmt.Errorf("%w: not a public key credential", ErrInvalidResponse)
+	}
+	return &resp, nil
+}
+
+// clientData is the collected client data (WebAuthn section 5.8.1).
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// verifyClientData decodes clientDataJSON and checks its type, challenge and origin. It returns
+// the raw JSON, whose hash the authenticator signs.
+func (rp *RelyingParty) verifyClientData(encoded, typ, challenge string) ([]byte, error) {
+	raw, err := b64.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client data is not base64url", ErrInvalidResponse)
+	}
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, fmt.Errorf("%w: client data: %v", ErrInvalidResponse, err)
+	}
+	if cd.Type != typ {
+		return nil, fmt.Errorf("%w: client data type %q", ErrInvalidResponse, cd.Type)
+	}
+	if challenge == "" || subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(challenge)) != 1 {
+		return nil, fmt.Errorf("%w: challenge mismatch", ErrInvalidResponse)
+	}
+	if !slices.Contains(rp.cfg.Origins, cd.Origin) || cd.CrossOrigin {
+		return nil, fmt.Errorf("%w: origin %q not allowed", ErrInvalidResponse, cd.Origin)
+	}
+	return raw, nil
+}
+
+// authenticatorData is the parsed authenticator data (WebAuthn section 6.1).
+type authenticatorData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte // COSE_Key, only with attested credential data
+}
+
+// parseAuthenticatorData decodes data and checks the RP ID hash and the user presence and
+// verification flags.
+func (rp *RelyingParty) parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrInvalidResponse)
+	}
+	if subtle.ConstantTimeCompare(data[:32], rp.rpIDHash[:]) != 1 {
+		return nil, fmt.Errorf("%w: RP ID mismatch", ErrInvalidResponse)
+	}
+	ad := &authenticatorData{flags: data[32], signCount: binary.BigEndian.Uint32(data[33:37])}
+	if ad.flags&flagUserPresent == 0 {
+		return nil, fmt.Errorf("%w: user not present", ErrInvalidResponse)
+	}
+	if rp.cfg.UserVerification == UserVerificationRequired && ad.flags&flagUserVerified == 0 {
+		return nil, fmt.Errorf("%w: user not verified", ErrInvalidResponse)
+	}
+	if ad.flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+
+	// Attested credential data: AAGUID (16), credential ID length (2), credential ID, COSE key
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalidResponse)
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLen == 0 || idLen > maxCredentialID || idLen > len(rest) {
+		return nil, fmt.Errorf("%w: invalid credential ID", ErrInvalidResponse)
+	}
+	ad.credentialID, rest = rest[:idLen], rest[idLen:]
+	_, extensions, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: credential public key: %v", ErrInvalidResponse, err)
+	}
+	ad.publicKey = rest[:len(rest)-len(extensions)]
+	return ad, nil
+}
+
+// Register verifies the response to CreationOptions with challenge and returns the new passkey
+// of owner. The passkey is not stored; see FinishRegistration.
+func (rp *RelyingParty) Register(challenge string, resp *Response, owner Owner, name string) (*Credential, error) {
+	if _, err := rp.verifyClientData(resp.Response.ClientDataJSON, clientDataCreate, challenge); err != nil {
+		return nil, err
+	}
+	rawAttestation, err := b64.DecodeString(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: attestation object is not base64url", ErrInvalidResponse)
+	}
+	item, _, err := decodeCBOR(rawAttestation)
+	if err != nil {
+		return nil, fmt.Errorf("%w: attestation object: %v", ErrInvalidResponse, err)
+	}
+	attestation, _ := item.(map[interface{}]interface{})
+	authData, _ := attestation["authData"].([]byte)
+	if format, _ := attestation["fmt"].(string); format == "" || authData == nil {
+		return nil, fmt.Errorf("%w: malformed attestation object", ErrInvalidResponse)
+	}
+
+	ad, err := rp.parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.publicKey == nil {
+		return nil, fmt.Errorf("%w: no attested credential data", ErrInvalidResponse)
+	}
+	if b64.EncodeToString(ad.credentialID) != resp.RawID {
+		return nil, fmt.Errorf("%w: credential ID mismatch", ErrInvalidResponse)
+	}
+	_, alg, err := parseCOSEKey(ad.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := rp.now()
+	return &Credential{
+		ID:             resp.RawID,
+		Name:           strings.TrimSpace(name),
+		Owner:          owner,
+		PublicKey:      bytes.Clone(ad.publicKey),
+		Algorithm:      alg,
+		SignCount:      ad.signCount,
+		BackupEligible: ad.flags&flagBackupEligible != 0,
+		Transports:     resp.Response.Transports,
+		CreatedAt:      now,
+	}, nil
+}
+
+// Verify checks the response to RequestOptions with challenge against the stored passkey cred,
+// and returns cred with the new signature counter and last use time.
+func (rp *RelyingParty) Verify(challenge string, cred *Credential, resp *Response) (*Credential, error) {
+	if resp.RawID != cred.ID {
+		return nil, fmt.Errorf("%w: credential ID mismatch", ErrInvalidResponse)
+	}
+	clientDataJSON, err := rp.verifyClientData(resp.Response.ClientDataJSON, clientDataGet, challenge)
+	if err != nil {
+		return nil, err
+	}
+	authData, err := b64.DecodeString(resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: authenticator data is not base64url", ErrInvalidResponse)
+	}
+	ad, err := rp.parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Response.UserHandle != "" && resp.Response.UserHandle != UserHandle(cred.Owner.UserID) {
+		return nil, fmt.Errorf("%w: user handle mismatch", ErrInvalidResponse)
+	}
+
+	key, alg, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := b64.DecodeString(resp.Response.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature is not base64url", ErrInvalidResponse)
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	if !verifySignature(key, alg, append(bytes.Clone(authData), clientDataHash[:]...), sig) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidResponse)
+	}
+
+	// A counter that does not grow hints at a cloned authenticator. Passkeys that do not count
+	// (synced passkeys always send 0) are exempt.
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return nil, fmt.Errorf("%w: signature counter did not increase", ErrInvalidResponse)
+	}
+
+	updated := *cred
+	updated.SignCount = ad.signCount
+	updated.LastUsedAt = rp.now()
+	return &updated, nil
+}
+
+var relyingParty *RelyingParty
+
+// Init sets the relying party used by the passkey routes; nil disables passkeys.
+func Init(rp *RelyingParty) {
+	relyingParty = rp
+}
+
+// Get returns the relying party, or nil when passkeys are disabled.
+func Get() *RelyingParty {
+	return relyingParty
+}
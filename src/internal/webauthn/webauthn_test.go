@@ -0,0 +1,224 @@
+package webauthn_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/MarvinJWendt/testza"
+
+	"github.com/soulteary/stargate/src/internal/filestore"
+	"github.com/soulteary/stargate/src/internal/webauthn"
+	"github.com/soulteary/stargate/src/internal/webauthn/webauthntest"
+)
+
+const testOrigin = "https://auth.example.com"
+
+var testOwner = webauthn.Owner{UserID: "u-1", Email: "alice@example.com", Name: "Alice", Role: "admin"}
+
+func newTestRP(t *testing.T, uv string) *webauthn.RelyingParty {
+	t.Helper()
+	storage, err := filestore.Open(filepath.Join(t.TempDir(), "passkeys.json"))
+	testza.AssertNoError(t, err)
+	rp, err := webauthn.New(webauthn.Config{
+		RPID:             "example.com",
+		Origins:          []string{testOrigin},
+		UserVerification: uv,
+	}, webauthn.NewStore(storage))
+	testza.AssertNoError(t, err)
+	return rp
+}
+
+// register creates a passkey for testOwner on authenticator a.
+func register(t *testing.T, rp *webauthn.RelyingParty, a *webauthntest.Authenticator) *webauthn.Credential {
+	t.Helper()
+	challenge, err := webauthn.NewChallenge()
+	testza.AssertNoError(t, err)
+	existing, err := rp.Store().List(testOwner.UserID)
+	testza.AssertNoError(t, err)
+	resp, err := a.Create(rp.CreationOptions(challenge, testOwner, existing))
+	testza.AssertNoError(t, err)
+	cred, err := rp.FinishRegistration(challenge, roundTrip(t, resp), testOwner, "Laptop")
+	testza.AssertNoError(t, err)
+	return cred
+}
+
+// roundTrip serializes resp as the browser would and parses it back.
+func roundTrip(t *testing.T, resp *webauthn.Response) *webauthn.Response {
+	t.Helper()
+	data, err := json.Marshal(resp)
+	testza.AssertNoError(t, err)
+	parsed, err := webauthn.ParseResponse(data)
+	testza.AssertNoError(t, err)
+	return parsed
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	for _, alg := range []int{webauthn.AlgES256, webauthn.AlgEdDSA} {
+		rp := newTestRP(t, webauthn.UserVerificationRequired)
+		a := webauthntest.New(testOrigin)
+		a.Algorithm = alg
+
+		cred := register(t, rp, a)
+		testza.AssertEqual(t, alg, cred.Algorithm)
+		testza.AssertEqual(t, "Laptop", cred.Name)
+		testza.AssertEqual(t, webauthn.AMRHardwareKey, cred.AMR())
+
+		// A discoverable login: no allowed credentials
+		challenge, _ := webauthn.NewChallenge()
+		resp, err := a.Get(rp.RequestOptions(challenge, nil))
+		testza.AssertNoError(t, err)
+		used, err := rp.FinishLogin(challenge, roundTrip(t, resp), "")
+		testza.AssertNoError(t, err)
+		testza.AssertEqual(t, testOwner, used.Owner)
+		testza.AssertEqual(t, uint32(1), used.SignCount)
+		testza.AssertFalse(t, used.LastUsedAt.IsZero())
+
+		// The same response cannot be replayed against a new challenge
+		again, _ := webauthn.NewChallenge()
+		_, err = rp.FinishLogin(again, roundTrip(t, resp), "")
+		testza.AssertErrorIs(t, err, webauthn.ErrInvalidResponse)
+	}
+}
+
+func TestSyncedPasskey(t *testing.T) {
+	rp := newTestRP(t, "")
+	a := webauthntest.New(testOrigin)
+	a.Synced = true
+	cred := register(t, rp, a)
+	testza.AssertTrue(t, cred.BackupEligible)
+	testza.AssertEqual(t, webauthn.AMRSoftwareKey, cred.AMR())
+
+	// Synced passkeys keep their counter at 0 on every login
+	for i := 0; i < 2; i++ {
+		challenge, _ := webauthn.NewChallenge()
+		resp, err := a.Get(rp.RequestOptions(challenge, []*webauthn.Credential{cred}))
+		testza.AssertNoError(t, err)
+		_, err = rp.FinishLogin(challenge, resp, testOwner.UserID)
+		testza.AssertNoError(t, err)
+	}
+}
+
+func TestFinishLogin_Rejects(t *testing.T) {
+	rp := newTestRP(t, "")
+	a := webauthntest.New(testOrigin)
+	cred := register(t, rp, a)
+
+	login := func() (string, *webauthn.Response) {
+		challenge, _ := webauthn.NewChallenge()
+		resp, err := a.Get(rp.RequestOptions(challenge, nil))
+		testza.AssertNoError(t, err)
+		return challenge, resp
+	}
+
+	// Step-up only accepts the session user's passkeys
+	challenge, resp := login()
+	_, err := rp.FinishLogin(challenge, resp, "someone-else")
+	testza.AssertErrorIs(t, err, webauthn.ErrUnknownCredential)
+
+	challenge, resp = login()
+	resp.Response.Signature = base64.RawURLEncoding.EncodeToString([]byte("forged"))
+	_, err = rp.FinishLogin(challenge, resp, "")
+	testza.AssertErrorIs(t, err, webauthn.ErrInvalidResponse)
+
+	challenge, resp = login()
+	resp.Response.UserHandle = webauthn.UserHandle("someone-else")
+	_, err = rp.FinishLogin(challenge, resp, "")
+	testza.AssertErrorIs(t, err, webauthn.ErrInvalidResponse)
+
+	// A page on another origin
+	other := webauthntest.New("https://evil.example.net")
+	*other = *a
+	other.Origin = "https://evil.example.net"
+	challenge, _ = webauthn.NewChallenge()
+	resp, err = other.Get(rp.RequestOptions(challenge, nil))
+	testza.AssertNoError(t, err)
+	_, err = rp.FinishLogin(challenge, resp, "")
+	testza.AssertErrorIs(t, err, webauthn.ErrInvalidResponse)
+
+	// A counter that goes backwards hints at a cloned authenticator
+	challenge, resp = login()
+	_, err = rp.FinishLogin(challenge, resp, "")
+	testza.AssertNoError(t, err)
+	stored, err := rp.Store().Lookup(cred.ID)
+	testza.AssertNoError(t, err)
+	stored.SignCount = 1000
+	testza.AssertNoError(t, rp.Store().Update(stored))
+	challenge, resp = login()
+	_, err = rp.FinishLogin(challenge, resp, "")
+	testza.AssertErrorIs(t, err, webauthn.ErrInvalidResponse)
+
+	// Removed passkeys no longer log in
+	_, err = rp.Store().Remove(testOwner.UserID, cred.ID)
+	testza.AssertNoError(t, err)
+	challenge, resp = login()
+	_, err = rp.FinishLogin(challenge, resp, "")
+	testza.AssertErrorIs(t, err, webauthn.ErrUnknownCredential)
+}
+
+func TestRegister_Rejects(t *testing.T) {
+	rp := newTestRP(t, "")
+	a := webauthntest.New(testOrigin)
+
+	challenge, _ := webauthn.NewChallenge()
+	resp, err := a.Create(rp.CreationOptions(challenge, testOwner, nil))
+	testza.AssertNoError(t, err)
+
+	other, _ := webauthn.NewChallenge()
+	_, err = rp.FinishRegistration(other, resp, testOwner, "Laptop")
+	testza.AssertErrorIs(t, err, webauthn.ErrInvalidResponse)
+
+	// A login response is no registration
+	cred := register(t, rp, a)
+	loginChallenge, _ := webauthn.NewChallenge()
+	loginResp, err := a.Get(rp.RequestOptions(loginChallenge, []*webauthn.Credential{cred}))
+	testza.AssertNoError(t, err)
+	_, err = rp.FinishRegistration(loginChallenge, loginResp, testOwner, "Laptop")
+	testza.AssertErrorIs(t, err, webauthn.ErrInvalidResponse)
+
+	// The same authenticator is excluded from registering again
+	challenge, _ = webauthn.NewChallenge()
+	list, err := rp.Store().List(testOwner.UserID)
+	testza.AssertNoError(t, err)
+	testza.AssertEqual(t, 1, len(list))
+	_, err = a.Create(rp.CreationOptions(challenge, testOwner, list))
+	testza.AssertNotNil(t, err)
+
+	// Passkeys are named
+	challenge, _ = webauthn.NewChallenge()
+	resp, err = webauthntest.New(testOrigin).Create(rp.CreationOptions(challenge, testOwner, nil))
+	testza.AssertNoError(t, err)
+	_, err = rp.FinishRegistration(challenge, resp, testOwner, " ")
+	testza.AssertErrorIs(t, err, webauthn.ErrInvalidName)
+}
+
+func TestNew_Config(t *testing.T) {
+	store := webauthn.NewStore(nil)
+	for name, cfg := range map[string]webauthn.Config{
+		"no RP ID":          {Origins: []string{testOrigin}},
+		"RP ID with port":   {RPID: "example.com:443", Origins: []string{testOrigin}},
+		"no origins":        {RPID: "example.com"},
+		"origin off RP ID":  {RPID: "example.com", Origins: []string{"https://example.org"}},
+		"plain http origin": {RPID: "example.com", Origins: []string{"http://auth.example.com"}},
+		"origin with path":  {RPID: "example.com", Origins: []string{testOrigin + "/login"}},
+		"unknown UV":        {RPID: "example.com", Origins: []string{testOrigin}, UserVerification: "always"},
+	} {
+		_, err := webauthn.New(cfg, store)
+		testza.AssertNotNil(t, err, name)
+	}
+
+	_, err := webauthn.New(webauthn.Config{RPID: "localhost", Origins: []string{"http://localhost:8080"}}, store)
+	testza.AssertNoError(t, err)
+}
+
+func TestParseResponse_Invalid(t *testing.T) {
+	for _, data := range []string{
+		"not json",
+		`{"id":"abc","rawId":"abc","type":"password"}`,
+		`{"id":"abc","rawId":"abd","type":"public-key"}`,
+	} {
+		_, err := webauthn.ParseResponse([]byte(data))
+		testza.AssertErrorIs(t, err, webauthn.ErrInvalidResponse, data)
+	}
+}
@@ -0,0 +1,243 @@
+// Package webauthntest provides a software authenticator for tests. It creates passkeys and
+// signs logins like a browser with a platform authenticator, and returns the JSON-serialized
+// PublicKeyCredential the passkey routes expect.
+package webauthntest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/soulteary/stargate/src/internal/webauthn"
+)
+
+var b64 = base64.RawURLEncoding
+
+// Authenticator flags (WebAuthn section 6.1).
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagBackup       = 0x18 // backup eligible and backed up
+	flagAttestedData = 0x40
+)
+
+// credential is a passkey held by the authenticator.
+type credential struct {
+	id         []byte
+	rpID       string
+	userHandle string
+	key        crypto.Signer
+	alg        int
+	counter    uint32
+}
+
+// Authenticator is a software authenticator with user presence and verification always given.
+type Authenticator struct {
+	// Origin is the page origin reported in the client data.
+	Origin string
+	// Synced marks new passkeys as backed up to a cloud keychain; their counter stays 0.
+	Synced bool
+	// Algorithm is the COSE algorithm of new passkeys: webauthn.AlgES256 (default) or AlgEdDSA.
+	Algorithm int
+
+	credentials []*credential
+}
+
+// New returns an authenticator for pages on origin.
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, Algorithm: webauthn.AlgES256}
+}
+
+// Create answers navigator.credentials.create() with options.
+func (a *Authenticator) Create(options webauthn.CreationOptions) (*webauthn.Response, error) {
+	for _, excluded := range options.ExcludeCredentials {
+		if a.find(options.RP.ID, excluded.ID) != nil {
+			return nil, errors.New("authenticator already registered")
+		}
+	}
+	c := &credential{id: make([]byte, 16), rpID: options.RP.ID, userHandle: options.User.ID, alg: a.Algorithm}
+	if _, err := rand.Read(c.id); err != nil {
+		return nil, err
+	}
+	var (
+		coseKey []byte
+		err     error
+	)
+	switch a.Algorithm {
+	case webauthn.AlgEdDSA:
+		var pub ed25519.PublicKey
+		pub, c.key, err = ed25519.GenerateKey(rand.Reader)
+		coseKey = encodeCBOR(map[interface{}]interface{}{1: 1, 3: webauthn.AlgEdDSA, -1: 6, -2: []byte(pub)})
+	default:
+		var key *ecdsa.PrivateKey
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err == nil {
+			var point []byte
+			if point, err = key.PublicKey.Bytes(); err == nil {
+				coseKey = encodeCBOR(map[interface{}]interface{}{1: 2, 3: webauthn.AlgES256, -1: 1, -2: point[1:33], -3: point[33:]})
+			}
+		}
+		c.key = key
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	authData := a.authenticatorData(c.rpID, 0, flagAttestedData)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(c.id)))
+	authData = append(authData, c.id...)
+	authData = append(authData, coseKey...)
+	attestation := encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": authData,
+	})
+	clientData, err := a.clientData("webauthn.create", options.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	a.credentials = append(a.credentials, c)
+
+	id := b64.EncodeToString(c.id)
+	return &webauthn.Response{ID: id, RawID: id, Type: "public-key", Response: webauthn.AuthenticatorResponse{
+		ClientDataJSON:    b64.EncodeToString(clientData),
+		AttestationObject: b64.EncodeToString(attestation),
+		Transports:        []string{"internal"},
+	}}, nil
+}
+
+// Get answers navigator.credentials.get() with options, using the first passkey allowed.
+func (a *Authenticator) Get(options webauthn.RequestOptions) (*webauthn.Response, error) {
+	var c *credential
+	if len(options.AllowCredentials) == 0 {
+		c = a.find(options.RPID, "")
+	}
+	for _, allowed := range options.AllowCredentials {
+		if c = a.find(options.RPID, allowed.ID); c != nil {
+			break
+		}
+	}
+	if c == nil {
+		return nil, errors.New("no passkey for this relying party")
+	}
+	if !a.Synced {
+		c.counter++
+	}
+
+	authData := a.authenticatorData(c.rpID, c.counter, 0)
+	clientData, err := a.clientData("webauthn.get", options.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientData)
+	message := append(bytes.Clone(authData), clientDataHash[:]...)
+	var sig []byte
+	if c.alg == webauthn.AlgEdDSA {
+		sig, err = c.key.Sign(rand.Reader, message, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(message)
+		sig, err = c.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	id := b64.EncodeToString(c.id)
+	return &webauthn.Response{ID: id, RawID: id, Type: "public-key", Response: webauthn.AuthenticatorResponse{
+		ClientDataJSON:    b64.EncodeToString(clientData),
+		AuthenticatorData: b64.EncodeToString(authData),
+		Signature:         b64.EncodeToString(sig),
+		UserHandle:        c.userHandle,
+	}}, nil
+}
+
+// find returns the passkey with base64url ID id for rpID, or the first one for rpID when id is "".
+func (a *Authenticator) find(rpID, id string) *credential {
+	for _, c := range a.credentials {
+		if c.rpID == rpID && (id == "" || b64.EncodeToString(c.id) == id) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (a *Authenticator) authenticatorData(rpID string, counter uint32, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags |= flagUserPresent | flagUserVerified
+	if a.Synced {
+		flags |= flagBackup
+	}
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, counter)
+}
+
+func (a *Authenticator) clientData(typ, challenge string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"type":        typ,
+		"challenge":   challenge,
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+}
+
+// encodeCBOR encodes integers, byte and text strings and maps in the CTAP2 canonical form.
+func encodeCBOR(v interface{}) []byte {
+	switch v := v.(type) {
+	case int:
+		if v >= 0 {
+			return cborHead(0, uint64(v))
+		}
+		return cborHead(1, uint64(-1-v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case map[interface{}]interface{}:
+		keys := make([][]byte, 0, len(v))
+		values := make(map[string][]byte, len(v))
+		for key, value := range v {
+			k := encodeCBOR(key)
+			keys = append(keys, k)
+			values[string(k)] = encodeCBOR(value)
+		}
+		// Canonical order: shorter keys first, then bytewise
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return bytes.Compare(keys[i], keys[j]) < 0
+		})
+		out := cborHead(5, uint64(len(v)))
+		for _, k := range keys {
+			out = append(append(out, k...), values[string(k)]...)
+		}
+		return out
+	default:
+		panic("webauthntest: cannot encode value")
+	}
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+	}
+}